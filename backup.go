@@ -8,8 +8,8 @@ import (
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/pkg/errors"
 	"io"
-	"io/ioutil"
 	"log"
+	"path"
 	"sort"
 	"strings"
 )
@@ -33,6 +33,8 @@ type S3ReaderMaker struct {
 	Backup     *Backup
 	Key        *string
 	FileFormat string
+	// Partition is verified while the object is read, nil skips verification
+	Partition *PartitionDescription
 }
 
 // Format of a file
@@ -43,16 +45,24 @@ func (s *S3ReaderMaker) Path() string { return *s.Key }
 
 // Reader creates a new S3 reader for each S3 object.
 func (s *S3ReaderMaker) Reader() (io.ReadCloser, error) {
-	input := &s3.GetObjectInput{
-		Bucket: s.Backup.Prefix.Bucket,
-		Key:    s.Key,
+	download := func() (io.ReadCloser, error) {
+		return downloadObject(s.Backup.Prefix.Svc, s.Backup.Prefix.Bucket, *s.Key)
+	}
+	var rdr io.ReadCloser
+	var err error
+	if s.Partition != nil {
+		// Partitions described in the sentinel have known checksum and can be served from download cache
+		rdr, err = openCachedObject(*s.Key, s.Partition.Sha256, s.Partition.Size, download)
+	} else {
+		rdr, err = download()
 	}
-
-	rdr, err := s.Backup.Prefix.Svc.GetObject(input)
 	if err != nil {
 		return nil, errors.Wrap(err, "S3 Reader: s3.GetObject failed")
 	}
-	return rdr.Body, nil
+	if s.Partition != nil {
+		return newVerifyingReader(rdr, *s.Key, *s.Partition), nil
+	}
+	return rdr, nil
 
 }
 
@@ -98,7 +108,7 @@ func (b *Backup) GetBackups() ([]BackupTime, error) {
 
 	var backups = make([]*s3.Object, 0)
 
-	err := b.Prefix.Svc.ListObjectsV2Pages(objects, func(files *s3.ListObjectsV2Output, lastPage bool) bool {
+	err := listObjectsV2Pages(b.Prefix.Svc, objects, func(files *s3.ListObjectsV2Output, lastPage bool) bool {
 		backups = append(backups, files.Contents...)
 		return true
 	})
@@ -144,19 +154,19 @@ func stripWalFileName(key string) string {
 	name = strings.SplitN(name, "_D_", 2)[0]
 
 	if strings.HasPrefix(name, backupNamePrefix) {
-		return name[len(backupNamePrefix):]
+		name = name[len(backupNamePrefix):]
+		// WAL-E and WAL-G backup names contain offset in the segment after its name
+		if len(name) > 24 && (name[24] == '_' || name[24] == '.') {
+			name = name[:24]
+		}
+		return name
 	}
 	return ""
 }
 
 // CheckExistence checks that the specified backup exists.
 func (b *Backup) CheckExistence() (bool, error) {
-	js := &s3.HeadObjectInput{
-		Bucket: b.Prefix.Bucket,
-		Key:    b.Js,
-	}
-
-	_, err := b.Prefix.Svc.HeadObject(js)
+	_, err := headObject(b.Prefix.Svc, b.Prefix.Bucket, b.Js)
 	if err != nil {
 		if awsErr, ok := err.(awserr.Error); ok {
 			switch awsErr.Code() {
@@ -180,7 +190,7 @@ func (b *Backup) GetKeys() ([]string, error) {
 
 	result := make([]string, 0)
 
-	err := b.Prefix.Svc.ListObjectsV2Pages(objects, func(files *s3.ListObjectsV2Output, lastPage bool) bool {
+	err := listObjectsV2Pages(b.Prefix.Svc, objects, func(files *s3.ListObjectsV2Output, lastPage bool) bool {
 
 		arr := make([]string, len(files.Contents))
 
@@ -201,28 +211,47 @@ func (b *Backup) GetKeys() ([]string, error) {
 
 // GetWals returns all WAL file keys less then key provided
 func (b *Backup) GetWals(before string) ([]*s3.ObjectIdentifier, error) {
-	objects := &s3.ListObjectsV2Input{
-		Bucket: b.Prefix.Bucket,
-		Prefix: aws.String(sanitizePath(*b.Path)),
-	}
-
 	arr := make([]*s3.ObjectIdentifier, 0)
+	err := b.ListWals(before, func(page []*s3.ObjectIdentifier) error {
+		arr = append(arr, page...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return arr, nil
+}
 
-	err := b.Prefix.Svc.ListObjectsV2Pages(objects, func(files *s3.ListObjectsV2Output, lastPage bool) bool {
+// ListWals passes WAL file keys less then key provided to handler page by page as they are listed,
+// so archives of millions of WAL files are not held in memory. Listing stops at the first handler error.
+func (b *Backup) ListWals(before string, handler func(page []*s3.ObjectIdentifier) error) error {
+	var handlerErr error
+	err := listWalObjects(b.Prefix, sanitizePath(*b.Path), func(files *s3.ListObjectsV2Output, lastPage bool) bool {
+		page := make([]*s3.ObjectIdentifier, 0, len(files.Contents))
 		for _, ob := range files.Contents {
 			key := *ob.Key
-			if stripWalName(key) < before {
-				arr = append(arr, &s3.ObjectIdentifier{Key: aws.String(key)})
+			if isTimelineHistoryName(strings.TrimSuffix(path.Base(key), path.Ext(key))) {
+				// Timeline history is needed to recover to any later timeline, it is never deleted
+				continue
+			}
+			name := stripWalName(key)
+			if bundle, ok := parseWalBundleKey(key); ok {
+				// Bundle is deleted only when all its segments are
+				name = bundle.Last.Name()
+			}
+			if name < before {
+				page = append(page, &s3.ObjectIdentifier{Key: aws.String(key)})
 			}
 		}
-		return true
+		if len(page) > 0 {
+			handlerErr = handler(page)
+		}
+		return handlerErr == nil
 	})
-
-	if err != nil {
-		return nil, errors.Wrap(err, "GetKeys: s3.ListObjectsV2 failed")
+	if handlerErr != nil {
+		return handlerErr
 	}
-
-	return arr, nil
+	return errors.Wrap(err, "ListWals: s3.ListObjectsV2 failed")
 }
 
 func stripWalName(key string) string {
@@ -240,12 +269,7 @@ type Archive struct {
 
 // CheckExistence checks that the specified WAL file exists.
 func (a *Archive) CheckExistence() (bool, error) {
-	arch := &s3.HeadObjectInput{
-		Bucket: a.Prefix.Bucket,
-		Key:    a.Archive,
-	}
-
-	_, err := a.Prefix.Svc.HeadObject(arch)
+	_, err := headObject(a.Prefix.Svc, a.Prefix.Bucket, a.Archive)
 	if err != nil {
 		if awsErr, ok := err.(awserr.Error); ok {
 			switch awsErr.Code() {
@@ -261,12 +285,7 @@ func (a *Archive) CheckExistence() (bool, error) {
 
 // GetETag aquires ETag of the object from S3
 func (a *Archive) GetETag() (*string, error) {
-	arch := &s3.HeadObjectInput{
-		Bucket: a.Prefix.Bucket,
-		Key:    a.Archive,
-	}
-
-	h, err := a.Prefix.Svc.HeadObject(arch)
+	h, err := headObject(a.Prefix.Svc, a.Prefix.Bucket, a.Archive)
 	if err != nil {
 		return nil, err
 	}
@@ -276,50 +295,45 @@ func (a *Archive) GetETag() (*string, error) {
 
 // GetArchive downloads the specified archive from S3.
 func (a *Archive) GetArchive() (io.ReadCloser, error) {
-	input := &s3.GetObjectInput{
-		Bucket: a.Prefix.Bucket,
-		Key:    a.Archive,
-	}
-
-	archive, err := a.Prefix.Svc.GetObject(input)
+	archive, err := downloadObject(a.Prefix.Svc, a.Prefix.Bucket, *a.Archive)
 	if err != nil {
 		return nil, errors.Wrap(err, "GetArchive: s3.GetObject failed")
 	}
 
-	return archive.Body, nil
+	return archive, nil
 }
 
 // SentinelSuffix is a suffix of backup finish sentinel file
 const SentinelSuffix = "_backup_stop_sentinel.json"
 
-func fetchSentinel(backupName string, bk *Backup, pre *Prefix) (dto S3TarBallSentinelDto) {
-	latestSentinel := backupName + SentinelSuffix
-	previousBackupReader := S3ReaderMaker{
-		Backup:     bk,
-		Key:        aws.String(*pre.Server + "/basebackups_005/" + latestSentinel),
-		FileFormat: CheckType(latestSentinel),
-	}
-	prevBackup, err := previousBackupReader.Reader()
+func fetchSentinel(backupName string, bk *Backup, pre *Prefix) S3TarBallSentinelDto {
+	dto, err := readSentinel(backupName, bk, pre)
 	if err != nil {
 		log.Fatalf("%+v\n", err)
 	}
-	sentinelDto, err := ioutil.ReadAll(prevBackup)
+	return dto
+}
+
+// readSentinel is fetchSentinel returning errors
+func readSentinel(backupName string, bk *Backup, pre *Prefix) (dto S3TarBallSentinelDto, err error) {
+	sentinelDto, err := readSentinelObject(pre, *GetBackupPath(pre)+backupName+SentinelSuffix)
 	if err != nil {
-		log.Fatalf("%+v\n", err)
+		return dto, errors.Wrap(err, "readSentinel: unable to read sentinel")
 	}
 
 	err = json.Unmarshal(sentinelDto, &dto)
 	if err != nil {
-		log.Fatalf("%+v\n", err)
+		return dto, errors.Wrapf(err, "readSentinel: unable to parse sentinel of %s", backupName)
+	}
+	if dto.LSN == nil && isWalEBackup(backupName) {
+		err = applyWalESentinel(backupName, sentinelDto, &dto)
 	}
-	return
+	return dto, err
 }
 
 // GetBackupPath gets path for basebackup in a bucket
 func GetBackupPath(prefix *Prefix) *string {
-	path := *prefix.Server + "/basebackups_005/"
-	server := sanitizePath(path)
-	return aws.String(server)
+	return aws.String(backupFolderPath(*prefix.Server))
 }
 
 func sanitizePath(path string) string {
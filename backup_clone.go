@@ -0,0 +1,170 @@
+package walg
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// BackupCloneUsage is a text message explaining how to use backup-clone
+var BackupCloneUsage = "usage:\twal-g backup-clone cache_directory clone_directory [backup_name] [--hard-links]" + `
+Materializes a clone of the backup restored into cache_directory, e.g. for many short-lived test instances
+from one fetched backup. With backup_name the cache is restored or refreshed first as backup-fetch
+--delta-restore does. The cache must be unchanged since it was restored. Files are cloned by reflinks
+(copy-on-write, Btrfs and XFS on Linux) and copied where reflinks are not supported.
+Options:
+	--hard-links   hard link files of the clone to the cache instead, only for clones nothing writes to:
+	               PostgreSQL changes files in place, so a started clone changes the cache and other clones
+`
+
+// ErrCloneCacheChanged happens when files of clone cache were changed since restore, e.g. through hard links
+var ErrCloneCacheChanged = errors.New("clone cache is changed since restore")
+
+func printBackupCloneUsageAndFail() {
+	log.Fatal(BackupCloneUsage)
+}
+
+// HandleBackupClone is invoked to perform wal-g backup-clone
+func HandleBackupClone(pre *Prefix, args []string) {
+	hardLinks := false
+	params := make([]string, 0, len(args))
+	for _, arg := range args {
+		if arg == "--hard-links" {
+			hardLinks = true
+			continue
+		}
+		params = append(params, arg)
+	}
+	if len(params) != 3 && len(params) != 4 {
+		printBackupCloneUsageAndFail()
+	}
+	if hardLinks && runtime.GOOS == "windows" {
+		log.Fatal("--hard-links is not supported on Windows")
+	}
+	cacheDir, cloneDir := ResolveSymlink(params[1]), params[2]
+
+	if len(params) == 4 {
+		restoreDeltaOnto = true
+		HandleBackupFetch(params[3], pre, cacheDir, false)
+	}
+	if err := CloneRestoredBackup(cacheDir, cloneDir, hardLinks); err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+}
+
+// CloneRestoredBackup materializes files of the backup restored into cache directory with --delta-restore
+// in clone directory, which must be empty or absent
+func CloneRestoredBackup(cacheDir string, cloneDir string, hardLinks bool) error {
+	state, err := readRestoreState(cacheDir)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		return errors.Errorf("CloneRestoredBackup: %s was not restored by backup-clone or backup-fetch --delta-restore", cacheDir)
+	}
+	names := make([]string, 0, len(state.Files))
+	for name := range state.Files {
+		names = append(names, name)
+	}
+	if changed := findChangedFiles(state, names); len(changed) > 0 {
+		examples := changed[:min(len(changed), 10)]
+		return errors.Wrapf(ErrCloneCacheChanged, "%d files changed, e.g. %s; restore %s from scratch", len(changed), strings.Join(examples, ", "), cacheDir)
+	}
+	if err = os.MkdirAll(cloneDir, 0700); err != nil {
+		return errors.Wrapf(err, "CloneRestoredBackup: unable to create %s", cloneDir)
+	}
+	if entries, err := ioutil.ReadDir(cloneDir); err != nil || len(entries) > 0 {
+		return errors.Errorf("CloneRestoredBackup: clone directory %s must be empty", cloneDir)
+	}
+
+	stats := make(map[string]int)
+	err = filepath.Walk(cacheDir, func(location string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(cacheDir, location)
+		if err != nil || name == RestoreStateFile {
+			return err
+		}
+		target := filepath.Join(cloneDir, name)
+		switch {
+		case info.IsDir():
+			if err = os.MkdirAll(target, 0700); err != nil {
+				return err
+			}
+			return os.Chmod(target, info.Mode().Perm())
+		case info.Mode()&os.ModeSymlink != 0:
+			if filepath.Dir(filepath.ToSlash(name)) == "pg_tblspc" {
+				return errors.Errorf("tablespace %s is outside of cache, it can not be cloned", name)
+			}
+			linkname, err := os.Readlink(location)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(linkname, target)
+		case !info.Mode().IsRegular():
+			return nil
+		}
+		method, err := cloneFile(location, target, info, hardLinks)
+		stats[method]++
+		return err
+	})
+	if err != nil {
+		return errors.Wrapf(err, "CloneRestoredBackup: unable to clone %s", cacheDir)
+	}
+	fmt.Printf("%s is cloned from %s into %s: %d files reflinked, %d copied, %d hard linked\n",
+		state.Backup, cacheDir, cloneDir, stats["reflinked"], stats["copied"], stats["hard linked"])
+	return nil
+}
+
+// cloneFile hard links, reflinks or copies the file, the way it was cloned is returned
+func cloneFile(source string, destination string, info os.FileInfo, hardLinks bool) (string, error) {
+	if hardLinks {
+		return "hard linked", os.Link(source, destination)
+	}
+	method := "reflinked"
+	if err := reflinkFile(source, destination); err != nil {
+		method = "copied"
+		if err = copyFile(source, destination); err != nil {
+			return method, err
+		}
+	}
+	if err := os.Chmod(destination, info.Mode().Perm()); err != nil {
+		return method, err
+	}
+	return method, os.Chtimes(destination, info.ModTime(), info.ModTime())
+}
+
+// breakHardLink replaces file shared with clones by its copy, so changing it does not change the clones
+func breakHardLink(location string) error {
+	info, err := os.Lstat(location)
+	if err != nil || hardLinkCount(info) < 2 {
+		return nil
+	}
+	if err = copyFile(location, location+".walg-cow"); err == nil {
+		err = os.Chmod(location+".walg-cow", info.Mode().Perm())
+	}
+	if err == nil {
+		err = os.Rename(location+".walg-cow", location)
+	}
+	if err != nil {
+		os.Remove(location + ".walg-cow")
+		return errors.Wrapf(err, "breakHardLink: unable to copy %s", location)
+	}
+	return nil
+}
+
+// unlinkHardLink removes file shared with clones before it is written anew, clones keep the old content
+func unlinkHardLink(location string) error {
+	info, err := os.Lstat(location)
+	if err != nil || hardLinkCount(info) < 2 {
+		return nil
+	}
+	return errors.Wrapf(os.Remove(location), "unlinkHardLink: unable to remove %s", location)
+}
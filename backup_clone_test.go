@@ -0,0 +1,98 @@
+package walg
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/pkg/errors"
+)
+
+func TestCloneRestoredBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walg-backup-clone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cacheDir := filepath.Join(dir, "cache")
+	if err = os.MkdirAll(filepath.Join(cacheDir, "base", "1"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(cacheDir, "base", "1", "1"), []byte("relation"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	base := "base_000000010000000000000002"
+	svc := &backupChainS3{sentinels: map[string]string{
+		"server/basebackups_005/" + base + SentinelSuffix: `{"Partitions":{"part_001.tar.lz4":{"Size":30,"Sha256":"aa"}}}`,
+	}}
+	pre := &Prefix{Svc: svc, Bucket: aws.String("bucket"), Server: aws.String("server")}
+	if err = writeRestoreState(pre, cacheDir, base); err != nil {
+		t.Fatal(err)
+	}
+
+	copied := filepath.Join(dir, "copy")
+	if err = CloneRestoredBackup(cacheDir, copied, false); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := ioutil.ReadFile(filepath.Join(copied, "base", "1", "1")); err != nil || string(content) != "relation" {
+		t.Fatalf("file is not cloned: %s %v", content, err)
+	}
+	if _, err = os.Stat(filepath.Join(copied, RestoreStateFile)); !os.IsNotExist(err) {
+		t.Fatal("restore state is cloned")
+	}
+	if err = CloneRestoredBackup(cacheDir, copied, false); err == nil {
+		t.Fatal("backup is cloned into non-empty directory")
+	}
+
+	linked := filepath.Join(dir, "link")
+	if err = CloneRestoredBackup(cacheDir, linked, true); err != nil {
+		t.Fatal(err)
+	}
+	location := filepath.Join(cacheDir, "base", "1", "1")
+	info, err := os.Stat(location)
+	if err != nil || hardLinkCount(info) != 2 {
+		t.Fatalf("file is not hard linked: %v", err)
+	}
+	// Cache is changed through the link and can not be cloned any more
+	if err = ioutil.WriteFile(filepath.Join(linked, "base", "1", "1"), []byte("changed"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = CloneRestoredBackup(cacheDir, filepath.Join(dir, "another"), false); errors.Cause(err) != ErrCloneCacheChanged {
+		t.Fatalf("changed cache is cloned: %v", err)
+	}
+
+	if err = breakHardLink(location); err != nil {
+		t.Fatal(err)
+	}
+	if info, err = os.Stat(location); err != nil || hardLinkCount(info) != 1 {
+		t.Fatalf("hard link is not broken: %v", err)
+	}
+
+	// Refreshing the cache writes files sent in full anew, hard linked clones keep their content
+	if err = os.Remove(filepath.Join(cacheDir, RestoreStateFile)); err != nil {
+		t.Fatal(err)
+	}
+	if err = writeRestoreState(pre, cacheDir, base); err != nil {
+		t.Fatal(err)
+	}
+	frozen := filepath.Join(dir, "frozen")
+	if err = CloneRestoredBackup(cacheDir, frozen, true); err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("refreshed")
+	interpreter := &FileTarInterpreter{NewDir: cacheDir, IncrementalBaseDir: cacheDir}
+	header := &tar.Header{Name: "base/1/1", Typeflag: tar.TypeReg, Mode: 0600, Size: int64(len(content))}
+	if err = interpreter.Interpret(bytes.NewReader(content), header); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := ioutil.ReadFile(filepath.Join(frozen, "base", "1", "1")); err != nil || string(content) != "changed" {
+		t.Fatalf("hard linked clone is changed by refresh: %s %v", content, err)
+	}
+	if content, err := ioutil.ReadFile(location); err != nil || string(content) != "refreshed" {
+		t.Fatalf("cache is not refreshed: %s %v", content, err)
+	}
+}
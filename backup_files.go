@@ -0,0 +1,281 @@
+package walg
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/pkg/errors"
+)
+
+// ErrBackupFileNotFound happens when no partition of the backup holds requested file
+var ErrBackupFileNotFound = errors.New("file is not found in the backup")
+
+// backupFiles finds single files in partitions of a backup without extracting the whole backup. Partitions are
+// decoded in order until the file is found, partition of every member passed on the way is remembered, so later
+// lookups decode one partition only.
+type backupFiles struct {
+	mutex      sync.Mutex
+	partitions []ReaderMaker
+	scanned    []bool
+	members    map[string]backupMember
+}
+
+// backupMember is a tar header of backup file and the index of partition holding it
+type backupMember struct {
+	partition int
+	header    tar.Header
+}
+
+func newBackupFiles(partitions []ReaderMaker) *backupFiles {
+	return &backupFiles{
+		partitions: partitions,
+		scanned:    make([]bool, len(partitions)),
+		members:    make(map[string]backupMember),
+	}
+}
+
+// getBackupPartitions returns readers of PGDATA partitions of the backup, pg_control partition included
+func getBackupPartitions(bk *Backup) ([]ReaderMaker, error) {
+	keys, err := bk.GetKeys()
+	if err != nil {
+		return nil, err
+	}
+	partitions := make([]ReaderMaker, 0, len(keys))
+	for _, key := range skipMigratedPartitions(keys) {
+		if path.Base(key) == ConfigFilesPartition {
+			continue
+		}
+		partitions = append(partitions, &S3ReaderMaker{
+			Backup:     bk,
+			Key:        aws.String(key),
+			FileFormat: CheckType(key),
+		})
+	}
+	return partitions, nil
+}
+
+// normalizeMemberName turns tar member name or sentinel file name into path relative to PGDATA
+func normalizeMemberName(name string) string {
+	return strings.Trim(path.Clean("/"+name), "/")
+}
+
+// locate remembers partitions of files recorded in backup manifest, so they are found without scanning
+func (files *backupFiles) locate(fileList BackupFileList) {
+	files.mutex.Lock()
+	defer files.mutex.Unlock()
+	numbers := make(map[int]int, len(files.partitions))
+	for i, partition := range files.partitions {
+		if strings.HasPrefix(path.Base(partition.Path()), "part_") {
+			numbers[partitionNumber(partition.Path())] = i
+		}
+	}
+	for name, description := range fileList {
+		if i, ok := numbers[description.Partition]; ok && description.Partition != 0 {
+			files.members[normalizeMemberName(name)] = backupMember{partition: i}
+		}
+	}
+}
+
+// extract passes content of the file to write and returns its tar header
+func (files *backupFiles) extract(name string, write func(io.Reader, *tar.Header) error) (*tar.Header, error) {
+	name = normalizeMemberName(name)
+	files.mutex.Lock()
+	defer files.mutex.Unlock()
+
+	if member, ok := files.members[name]; ok {
+		found, err := files.scanPartition(member.partition, name, write)
+		if err != nil || found != nil {
+			return found, err
+		}
+	}
+	for i := range files.partitions {
+		if files.scanned[i] {
+			continue
+		}
+		found, err := files.scanPartition(i, name, write)
+		if err != nil || found != nil {
+			return found, err
+		}
+	}
+	return nil, errors.Wrapf(ErrBackupFileNotFound, "backupFiles: %s", name)
+}
+
+// scanAll remembers members of all partitions, e.g. when backup sentinel has no file list
+func (files *backupFiles) scanAll() (map[string]tar.Header, error) {
+	files.mutex.Lock()
+	defer files.mutex.Unlock()
+	for i := range files.partitions {
+		if files.scanned[i] {
+			continue
+		}
+		if _, err := files.scanPartition(i, "", nil); err != nil {
+			return nil, err
+		}
+	}
+	headers := make(map[string]tar.Header, len(files.members))
+	for name, member := range files.members {
+		headers[name] = member.header
+	}
+	return headers, nil
+}
+
+// scanPartition decodes partition remembering its members until the file with the name is passed to write.
+// Empty name scans the whole partition.
+func (files *backupFiles) scanPartition(partition int, name string, write func(io.Reader, *tar.Header) error) (*tar.Header, error) {
+	interpreter := &memberTarInterpreter{files: files, partition: partition, name: name, write: write}
+	err := ExtractAll(interpreter, []ReaderMaker{files.partitions[partition]})
+	if interpreter.found != nil {
+		// Decoding of the rest of partition is aborted on purpose
+		return interpreter.found, interpreter.err
+	}
+	if err != nil {
+		return nil, err
+	}
+	files.scanned[partition] = true
+	return nil, nil
+}
+
+// errMemberExtracted stops decoding of partition once requested member is extracted
+var errMemberExtracted = errors.New("member is extracted")
+
+// memberTarInterpreter remembers headers of partition members and passes requested member to write
+type memberTarInterpreter struct {
+	files     *backupFiles
+	partition int
+	name      string
+	write     func(io.Reader, *tar.Header) error
+	found     *tar.Header
+	err       error
+}
+
+// Interpret is called for every member of the partition
+func (ti *memberTarInterpreter) Interpret(tr io.Reader, hdr *tar.Header) error {
+	name := normalizeMemberName(hdr.Name)
+	ti.files.members[name] = backupMember{partition: ti.partition, header: *hdr}
+	if ti.name == "" || name != ti.name {
+		return nil
+	}
+	found := *hdr
+	ti.found = &found
+	ti.err = ti.write(tr, hdr)
+	return errMemberExtracted
+}
+
+// FetchBackupFiles extracts only requested files of the backup into directory, keeping their paths relative to
+// PGDATA. Directories are expanded to all files under them. Delta backups take unchanged files and bases of
+// incremented files from their base backups.
+func FetchBackupFiles(pre *Prefix, backupName string, dirArc string, names []string) error {
+	bk, err := findBackup(backupName, pre)
+	if err != nil {
+		return err
+	}
+	sentinel, err := readSentinel(*bk.Name, bk, pre)
+	if err != nil {
+		return err
+	}
+	return fetchBackupFiles(pre, bk, sentinel, dirArc, expandBackupFileNames(sentinel.Files, names))
+}
+
+func fetchBackupFiles(pre *Prefix, bk *Backup, sentinel S3TarBallSentinelDto, dirArc string, names []string) error {
+	manifest := make(map[string]BackupFileDescription, len(sentinel.Files))
+	for name, description := range sentinel.Files {
+		manifest[normalizeMemberName(name)] = description
+	}
+
+	fromBase := make([]string, 0)
+	for _, name := range names {
+		if description := manifest[name]; sentinel.IsIncremental() && (description.IsSkipped || description.IsIncremented) {
+			fromBase = append(fromBase, name)
+		}
+	}
+	if len(fromBase) > 0 {
+		base, err := findBackup(*sentinel.IncrementFrom, pre)
+		if err != nil {
+			return err
+		}
+		baseSentinel, err := readSentinel(*base.Name, base, pre)
+		if err != nil {
+			return err
+		}
+		if err = fetchBackupFiles(pre, base, baseSentinel, dirArc, fromBase); err != nil {
+			return err
+		}
+	}
+
+	partitions, err := getBackupPartitions(bk)
+	if err != nil {
+		return err
+	}
+	files := newBackupFiles(partitions)
+	files.locate(sentinel.Files)
+	for _, name := range names {
+		description := manifest[name]
+		if sentinel.IsIncremental() && description.IsSkipped {
+			continue
+		}
+		targetPath := filepath.Join(dirArc, filepath.FromSlash(name))
+		_, err = files.extract(name, func(r io.Reader, hdr *tar.Header) error {
+			if sentinel.IsIncremental() && description.IsIncremented {
+				return ApplyFileIncrement(targetPath, r)
+			}
+			return extractBackupFile(targetPath, r, hdr, description.SparseHoles)
+		})
+		if err != nil {
+			return errors.Wrapf(err, "FetchBackupFiles: unable to fetch %s from %s", name, *bk.Name)
+		}
+		infoln(name)
+	}
+	return nil
+}
+
+// expandBackupFileNames replaces directories with files of the manifest under them. Names missing in the manifest
+// are kept, backups without manifest are scanned for them.
+func expandBackupFileNames(fileList BackupFileList, names []string) []string {
+	unique := make(map[string]bool)
+	for _, name := range names {
+		name = normalizeMemberName(name)
+		expanded := false
+		for file := range fileList {
+			file = normalizeMemberName(file)
+			if file == name || name == "" || strings.HasPrefix(file, name+"/") {
+				unique[file] = true
+				expanded = true
+			}
+		}
+		if !expanded {
+			unique[name] = true
+		}
+	}
+	result := make([]string, 0, len(unique))
+	for name := range unique {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// extractBackupFile writes file of the backup recreating its holes
+func extractBackupFile(targetPath string, r io.Reader, hdr *tar.Header, holes []FileHole) error {
+	if err := os.MkdirAll(filepath.Dir(targetPath), 0700); err != nil {
+		return errors.Wrapf(err, "extractBackupFile: unable to create directory of %s", targetPath)
+	}
+	f, err := os.OpenFile(targetPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, os.FileMode(hdr.Mode)&os.ModePerm)
+	if err != nil {
+		return errors.Wrapf(err, "extractBackupFile: unable to create %s", targetPath)
+	}
+	defer f.Close()
+	if err = writeSparseFile(f, r, holes); err != nil {
+		return err
+	}
+	if err = syncExtractedFile(f); err != nil {
+		return errors.Wrapf(err, "extractBackupFile: fsync of %s failed", targetPath)
+	}
+	return errors.Wrapf(f.Close(), "extractBackupFile: unable to close %s", targetPath)
+}
@@ -0,0 +1,47 @@
+package walg
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestExpandBackupFileNames(t *testing.T) {
+	fileList := BackupFileList{"/base/1/1259": {}, "/base/1/1249": {}, "/base/12/1259": {}, "/PG_VERSION": {}}
+	names := expandBackupFileNames(fileList, []string{"base/1", "/PG_VERSION", "postgresql.auto.conf"})
+	if !reflect.DeepEqual(names, []string{"PG_VERSION", "base/1/1249", "base/1/1259", "postgresql.auto.conf"}) {
+		t.Fatalf("Wrong expanded names %v", names)
+	}
+}
+
+func TestBackupFilesLocate(t *testing.T) {
+	first := makeTarPartition(t, map[string]string{"/PG_VERSION": "12\n"})
+	first.key = "server/basebackups_005/base/tar_partitions/part_001.tar.lz4"
+	second := makeTarPartition(t, map[string]string{"/base/1/1259": "relation"})
+	second.key = "server/basebackups_005/base/tar_partitions/part_002.tar.lz4"
+	files := newBackupFiles([]ReaderMaker{first, second})
+	files.locate(BackupFileList{"/base/1/1259": {Partition: 2}})
+
+	var content bytes.Buffer
+	_, err := files.extract("base/1/1259", func(r io.Reader, hdr *tar.Header) error {
+		_, err := io.Copy(&content, r)
+		return err
+	})
+	if err != nil || content.String() != "relation" {
+		t.Fatalf("Wrong content %s: %v", content.String(), err)
+	}
+	if first.read != 0 || second.read != 1 {
+		t.Fatalf("Partitions are read %d and %d times", first.read, second.read)
+	}
+
+	_, err = files.extract("base/1/missing", func(r io.Reader, hdr *tar.Header) error {
+		_, err := io.Copy(ioutil.Discard, r)
+		return err
+	})
+	if err == nil {
+		t.Fatal("Missing file is extracted")
+	}
+}
@@ -0,0 +1,231 @@
+package walg
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// BackupListArguments incapsulates arguments for backup-list command
+type BackupListArguments struct {
+	filters map[string]string
+	tree    bool
+	summary bool
+}
+
+// ParseBackupListArguments interprets arguments for backup-list command. TODO: use flags or cobra
+func ParseBackupListArguments(args []string, fallBackFunc func()) (result BackupListArguments) {
+	params := args[1:]
+	for len(params) > 0 {
+		switch strings.TrimLeft(params[0], "-") {
+		case "filter":
+			if len(params) < 2 {
+				log.Printf("Value for %v not specified\n", params[0])
+				fallBackFunc()
+				return
+			}
+			key, value, err := ParseLabel(params[1])
+			if err != nil {
+				log.Println(err)
+				fallBackFunc()
+				return
+			}
+			if result.filters == nil {
+				result.filters = make(map[string]string)
+			}
+			result.filters[key] = value
+			params = params[2:]
+		case "tree":
+			result.tree = true
+			params = params[1:]
+		case "summary":
+			result.summary = true
+			params = params[1:]
+		default:
+			log.Printf("Unknown option %v\n", params[0])
+			fallBackFunc()
+			return
+		}
+	}
+	return
+}
+
+// filterBackupsByLabels keeps backups which have all of the labels in their sentinels
+func filterBackupsByLabels(backups []BackupTime, filters map[string]string, sentinelFetcher func(name string) S3TarBallSentinelDto) []BackupTime {
+	result := make([]BackupTime, 0, len(backups))
+	for _, b := range backups {
+		if labelsMatch(sentinelFetcher(b.Name).Labels, filters) {
+			result = append(result, b)
+		}
+	}
+	return result
+}
+
+func labelsMatch(labels map[string]string, filters map[string]string) bool {
+	for key, value := range filters {
+		if actual, ok := labels[key]; !ok || actual != value {
+			return false
+		}
+	}
+	return true
+}
+
+// BackupListUsage is a text message explaining how to use backup-list
+var BackupListUsage = "usage:\twal-g backup-list" + `
+	wal-g backup-list --filter key=value [--filter key2=value2]   list backups pushed with all of the labels
+	wal-g backup-list --tree                                      show full backups with dependent delta backups and LSN ranges
+	wal-g backup-list --summary                                   show partition count of every backup and WAL segments
+	                                                              retained since the oldest backup
+`
+
+func printBackupListUsageAndFail() {
+	log.Fatal(BackupListUsage)
+}
+
+// backupTreeNode is a backup with delta backups based on it
+type backupTreeNode struct {
+	backup   BackupTime
+	sentinel S3TarBallSentinelDto
+	children []*backupTreeNode
+}
+
+// countDependent counts delta backups which can't be restored without the backup
+func (node *backupTreeNode) countDependent() int {
+	count := 0
+	for _, child := range node.children {
+		count += 1 + child.countDependent()
+	}
+	return count
+}
+
+// buildBackupTree links delta backups to their bases. Backups are expected to be sorted from the newest,
+// as returned by GetBackups. Delta backups with missing base become roots.
+func buildBackupTree(backups []BackupTime, sentinelFetcher func(name string) S3TarBallSentinelDto) []*backupTreeNode {
+	nodes := make(map[string]*backupTreeNode, len(backups))
+	ordered := make([]*backupTreeNode, 0, len(backups))
+	for i := len(backups) - 1; i >= 0; i-- {
+		node := &backupTreeNode{backup: backups[i], sentinel: sentinelFetcher(backups[i].Name)}
+		nodes[node.backup.Name] = node
+		ordered = append(ordered, node)
+	}
+
+	roots := make([]*backupTreeNode, 0)
+	for _, node := range ordered {
+		if node.sentinel.IsIncremental() {
+			if base, ok := nodes[*node.sentinel.IncrementFrom]; ok {
+				base.children = append(base.children, node)
+				continue
+			}
+		}
+		roots = append(roots, node)
+	}
+	return roots
+}
+
+// printBackupTree prints backups from the oldest, delta backups are indented under their bases
+func printBackupTree(output io.Writer, roots []*backupTreeNode) {
+	var printNode func(node *backupTreeNode, indent string)
+	printNode = func(node *backupTreeNode, indent string) {
+		sentinel := node.sentinel
+		kind := "full"
+		if sentinel.IsIncremental() {
+			kind = "delta from " + FormatLsn(*sentinel.IncrementFromLSN)
+		}
+		lsnRange := "unknown"
+		if sentinel.LSN != nil {
+			lsnRange = FormatLsn(*sentinel.LSN) + " - "
+			if sentinel.FinishLSN != nil {
+				lsnRange += FormatLsn(*sentinel.FinishLSN)
+			}
+		}
+		line := fmt.Sprintf("%v%v\t%v\t%v\t%v", indent, node.backup.Name, node.backup.Time.Format(time.RFC3339), kind, lsnRange)
+		if dependent := node.countDependent(); dependent > 0 {
+			line += fmt.Sprintf("\t%d dependent", dependent)
+		} else if sentinel.IsIncremental() && indent == "" {
+			line += fmt.Sprintf("\tbase %v is missing", *sentinel.IncrementFrom)
+		}
+		fmt.Fprintln(output, line)
+		for _, child := range node.children {
+			printNode(child, indent+"  ")
+		}
+	}
+	for _, root := range roots {
+		printNode(root, "")
+	}
+}
+
+// archiveSummary describes what is stored in the prefix besides backup names
+type archiveSummary struct {
+	partitions map[string]int
+	// WAL segments retained since the oldest backup and their modification time range
+	walSegments int
+	walOldest   time.Time
+	walNewest   time.Time
+	// walBeforeOldest counts segments older than the oldest backup, which are not needed for its recovery
+	walBeforeOldest int
+}
+
+// collectArchiveSummary counts tar partitions of backups and WAL segments. Backups are expected to be sorted
+// from the newest, as returned by GetBackups.
+func collectArchiveSummary(pre *Prefix, backups []BackupTime) (archiveSummary, error) {
+	summary := archiveSummary{partitions: make(map[string]int)}
+	backupPath := *GetBackupPath(pre)
+	err := listAllObjects(pre, backupPath, func(ob *s3.Object) {
+		parts := strings.SplitN(strings.TrimPrefix(*ob.Key, backupPath), "/tar_partitions/", 2)
+		if len(parts) == 2 {
+			summary.partitions[parts[0]]++
+		}
+	})
+	if err != nil {
+		return summary, err
+	}
+
+	oldest := ""
+	if len(backups) > 0 {
+		oldest = backups[len(backups)-1].WalFileName
+	}
+	err = listWalObjects(pre, GetWalFolderPath(pre), func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, ob := range page.Contents {
+			var segments []WalSegmentNo
+			if segment, ok := parseWalSegmentKey(*ob.Key); ok {
+				segments = []WalSegmentNo{segment}
+			} else if bundle, ok := parseWalBundleKey(*ob.Key); ok {
+				segments = bundle.Segments()
+			}
+			for _, segment := range segments {
+				if segment.Name() < oldest {
+					summary.walBeforeOldest++
+					continue
+				}
+				summary.walSegments++
+				if ob.LastModified == nil {
+					continue
+				}
+				if summary.walOldest.IsZero() || ob.LastModified.Before(summary.walOldest) {
+					summary.walOldest = *ob.LastModified
+				}
+				if ob.LastModified.After(summary.walNewest) {
+					summary.walNewest = *ob.LastModified
+				}
+			}
+		}
+		return true
+	})
+	return summary, err
+}
+
+// printArchiveSummary prints WAL segments of the summary, partitions are printed with backups
+func printArchiveSummary(output io.Writer, summary archiveSummary) {
+	line := fmt.Sprintf("%d WAL segments since the oldest backup", summary.walSegments)
+	if !summary.walOldest.IsZero() {
+		line += fmt.Sprintf(", archived from %v to %v", summary.walOldest.Format(time.RFC3339), summary.walNewest.Format(time.RFC3339))
+	}
+	fmt.Fprintln(output, line)
+	if summary.walBeforeOldest > 0 {
+		fmt.Fprintf(output, "%d WAL segments are older than the oldest backup\n", summary.walBeforeOldest)
+	}
+}
@@ -0,0 +1,161 @@
+package walg
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+// backupMarkerHeartbeat is the interval of marker refresh, marker not refreshed for three intervals is abandoned
+const backupMarkerHeartbeat = time.Minute
+
+// sentinelVisibilityTimeout limits waiting for uploaded sentinel to become readable on eventually consistent storage
+const sentinelVisibilityTimeout = 2 * time.Minute
+
+// ErrSentinelNotVisible happens when uploaded sentinel can not be read back in time
+var ErrSentinelNotVisible = errors.New("uploaded sentinel is not readable")
+
+// BackupMarker is the object telling that backup is running. It is uploaded when backup starts, refreshed while
+// backup runs and deleted after the sentinel is readable, so backup which has a marker and no sentinel is running
+// or, if the marker is not refreshed, abandoned.
+type BackupMarker struct {
+	Name      string    `json:"name"`
+	Host      string    `json:"host"`
+	StartTime time.Time `json:"start_time"`
+
+	tu   *TarUploader
+	pre  *Prefix
+	stop chan struct{}
+	done chan struct{}
+}
+
+// BackupProgress describes backup which has a marker
+type BackupProgress struct {
+	Name      string    `json:"name"`
+	Heartbeat time.Time `json:"heartbeat"`
+	Abandoned bool      `json:"abandoned"`
+}
+
+func getBackupMarkerFolder(pre *Prefix) string {
+	return sanitizePath(*pre.Server + "/wal-g-backups-in-progress/")
+}
+
+// StartBackupMarker uploads marker of the backup and refreshes it until Finish. Failure to upload marker
+// is only logged, marker is for monitoring and backup does not depend on it.
+func StartBackupMarker(tu *TarUploader, pre *Prefix, name string) *BackupMarker {
+	host, _ := os.Hostname()
+	marker := &BackupMarker{
+		Name:      name,
+		Host:      host,
+		StartTime: time.Now().UTC(),
+		tu:        tu.Clone(),
+		pre:       pre,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	marker.upload()
+
+	go func() {
+		defer close(marker.done)
+		ticker := time.NewTicker(backupMarkerHeartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-marker.stop:
+				return
+			case <-ticker.C:
+				marker.upload()
+			}
+		}
+	}()
+	return marker
+}
+
+func (marker *BackupMarker) key() string {
+	return getBackupMarkerFolder(marker.pre) + marker.Name + ".json"
+}
+
+func (marker *BackupMarker) upload() {
+	body, err := json.Marshal(marker)
+	if err == nil {
+		err = marker.tu.uploadSentinel(marker.key(), body)
+	}
+	if err != nil {
+		log.Printf("WARNING! Failed to upload marker of running backup %s: %v\n", marker.Name, err)
+	}
+}
+
+// Finish stops refreshing the marker and deletes it, called after the sentinel is uploaded
+func (marker *BackupMarker) Finish() {
+	close(marker.stop)
+	<-marker.done
+	if err := deleteObjects(marker.pre, partitionToObjects([]string{marker.key()})); err != nil {
+		log.Printf("WARNING! Failed to delete marker of finished backup %s: %v\n", marker.Name, err)
+	}
+}
+
+// ListBackupsInProgress lists backups having a marker, backups finished meanwhile are skipped
+func ListBackupsInProgress(pre *Prefix, now time.Time) ([]BackupProgress, error) {
+	finished := make(map[string]bool)
+	backupTimes, err := (&Backup{Prefix: pre, Path: GetBackupPath(pre)}).GetBackups()
+	if err != nil && err != ErrLatestNotFound {
+		return nil, err
+	}
+	for _, backupTime := range backupTimes {
+		finished[backupTime.Name] = true
+	}
+
+	backups := make([]BackupProgress, 0)
+	err = listAllObjects(pre, getBackupMarkerFolder(pre), func(ob *s3.Object) {
+		name := strings.TrimSuffix(path.Base(*ob.Key), ".json")
+		if finished[name] {
+			return
+		}
+		heartbeat := aws.TimeValue(ob.LastModified)
+		backups = append(backups, BackupProgress{
+			Name:      name,
+			Heartbeat: heartbeat,
+			Abandoned: now.Sub(heartbeat) > 3*backupMarkerHeartbeat,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].Name < backups[j].Name })
+	return backups, nil
+}
+
+// awaitSentinel polls uploaded sentinel until storage serves it, so backup is not reported successful
+// before backup-list and backup-fetch can see it
+func (tu *TarUploader) awaitSentinel(key string) error {
+	deadline := time.Now().Add(sentinelVisibilityTimeout)
+	interval := 100 * time.Millisecond
+	for {
+		_, err := tu.svc.HeadObject(&s3.HeadObjectInput{
+			Bucket: aws.String(tu.bucket),
+			Key:    aws.String(key),
+		})
+		if err == nil {
+			return nil
+		}
+		if awsErr, ok := err.(awserr.Error); !ok || awsErr.Code() != "NotFound" {
+			return errors.Wrapf(err, "awaitSentinel: s3.HeadObject of %s failed", key)
+		}
+		if !time.Now().Before(deadline) {
+			return errors.Wrapf(ErrSentinelNotVisible, "awaitSentinel: %s is not readable after %v", key, sentinelVisibilityTimeout)
+		}
+		time.Sleep(interval)
+		if interval < 5*time.Second {
+			interval *= 2
+		}
+	}
+}
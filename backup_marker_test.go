@@ -0,0 +1,61 @@
+package walg
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+func TestListBackupsInProgress(t *testing.T) {
+	svc := &listObjectsS3{objects: map[string]int64{
+		"server/basebackups_005/base_000000010000000000000002_backup_stop_sentinel.json": 100,
+		"server/wal-g-backups-in-progress/base_000000010000000000000002.json":            50,
+		"server/wal-g-backups-in-progress/base_000000010000000000000004.json":            50,
+	}}
+	pre := &Prefix{Svc: svc, Bucket: aws.String("bucket"), Server: aws.String("server")}
+
+	backups, err := ListBackupsInProgress(pre, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 1 || backups[0].Name != "base_000000010000000000000004" || backups[0].Abandoned {
+		t.Errorf("ListBackupsInProgress: unexpected %v", backups)
+	}
+
+	backups, err = ListBackupsInProgress(pre, time.Now().Add(10*backupMarkerHeartbeat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 1 || !backups[0].Abandoned {
+		t.Errorf("ListBackupsInProgress: marker without heartbeat is not abandoned %v", backups)
+	}
+}
+
+// eventuallyConsistentS3 serves objects only after several HEAD requests
+type eventuallyConsistentS3 struct {
+	s3iface.S3API
+	misses int
+}
+
+func (m *eventuallyConsistentS3) HeadObject(*s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	if m.misses > 0 {
+		m.misses--
+		return nil, awserr.New("NotFound", "Not Found", nil)
+	}
+	return &s3.HeadObjectOutput{}, nil
+}
+
+func TestAwaitSentinel(t *testing.T) {
+	svc := &eventuallyConsistentS3{misses: 2}
+	tu := NewTarUploader(svc, "bucket", "server", "region")
+	if err := tu.awaitSentinel("server/basebackups_005/base_000000010000000000000002_backup_stop_sentinel.json"); err != nil {
+		t.Errorf("awaitSentinel: %v", err)
+	}
+	if svc.misses != 0 {
+		t.Errorf("awaitSentinel: returned before sentinel was readable")
+	}
+}
@@ -0,0 +1,228 @@
+package walg
+
+import (
+	"archive/tar"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// BackupMountUsage is a text message explaining how to use backup-mount
+var BackupMountUsage = "usage:\twal-g backup-mount backup_name mount_point" + `
+	wal-g backup-mount LATEST mount_point
+Exposes files of the backup read-only via FUSE until the mount point is unmounted or wal-g is interrupted.
+A file is extracted into a temporary directory when it is opened for the first time, only partitions up to
+the one holding it are downloaded. Delta backups can not be mounted. Linux only.
+`
+
+func printBackupMountUsageAndFail() {
+	log.Fatal(BackupMountUsage)
+}
+
+// mountNode is a file or directory of mounted backup, inode is its index in backupMount nodes plus one
+type mountNode struct {
+	inode    uint64
+	name     string // path relative to PGDATA, empty for root
+	typeflag byte
+	mode     int64
+	linkname string
+	mtime    time.Time
+	size     int64
+	holes    []FileHole
+	children map[string]uint64
+
+	fetch  sync.Mutex
+	cached string // location of extracted file in cache directory
+}
+
+func (node *mountNode) isDir() bool {
+	return node.typeflag == tar.TypeDir
+}
+
+// backupMount is a read-only file tree of a backup, files are extracted to cache directory on demand
+type backupMount struct {
+	mutex    sync.Mutex
+	nodes    []*mountNode
+	files    *backupFiles
+	cacheDir string
+	// mountTime is reported as modification time of directories not found in tar headers
+	mountTime time.Time
+}
+
+// HandleBackupMount is invoked to perform wal-g backup-mount
+func HandleBackupMount(pre *Prefix, args []string) {
+	if len(args) != 3 {
+		printBackupMountUsageAndFail()
+	}
+	bk := resolveBackup(args[1], pre)
+	sentinel := fetchSentinel(*bk.Name, bk, pre)
+	if sentinel.IsIncremental() {
+		log.Fatalf("Backup %s is a delta backup, fetch it with backup-fetch or mount its base %s\n", *bk.Name, *sentinel.IncrementFullName)
+	}
+	partitions, err := getBackupPartitions(bk)
+	if err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+
+	files := newBackupFiles(partitions)
+	files.locate(sentinel.Files)
+	headers := make(map[string]tar.Header)
+	if len(sentinel.Files) == 0 {
+		log.Printf("Backup %s has no file list, reading all partitions to build it\n", *bk.Name)
+		if headers, err = files.scanAll(); err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+	}
+	cacheDir, err := createTempDir("wal-g-backup-mount")
+	if err != nil {
+		log.Fatalf("Unable to create cache directory: %v\n", err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	mount := newBackupMount(files, sentinel.Files, headers, cacheDir)
+	log.Printf("Backup %s is mounted at %s\n", *bk.Name, args[2])
+	if err = serveFuse(args[2], mount); err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+}
+
+// newBackupMount builds file tree from sentinel file list and tar headers, directories of files are implied
+func newBackupMount(files *backupFiles, fileList BackupFileList, headers map[string]tar.Header, cacheDir string) *backupMount {
+	mount := &backupMount{files: files, cacheDir: cacheDir, mountTime: time.Now()}
+	mount.addNode("", tar.Header{Typeflag: tar.TypeDir, Mode: 0700})
+	for name, description := range fileList {
+		node := mount.addNode(normalizeMemberName(name), tar.Header{Typeflag: tar.TypeReg, Mode: 0600, ModTime: description.MTime})
+		node.holes = description.SparseHoles
+	}
+	for name, header := range headers {
+		mount.addNode(normalizeMemberName(name), header)
+	}
+	return mount
+}
+
+// addNode adds node with its parent directories, existing node gets attributes of the header
+func (mount *backupMount) addNode(name string, header tar.Header) *mountNode {
+	parent := uint64(0)
+	if name != "" {
+		parent = mount.directory(normalizeMemberName(path.Dir(name))).inode
+	}
+	node := mount.lookup(parent, path.Base(name))
+	if name == "" && len(mount.nodes) > 0 {
+		node = mount.nodes[0]
+	}
+	if node == nil {
+		node = &mountNode{inode: uint64(len(mount.nodes) + 1), name: name, typeflag: header.Typeflag, mtime: mount.mountTime}
+		mount.nodes = append(mount.nodes, node)
+		if node.isDir() {
+			node.children = make(map[string]uint64)
+		}
+		if parent != 0 {
+			mount.nodes[parent-1].children[path.Base(name)] = node.inode
+		}
+	} else if node.isDir() != (header.Typeflag == tar.TypeDir) {
+		return node
+	}
+	node.mode = header.Mode
+	node.linkname = header.Linkname
+	if !header.ModTime.IsZero() {
+		node.mtime = header.ModTime
+	}
+	if (header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeRegA) && len(node.holes) == 0 {
+		node.size = header.Size
+	}
+	return node
+}
+
+// directory returns directory node creating it if it is not known yet
+func (mount *backupMount) directory(name string) *mountNode {
+	if name == "" && len(mount.nodes) > 0 {
+		return mount.nodes[0]
+	}
+	parent := mount.directory(normalizeMemberName(path.Dir(name)))
+	if node := mount.lookup(parent.inode, path.Base(name)); node != nil {
+		return node
+	}
+	return mount.addNode(name, tar.Header{Typeflag: tar.TypeDir, Mode: 0700})
+}
+
+// node returns node by inode, nil if there is no such node
+func (mount *backupMount) node(inode uint64) *mountNode {
+	if inode == 0 || inode > uint64(len(mount.nodes)) {
+		return nil
+	}
+	return mount.nodes[inode-1]
+}
+
+// lookup returns child of directory by name, nil if there is no such child
+func (mount *backupMount) lookup(parent uint64, name string) *mountNode {
+	directory := mount.node(parent)
+	if directory == nil || !directory.isDir() {
+		return nil
+	}
+	inode, ok := directory.children[name]
+	if !ok {
+		return nil
+	}
+	return mount.node(inode)
+}
+
+// children returns children of directory sorted by name
+func (mount *backupMount) children(directory *mountNode) []*mountNode {
+	names := make([]string, 0, len(directory.children))
+	for name := range directory.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	result := make([]*mountNode, len(names))
+	for i, name := range names {
+		result[i] = mount.node(directory.children[name])
+	}
+	return result
+}
+
+// size returns size of file, it is zero until the file is extracted when sentinel does not tell it
+func (mount *backupMount) size(node *mountNode) int64 {
+	mount.mutex.Lock()
+	defer mount.mutex.Unlock()
+	return node.size
+}
+
+// open extracts file into cache directory, unless it is already extracted, and opens extracted copy
+func (mount *backupMount) open(node *mountNode) (*os.File, error) {
+	node.fetch.Lock()
+	defer node.fetch.Unlock()
+	if node.cached == "" {
+		location := filepath.Join(mount.cacheDir, filepath.FromSlash(node.name))
+		if err := os.MkdirAll(filepath.Dir(location), 0700); err != nil {
+			return nil, errors.Wrapf(err, "backupMount: unable to create cache directory for %s", node.name)
+		}
+		_, err := mount.files.extract(node.name, func(r io.Reader, hdr *tar.Header) error {
+			f, err := os.OpenFile(location, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			return writeSparseFile(f, r, node.holes)
+		})
+		if err != nil {
+			os.Remove(location)
+			return nil, err
+		}
+		stat, err := os.Stat(location)
+		if err != nil {
+			return nil, errors.Wrapf(err, "backupMount: unable to stat extracted %s", node.name)
+		}
+		mount.mutex.Lock()
+		node.size = stat.Size()
+		mount.mutex.Unlock()
+		node.cached = location
+	}
+	return os.Open(node.cached)
+}
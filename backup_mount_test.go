@@ -0,0 +1,86 @@
+package walg
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+type tarPartitionMaker struct {
+	key  string
+	data []byte
+	read int
+}
+
+func (m *tarPartitionMaker) Reader() (io.ReadCloser, error) {
+	m.read++
+	return ioutil.NopCloser(bytes.NewReader(m.data)), nil
+}
+func (m *tarPartitionMaker) Format() string { return "tar" }
+func (m *tarPartitionMaker) Path() string   { return m.key }
+
+func makeTarPartition(t *testing.T, files map[string]string) *tarPartitionMaker {
+	var buffer bytes.Buffer
+	tw := tar.NewWriter(&buffer)
+	for name, content := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+	return &tarPartitionMaker{key: "partition.tar", data: buffer.Bytes()}
+}
+
+func TestBackupMountTree(t *testing.T) {
+	mount := newBackupMount(nil, BackupFileList{"/base/1/1259": {}, "/PG_VERSION": {}}, map[string]tar.Header{
+		"/base":   {Name: "/base", Typeflag: tar.TypeDir, Mode: 0750},
+		"/pg_wal": {Name: "/pg_wal", Typeflag: tar.TypeSymlink, Linkname: "/wal"},
+	}, "")
+
+	base := mount.lookup(1, "base")
+	if base == nil || !base.isDir() || base.mode != 0750 {
+		t.Fatalf("Wrong base directory %+v", base)
+	}
+	relation := mount.lookup(mount.lookup(base.inode, "1").inode, "1259")
+	if relation == nil || relation.isDir() || relation.name != "base/1/1259" {
+		t.Fatalf("Wrong relation file %+v", relation)
+	}
+	children := mount.children(mount.node(1))
+	if len(children) != 3 || children[0].name != "PG_VERSION" || children[1].name != "base" || children[2].linkname != "/wal" {
+		t.Fatalf("Wrong root children %v", children)
+	}
+}
+
+func TestBackupMountOpen(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "wal-g-backup-mount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	first := makeTarPartition(t, map[string]string{"/PG_VERSION": "12\n"})
+	second := makeTarPartition(t, map[string]string{"/base/1/1259": "relation", "/base/1/1249": "attribute"})
+	files := newBackupFiles([]ReaderMaker{first, second})
+	mount := newBackupMount(files, BackupFileList{"/PG_VERSION": {}, "/base/1/1259": {}, "/base/1/1249": {}}, nil, cacheDir)
+
+	for _, name := range []string{"1259", "1249", "1259"} {
+		node := mount.lookup(mount.lookup(mount.lookup(1, "base").inode, "1").inode, name)
+		file, err := mount.open(node)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := ioutil.ReadAll(file)
+		file.Close()
+		if len(content) == 0 || mount.size(node) != int64(len(content)) {
+			t.Fatalf("Wrong content of %s: %s", name, content)
+		}
+	}
+	// Partition of the second file is known after the first lookup, extracted file is cached
+	if first.read != 1 || second.read != 2 {
+		t.Fatalf("Partitions are read %d and %d times", first.read, second.read)
+	}
+}
@@ -0,0 +1,63 @@
+package walg
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+// maxBackupNameDisambiguator limits attempts to find free name for backups starting at the same LSN
+const maxBackupNameDisambiguator = 100
+
+// ErrBackupNameTaken happens when backup name is used by a finished or running backup
+var ErrBackupNameTaken = errors.New("backup name is taken")
+
+// FormatBackupName makes backup name from start WAL file and offset of start LSN in it, like PostgreSQL
+// names backup history files, e.g. base_000000010000000000000002.00000028
+func FormatBackupName(walFileName string, lsn uint64) string {
+	return fmt.Sprintf("%s%s.%08X", backupNamePrefix, walFileName, lsn%GetWalSegmentSize())
+}
+
+// reserveBackupName finds a name not used in storage: name with suffix, or name with disambiguator
+// and suffix if backup with the same start LSN exists, e.g. taken on idle replica
+func reserveBackupName(pre *Prefix, name string, suffix string) (string, error) {
+	for i := 0; i < maxBackupNameDisambiguator; i++ {
+		candidate := name + suffix
+		if i > 0 {
+			candidate = fmt.Sprintf("%s.%d%s", name, i, suffix)
+		}
+		taken, err := isBackupNameTaken(pre, candidate)
+		if err != nil {
+			return "", err
+		}
+		if !taken {
+			return candidate, nil
+		}
+		log.Printf("WARNING! Backup name %s is taken, tar partitions of existing backup are not overwritten\n", candidate)
+	}
+	return "", errors.Wrapf(ErrBackupNameTaken, "reserveBackupName: %s", name+suffix)
+}
+
+// isBackupNameTaken checks whether backup has a sentinel, tar partitions or a marker of running backup
+func isBackupNameTaken(pre *Prefix, name string) (bool, error) {
+	backupPath := *GetBackupPath(pre)
+	for _, key := range []string{backupPath + name + SentinelSuffix, getBackupMarkerFolder(pre) + name + ".json"} {
+		exists, err := (&Archive{Prefix: pre, Archive: aws.String(key)}).CheckExistence()
+		if err != nil || exists {
+			return exists, err
+		}
+	}
+	taken := false
+	err := listObjectsV2Pages(pre.Svc, &s3.ListObjectsV2Input{
+		Bucket:  pre.Bucket,
+		Prefix:  aws.String(backupPath + name + "/"),
+		MaxKeys: aws.Int64(1),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		taken = len(page.Contents) > 0
+		return false
+	})
+	return taken, errors.Wrap(err, "isBackupNameTaken: s3.ListObjectsV2 failed")
+}
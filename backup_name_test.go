@@ -0,0 +1,56 @@
+package walg
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// existingObjectsS3 answers HEAD requests for listed objects
+type existingObjectsS3 struct {
+	listObjectsS3
+}
+
+func (m *existingObjectsS3) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	if _, ok := m.objects[*input.Key]; !ok {
+		return nil, awserr.New("NotFound", "Not Found", nil)
+	}
+	return &s3.HeadObjectOutput{}, nil
+}
+
+func TestFormatBackupName(t *testing.T) {
+	name := FormatBackupName("000000010000000000000002", 0x2000028)
+	if name != "base_000000010000000000000002.00000028" {
+		t.Errorf("FormatBackupName: unexpected %s", name)
+	}
+	if wal := stripWalFileName(name + "_D_000000010000000000000001"); wal != "000000010000000000000002" {
+		t.Errorf("stripWalFileName: unexpected %s for %s", wal, name)
+	}
+}
+
+func TestReserveBackupName(t *testing.T) {
+	svc := &existingObjectsS3{listObjectsS3{objects: map[string]int64{
+		"server/basebackups_005/base_000000010000000000000002.00000028_backup_stop_sentinel.json": 100,
+		"server/basebackups_005/base_000000010000000000000002.00000028.1/tar_partitions/part_1":   100,
+		"server/wal-g-backups-in-progress/base_000000010000000000000002.00000028.2.json":          50,
+	}}}
+	pre := &Prefix{Svc: svc, Bucket: aws.String("bucket"), Server: aws.String("server")}
+
+	name, err := reserveBackupName(pre, "base_000000010000000000000002.00000028", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "base_000000010000000000000002.00000028.3" {
+		t.Errorf("reserveBackupName: unexpected %s", name)
+	}
+
+	name, err = reserveBackupName(pre, "base_000000010000000000000002.00000028", "_D_000000010000000000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "base_000000010000000000000002.00000028_D_000000010000000000000001" {
+		t.Errorf("reserveBackupName: unexpected delta name %s", name)
+	}
+}
@@ -0,0 +1,247 @@
+package walg
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+// BackupRepairUsage is a text message explaining how to use backup-repair
+var BackupRepairUsage = "usage:\twal-g backup-repair backup_name [--confirm]" + `
+Rebuilds lost or corrupted sentinel of a full backup from its tar partitions.
+Without --confirm prints the rebuilt sentinel only.
+`
+
+// ErrDeltaSentinelRebuild happens on attempt to rebuild sentinel of delta backup, its file list can not be recovered
+var ErrDeltaSentinelRebuild = errors.New("sentinel of delta backup can not be rebuilt")
+
+// pgControlPartition is the partition uploaded by HandleMetadataFiles, backup can't be restored without it
+const pgControlPartition = "pg_control.tar.lz4"
+
+var startWalLocationRegexp = regexp.MustCompile(`START WAL LOCATION: ([0-9A-Fa-f]+/[0-9A-Fa-f]+) \(file ([0-9A-Fa-f]{24})\)`)
+
+// BackupRepairArguments holds arguments of backup-repair
+type BackupRepairArguments struct {
+	backupName string
+	confirm    bool
+}
+
+func printBackupRepairUsageAndFail() {
+	log.Fatal(BackupRepairUsage)
+}
+
+// ParseBackupRepairArguments interprets arguments for backup-repair command. In case of any error it calls fallBackFunc
+func ParseBackupRepairArguments(args []string, fallBackFunc func()) (result BackupRepairArguments) {
+	params := args[1:]
+	if len(params) > 0 && params[len(params)-1] == "--confirm" {
+		result.confirm = true
+		params = params[:len(params)-1]
+	}
+	if len(params) != 1 {
+		fallBackFunc()
+		return
+	}
+	result.backupName = params[0]
+	return
+}
+
+// HandleBackupRepair is invoked to perform wal-g backup-repair
+func HandleBackupRepair(tu *TarUploader, pre *Prefix, args []string) {
+	arguments := ParseBackupRepairArguments(args, printBackupRepairUsageAndFail)
+
+	sentinel, err := RebuildSentinel(pre, arguments.backupName)
+	if err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+	dtoBody, err := json.Marshal(sentinel)
+	if err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+	fmt.Println(string(dtoBody))
+	if !arguments.confirm {
+		fmt.Println("Dry run, add --confirm to upload the sentinel")
+		return
+	}
+
+	key := *GetBackupPath(pre) + arguments.backupName + SentinelSuffix
+	err = tu.uploadSentinel(key, dtoBody)
+	if err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+	fmt.Println("Uploaded", key)
+}
+
+// RebuildSentinel reconstructs minimal sentinel of a full backup: start LSN from backup_label and
+// PostgreSQL version from PG_VERSION found in tar partitions.
+func RebuildSentinel(pre *Prefix, backupName string) (*S3TarBallSentinelDto, error) {
+	if strings.Contains(backupName, "_D_") {
+		return nil, errors.Wrapf(ErrDeltaSentinelRebuild, "RebuildSentinel: %s", backupName)
+	}
+	partitions, err := listTarPartitions(pre, backupName)
+	if err != nil {
+		return nil, err
+	}
+	if len(partitions) == 0 {
+		return nil, errors.Errorf("RebuildSentinel: no tar partitions found for %s", backupName)
+	}
+
+	dataPartitions := make([]string, 0, len(partitions))
+	pgControl := ""
+	for _, partition := range partitions {
+		if path.Base(partition) == pgControlPartition {
+			pgControl = partition
+		} else {
+			dataPartitions = append(dataPartitions, partition)
+		}
+	}
+	if pgControl == "" {
+		return nil, errors.Errorf("RebuildSentinel: %s is not found, backup %s is incomplete", pgControlPartition, backupName)
+	}
+
+	// backup_label is stored along with pg_control, older backups have it in the last data partition
+	files := map[string][]byte{"PG_VERSION": nil, "backup_label": nil}
+	for _, partition := range append([]string{pgControl}, tarScanOrder(dataPartitions)...) {
+		if err = findTarFiles(pre, partition, files); err != nil {
+			return nil, err
+		}
+		if files["PG_VERSION"] != nil && files["backup_label"] != nil {
+			break
+		}
+	}
+	if files["backup_label"] == nil {
+		return nil, errors.Errorf("RebuildSentinel: backup_label is not found in partitions of %s", backupName)
+	}
+
+	sentinel := &S3TarBallSentinelDto{}
+	lsn, walFileName, err := parseBackupLabel(files["backup_label"])
+	if err != nil {
+		return nil, err
+	}
+	if stripWalFileName(backupName) != walFileName {
+		log.Printf("WARNING! backup_label refers to WAL file %s, it does not match backup name %s\n", walFileName, backupName)
+	}
+	sentinel.LSN = &lsn
+
+	if files["PG_VERSION"] != nil {
+		sentinel.PgVersion, err = pgVersionNum(string(files["PG_VERSION"]))
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		log.Println("WARNING! PG_VERSION is not found, sentinel will not contain PostgreSQL version")
+	}
+	return sentinel, nil
+}
+
+// listTarPartitions lists keys of tar partitions of the backup sorted by partition number
+func listTarPartitions(pre *Prefix, backupName string) ([]string, error) {
+	objects := &s3.ListObjectsV2Input{
+		Bucket: pre.Bucket,
+		Prefix: aws.String(*GetBackupPath(pre) + backupName + "/tar_partitions/"),
+	}
+	partitions := make([]string, 0)
+	err := listObjectsV2Pages(pre.Svc, objects, func(files *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, ob := range files.Contents {
+			partitions = append(partitions, *ob.Key)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "listTarPartitions: s3.ListObjectsV2 failed")
+	}
+	sort.SliceStable(partitions, func(i, j int) bool {
+		return partitionNumber(partitions[i]) < partitionNumber(partitions[j])
+	})
+	return partitions, nil
+}
+
+func partitionNumber(key string) int {
+	name := strings.TrimPrefix(path.Base(key), "part_")
+	number, err := strconv.Atoi(strings.SplitN(name, ".", 2)[0])
+	if err != nil {
+		return 0
+	}
+	return number
+}
+
+// tarScanOrder puts first partition (PG_VERSION is walked first) and last partition (backup_label of
+// non-exclusive backup is written last) ahead, other partitions may contain backup_label of exclusive backup.
+func tarScanOrder(partitions []string) []string {
+	if len(partitions) < 2 {
+		return partitions
+	}
+	order := []string{partitions[0], partitions[len(partitions)-1]}
+	return append(order, partitions[1:len(partitions)-1]...)
+}
+
+// findTarFiles reads partition until all wanted files in the root of data directory are found
+func findTarFiles(pre *Prefix, key string, files map[string][]byte) error {
+	a := &Archive{Prefix: pre, Archive: aws.String(key)}
+	reader, err := a.GetArchive()
+	if err != nil {
+		return errors.Wrapf(err, "findTarFiles: failed to download %s", key)
+	}
+	defer reader.Close()
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(decodeObject(pw, reader, key))
+	}()
+	defer pr.Close()
+	return scanTarFiles(pr, files)
+}
+
+func scanTarFiles(reader io.Reader, files map[string][]byte) error {
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "scanTarFiles: failed to read tar")
+		}
+		name := strings.TrimPrefix(hdr.Name, "/")
+		content, wanted := files[name]
+		if !wanted || content != nil {
+			continue
+		}
+		files[name], err = ioutil.ReadAll(tr)
+		if err != nil {
+			return errors.Wrapf(err, "scanTarFiles: failed to read %s", name)
+		}
+
+		missing := false
+		for _, content := range files {
+			missing = missing || content == nil
+		}
+		if !missing {
+			return nil
+		}
+	}
+}
+
+// parseBackupLabel extracts start LSN and WAL file name from backup_label
+func parseBackupLabel(label []byte) (lsn uint64, walFileName string, err error) {
+	match := startWalLocationRegexp.FindSubmatch(label)
+	if match == nil {
+		return 0, "", errors.New("parseBackupLabel: START WAL LOCATION is not found")
+	}
+	lsn, err = ParseLsn(string(match[1]))
+	if err != nil {
+		return 0, "", errors.Wrap(err, "parseBackupLabel: failed to parse start LSN")
+	}
+	return lsn, string(match[2]), nil
+}
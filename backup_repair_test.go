@@ -0,0 +1,61 @@
+package walg
+
+import (
+	"archive/tar"
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestParseBackupLabel(t *testing.T) {
+	label := []byte("START WAL LOCATION: 0/2000028 (file 000000010000000000000002)\n" +
+		"CHECKPOINT LOCATION: 0/2000060\nBACKUP METHOD: streamed\nBACKUP FROM: master\n")
+	lsn, walFileName, err := parseBackupLabel(label)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lsn != 0x2000028 || walFileName != "000000010000000000000002" {
+		t.Errorf("backup_label was not parsed correctly: %x %v", lsn, walFileName)
+	}
+
+	if _, _, err = parseBackupLabel([]byte("garbage")); err == nil {
+		t.Error("garbage was parsed as backup_label")
+	}
+}
+
+func TestScanTarFiles(t *testing.T) {
+	var buffer bytes.Buffer
+	tw := tar.NewWriter(&buffer)
+	for name, content := range map[string]string{"/PG_VERSION": "10\n", "/base/1/PG_VERSION": "9.6\n"} {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(content)), Typeflag: tar.TypeReg})
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+
+	files := map[string][]byte{"PG_VERSION": nil, "backup_label": nil}
+	if err := scanTarFiles(&buffer, files); err != nil {
+		t.Fatal(err)
+	}
+	if string(files["PG_VERSION"]) != "10\n" || files["backup_label"] != nil {
+		t.Errorf("unexpected files found %v", files)
+	}
+}
+
+func TestTarScanOrder(t *testing.T) {
+	order := tarScanOrder([]string{"part_001", "part_002", "part_003", "part_004"})
+	if !reflect.DeepEqual(order, []string{"part_001", "part_004", "part_002", "part_003"}) {
+		t.Errorf("unexpected scan order %v", order)
+	}
+	if partitionNumber("server/basebackups_005/base/tar_partitions/part_012.tar.lz4") != 12 {
+		t.Error("partition number was not parsed")
+	}
+}
+
+func TestPgVersionNum(t *testing.T) {
+	for version, expected := range map[string]int{"9.6\n": 90600, "10\n": 100000, "9.4": 90400} {
+		num, err := pgVersionNum(version)
+		if err != nil || num != expected {
+			t.Errorf("pgVersionNum(%q) = %v, %v; expected %v", version, num, err, expected)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package walg
+
+import (
+	"path"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+// ErrPartitionMismatch happens when stored partitions of a backup differ from the ones recorded in its sentinel
+var ErrPartitionMismatch = errors.New("stored partitions differ from sentinel")
+
+// verifyBackupChain checks the backup and its delta bases before anything is written to PGDATA.
+// Sentinels are read with their checksums verified and every partition recorded in a sentinel must be stored
+// with the recorded size. Backups made before partitions were recorded are checked for readable sentinels only.
+func verifyBackupChain(pre *Prefix, backupName string) error {
+	for backupName != "" {
+		bk, err := findBackup(backupName, pre)
+		if err != nil {
+			return err
+		}
+		sentinel, err := readSentinel(*bk.Name, bk, pre)
+		if err != nil {
+			return err
+		}
+		if err = verifyStoredPartitions(bk, sentinel); err != nil {
+			return err
+		}
+		backupName = ""
+		if sentinel.IsIncremental() {
+			backupName = *sentinel.IncrementFrom
+		}
+	}
+	return nil
+}
+
+// verifyStoredPartitions compares partitions listed in storage with the ones recorded in sentinel
+func verifyStoredPartitions(bk *Backup, sentinel S3TarBallSentinelDto) error {
+	if len(sentinel.Partitions) == 0 {
+		infof("Backup %s has no recorded partitions, they are not verified\n", *bk.Name)
+		return nil
+	}
+	stored := make(map[string]int64)
+	err := listObjectsV2Pages(bk.Prefix.Svc, &s3.ListObjectsV2Input{
+		Bucket: bk.Prefix.Bucket,
+		Prefix: aws.String(sanitizePath(*bk.Path + *bk.Name + "/tar_partitions/")),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			stored[path.Base(aws.StringValue(object.Key))] = aws.Int64Value(object.Size)
+		}
+		return true
+	})
+	if err != nil {
+		return errors.Wrap(err, "verifyStoredPartitions: s3.ListObjectsV2 failed")
+	}
+
+	for name, description := range sentinel.Partitions {
+		size, ok := stored[name]
+		if !ok {
+			return errors.Wrapf(ErrPartitionMismatch, "verifyStoredPartitions: partition %s of %s is missing", name, *bk.Name)
+		}
+		if size != description.Size {
+			return errors.Wrapf(ErrPartitionMismatch, "verifyStoredPartitions: partition %s of %s is %d bytes, recorded %d bytes",
+				name, *bk.Name, size, description.Size)
+		}
+	}
+	for name := range stored {
+		if _, ok := sentinel.Partitions[name]; !ok {
+			return errors.Wrapf(ErrPartitionMismatch, "verifyStoredPartitions: partition %s of %s is not recorded in sentinel", name, *bk.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package walg
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/pkg/errors"
+)
+
+func TestVerifyStoredPartitions(t *testing.T) {
+	prefix := "server/basebackups_005/base_000000010000000000000002/tar_partitions/"
+	svc := &listObjectsS3{objects: map[string]int64{
+		prefix + "part_1.tar.lz4":     100,
+		prefix + "pg_control.tar.lz4": 10,
+	}}
+	bk := &Backup{
+		Prefix: &Prefix{Svc: svc, Bucket: aws.String("bucket"), Server: aws.String("server")},
+		Path:   aws.String("server/basebackups_005/"),
+		Name:   aws.String("base_000000010000000000000002"),
+	}
+	sentinel := S3TarBallSentinelDto{Partitions: map[string]PartitionDescription{
+		"part_1.tar.lz4":     {Size: 100, Sha256: "1"},
+		"pg_control.tar.lz4": {Size: 10, Sha256: "2"},
+	}}
+
+	if err := verifyStoredPartitions(bk, sentinel); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyStoredPartitions(bk, S3TarBallSentinelDto{}); err != nil {
+		t.Fatalf("backup without recorded partitions is not expected to fail: %v", err)
+	}
+
+	svc.objects[prefix+"part_1.tar.lz4"] = 99
+	if err := verifyStoredPartitions(bk, sentinel); errors.Cause(err) != ErrPartitionMismatch {
+		t.Errorf("expected partition mismatch for truncated partition, got %v", err)
+	}
+
+	delete(svc.objects, prefix+"part_1.tar.lz4")
+	if err := verifyStoredPartitions(bk, sentinel); errors.Cause(err) != ErrPartitionMismatch {
+		t.Errorf("expected partition mismatch for missing partition, got %v", err)
+	}
+
+	svc.objects[prefix+"part_1.tar.lz4"] = 100
+	svc.objects[prefix+"part_2.tar.lz4"] = 100
+	if err := verifyStoredPartitions(bk, sentinel); errors.Cause(err) != ErrPartitionMismatch {
+		t.Errorf("expected partition mismatch for unrecorded partition, got %v", err)
+	}
+}
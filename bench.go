@@ -0,0 +1,203 @@
+package walg
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pierrec/lz4"
+	"github.com/pkg/errors"
+)
+
+// BenchUsage is a text message explaining how to use bench
+var BenchUsage = "usage:\twal-g bench compress data_directory [sample_mb]   compression speed and ratio on files of data directory" + `
+	wal-g bench upload [size_mb [concurrency ...]]        storage throughput for each upload concurrency
+`
+
+func printBenchUsageAndFail() {
+	log.Fatal(BenchUsage)
+}
+
+// CountingWriter discards data and counts written bytes
+type CountingWriter struct {
+	Count int64
+}
+
+func (w *CountingWriter) Write(p []byte) (int, error) {
+	w.Count += int64(len(p))
+	return len(p), nil
+}
+
+// benchCodecs are compressors available for comparison
+var benchCodecs = map[string]func(io.Writer) io.WriteCloser{
+	"lz4": func(w io.Writer) io.WriteCloser { return lz4.NewWriter(w) },
+	"gzip-fast": func(w io.Writer) io.WriteCloser {
+		gz, _ := gzip.NewWriterLevel(w, gzip.BestSpeed)
+		return gz
+	},
+	"gzip": func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+}
+
+// CompressionBenchResult describes performance of one codec on the sample
+type CompressionBenchResult struct {
+	Codec        string
+	Uncompressed int64
+	Compressed   int64
+	Duration     time.Duration
+}
+
+// Ratio of uncompressed to compressed size
+func (r CompressionBenchResult) Ratio() float64 {
+	if r.Compressed == 0 {
+		return 0
+	}
+	return float64(r.Uncompressed) / float64(r.Compressed)
+}
+
+// Speed in uncompressed MB per second
+func (r CompressionBenchResult) Speed() float64 {
+	return float64(r.Uncompressed) / 1024 / 1024 / r.Duration.Seconds()
+}
+
+// HandleBench is invoked to perform wal-g bench
+func HandleBench(tu *TarUploader, pre *Prefix, args []string) {
+	if len(args) < 2 {
+		printBenchUsageAndFail()
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+	defer w.Flush()
+
+	switch args[1] {
+	case "compress":
+		if len(args) < 3 {
+			printBenchUsageAndFail()
+		}
+		sampleMb := parseBenchNumber(args, 3, 256)
+		files, err := sampleDataFiles(args[2], int64(sampleMb)*1024*1024)
+		if err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+		fmt.Fprintln(w, "codec\tuncompressed_bytes\tcompressed_bytes\tratio\tMB/s")
+		for _, codec := range []string{"lz4", "gzip-fast", "gzip"} {
+			result, err := benchCompression(codec, files)
+			if err != nil {
+				log.Fatalf("%+v\n", err)
+			}
+			fmt.Fprintf(w, "%v\t%v\t%v\t%.2f\t%.1f\n", codec, result.Uncompressed, result.Compressed, result.Ratio(), result.Speed())
+		}
+	case "upload":
+		sizeMb := parseBenchNumber(args, 2, 100)
+		concurrencies := []int{1, 4, getMaxUploadConcurrency(10)}
+		if len(args) > 3 {
+			concurrencies = concurrencies[:0]
+			for i := 3; i < len(args); i++ {
+				concurrencies = append(concurrencies, parseBenchNumber(args, i, 1))
+			}
+		}
+		fmt.Fprintln(w, "concurrency\tbytes\tseconds\tMB/s")
+		for _, concurrency := range concurrencies {
+			duration, err := benchUpload(tu, pre, int64(sizeMb)*1024*1024, concurrency)
+			if err != nil {
+				log.Fatalf("%+v\n", err)
+			}
+			fmt.Fprintf(w, "%v\t%v\t%.1f\t%.1f\n", concurrency, sizeMb*1024*1024, duration.Seconds(), float64(sizeMb)/duration.Seconds())
+		}
+	default:
+		printBenchUsageAndFail()
+	}
+}
+
+func parseBenchNumber(args []string, index int, defaultValue int) int {
+	if len(args) <= index {
+		return defaultValue
+	}
+	value, err := strconv.Atoi(args[index])
+	if err != nil || value <= 0 {
+		log.Printf("Cannot parse positive number %v\n", args[index])
+		printBenchUsageAndFail()
+	}
+	return value
+}
+
+// sampleDataFiles collects regular files of directory until their total size reaches limit
+func sampleDataFiles(dir string, limit int64) ([]string, error) {
+	files := make([]string, 0)
+	var total int64
+	errEnough := errors.New("sample is collected")
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil // files can disappear during walk of live cluster
+		}
+		if info.Mode().IsRegular() && info.Size() > 0 {
+			files = append(files, path)
+			total += info.Size()
+		}
+		if total >= limit {
+			return errEnough
+		}
+		return nil
+	})
+	if err != nil && err != errEnough {
+		return nil, errors.Wrap(err, "sampleDataFiles: walk failed")
+	}
+	if len(files) == 0 {
+		return nil, errors.Errorf("sampleDataFiles: no files found in %s", dir)
+	}
+	return files, nil
+}
+
+func benchCompression(codec string, files []string) (result CompressionBenchResult, err error) {
+	result.Codec = codec
+	counter := &CountingWriter{}
+	compressor := benchCodecs[codec](counter)
+
+	start := time.Now()
+	for _, path := range files {
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		n, err := io.Copy(compressor, f)
+		f.Close()
+		if err != nil {
+			return result, errors.Wrapf(err, "benchCompression: %s failed on %s", codec, path)
+		}
+		result.Uncompressed += n
+	}
+	if err = compressor.Close(); err != nil {
+		return result, errors.Wrapf(err, "benchCompression: %s close failed", codec)
+	}
+	result.Duration = time.Since(start)
+	result.Compressed = counter.Count
+	return result, nil
+}
+
+// benchUpload uploads incompressible data of given size with the concurrency and deletes it
+func benchUpload(tu *TarUploader, pre *Prefix, size int64, concurrency int) (time.Duration, error) {
+	key := sanitizePath(fmt.Sprintf("%v/wal-g-bench-%d", *pre.Server, time.Now().UnixNano()))
+	uploader := tu.Clone()
+	uploader.Upl = CreateUploader(pre.Svc, 20*1024*1024, concurrency)
+	data := &io.LimitedReader{R: rand.New(rand.NewSource(time.Now().UnixNano())), N: size}
+
+	start := time.Now()
+	err := uploader.upload(uploader.createUploadInput(key, data), key)
+	duration := time.Since(start)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = pre.Svc.DeleteObject(&s3.DeleteObjectInput{Bucket: pre.Bucket, Key: aws.String(key)})
+	if err != nil {
+		log.Printf("WARNING! Unable to delete benchmark object %v: %v\n", key, err)
+	}
+	return duration, nil
+}
@@ -0,0 +1,43 @@
+package walg
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBenchCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bench")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := bytes.Repeat([]byte("compressible page content "), 4096)
+	for _, name := range []string{"16384", "16385", "16386"} {
+		err = ioutil.WriteFile(filepath.Join(dir, name), content, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := sampleDataFiles(dir, int64(len(content)*2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("bench: expected 2 files in sample, got %v", files)
+	}
+
+	for codec := range benchCodecs {
+		result, err := benchCompression(codec, files)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Uncompressed != int64(len(content)*2) || result.Ratio() <= 1 {
+			t.Errorf("bench: unexpected result for %v: %+v", codec, result)
+		}
+	}
+}
@@ -45,6 +45,12 @@ func (u *BgUploader) Start(walFilePath string, maxParallelWorkers int32, tu *Tar
 	if maxParallelWorkers < 1 {
 		return // Nothing to start
 	}
+	// WAL files are uploaded from directory of the file handed to wal-push, whatever its name is
+	walFilePath = getWalFileLocation(walFilePath)
+	if _, err := os.Stat(filepath.Join(filepath.Dir(walFilePath), archiveStatus)); err != nil {
+		log.Printf("Parallel upload is disabled, %v is not a WAL directory: %v\n", filepath.Dir(walFilePath), err)
+		return
+	}
 	// prepare state
 	u.tu = tu
 	u.maxParallelWorkers = maxParallelWorkers
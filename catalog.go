@@ -0,0 +1,143 @@
+package walg
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// CatalogUsage is a text message explaining how to use catalog
+var CatalogUsage = "usage:\twal-g catalog [path]" + `
+Finds server prefixes with backups or WAL under path in the bucket (the whole bucket by default) and prints
+newest backup, newest WAL, number of objects and stored bytes of each.
+`
+
+// CatalogItem describes one server prefix found in the bucket
+type CatalogItem struct {
+	Server       string
+	NewestBackup string
+	BackupTime   time.Time
+	NewestWal    string
+	WalTime      time.Time
+	Objects      int
+	Size         int64
+}
+
+// HandleCatalog is invoked to perform wal-g catalog
+func HandleCatalog(pre *Prefix, args []string) {
+	if len(args) > 2 {
+		log.Fatal(CatalogUsage)
+	}
+	root := ""
+	if len(args) == 2 {
+		root = strings.Trim(args[1], "/") + "/"
+	}
+
+	objects := make([]*s3.Object, 0)
+	err := listAllObjects(pre, root, func(ob *s3.Object) {
+		objects = append(objects, ob)
+	})
+	if err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+	printCatalog(os.Stdout, buildCatalog(objects))
+}
+
+// buildCatalog groups objects by server prefix. Server prefix is the path before backup or WAL folder,
+// object belongs to the longest server prefix it starts with, so nested servers are told apart.
+func buildCatalog(objects []*s3.Object) []*CatalogItem {
+	backupFolder := "/" + strings.TrimSuffix(backupFolderPath(""), "/") + "/"
+	walFolder := "/" + strings.TrimSuffix(walFolderPath(""), "/") + "/"
+
+	items := make(map[string]*CatalogItem)
+	for _, ob := range objects {
+		key := "/" + *ob.Key
+		for _, folder := range []string{backupFolder, walFolder} {
+			if i := strings.Index(key, folder); i >= 0 {
+				server := strings.TrimPrefix(key[:i], "/")
+				if _, ok := items[server]; !ok {
+					items[server] = &CatalogItem{Server: server}
+				}
+			}
+		}
+	}
+
+	servers := make([]string, 0, len(items))
+	for server := range items {
+		servers = append(servers, server)
+	}
+	// Longer prefixes first to find the longest match
+	sort.Slice(servers, func(i, j int) bool {
+		return len(servers[i]) > len(servers[j])
+	})
+
+	for _, ob := range objects {
+		key := *ob.Key
+		for _, server := range servers {
+			serverPath := server + "/"
+			if server == "" {
+				serverPath = ""
+			}
+			if !strings.HasPrefix(key, serverPath) {
+				continue
+			}
+			item := items[server]
+			item.Objects++
+			item.Size += *ob.Size
+			relative := "/" + strings.TrimPrefix(key, serverPath)
+			if strings.HasPrefix(relative, backupFolder) && strings.HasSuffix(key, SentinelSuffix) &&
+				!strings.Contains(strings.TrimPrefix(relative, backupFolder), "/") && ob.LastModified.After(item.BackupTime) {
+				item.NewestBackup = strings.TrimSuffix(path.Base(key), SentinelSuffix)
+				item.BackupTime = *ob.LastModified
+			}
+			if strings.HasPrefix(relative, walFolder) {
+				if segment, ok := parseWalSegmentKey(key); ok && segment.Name() > item.NewestWal {
+					item.NewestWal = segment.Name()
+					item.WalTime = *ob.LastModified
+				}
+			}
+			break
+		}
+	}
+
+	result := make([]*CatalogItem, 0, len(items))
+	for _, item := range items {
+		result = append(result, item)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Server < result[j].Server
+	})
+	return result
+}
+
+func printCatalog(output io.Writer, items []*CatalogItem) {
+	w := tabwriter.NewWriter(output, 0, 0, 1, ' ', 0)
+	defer w.Flush()
+	fmt.Fprintln(w, "server\tnewest_backup\tbackup_time\tnewest_wal\twal_time\tobjects\tstored_bytes")
+	for _, item := range items {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n", item.Server, orDash(item.NewestBackup), formatCatalogTime(item.BackupTime),
+			orDash(item.NewestWal), formatCatalogTime(item.WalTime), item.Objects, item.Size)
+	}
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+func formatCatalogTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
@@ -0,0 +1,45 @@
+package walg
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestBuildCatalog(t *testing.T) {
+	now := time.Now()
+	object := func(key string, size int64, modified time.Time) *s3.Object {
+		return &s3.Object{Key: aws.String(key), Size: aws.Int64(size), LastModified: aws.Time(modified)}
+	}
+	objects := []*s3.Object{
+		object("db1/basebackups_005/base_000000010000000000000002_backup_stop_sentinel.json", 10, now.Add(-2*time.Hour)),
+		object("db1/basebackups_005/base_000000010000000000000002/tar_partitions/part_1.tar.lz4", 100, now.Add(-2*time.Hour)),
+		object("db1/basebackups_005/base_000000010000000000000005_backup_stop_sentinel.json", 10, now.Add(-time.Hour)),
+		object("db1/wal_005/000000010000000000000005.lz4", 50, now),
+		object("db1/wal_005/000000010000000000000004.lz4", 50, now),
+		object("db1/replica/wal_005/000000020000000000000001.lz4", 50, now),
+		object("unrelated/file", 1, now),
+	}
+
+	items := buildCatalog(objects)
+	if len(items) != 2 || items[0].Server != "db1" || items[1].Server != "db1/replica" {
+		t.Fatalf("Unexpected servers %+v", items)
+	}
+	if items[0].NewestBackup != "base_000000010000000000000005" || items[0].NewestWal != "000000010000000000000005" ||
+		items[0].Objects != 5 || items[0].Size != 220 {
+		t.Fatalf("Unexpected catalog item %+v", items[0])
+	}
+	if items[1].NewestBackup != "" || items[1].Objects != 1 {
+		t.Fatalf("Unexpected catalog item %+v", items[1])
+	}
+
+	var output bytes.Buffer
+	printCatalog(&output, items)
+	if !strings.Contains(output.String(), "db1/replica -") {
+		t.Fatalf("Unexpected output %v", output.String())
+	}
+}
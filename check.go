@@ -0,0 +1,173 @@
+package walg
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/jackc/pgx"
+	"github.com/pkg/errors"
+)
+
+// CheckFinding is a result of one diagnostic step of wal-g check
+type CheckFinding struct {
+	Name    string
+	Failed  bool
+	Warning bool
+	Message string
+}
+
+func (finding CheckFinding) String() string {
+	status := "OK"
+	if finding.Failed {
+		status = "FAIL"
+	} else if finding.Warning {
+		status = "WARN"
+	}
+	return fmt.Sprintf("[%-4s] %s: %s", status, finding.Name, finding.Message)
+}
+
+// HandleCheck is invoked to perform wal-g check. It validates configuration end-to-end and
+// prints findings. Exits with non-zero status if any of the checks failed.
+func HandleCheck() {
+	findings := make([]CheckFinding, 0)
+
+	tu, pre, err := Configure()
+	if err != nil {
+		findings = append(findings, CheckFinding{"storage configuration", true, false,
+			fmt.Sprintf("%v. Check WALE_S3_PREFIX, AWS credentials and AWS_REGION.", err)})
+	} else {
+		findings = append(findings, CheckFinding{"storage configuration", false, false,
+			fmt.Sprintf("bucket %v, path '%v', region %v", *pre.Bucket, *pre.Server, tu.region)})
+		findings = append(findings, checkStorageRoundTrip(tu, pre))
+		findings = append(findings, checkBackupListing(pre))
+	}
+
+	findings = append(findings, checkPostgres()...)
+
+	failed := false
+	for _, finding := range findings {
+		fmt.Println(finding)
+		failed = failed || finding.Failed
+	}
+	if failed {
+		EmitEvent(Event{Event: EventFailed, Error: "check failed"})
+		os.Exit(1)
+	}
+}
+
+// checkStorageRoundTrip writes, reads back and deletes a small object in the prefix
+func checkStorageRoundTrip(tu *TarUploader, pre *Prefix) CheckFinding {
+	const name = "storage write/read/delete"
+	host, _ := os.Hostname()
+	content := []byte(fmt.Sprintf("wal-g check from %v at %v", host, time.Now().UTC().Format(time.RFC3339Nano)))
+	key := sanitizePath(fmt.Sprintf("%v/wal-g-check-%v-%d", *pre.Server, host, time.Now().UnixNano()))
+
+	err := tu.upload(tu.createUploadInput(key, bytes.NewReader(content)), key)
+	if err != nil {
+		return CheckFinding{name, true, false, fmt.Sprintf("upload of %v failed: %v. Check s3:PutObject permission and SSE settings.", key, err)}
+	}
+
+	a := &Archive{Prefix: pre, Archive: aws.String(key)}
+	reader, err := a.GetArchive()
+	if err != nil {
+		return CheckFinding{name, true, false, fmt.Sprintf("download of %v failed: %v. Check s3:GetObject permission.", key, err)}
+	}
+	readBack, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil || !bytes.Equal(readBack, content) {
+		return CheckFinding{name, true, false, fmt.Sprintf("content of %v read back differs from written: %v", key, err)}
+	}
+
+	_, err = pre.Svc.DeleteObject(&s3.DeleteObjectInput{Bucket: pre.Bucket, Key: aws.String(key)})
+	if err != nil {
+		return CheckFinding{name, true, false, fmt.Sprintf("delete of %v failed: %v. Check s3:DeleteObject permission, it is required by delete command.", key, err)}
+	}
+	return CheckFinding{name, false, false, "round-trip succeeded"}
+}
+
+func checkBackupListing(pre *Prefix) CheckFinding {
+	const name = "backup listing"
+	var bk = &Backup{
+		Prefix: pre,
+		Path:   GetBackupPath(pre),
+	}
+	backups, err := bk.GetBackups()
+	if err == ErrLatestNotFound {
+		return CheckFinding{name, false, true, "no backups found yet, run backup-push"}
+	}
+	if err != nil {
+		return CheckFinding{name, true, false, fmt.Sprintf("%v. Check s3:ListBucket permission.", err)}
+	}
+	return CheckFinding{name, false, false, fmt.Sprintf("%d backups, latest %v at %v", len(backups), backups[0].Name, backups[0].Time.Format(time.RFC3339))}
+}
+
+// checkPostgres verifies connectivity and archiving settings of the server
+func checkPostgres() []CheckFinding {
+	const name = "postgres connection"
+	config, err := GetPgConnConfig()
+	if err != nil {
+		return []CheckFinding{{name, true, false, fmt.Sprintf("invalid connection settings: %v", err)}}
+	}
+	conn, err := pgx.Connect(config)
+	if err != nil {
+		return []CheckFinding{{name, true, false, fmt.Sprintf("%v. Check WALG_PG_* or PGHOST, PGPORT, PGUSER and PGPASSWORD/.pgpass.", err)}}
+	}
+	defer conn.Close()
+
+	queryRunner, err := NewPgQueryRunner(conn)
+	if err != nil {
+		return []CheckFinding{{name, true, false, err.Error()}}
+	}
+	findings := []CheckFinding{{name, false, false, fmt.Sprintf("connected to PostgreSQL %v", FormatPgMajorVersion(queryRunner.Version))}}
+	if queryRunner.Version < 90000 {
+		findings[0].Failed = true
+		findings[0].Message += ", WAL-G requires 9.0 or newer"
+	}
+	return append(findings, checkArchiving(conn)...)
+}
+
+func checkArchiving(conn *pgx.Conn) []CheckFinding {
+	var archiveMode, archiveCommand, walLevel string
+	err := conn.QueryRow("show archive_mode").Scan(&archiveMode)
+	if err == nil {
+		err = conn.QueryRow("show archive_command").Scan(&archiveCommand)
+	}
+	if err == nil {
+		err = conn.QueryRow("show wal_level").Scan(&walLevel)
+	}
+	if err != nil {
+		return []CheckFinding{{"archiving settings", true, false, errors.Wrap(err, "unable to read settings").Error()}}
+	}
+	return evaluateArchiving(archiveMode, archiveCommand, walLevel)
+}
+
+// evaluateArchiving checks that settings of the server archive WAL with WAL-G
+func evaluateArchiving(archiveMode string, archiveCommand string, walLevel string) []CheckFinding {
+	findings := make([]CheckFinding, 0, 3)
+	if archiveMode != "on" && archiveMode != "always" {
+		findings = append(findings, CheckFinding{"archive_mode", true, false, fmt.Sprintf("is '%v', set archive_mode = on and restart the server, otherwise backups are inconsistent", archiveMode)})
+	} else {
+		findings = append(findings, CheckFinding{"archive_mode", false, false, archiveMode})
+	}
+
+	if len(archiveCommand) == 0 || archiveCommand == "(disabled)" {
+		findings = append(findings, CheckFinding{"archive_command", true, false, "is not configured, set archive_command = 'wal-g wal-push %p'"})
+	} else if !strings.Contains(archiveCommand, "wal-g") || !strings.Contains(archiveCommand, "%p") {
+		findings = append(findings, CheckFinding{"archive_command", false, true, fmt.Sprintf("'%v' does not look like 'wal-g wal-push %%p'", archiveCommand)})
+	} else {
+		findings = append(findings, CheckFinding{"archive_command", false, false, archiveCommand})
+	}
+
+	if walLevel == "minimal" {
+		findings = append(findings, CheckFinding{"wal_level", true, false, "is 'minimal', WAL archiving requires 'replica' or higher"})
+	} else {
+		findings = append(findings, CheckFinding{"wal_level", false, false, walLevel})
+	}
+	return findings
+}
@@ -0,0 +1,57 @@
+package walg
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestEvaluateArchiving(t *testing.T) {
+	for _, test := range []struct {
+		archiveMode    string
+		archiveCommand string
+		walLevel       string
+		failed         []bool
+		warning        []bool
+	}{
+		{"on", "wal-g wal-push %p", "replica", []bool{false, false, false}, []bool{false, false, false}},
+		{"always", "envdir /etc/wal-g.d/env wal-g wal-push %p", "logical", []bool{false, false, false}, []bool{false, false, false}},
+		{"off", "wal-g wal-push %p", "replica", []bool{true, false, false}, []bool{false, false, false}},
+		{"on", "", "replica", []bool{false, true, false}, []bool{false, false, false}},
+		{"on", "(disabled)", "replica", []bool{false, true, false}, []bool{false, false, false}},
+		{"on", "cp %p /mnt/archive/%f", "replica", []bool{false, false, false}, []bool{false, true, false}},
+		{"on", "wal-g wal-push %p", "minimal", []bool{false, false, true}, []bool{false, false, false}},
+	} {
+		findings := evaluateArchiving(test.archiveMode, test.archiveCommand, test.walLevel)
+		failed, warning := make([]bool, 0), make([]bool, 0)
+		for _, finding := range findings {
+			failed = append(failed, finding.Failed)
+			warning = append(warning, finding.Warning)
+		}
+		if !reflect.DeepEqual(failed, test.failed) || !reflect.DeepEqual(warning, test.warning) {
+			t.Errorf("evaluateArchiving: %v for %s, '%s', %s", findings, test.archiveMode, test.archiveCommand, test.walLevel)
+		}
+	}
+}
+
+func TestCheckBackupListing(t *testing.T) {
+	svc := &listObjectsS3{objects: map[string]int64{}}
+	pre := &Prefix{Svc: svc, Bucket: aws.String("bucket"), Server: aws.String("server")}
+	if finding := checkBackupListing(pre); finding.Failed || !finding.Warning {
+		t.Errorf("checkBackupListing: %v for empty storage", finding)
+	}
+
+	svc.objects["server/basebackups_005/base_000000010000000000000002_backup_stop_sentinel.json"] = 100
+	finding := checkBackupListing(pre)
+	if finding.Failed || finding.Warning || !strings.Contains(finding.Message, "base_000000010000000000000002") {
+		t.Errorf("checkBackupListing: %v for one backup", finding)
+	}
+
+	// Truncated page without continuation token can not be listed further
+	pre.Svc = &truncatedListS3{keys: []string{"server/basebackups_005/base_000000010000000000000002_backup_stop_sentinel.json"}}
+	if finding := checkBackupListing(pre); !finding.Failed {
+		t.Errorf("checkBackupListing: %v for failed listing", finding)
+	}
+}
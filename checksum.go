@@ -0,0 +1,156 @@
+package walg
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"io/ioutil"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/pkg/errors"
+)
+
+// ChecksumMetadataKey is the user metadata key holding SHA256 of the uploaded object as computed by WAL-G.
+// Unlike ETag it does not depend on multipart upload and server side encryption settings.
+const ChecksumMetadataKey = "Walg-Sha256"
+
+// EncryptedMetadataKey is the user metadata key marking sentinels encrypted with WALG_ENCRYPT_METADATA
+const EncryptedMetadataKey = "Walg-Encrypted"
+
+// ErrChecksumMismatch happens when stored object differs from the uploaded data
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// GetChecksum acquires SHA256 stored in object metadata and object size from S3.
+// Empty checksum is returned for objects uploaded without it.
+func (a *Archive) GetChecksum() (sum string, size int64, err error) {
+	h, err := headObject(a.Prefix.Svc, a.Prefix.Bucket, a.Archive)
+	if err != nil {
+		return "", 0, errors.Wrapf(err, "GetChecksum: HEAD of %s failed", *a.Archive)
+	}
+	if h.ContentLength != nil {
+		size = *h.ContentLength
+	}
+	return aws.StringValue(h.Metadata[ChecksumMetadataKey]), size, nil
+}
+
+// verifyUploadedChecksum checks that object in storage has expected checksum and size
+func verifyUploadedChecksum(pre *Prefix, key string, sum string, size int64) error {
+	a := &Archive{Prefix: pre, Archive: aws.String(key)}
+	storedSum, storedSize, err := a.GetChecksum()
+	if err != nil {
+		return err
+	}
+	if storedSum != sum || storedSize != size {
+		return errors.Wrapf(ErrChecksumMismatch, "verifyUploadedChecksum: %s is %d bytes with sha256 '%s', uploaded %d bytes with sha256 '%s'",
+			key, storedSize, storedSum, size, sum)
+	}
+	return nil
+}
+
+// readSentinelObject downloads small object, e.g. sentinel, and verifies SHA256 stored in its metadata.
+// Objects uploaded without checksum are not verified, encrypted ones are decrypted.
+func readSentinelObject(pre *Prefix, key string) ([]byte, error) {
+	body, metadata, err := downloadObjectWithMetadata(pre.Svc, pre.Bucket, key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "readSentinelObject: failed to download %s", key)
+	}
+	defer body.Close()
+	content, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "readSentinelObject: failed to download %s", key)
+	}
+	expected := aws.StringValue(metadata[ChecksumMetadataKey])
+	if sum := sha256Hex(content); expected != "" && expected != sum {
+		return nil, errors.Wrapf(ErrChecksumMismatch, "readSentinelObject: %s has sha256 '%s', expected '%s'", key, sum, expected)
+	}
+	if aws.StringValue(metadata[EncryptedMetadataKey]) == "true" {
+		content, err = decryptMetadata(content)
+		if err != nil {
+			return nil, errors.Wrapf(err, "readSentinelObject: failed to decrypt %s", key)
+		}
+	}
+	return content, nil
+}
+
+type sha256Reader struct {
+	internal io.Reader
+	hash     hash.Hash
+	size     int64
+}
+
+func newSha256Reader(reader io.Reader) *sha256Reader {
+	return &sha256Reader{internal: reader, hash: sha256.New()}
+}
+
+func (r *sha256Reader) Read(p []byte) (n int, err error) {
+	n, err = r.internal.Read(p)
+	r.hash.Write(p[:n])
+	r.size += int64(n)
+	return
+}
+
+// Size returns number of bytes read so far
+func (r *sha256Reader) Size() int64 {
+	return r.size
+}
+
+// Sum returns hex encoded SHA256 of data read so far
+func (r *sha256Reader) Sum() string {
+	return hex.EncodeToString(r.hash.Sum(nil))
+}
+
+// verifyingReader fails when object turns out to differ from its description: as soon as it is longer
+// than recorded or at the end of object when its size or SHA256 differ
+type verifyingReader struct {
+	*sha256Reader
+	closer      io.Closer
+	key         string
+	description PartitionDescription
+}
+
+func newVerifyingReader(object io.ReadCloser, key string, description PartitionDescription) io.ReadCloser {
+	return &verifyingReader{newSha256Reader(object), object, key, description}
+}
+
+func (r *verifyingReader) Read(p []byte) (n int, err error) {
+	n, err = r.sha256Reader.Read(p)
+	if r.Size() > r.description.Size {
+		return n, errors.Wrapf(ErrChecksumMismatch, "verifyingReader: %s is longer than %d bytes", r.key, r.description.Size)
+	}
+	if err == io.EOF && (r.Size() != r.description.Size || r.Sum() != r.description.Sha256) {
+		return n, errors.Wrapf(ErrChecksumMismatch, "verifyingReader: %s is %d bytes with sha256 '%s', expected %d bytes with sha256 '%s'",
+			r.key, r.Size(), r.Sum(), r.description.Size, r.description.Sha256)
+	}
+	return n, err
+}
+
+func (r *verifyingReader) Close() error {
+	return r.closer.Close()
+}
+
+// readBack downloads just uploaded object and compares its SHA256 with the uploaded data.
+// It is used with WALG_UPLOAD_READ_BACK to detect corruption on the way to storage before
+// archive_command reports success or backup is finalized.
+func (tu *TarUploader) readBack(key string, sum string) error {
+	body, err := downloadObject(tu.svc, aws.String(tu.bucket), key)
+	if err != nil {
+		return errors.Wrapf(err, "readBack: failed to download %s", key)
+	}
+	defer body.Close()
+
+	hashReader := newSha256Reader(body)
+	if _, err = io.Copy(ioutil.Discard, hashReader); err != nil {
+		return errors.Wrapf(err, "readBack: failed to download %s", key)
+	}
+	if hashReader.Sum() != sum {
+		return errors.Wrapf(ErrChecksumMismatch, "readBack: %s has sha256 '%s', uploaded '%s'", key, hashReader.Sum(), sum)
+	}
+	infoln("Read back", key)
+	return nil
+}
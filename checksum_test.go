@@ -0,0 +1,155 @@
+package walg
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/pkg/errors"
+)
+
+type headObjectS3 struct {
+	s3iface.S3API
+	output *s3.HeadObjectOutput
+}
+
+func (m *headObjectS3) HeadObject(*s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	return m.output, nil
+}
+
+type getObjectS3 struct {
+	s3iface.S3API
+	content []byte
+}
+
+func (m *getObjectS3) GetObject(*s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewReader(m.content))}, nil
+}
+
+func TestVerifyUploadedChecksum(t *testing.T) {
+	content := []byte("compressed WAL")
+	sum := sha256Hex(content)
+	svc := &headObjectS3{output: &s3.HeadObjectOutput{
+		ContentLength: aws.Int64(int64(len(content))),
+		// ETag of multipart or SSE-KMS object is not md5 of content and must not matter
+		ETag:     aws.String("\"d41d8cd98f00b204e9800998ecf8427e-2\""),
+		Metadata: map[string]*string{ChecksumMetadataKey: aws.String(sum)},
+	}}
+	pre := &Prefix{Svc: svc, Bucket: aws.String("bucket"), Server: aws.String("server")}
+
+	if err := verifyUploadedChecksum(pre, "server/wal_005/000000010000000000000002.lz4", sum, int64(len(content))); err != nil {
+		t.Fatal(err)
+	}
+
+	err := verifyUploadedChecksum(pre, "server/wal_005/000000010000000000000002.lz4", sha256Hex([]byte("other")), int64(len(content)))
+	if errors.Cause(err) != ErrChecksumMismatch {
+		t.Fatalf("expected checksum mismatch, got %v", err)
+	}
+
+	svc.output.Metadata = nil
+	err = verifyUploadedChecksum(pre, "server/wal_005/000000010000000000000002.lz4", sum, int64(len(content)))
+	if errors.Cause(err) != ErrChecksumMismatch {
+		t.Fatalf("expected checksum mismatch for object without checksum, got %v", err)
+	}
+}
+
+func TestReadBack(t *testing.T) {
+	content := []byte("tar partition")
+	svc := &getObjectS3{content: content}
+	tu := NewTarUploader(svc, "bucket", "server", "region")
+
+	if err := tu.readBack("server/basebackups_005/base/tar_partitions/part_1.tar.lz4", sha256Hex(content)); err != nil {
+		t.Fatal(err)
+	}
+
+	svc.content = []byte("tar partitioN")
+	err := tu.readBack("server/basebackups_005/base/tar_partitions/part_1.tar.lz4", sha256Hex(content))
+	if errors.Cause(err) != ErrChecksumMismatch {
+		t.Fatalf("expected checksum mismatch, got %v", err)
+	}
+}
+
+func TestVerifyingReader(t *testing.T) {
+	content := []byte("tar partition")
+	description := PartitionDescription{Size: int64(len(content)), Sha256: sha256Hex(content)}
+
+	reader := newVerifyingReader(ioutil.NopCloser(bytes.NewReader(content)), "part_1.tar.lz4", description)
+	if _, err := ioutil.ReadAll(reader); err != nil {
+		t.Fatal(err)
+	}
+
+	reader = newVerifyingReader(ioutil.NopCloser(bytes.NewReader([]byte("tar partitioN"))), "part_1.tar.lz4", description)
+	if _, err := ioutil.ReadAll(reader); errors.Cause(err) != ErrChecksumMismatch {
+		t.Fatalf("expected checksum mismatch, got %v", err)
+	}
+
+	reader = newVerifyingReader(ioutil.NopCloser(bytes.NewReader([]byte("tar partition and more"))), "part_1.tar.lz4", description)
+	if _, err := ioutil.ReadAll(reader); errors.Cause(err) != ErrChecksumMismatch {
+		t.Fatalf("expected checksum mismatch for longer object, got %v", err)
+	}
+}
+
+type sentinelS3 struct {
+	s3iface.S3API
+	content  []byte
+	metadata map[string]*string
+}
+
+func (m *sentinelS3) GetObject(*s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewReader(m.content)), Metadata: m.metadata}, nil
+}
+
+func TestReadSentinelObject(t *testing.T) {
+	content := []byte(`{"LSN":1}`)
+	svc := &sentinelS3{content: content, metadata: map[string]*string{ChecksumMetadataKey: aws.String(sha256Hex(content))}}
+	pre := &Prefix{Svc: svc, Bucket: aws.String("bucket"), Server: aws.String("server")}
+
+	if _, err := readSentinelObject(pre, "server/basebackups_005/base_backup_stop_sentinel.json"); err != nil {
+		t.Fatal(err)
+	}
+
+	svc.content = []byte(`{"LSN":2}`)
+	_, err := readSentinelObject(pre, "server/basebackups_005/base_backup_stop_sentinel.json")
+	if errors.Cause(err) != ErrChecksumMismatch {
+		t.Fatalf("expected checksum mismatch, got %v", err)
+	}
+
+	svc.metadata = nil
+	if _, err = readSentinelObject(pre, "server/basebackups_005/base_backup_stop_sentinel.json"); err != nil {
+		t.Fatalf("object without checksum is not expected to fail: %v", err)
+	}
+}
+
+func TestReadEncryptedSentinelWithoutKey(t *testing.T) {
+	content := []byte("encrypted sentinel")
+	svc := &sentinelS3{content: content, metadata: map[string]*string{
+		ChecksumMetadataKey:  aws.String(sha256Hex(content)),
+		EncryptedMetadataKey: aws.String("true"),
+	}}
+	pre := &Prefix{Svc: svc, Bucket: aws.String("bucket"), Server: aws.String("server")}
+
+	_, err := readSentinelObject(pre, "server/basebackups_005/base_backup_stop_sentinel.json")
+	if errors.Cause(err) != ErrMetadataKeyMissing {
+		t.Fatalf("expected missing key error, got %v", err)
+	}
+}
+
+func TestCreateSentinelUploadInput(t *testing.T) {
+	body := []byte(`{"LSN":1}`)
+	tu := NewTarUploader(&sentinelS3{}, "bucket", "server", "region")
+	input, err := tu.createSentinelUploadInput("server/basebackups_005/base_backup_stop_sentinel.json", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aws.StringValue(input.Metadata[ChecksumMetadataKey]) != sha256Hex(body) || input.Metadata[EncryptedMetadataKey] != nil {
+		t.Errorf("unexpected metadata of plaintext sentinel %v", input.Metadata)
+	}
+
+	tu.EncryptMetadata = true
+	if _, err = tu.createSentinelUploadInput("server/basebackups_005/base_backup_stop_sentinel.json", body); errors.Cause(err) != ErrMetadataKeyMissing {
+		t.Errorf("expected missing key error, got %v", err)
+	}
+}
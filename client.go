@@ -0,0 +1,115 @@
+package walg
+
+import (
+	"io"
+	"log"
+)
+
+// Config configures WAL-G embedded into another program
+type Config struct {
+	// Settings override environment variables of the same names, e.g. WALE_S3_PREFIX, AWS_ACCESS_KEY_ID,
+	// WALG_COMPRESSION_METHOD. Variables which are not overridden are still read from environment.
+	Settings map[string]string
+	// Log receives messages WAL-G prints to standard logger and informational messages it prints to stdout,
+	// e.g. names of restored files. Nil keeps both outputs.
+	Log io.Writer
+	// TransferMiddleware wraps every upload and download of objects, it replaces middleware registered before.
+	// Nil keeps middleware registered with UseTransferMiddleware.
+	TransferMiddleware []TransferMiddleware
+}
+
+// apply installs settings, log output and transfer middleware, all are global for the process
+func (config Config) apply() (*TarUploader, *Prefix, error) {
+	if config.Log != nil {
+		log.SetOutput(config.Log)
+		infoOutput = config.Log
+	}
+	SetSettings(config.Settings)
+	if config.TransferMiddleware != nil {
+		SetTransferMiddleware(config.TransferMiddleware)
+	}
+	return Configure()
+}
+
+// Uploader pushes WAL and restore points to storage, its methods return errors instead of exiting the process.
+// Backups are pushed with backup-push command only, it still exits on errors.
+type Uploader struct {
+	tarUploader *TarUploader
+	prefix      *Prefix
+}
+
+// NewUploader connects to storage configured by config
+func NewUploader(config Config) (*Uploader, error) {
+	tu, pre, err := config.apply()
+	if err != nil {
+		return nil, err
+	}
+	return &Uploader{tarUploader: tu, prefix: pre}, nil
+}
+
+// PushWAL uploads WAL segment or history file, verify reads it back from storage after upload
+func (uploader *Uploader) PushWAL(path string, verify bool) error {
+	_, err := uploader.tarUploader.UploadWal(path, uploader.prefix, verify)
+	return err
+}
+
+// CreateRestorePoint creates named restore point in the database configured by PG* settings
+func (uploader *Uploader) CreateRestorePoint(name string) (RestorePoint, error) {
+	return CreateRestorePoint(uploader.tarUploader, uploader.prefix, name)
+}
+
+// Fetcher reads backups and WAL from storage, its methods return errors instead of exiting the process
+type Fetcher struct {
+	prefix *Prefix
+}
+
+// NewFetcher connects to storage configured by config
+func NewFetcher(config Config) (*Fetcher, error) {
+	_, pre, err := config.apply()
+	if err != nil {
+		return nil, err
+	}
+	return &Fetcher{prefix: pre}, nil
+}
+
+// ListBackups returns backups sorted by modification time, the newest is the last
+func (fetcher *Fetcher) ListBackups() ([]BackupTime, error) {
+	bk := &Backup{
+		Prefix: fetcher.prefix,
+		Path:   GetBackupPath(fetcher.prefix),
+	}
+	return bk.GetBackups()
+}
+
+// FetchBackup restores the backup into directory as backup-fetch does, LATEST names the newest backup.
+// LSN of the backup is returned.
+func (fetcher *Fetcher) FetchBackup(backupName string, dirArc string) (uint64, error) {
+	lsn, err := FetchBackup(fetcher.prefix, backupName, dirArc)
+	if err != nil {
+		return 0, err
+	}
+	if lsn == nil {
+		return 0, nil
+	}
+	return *lsn, nil
+}
+
+// FetchBackupFiles extracts only the files of the backup, paths are relative to PGDATA
+func (fetcher *Fetcher) FetchBackupFiles(backupName string, dirArc string, names []string) error {
+	return FetchBackupFiles(fetcher.prefix, backupName, dirArc, names)
+}
+
+// FetchWAL downloads WAL file to location, ErrWalNotFound is the cause of error when it is not archived
+func (fetcher *Fetcher) FetchWAL(walFileName string, location string) error {
+	return FetchWALFile(fetcher.prefix, walFileName, location)
+}
+
+// WriteWAL writes decompressed WAL file to output
+func (fetcher *Fetcher) WriteWAL(walFileName string, output io.Writer) error {
+	return FetchWALFileToWriter(fetcher.prefix, walFileName, output)
+}
+
+// RestoreMissingWal fetches WAL absent in pg_wal of stopped cluster as wal-restore does
+func (fetcher *Fetcher) RestoreMissingWal(pgdata string, timeline uint32) error {
+	return RestoreMissingWal(fetcher.prefix, pgdata, timeline)
+}
@@ -0,0 +1,34 @@
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package walg
+
+import (
+	"os"
+	"syscall"
+)
+
+// ficlone is FICLONE ioctl request of Linux, it shares extents of source with destination
+const ficlone = 0x40049409
+
+// reflinkFile makes destination a copy-on-write clone of source, file systems without reflinks, e.g. ext4,
+// return an error
+func reflinkFile(source string, destination string) error {
+	input, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+	output, err := os.OpenFile(destination, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, output.Fd(), ficlone, input.Fd())
+	output.Close()
+	if errno != 0 {
+		os.Remove(destination)
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux || !(amd64 || arm64)
+// +build !linux !amd64,!arm64
+
+package walg
+
+import "github.com/pkg/errors"
+
+// reflinkFile fails where FICLONE ioctl layout is not known, files are copied instead
+func reflinkFile(source string, destination string) error {
+	return errors.New("reflinks are not supported")
+}
@@ -16,9 +16,41 @@ var l *log.Logger
 var helpMsg = "  backup-fetch\tfetch a backup from S3\n" +
 	"  backup-push\tstarts and uploads a finished backup to S3\n" +
 	"  backup-list\tprints available backups\n" +
+	"  backup-export\twrite a backup as pg_basebackup tar files\n" +
+	"  backup-repair\trebuild lost sentinel of a backup from its tar partitions\n" +
 	"  wal-fetch\tfetch a WAL file from S3\n" +
 	"  wal-push\tupload a WAL file to S3\n" +
-	"  delete\tclear old backups and WALs\n"
+	"  delete\tclear old backups and WALs\n" +
+	"  trash\tlist, restore or purge objects deleted with WALG_DELETE_TO_TRASH\n" +
+	"  versions\tlist object versions of a versioned bucket or restore objects to their state at a time\n" +
+	"  check\tvalidate storage and PostgreSQL configuration\n" +
+	"  st\tlow level storage operations: ls, cat, get, put, rm\n" +
+	"  bench\tmeasure compression and upload throughput\n" +
+	"  init\tcreate bucket if needed, mark prefix with cluster identity and verify permissions\n" +
+	"  lifecycle\tinstall bucket lifecycle rules generated from retention settings\n" +
+	"  wal-compact\tbundle consecutive archived WAL segments into larger objects\n" +
+	"  wal-verify\tverify CRC of WAL records in local segment files\n" +
+	"  wal-dump\tfetch WAL segments of a segment or LSN range and decode them with pg_waldump\n" +
+	"  wal-restore\tfetch WAL segments missing in pg_wal of a stopped cluster, e.g. before pg_rewind\n" +
+	"  wal-fetch-range\tfetch a range of WAL segments into a directory concurrently\n" +
+	"  create-restore-point\tcreate named restore point and record it for backup-fetch --target-name\n" +
+	"  backup-mount\texpose files of a backup read-only via FUSE, extracting them on demand\n" +
+	"  backup-clone\tclone a backup restored once into a cache directory, e.g. for test instances\n" +
+	"  catalog\tnewest backup, newest WAL and size of every server prefix in the bucket\n" +
+	"  storage-usage\tbytes consumed per backup, per WAL timeline and in total\n" +
+	"  scrub\tverify integrity of all backups and WALs in storage\n" +
+	"  replica-verify\tcompare objects with a replica prefix, e.g. DR bucket, and verify its latest backup\n" +
+	"  dump-push\tlogical backup with pg_dump or pg_dumpall\n" +
+	"  dump-fetch\tfetch a logical backup for pg_restore or psql\n" +
+	"  dump-list\tprints available logical backups\n" +
+	"  wal-e-migrate\trecompress WAL-E archive to lz4 and replace WAL-E sentinels\n" +
+	"  stream-push\tupload stdin as a named stream\n" +
+	"  stream-fetch\tfetch a stream to file or stdout\n" +
+	"  stream-list\tprints available streams\n" +
+	"  mysql\tMySQL backups with xtrabackup and binlog archiving\n" +
+	"  mongodb\tMongoDB backups with mongodump and oplog archiving\n" +
+	"  redis\tRedis RDB snapshot backups\n" +
+	"  health\tJSON health report for monitoring, non-zero exit if backups are stale or WALs are missing\n"
 
 func init() {
 	flag.Usage = func() {
@@ -34,6 +66,8 @@ func init() {
 	flag.BoolVar(&showVersion, "v", false, "\tversion")
 	flag.BoolVar(&showVersionVerbose, "version-verbose", false, "\tLong version")
 	flag.BoolVar(&showVersionVerbose, "vv", false, "\tLong version")
+	flag.BoolVar(&quiet, "quiet", false, "\tPrint only warnings and errors, same as WALG_QUIET=true")
+	flag.IntVar(&jsonEventsFd, "json-events", 0, "\tWrite newline-delimited JSON lifecycle events to file descriptor N, e.g. 1 for stdout")
 
 	l = log.New(os.Stderr, "", 0)
 }
@@ -44,6 +78,8 @@ var BuildDate = "devel"
 
 var showVersion bool
 var showVersionVerbose bool
+var jsonEventsFd int
+var quiet bool
 
 func main() {
 	flag.Parse()
@@ -51,6 +87,7 @@ func main() {
 	if WalgVersion == "" {
 		WalgVersion = "devel"
 	}
+	walg.WalgVersion = WalgVersion
 
 	if showVersionVerbose {
 		fmt.Println(WalgVersion, "\t", GitRevision, "\t", BuildDate)
@@ -66,6 +103,16 @@ func main() {
 		l.Fatalf("Please choose a command:\n%s", helpMsg)
 	}
 	command := all[0]
+	walg.ConfigureQuiet(quiet)
+	walg.ConfigureSyslog()
+	// Failed event and traces are written before fatal message exits
+	log.SetOutput(walg.NewFatalLogWriter(log.Writer()))
+	l.SetOutput(walg.NewFatalLogWriter(os.Stderr))
+	if jsonEventsFd > 0 {
+		walg.EnableJSONEvents(jsonEventsFd, command)
+		defer walg.FinishJSONEvents()
+	}
+	defer walg.StartTracing(command)()
 	firstArgument := ""
 	if len(all) > 1 {
 		firstArgument = all[1]
@@ -73,19 +120,26 @@ func main() {
 
 	// Usage strings for supported commands
 	// TODO: refactor arg parsing towards gloang flag usage and more helpful messages
-	if firstArgument == "-h" || firstArgument == "--help" || (firstArgument == "" && command != "backup-list") {
+	if firstArgument == "-h" || firstArgument == "--help" || (firstArgument == "" && command != "backup-list" && command != "check" && command != "health" && command != "scrub" && command != "storage-usage" && command != "catalog" && command != "init" && command != "lifecycle" && command != "wal-compact" && command != "dump-push" && command != "dump-list" && command != "stream-list" && command != "wal-e-migrate") {
+		walg.EmitEvent(walg.Event{Event: walg.EventFailed, Error: "usage"})
 		switch command {
 		case "backup-fetch":
-			fmt.Printf("usage:\twal-g backup-fetch output_directory backup_name\n\twal-g backup-fetch output_directory LATEST\n\n")
+			fmt.Println(walg.BackupFetchUsage)
 			os.Exit(1)
 		case "backup-push":
-			fmt.Printf("usage:\twal-g backup-push backup_directory\n\n")
+			fmt.Println(walg.BackupPushUsage)
 			os.Exit(1)
 		case "backup-list":
-			fmt.Printf("usage:\twal-g backup-list\n\n")
+			fmt.Println(walg.BackupListUsage)
+			os.Exit(1)
+		case "backup-export":
+			fmt.Println(walg.BackupExportUsage)
+			os.Exit(1)
+		case "backup-repair":
+			fmt.Println(walg.BackupRepairUsage)
 			os.Exit(1)
 		case "wal-fetch":
-			fmt.Printf("usage:\twal-g wal-fetch wal_name file_name\n\t   wal_name: name of WAL archive\n\t   file_name: name of file to be written to\n\n")
+			fmt.Printf("usage:\twal-g wal-fetch wal_name file_name\n\t   wal_name: name of WAL archive\n\t   file_name: name of file to be written to, - writes to stdout\n\n")
 			os.Exit(1)
 		case "wal-push":
 			fmt.Printf("usage:\twal-g wal-push archive_path\n\n")
@@ -93,11 +147,91 @@ func main() {
 		case "delete":
 			fmt.Println(walg.DeleteUsage)
 			os.Exit(1)
+		case "trash":
+			fmt.Println(walg.TrashUsage)
+			os.Exit(1)
+		case "versions":
+			fmt.Println(walg.VersionsUsage)
+			os.Exit(1)
+		case "check":
+			fmt.Printf("usage:\twal-g check\n\n")
+			os.Exit(1)
+		case "st":
+			fmt.Println(walg.StorageUsage)
+			os.Exit(1)
+		case "bench":
+			fmt.Println(walg.BenchUsage)
+			os.Exit(1)
+		case "init":
+			fmt.Println(walg.InitUsage)
+			os.Exit(1)
+		case "lifecycle":
+			fmt.Println(walg.LifecycleUsage)
+			os.Exit(1)
+		case "wal-compact":
+			fmt.Println(walg.WalCompactUsage)
+			os.Exit(1)
+		case "wal-verify":
+			fmt.Println(walg.WalVerifyUsage)
+			os.Exit(1)
+		case "wal-dump":
+			fmt.Println(walg.WalDumpUsage)
+			os.Exit(1)
+		case "wal-restore":
+			fmt.Println(walg.WalRestoreUsage)
+			os.Exit(1)
+		case "wal-fetch-range":
+			fmt.Println(walg.WalFetchRangeUsage)
+			os.Exit(1)
+		case "create-restore-point":
+			fmt.Println(walg.CreateRestorePointUsage)
+			os.Exit(1)
+		case "backup-mount":
+			fmt.Println(walg.BackupMountUsage)
+			os.Exit(1)
+		case "backup-clone":
+			fmt.Println(walg.BackupCloneUsage)
+			os.Exit(1)
+		case "catalog":
+			fmt.Println(walg.CatalogUsage)
+			os.Exit(1)
+		case "storage-usage":
+			fmt.Println(walg.StorageUsageUsage)
+			os.Exit(1)
+		case "scrub":
+			fmt.Println(walg.ScrubUsage)
+			os.Exit(1)
+		case "replica-verify":
+			fmt.Println(walg.ReplicaVerifyUsage)
+			os.Exit(1)
+		case "health":
+			fmt.Println(walg.HealthUsage)
+			os.Exit(1)
+		case "dump-push", "dump-fetch", "dump-list":
+			fmt.Println(walg.DumpUsage)
+			os.Exit(1)
+		case "wal-e-migrate":
+			fmt.Println(walg.WalEMigrateUsage)
+			os.Exit(1)
+		case "stream-push", "stream-fetch", "stream-list":
+			fmt.Println(walg.StreamUsage)
+			os.Exit(1)
+		case "mysql":
+			fmt.Println(walg.MySQLUsage)
+			os.Exit(1)
+		case "mongodb":
+			fmt.Println(walg.MongoUsage)
+			os.Exit(1)
+		case "redis":
+			fmt.Println(walg.RedisUsage)
+			os.Exit(1)
 		default:
 			l.Fatalf("Command '%s' is unsupported by WAL-G.\n\n", command)
 		}
 	}
 
+	defer walg.StartCommandTimeout(command, firstArgument)()
+
 	var backupName string
 	var verify = false
 	if len(all) == 3 {
@@ -116,15 +250,43 @@ func main() {
 		defer pprof.StopCPUProfile()
 	}
 
+	// Check and health report configuration errors themselves instead of failing on them
+	if command == "check" {
+		walg.HandleCheck()
+		return
+	}
+	if command == "health" {
+		walg.HandleHealth(all)
+		return
+	}
+	if command == "wal-verify" {
+		walg.HandleWalVerify(all)
+		return
+	}
+
 	// Configure and start S3 session with bucket, region, and path names.
 	// Checks that environment variables are properly set.
 	tu, pre, err := walg.Configure()
+	if err != nil && command == "wal-fetch" {
+		walg.FailWalFetch(firstArgument, err)
+	}
 	if err != nil {
 		log.Fatalf("FATAL: %+v\n", err)
 	}
+	if err = walg.CheckReadAt(command); err != nil {
+		log.Fatalf("FATAL: %+v\n", err)
+	}
 
-	fmt.Println("BUCKET:", *pre.Bucket)
-	fmt.Println("SERVER:", *pre.Server)
+	sizeOnly := false
+	for _, arg := range all {
+		sizeOnly = sizeOnly || arg == "--size-only"
+	}
+	// st, dump-fetch, stream-fetch, wal-fetch to stdout, wal-dump, backup-fetch --size-only and database subcommands output may be piped, so it must contain only the object
+	if command != "st" && command != "dump-fetch" && command != "stream-fetch" && command != "wal-dump" && command != "mysql" && command != "mongodb" && command != "redis" &&
+		!(command == "wal-fetch" && backupName == "-") && !(command == "backup-fetch" && sizeOnly) && !walg.IsQuiet() {
+		fmt.Println("BUCKET:", *pre.Bucket)
+		fmt.Println("SERVER:", *pre.Server)
+	}
 
 	if command == "wal-fetch" {
 		// Fetch and decompress a WAL file from S3.
@@ -135,13 +297,71 @@ func main() {
 		// Upload a WAL file to S3.
 		walg.HandleWALPush(tu, firstArgument, pre, verify)
 	} else if command == "backup-push" {
-		walg.HandleBackupPush(firstArgument, tu, pre)
+		walg.HandleBackupPushCommand(tu, pre, all)
 	} else if command == "backup-fetch" {
-		walg.HandleBackupFetch(backupName, pre, firstArgument, mem)
+		walg.HandleBackupFetchCommand(pre, all, mem)
 	} else if command == "backup-list" {
-		walg.HandleBackupList(pre)
+		walg.HandleBackupList(pre, all)
+	} else if command == "backup-export" {
+		walg.HandleBackupExport(pre, all)
+	} else if command == "backup-repair" {
+		walg.HandleBackupRepair(tu, pre, all)
 	} else if command == "delete" {
 		walg.HandleDelete(pre, all)
+	} else if command == "trash" {
+		walg.HandleTrash(pre, all)
+	} else if command == "versions" {
+		walg.HandleVersions(pre, all)
+	} else if command == "st" {
+		walg.HandleStorageCommand(tu, pre, all)
+	} else if command == "bench" {
+		walg.HandleBench(tu, pre, all)
+	} else if command == "init" {
+		walg.HandleInit(tu, pre, all)
+	} else if command == "lifecycle" {
+		walg.HandleLifecycle(pre, all)
+	} else if command == "wal-compact" {
+		walg.HandleWalCompact(tu, pre, all)
+	} else if command == "wal-dump" {
+		walg.HandleWalDump(pre, all)
+	} else if command == "wal-restore" {
+		walg.HandleWalRestore(pre, all)
+	} else if command == "wal-fetch-range" {
+		walg.HandleWalFetchRange(pre, all)
+	} else if command == "create-restore-point" {
+		walg.HandleCreateRestorePoint(tu, pre, all)
+	} else if command == "backup-mount" {
+		walg.HandleBackupMount(pre, all)
+	} else if command == "backup-clone" {
+		walg.HandleBackupClone(pre, all)
+	} else if command == "catalog" {
+		walg.HandleCatalog(pre, all)
+	} else if command == "storage-usage" {
+		walg.HandleStorageUsage(pre)
+	} else if command == "scrub" {
+		walg.HandleScrub(tu, pre, all)
+	} else if command == "replica-verify" {
+		walg.HandleReplicaVerify(pre, all)
+	} else if command == "dump-push" {
+		walg.HandleDumpPush(tu, pre, all)
+	} else if command == "dump-fetch" {
+		walg.HandleDumpFetch(pre, all)
+	} else if command == "dump-list" {
+		walg.HandleDumpList(pre)
+	} else if command == "wal-e-migrate" {
+		walg.HandleWalEMigrate(tu, pre, all)
+	} else if command == "stream-push" {
+		walg.HandleStreamPush(tu, pre, all)
+	} else if command == "stream-fetch" {
+		walg.HandleStreamFetch(pre, all)
+	} else if command == "stream-list" {
+		walg.HandleStreamList(pre)
+	} else if command == "mysql" {
+		walg.HandleMySQL(tu, pre, all)
+	} else if command == "mongodb" {
+		walg.HandleMongo(tu, pre, all)
+	} else if command == "redis" {
+		walg.HandleRedis(tu, pre, all)
 	} else {
 		l.Fatalf("Command '%s' is unsupported by WAL-G.", command)
 	}
@@ -0,0 +1,56 @@
+package walg
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrCommandTimeout happens when command runs longer than WALG_COMMAND_TIMEOUT
+var ErrCommandTimeout = errors.New("command timed out")
+
+// timeoutCommands are run by PostgreSQL, which waits for them holding archiver or startup process
+var timeoutCommands = map[string]bool{
+	"wal-push":     true,
+	"wal-fetch":    true,
+	"wal-prefetch": true,
+}
+
+// getCommandTimeout reads WALG_COMMAND_TIMEOUT, 0 means no timeout
+func getCommandTimeout() (time.Duration, error) {
+	return getPgDuration("WALG_COMMAND_TIMEOUT", 0)
+}
+
+// StartCommandTimeout makes wal-push, wal-fetch and wal-prefetch fail when they run longer than
+// WALG_COMMAND_TIMEOUT, so hung storage connection fails archive_command or restore_command within the
+// time PostgreSQL expects instead of wedging it. Other commands are not limited. Returned function stops
+// the timer when command is done.
+func StartCommandTimeout(command string, walFileName string) func() {
+	if !timeoutCommands[command] {
+		return func() {}
+	}
+	timeout, err := getCommandTimeout()
+	if err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+	if timeout == 0 {
+		return func() {}
+	}
+	timer := time.AfterFunc(timeout, func() {
+		failCommandTimeout(command, walFileName, timeout)
+	})
+	return func() { timer.Stop() }
+}
+
+func failCommandTimeout(command string, walFileName string, timeout time.Duration) {
+	err := errors.Wrapf(ErrCommandTimeout, "%s of %s is not done in %v", command, walFileName, timeout)
+	if command == "wal-fetch" {
+		// Timed out fetch must not look like the end of archive to recovery
+		FailWalFetch(walFileName, err)
+	}
+	log.Printf("ERROR: %v\n", err)
+	EmitEvent(Event{Event: EventFailed, Object: walFileName, Error: err.Error()})
+	os.Exit(1)
+}
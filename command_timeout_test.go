@@ -0,0 +1,29 @@
+package walg
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCommandTimeoutScope(t *testing.T) {
+	SetSettings(map[string]string{"WALG_COMMAND_TIMEOUT": "10ms"})
+	defer SetSettings(nil)
+
+	// Commands not run by PostgreSQL are not limited, test process would exit otherwise
+	stop := StartCommandTimeout("backup-push", "")
+	time.Sleep(30 * time.Millisecond)
+	stop()
+
+	// Timer of finished command is stopped
+	stop = StartCommandTimeout("wal-push", "pg_wal/000000010000000000000001")
+	stop()
+	time.Sleep(30 * time.Millisecond)
+
+	if timeout, err := getCommandTimeout(); err != nil || timeout != 10*time.Millisecond {
+		t.Fatalf("unexpected timeout %v %v", timeout, err)
+	}
+	SetSettings(map[string]string{"WALG_COMMAND_TIMEOUT": "soon"})
+	if _, err := getCommandTimeout(); err == nil {
+		t.Fatal("invalid WALG_COMMAND_TIMEOUT is accepted")
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
 	"os"
 	"path"
 	"path/filepath"
@@ -16,6 +17,7 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/jackc/pgx"
 	"github.com/pkg/errors"
 	"sync"
 )
@@ -83,7 +85,8 @@ func HandleDelete(pre *Prefix, args []string) {
 }
 
 // HandleBackupList is invoked to perform wal-g backup-list
-func HandleBackupList(pre *Prefix) {
+func HandleBackupList(pre *Prefix, args []string) {
+	cfg := ParseBackupListArguments(args, printBackupListUsageAndFail)
 	var bk = &Backup{
 		Prefix: pre,
 		Path:   GetBackupPath(pre),
@@ -92,9 +95,35 @@ func HandleBackupList(pre *Prefix) {
 	if err != nil {
 		log.Fatal(err)
 	}
+	if len(cfg.filters) > 0 {
+		backups = filterBackupsByLabels(backups, cfg.filters, func(name string) S3TarBallSentinelDto {
+			return fetchSentinel(name, bk, pre)
+		})
+	}
 
 	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
 	defer w.Flush()
+	if cfg.tree {
+		fmt.Fprintln(w, "name\tlast_modified\ttype\tlsn_range")
+		printBackupTree(w, buildBackupTree(backups, func(name string) S3TarBallSentinelDto {
+			return fetchSentinel(name, bk, pre)
+		}))
+		return
+	}
+	if cfg.summary {
+		summary, err := collectArchiveSummary(pre, backups)
+		if err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+		fmt.Fprintln(w, "name\tlast_modified\twal_segment_backup_start\tpartitions")
+		for i := len(backups) - 1; i >= 0; i-- {
+			b := backups[i]
+			fmt.Fprintln(w, fmt.Sprintf("%v\t%v\t%v\t%v", b.Name, b.Time.Format(time.RFC3339), b.WalFileName, summary.partitions[b.Name]))
+		}
+		w.Flush()
+		printArchiveSummary(os.Stdout, summary)
+		return
+	}
 	fmt.Fprintln(w, "name\tlast_modified\twal_segment_backup_start")
 
 	for i := len(backups) - 1; i >= 0; i-- {
@@ -103,10 +132,21 @@ func HandleBackupList(pre *Prefix) {
 	}
 }
 
+// checkTablespaceTargets warns about restored tablespace symlinks pointing to absent directories
+func checkTablespaceTargets(tablespaces map[string]string) {
+	for name, target := range tablespaces {
+		if _, err := os.Stat(target); err != nil {
+			log.Printf("WARNING! Tablespace %s points to %s, it must be restored there before PostgreSQL start: %v\n", name, target, err)
+		}
+	}
+}
+
 // HandleBackupFetch is invoked to perform wal-g backup-fetch
 func HandleBackupFetch(backupName string, pre *Prefix, dirArc string, mem bool) (lsn *uint64) {
-	dirArc = ResolveSymlink(dirArc)
-	lsn = deltaFetchRecursion(backupName, pre, dirArc)
+	lsn, err := FetchBackup(pre, backupName, dirArc)
+	if err != nil {
+		log.Fatalf("%+v\n", err)
+	}
 
 	if mem {
 		f, err := os.Create("mem.prof")
@@ -120,57 +160,138 @@ func HandleBackupFetch(backupName string, pre *Prefix, dirArc string, mem bool)
 	return
 }
 
-// deltaFetchRecursion function composes Backup object and recursively searches for necessary base backup
-func deltaFetchRecursion(backupName string, pre *Prefix, dirArc string) (lsn *uint64) {
-	var bk *Backup
-	// Check if BACKUPNAME exists and if it does extract to DIRARC.
-	if backupName != "LATEST" {
-		bk = &Backup{
-			Prefix: pre,
-			Path:   GetBackupPath(pre),
-			Name:   aws.String(backupName),
-		}
-		bk.Js = aws.String(*bk.Path + *bk.Name + "_backup_stop_sentinel.json")
+// FetchBackup restores the backup with its delta chain into dirArc and returns LSN of the backup
+func FetchBackup(pre *Prefix, backupName string, dirArc string) (*uint64, error) {
+	dirArc = ResolveSymlink(dirArc)
 
-		exists, err := bk.CheckExistence()
+	bk, err := findBackup(backupName, pre)
+	if err != nil {
+		return nil, err
+	}
+	// Nothing is written to PGDATA unless metadata of the whole delta chain is valid
+	if err = verifyBackupChain(pre, *bk.Name); err != nil {
+		return nil, err
+	}
+	sentinel, err := readSentinel(*bk.Name, bk, pre)
+	if err != nil {
+		return nil, err
+	}
+	err = checkRestoreCompatibility(sentinel, dirArc)
+	if err != nil {
+		if !ignorePgVersionMismatch() {
+			return nil, errors.Wrap(err, "Set WALG_IGNORE_PG_VERSION_MISMATCH=true to fetch the backup anyway")
+		}
+		log.Printf("WARNING! %v\n", err)
+	}
+	restored, err := prepareDeltaRestore(pre, *bk.Name, dirArc)
+	if err != nil {
+		return nil, err
+	}
+	if restored == "" && !skipDiskSpaceCheck() {
+		size, err := getBackupRestoreSize(pre, *bk.Name)
 		if err != nil {
-			log.Fatalf("%+v\n", err)
+			return nil, err
 		}
-		if !exists {
-			log.Fatalf("Backup '%s' does not exist.\n", *bk.Name)
+		if err = checkFreeDiskSpace(dirArc, size); err != nil {
+			return nil, errors.Wrap(err, "Set WALG_SKIP_DISK_SPACE_CHECK=true to fetch the backup anyway")
 		}
+	}
 
-		// Find the LATEST valid backup (checks against JSON file and grabs backup name) and extract to DIRARC.
-	} else {
-		bk = &Backup{
-			Prefix: pre,
-			Path:   GetBackupPath(pre),
+	lsn, err := deltaFetchRecursion(*bk.Name, pre, dirArc, restored)
+	if err != nil {
+		return nil, err
+	}
+	relocateTablespaces(dirArc, sentinel.Tablespaces)
+	checkTablespaceTargets(sentinel.Tablespaces)
+	if err = syncExtractedDirectories(dirArc, sentinel.Tablespaces); err != nil {
+		return nil, err
+	}
+	if restoreDeltaOnto {
+		if err = writeRestoreState(pre, dirArc, *bk.Name); err != nil {
+			return nil, err
 		}
+	}
+	return lsn, nil
+}
+
+// ErrBackupNotFound happens when backup requested by name does not exist
+var ErrBackupNotFound = errors.New("backup does not exist")
+
+// resolveBackup composes Backup object for a name given by user, LATEST is resolved to the name of the newest backup
+func resolveBackup(backupName string, pre *Prefix) *Backup {
+	bk, err := findBackup(backupName, pre)
+	if errors.Cause(err) == ErrBackupNotFound {
+		log.Fatalf("Backup '%s' does not exist.\n", backupName)
+	}
+	if err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+	return bk
+}
 
+// findBackup is resolveBackup returning errors
+func findBackup(backupName string, pre *Prefix) (*Backup, error) {
+	bk := &Backup{
+		Prefix: pre,
+		Path:   GetBackupPath(pre),
+	}
+	// Find the LATEST valid backup (checks against JSON file and grabs backup name).
+	if backupName == "LATEST" {
 		latest, err := bk.GetLatest()
 		if err != nil {
-			log.Fatalf("%+v\n", err)
+			return nil, err
 		}
 		bk.Name = aws.String(latest)
+		return bk, nil
 	}
-	var dto = fetchSentinel(*bk.Name, bk, pre)
 
-	if dto.IsIncremental() {
-		fmt.Printf("Delta from %v at LSN %x \n", *dto.IncrementFrom, *dto.IncrementFromLSN)
-		deltaFetchRecursion(*dto.IncrementFrom, pre, dirArc)
-		fmt.Printf("%v fetched. Upgrading from LSN %x to LSN %x \n", *dto.IncrementFrom, *dto.IncrementFromLSN, dto.LSN)
+	// Check if BACKUPNAME exists.
+	bk.Name = aws.String(backupName)
+	bk.Js = aws.String(*bk.Path + *bk.Name + "_backup_stop_sentinel.json")
+	exists, err := bk.CheckExistence()
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errors.Wrapf(ErrBackupNotFound, "findBackup: %s", backupName)
 	}
+	return bk, nil
+}
 
-	unwrapBackup(bk, dirArc, pre, dto)
+// deltaFetchRecursion function composes Backup object and recursively searches for necessary base backup.
+// Recursion stops at restored backup, which is already extracted into dirArc.
+func deltaFetchRecursion(backupName string, pre *Prefix, dirArc string, restored string) (*uint64, error) {
+	bk, err := findBackup(backupName, pre)
+	if err != nil {
+		return nil, err
+	}
+	dto, err := readSentinel(*bk.Name, bk, pre)
+	if err != nil {
+		return nil, err
+	}
+	if *bk.Name == restored {
+		infof("%v is already restored\n", restored)
+		return dto.LSN, nil
+	}
 
-	lsn = dto.LSN
-	return
+	if dto.IsIncremental() {
+		infof("Delta from %v at LSN %x \n", *dto.IncrementFrom, *dto.IncrementFromLSN)
+		if _, err = deltaFetchRecursion(*dto.IncrementFrom, pre, dirArc, restored); err != nil {
+			return nil, err
+		}
+		infof("%v fetched. Upgrading from LSN %x to LSN %x \n", *dto.IncrementFrom, *dto.IncrementFromLSN, dto.LSN)
+	}
+
+	if err = unwrapBackup(bk, dirArc, pre, dto); err != nil {
+		return nil, err
+	}
+	return dto.LSN, nil
 }
 
 // Do the job of unpacking Backup object
-func unwrapBackup(bk *Backup, dirArc string, pre *Prefix, sentinel S3TarBallSentinelDto) {
+func unwrapBackup(bk *Backup, dirArc string, pre *Prefix, sentinel S3TarBallSentinelDto) error {
 
-	incrementBase := path.Join(dirArc, "increment_base")
+	incrementBase := filepath.Join(dirArc, "increment_base")
 	if !sentinel.IsIncremental() {
 		var empty = true
 		searchLambda := func(path string, info os.FileInfo, err error) error {
@@ -182,32 +303,31 @@ func unwrapBackup(bk *Backup, dirArc string, pre *Prefix, sentinel S3TarBallSent
 		filepath.Walk(dirArc, searchLambda)
 
 		if !empty {
-			log.Fatalf("Directory %v for delta base must be empty", dirArc)
+			return errors.Errorf("Directory %v for delta base must be empty", dirArc)
 		}
 	} else {
 		defer func() {
-			err := os.RemoveAll(incrementBase)
-			if err != nil {
-				log.Fatal(err)
+			if err := os.RemoveAll(incrementBase); err != nil {
+				log.Printf("WARNING! Unable to remove %s: %v\n", incrementBase, err)
 			}
 		}()
 
 		err := os.MkdirAll(incrementBase, os.FileMode(0777))
 		if err != nil {
-			log.Fatal(err)
+			return errors.Wrap(err, "unwrapBackup: unable to create increment base")
 		}
 
 		files, err := ioutil.ReadDir(dirArc)
 		if err != nil {
-			log.Fatal(err)
+			return errors.Wrap(err, "unwrapBackup: unable to read delta base")
 		}
 
 		for _, f := range files {
 			objName := f.Name()
 			if objName != "increment_base" {
-				err := os.Rename(path.Join(dirArc, objName), path.Join(incrementBase, objName))
+				err := os.Rename(filepath.Join(dirArc, objName), filepath.Join(incrementBase, objName))
 				if err != nil {
-					log.Fatal(err)
+					return errors.Wrap(err, "unwrapBackup: unable to move delta base")
 				}
 			}
 		}
@@ -216,13 +336,13 @@ func unwrapBackup(bk *Backup, dirArc string, pre *Prefix, sentinel S3TarBallSent
 			if !fd.IsSkipped {
 				continue
 			}
-			fmt.Printf("Skipped file %v\n", fileName)
-			targetPath := path.Join(dirArc, fileName)
+			infof("Skipped file %v\n", fileName)
+			targetPath := filepath.Join(dirArc, fileName)
 			// this path is only used for increment restoration
-			incrementalPath := path.Join(incrementBase, fileName)
+			incrementalPath := filepath.Join(incrementBase, fileName)
 			err = MoveFileAndCreateDirs(incrementalPath, targetPath, fileName)
 			if err != nil {
-				log.Fatal(err, "Failed to move skipped file for "+targetPath+" "+fileName)
+				return errors.Wrap(err, "Failed to move skipped file for "+targetPath+" "+fileName)
 			}
 		}
 
@@ -232,9 +352,15 @@ func unwrapBackup(bk *Backup, dirArc string, pre *Prefix, sentinel S3TarBallSent
 	var keys []string
 	allKeys, err := bk.GetKeys()
 	if err != nil {
-		log.Fatalf("%+v\n", err)
+		return err
+	}
+	for _, key := range skipMigratedPartitions(allKeys) {
+		// pg_control is extracted last, configuration files are extracted outside of PGDATA by FetchConfigFiles.
+		// Backups made by WAL-E have neither of them.
+		if base := path.Base(key); base != pgControlPartition && base != ConfigFilesPartition {
+			keys = append(keys, key)
+		}
 	}
-	keys = allKeys[:len(allKeys)-1] // TODO: WTF is going on?
 	f := &FileTarInterpreter{
 		NewDir:             dirArc,
 		Sentinel:           sentinel,
@@ -246,21 +372,19 @@ func unwrapBackup(bk *Backup, dirArc string, pre *Prefix, sentinel S3TarBallSent
 			Backup:     bk,
 			Key:        aws.String(key),
 			FileFormat: CheckType(key),
+			Partition:  sentinel.partition(key),
 		}
 		out[i] = s
 	}
 	// Extract all compressed tar members except `pg_control.tar.lz4` if WALG version backup.
-	err = ExtractAll(f, out)
-	if serr, ok := err.(*UnsupportedFileTypeError); ok {
-		log.Fatalf("%v\n", serr)
-	} else if err != nil {
-		log.Fatalf("%+v\n", err)
+	if err = ExtractAll(f, out); err != nil {
+		return err
 	}
 	// Check name for backwards compatibility. Will check for `pg_control` if WALG version of backup.
 	re := regexp.MustCompile(`^([^_]+._{1}[^_]+._{1})`)
 	match := re.FindString(*bk.Name)
 	if match == "" || sentinel.IsIncremental() {
-		// Extract pg_control last. If pg_control does not exist, program exits with error code 1.
+		// Extract pg_control last. If pg_control does not exist, backup is corrupt.
 		name := *bk.Path + *bk.Name + "/tar_partitions/pg_control.tar.lz4"
 		pgControl := &Archive{
 			Prefix:  pre,
@@ -269,31 +393,30 @@ func unwrapBackup(bk *Backup, dirArc string, pre *Prefix, sentinel S3TarBallSent
 
 		exists, err := pgControl.CheckExistence()
 		if err != nil {
-			log.Fatalf("%+v\n", err)
+			return err
 		}
 
 		if exists {
-			sentinel := make([]ReaderMaker, 1)
-			sentinel[0] = &S3ReaderMaker{
+			pgControlReaders := make([]ReaderMaker, 1)
+			pgControlReaders[0] = &S3ReaderMaker{
 				Backup:     bk,
 				Key:        aws.String(name),
 				FileFormat: CheckType(name),
+				Partition:  sentinel.partition(name),
 			}
-			err := ExtractAll(f, sentinel)
-			if serr, ok := err.(*UnsupportedFileTypeError); ok {
-				log.Fatalf("%v\n", serr)
-			} else if err != nil {
-				log.Fatalf("%+v\n", err)
+			if err = ExtractAll(f, pgControlReaders); err != nil {
+				return err
 			}
-			fmt.Printf("\nBackup extraction complete.\n")
+			infof("\nBackup extraction complete.\n")
 		} else {
-			log.Fatal("Corrupt backup: missing pg_control")
+			return errors.New("Corrupt backup: missing pg_control")
 		}
 	}
+	return nil
 }
 
 func getDeltaConfig() (maxDeltas int, fromFull bool) {
-	stepsStr, hasSteps := os.LookupEnv("WALG_DELTA_MAX_STEPS")
+	stepsStr, hasSteps := lookupSetting("WALG_DELTA_MAX_STEPS")
 	var err error
 	if hasSteps {
 		maxDeltas, err = strconv.Atoi(stepsStr)
@@ -301,7 +424,7 @@ func getDeltaConfig() (maxDeltas int, fromFull bool) {
 			log.Fatal("Unable to parse WALG_DELTA_MAX_STEPS ", err)
 		}
 	}
-	origin, hasOrigin := os.LookupEnv("WALG_DELTA_ORIGIN")
+	origin, hasOrigin := lookupSetting("WALG_DELTA_ORIGIN")
 	if hasOrigin {
 		switch origin {
 		case "LATEST":
@@ -314,10 +437,51 @@ func getDeltaConfig() (maxDeltas int, fromFull bool) {
 	return
 }
 
+// isFullBackupOlderThan checks age of the full backup the latest backup is based on
+func isFullBackupOlderThan(bk *Backup, latest string, dto *S3TarBallSentinelDto, age time.Duration, event NotifyEvent) bool {
+	fullName := latest
+	if dto.IsIncremental() {
+		fullName = *dto.IncrementFullName
+	}
+	backups, err := bk.GetBackups()
+	if err != nil {
+		fatalWithNotification(event, err)
+	}
+	for _, backup := range backups {
+		if backup.Name == fullName {
+			return time.Since(backup.Time) > age
+		}
+	}
+	// Full backup of the chain is deleted, chain can not be continued
+	return true
+}
+
+// verifyDeltaBase checks that WAL history from delta base to the server is continuous
+func verifyDeltaBase(pre *Prefix, conn *pgx.Conn, baseName string, base *S3TarBallSentinelDto) error {
+	timeline, err := readTimeline(conn)
+	if err != nil {
+		return errors.Wrap(err, "verifyDeltaBase: unable to read timeline of the server")
+	}
+	segments, err := ListWalSegments(pre)
+	if err != nil {
+		return err
+	}
+	return checkDeltaBaseWal(baseName, base, timeline, segments)
+}
+
 // HandleBackupPush is invoked to performa wal-g backup-push
 func HandleBackupPush(dirArc string, tu *TarUploader, pre *Prefix) {
-	dirArc = ResolveSymlink(dirArc)
+	backupPush(BackupPushArguments{dirArc: dirArc}, tu, pre)
+}
+
+func backupPush(cfg BackupPushArguments, tu *TarUploader, pre *Prefix) {
+	dirArc := ResolveSymlink(cfg.dirArc)
+	event := NewNotifyEvent("backup-push", pre)
 	maxDeltas, fromFull := getDeltaConfig()
+	if cfg.fullIfOlderThan > 0 && maxDeltas == 0 {
+		// Age of the full backup bounds delta chain unless WALG_DELTA_MAX_STEPS does
+		maxDeltas = math.MaxInt32
+	}
 
 	var bk = &Backup{
 		Prefix: pre,
@@ -333,7 +497,7 @@ func HandleBackupPush(dirArc string, tu *TarUploader, pre *Prefix) {
 		latest, err = bk.GetLatest()
 		if err != ErrLatestNotFound {
 			if err != nil {
-				log.Fatalf("%+v\n", err)
+				fatalWithNotification(event, err)
 			}
 			dto = fetchSentinel(latest, bk, pre)
 			if dto.IncrementCount != nil {
@@ -341,23 +505,65 @@ func HandleBackupPush(dirArc string, tu *TarUploader, pre *Prefix) {
 			}
 
 			if incrementCount > maxDeltas {
-				fmt.Println("Reached max delta steps. Doing full backup.")
+				infoln("Reached max delta steps. Doing full backup.")
+				dto = S3TarBallSentinelDto{}
+			} else if cfg.fullIfOlderThan > 0 && isFullBackupOlderThan(bk, latest, &dto, cfg.fullIfOlderThan, event) {
+				infof("Latest full backup is older than %v. Doing full backup.\n", cfg.fullIfOlderThan)
 				dto = S3TarBallSentinelDto{}
 			} else if dto.LSN == nil {
-				fmt.Println("LATEST backup was made without support for delta feature. Fallback to full backup with LSN marker for future deltas.")
+				infoln("LATEST backup was made without support for delta feature. Fallback to full backup with LSN marker for future deltas.")
 			} else {
 				if fromFull {
-					fmt.Println("Delta will be made from full backup.")
+					infoln("Delta will be made from full backup.")
 					latest = *dto.IncrementFullName
 					dto = fetchSentinel(latest, bk, pre)
 				}
-				fmt.Printf("Delta backup from %v with LSN %x. \n", latest, *dto.LSN)
+				infof("Delta backup from %v with LSN %x. \n", latest, *dto.LSN)
 			}
 		}
 	}
 
+	// Connect to postgres and start/finish a nonexclusive backup.
+	conn, err := Connect()
+	if err != nil {
+		fatalWithNotification(event, err)
+	}
+	role, err := cfg.getBackupRole()
+	if err != nil {
+		fatalWithNotification(event, err)
+	}
+	queryRunner, err := NewPgQueryRunner(conn)
+	if err != nil {
+		fatalWithNotification(event, err)
+	}
+	if role != "" {
+		// Cron entries on every node of a cluster back up only the node of expected role, which changes on failover
+		inRecovery, err := queryRunner.IsInRecovery()
+		if err == nil {
+			err = checkBackupRole(role, inRecovery)
+		}
+		if err != nil {
+			fatalWithNotification(event, err)
+		}
+	}
+	// Segment size must be known before WAL of the delta base is checked
+	walSegmentSize, dataChecksums, err := queryRunner.ReadServerSettings()
+	if err != nil {
+		fatalWithNotification(event, err)
+	}
+	if err = SetWalSegmentSize(walSegmentSize); err != nil {
+		fatalWithNotification(event, err)
+	}
+	if dto.LSN != nil {
+		if err = verifyDeltaBase(pre, conn, latest, &dto); err != nil {
+			log.Printf("WARNING! Delta can not be made from %v: %v. Doing full backup.\n", latest, err)
+			dto = S3TarBallSentinelDto{}
+		}
+	}
+
 	bundle := &Bundle{
 		MinSize:            int64(1000000000), //MINSIZE = 1GB
+		SkipUnlogged:       skipUnloggedRelations(),
 		IncrementFromLsn:   dto.LSN,
 		IncrementFromFiles: dto.Files,
 		Files:              &sync.Map{},
@@ -366,24 +572,57 @@ func HandleBackupPush(dirArc string, tu *TarUploader, pre *Prefix) {
 		bundle.IncrementFromFiles = make(map[string]BackupFileDescription)
 	}
 
-	// Connect to postgres and start/finish a nonexclusive backup.
-	conn, err := Connect()
+	err = GetBackupHook(PreBackupHook).Run(conn, "WALG_BACKUP_DIRECTORY="+dirArc)
 	if err != nil {
-		log.Fatalf("%+v\n", err)
+		fatalWithNotification(event, errors.Wrap(err, "Backup aborted"))
 	}
 	name, lsn, pgVersion, err := bundle.StartBackup(conn, time.Now().String())
 	if err != nil {
-		log.Fatalf("%+v\n", err)
+		fatalWithNotification(event, err)
 	}
+	tu.PgVersion = formatPgMajorVersion(pgVersion)
+	event.Backup = name
 
+	var configFiles []string
+	if backupConfigFiles() {
+		configFiles, err = FindConfigFiles(conn, dirArc)
+		if err != nil {
+			fatalWithNotification(event, err)
+		}
+	}
+
+	// Start LSN is in the name, so backups started in the same WAL segment do not overwrite each other
+	name = FormatBackupName(stripWalFileName(name), lsn)
+	suffix := ""
 	if len(latest) > 0 && dto.LSN != nil {
-		name = name + "_D_" + stripWalFileName(latest)
+		suffix = "_D_" + stripWalFileName(latest)
+	}
+	name, err = reserveBackupName(pre, name, suffix)
+	if err != nil {
+		fatalWithNotification(event, err)
+	}
+	event.Backup = name
+	// Marker is left in storage if backup fails, it tells monitoring that the backup is abandoned
+	marker := StartBackupMarker(tu, pre, name)
+
+	// Files are read from file system snapshot taken after backup start when it is configured
+	snapshot, err := TakeFilesystemSnapshot(dirArc, name)
+	if err != nil {
+		fatalWithNotification(event, err)
+	}
+	walkDir := dirArc
+	if snapshot != nil {
+		walkDir = snapshot.Path
+	}
+	failReleasingSnapshot := func(err error) {
+		snapshot.Release()
+		fatalWithNotification(event, err)
 	}
 
 	// Start a new tar bundle and walk the DIRARC directory and upload to S3.
 	bundle.Tbm = &S3TarBallMaker{
 		BaseDir:          filepath.Base(dirArc),
-		Trim:             dirArc,
+		Trim:             walkDir,
 		BkupName:         name,
 		Tu:               tu,
 		Lsn:              &lsn,
@@ -391,25 +630,38 @@ func HandleBackupPush(dirArc string, tu *TarUploader, pre *Prefix) {
 		IncrementFrom:    latest,
 	}
 
+	// Connection is idle while files are uploaded, keep it alive until backup is stopped
+	keepAlive := StartPgKeepAlive(conn)
+	serverMonitor := StartServerMonitor(lsn)
 	bundle.StartQueue()
-	fmt.Println("Walking ...")
-	err = filepath.Walk(dirArc, bundle.TarWalker)
+	infoln("Walking ...")
+	err = filepath.Walk(walkDir, bundle.TarWalker)
 	if err != nil {
-		log.Fatalf("%+v\n", err)
+		failReleasingSnapshot(err)
 	}
 	err = bundle.FinishQueue()
 	if err != nil {
-		log.Fatalf("%+v\n", err)
+		failReleasingSnapshot(err)
+	}
+	if len(configFiles) > 0 {
+		err = bundle.HandleConfigFiles(configFiles)
+		if err != nil {
+			failReleasingSnapshot(err)
+		}
 	}
-	// Upload `pg_control`.
-	err = bundle.HandleSentinel()
+	serverMonitor.Stop()
+	keepAlive.Stop()
+	// Stops backup and uploads `pg_control`, `backup_label` and `tablespace_map` in one tarball.
+	// pg_control is read from the snapshot, so it is released only then.
+	finishLsn, err := bundle.HandleMetadataFiles(conn)
+	snapshot.Release()
 	if err != nil {
-		log.Fatalf("%+v\n", err)
+		fatalWithNotification(event, err)
 	}
-	// Stops backup and write/upload postgres `backup_label` and `tablespace_map` Files
-	finishLsn, err := bundle.HandleLabelFiles(conn)
+	// Sentinel is not uploaded if post backup hook fails, so the backup is never considered complete
+	err = GetBackupHook(PostBackupHook).Run(conn, "WALG_BACKUP_DIRECTORY="+dirArc, "WALG_BACKUP_NAME="+name)
 	if err != nil {
-		log.Fatalf("%+v\n", err)
+		fatalWithNotification(event, errors.Wrap(err, "Backup aborted"))
 	}
 
 	timelineChanged := bundle.CheckTimelineChanged(conn)
@@ -420,6 +672,10 @@ func HandleBackupPush(dirArc string, tu *TarUploader, pre *Prefix) {
 			LSN:              &lsn,
 			IncrementFromLSN: dto.LSN,
 			PgVersion:        pgVersion,
+			WalSegmentSize:   walSegmentSize,
+			DataChecksums:    dataChecksums,
+			WalgVersion:      WalgVersion,
+			Labels:           cfg.labels,
 		}
 		if dto.LSN != nil {
 			sentinel.IncrementFrom = &latest
@@ -432,35 +688,57 @@ func HandleBackupPush(dirArc string, tu *TarUploader, pre *Prefix) {
 
 		sentinel.SetFiles(bundle.GetFiles())
 		sentinel.FinishLSN = &finishLsn
+		sentinel.UncompressedSize = bundle.GetUncompressedSize()
+		sentinel.Tablespaces = bundle.GetTablespaces()
+		sentinel.ConfigFiles = configFiles
 	}
 
 	// Wait for all uploads to finish.
 	err = bundle.Tb.Finish(sentinel)
 	if err != nil {
-		log.Fatalf("%+v\n", err)
+		fatalWithNotification(event, err)
 	}
+	marker.Finish()
+	NotifySuccess(event)
+	applyRetention(pre)
 }
 
 // HandleWALFetch is invoked to performa wal-g wal-fetch
 func HandleWALFetch(pre *Prefix, walFileName string, location string, triggerPrefetch bool) {
-	location = ResolveSymlink(location)
+	if location == "-" {
+		// Output is piped, e.g. to pg_waldump, prefetch is pointless
+		err := FetchWALFileToWriter(pre, walFileName, os.Stdout)
+		if errors.Cause(err) == ErrWalNotFound && isWalSegmentName(walFileName) {
+			err = fetchPartialWALFile(walFileName, err, func(partialName string) error {
+				return FetchWALFileToWriter(pre, partialName, os.Stdout)
+			})
+		}
+		exitOnWalFetchError(walFileName, err)
+		return
+	}
+	location = getWalFileLocation(location)
+	if !isWalSegmentName(walFileName) {
+		// History files are fetched as they are, they are neither prefetched nor checked as segments
+		exitOnWalFetchError(walFileName, FetchWALFile(pre, walFileName, location))
+		return
+	}
 	if triggerPrefetch {
 		defer forkPrefetch(walFileName, location)
 	}
 
-	_, _, running, prefetched := getPrefetchLocations(path.Dir(location), walFileName)
+	_, _, running, prefetched := getPrefetchLocations(filepath.Dir(location), walFileName)
 	seenSize := int64(-1)
 
 	for {
 		if stat, err := os.Stat(prefetched); err == nil {
-			if stat.Size() != int64(WalSegmentSize) {
-				log.Println("WAL-G: Prefetch error: wrong file size of prefetched file ", stat.Size())
+			if err = checkWalFileSize(prefetched, stat.Size()); err != nil {
+				log.Println("WAL-G: Prefetch error: wrong file size of prefetched file ", err)
 				break
 			}
 
-			err = os.Rename(prefetched, location)
+			err = moveFile(prefetched, location)
 			if err != nil {
-				log.Fatalf("%+v\n", err)
+				FailWalFetch(walFileName, err)
 			}
 
 			err := checkWALFileMagic(location)
@@ -472,7 +750,7 @@ func HandleWALFetch(pre *Prefix, walFileName string, location string, triggerPre
 
 			return
 		} else if !os.IsNotExist(err) {
-			log.Fatalf("%+v\n", err)
+			FailWalFetch(walFileName, err)
 		}
 
 		// We have race condition here, if running is renamed here, but it's OK
@@ -495,7 +773,11 @@ func HandleWALFetch(pre *Prefix, walFileName string, location string, triggerPre
 		time.Sleep(50 * time.Millisecond)
 	}
 
-	DownloadWALFile(pre, walFileName, location)
+	wait, err := getWalFetchWait()
+	if err != nil {
+		FailWalFetch(walFileName, err)
+	}
+	exitOnWalFetchError(walFileName, fetchWALFileWaiting(pre, walFileName, location, wait))
 }
 
 func checkWALFileMagic(prefetched string) error {
@@ -513,90 +795,143 @@ func checkWALFileMagic(prefetched string) error {
 	return nil
 }
 
-// DownloadWALFile downloads a file and writes it to local file
+// DownloadWALFile downloads a file and writes it to local file, missing file is only logged
 func DownloadWALFile(pre *Prefix, walFileName string, location string) {
-	a := &Archive{
-		Prefix:  pre,
-		Archive: aws.String(sanitizePath(*pre.Server + "/wal_005/" + walFileName + ".lzo")),
+	err := FetchWALFile(pre, walFileName, location)
+	if errors.Cause(err) == ErrWalNotFound {
+		log.Printf("Archive '%s' does not exist.\n", walFileName)
+		return
 	}
-	// Check existence of compressed LZO WAL file
-	exists, err := a.CheckExistence()
 	if err != nil {
 		log.Fatalf("%+v\n", err)
 	}
-	var crypter = OpenPGPCrypter{}
-	if exists {
-		arch, err := a.GetArchive()
-		if err != nil {
-			log.Fatalf("%+v\n", err)
-		}
+}
 
-		if crypter.IsUsed() {
-			var reader io.Reader
-			reader, err = crypter.Decrypt(arch)
-			if err != nil {
-				log.Fatalf("%v\n", err)
-			}
-			arch = ReadCascadeClose{reader, arch}
-		}
+// FetchWALFile downloads WAL file and writes it to location. ErrWalNotFound is returned when neither archive
+// nor bundle of the file exists, other errors are failures of storage, decryption or local disk.
+func FetchWALFile(pre *Prefix, walFileName string, location string) error {
+	a, format, err := findWALArchive(pre, walFileName)
+	if err != nil {
+		return err
+	}
+	if a != nil {
+		return fetchWALArchive(a, format, location, isWalSegmentName(walFileName))
+	}
 
-		f, err := os.Create(location)
+	found, err := fetchWalFromBundle(pre, walFileName, location)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return errors.Wrapf(ErrWalNotFound, "FetchWALFile: %s", walFileName)
+	}
+	return nil
+}
+
+// FetchWALFileToWriter writes decrypted and decompressed WAL file to output, e.g. stdout. Errors are the same
+// as of FetchWALFile, but output may be partially written on failure.
+func FetchWALFileToWriter(pre *Prefix, walFileName string, output io.Writer) error {
+	a, _, err := findWALArchive(pre, walFileName)
+	if err != nil {
+		return err
+	}
+	if a != nil {
+		arch, err := a.getCachedArchive()
 		if err != nil {
-			log.Fatalf("%v\n", err)
+			return err
 		}
+		defer arch.Close()
+		return decodeObject(output, arch, *a.Archive)
+	}
 
-		err = DecompressLzo(f, arch)
-		if err != nil {
-			log.Fatalf("%+v\n", err)
+	found, err := readWalFromBundle(pre, walFileName, "", func(segment io.Reader) error {
+		_, err := io.Copy(output, segment)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return errors.Wrapf(ErrWalNotFound, "FetchWALFileToWriter: %s", walFileName)
+	}
+	return nil
+}
+
+// findWALArchive finds archive of WAL file and its compression format, archive is nil if it does not exist.
+// WAL-E archives are compressed with lzo or gzip.
+func findWALArchive(pre *Prefix, walFileName string) (*Archive, string, error) {
+	for _, format := range []string{"lzo", "lz4", "gz"} {
+		a := &Archive{
+			Prefix:  pre,
+			Archive: aws.String(GetWalFolderPath(pre) + walFileName + "." + format),
 		}
-		f.Close()
-	} else if !exists {
-		// Check existence of compressed LZ4 WAL file
-		a.Archive = aws.String(sanitizePath(*pre.Server + "/wal_005/" + walFileName + ".lz4"))
-		exists, err = a.CheckExistence()
+		exists, err := a.CheckExistence()
 		if err != nil {
-			log.Fatalf("%+v\n", err)
+			return nil, "", err
 		}
-
 		if exists {
-			arch, err := a.GetArchive()
-			if err != nil {
-				log.Fatalf("%+v\n", err)
-			}
-
-			if crypter.IsUsed() {
-				var reader io.Reader
-				reader, err = crypter.Decrypt(arch)
-				if err != nil {
-					log.Fatalf("%v\n", err)
-				}
-				arch = ReadCascadeClose{reader, arch}
-			}
+			return a, format, nil
+		}
+	}
+	return nil, "", nil
+}
 
-			f, err := os.OpenFile(location, os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_EXCL, 0666)
-			if err != nil {
-				log.Fatalf("%v\n", err)
-			}
+// fetchWALArchive decrypts and decompresses WAL archive into location, partially written file is removed.
+// Size of segments is checked against the segment header, history files have no header.
+func fetchWALArchive(a *Archive, format string, location string, isSegment bool) error {
+	arch, err := a.getCachedArchive()
+	if err != nil {
+		return err
+	}
+	defer arch.Close()
 
-			size, err := DecompressLz4(f, arch)
-			if err != nil {
-				log.Fatalf("%+v\n", err)
-			}
-			if size != int64(WalSegmentSize) {
-				log.Fatal("Download WAL error: wrong size ", size)
-			}
-			err = f.Close()
-			if err != nil {
-				log.Fatalf("%+v\n", err)
-			}
-		} else {
-			log.Printf("Archive '%s' does not exist.\n", walFileName)
+	var crypter = OpenPGPCrypter{}
+	if crypter.IsUsed() {
+		var reader io.Reader
+		reader, err = crypter.Decrypt(arch)
+		if err != nil {
+			return errors.Wrapf(err, "fetchWALArchive: unable to decrypt %s", *a.Archive)
 		}
+		arch = ReadCascadeClose{reader, arch}
+	}
+
+	flags := os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	if format == "lz4" {
+		flags |= os.O_EXCL
 	}
+	f, err := os.OpenFile(location, flags, 0666)
+	if err != nil {
+		return err
+	}
+
+	var size int64
+	switch format {
+	case "lzo":
+		err = DecompressLzo(f, arch)
+	case "gz":
+		err = DecompressGzip(f, arch)
+	default:
+		size, err = DecompressLz4(f, arch)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && format == "lz4" && isSegment {
+		err = errors.Wrap(checkWalFileSize(location, size), "Download WAL error: wrong size")
+	}
+	if err == nil {
+		err = syncFetchedWalFile(location)
+	}
+	if err != nil {
+		os.Remove(location)
+	}
+	return err
 }
 
 // HandleWALPush is invoked to perform wal-g wal-push
 func HandleWALPush(tu *TarUploader, dirArc string, pre *Prefix, verify bool) {
+	tu.PgVersion = readWalPgVersion(dirArc)
+	verify = verify || verifyUploads()
 	bu := BgUploader{}
 	// Look for new WALs while doing main upload
 	bu.Start(dirArc, int32(getMaxUploadConcurrency(16)-1), tu, pre, verify)
@@ -609,6 +944,11 @@ func HandleWALPush(tu *TarUploader, dirArc string, pre *Prefix, verify bool) {
 // UploadWALFile from FS to the cloud
 func UploadWALFile(tu *TarUploader, dirArc string, pre *Prefix, verify bool) {
 	path, err := tu.UploadWal(dirArc, pre, verify)
+	if err != nil {
+		event := NewNotifyEvent("wal-push", pre)
+		event.WalFile = filepath.Base(dirArc)
+		NotifyWalPushFailure(event, err)
+	}
 	if re, ok := err.(Lz4Error); ok {
 		log.Fatalf("FATAL: could not upload '%s' due to compression error.\n%+v\n", path, re)
 	} else if err != nil {
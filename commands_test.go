@@ -1,6 +1,16 @@
 package walg
 
-import "testing"
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/pkg/errors"
+)
 
 func TestDeleteArgsParsingRetain(t *testing.T) {
 	var args DeleteCommandArguments
@@ -82,3 +92,318 @@ func parseAndTestFail(command []string, arguments *DeleteCommandArguments) bool
 	*arguments = result
 	return failed
 }
+
+func TestBackupFetchArgsParsing(t *testing.T) {
+	var failed bool
+	fail := func() { failed = true }
+
+	args := ParseBackupFetchArguments([]string{"backup-fetch", "dir", "LATEST"}, fail)
+	if failed || args.dirArc != "dir" || args.backupName != "LATEST" || args.targetTime != nil || args.targetLsn != nil {
+		t.Fatal("Parsing was wrong")
+	}
+
+	args = ParseBackupFetchArguments([]string{"backup-fetch", "dir", "--target-time", "2014-11-12T11:45:26.371Z"}, fail)
+	if failed || args.backupName != "" || args.targetTime == nil {
+		t.Fatal("Parsing was wrong")
+	}
+
+	args = ParseBackupFetchArguments([]string{"backup-fetch", "dir", "--target-lsn", "2/E5000028"}, fail)
+	if failed || args.targetLsn == nil || *args.targetLsn != 0x2E5000028 {
+		t.Fatal("Parsing was wrong")
+	}
+
+	args = ParseBackupFetchArguments([]string{"backup-fetch", "dir", "LATEST", "--config-files-to", "/"}, fail)
+	if failed || args.backupName != "LATEST" || args.configFilesTo != "/" {
+		t.Fatal("Parsing was wrong")
+	}
+
+	args = ParseBackupFetchArguments([]string{"backup-fetch", "dir", "LATEST", "--files", "postgresql.auto.conf,base/1"}, fail)
+	if failed || args.backupName != "LATEST" || !reflect.DeepEqual(args.files, []string{"postgresql.auto.conf", "base/1"}) {
+		t.Fatal("Parsing was wrong")
+	}
+
+	args = ParseBackupFetchArguments([]string{"backup-fetch", "dir", "--no-sync", "LATEST"}, fail)
+	if failed || args.backupName != "LATEST" || !args.noSync {
+		t.Fatal("Parsing was wrong")
+	}
+
+	args = ParseBackupFetchArguments([]string{"backup-fetch", "dir", "--target-name", "before_migration"}, fail)
+	if failed || args.backupName != "" || args.targetName != "before_migration" {
+		t.Fatal("Parsing was wrong")
+	}
+
+	ParseBackupFetchArguments([]string{"backup-fetch", "dir", "base_0001", "--target-lsn", "2/E5000028"}, fail)
+	if !failed {
+		t.Fatal("Parsing of backup-fetch command parsed ambiguous target")
+	}
+
+	failed = false
+	ParseBackupFetchArguments([]string{"backup-fetch", "dir", "--target-time", "yesterday"}, fail)
+	if !failed {
+		t.Fatal("Parsing of backup-fetch command parsed wrong time")
+	}
+
+	failed = false
+	args = ParseBackupFetchArguments([]string{"backup-fetch", "dir", "LATEST", "--sanitize"}, fail)
+	if failed || !args.sanitize || !reflect.DeepEqual(sanitizeRecoverySettings(args), [][2]string{{"recovery_target", "immediate"}, {"recovery_target_action", "promote"}}) {
+		t.Fatal("Parsing was wrong")
+	}
+
+	args = ParseBackupFetchArguments([]string{"backup-fetch", "dir", "LATEST", "--fetch-rate-limit", "100M"}, fail)
+	if failed || args.rateLimit != 100<<20 {
+		t.Fatal("Parsing was wrong")
+	}
+
+	ParseBackupFetchArguments([]string{"backup-fetch", "dir", "LATEST", "--sanitize", "--files", "base/1"}, fail)
+	if !failed {
+		t.Fatal("Parsing of backup-fetch command accepted --sanitize with --files")
+	}
+
+	failed = false
+	args = ParseBackupFetchArguments([]string{"backup-fetch", "--size-only", "LATEST"}, fail)
+	if failed || !args.sizeOnly || args.dirArc != "" || args.backupName != "LATEST" {
+		t.Fatal("Parsing was wrong")
+	}
+
+	args = ParseBackupFetchArguments([]string{"backup-fetch", "dir", "LATEST", "--size-only"}, fail)
+	if failed || !args.sizeOnly || args.dirArc != "dir" {
+		t.Fatal("Parsing was wrong")
+	}
+
+	args = ParseBackupFetchArguments([]string{"backup-fetch", "dir", "LATEST", "--delta-restore"}, fail)
+	if failed || !args.deltaRestore {
+		t.Fatal("Parsing was wrong")
+	}
+}
+
+func TestChooseBackupByTime(t *testing.T) {
+	backups := []BackupTime{
+		{Name: "third", Time: time.Date(2018, 3, 3, 0, 0, 0, 0, time.UTC)},
+		{Name: "second", Time: time.Date(2018, 2, 2, 0, 0, 0, 0, time.UTC)},
+		{Name: "first", Time: time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}
+
+	name, found := chooseBackupByTime(backups, time.Date(2018, 2, 10, 0, 0, 0, 0, time.UTC))
+	if !found || name != "second" {
+		t.Fatalf("Expected second backup, got %v", name)
+	}
+
+	name, found = chooseBackupByTime(backups, time.Date(2018, 3, 3, 0, 0, 0, 0, time.UTC))
+	if !found || name != "third" {
+		t.Fatalf("Expected third backup, got %v", name)
+	}
+
+	_, found = chooseBackupByTime(backups, time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC))
+	if found {
+		t.Fatal("Found backup before all backups")
+	}
+}
+
+func TestBackupPushArgsParsing(t *testing.T) {
+	var failed bool
+	fail := func() { failed = true }
+
+	args := ParseBackupPushArguments([]string{"backup-push", "dir", "--label", "purpose=pre-release", "--label", "ticket=DBA-1=2"}, fail)
+	if failed || args.dirArc != "dir" || args.labels["purpose"] != "pre-release" || args.labels["ticket"] != "DBA-1=2" {
+		t.Fatal("Parsing was wrong")
+	}
+
+	ParseBackupPushArguments([]string{"backup-push", "dir", "--label", "=value"}, fail)
+	if !failed {
+		t.Fatal("Parsing of backup-push command parsed label without key")
+	}
+
+	failed = false
+	args = ParseBackupPushArguments([]string{"backup-push", "dir", "--full-if-older-than", "7d"}, fail)
+	if failed || args.fullIfOlderThan != 7*24*time.Hour {
+		t.Fatal("Parsing of --full-if-older-than was wrong")
+	}
+	args = ParseBackupPushArguments([]string{"backup-push", "dir", "--full-if-older-than", "36h"}, fail)
+	if failed || args.fullIfOlderThan != 36*time.Hour {
+		t.Fatal("Parsing of --full-if-older-than was wrong")
+	}
+	ParseBackupPushArguments([]string{"backup-push", "dir", "--full-if-older-than", "week"}, fail)
+	if !failed {
+		t.Fatal("Parsing of backup-push command accepted wrong age")
+	}
+}
+
+func TestFilterBackupsByLabels(t *testing.T) {
+	backups := []BackupTime{{Name: "tagged"}, {Name: "other"}, {Name: "plain"}}
+	sentinels := map[string]S3TarBallSentinelDto{
+		"tagged": {Labels: map[string]string{"purpose": "migration", "env": "prod"}},
+		"other":  {Labels: map[string]string{"purpose": "nightly"}},
+		"plain":  {},
+	}
+
+	var failed bool
+	args := ParseBackupListArguments([]string{"backup-list", "--filter", "purpose=migration"}, func() { failed = true })
+	if failed {
+		t.Fatal("Parsing of backup-list command failed")
+	}
+
+	filtered := filterBackupsByLabels(backups, args.filters, func(name string) S3TarBallSentinelDto { return sentinels[name] })
+	if len(filtered) != 1 || filtered[0].Name != "tagged" {
+		t.Fatalf("Filtering was wrong: %v", filtered)
+	}
+}
+
+func TestCollectArchiveSummary(t *testing.T) {
+	pre := &Prefix{Svc: &listObjectsS3{objects: map[string]int64{
+		"server/basebackups_005/base_000000010000000000000004_backup_stop_sentinel.json":         100,
+		"server/basebackups_005/base_000000010000000000000004/tar_partitions/part_1.tar.lz4":     1000,
+		"server/basebackups_005/base_000000010000000000000004/tar_partitions/part_2.tar.lz4":     1000,
+		"server/basebackups_005/base_000000010000000000000004/tar_partitions/pg_control.tar.lz4": 10,
+		"server/wal_005/000000010000000000000003.lz4":                                            300,
+		"server/wal_005/000000010000000000000004.lz4":                                            300,
+		"server/wal_005/000000010000000000000005.lz4":                                            300,
+		"server/wal_005/00000002.history.lz4":                                                    1,
+	}}, Bucket: aws.String("bucket"), Server: aws.String("server")}
+
+	args := ParseBackupListArguments([]string{"backup-list", "--summary"}, func() { t.Fatal("Parsing of backup-list command failed") })
+	if !args.summary {
+		t.Fatal("Parsing was wrong")
+	}
+	summary, err := collectArchiveSummary(pre, []BackupTime{{Name: "base_000000010000000000000004", WalFileName: "000000010000000000000004"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.partitions["base_000000010000000000000004"] != 3 || summary.walSegments != 2 || summary.walBeforeOldest != 1 || summary.walOldest.IsZero() {
+		t.Errorf("collectArchiveSummary: unexpected %+v", summary)
+	}
+}
+
+func TestHealthArgsParsing(t *testing.T) {
+	var failed bool
+	fail := func() { failed = true }
+
+	args := ParseHealthArguments([]string{"health", "--max-backup-age", "50h"}, fail)
+	if failed || args.maxBackupAge != 50*time.Hour {
+		t.Fatal("Parsing was wrong")
+	}
+
+	ParseHealthArguments([]string{"health", "--max-backup-age", "yesterday"}, fail)
+	if !failed {
+		t.Fatal("Parsing of health command accepted wrong duration")
+	}
+}
+
+func TestScrubArgsParsing(t *testing.T) {
+	var failed bool
+	fail := func() { failed = true }
+
+	args := ParseScrubArguments([]string{"scrub", "--budget", "50G", "--duration", "6h"}, fail)
+	if failed || args.budget != 50<<30 || args.duration != 6*time.Hour {
+		t.Fatal("Parsing was wrong")
+	}
+
+	ParseScrubArguments([]string{"scrub", "--budget"}, fail)
+	if !failed {
+		t.Fatal("Parsing of scrub command accepted budget without value")
+	}
+}
+
+func TestBackupRepairArgsParsing(t *testing.T) {
+	var failed bool
+	fail := func() { failed = true }
+
+	args := ParseBackupRepairArguments([]string{"backup-repair", "base_000000010000000000000002", "--confirm"}, fail)
+	if failed || args.backupName != "base_000000010000000000000002" || !args.confirm {
+		t.Fatal("Parsing was wrong")
+	}
+
+	ParseBackupRepairArguments([]string{"backup-repair"}, fail)
+	if !failed {
+		t.Fatal("Parsing of backup-repair command accepted no backup name")
+	}
+}
+
+func TestBuildBackupTree(t *testing.T) {
+	lsn := func(value uint64) *uint64 { return &value }
+	delta := func(from string, fromLsn uint64, startLsn uint64) S3TarBallSentinelDto {
+		full, count := "full", 1
+		return S3TarBallSentinelDto{LSN: &startLsn, IncrementFrom: &from, IncrementFromLSN: &fromLsn, IncrementFullName: &full, IncrementCount: &count}
+	}
+	sentinels := map[string]S3TarBallSentinelDto{
+		"full":    {LSN: lsn(0x2000028), FinishLSN: lsn(0x2000130)},
+		"delta1":  delta("full", 0x2000028, 0x4000028),
+		"delta2":  delta("delta1", 0x4000028, 0x6000028),
+		"orphan":  delta("deleted", 0x7000028, 0x8000028),
+		"another": {LSN: lsn(0x9000028)},
+	}
+	// GetBackups returns backups from the newest
+	backups := []BackupTime{{Name: "another"}, {Name: "orphan"}, {Name: "delta2"}, {Name: "delta1"}, {Name: "full"}}
+
+	roots := buildBackupTree(backups, func(name string) S3TarBallSentinelDto { return sentinels[name] })
+	if len(roots) != 3 || roots[0].backup.Name != "full" || roots[1].backup.Name != "orphan" || roots[2].backup.Name != "another" {
+		t.Fatalf("unexpected roots %v", roots)
+	}
+	if roots[0].countDependent() != 2 || roots[0].children[0].children[0].backup.Name != "delta2" {
+		t.Fatal("delta chain was not built")
+	}
+
+	var output bytes.Buffer
+	printBackupTree(&output, roots)
+	if !strings.Contains(output.String(), "  delta1") || !strings.Contains(output.String(), "base deleted is missing") {
+		t.Errorf("unexpected tree output:\n%v", output.String())
+	}
+}
+
+func TestParseDumpPushArguments(t *testing.T) {
+	failed := false
+	fail := func() { failed = true }
+
+	args := ParseDumpPushArguments([]string{"dump-push", "db", "--", "--schema-only", "-n", "public"}, fail)
+	if failed || args.database != "db" || args.all || len(args.extraArgs) != 3 || args.extraArgs[0] != "--schema-only" {
+		t.Fatalf("Parsing was wrong %+v", args)
+	}
+
+	args = ParseDumpPushArguments([]string{"dump-push", "--all"}, fail)
+	if failed || !args.all || args.database != "" {
+		t.Fatalf("Parsing was wrong %+v", args)
+	}
+
+	ParseDumpPushArguments([]string{"dump-push", "db", "--all"}, fail)
+	if !failed {
+		t.Fatal("Database was accepted along with --all")
+	}
+
+	failed = false
+	ParseDumpPushArguments([]string{"dump-push", "db", "other"}, fail)
+	if !failed {
+		t.Fatal("Two databases were accepted")
+	}
+}
+
+func TestBackupPushRole(t *testing.T) {
+	var failed bool
+	fail := func() { failed = true }
+
+	args := ParseBackupPushArguments([]string{"backup-push", "dir", "--role", "standby"}, fail)
+	if failed || args.role != BackupRoleStandby {
+		t.Fatal("Parsing of --role was wrong")
+	}
+	ParseBackupPushArguments([]string{"backup-push", "dir", "--role", "master"}, fail)
+	if !failed {
+		t.Fatal("Parsing of backup-push command accepted wrong role")
+	}
+
+	os.Setenv("WALG_BACKUP_ROLE", "primary")
+	defer os.Unsetenv("WALG_BACKUP_ROLE")
+	if role, err := (BackupPushArguments{}).getBackupRole(); err != nil || role != BackupRolePrimary {
+		t.Errorf("WALG_BACKUP_ROLE is not used: %v %v", role, err)
+	}
+	if role, err := args.getBackupRole(); err != nil || role != BackupRoleStandby {
+		t.Errorf("--role does not override WALG_BACKUP_ROLE: %v %v", role, err)
+	}
+
+	if err := checkBackupRole(BackupRolePrimary, true); errors.Cause(err) != ErrUnexpectedRole {
+		t.Errorf("Standby is backed up as primary: %v", err)
+	}
+	if err := checkBackupRole(BackupRoleStandby, true); err != nil {
+		t.Errorf("Standby is not backed up: %v", err)
+	}
+	if err := checkBackupRole("", false); err != nil {
+		t.Errorf("Server of any role is not backed up: %v", err)
+	}
+}
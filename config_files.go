@@ -0,0 +1,177 @@
+package walg
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/jackc/pgx"
+	"github.com/pkg/errors"
+)
+
+// ConfigFilesPartition is the partition with configuration files living outside of PGDATA
+const ConfigFilesPartition = "config_files.tar.lz4"
+
+var configIncludeRegexp = regexp.MustCompile(`^\s*(include|include_if_exists|include_dir)\s*=?\s*'([^']+)'`)
+
+// backupConfigFiles reads WALG_BACKUP_CONFIG_FILES setting
+func backupConfigFiles() bool {
+	configStr, ok := lookupSetting("WALG_BACKUP_CONFIG_FILES")
+	if !ok {
+		return false
+	}
+	config, err := strconv.ParseBool(configStr)
+	if err != nil {
+		log.Fatalf("Unable to parse WALG_BACKUP_CONFIG_FILES %v\n", err)
+	}
+	return config
+}
+
+// FindConfigFiles returns postgresql.conf, pg_hba.conf, pg_ident.conf and files included by postgresql.conf
+// which are located outside of PGDATA, e.g. in /etc/postgresql on Debian. Files inside PGDATA are in the backup anyway.
+func FindConfigFiles(conn *pgx.Conn, pgdata string) ([]string, error) {
+	files := make(map[string]bool)
+	for _, setting := range []string{"config_file", "hba_file", "ident_file"} {
+		var file string
+		if err := conn.QueryRow("show " + setting).Scan(&file); err != nil {
+			return nil, errors.Wrapf(err, "FindConfigFiles: failed to read %s", setting)
+		}
+		files[file] = true
+		if setting == "config_file" {
+			if err := collectConfigIncludes(file, files); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	result := make([]string, 0, len(files))
+	for file := range files {
+		if !isInDirectory(file, pgdata) {
+			result = append(result, file)
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// collectConfigIncludes adds files included by configuration file, recursively
+func collectConfigIncludes(configFile string, files map[string]bool) error {
+	f, err := os.Open(configFile)
+	if err != nil {
+		return errors.Wrapf(err, "collectConfigIncludes: failed to open %s", configFile)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		match := configIncludeRegexp.FindStringSubmatch(scanner.Text())
+		if match == nil {
+			continue
+		}
+		included := match[2]
+		if !filepath.IsAbs(included) {
+			included = filepath.Join(filepath.Dir(configFile), included)
+		}
+
+		var includedFiles []string
+		switch match[1] {
+		case "include_dir":
+			names, err := ioutil.ReadDir(included)
+			if err != nil {
+				return errors.Wrapf(err, "collectConfigIncludes: failed to read %s", included)
+			}
+			for _, info := range names {
+				// PostgreSQL reads only *.conf files of include_dir, skipping hidden ones
+				if info.Mode().IsRegular() && strings.HasSuffix(info.Name(), ".conf") && !strings.HasPrefix(info.Name(), ".") {
+					includedFiles = append(includedFiles, filepath.Join(included, info.Name()))
+				}
+			}
+		case "include_if_exists":
+			if _, err := os.Stat(included); err != nil {
+				continue
+			}
+			includedFiles = []string{included}
+		default:
+			includedFiles = []string{included}
+		}
+
+		for _, file := range includedFiles {
+			if files[file] {
+				continue
+			}
+			files[file] = true
+			if err := collectConfigIncludes(file, files); err != nil {
+				return err
+			}
+		}
+	}
+	return errors.Wrapf(scanner.Err(), "collectConfigIncludes: failed to read %s", configFile)
+}
+
+// HandleConfigFiles uploads configuration files in a dedicated partition, file names are absolute paths
+func (bundle *Bundle) HandleConfigFiles(files []string) error {
+	bundle.NewTarBall(false)
+	tarBall := bundle.Tb
+	tarBall.SetUp(&bundle.Crypter, ConfigFilesPartition)
+	tarWriter := tarBall.Tw()
+
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return errors.Wrapf(err, "HandleConfigFiles: failed to stat %s", file)
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return errors.Wrap(err, "HandleConfigFiles: failed to grab header info")
+		}
+		hdr.Name = file
+		fmt.Println(hdr.Name)
+
+		f, err := os.Open(file)
+		if err != nil {
+			return errors.Wrapf(err, "HandleConfigFiles: failed to open file %s", file)
+		}
+		err = tarWriter.WriteHeader(hdr)
+		if err == nil {
+			_, err = io.Copy(tarWriter, io.LimitReader(f, hdr.Size))
+		}
+		f.Close()
+		if err != nil {
+			return errors.Wrapf(err, "HandleConfigFiles: failed to pack %s", file)
+		}
+		tarBall.AddSize(hdr.Size)
+	}
+
+	return errors.Wrap(tarBall.CloseTar(), "HandleConfigFiles: failed to close tarball")
+}
+
+// FetchConfigFiles extracts configuration files of the backup into directory keeping their absolute paths,
+// so directory / restores them in place.
+func FetchConfigFiles(pre *Prefix, backupName string, directory string) error {
+	bk := resolveBackup(backupName, pre)
+	key := *bk.Path + *bk.Name + "/tar_partitions/" + ConfigFilesPartition
+	exists, err := (&Archive{Prefix: pre, Archive: aws.String(key)}).CheckExistence()
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errors.Errorf("FetchConfigFiles: backup %s does not contain configuration files", *bk.Name)
+	}
+
+	reader := &S3ReaderMaker{
+		Backup:     bk,
+		Key:        aws.String(key),
+		FileFormat: CheckType(key),
+	}
+	return ExtractAll(&FileTarInterpreter{NewDir: directory}, []ReaderMaker{reader})
+}
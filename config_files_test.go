@@ -0,0 +1,47 @@
+package walg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCollectConfigIncludes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "conf.d"), 0700)
+	configFiles := map[string]string{
+		"postgresql.conf": "data_directory = '/var/lib/postgresql/data'\n" +
+			"include_dir 'conf.d'\n" +
+			"include_if_exists = 'missing.conf'\n" +
+			"#include 'commented.conf'\n" +
+			"include '" + filepath.Join(dir, "extra.conf") + "'\n",
+		"extra.conf":          "include 'postgresql.conf'\n",
+		"conf.d/memory.conf":  "shared_buffers = 1GB\n",
+		"conf.d/.hidden.conf": "",
+		"conf.d/README":       "",
+	}
+	for name, content := range configFiles {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files := make(map[string]bool)
+	if err = collectConfigIncludes(filepath.Join(dir, "postgresql.conf"), files); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"postgresql.conf", "extra.conf", "conf.d/memory.conf"}
+	if len(files) != len(expected) {
+		t.Fatalf("Unexpected included files %v", files)
+	}
+	for _, name := range expected {
+		if !files[filepath.Join(dir, name)] {
+			t.Errorf("%v is not included", name)
+		}
+	}
+}
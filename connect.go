@@ -15,9 +15,9 @@ import (
 //
 // Example: PGHOST=/var/run/postgresql or PGHOST=10.0.0.1
 func Connect() (*pgx.Conn, error) {
-	config, err := pgx.ParseEnvLibpq()
+	config, err := GetPgConnConfig()
 	if err != nil {
-		return nil, errors.Wrap(err, "Connect: unable to read environment variables")
+		return nil, errors.Wrap(err, "Connect: unable to build connection configuration")
 	}
 
 	conn, err := pgx.Connect(config)
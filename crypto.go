@@ -7,11 +7,11 @@ import (
 	"golang.org/x/crypto/openpgp"
 	"io"
 	"io/ioutil"
-	"os"
 	"os/exec"
 	"os/user"
 	"path/filepath"
 	"strings"
+	"sync"
 )
 
 // Crypter is responsible for makeing cryptographical pipeline parts when needed
@@ -52,25 +52,116 @@ func (crypter *OpenPGPCrypter) ConfigureGPGCrypter() {
 // ErrCrypterUseMischief happens when crypter is used before initialization
 var ErrCrypterUseMischief = errors.New("Crypter is not checked before use")
 
-// Encrypt creates encryption writer from ordinary writer
+// Encrypt creates encryption writer from ordinary writer. Every stream gets its own encryptor, encryption runs
+// in a separate goroutine, so it does not share a core with compression.
 func (crypter *OpenPGPCrypter) Encrypt(writer io.WriteCloser) (io.WriteCloser, error) {
 	if !crypter.configured {
 		return nil, ErrCrypterUseMischief
 	}
 	if crypter.pubKey == nil {
-		armour, err := getPubRingArmour(crypter.keyRingId)
+		entitylist, err := loadKeyRing(crypter.keyRingId, false)
 		if err != nil {
 			return nil, err
 		}
+		crypter.pubKey = entitylist
+	}
 
-		entitylist, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(armour))
-		if err != nil {
-			return nil, err
+	return newAsyncWriteCloser(&DelayWriteCloser{writer, crypter.pubKey, nil}, asyncEncryptionDepth), nil
+}
+
+// keyRings caches key rings read by gpg, so concurrent streams neither start gpg nor parse keys again
+var keyRings = struct {
+	sync.Mutex
+	public map[string]openpgp.EntityList
+	secret map[string]openpgp.EntityList
+}{public: make(map[string]openpgp.EntityList), secret: make(map[string]openpgp.EntityList)}
+
+func loadKeyRing(keyRingId string, secret bool) (openpgp.EntityList, error) {
+	keyRings.Lock()
+	defer keyRings.Unlock()
+	cache, getArmour := keyRings.public, getPubRingArmour
+	if secret {
+		cache, getArmour = keyRings.secret, getSecretRingArmour
+	}
+	if entitylist, ok := cache[keyRingId]; ok {
+		return entitylist, nil
+	}
+
+	armour, err := getArmour(keyRingId)
+	if err != nil {
+		return nil, err
+	}
+	entitylist, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(armour))
+	if err != nil {
+		return nil, err
+	}
+	cache[keyRingId] = entitylist
+	return entitylist, nil
+}
+
+// asyncEncryptionDepth is the number of compressed blocks queued for encryption
+const asyncEncryptionDepth = 4
+
+// asyncWriteCloser writes to inner writer in its own goroutine. Write error is returned by following
+// Write or Close.
+type asyncWriteCloser struct {
+	inner  io.WriteCloser
+	chunks chan []byte
+	done   chan struct{}
+	mutex  sync.Mutex
+	err    error
+}
+
+func newAsyncWriteCloser(inner io.WriteCloser, depth int) *asyncWriteCloser {
+	w := &asyncWriteCloser{inner: inner, chunks: make(chan []byte, depth), done: make(chan struct{})}
+	go func() {
+		defer close(w.done)
+		for chunk := range w.chunks {
+			if w.getErr() != nil {
+				continue // drain, so writers are not blocked
+			}
+			if _, err := w.inner.Write(chunk); err != nil {
+				w.setErr(err)
+			}
 		}
-		crypter.pubKey = entitylist
+	}()
+	return w
+}
+
+func (w *asyncWriteCloser) getErr() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.err
+}
+
+func (w *asyncWriteCloser) setErr(err error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.err = err
+}
+
+func (w *asyncWriteCloser) Write(p []byte) (int, error) {
+	if err := w.getErr(); err != nil {
+		return 0, err
 	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	// Caller reuses the buffer
+	chunk := make([]byte, len(p))
+	copy(chunk, p)
+	w.chunks <- chunk
+	return len(p), nil
+}
 
-	return &DelayWriteCloser{writer, crypter.pubKey, nil}, nil
+// Close waits until queued chunks are written and closes inner writer
+func (w *asyncWriteCloser) Close() error {
+	close(w.chunks)
+	<-w.done
+	if err := w.getErr(); err != nil {
+		return err
+	}
+	return w.inner.Close()
 }
 
 // DelayWriteCloser delays first writes.
@@ -119,12 +210,7 @@ func (crypter *OpenPGPCrypter) Decrypt(reader io.ReadCloser) (io.Reader, error)
 		return nil, ErrCrypterUseMischief
 	}
 	if crypter.secretKey == nil {
-		armour, err := getSecretRingArmour(crypter.keyRingId)
-		if err != nil {
-			return nil, err
-		}
-
-		entitylist, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(armour))
+		entitylist, err := loadKeyRing(crypter.keyRingId, true)
 		if err != nil {
 			return nil, err
 		}
@@ -141,7 +227,7 @@ func (crypter *OpenPGPCrypter) Decrypt(reader io.ReadCloser) (io.Reader, error)
 
 // GetKeyRingId extracts name of a key to use from env variable
 func GetKeyRingId() string {
-	return os.Getenv("WALE_GPG_KEY_ID")
+	return getSetting("WALE_GPG_KEY_ID")
 }
 
 const gpgBin = "gpg"
@@ -198,3 +284,46 @@ func getSecretRingArmour(keyId string) ([]byte, error) {
 	}
 	return out, nil
 }
+
+// ErrMetadataKeyMissing happens when sentinel is encrypted or decrypted without WALE_GPG_KEY_ID
+var ErrMetadataKeyMissing = errors.New("WALE_GPG_KEY_ID is required to encrypt or decrypt metadata")
+
+// nopWriteCloser turns writer into io.WriteCloser with Close doing nothing
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// encryptMetadata encrypts small object, e.g. sentinel, with the crypter used for backups
+func encryptMetadata(content []byte) ([]byte, error) {
+	crypter := &OpenPGPCrypter{}
+	if !crypter.IsUsed() {
+		return nil, ErrMetadataKeyMissing
+	}
+	var buffer bytes.Buffer
+	writer, err := crypter.Encrypt(nopWriteCloser{&buffer})
+	if err != nil {
+		return nil, err
+	}
+	if _, err = writer.Write(content); err != nil {
+		return nil, err
+	}
+	if err = writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// decryptMetadata decrypts object encrypted by encryptMetadata
+func decryptMetadata(content []byte) ([]byte, error) {
+	crypter := &OpenPGPCrypter{}
+	if !crypter.IsUsed() {
+		return nil, ErrMetadataKeyMissing
+	}
+	reader, err := crypter.Decrypt(ioutil.NopCloser(bytes.NewReader(content)))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(reader)
+}
@@ -141,3 +141,44 @@ func TestEncryptionCycle(t *testing.T) {
 		t.Errorf("Decrypted text not equals open text")
 	}
 }
+
+type failingWriteCloser struct {
+	writes int
+}
+
+func (w *failingWriteCloser) Write(p []byte) (int, error) {
+	w.writes++
+	return 0, io.ErrShortWrite
+}
+
+func (w *failingWriteCloser) Close() error {
+	return nil
+}
+
+func TestAsyncWriteCloser(t *testing.T) {
+	buffer := &ClosingBuffer{&bytes.Buffer{}}
+	w := newAsyncWriteCloser(buffer, 2)
+	chunk := make([]byte, 3)
+	for i := 0; i < 100; i++ {
+		// Buffer is reused by the caller
+		chunk[0], chunk[1], chunk[2] = byte(i), byte(i), byte(i)
+		if _, err := w.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for i, b := range buffer.Bytes() {
+		if b != byte(i/3) {
+			t.Fatalf("Unexpected byte %d at %d", b, i)
+		}
+	}
+
+	failing := &failingWriteCloser{}
+	w = newAsyncWriteCloser(failing, 2)
+	w.Write(chunk)
+	if err := w.Close(); err != io.ErrShortWrite {
+		t.Fatalf("Write error is not returned: %v", err)
+	}
+}
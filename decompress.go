@@ -1,6 +1,7 @@
 package walg
 
 import (
+	"compress/gzip"
 	"encoding/binary"
 	"github.com/pierrec/lz4"
 	"github.com/pkg/errors"
@@ -148,3 +149,14 @@ type ReadCascadeClose struct {
 	io.Reader
 	io.Closer
 }
+
+// DecompressGzip decompresses a .gz file, WAL-E archives may be compressed with gzip
+func DecompressGzip(d io.Writer, s io.Reader) error {
+	gz, err := gzip.NewReader(s)
+	if err != nil {
+		return errors.Wrap(err, "DecompressGzip: invalid gzip header")
+	}
+	defer gz.Close()
+	_, err = io.Copy(d, gz)
+	return errors.Wrap(err, "DecompressGzip: decompress failed")
+}
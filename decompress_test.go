@@ -1,6 +1,8 @@
 package walg_test
 
 import (
+	"bytes"
+	"compress/gzip"
 	"github.com/wal-g/wal-g"
 	"testing"
 )
@@ -26,3 +28,16 @@ func TestCheckType(t *testing.T) {
 		}
 	}
 }
+
+func TestDecompressGzip(t *testing.T) {
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write([]byte("WAL-E archive"))
+	gz.Close()
+
+	var decompressed bytes.Buffer
+	err := walg.DecompressGzip(&decompressed, &compressed)
+	if err != nil || decompressed.String() != "WAL-E archive" {
+		t.Fatalf("Unexpected result %q %v", decompressed.String(), err)
+	}
+}
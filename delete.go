@@ -6,7 +6,6 @@ import (
 	"log"
 	"strconv"
 	"time"
-	"strings"
 )
 
 // DeleteCommandArguments incapsulates arguments for delete command
@@ -112,11 +111,25 @@ func deleteBeforeTarget(target string, bk *Backup, pre *Prefix, findFull bool, b
 		}
 	}
 
+	if skipLine < len(backups)-1 {
+		// Dumps and streams older than the oldest retained backup are deleted as well
+		err = deleteDumpsBefore(pre, backups[skipLine].Time, dryRun)
+		if err == nil {
+			err = deleteStreamsBefore(pre, backups[skipLine].Time, dryRun)
+		}
+		if err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+	}
+
 	if !dryRun {
 		if skipLine < len(backups)-1 {
 			deleteWALBefore(backups[skipLine], pre)
 			deleteBackupsBefore(backups, skipLine, pre)
 		}
+		event := NewNotifyEvent("delete", pre)
+		event.Backup = target
+		NotifySuccess(event)
 	} else {
 		log.Printf("Dry run finished.\n")
 	}
@@ -141,21 +154,19 @@ func dropBackup(pre *Prefix, b BackupTime) {
 		log.Fatal("Unable to list backup for deletion ", b.Name, err)
 	}
 
-	folderKey := strings.TrimPrefix(*pre.Server+"/basebackups_005/"+b.Name, "/")
+	folderKey := *GetBackupPath(pre) + b.Name
 	suffixKey := folderKey + SentinelSuffix
 
-	keys := append(tarFiles, suffixKey, folderKey)
-	parts := partition(keys, 1000)
-	for _, part := range parts {
-
-		input := &s3.DeleteObjectsInput{Bucket: pre.Bucket, Delete: &s3.Delete{
-			Objects: partitionToObjects(part),
-		}}
-		_, err = pre.Svc.DeleteObjects(input)
-		if err != nil {
-			log.Fatal("Unable to delete backup ", b.Name, err)
-		}
-
+	// Sentinel is deleted last: if deletion is interrupted, the backup is still listed and rerun deletes the rest
+	err = deleteObjects(pre, partitionToObjects(tarFiles))
+	if err == nil {
+		err = deleteObjects(pre, partitionToObjects([]string{suffixKey, folderKey}))
+	}
+	if err != nil {
+		event := NewNotifyEvent("delete", pre)
+		event.Backup = b.Name
+		NotifyFailure(event, err)
+		log.Fatal("Unable to delete backup ", b.Name, err)
 	}
 }
 
@@ -167,25 +178,34 @@ func partitionToObjects(keys []string) []*s3.ObjectIdentifier {
 	return objs
 }
 
+// walDeleteChunkSize is the number of WAL files deleted at once, it keeps deletion parallel and memory bounded
+const walDeleteChunkSize = 10 * deleteBatchSize
+
 func deleteWALBefore(bt BackupTime, pre *Prefix) {
 	var bk = &Backup{
 		Prefix: pre,
-		Path:   aws.String(sanitizePath(*pre.Server + "/wal_005/")),
+		Path:   aws.String(GetWalFolderPath(pre)),
 	}
 
-	objects, err := bk.GetWals(bt.WalFileName)
-	if err != nil {
-		log.Fatal("Unable to obtaind WALS for border ", bt.Name, err)
-	}
-	parts := partitionObjects(objects, 1000)
-	for _, part := range parts {
-		input := &s3.DeleteObjectsInput{Bucket: pre.Bucket, Delete: &s3.Delete{
-			Objects: part,
-		}}
-		_, err = pre.Svc.DeleteObjects(input)
-		if err != nil {
-			log.Fatal("Unable to delete WALS before ", bt.Name, err)
+	// WAL files are deleted in chunks while they are listed, listing continues after deleted keys
+	chunk := make([]*s3.ObjectIdentifier, 0, walDeleteChunkSize)
+	err := bk.ListWals(bt.WalFileName, func(page []*s3.ObjectIdentifier) error {
+		chunk = append(chunk, page...)
+		if len(chunk) < walDeleteChunkSize {
+			return nil
 		}
+		err := deleteObjects(pre, chunk)
+		chunk = chunk[:0]
+		return err
+	})
+	if err == nil && len(chunk) > 0 {
+		err = deleteObjects(pre, chunk)
+	}
+	if err != nil {
+		event := NewNotifyEvent("delete", pre)
+		event.Backup = bt.Name
+		NotifyFailure(event, err)
+		log.Fatal("Unable to delete WALS before ", bt.Name, err)
 	}
 }
 
@@ -0,0 +1,124 @@
+package walg
+
+import (
+	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+// deleteBatchSize is the maximum number of keys in one DeleteObjects request
+const deleteBatchSize = 1000
+
+func getMaxDeleteConcurrency() int {
+	return getMaxConcurrency("WALG_DELETE_CONCURRENCY", 4)
+}
+
+// getDeleteRateLimit reads WALG_DELETE_RATE_LIMIT, maximum storage requests per second made by deletion.
+// Zero means no limit.
+func getDeleteRateLimit() float64 {
+	rateStr, ok := lookupSetting("WALG_DELETE_RATE_LIMIT")
+	if !ok {
+		return 0
+	}
+	rate, err := strconv.ParseFloat(rateStr, 64)
+	if err != nil || rate < 0 {
+		log.Fatalf("Unable to parse WALG_DELETE_RATE_LIMIT '%v'\n", rateStr)
+	}
+	return rate
+}
+
+// requestLimiter spaces storage requests evenly to stay under the rate
+type requestLimiter struct {
+	ticker *time.Ticker
+}
+
+func newRequestLimiter(requestsPerSecond float64) *requestLimiter {
+	if requestsPerSecond <= 0 {
+		return &requestLimiter{}
+	}
+	return &requestLimiter{time.NewTicker(time.Duration(float64(time.Second) / requestsPerSecond))}
+}
+
+func (limiter *requestLimiter) wait() {
+	if limiter.ticker != nil {
+		<-limiter.ticker.C
+	}
+}
+
+func (limiter *requestLimiter) stop() {
+	if limiter.ticker != nil {
+		limiter.ticker.Stop()
+	}
+}
+
+// runDeleteTasks executes tasks with WALG_DELETE_CONCURRENCY workers, each task is one storage request
+// limited by WALG_DELETE_RATE_LIMIT. Task returns number of processed objects for progress output.
+// Remaining tasks are skipped after the first error, so rerun of interrupted or failed deletion
+// only has to process what is left.
+func runDeleteTasks(action string, total int, tasks []func() (int, error)) error {
+	limiter := newRequestLimiter(getDeleteRateLimit())
+	defer limiter.stop()
+
+	queue := make(chan func() (int, error))
+	var processed int64
+	var failed int32
+	var firstErr error
+	var errOnce sync.Once
+	var wg sync.WaitGroup
+	for i := 0; i < getMaxDeleteConcurrency(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for task := range queue {
+				if atomic.LoadInt32(&failed) != 0 {
+					continue
+				}
+				limiter.wait()
+				count, err := task()
+				if err != nil {
+					atomic.StoreInt32(&failed, 1)
+					errOnce.Do(func() { firstErr = err })
+					continue
+				}
+				done := atomic.AddInt64(&processed, int64(count))
+				log.Printf("%v %d of %d objects\n", action, done, total)
+				EmitEvent(Event{Event: EventProgress, Done: done, Total: int64(total)})
+			}
+		}()
+	}
+	for _, task := range tasks {
+		queue <- task
+	}
+	close(queue)
+	wg.Wait()
+	return firstErr
+}
+
+// deleteObjectsPermanently deletes objects in parallel batches
+func deleteObjectsPermanently(pre *Prefix, objects []*s3.ObjectIdentifier) error {
+	tasks := make([]func() (int, error), 0)
+	for _, part := range partitionObjects(objects, deleteBatchSize) {
+		part := part
+		tasks = append(tasks, func() (int, error) {
+			output, err := pre.Svc.DeleteObjects(&s3.DeleteObjectsInput{Bucket: pre.Bucket, Delete: &s3.Delete{
+				Objects: part,
+			}})
+			if err != nil {
+				return 0, errors.Wrap(err, "deleteObjectsPermanently: s3.DeleteObjects failed")
+			}
+			if output != nil && len(output.Errors) > 0 {
+				e := output.Errors[0]
+				return 0, errors.Errorf("deleteObjectsPermanently: %d objects were not deleted, %v: %v %v",
+					len(output.Errors), aws.StringValue(e.Key), aws.StringValue(e.Code), aws.StringValue(e.Message))
+			}
+			return len(part), nil
+		})
+	}
+	return runDeleteTasks("Deleted", len(objects), tasks)
+}
@@ -0,0 +1,71 @@
+package walg
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestRunDeleteTasksStopsOnError(t *testing.T) {
+	os.Setenv("WALG_DELETE_CONCURRENCY", "1")
+	defer os.Unsetenv("WALG_DELETE_CONCURRENCY")
+
+	var executed int32
+	failure := errors.New("SlowDown")
+	tasks := make([]func() (int, error), 0)
+	for i := 0; i < 10; i++ {
+		i := i
+		tasks = append(tasks, func() (int, error) {
+			atomic.AddInt32(&executed, 1)
+			if i == 2 {
+				return 0, failure
+			}
+			return 1, nil
+		})
+	}
+	if err := runDeleteTasks("Deleted", 10, tasks); err != failure {
+		t.Fatalf("expected task error, got %v", err)
+	}
+	if executed != 3 {
+		t.Errorf("tasks after failure were executed: %d", executed)
+	}
+}
+
+func TestRunDeleteTasksRateLimit(t *testing.T) {
+	os.Setenv("WALG_DELETE_RATE_LIMIT", "50")
+	defer os.Unsetenv("WALG_DELETE_RATE_LIMIT")
+
+	tasks := make([]func() (int, error), 0)
+	for i := 0; i < 5; i++ {
+		tasks = append(tasks, func() (int, error) { return 1, nil })
+	}
+	start := time.Now()
+	if err := runDeleteTasks("Deleted", 5, tasks); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("5 requests at 50 per second took only %v", elapsed)
+	}
+}
+
+func TestDeleteObjectsPermanentlyInBatches(t *testing.T) {
+	svc := &memoryS3{objects: map[string]time.Time{}}
+	keys := make([]string, 2500)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("server/wal_005/%024X.lz4", i)
+		svc.objects[keys[i]] = time.Now()
+	}
+	pre := &Prefix{Svc: svc, Bucket: aws.String("bucket"), Server: aws.String("server")}
+
+	if err := deleteObjectsPermanently(pre, partitionToObjects(keys)); err != nil {
+		t.Fatal(err)
+	}
+	if len(svc.objects) != 0 {
+		t.Errorf("%d objects were not deleted", len(svc.objects))
+	}
+}
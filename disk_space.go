@@ -0,0 +1,176 @@
+package walg
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+// ErrNotEnoughDiskSpace happens when expected size of fetched data exceeds free space of target volume
+var ErrNotEnoughDiskSpace = errors.New("not enough free disk space")
+
+// errFreeDiskSpaceUnknown happens on systems where free space of a volume is not known, checks are skipped there
+var errFreeDiskSpaceUnknown = errors.New("free disk space is unknown on this system")
+
+// getFreeDiskSpace returns number of bytes available to unprivileged user on the volume of path.
+// Path may not exist yet, then its nearest existing parent is checked.
+func getFreeDiskSpace(path string) (uint64, error) {
+	path = filepath.Clean(path)
+	for {
+		free, err := statFreeDiskSpace(path)
+		if err == nil {
+			return free, nil
+		}
+		parent := filepath.Dir(path)
+		if !os.IsNotExist(err) || parent == path {
+			return 0, errors.Wrapf(err, "getFreeDiskSpace: unable to stat file system of %s", path)
+		}
+		path = parent
+	}
+}
+
+// checkFreeDiskSpace fails fast when needed bytes do not fit into the volume of path
+func checkFreeDiskSpace(path string, needed int64) error {
+	if needed <= 0 {
+		return nil
+	}
+	free, err := getFreeDiskSpace(path)
+	if errors.Cause(err) == errFreeDiskSpaceUnknown {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if uint64(needed) > free {
+		return errors.Wrapf(ErrNotEnoughDiskSpace, "%s needs %d bytes, %d bytes are free", path, needed, free)
+	}
+	return nil
+}
+
+// getBackupRestoreSize estimates size of restored backup as the largest uncompressed size in its delta chain.
+// Deltas mostly overwrite pages of the base backup, so the sum of the chain would overestimate it.
+func getBackupRestoreSize(pre *Prefix, backupName string) (int64, error) {
+	estimate, err := estimateRestoreSize(pre, backupName, "")
+	if err != nil {
+		return 0, err
+	}
+	return estimate.ExtractedSize, nil
+}
+
+// RestoreSizeEstimate is disk space restore of a backup needs, printed by backup-fetch --size-only
+type RestoreSizeEstimate struct {
+	Backup string `json:"backup"`
+	// ExtractedSize is the largest uncompressed size in the delta chain, 0 when backups do not record it
+	ExtractedSize int64 `json:"extracted_bytes"`
+	// DownloadSize is stored size of partitions of the whole delta chain
+	DownloadSize int64 `json:"download_bytes"`
+	// ScratchSize is space WALG_DOWNLOAD_CACHE_DIR grows by, partitions already cached are not counted
+	ScratchSize int64 `json:"scratch_bytes"`
+	// FreeSpace is free space of output directory volume, when it is given and the system reports it
+	FreeSpace *uint64 `json:"free_bytes,omitempty"`
+	Backups   int     `json:"delta_chain_length"`
+}
+
+// estimateRestoreSize sums sizes recorded in sentinels of the delta chain. Partition sizes absent in older
+// sentinels are taken from storage listing. Free space of dirArc is reported unless it is empty.
+func estimateRestoreSize(pre *Prefix, backupName string, dirArc string) (*RestoreSizeEstimate, error) {
+	bk, err := findBackup(backupName, pre)
+	if err != nil {
+		return nil, err
+	}
+	estimate := &RestoreSizeEstimate{Backup: *bk.Name}
+	cacheDir := getDownloadCacheDir()
+	for backupName = *bk.Name; backupName != ""; estimate.Backups++ {
+		sentinel, err := readSentinel(backupName, bk, pre)
+		if err != nil {
+			return nil, err
+		}
+		var rawSize int64
+		for _, partition := range sentinel.Partitions {
+			rawSize += partition.RawSize
+			estimate.DownloadSize += partition.Size
+			if cacheDir != "" && partition.Sha256 != "" && !isCached(cacheDir, partition) {
+				estimate.ScratchSize += partition.Size
+			}
+		}
+		if len(sentinel.Partitions) == 0 {
+			err = listAllObjects(pre, *GetBackupPath(pre)+backupName+"/tar_partitions/", func(ob *s3.Object) {
+				estimate.DownloadSize += aws.Int64Value(ob.Size)
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		if sentinel.UncompressedSize == 0 {
+			sentinel.UncompressedSize = rawSize
+		}
+		estimate.ExtractedSize = maxInt64(estimate.ExtractedSize, sentinel.UncompressedSize)
+		backupName = ""
+		if sentinel.IsIncremental() {
+			backupName = *sentinel.IncrementFrom
+		}
+	}
+	if dirArc != "" {
+		free, err := getFreeDiskSpace(dirArc)
+		if err != nil && errors.Cause(err) != errFreeDiskSpaceUnknown {
+			return nil, err
+		}
+		if err == nil {
+			estimate.FreeSpace = &free
+		}
+	}
+	return estimate, nil
+}
+
+// isCached checks that download cache holds partition of recorded size
+func isCached(cacheDir string, partition PartitionDescription) bool {
+	cachePath := downloadCachePath(cacheDir, partition.Sha256)
+	if cachePath == "" {
+		return false
+	}
+	stat, err := os.Stat(cachePath)
+	return err == nil && stat.Size() == partition.Size
+}
+
+func maxInt64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// skipDiskSpaceCheck reads WALG_SKIP_DISK_SPACE_CHECK override, free space is misleading on compressing
+// or thin provisioned file systems
+func skipDiskSpaceCheck() bool {
+	skipStr, ok := lookupSetting("WALG_SKIP_DISK_SPACE_CHECK")
+	if !ok {
+		return false
+	}
+	skip, err := strconv.ParseBool(skipStr)
+	if err != nil {
+		log.Fatal("Unable to parse WALG_SKIP_DISK_SPACE_CHECK ", err)
+	}
+	return skip
+}
+
+// hasPrefetchSpace checks that volume has room for segments prefetched concurrently and for the one
+// PostgreSQL fetches itself. Prefetch is skipped otherwise, it is only an optimization.
+func hasPrefetchSpace(location string, prefetched int) bool {
+	if skipDiskSpaceCheck() {
+		return true
+	}
+	free, err := getFreeDiskSpace(location)
+	if errors.Cause(err) == errFreeDiskSpaceUnknown {
+		return true
+	}
+	if err != nil {
+		log.Println("WAL-prefetch unable to check free disk space: ", err)
+		return true
+	}
+	return free >= GetWalSegmentSize()*uint64(prefetched+1)
+}
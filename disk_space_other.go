@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !windows
+// +build !linux,!darwin,!windows
+
+package walg
+
+// statFreeDiskSpace does not know statfs layout of other systems, free space checks are skipped there
+func statFreeDiskSpace(path string) (uint64, error) {
+	return 0, errFreeDiskSpaceUnknown
+}
@@ -0,0 +1,15 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package walg
+
+import "syscall"
+
+// statFreeDiskSpace returns space available to unprivileged user with statfs
+func statFreeDiskSpace(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,108 @@
+package walg
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/pkg/errors"
+)
+
+func TestCheckFreeDiskSpace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walg-disk-space")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Directory does not exist yet, its parent is checked
+	target := filepath.Join(dir, "not", "created")
+	if err = checkFreeDiskSpace(target, 1); err != nil {
+		t.Errorf("checkFreeDiskSpace: unexpected error %v", err)
+	}
+	if err = checkFreeDiskSpace(target, 0); err != nil {
+		t.Errorf("checkFreeDiskSpace: unexpected error %v", err)
+	}
+	err = checkFreeDiskSpace(target, math.MaxInt64)
+	if errors.Cause(err) != ErrNotEnoughDiskSpace {
+		t.Errorf("checkFreeDiskSpace: expected not enough space, got %v", err)
+	}
+}
+
+// backupChainS3 serves sentinels and lists partitions of given sizes
+type backupChainS3 struct {
+	s3iface.S3API
+	sentinels  map[string]string
+	partitions map[string]int64
+}
+
+func (m *backupChainS3) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	if _, ok := m.sentinels[*input.Key]; !ok {
+		return nil, awserr.New("NotFound", "not found", nil)
+	}
+	return &s3.HeadObjectOutput{}, nil
+}
+
+func (m *backupChainS3) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(strings.NewReader(m.sentinels[*input.Key]))}, nil
+}
+
+func (m *backupChainS3) ListObjectsV2Pages(input *s3.ListObjectsV2Input, callback func(*s3.ListObjectsV2Output, bool) bool) error {
+	output := &s3.ListObjectsV2Output{}
+	for key, size := range m.partitions {
+		if strings.HasPrefix(key, *input.Prefix) {
+			output.Contents = append(output.Contents, &s3.Object{Key: aws.String(key), Size: aws.Int64(size)})
+		}
+	}
+	callback(output, true)
+	return nil
+}
+
+func TestEstimateRestoreSize(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "walg-download-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	SetSettings(map[string]string{"WALG_DOWNLOAD_CACHE_DIR": cacheDir})
+	defer SetSettings(nil)
+
+	sum := strings.Repeat("ab", 32)
+	if err = os.MkdirAll(filepath.Dir(downloadCachePath(cacheDir, sum)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(downloadCachePath(cacheDir, sum), make([]byte, 30), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Delta records its partitions, older base backup has neither partitions nor uncompressed size
+	path := "server/basebackups_005/"
+	svc := &backupChainS3{
+		sentinels: map[string]string{
+			path + "base_000000010000000000000004_D_000000010000000000000002" + SentinelSuffix: `{"DeltaFrom":"base_000000010000000000000002","DeltaFromLSN":1,"DeltaFullName":"base_000000010000000000000002","DeltaCount":1,
+				"Partitions":{"part_001.tar.lz4":{"Size":30,"Sha256":"` + sum + `","RawSize":100},
+				"part_002.tar.lz4":{"Size":20,"Sha256":"` + strings.Repeat("cd", 32) + `","RawSize":50}}}`,
+			path + "base_000000010000000000000002" + SentinelSuffix: `{}`,
+		},
+		partitions: map[string]int64{
+			path + "base_000000010000000000000002/tar_partitions/part_001.tar.lz4": 400,
+			path + "base_000000010000000000000002/tar_partitions/part_002.tar.lz4": 100,
+		},
+	}
+	pre := &Prefix{Svc: svc, Bucket: aws.String("bucket"), Server: aws.String("server")}
+
+	estimate, err := estimateRestoreSize(pre, "base_000000010000000000000004_D_000000010000000000000002", cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if estimate.ExtractedSize != 150 || estimate.DownloadSize != 550 || estimate.ScratchSize != 20 || estimate.Backups != 2 || estimate.FreeSpace == nil {
+		t.Errorf("unexpected estimate %+v", estimate)
+	}
+}
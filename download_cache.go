@@ -0,0 +1,174 @@
+package walg
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/pkg/errors"
+)
+
+// sha256HexRegexp matches SHA256 sums as recorded in sentinels and object metadata
+var sha256HexRegexp = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// getDownloadCacheDir returns WALG_DOWNLOAD_CACHE_DIR, empty directory disables the cache
+func getDownloadCacheDir() string {
+	return getSetting("WALG_DOWNLOAD_CACHE_DIR")
+}
+
+// downloadCachePath is the cache file of object with SHA256 sum, files are spread over subdirectories
+// by the first byte of the sum. Sum comes from storage, path is empty unless it is hex encoded SHA256,
+// so it never points outside of the cache.
+func downloadCachePath(dir string, sum string) string {
+	if !sha256HexRegexp.MatchString(sum) {
+		return ""
+	}
+	return filepath.Join(dir, sum[:2], sum)
+}
+
+// openCachedObject serves object with known SHA256 and size from WALG_DOWNLOAD_CACHE_DIR. Object missing in
+// the cache is downloaded and stored to the cache once it is read to the end and its checksum matches, so
+// restoring the same backup repeatedly does not download it again. Objects without checksum are not cached.
+// Cache failures are only logged, the object is downloaded as if there were no cache.
+func openCachedObject(key string, sum string, size int64, download func() (io.ReadCloser, error)) (io.ReadCloser, error) {
+	dir := getDownloadCacheDir()
+	if dir == "" {
+		return download()
+	}
+	cachePath := downloadCachePath(dir, sum)
+	if cachePath == "" {
+		return download()
+	}
+	if file, err := os.Open(cachePath); err == nil {
+		if stat, err := file.Stat(); err == nil && stat.Size() == size {
+			infof("Serving %s from download cache\n", key)
+			return &cachedFileReader{sha256Reader: newSha256Reader(file), file: file, sum: sum}, nil
+		}
+		file.Close()
+	}
+
+	object, err := download()
+	if err != nil {
+		return nil, err
+	}
+	temp, err := createCacheTempFile(filepath.Dir(cachePath))
+	if err != nil {
+		log.Printf("WARNING! Download cache is not written: %v\n", err)
+		return object, nil
+	}
+	cacheFile := &cacheFileWriter{file: temp}
+	return &cachingReader{
+		sha256Reader: newSha256Reader(io.TeeReader(object, cacheFile)),
+		object:       object,
+		temp:         cacheFile,
+		cachePath:    cachePath,
+		sum:          sum,
+		size:         size,
+	}, nil
+}
+
+func createCacheTempFile(dir string) (*os.File, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrapf(err, "createCacheTempFile: unable to create %s", dir)
+	}
+	temp, err := ioutil.TempFile(dir, ".download-")
+	if err != nil {
+		return nil, errors.Wrapf(err, "createCacheTempFile: unable to create file in %s", dir)
+	}
+	return temp, nil
+}
+
+// cacheFileWriter remembers write error instead of returning it, so failing cache does not fail the download
+type cacheFileWriter struct {
+	file *os.File
+	err  error
+}
+
+func (w *cacheFileWriter) Write(p []byte) (int, error) {
+	if w.err == nil {
+		_, w.err = w.file.Write(p)
+		if w.err != nil {
+			log.Printf("WARNING! Download cache is not written: %v\n", w.err)
+		}
+	}
+	return len(p), nil
+}
+
+// cachingReader copies downloaded object to a temporary file, which becomes the cache file on Close
+// if the object was read completely and matches its checksum
+type cachingReader struct {
+	*sha256Reader
+	object    io.ReadCloser
+	temp      *cacheFileWriter
+	cachePath string
+	sum       string
+	size      int64
+	complete  bool
+}
+
+func (r *cachingReader) Read(p []byte) (n int, err error) {
+	n, err = r.sha256Reader.Read(p)
+	if err == io.EOF {
+		r.complete = true
+	}
+	return n, err
+}
+
+// Close closes the object and moves the temporary file into the cache
+func (r *cachingReader) Close() error {
+	err := r.object.Close()
+	tempPath := r.temp.file.Name()
+	closeErr := r.temp.file.Close()
+	if !r.complete || closeErr != nil || r.temp.err != nil || r.Size() != r.size || r.Sum() != r.sum {
+		os.Remove(tempPath)
+		return err
+	}
+	// Concurrent restores may cache the same object, rename is atomic and either copy is fine
+	if renameErr := os.Rename(tempPath, r.cachePath); renameErr != nil {
+		log.Printf("WARNING! Download cache is not written: %v\n", renameErr)
+		os.Remove(tempPath)
+	}
+	return err
+}
+
+// cachedFileReader removes cache file which does not match its checksum once it is read to the end, so
+// corrupted cache file is downloaded again by the next restore
+type cachedFileReader struct {
+	*sha256Reader
+	file    *os.File
+	sum     string
+	checked bool
+}
+
+func (r *cachedFileReader) Read(p []byte) (n int, err error) {
+	n, err = r.sha256Reader.Read(p)
+	if err == io.EOF && !r.checked {
+		r.checked = true
+		if r.Sum() != r.sum {
+			log.Printf("WARNING! %s does not match its checksum, it is removed from download cache\n", r.file.Name())
+			os.Remove(r.file.Name())
+		}
+	}
+	return n, err
+}
+
+// Close closes the cache file
+func (r *cachedFileReader) Close() error {
+	return r.file.Close()
+}
+
+// getCachedArchive is GetArchive served from download cache when it is enabled. Checksum of the archive
+// is read from its metadata, which costs HEAD request per archive.
+func (a *Archive) getCachedArchive() (io.ReadCloser, error) {
+	if getDownloadCacheDir() == "" {
+		return a.GetArchive()
+	}
+	sum, size, err := a.GetChecksum()
+	if err != nil {
+		return nil, err
+	}
+	return openCachedObject(*a.Archive, sum, size, a.GetArchive)
+}
@@ -0,0 +1,79 @@
+package walg
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestOpenCachedObject(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walg-download-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	SetSettings(map[string]string{"WALG_DOWNLOAD_CACHE_DIR": dir})
+	defer SetSettings(nil)
+
+	content := []byte("partition content")
+	downloads := 0
+	download := func() (io.ReadCloser, error) {
+		downloads++
+		return ioutil.NopCloser(bytes.NewReader(content)), nil
+	}
+	read := func(sum string) []byte {
+		reader, err := openCachedObject("server/part_1.tar.lz4", sum, int64(len(content)), download)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = reader.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	// Object not matching its checksum is not cached
+	read(sha256Hex([]byte("other content")))
+	read(sha256Hex([]byte("other content")))
+	if downloads != 2 {
+		t.Errorf("openCachedObject: object with wrong checksum is served from cache")
+	}
+
+	sum := sha256Hex(content)
+	for i := 0; i < 2; i++ {
+		if data := read(sum); !bytes.Equal(data, content) {
+			t.Errorf("openCachedObject: unexpected content %q", data)
+		}
+	}
+	if downloads != 3 {
+		t.Errorf("openCachedObject: object is downloaded %d times", downloads)
+	}
+	if _, err := os.Stat(downloadCachePath(dir, sum)); err != nil {
+		t.Errorf("openCachedObject: cache file is missing: %v", err)
+	}
+
+	// Corrupted cache file is served once and removed, the next read downloads the object again
+	if err = ioutil.WriteFile(downloadCachePath(dir, sum), bytes.ToUpper(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	read(sum)
+	if _, err := os.Stat(downloadCachePath(dir, sum)); !os.IsNotExist(err) {
+		t.Errorf("openCachedObject: corrupted cache file is kept")
+	}
+	if data := read(sum); !bytes.Equal(data, content) || downloads != 4 {
+		t.Errorf("openCachedObject: corrupted cache file is served again")
+	}
+
+	// Sum is not trusted to name a file in the cache
+	for _, sum := range []string{"", "../../../etc/passwd", sha256Hex(content)[:63] + "/"} {
+		if cachePath := downloadCachePath(dir, sum); cachePath != "" {
+			t.Errorf("downloadCachePath: %s for sum '%s'", cachePath, sum)
+		}
+	}
+}
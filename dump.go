@@ -0,0 +1,366 @@
+package walg
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+// DumpUsage is a text message explaining how to use dump-push, dump-fetch and dump-list
+var DumpUsage = "usage:\twal-g dump-push [database] [-- pg_dump_options]    logical backup of database with pg_dump in custom format" + `
+	wal-g dump-push --all [-- pg_dumpall_options]        logical backup of the cluster with pg_dumpall
+	wal-g dump-fetch dump_name|LATEST [file]             write dump to file or stdout, e.g. for pg_restore or psql
+	wal-g dump-list                                      list dumps
+Dumps are compressed and encrypted like backups and deleted by delete along with backups older than them.
+`
+
+// DumpSentinelSuffix is the suffix of dump sentinel, dump is complete when sentinel is uploaded
+const DumpSentinelSuffix = "_dump_sentinel.json"
+
+// ErrDumpNotFound happens when there are no dumps or requested dump does not exist
+var ErrDumpNotFound = errors.New("dump not found")
+
+func printDumpUsageAndFail() {
+	log.Fatal(DumpUsage)
+}
+
+// DumpPushArguments holds arguments of dump-push
+type DumpPushArguments struct {
+	database  string
+	all       bool
+	extraArgs []string
+}
+
+// DumpSentinelDto describes dump
+type DumpSentinelDto struct {
+	Database         string `json:"Database,omitempty"`
+	Format           string
+	StartTime        time.Time
+	FinishTime       time.Time
+	UncompressedSize int64
+	WalgVersion      string `json:"WalgVersion,omitempty"`
+}
+
+// DumpTime is a dump name with its finish time
+type DumpTime struct {
+	Name string
+	Time time.Time
+}
+
+// ParseDumpPushArguments interprets arguments for dump-push command. In case of any error it calls fallBackFunc
+func ParseDumpPushArguments(args []string, fallBackFunc func()) (result DumpPushArguments) {
+	params := args[1:]
+	for i, param := range params {
+		if param == "--" {
+			result.extraArgs = params[i+1:]
+			params = params[:i]
+			break
+		}
+	}
+	for _, param := range params {
+		switch {
+		case param == "--all":
+			result.all = true
+		case strings.HasPrefix(param, "-") || result.database != "":
+			fallBackFunc()
+			return
+		default:
+			result.database = param
+		}
+	}
+	if result.all && result.database != "" {
+		log.Println("Database can not be specified with --all")
+		fallBackFunc()
+	}
+	return
+}
+
+// GetDumpPath gets path for dumps in a bucket
+func GetDumpPath(pre *Prefix) string {
+	return sanitizePath(*pre.Server + "/dumps_005/")
+}
+
+func getDumpDataKey(pre *Prefix, name string) string {
+	return GetDumpPath(pre) + name + "/dump.lz4"
+}
+
+// HandleDumpPush is invoked to perform wal-g dump-push
+func HandleDumpPush(tu *TarUploader, pre *Prefix, args []string) {
+	arguments := ParseDumpPushArguments(args, printDumpUsageAndFail)
+	name, err := PushDump(tu, pre, arguments)
+	if err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+	fmt.Println("Uploaded dump", name)
+}
+
+// PushDump runs pg_dump or pg_dumpall and streams its output through compression and encryption to storage.
+// Connection settings WALG_PG_* are passed to pg_dump as libpq variables.
+func PushDump(tu *TarUploader, pre *Prefix, arguments DumpPushArguments) (string, error) {
+	sentinel := DumpSentinelDto{Database: arguments.database, Format: "custom", StartTime: time.Now().UTC(), WalgVersion: WalgVersion}
+	command := "pg_dump"
+	commandArgs := append([]string{"--format=custom"}, arguments.extraArgs...)
+	nameSuffix := arguments.database
+	if arguments.all {
+		command = "pg_dumpall"
+		commandArgs = arguments.extraArgs
+		sentinel.Format = "plain"
+		nameSuffix = "all"
+	} else if arguments.database != "" {
+		commandArgs = append(commandArgs, arguments.database)
+	}
+	if nameSuffix == "" {
+		nameSuffix = "default"
+	}
+	name := "dump_" + sentinel.StartTime.Format("20060102T150405Z") + "_" + nameSuffix
+
+	cmd := exec.Command(command, commandArgs...)
+	cmd.Env = getPgDumpEnvironment()
+	size, err := uploadCommandOutput(tu, pre, cmd, getDumpDataKey(pre, name))
+	if err != nil {
+		return "", errors.Wrap(err, "PushDump: dump failed")
+	}
+
+	sentinel.FinishTime = time.Now().UTC()
+	sentinel.UncompressedSize = size
+	err = uploadJSONSentinel(tu, GetDumpPath(pre)+name+DumpSentinelSuffix, &sentinel)
+	return name, errors.Wrap(err, "PushDump: failed to upload sentinel")
+}
+
+// uploadCommandOutput runs the command and streams its output through compression and encryption to key.
+// Object of failed command is removed not to be mistaken for a complete one. Returns uncompressed size.
+func uploadCommandOutput(tu *TarUploader, pre *Prefix, cmd *exec.Cmd, key string) (int64, error) {
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return 0, errors.Wrap(err, "uploadCommandOutput: failed to create pipe")
+	}
+	if err = cmd.Start(); err != nil {
+		return 0, errors.Wrapf(err, "uploadCommandOutput: failed to start %s", cmd.Path)
+	}
+
+	counter := &countingReader{reader: stdout}
+	lz := &LzPipeWriter{Input: counter}
+	lz.Compress(&OpenPGPCrypter{})
+	err = tu.upload(tu.createUploadInput(key, lz.Output), key)
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return 0, errors.Wrap(err, "uploadCommandOutput: upload failed")
+	}
+	if err = cmd.Wait(); err != nil {
+		deleteObjectsPermanently(pre, partitionToObjects([]string{key}))
+		return 0, errors.Wrapf(err, "uploadCommandOutput: %s failed", cmd.Path)
+	}
+	return counter.Count(), nil
+}
+
+// uploadJSONSentinel uploads sentinel marking the end of a stream backup
+func uploadJSONSentinel(tu *TarUploader, key string, sentinel interface{}) error {
+	body, err := json.Marshal(sentinel)
+	if err != nil {
+		return errors.Wrap(err, "uploadJSONSentinel: failed to marshal sentinel")
+	}
+	return tu.uploadSentinel(key, body)
+}
+
+// getPgDumpEnvironment passes WALG_PG_* connection settings to pg_dump as libpq variables
+func getPgDumpEnvironment() []string {
+	env := settingsEnviron()
+	for name, libpqName := range pgConnectionSettings {
+		if value, ok := lookupSetting(name); ok {
+			env = append(env, libpqName+"="+value)
+		}
+	}
+	return env
+}
+
+// countingReader counts bytes read, count can be read concurrently
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (r *countingReader) Read(p []byte) (n int, err error) {
+	n, err = r.reader.Read(p)
+	atomic.AddInt64(&r.count, int64(n))
+	return
+}
+
+// Count returns number of bytes read so far
+func (r *countingReader) Count() int64 {
+	return atomic.LoadInt64(&r.count)
+}
+
+// GetDumps lists complete dumps sorted from the newest
+func GetDumps(pre *Prefix) ([]DumpTime, error) {
+	return listStreamBackups(pre, GetDumpPath(pre), DumpSentinelSuffix)
+}
+
+// listStreamBackups lists names of backups with sentinels directly under the path, sorted from the newest
+func listStreamBackups(pre *Prefix, backupPath string, sentinelSuffix string) ([]DumpTime, error) {
+	backups := make([]DumpTime, 0)
+	err := listAllObjects(pre, backupPath, func(ob *s3.Object) {
+		key := strings.TrimPrefix(*ob.Key, backupPath)
+		if strings.HasSuffix(key, sentinelSuffix) && !strings.Contains(key, "/") {
+			backups = append(backups, DumpTime{strings.TrimSuffix(key, sentinelSuffix), *ob.LastModified})
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].Time.After(backups[j].Time)
+	})
+	return backups, nil
+}
+
+// deleteStreamBackups deletes backups along with other objects they depend on. Sentinels are deleted last,
+// like sentinels of base backups, so interrupted deletion never leaves sentinel of a partially deleted backup.
+func deleteStreamBackups(pre *Prefix, backupPath string, dataObject string, backups []DumpTime, extraKeys []string, dryRun bool) error {
+	keys := append([]string{}, extraKeys...)
+	sentinels := make([]string, 0, len(backups))
+	for _, backup := range backups {
+		fmt.Printf("%v will be deleted\n", backup.Name)
+		keys = append(keys, backupPath+backup.Name+"/"+dataObject)
+		sentinels = append(sentinels, backupPath+backup.Name+SentinelSuffix)
+	}
+	if dryRun {
+		fmt.Printf("%d objects will be deleted, add --confirm to delete\n", len(keys)+len(sentinels))
+		return nil
+	}
+	if err := deleteObjects(pre, partitionToObjects(keys)); err != nil {
+		return err
+	}
+	return deleteObjects(pre, partitionToObjects(sentinels))
+}
+
+func fetchDumpSentinel(pre *Prefix, name string) (*DumpSentinelDto, error) {
+	sentinel := &DumpSentinelDto{}
+	err := fetchJSONSentinel(pre, GetDumpPath(pre)+name+DumpSentinelSuffix, sentinel)
+	return sentinel, err
+}
+
+func fetchJSONSentinel(pre *Prefix, key string, sentinel interface{}) error {
+	body, err := readSentinelObject(pre, key)
+	if err != nil {
+		return errors.Wrap(err, "fetchJSONSentinel: failed to read sentinel")
+	}
+	return errors.Wrap(json.Unmarshal(body, sentinel), "fetchJSONSentinel: failed to unmarshal sentinel")
+}
+
+// HandleDumpList is invoked to perform wal-g dump-list
+func HandleDumpList(pre *Prefix) {
+	dumps, err := GetDumps(pre)
+	if err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+	defer w.Flush()
+	fmt.Fprintln(w, "name\tlast_modified\tdatabase\tformat\tsize")
+	for i := len(dumps) - 1; i >= 0; i-- {
+		sentinel, err := fetchDumpSentinel(pre, dumps[i].Name)
+		if err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", dumps[i].Name, dumps[i].Time.Format(time.RFC3339),
+			sentinel.Database, sentinel.Format, sentinel.UncompressedSize)
+	}
+}
+
+// HandleDumpFetch is invoked to perform wal-g dump-fetch
+func HandleDumpFetch(pre *Prefix, args []string) {
+	if len(args) < 2 || len(args) > 3 {
+		printDumpUsageAndFail()
+	}
+	output := os.Stdout
+	if len(args) == 3 {
+		var err error
+		output, err = os.Create(args[2])
+		if err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+	}
+
+	err := FetchDump(pre, args[1], output)
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+}
+
+// FetchDump writes decrypted and decompressed dump to output
+func FetchDump(pre *Prefix, name string, output io.Writer) error {
+	if name == "LATEST" {
+		dumps, err := GetDumps(pre)
+		if err != nil {
+			return err
+		}
+		if len(dumps) == 0 {
+			return errors.Wrap(ErrDumpNotFound, "FetchDump: no dumps found")
+		}
+		name = dumps[0].Name
+		log.Printf("Fetching dump %v\n", name)
+	}
+
+	a := &Archive{Prefix: pre, Archive: aws.String(GetDumpPath(pre) + name + DumpSentinelSuffix)}
+	exists, err := a.CheckExistence()
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errors.Wrapf(ErrDumpNotFound, "FetchDump: %s", name)
+	}
+	return fetchStreamObject(pre, getDumpDataKey(pre, name), output)
+}
+
+// fetchStreamObject writes decrypted and decompressed object to output
+func fetchStreamObject(pre *Prefix, key string, output io.Writer) error {
+	reader, err := (&Archive{Prefix: pre, Archive: aws.String(key)}).GetArchive()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	return decodeObject(output, reader, key)
+}
+
+// deleteDumpsBefore deletes dumps finished before the time, so dumps share retention with backups
+func deleteDumpsBefore(pre *Prefix, before time.Time, dryRun bool) error {
+	dumps, err := GetDumps(pre)
+	if err != nil {
+		return err
+	}
+	for _, dump := range dumps {
+		if !dump.Time.Before(before) {
+			continue
+		}
+		if dryRun {
+			log.Printf("%v will be deleted\n", dump.Name)
+			continue
+		}
+		// Sentinel is deleted last, like sentinels of backups
+		dumpPath := GetDumpPath(pre) + dump.Name
+		err = deleteObjects(pre, partitionToObjects([]string{getDumpDataKey(pre, dump.Name)}))
+		if err == nil {
+			err = deleteObjects(pre, partitionToObjects([]string{dumpPath + DumpSentinelSuffix}))
+		}
+		if err != nil {
+			return errors.Wrapf(err, "deleteDumpsBefore: unable to delete %s", dump.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package walg
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestGetDumpsAndDeleteDumpsBefore(t *testing.T) {
+	now := time.Now()
+	svc := &memoryS3{objects: map[string]time.Time{
+		"server/dumps_005/dump_20180101T000000Z_db/dump.lz4":            now.Add(-72 * time.Hour),
+		"server/dumps_005/dump_20180101T000000Z_db_dump_sentinel.json":  now.Add(-72 * time.Hour),
+		"server/dumps_005/dump_20180102T000000Z_all/dump.lz4":           now.Add(-48 * time.Hour),
+		"server/dumps_005/dump_20180102T000000Z_all_dump_sentinel.json": now.Add(-48 * time.Hour),
+		"server/dumps_005/dump_20180103T000000Z_db/dump.lz4":            now.Add(-time.Hour),
+	}}
+	pre := &Prefix{Svc: svc, Bucket: aws.String("bucket"), Server: aws.String("server")}
+
+	dumps, err := GetDumps(pre)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dumps) != 2 || dumps[0].Name != "dump_20180102T000000Z_all" || dumps[1].Name != "dump_20180101T000000Z_db" {
+		t.Fatalf("Unexpected dumps %v, incomplete dump must not be listed", dumps)
+	}
+
+	if err = deleteDumpsBefore(pre, now.Add(-24*time.Hour), true); err != nil || len(svc.keys()) != 5 {
+		t.Fatalf("Dry run deleted objects: %v %v", svc.keys(), err)
+	}
+	if err = deleteDumpsBefore(pre, now.Add(-60*time.Hour), false); err != nil {
+		t.Fatal(err)
+	}
+	keys := svc.keys()
+	if len(keys) != 3 || keys[0] != "server/dumps_005/dump_20180102T000000Z_all/dump.lz4" {
+		t.Fatalf("Unexpected objects left %v", keys)
+	}
+}
+
+func TestDeleteStreamBackups(t *testing.T) {
+	now := time.Now()
+	svc := &memoryS3{objects: map[string]time.Time{
+		"server/redis/basebackups_005/base_1/dump.rdb.lz4":              now,
+		"server/redis/basebackups_005/base_1_backup_stop_sentinel.json": now,
+		"server/redis/basebackups_005/base_2/dump.rdb.lz4":              now,
+		"server/redis/basebackups_005/base_2_backup_stop_sentinel.json": now,
+	}}
+	pre := &Prefix{Svc: svc, Bucket: aws.String("bucket"), Server: aws.String("server")}
+	backups := []DumpTime{{Name: "base_1", Time: now}}
+
+	if err := deleteStreamBackups(pre, GetRedisBackupPath(pre), "dump.rdb.lz4", backups, nil, true); err != nil || len(svc.keys()) != 4 {
+		t.Fatalf("Dry run deleted objects: %v %v", svc.keys(), err)
+	}
+	if err := deleteStreamBackups(pre, GetRedisBackupPath(pre), "dump.rdb.lz4", backups, nil, false); err != nil {
+		t.Fatal(err)
+	}
+	keys := svc.keys()
+	if len(keys) != 2 || keys[0] != "server/redis/basebackups_005/base_2/dump.rdb.lz4" {
+		t.Fatalf("Unexpected objects left %v", keys)
+	}
+}
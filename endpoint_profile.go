@@ -0,0 +1,42 @@
+package walg
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// endpointProfile holds settings known to work with S3-compatible storage. Settings set explicitly
+// by AWS_S3_FORCE_PATH_STYLE and AWS_REGION take precedence.
+type endpointProfile struct {
+	ForcePathStyle     bool
+	Region             string
+	Disable100Continue bool
+}
+
+var endpointProfiles = map[string]endpointProfile{
+	"aws":   {},
+	"minio": {ForcePathStyle: true, Region: "us-east-1", Disable100Continue: true},
+	"ceph":  {ForcePathStyle: true, Region: "us-east-1", Disable100Continue: true},
+	"r2":    {ForcePathStyle: true, Region: "auto", Disable100Continue: true},
+}
+
+// getEndpointProfile reads WALG_S3_ENDPOINT_PROFILE, by default there is no profile
+func getEndpointProfile() (*endpointProfile, error) {
+	name := getSetting("WALG_S3_ENDPOINT_PROFILE")
+	if name == "" {
+		return nil, nil
+	}
+	profile, ok := endpointProfiles[strings.ToLower(name)]
+	if !ok {
+		names := make([]string, 0, len(endpointProfiles))
+		for known := range endpointProfiles {
+			names = append(names, known)
+		}
+		sort.Strings(names)
+		return nil, errors.Errorf("getEndpointProfile: unknown WALG_S3_ENDPOINT_PROFILE '%s', one of %s expected",
+			name, strings.Join(names, ", "))
+	}
+	return &profile, nil
+}
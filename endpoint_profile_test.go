@@ -0,0 +1,29 @@
+package walg
+
+import (
+	"os"
+	"testing"
+)
+
+func TestGetEndpointProfile(t *testing.T) {
+	defer os.Unsetenv("WALG_S3_ENDPOINT_PROFILE")
+	if profile, err := getEndpointProfile(); profile != nil || err != nil {
+		t.Fatalf("Unexpected profile %+v %v", profile, err)
+	}
+
+	os.Setenv("WALG_S3_ENDPOINT_PROFILE", "MinIO")
+	profile, err := getEndpointProfile()
+	if err != nil || !profile.ForcePathStyle || profile.Region != "us-east-1" || !profile.Disable100Continue {
+		t.Fatalf("Unexpected profile %+v %v", profile, err)
+	}
+
+	os.Setenv("WALG_S3_ENDPOINT_PROFILE", "r2")
+	if profile, err = getEndpointProfile(); err != nil || profile.Region != "auto" {
+		t.Fatalf("Unexpected profile %+v %v", profile, err)
+	}
+
+	os.Setenv("WALG_S3_ENDPOINT_PROFILE", "gcs")
+	if _, err = getEndpointProfile(); err == nil {
+		t.Fatal("Error expected for unknown profile")
+	}
+}
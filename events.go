@@ -0,0 +1,156 @@
+package walg
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event is a lifecycle event written by --json-events as a line of JSON
+type Event struct {
+	Event   string    `json:"event"`
+	Time    time.Time `json:"time"`
+	Command string    `json:"command"`
+	Object  string    `json:"object,omitempty"`
+	Bytes   int64     `json:"bytes,omitempty"`
+	Done    int64     `json:"done,omitempty"`
+	Total   int64     `json:"total,omitempty"`
+	Error   string    `json:"error,omitempty"`
+	// Server is the server state reported with backup-push progress
+	Server *ServerProgress `json:"server,omitempty"`
+}
+
+// Event kinds written by --json-events
+const (
+	EventStarted        = "started"
+	EventProgress       = "progress"
+	EventUploadedObject = "uploaded-object"
+	EventThrottled      = "throttled"
+	EventFinished       = "finished"
+	EventFailed         = "failed"
+)
+
+// eventStream is the destination of events, events are not written until it is enabled
+var eventStream struct {
+	sync.Mutex
+	output  io.Writer
+	command string
+	closed  bool
+}
+
+// EnableJSONEvents writes events of the command to file descriptor as newline-delimited JSON and emits started event.
+// Messages of fatal log calls are turned into failed event, since the process exits right after them.
+func EnableJSONEvents(fd int, command string) {
+	output := os.NewFile(uintptr(fd), "json-events")
+	switch fd {
+	case 1:
+		output = os.Stdout
+	case 2:
+		output = os.Stderr
+	}
+	eventStream.Lock()
+	eventStream.output = output
+	eventStream.command = command
+	eventStream.Unlock()
+	onFatalLog(func(message string) {
+		EmitEvent(Event{Event: EventFailed, Error: message})
+	})
+	EmitEvent(Event{Event: EventStarted})
+}
+
+// EmitEvent writes event if JSON events are enabled, nothing is written after finished or failed event
+func EmitEvent(event Event) {
+	eventStream.Lock()
+	defer eventStream.Unlock()
+	if eventStream.output == nil || eventStream.closed {
+		return
+	}
+	event.Time = time.Now().UTC()
+	event.Command = eventStream.command
+	line, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	// Event consumer going away must not fail the command
+	eventStream.output.Write(append(line, '\n'))
+	eventStream.closed = event.Event == EventFinished || event.Event == EventFailed
+}
+
+// FinishJSONEvents emits finished event of successful command
+func FinishJSONEvents() {
+	EmitEvent(Event{Event: EventFinished})
+}
+
+// fatalHooks are run with the message of log.Fatal or log.Panic call before the process exits
+var fatalHooks struct {
+	sync.Mutex
+	hooks []func(message string)
+}
+
+// onFatalLog registers hook run for fatal message, it works for loggers writing to NewFatalLogWriter only
+func onFatalLog(hook func(message string)) {
+	fatalHooks.Lock()
+	defer fatalHooks.Unlock()
+	fatalHooks.hooks = append(fatalHooks.hooks, hook)
+}
+
+// fatalLogWriter passes log output through and runs fatal hooks for messages of log.Fatal and log.Panic calls
+type fatalLogWriter struct {
+	output io.Writer
+}
+
+// NewFatalLogWriter wraps output of a logger, so failed events and traces are written before fatal message exits
+func NewFatalLogWriter(output io.Writer) io.Writer {
+	return &fatalLogWriter{output: output}
+}
+
+func (writer *fatalLogWriter) Write(p []byte) (int, error) {
+	if isFatalLogCall() {
+		message := strings.TrimSpace(logTimestamp.ReplaceAllString(string(p), ""))
+		fatalHooks.Lock()
+		hooks := fatalHooks.hooks
+		fatalHooks.Unlock()
+		for _, hook := range hooks {
+			hook(message)
+		}
+	}
+	return writer.output.Write(p)
+}
+
+// logTimestamp is the date and time standard logger puts before messages
+var logTimestamp = regexp.MustCompile(`^\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2}(\.\d+)? `)
+
+// isFatalLogCall tells if log output is written by log.Fatal*, log.Panic* or their Logger methods
+func isFatalLogCall() bool {
+	pc := make([]uintptr, 8)
+	frames := runtime.CallersFrames(pc[:runtime.Callers(3, pc)])
+	for {
+		frame, more := frames.Next()
+		if strings.HasPrefix(frame.Function, "log.") {
+			name := strings.TrimPrefix(strings.TrimPrefix(frame.Function, "log."), "(*Logger).")
+			if strings.HasPrefix(name, "Fatal") || strings.HasPrefix(name, "Panic") {
+				return true
+			}
+		}
+		if !more {
+			return false
+		}
+	}
+}
+
+// countUploadedBytes counts bytes of uploaded object for uploaded-object event and upload span
+func countUploadedBytes(reader io.Reader) (io.Reader, func() int64) {
+	eventStream.Lock()
+	enabled := eventStream.output != nil || getTracer() != nil
+	eventStream.Unlock()
+	if !enabled || reader == nil {
+		return reader, func() int64 { return 0 }
+	}
+	counter := &countingReader{reader: reader}
+	return counter, counter.Count
+}
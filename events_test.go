@@ -0,0 +1,57 @@
+package walg
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestEmitEventWritesLines(t *testing.T) {
+	var buffer bytes.Buffer
+	eventStream.Lock()
+	eventStream.output = &buffer
+	eventStream.command = "wal-push"
+	eventStream.closed = false
+	eventStream.Unlock()
+	onFatalLog(func(message string) {
+		EmitEvent(Event{Event: EventFailed, Error: message})
+	})
+	defer func() {
+		eventStream.Lock()
+		eventStream.output = nil
+		eventStream.Unlock()
+		fatalHooks.Lock()
+		fatalHooks.hooks = nil
+		fatalHooks.Unlock()
+	}()
+
+	EmitEvent(Event{Event: EventUploadedObject, Object: "wal_005/000000010000000000000001.lz4", Bytes: 42})
+	logger := log.New(NewFatalLogWriter(&bytes.Buffer{}), "", 0)
+	logger.Print("not an error")
+	func() {
+		defer func() { recover() }()
+		logger.Panicf("upload failed")
+	}()
+	FinishJSONEvents()
+
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Wrong events %v", lines)
+	}
+	var uploaded, failed Event
+	if err := json.Unmarshal([]byte(lines[0]), &uploaded); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &failed); err != nil {
+		t.Fatal(err)
+	}
+	if uploaded.Event != EventUploadedObject || uploaded.Command != "wal-push" || uploaded.Bytes != 42 || uploaded.Time.IsZero() {
+		t.Errorf("Wrong uploaded-object event %v", uploaded)
+	}
+	// Nothing is written after failed event, finished one is dropped
+	if failed.Event != EventFailed || failed.Error != "upload failed" {
+		t.Errorf("Wrong failed event %v", failed)
+	}
+}
@@ -0,0 +1,160 @@
+package walg
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// BackupExportUsage is a text message explaining how to use backup-export
+var BackupExportUsage = "usage:\twal-g backup-export backup_name|LATEST output_directory" + `
+Writes base.tar.gz and pg_wal.tar with WAL needed for consistency, as pg_basebackup -Ft -z -Xstream does.
+Output can be restored without WAL-G: unpack base.tar.gz to data directory and pg_wal.tar to its pg_wal.
+`
+
+func printBackupExportUsageAndFail() {
+	log.Fatal(BackupExportUsage)
+}
+
+// HandleBackupExport is invoked to perform wal-g backup-export
+func HandleBackupExport(pre *Prefix, args []string) {
+	if len(args) != 3 {
+		printBackupExportUsageAndFail()
+	}
+	if err := ExportBackup(pre, args[1], args[2]); err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+}
+
+// ExportBackup fetches backup into temporary directory inside output and packs it in pg_basebackup format
+func ExportBackup(pre *Prefix, backupName string, output string) error {
+	bk := resolveBackup(backupName, pre)
+	sentinel := fetchSentinel(*bk.Name, bk, pre)
+	if sentinel.WalSegmentSize != 0 {
+		if err := SetWalSegmentSize(sentinel.WalSegmentSize); err != nil {
+			return err
+		}
+	}
+	segments, err := getBackupWalSegments(*bk.Name, sentinel)
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(output, ".backup-export")
+	if err = os.MkdirAll(tmp, 0700); err != nil {
+		return errors.Wrap(err, "ExportBackup: unable to create temporary directory")
+	}
+	defer os.RemoveAll(tmp)
+	dataDir := filepath.Join(tmp, "data")
+	walDir := filepath.Join(tmp, "wal")
+	if err = os.Mkdir(walDir, 0700); err != nil {
+		return errors.Wrap(err, "ExportBackup: unable to create temporary directory")
+	}
+
+	HandleBackupFetch(*bk.Name, pre, dataDir, false)
+	for _, segment := range segments {
+		location := filepath.Join(walDir, segment)
+		DownloadWALFile(pre, segment, location)
+		if _, err = os.Stat(location); err != nil {
+			return errors.Wrapf(err, "ExportBackup: WAL segment %s needed for consistency is missing", segment)
+		}
+	}
+
+	if err = writeTarArchive(filepath.Join(output, "base.tar.gz"), dataDir, true); err != nil {
+		return err
+	}
+	if err = writeTarArchive(filepath.Join(output, "pg_wal.tar"), walDir, false); err != nil {
+		return err
+	}
+	fmt.Printf("Backup %s is exported to %s\n", *bk.Name, output)
+	return nil
+}
+
+// getBackupWalSegments lists WAL segments from backup start to backup finish
+func getBackupWalSegments(backupName string, sentinel S3TarBallSentinelDto) ([]string, error) {
+	if sentinel.LSN == nil || sentinel.FinishLSN == nil {
+		return nil, errors.Errorf("getBackupWalSegments: backup %s does not record its start and finish LSN", backupName)
+	}
+	timeline, _, err := ParseWALFileName(stripWalFileName(backupName))
+	if err != nil {
+		return nil, errors.Wrapf(err, "getBackupWalSegments: unable to get timeline of backup %s", backupName)
+	}
+	segments := make([]string, 0)
+	for logSegNo := *sentinel.LSN / GetWalSegmentSize(); logSegNo <= (*sentinel.FinishLSN-1)/GetWalSegmentSize(); logSegNo++ {
+		segments = append(segments, formatWALFileName(timeline, logSegNo))
+	}
+	return segments, nil
+}
+
+// writeTarArchive packs directory contents with paths relative to it, as pg_basebackup does
+func writeTarArchive(archive string, directory string, compress bool) error {
+	file, err := os.Create(archive)
+	if err != nil {
+		return errors.Wrapf(err, "writeTarArchive: unable to create %s", archive)
+	}
+	defer file.Close()
+
+	var output io.WriteCloser = file
+	if compress {
+		output = gzip.NewWriter(file)
+	}
+	tarWriter := tar.NewWriter(output)
+	err = filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == directory {
+			return err
+		}
+		return writeTarEntry(tarWriter, directory, path, info)
+	})
+	if err != nil {
+		return errors.Wrapf(err, "writeTarArchive: unable to pack %s", archive)
+	}
+	if err = tarWriter.Close(); err != nil {
+		return errors.Wrapf(err, "writeTarArchive: unable to write %s", archive)
+	}
+	if compress {
+		if err = output.Close(); err != nil {
+			return errors.Wrapf(err, "writeTarArchive: unable to write %s", archive)
+		}
+	}
+	return errors.Wrapf(file.Close(), "writeTarArchive: unable to write %s", archive)
+}
+
+func writeTarEntry(tarWriter *tar.Writer, directory string, path string, info os.FileInfo) error {
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(path); err != nil {
+			return err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name, err = filepath.Rel(directory, path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	if err = tarWriter.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.CopyN(tarWriter, file, info.Size())
+	return err
+}
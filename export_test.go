@@ -0,0 +1,79 @@
+package walg
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestGetBackupWalSegments(t *testing.T) {
+	start, finish := uint64(0x2000028), uint64(0x4000000)
+	sentinel := S3TarBallSentinelDto{LSN: &start, FinishLSN: &finish}
+	segments, err := getBackupWalSegments("base_000000020000000000000002", sentinel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"000000020000000000000002", "000000020000000000000003"}
+	if !reflect.DeepEqual(segments, expected) {
+		t.Fatalf("Expected %v, got %v", expected, segments)
+	}
+
+	sentinel.FinishLSN = nil
+	if _, err = getBackupWalSegments("base_000000020000000000000002", sentinel); err == nil {
+		t.Fatal("Segments were computed without finish LSN")
+	}
+}
+
+func TestWriteTarArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := filepath.Join(dir, "data")
+	os.MkdirAll(filepath.Join(data, "base", "1"), 0700)
+	ioutil.WriteFile(filepath.Join(data, "PG_VERSION"), []byte("10\n"), 0600)
+	ioutil.WriteFile(filepath.Join(data, "base", "1", "1259"), []byte("relation"), 0600)
+	os.Symlink("/mnt/ts", filepath.Join(data, "ts_link"))
+
+	archive := filepath.Join(dir, "base.tar.gz")
+	if err = writeTarArchive(archive, data, true); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	names := make([]string, 0)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+		if hdr.Name == "ts_link" && hdr.Linkname != "/mnt/ts" {
+			t.Fatalf("Symlink is archived wrong: %+v", hdr)
+		}
+	}
+	sort.Strings(names)
+	expected := []string{"PG_VERSION", "base/", "base/1/", "base/1/1259", "ts_link"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("Expected %v, got %v", expected, names)
+	}
+}
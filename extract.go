@@ -4,8 +4,35 @@ import (
 	"archive/tar"
 	"github.com/pkg/errors"
 	"io"
+	"io/ioutil"
+	"path"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// fetchRateLimit is the limit of bytes per second read from storage and, separately, of bytes per second
+// of extracted data written to disk by backup-fetch, 0 is unlimited
+var fetchRateLimit int64
+
+// fetchLimiters are shared by partitions extracted at once
+type fetchLimiters struct {
+	network *byteRateLimiter
+	disk    *byteRateLimiter
+}
+
+func newFetchLimiters() *fetchLimiters {
+	if fetchRateLimit <= 0 {
+		return nil
+	}
+	now := time.Now()
+	return &fetchLimiters{
+		network: &byteRateLimiter{bytesPerSecond: float64(fetchRateLimit), start: now},
+		disk:    &byteRateLimiter{bytesPerSecond: float64(fetchRateLimit), start: now},
+	}
+}
+
 func min(a, b int) int {
 	if a < b {
 		return a
@@ -59,7 +86,7 @@ func extractOne(ti TarInterpreter, s io.Reader) error {
 
 // Ensures that file extension is valid. Any subsequent behavior
 // depends on file type.
-func tarHandler(wc io.WriteCloser, rm ReaderMaker, crypter Crypter) error {
+func tarHandler(wc io.WriteCloser, rm ReaderMaker, crypter Crypter, limiters *fetchLimiters) error {
 	defer wc.Close()
 	r, err := rm.Reader()
 
@@ -67,6 +94,9 @@ func tarHandler(wc io.WriteCloser, rm ReaderMaker, crypter Crypter) error {
 		return errors.Wrap(err, "ExtractAll: failed to create new reader")
 	}
 	defer r.Close()
+	if limiters != nil {
+		r = ReadCascadeClose{&throttledReader{r, limiters.network}, r}
+	}
 
 	if crypter.IsUsed() {
 		var reader io.Reader
@@ -74,7 +104,9 @@ func tarHandler(wc io.WriteCloser, rm ReaderMaker, crypter Crypter) error {
 		if err != nil {
 			return errors.Wrap(err, "ExtractAll: decrypt failed")
 		}
-		r = ReadCascadeClose{reader, r}
+		decrypted := readAhead(reader)
+		defer decrypted.Close()
+		r = ReadCascadeClose{decrypted, r}
 	}
 
 	if rm.Format() == "lzo" {
@@ -87,6 +119,11 @@ func tarHandler(wc io.WriteCloser, rm ReaderMaker, crypter Crypter) error {
 		if err != nil {
 			return errors.Wrap(err, "ExtractAll: lz4 decompress failed. Is archive encrypted?")
 		}
+	} else if rm.Format() == "gz" {
+		err = DecompressGzip(wc, r)
+		if err != nil {
+			return errors.Wrap(err, "ExtractAll: gzip decompress failed. Is archive encrypted?")
+		}
 	} else if rm.Format() == "tar" {
 		_, err = io.Copy(wc, r)
 		if err != nil {
@@ -96,86 +133,123 @@ func tarHandler(wc io.WriteCloser, rm ReaderMaker, crypter Crypter) error {
 	} else {
 		return errors.Wrap(UnsupportedFileTypeError{rm.Path(), rm.Format()}, "ExtractAll:")
 	}
+	// Decompressors may stop before the end of object, the rest is read so that the object is verified
+	if _, err = io.Copy(ioutil.Discard, r); err != nil {
+		return errors.Wrap(err, "ExtractAll: failed to read the end of object")
+	}
 	return nil
 }
 
-// ExtractAll Handles all files passed in. Supports `.lzo`, `.lz4, and `.tar`.
-// File type `.nop` is used for testing purposes. Each file is extracted
-// in its own goroutine and ExtractAll will wait for all goroutines to finish.
-// Returns the first error encountered.
-func ExtractAll(ti TarInterpreter, files []ReaderMaker) error {
-	if len(files) < 1 {
-		return errors.New("ExtractAll: did not provide files to extract")
-	}
+// decodeChunkSize is the size of chunks passed between download, decryption, decompression and extraction
+const decodeChunkSize = 1 << 20
 
-	var err error
-	sem := make(chan Empty, len(files))
-	collectAll := make(chan error)
-	defer close(collectAll)
+// decodeQueueDepth is the number of chunks each stage of partition decoding may run ahead of the next one
+const decodeQueueDepth = 4
+
+// readAhead reads source in its own goroutine, so download and decryption overlap with decompression.
+// Closing result stops the goroutine once it is done with the chunk being read.
+func readAhead(source io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
 	go func() {
-		for e := range collectAll {
-			if e != nil {
-				err = e
-			}
+		w := newAsyncWriteCloser(pw, decodeQueueDepth)
+		_, err := io.CopyBuffer(w, source, make([]byte, decodeChunkSize))
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
 		}
+		pw.CloseWithError(err)
 	}()
+	return pr
+}
 
-	// Set maximum number of goroutines spun off by ExtractAll
-	var con = getMaxDownloadConcurrency(min(len(files), 10))
+// getExtractConcurrency returns number of partitions decoded at once. Decryption and decompression are CPU bound,
+// so by default all cores are used, but no less than 10 partitions are fetched to keep network busy.
+func getExtractConcurrency(files int) int {
+	return max(1, min(files, getMaxDownloadConcurrency(max(runtime.NumCPU(), 10))))
+}
 
-	concurrent := make(chan Empty, con)
-	for i := 0; i < con; i++ {
-		concurrent <- Empty{}
+// ExtractAll Handles all files passed in. Supports `.lzo`, `.lz4`, `.gz` and `.tar`.
+// File type `.nop` is used for testing purposes. Files are extracted by a pool of
+// goroutines sized by getExtractConcurrency and ExtractAll will wait for all of them to finish.
+// Once a file differs from its recorded checksum, the backup is corrupt and files not started yet are skipped.
+// Returns the first error encountered.
+func ExtractAll(ti TarInterpreter, files []ReaderMaker) error {
+	if len(files) < 1 {
+		return errors.New("ExtractAll: did not provide files to extract")
 	}
 
-	var crypter OpenPGPCrypter
-
-	for i, val := range files {
-		<-concurrent
-		go func(i int, val ReaderMaker) {
-			defer func() {
-				concurrent <- Empty{}
-				sem <- Empty{}
-			}()
-
-			pr, tempW := io.Pipe()
-			pw := &EmptyWriteIgnorer{tempW}
-
-			// Collect errors returned by tarHandler or parsing.
-			collectLow := make(chan error)
-
-			go func() {
-				collectLow <- tarHandler(pw, val, &crypter)
-			}()
-
-			// Collect errors returned by extractOne.
-			collectTop := make(chan error)
-
-			go func() {
-				defer pr.Close()
-				err := extractOne(ti, pr)
-				collectTop <- err
-			}()
-
-			finishedTop := false
-			finishedLow := false
-
-			for !(finishedTop && finishedLow) {
-				select {
-				case err := <-collectTop:
-					finishedTop = true
-					collectAll <- err
-				case err := <-collectLow:
-					finishedLow = true
-					collectAll <- err
+	jobs := make(chan ReaderMaker, len(files))
+	for _, file := range files {
+		jobs <- file
+	}
+	close(jobs)
+
+	errs := make(chan error, len(files))
+	limiters := newFetchLimiters()
+	var extracted int64
+	var corrupt int32
+	var wg sync.WaitGroup
+	for i := 0; i < getExtractConcurrency(len(files)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Key rings are cached, so every worker can have its own crypter
+			var crypter OpenPGPCrypter
+			for file := range jobs {
+				if atomic.LoadInt32(&corrupt) != 0 {
+					continue
+				}
+				err := extractPartition(ti, file, &crypter, limiters)
+				if err == nil {
+					EmitEvent(Event{Event: EventProgress, Object: file.Path(), Done: atomic.AddInt64(&extracted, 1), Total: int64(len(files))})
+				} else if errors.Cause(err) == ErrChecksumMismatch {
+					atomic.StoreInt32(&corrupt, 1)
 				}
+				errs <- err
 			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
 
-		}(i, val)
+	var err error
+	for e := range errs {
+		if e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// extractPartition decodes partition and interprets it in separate goroutines. Decoded data is buffered
+// between them, so decompression does not wait for disk writes.
+func extractPartition(ti TarInterpreter, file ReaderMaker, crypter Crypter, limiters *fetchLimiters) (err error) {
+	defer startSpan(nil, "extract "+path.Base(file.Path()), map[string]interface{}{"s3.key": file.Path()}).endWith(&err)
+	pr, pw := io.Pipe()
+	// Extracted files are written as fast as decoded archive is read
+	var decoded io.Reader = pr
+	if limiters != nil {
+		decoded = &throttledReader{pr, limiters.disk}
 	}
 
-	for i := 0; i < len(files); i++ {
-		<-sem
+	// Collect errors returned by extractOne.
+	collectTop := make(chan error, 1)
+	go func() {
+		err := extractOne(ti, decoded)
+		if err == nil {
+			// Skip padding after the end of archive
+			_, err = io.Copy(ioutil.Discard, pr)
+		}
+		// Decoding fails with the same error, if it is not finished yet
+		pr.CloseWithError(err)
+		collectTop <- err
+	}()
+
+	err = tarHandler(newAsyncWriteCloser(pw, decodeQueueDepth), file, crypter, limiters)
+	if err != nil {
+		pw.CloseWithError(err)
+	}
+	if topErr := <-collectTop; err == nil {
+		err = topErr
 	}
 	return err
 }
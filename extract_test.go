@@ -1,13 +1,18 @@
 package walg_test
 
 import (
+	"archive/tar"
 	"bytes"
 	"fmt"
+	"github.com/pkg/errors"
 	"github.com/wal-g/wal-g"
 	"github.com/wal-g/wal-g/test_tools"
 	"io"
 	"io/ioutil"
+	"os"
+	"sync"
 	"testing"
+	"testing/iotest"
 )
 
 func TestNoFilesProvided(t *testing.T) {
@@ -70,6 +75,71 @@ func TestTar(t *testing.T) {
 	}
 }
 
+// countingTarInterpreter counts bytes of members extracted concurrently.
+type countingTarInterpreter struct {
+	mutex sync.Mutex
+	size  int
+}
+
+func (ti *countingTarInterpreter) Interpret(tr io.Reader, cur *tar.Header) error {
+	out, err := ioutil.ReadAll(tr)
+	ti.mutex.Lock()
+	defer ti.mutex.Unlock()
+	ti.size += len(out)
+	return err
+}
+
+// Tests that all partitions are extracted by the worker pool and a failed one is reported.
+func TestExtractAllPool(t *testing.T) {
+	os.Setenv("WALG_DOWNLOAD_CONCURRENCY", "3")
+	defer os.Unsetenv("WALG_DOWNLOAD_CONCURRENCY")
+
+	files := []walg.ReaderMaker{&BufferReaderMaker{&bytes.Buffer{}, "/broken", "gzip"}}
+	for i := 0; i < 20; i++ {
+		member := &bytes.Buffer{}
+		tools.CreateTar(member, &io.LimitedReader{R: tools.NewStrideByteReader(10), N: 1000})
+		files = append(files, &BufferReaderMaker{member, fmt.Sprintf("/usr/local/%d", i), "tar"})
+	}
+	ti := &countingTarInterpreter{}
+	err := walg.ExtractAll(ti, files)
+	if _, ok := errors.Cause(err).(walg.UnsupportedFileTypeError); !ok {
+		t.Errorf("extract: expected unsupported file type error, got %v", err)
+	}
+	if ti.size != 20*1000 {
+		t.Errorf("extract: expected 20000 bytes extracted, got %d", ti.size)
+	}
+}
+
+// corruptReaderMaker is a partition failing its checksum
+type corruptReaderMaker struct{}
+
+func (corruptReaderMaker) Reader() (io.ReadCloser, error) {
+	return ioutil.NopCloser(iotest.ErrReader(walg.ErrChecksumMismatch)), nil
+}
+func (corruptReaderMaker) Format() string { return "tar" }
+func (corruptReaderMaker) Path() string   { return "/corrupt" }
+
+// Tests that partitions are not extracted once a partition fails its checksum.
+func TestExtractAllStopsOnChecksumMismatch(t *testing.T) {
+	os.Setenv("WALG_DOWNLOAD_CONCURRENCY", "1")
+	defer os.Unsetenv("WALG_DOWNLOAD_CONCURRENCY")
+
+	files := []walg.ReaderMaker{corruptReaderMaker{}}
+	for i := 0; i < 5; i++ {
+		member := &bytes.Buffer{}
+		tools.CreateTar(member, &io.LimitedReader{R: tools.NewStrideByteReader(10), N: 1000})
+		files = append(files, &BufferReaderMaker{member, fmt.Sprintf("/usr/local/%d", i), "tar"})
+	}
+	ti := &countingTarInterpreter{}
+	err := walg.ExtractAll(ti, files)
+	if errors.Cause(err) != walg.ErrChecksumMismatch {
+		t.Errorf("extract: expected checksum mismatch, got %v", err)
+	}
+	if ti.size != 0 {
+		t.Errorf("extract: expected nothing extracted after checksum mismatch, got %d bytes", ti.size)
+	}
+}
+
 // Test extraction of various lzo compressed tar files.
 func testLzopRoundTrip(t *testing.T, stride, nBytes int) {
 	//Generate and save random bytes compare against compression-decompression cycle.
@@ -0,0 +1,42 @@
+package walg
+
+import (
+	"log"
+	"os"
+	"strconv"
+)
+
+// useReadFadvise reads WALG_READ_FADVISE setting. Files read by backup-push are advised to be read
+// sequentially and dropped from page cache after reading, so backup does not evict pages cached for queries.
+// Pages of the file cached before backup are dropped as well, PostgreSQL keeps hot pages in shared buffers.
+func useReadFadvise() bool {
+	fadviseStr, ok := lookupSetting("WALG_READ_FADVISE")
+	if !ok {
+		return false
+	}
+	fadvise, err := strconv.ParseBool(fadviseStr)
+	if err != nil {
+		log.Fatalf("Unable to parse WALG_READ_FADVISE %v\n", err)
+	}
+	return fadvise
+}
+
+// adviseSequentialRead hints that file is read once from start to end, so kernel reads ahead aggressively
+func adviseSequentialRead(file *os.File) {
+	if useReadFadvise() {
+		fadviseSequential(file)
+	}
+}
+
+// dropReadFileCache drops pages of file read by backup from page cache
+func dropReadFileCache(path string) {
+	if !useReadFadvise() {
+		return
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	fadviseDontNeed(file)
+}
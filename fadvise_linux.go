@@ -0,0 +1,29 @@
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package walg
+
+import (
+	"os"
+	"syscall"
+)
+
+// posix_fadvise advice values of Linux
+const (
+	fadvSequential = 2
+	fadvDontNeed   = 4
+)
+
+// fadvise calls posix_fadvise for the whole file, advice is only a hint, so errors are ignored
+func fadvise(file *os.File, advice int) {
+	syscall.Syscall6(syscall.SYS_FADVISE64, file.Fd(), 0, 0, uintptr(advice), 0, 0)
+}
+
+func fadviseSequential(file *os.File) {
+	fadvise(file, fadvSequential)
+}
+
+func fadviseDontNeed(file *os.File) {
+	fadvise(file, fadvDontNeed)
+}
@@ -0,0 +1,12 @@
+//go:build !linux || !(amd64 || arm64)
+// +build !linux !amd64,!arm64
+
+package walg
+
+import "os"
+
+// fadviseSequential does nothing where posix_fadvise arguments layout is not known
+func fadviseSequential(file *os.File) {}
+
+// fadviseDontNeed does nothing where posix_fadvise arguments layout is not known
+func fadviseDontNeed(file *os.File) {}
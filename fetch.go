@@ -0,0 +1,304 @@
+package walg
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// BackupFetchArguments incapsulates arguments for backup-fetch command
+type BackupFetchArguments struct {
+	dirArc     string
+	backupName string
+	targetTime *time.Time
+	targetLsn  *uint64
+	targetName string
+
+	configFilesTo string
+	noSync        bool
+	files         []string
+	sanitize      bool
+	rateLimit     int64
+	sizeOnly      bool
+	deltaRestore  bool
+}
+
+// ParseBackupFetchArguments interprets arguments for backup-fetch command. TODO: use flags or cobra
+func ParseBackupFetchArguments(args []string, fallBackFunc func()) (result BackupFetchArguments) {
+	if len(args) < 3 {
+		fallBackFunc()
+		return
+	}
+
+	result.dirArc = args[1]
+	params := args[2:]
+	if args[1] == "--size-only" {
+		// Size is estimated without output directory
+		result.dirArc, result.sizeOnly = "", true
+	}
+	for len(params) > 0 {
+		param := strings.TrimLeft(params[0], "-")
+		if param == params[0] {
+			if result.backupName != "" {
+				log.Println("Backup name specified twice")
+				fallBackFunc()
+				return
+			}
+			result.backupName = params[0]
+			params = params[1:]
+			continue
+		}
+		if param == "no-sync" {
+			result.noSync = true
+			params = params[1:]
+			continue
+		}
+		if param == "sanitize" {
+			result.sanitize = true
+			params = params[1:]
+			continue
+		}
+		if param == "delta-restore" {
+			result.deltaRestore = true
+			params = params[1:]
+			continue
+		}
+		if param == "size-only" {
+			result.sizeOnly = true
+			params = params[1:]
+			continue
+		}
+		if len(params) < 2 {
+			log.Printf("Value for %v not specified\n", params[0])
+			fallBackFunc()
+			return
+		}
+		value := params[1]
+		params = params[2:]
+
+		switch param {
+		case "target-time":
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				log.Println("Cannot parse target time ", err)
+				fallBackFunc()
+				return
+			}
+			result.targetTime = &t
+		case "target-lsn":
+			lsn, err := ParseLsn(value)
+			if err != nil {
+				log.Println("Cannot parse target LSN ", err)
+				fallBackFunc()
+				return
+			}
+			result.targetLsn = &lsn
+		case "target-name":
+			result.targetName = value
+		case "config-files-to":
+			result.configFilesTo = value
+		case "files":
+			result.files = strings.Split(value, ",")
+		case "fetch-rate-limit":
+			rateLimit, err := ParseByteSize(value)
+			if err != nil || rateLimit <= 0 {
+				log.Println("Cannot parse fetch rate limit ", value)
+				fallBackFunc()
+				return
+			}
+			result.rateLimit = rateLimit
+		default:
+			log.Printf("Unknown option %v\n", params[0])
+			fallBackFunc()
+			return
+		}
+	}
+
+	targets := 0
+	for _, isSet := range []bool{result.backupName != "", result.targetTime != nil, result.targetLsn != nil, result.targetName != ""} {
+		if isSet {
+			targets++
+		}
+	}
+	if targets != 1 {
+		log.Println("Exactly one of backup name, --target-time, --target-lsn or --target-name must be specified")
+		fallBackFunc()
+		return
+	}
+	if result.sanitize && result.files != nil {
+		log.Println("--sanitize needs whole cluster, it can not be used with --files")
+		fallBackFunc()
+	}
+	if result.deltaRestore && result.files != nil {
+		log.Println("--delta-restore applies whole backup, it can not be used with --files")
+		fallBackFunc()
+	}
+	if result.sizeOnly && (result.sanitize || result.files != nil) {
+		log.Println("--size-only estimates the whole backup, it can not be used with --files or --sanitize")
+		fallBackFunc()
+	}
+	return
+}
+
+// HandleBackupFetchCommand is invoked to perform wal-g backup-fetch with command line arguments
+func HandleBackupFetchCommand(pre *Prefix, args []string, mem bool) {
+	cfg := ParseBackupFetchArguments(args, printBackupFetchUsageAndFail)
+	if cfg.noSync {
+		fsyncPolicy = FsyncNone
+	}
+	fetchRateLimit = cfg.rateLimit
+	restoreDeltaOnto = cfg.deltaRestore
+	postFetchHook := GetBackupHook(PostFetchHook)
+	if postFetchHook.SQL != "" && !cfg.sanitize && !cfg.sizeOnly {
+		log.Fatal("WALG_POST_FETCH_SQL needs temporary server, use --sanitize")
+	}
+
+	if cfg.targetName != "" {
+		point, err := FindRestorePoint(pre, cfg.targetName)
+		if err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+		cfg.targetLsn = &point.LSN
+	}
+
+	backupName := cfg.backupName
+	if backupName == "" {
+		var err error
+		backupName, err = FindBackupByTarget(pre, cfg.targetTime, cfg.targetLsn)
+		if err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+		log.Printf("Backup %v is chosen for the target\n", backupName)
+	}
+
+	if cfg.sizeOnly {
+		printRestoreSizeEstimate(pre, backupName, cfg.dirArc)
+		return
+	}
+
+	if cfg.files != nil {
+		if err := FetchBackupFiles(pre, backupName, cfg.dirArc, cfg.files); err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+		return
+	}
+
+	HandleBackupFetch(backupName, pre, cfg.dirArc, mem)
+
+	// With --sanitize recovery settings are written for temporary server
+	if cfg.targetName != "" && !cfg.sanitize {
+		err := writeRecoveryConf(ResolveSymlink(cfg.dirArc), [][2]string{{"recovery_target_name", cfg.targetName}})
+		if err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+	}
+
+	if cfg.configFilesTo != "" {
+		err := FetchConfigFiles(pre, backupName, cfg.configFilesTo)
+		if err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+	}
+
+	// Restored cluster is sanitized after configuration files are in place, temporary server may need them
+	var err error
+	if cfg.sanitize {
+		err = SanitizeRestoredCluster(ResolveSymlink(cfg.dirArc), backupName, cfg)
+	} else if postFetchHook.IsConfigured() {
+		err = postFetchHook.Run(nil, "WALG_RESTORE_DIRECTORY="+ResolveSymlink(cfg.dirArc), "WALG_BACKUP_NAME="+backupName)
+	}
+	if err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+}
+
+// printRestoreSizeEstimate prints disk space restore of the backup needs as JSON, nothing is fetched
+func printRestoreSizeEstimate(pre *Prefix, backupName string, dirArc string) {
+	estimate, err := estimateRestoreSize(pre, backupName, dirArc)
+	if err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+	output, err := json.MarshalIndent(estimate, "", "  ")
+	if err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+	fmt.Println(string(output))
+}
+
+// ErrNoBackupBeforeTarget happens when all backups were finished after requested recovery target
+var ErrNoBackupBeforeTarget = errors.New("No backup finished before target")
+
+// FindBackupByTarget returns the newest backup which was finished before target time or target LSN
+func FindBackupByTarget(pre *Prefix, targetTime *time.Time, targetLsn *uint64) (string, error) {
+	var bk = &Backup{
+		Prefix: pre,
+		Path:   GetBackupPath(pre),
+	}
+	backups, err := bk.GetBackups()
+	if err != nil {
+		return "", err
+	}
+
+	if targetTime != nil {
+		name, found := chooseBackupByTime(backups, *targetTime)
+		if !found {
+			return "", errors.Wrapf(ErrNoBackupBeforeTarget, "FindBackupByTarget: %v", targetTime.Format(time.RFC3339))
+		}
+		return name, nil
+	}
+
+	// Backups are sorted from the newest, so the first suitable is the one we need
+	for _, b := range backups {
+		dto := fetchSentinel(b.Name, bk, pre)
+		if dto.FinishLSN == nil {
+			log.Printf("Backup %v does not have finish LSN, skipped\n", b.Name)
+			continue
+		}
+		if *dto.FinishLSN <= *targetLsn {
+			return b.Name, nil
+		}
+	}
+	return "", errors.Wrapf(ErrNoBackupBeforeTarget, "FindBackupByTarget: LSN %x", *targetLsn)
+}
+
+// chooseBackupByTime picks the newest backup with sentinel uploaded before target time
+func chooseBackupByTime(backups []BackupTime, target time.Time) (string, bool) {
+	for _, b := range backups {
+		if !b.Time.After(target) {
+			return b.Name, true
+		}
+	}
+	return "", false
+}
+
+// BackupFetchUsage is a text message explaining how to use backup-fetch
+var BackupFetchUsage = "usage:\twal-g backup-fetch output_directory backup_name" + `
+	wal-g backup-fetch output_directory LATEST
+	wal-g backup-fetch output_directory --target-time 2018-04-12T11:45:26Z   newest backup finished before the time
+	wal-g backup-fetch output_directory --target-lsn 2/E5000028             newest backup finished before the LSN
+	wal-g backup-fetch output_directory --target-name before_migration      newest backup finished before the restore
+	                                                                        point, recovery is configured to stop at it
+	wal-g backup-fetch --size-only backup_name                              print disk space restore needs, nothing is fetched
+Options:
+	--config-files-to directory   extract configuration files stored with WALG_BACKUP_CONFIG_FILES into directory,
+	                              files keep their absolute paths under it, / restores them in place
+	--no-sync                     do not fsync extracted files, for scratch restores, overrides WALG_FSYNC
+	--files path1,path2           extract only these files or directories, paths are relative to PGDATA,
+	                              output directory need not be empty
+	--fetch-rate-limit bytes      limit bytes per second read from storage and, separately, written to disk,
+	                              suffixes K, M, G and T are allowed, e.g. 100M; unlimited by default
+	--delta-restore               directory may hold a backup restored earlier with --delta-restore, only deltas
+	                              newer than it are fetched if it is in the delta chain and unchanged since
+	--size-only                   print extracted, download and download cache sizes of restore and free space of
+	                              output directory as JSON instead of fetching the backup
+	--sanitize                    recover restored cluster on temporary server to the target and promote it,
+	                              then run WALG_POST_FETCH_SQL and WALG_POST_FETCH_COMMAND against it
+`
+
+func printBackupFetchUsageAndFail() {
+	log.Fatal(BackupFetchUsage)
+}
@@ -0,0 +1,95 @@
+package walg
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// Fsync policies of fetched files, set by WALG_FSYNC
+const (
+	// FsyncNone does not sync anything, for scratch restores which are thrown away after a crash
+	FsyncNone = "none"
+	// FsyncFiles syncs every extracted backup file, this is the default
+	FsyncFiles = "files"
+	// FsyncAll also syncs directories of extracted backup and fetched WAL files, as pg_basebackup does
+	FsyncAll = "all"
+)
+
+// fsyncPolicy overrides WALG_FSYNC, it is set by backup-fetch --no-sync
+var fsyncPolicy string
+
+// getFsyncPolicy reads WALG_FSYNC
+func getFsyncPolicy() string {
+	if fsyncPolicy != "" {
+		return fsyncPolicy
+	}
+	policy, ok := lookupSetting("WALG_FSYNC")
+	if !ok {
+		return FsyncFiles
+	}
+	switch policy {
+	case FsyncNone, FsyncFiles, FsyncAll:
+		return policy
+	}
+	log.Fatalf("Unable to parse WALG_FSYNC %v, expected %v, %v or %v\n", policy, FsyncNone, FsyncFiles, FsyncAll)
+	return ""
+}
+
+// syncExtractedFile syncs file of extracted backup unless syncing is disabled
+func syncExtractedFile(file *os.File) error {
+	if getFsyncPolicy() == FsyncNone {
+		return nil
+	}
+	return file.Sync()
+}
+
+// syncPath opens file or directory and syncs it
+func syncPath(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return errors.Wrapf(err, "syncPath: unable to open %s", path)
+	}
+	defer file.Close()
+	return errors.Wrapf(file.Sync(), "syncPath: unable to sync %s", path)
+}
+
+// syncFetchedWalFile syncs fetched WAL file and its directory when all writes are synced
+func syncFetchedWalFile(location string) error {
+	if getFsyncPolicy() != FsyncAll {
+		return nil
+	}
+	if err := syncPath(location); err != nil {
+		return err
+	}
+	return syncPath(filepath.Dir(location))
+}
+
+// syncExtractedDirectories syncs directories of extracted backup and its tablespaces when all writes are synced,
+// so names of extracted files survive a crash too. Files are synced as they are extracted.
+func syncExtractedDirectories(dirArc string, tablespaces map[string]string) error {
+	if getFsyncPolicy() != FsyncAll {
+		return nil
+	}
+	roots := []string{dirArc}
+	for _, location := range tablespaces {
+		roots = append(roots, location)
+	}
+	for _, root := range roots {
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() {
+				return nil
+			}
+			return syncPath(path)
+		})
+		if err != nil {
+			return errors.Wrapf(err, "syncExtractedDirectories: unable to sync %s", root)
+		}
+	}
+	return nil
+}
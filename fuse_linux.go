@@ -0,0 +1,431 @@
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package walg
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// FUSE kernel protocol opcodes served by backup-mount, include/uapi/linux/fuse.h
+const (
+	fuseLookup      = 1
+	fuseForget      = 2
+	fuseGetattr     = 3
+	fuseReadlink    = 5
+	fuseOpen        = 14
+	fuseRead        = 15
+	fuseStatfs      = 17
+	fuseRelease     = 18
+	fuseFlush       = 25
+	fuseInit        = 26
+	fuseOpendir     = 27
+	fuseReaddir     = 28
+	fuseReleasedir  = 29
+	fuseInterrupt   = 36
+	fuseDestroy     = 38
+	fuseBatchForget = 42
+)
+
+const (
+	fuseKernelVersion      = 7
+	fuseKernelMinorVersion = 26
+	fuseMaxWrite           = 128 * 1024
+	fuseInHeaderLen        = 40
+	fuseOutHeaderLen       = 16
+	fuseAttrLen            = 88
+	fuseOpenDirectIO       = 1
+	// Attributes and names are cached by kernel for a second, sizes of files change when they are extracted
+	fuseAttrValid = 1
+)
+
+// fuseServer answers FUSE requests of kernel about mounted backup
+type fuseServer struct {
+	device *os.File
+	mount  *backupMount
+	uid    uint32
+	gid    uint32
+
+	mutex   sync.Mutex
+	handles map[uint64]*os.File
+	nextFh  uint64
+}
+
+// serveFuse mounts backup at mount point and serves it until it is unmounted, SIGINT and SIGTERM unmount it
+func serveFuse(mountPoint string, mount *backupMount) error {
+	device, err := mountFuse(mountPoint)
+	if err != nil {
+		return err
+	}
+	defer device.Close()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		for range signals {
+			if err := unmountFuse(mountPoint); err != nil {
+				log.Printf("Unable to unmount %s: %v\n", mountPoint, err)
+			}
+		}
+	}()
+
+	server := &fuseServer{
+		device:  device,
+		mount:   mount,
+		uid:     uint32(os.Getuid()),
+		gid:     uint32(os.Getgid()),
+		handles: make(map[uint64]*os.File),
+	}
+	buffer := make([]byte, fuseMaxWrite+4096)
+	for {
+		n, err := syscall.Read(int(device.Fd()), buffer)
+		if err == syscall.EINTR || err == syscall.EAGAIN || err == syscall.ENOENT {
+			continue
+		}
+		if err == syscall.ENODEV {
+			// File system is unmounted
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "serveFuse: unable to read request")
+		}
+		if n < fuseInHeaderLen {
+			return errors.Errorf("serveFuse: short request of %d bytes", n)
+		}
+		request := make([]byte, n)
+		copy(request, buffer[:n])
+		if binary.LittleEndian.Uint32(request[4:8]) == fuseDestroy {
+			server.reply(request, 0, nil)
+			return nil
+		}
+		go server.handle(request)
+	}
+}
+
+// mountFuse mounts FUSE file system with fusermount if it is installed, otherwise by mount system call
+func mountFuse(mountPoint string) (*os.File, error) {
+	options := "ro,nosuid,nodev,default_permissions"
+	for _, name := range []string{"fusermount3", "fusermount"} {
+		if fusermount, err := exec.LookPath(name); err == nil {
+			return mountWithFusermount(fusermount, mountPoint, options+",fsname=wal-g,subtype=wal-g")
+		}
+	}
+	device, err := os.OpenFile("/dev/fuse", os.O_RDWR, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "mountFuse: unable to open /dev/fuse")
+	}
+	data := fmt.Sprintf("fd=%d,rootmode=40000,user_id=%d,group_id=%d,default_permissions", device.Fd(), os.Getuid(), os.Getgid())
+	err = syscall.Mount("wal-g", mountPoint, "fuse.wal-g", syscall.MS_RDONLY|syscall.MS_NOSUID|syscall.MS_NODEV, data)
+	if err != nil {
+		device.Close()
+		return nil, errors.Wrapf(err, "mountFuse: unable to mount %s, fusermount is not found", mountPoint)
+	}
+	return device, nil
+}
+
+// mountWithFusermount runs setuid fusermount, which passes opened /dev/fuse back over a socket
+func mountWithFusermount(fusermount string, mountPoint string, options string) (*os.File, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "mountWithFusermount: socketpair failed")
+	}
+	local := os.NewFile(uintptr(fds[0]), "fusermount-local")
+	remote := os.NewFile(uintptr(fds[1]), "fusermount-remote")
+	defer local.Close()
+
+	cmd := exec.Command(fusermount, "-o", options, "--", mountPoint)
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{remote}
+	cmd.Env = append(os.Environ(), "_FUSECOMMFD=3")
+	err = cmd.Run()
+	remote.Close()
+	if err != nil {
+		return nil, errors.Wrapf(err, "mountWithFusermount: %s failed", fusermount)
+	}
+
+	oob := make([]byte, syscall.CmsgSpace(4))
+	_, oobn, _, _, err := syscall.Recvmsg(int(local.Fd()), make([]byte, 1), oob, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "mountWithFusermount: unable to receive /dev/fuse descriptor")
+	}
+	messages, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(messages) == 0 {
+		return nil, errors.Errorf("mountWithFusermount: %s did not pass /dev/fuse descriptor", fusermount)
+	}
+	received, err := syscall.ParseUnixRights(&messages[0])
+	if err != nil || len(received) == 0 {
+		return nil, errors.Errorf("mountWithFusermount: %s did not pass /dev/fuse descriptor", fusermount)
+	}
+	return os.NewFile(uintptr(received[0]), "/dev/fuse"), nil
+}
+
+func unmountFuse(mountPoint string) error {
+	for _, name := range []string{"fusermount3", "fusermount"} {
+		if fusermount, err := exec.LookPath(name); err == nil {
+			return exec.Command(fusermount, "-u", mountPoint).Run()
+		}
+	}
+	return syscall.Unmount(mountPoint, 0)
+}
+
+// reply writes answer to request, errno is sent negated as kernel expects
+func (server *fuseServer) reply(request []byte, errno syscall.Errno, payload []byte) {
+	answer := make([]byte, fuseOutHeaderLen+len(payload))
+	binary.LittleEndian.PutUint32(answer[0:4], uint32(len(answer)))
+	binary.LittleEndian.PutUint32(answer[4:8], uint32(-int32(errno)))
+	copy(answer[8:16], request[8:16])
+	copy(answer[fuseOutHeaderLen:], payload)
+	// Write fails if request is interrupted meanwhile, it is not an error
+	syscall.Write(int(server.device.Fd()), answer)
+}
+
+func (server *fuseServer) handle(request []byte) {
+	opcode := binary.LittleEndian.Uint32(request[4:8])
+	inode := binary.LittleEndian.Uint64(request[16:24])
+	body := request[fuseInHeaderLen:]
+
+	switch opcode {
+	case fuseForget, fuseBatchForget, fuseInterrupt:
+		// Inodes live as long as the mount, these requests are not answered
+		return
+	case fuseInit:
+		server.reply(request, 0, encodeFuseInit(body))
+		return
+	case fuseStatfs:
+		// kstatfs: blocks, bfree, bavail, files, ffree, bsize, namelen, frsize, padding, spare
+		statfs := make([]byte, 80)
+		binary.LittleEndian.PutUint32(statfs[40:44], 4096)
+		binary.LittleEndian.PutUint32(statfs[44:48], 255)
+		binary.LittleEndian.PutUint32(statfs[48:52], 4096)
+		server.reply(request, 0, statfs)
+		return
+	case fuseRead:
+		server.read(request, body)
+		return
+	case fuseRelease:
+		server.release(body)
+		server.reply(request, 0, nil)
+		return
+	case fuseFlush, fuseReleasedir:
+		server.reply(request, 0, nil)
+		return
+	}
+
+	node := server.mount.node(inode)
+	if node == nil {
+		server.reply(request, syscall.ENOENT, nil)
+		return
+	}
+	switch opcode {
+	case fuseLookup:
+		name := string(body)
+		if i := bytes.IndexByte(body, 0); i >= 0 {
+			name = string(body[:i])
+		}
+		child := server.mount.lookup(inode, name)
+		if child == nil {
+			server.reply(request, syscall.ENOENT, nil)
+			return
+		}
+		// entry_out: nodeid, generation, entry_valid, attr_valid, entry_valid_nsec, attr_valid_nsec, attr
+		entry := make([]byte, 40+fuseAttrLen)
+		binary.LittleEndian.PutUint64(entry[0:8], child.inode)
+		binary.LittleEndian.PutUint64(entry[8:16], 1)
+		binary.LittleEndian.PutUint64(entry[16:24], fuseAttrValid)
+		binary.LittleEndian.PutUint64(entry[24:32], fuseAttrValid)
+		server.encodeAttr(child, entry[40:])
+		server.reply(request, 0, entry)
+	case fuseGetattr:
+		// attr_out: attr_valid, attr_valid_nsec, dummy, attr
+		attr := make([]byte, 16+fuseAttrLen)
+		binary.LittleEndian.PutUint64(attr[0:8], fuseAttrValid)
+		server.encodeAttr(node, attr[16:])
+		server.reply(request, 0, attr)
+	case fuseReadlink:
+		if node.typeflag != tar.TypeSymlink {
+			server.reply(request, syscall.EINVAL, nil)
+			return
+		}
+		server.reply(request, 0, []byte(node.linkname))
+	case fuseOpen:
+		server.open(request, node, body)
+	case fuseOpendir:
+		if !node.isDir() {
+			server.reply(request, syscall.ENOTDIR, nil)
+			return
+		}
+		server.reply(request, 0, make([]byte, 16))
+	case fuseReaddir:
+		server.readdir(request, node, body)
+	default:
+		server.reply(request, syscall.ENOSYS, nil)
+	}
+}
+
+// encodeFuseInit negotiates protocol version, kernel falls back to older minor version if it is newer
+func encodeFuseInit(body []byte) []byte {
+	minor := binary.LittleEndian.Uint32(body[4:8])
+	if minor > fuseKernelMinorVersion {
+		minor = fuseKernelMinorVersion
+	}
+	// init_out: major, minor, max_readahead, flags, max_background, congestion_threshold, max_write,
+	// time_gran and reserved fields since 7.23
+	size := 64
+	if minor < 23 {
+		size = 24
+	}
+	init := make([]byte, size)
+	binary.LittleEndian.PutUint32(init[0:4], fuseKernelVersion)
+	binary.LittleEndian.PutUint32(init[4:8], minor)
+	copy(init[8:12], body[8:12])
+	binary.LittleEndian.PutUint16(init[16:18], 16)
+	binary.LittleEndian.PutUint16(init[18:20], 12)
+	binary.LittleEndian.PutUint32(init[20:24], fuseMaxWrite)
+	if size > 24 {
+		binary.LittleEndian.PutUint32(init[24:28], 1)
+	}
+	return init
+}
+
+// encodeAttr writes fuse_attr of node: ino, size, blocks, atime, mtime, ctime, their nanoseconds,
+// mode, nlink, uid, gid, rdev, blksize, padding
+func (server *fuseServer) encodeAttr(node *mountNode, attr []byte) {
+	size := server.mount.size(node)
+	mode := uint32(node.mode&0777) | syscall.S_IFREG
+	nlink := uint32(1)
+	switch node.typeflag {
+	case tar.TypeDir:
+		mode = uint32(node.mode&0777) | syscall.S_IFDIR
+		nlink = 2
+	case tar.TypeSymlink:
+		mode = 0777 | syscall.S_IFLNK
+		size = int64(len(node.linkname))
+	}
+	binary.LittleEndian.PutUint64(attr[0:8], node.inode)
+	binary.LittleEndian.PutUint64(attr[8:16], uint64(size))
+	binary.LittleEndian.PutUint64(attr[16:24], uint64((size+511)/512))
+	for offset := 24; offset < 48; offset += 8 {
+		binary.LittleEndian.PutUint64(attr[offset:offset+8], uint64(node.mtime.Unix()))
+	}
+	binary.LittleEndian.PutUint32(attr[60:64], mode)
+	binary.LittleEndian.PutUint32(attr[64:68], nlink)
+	binary.LittleEndian.PutUint32(attr[68:72], server.uid)
+	binary.LittleEndian.PutUint32(attr[72:76], server.gid)
+	binary.LittleEndian.PutUint32(attr[80:84], 4096)
+}
+
+// open extracts the file, reads bypass page cache because size is unknown until the file is extracted
+func (server *fuseServer) open(request []byte, node *mountNode, body []byte) {
+	if node.isDir() {
+		server.reply(request, syscall.EISDIR, nil)
+		return
+	}
+	if binary.LittleEndian.Uint32(body[0:4])&syscall.O_ACCMODE != syscall.O_RDONLY {
+		server.reply(request, syscall.EROFS, nil)
+		return
+	}
+	file, err := server.mount.open(node)
+	if err != nil {
+		log.Printf("Unable to extract %s: %+v\n", node.name, err)
+		server.reply(request, syscall.EIO, nil)
+		return
+	}
+	server.mutex.Lock()
+	server.nextFh++
+	fh := server.nextFh
+	server.handles[fh] = file
+	server.mutex.Unlock()
+
+	// open_out: fh, open_flags, padding
+	open := make([]byte, 16)
+	binary.LittleEndian.PutUint64(open[0:8], fh)
+	binary.LittleEndian.PutUint32(open[8:12], fuseOpenDirectIO)
+	server.reply(request, 0, open)
+}
+
+// read answers read_in: fh, offset, size, read_flags, lock_owner, flags, padding
+func (server *fuseServer) read(request []byte, body []byte) {
+	fh := binary.LittleEndian.Uint64(body[0:8])
+	offset := int64(binary.LittleEndian.Uint64(body[8:16]))
+	size := binary.LittleEndian.Uint32(body[16:20])
+	server.mutex.Lock()
+	file := server.handles[fh]
+	server.mutex.Unlock()
+	if file == nil {
+		server.reply(request, syscall.EBADF, nil)
+		return
+	}
+	data := make([]byte, size)
+	n, err := file.ReadAt(data, offset)
+	if err != nil && err != io.EOF {
+		server.reply(request, syscall.EIO, nil)
+		return
+	}
+	server.reply(request, 0, data[:n])
+}
+
+func (server *fuseServer) release(body []byte) {
+	fh := binary.LittleEndian.Uint64(body[0:8])
+	server.mutex.Lock()
+	file := server.handles[fh]
+	delete(server.handles, fh)
+	server.mutex.Unlock()
+	if file != nil {
+		file.Close()
+	}
+}
+
+// readdir answers with fuse_dirent records: ino, offset of the next record, namelen, type, name padded to 8 bytes.
+// Offset is the index of entry in the list of ".", ".." and sorted children.
+func (server *fuseServer) readdir(request []byte, node *mountNode, body []byte) {
+	offset := binary.LittleEndian.Uint64(body[8:16])
+	size := int(binary.LittleEndian.Uint32(body[16:20]))
+	entries := append([]*mountNode{node, node}, server.mount.children(node)...)
+	output := make([]byte, 0, size)
+	for i := offset; i < uint64(len(entries)); i++ {
+		name := "."
+		if i == 1 {
+			name = ".."
+		} else if i > 1 {
+			name = path.Base(entries[i].name)
+		}
+		dirent := encodeDirent(entries[i], name, i+1)
+		if len(output)+len(dirent) > size {
+			break
+		}
+		output = append(output, dirent...)
+	}
+	server.reply(request, 0, output)
+}
+
+func encodeDirent(node *mountNode, name string, next uint64) []byte {
+	direntType := uint32(syscall.DT_REG)
+	switch node.typeflag {
+	case tar.TypeDir:
+		direntType = syscall.DT_DIR
+	case tar.TypeSymlink:
+		direntType = syscall.DT_LNK
+	}
+	dirent := make([]byte, (24+len(name)+7)&^7)
+	binary.LittleEndian.PutUint64(dirent[0:8], node.inode)
+	binary.LittleEndian.PutUint64(dirent[8:16], next)
+	binary.LittleEndian.PutUint32(dirent[16:20], uint32(len(name)))
+	binary.LittleEndian.PutUint32(dirent[20:24], direntType)
+	copy(dirent[24:], name)
+	return dirent
+}
@@ -0,0 +1,11 @@
+//go:build !linux || !(amd64 || arm64)
+// +build !linux !amd64,!arm64
+
+package walg
+
+import "github.com/pkg/errors"
+
+// serveFuse is implemented with FUSE kernel protocol of Linux only
+func serveFuse(mountPoint string, mount *backupMount) error {
+	return errors.New("serveFuse: backup-mount is supported on Linux only")
+}
@@ -0,0 +1,180 @@
+package walg
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// HealthUsage is a text message explaining how to use health
+var HealthUsage = "usage:\twal-g health [--max-backup-age duration]" + `
+	--max-backup-age: alert if the latest backup is older, e.g. 26h; defaults to WALG_HEALTH_MAX_BACKUP_AGE or 26h
+Prints JSON report, exit status is 2 if backups are stale, WAL archive has gaps or storage is unreachable.
+`
+
+// healthCriticalExitCode follows Nagios plugin convention for CRITICAL state
+const healthCriticalExitCode = 2
+
+// maxReportedWalGaps limits size of the report when archiving was broken for long
+const maxReportedWalGaps = 100
+
+// HealthArguments holds thresholds of wal-g health
+type HealthArguments struct {
+	maxBackupAge time.Duration
+}
+
+// HealthReport is printed by wal-g health as JSON
+type HealthReport struct {
+	Healthy           bool             `json:"healthy"`
+	StorageReachable  bool             `json:"storage_reachable"`
+	LatestBackup      string           `json:"latest_backup,omitempty"`
+	LatestBackupTime  *time.Time       `json:"latest_backup_time,omitempty"`
+	BackupAgeSeconds  int64            `json:"backup_age_seconds,omitempty"`
+	MaxBackupAge      string           `json:"max_backup_age"`
+	WalGapsCount      int              `json:"wal_gaps_count"`
+	WalGaps           []string         `json:"wal_gaps,omitempty"`
+	LatestArchivedWal string           `json:"latest_archived_wal,omitempty"`
+	BackupsInProgress []BackupProgress `json:"backups_in_progress,omitempty"`
+	Problems          []string         `json:"problems"`
+}
+
+func (report *HealthReport) addProblem(format string, args ...interface{}) {
+	report.Healthy = false
+	report.Problems = append(report.Problems, fmt.Sprintf(format, args...))
+}
+
+func printHealthUsageAndFail() {
+	log.Fatal(HealthUsage)
+}
+
+// getHealthMaxBackupAge reads WALG_HEALTH_MAX_BACKUP_AGE, 26 hours by default to tolerate daily backups
+func getHealthMaxBackupAge() time.Duration {
+	ageStr, ok := lookupSetting("WALG_HEALTH_MAX_BACKUP_AGE")
+	if !ok {
+		return 26 * time.Hour
+	}
+	age, err := time.ParseDuration(ageStr)
+	if err != nil {
+		log.Println("WARNING! Unable to parse WALG_HEALTH_MAX_BACKUP_AGE ", err)
+		return 26 * time.Hour
+	}
+	return age
+}
+
+// ParseHealthArguments interprets arguments for health command. In case of any error it calls fallBackFunc
+func ParseHealthArguments(args []string, fallBackFunc func()) (result HealthArguments) {
+	result.maxBackupAge = getHealthMaxBackupAge()
+	params := args[1:]
+	for i := 0; i < len(params); i++ {
+		if strings.TrimLeft(params[i], "-") != "max-backup-age" || i+1 >= len(params) {
+			fallBackFunc()
+			return
+		}
+		age, err := time.ParseDuration(params[i+1])
+		if err != nil || age <= 0 {
+			log.Printf("Cannot parse duration %v\n", params[i+1])
+			fallBackFunc()
+			return
+		}
+		result.maxBackupAge = age
+		i++
+	}
+	return
+}
+
+// HandleHealth is invoked to perform wal-g health. Like check, it configures storage itself
+// to report unreachable storage instead of failing.
+func HandleHealth(args []string) {
+	arguments := ParseHealthArguments(args, printHealthUsageAndFail)
+
+	report := &HealthReport{Healthy: true, MaxBackupAge: arguments.maxBackupAge.String(), Problems: make([]string, 0)}
+	_, pre, err := Configure()
+	if err != nil {
+		report.addProblem("storage is not configured: %v", err)
+	} else {
+		checkHealth(report, pre, arguments, time.Now())
+	}
+
+	output, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+	fmt.Println(string(output))
+	if !report.Healthy {
+		EmitEvent(Event{Event: EventFailed, Error: "unhealthy"})
+		os.Exit(healthCriticalExitCode)
+	}
+}
+
+func checkHealth(report *HealthReport, pre *Prefix, arguments HealthArguments, now time.Time) {
+	var bk = &Backup{
+		Prefix: pre,
+		Path:   GetBackupPath(pre),
+	}
+	backups, err := bk.GetBackups()
+	if err == ErrLatestNotFound {
+		report.StorageReachable = true
+		report.addProblem("no backups found")
+		return
+	}
+	if err != nil {
+		report.addProblem("storage is unreachable: %v", err)
+		return
+	}
+	report.StorageReachable = true
+	// Running and abandoned backups are reported for monitoring, they are not problems by themselves
+	report.BackupsInProgress, err = ListBackupsInProgress(pre, now)
+	if err != nil {
+		report.addProblem("storage is unreachable: %v", err)
+		return
+	}
+
+	latest := backups[0]
+	report.LatestBackup = latest.Name
+	report.LatestBackupTime = &latest.Time
+	age := now.Sub(latest.Time)
+	report.BackupAgeSeconds = int64(age.Seconds())
+	if age > arguments.maxBackupAge {
+		report.addProblem("latest backup %v is %v old, threshold is %v", latest.Name, age.Round(time.Second), arguments.maxBackupAge)
+	}
+
+	timeline, logSegNo, err := ParseWALFileName(latest.WalFileName)
+	if err != nil {
+		report.addProblem("unable to parse WAL file name of backup %v: %v", latest.Name, err)
+		return
+	}
+	segments, err := ListWalSegments(pre)
+	if err != nil {
+		report.StorageReachable = false
+		report.addProblem("storage is unreachable: %v", err)
+		return
+	}
+	checkWalContinuity(report, segments, WalSegmentNo{timeline, logSegNo})
+}
+
+// checkWalContinuity reports segments missing since start of the latest backup
+func checkWalContinuity(report *HealthReport, segments []WalSegmentNo, start WalSegmentNo) {
+	var latestArchived *WalSegmentNo
+	for i := range segments {
+		if latestArchived == nil || segments[i].LogSegNo > latestArchived.LogSegNo ||
+			segments[i].LogSegNo == latestArchived.LogSegNo && segments[i].Timeline > latestArchived.Timeline {
+			latestArchived = &segments[i]
+		}
+	}
+	if latestArchived != nil {
+		report.LatestArchivedWal = latestArchived.Name()
+	}
+
+	gaps := FindWalGaps(segments, start)
+	report.WalGapsCount = len(gaps)
+	for i := 0; i < len(gaps) && i < maxReportedWalGaps; i++ {
+		report.WalGaps = append(report.WalGaps, gaps[i].Name())
+	}
+	if len(gaps) > 0 {
+		report.addProblem("%d WAL segments are missing since start of the latest backup %v, first is %v",
+			len(gaps), start.Name(), gaps[0].Name())
+	}
+}
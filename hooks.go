@@ -0,0 +1,68 @@
+package walg
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/jackc/pgx"
+	"github.com/pkg/errors"
+)
+
+const (
+	// PreBackupHook runs before pg_start_backup()
+	PreBackupHook = "PRE_BACKUP"
+	// PostBackupHook runs after pg_stop_backup(), but before sentinel upload
+	PostBackupHook = "POST_BACKUP"
+	// PostFetchHook runs after backup-fetch, SQL runs only on temporary server started with --sanitize
+	PostFetchHook = "POST_FETCH"
+)
+
+// BackupHook is a command and SQL statement configured by WALG_<STAGE>_COMMAND and WALG_<STAGE>_SQL
+type BackupHook struct {
+	Stage   string
+	Command string
+	SQL     string
+}
+
+// GetBackupHook reads hook configuration for a stage from environment
+func GetBackupHook(stage string) BackupHook {
+	return BackupHook{
+		Stage:   stage,
+		Command: getSetting("WALG_" + stage + "_COMMAND"),
+		SQL:     getSetting("WALG_" + stage + "_SQL"),
+	}
+}
+
+// IsConfigured checks whether hook has something to run
+func (hook BackupHook) IsConfigured() bool {
+	return hook.Command != "" || hook.SQL != ""
+}
+
+// Run executes hook SQL statement on backup connection and then hook command.
+// Any failure is returned, backup must be aborted in this case.
+// Environment of the command is extended with given variables of the form KEY=value.
+func (hook BackupHook) Run(conn *pgx.Conn, env ...string) error {
+	if hook.SQL != "" {
+		fmt.Printf("Running %v SQL\n", strings.ToLower(hook.Stage))
+		if _, err := conn.Exec(hook.SQL); err != nil {
+			return errors.Wrapf(err, "BackupHook: WALG_%v_SQL failed", hook.Stage)
+		}
+	}
+	if hook.Command != "" {
+		fmt.Printf("Running %v command\n", strings.ToLower(hook.Stage))
+		if err := runHookCommand(hook.Command, env); err != nil {
+			return errors.Wrapf(err, "BackupHook: WALG_%v_COMMAND failed", hook.Stage)
+		}
+	}
+	return nil
+}
+
+func runHookCommand(command string, env []string) error {
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Env = append(settingsEnviron(), env...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
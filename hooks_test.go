@@ -0,0 +1,33 @@
+package walg_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/wal-g/wal-g"
+)
+
+func TestBackupHookConfiguration(t *testing.T) {
+	os.Setenv("WALG_PRE_BACKUP_COMMAND", "true")
+	defer os.Unsetenv("WALG_PRE_BACKUP_COMMAND")
+
+	hook := walg.GetBackupHook(walg.PreBackupHook)
+	if !hook.IsConfigured() || hook.Command != "true" || hook.SQL != "" {
+		t.Fatalf("hooks: unexpected pre backup hook %+v", hook)
+	}
+	if walg.GetBackupHook(walg.PostBackupHook).IsConfigured() {
+		t.Fatal("hooks: post backup hook is not expected to be configured")
+	}
+}
+
+func TestBackupHookCommand(t *testing.T) {
+	hook := walg.BackupHook{Stage: walg.PostBackupHook, Command: `test "$WALG_BACKUP_NAME" = base_000000010000000000000002`}
+	if err := hook.Run(nil, "WALG_BACKUP_NAME=base_000000010000000000000002"); err != nil {
+		t.Errorf("hooks: command failed: %v", err)
+	}
+
+	hook.Command = "exit 3"
+	if err := hook.Run(nil); err == nil {
+		t.Error("hooks: failed command did not return an error")
+	}
+}
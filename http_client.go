@@ -0,0 +1,108 @@
+package walg
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// getStorageProxy returns proxy selection function for storage requests. WALG_PROXY overrides
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY and accepts http, https (CONNECT is used for https endpoints) and socks5 URLs.
+func getStorageProxy() (func(*http.Request) (*url.URL, error), error) {
+	proxy := getSetting("WALG_PROXY")
+	if proxy == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+	proxyURL, err := url.Parse(proxy)
+	if err != nil {
+		return nil, errors.Wrapf(err, "getStorageProxy: failed to parse WALG_PROXY '%s'", proxy)
+	}
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, errors.Errorf("getStorageProxy: unsupported WALG_PROXY scheme '%s', http, https or socks5 expected", proxyURL.Scheme)
+	}
+	if proxyURL.Host == "" {
+		return nil, errors.Errorf("getStorageProxy: WALG_PROXY '%s' has no host", proxy)
+	}
+	return http.ProxyURL(proxyURL), nil
+}
+
+// storageHTTPSettings tunes connections to the storage
+type storageHTTPSettings struct {
+	MaxIdleConnsPerHost   int
+	IdleConnTimeout       time.Duration
+	ResponseHeaderTimeout time.Duration
+	TCPKeepAlive          time.Duration
+}
+
+// getStorageHTTPSettings reads WALG_S3_MAX_IDLE_CONNS_PER_HOST, WALG_S3_IDLE_CONN_TIMEOUT,
+// WALG_S3_RESPONSE_HEADER_TIMEOUT and WALG_S3_TCP_KEEPALIVE. Zero timeouts mean no timeout.
+func getStorageHTTPSettings() (*storageHTTPSettings, error) {
+	settings := &storageHTTPSettings{MaxIdleConnsPerHost: 10}
+	if connsStr, ok := lookupSetting("WALG_S3_MAX_IDLE_CONNS_PER_HOST"); ok {
+		conns, err := strconv.Atoi(connsStr)
+		if err != nil || conns < 0 {
+			return nil, errors.Errorf("getStorageHTTPSettings: invalid WALG_S3_MAX_IDLE_CONNS_PER_HOST '%s'", connsStr)
+		}
+		settings.MaxIdleConnsPerHost = conns
+	}
+	var err error
+	if settings.IdleConnTimeout, err = getStorageDuration("WALG_S3_IDLE_CONN_TIMEOUT", 90*time.Second); err != nil {
+		return nil, err
+	}
+	if settings.ResponseHeaderTimeout, err = getStorageDuration("WALG_S3_RESPONSE_HEADER_TIMEOUT", 0); err != nil {
+		return nil, err
+	}
+	if settings.TCPKeepAlive, err = getStorageDuration("WALG_S3_TCP_KEEPALIVE", 30*time.Second); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+func getStorageDuration(name string, defaultValue time.Duration) (time.Duration, error) {
+	durationStr, ok := lookupSetting(name)
+	if !ok {
+		return defaultValue, nil
+	}
+	duration, err := time.ParseDuration(durationStr)
+	if err != nil || duration < 0 {
+		return 0, errors.Errorf("getStorageDuration: invalid %s '%s'", name, durationStr)
+	}
+	return duration, nil
+}
+
+// newStorageHTTPClient creates http client for storage requests
+func newStorageHTTPClient() (*http.Client, error) {
+	proxy, err := getStorageProxy()
+	if err != nil {
+		return nil, err
+	}
+	settings, err := getStorageHTTPSettings()
+	if err != nil {
+		return nil, err
+	}
+	keepAlive := settings.TCPKeepAlive
+	if keepAlive == 0 {
+		// Negative value disables keepalives in net.Dialer
+		keepAlive = -1
+	}
+	transport := &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: keepAlive,
+		}).DialContext,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   settings.MaxIdleConnsPerHost,
+		IdleConnTimeout:       settings.IdleConnTimeout,
+		ResponseHeaderTimeout: settings.ResponseHeaderTimeout,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	return &http.Client{Transport: transport}, nil
+}
@@ -0,0 +1,180 @@
+package walg
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/jackc/pgx"
+	"github.com/pkg/errors"
+)
+
+// InitUsage is a text message explaining how to use init
+var InitUsage = "usage:\twal-g init [--versioning]" + `
+Creates the bucket if it does not exist, writes cluster identity marker to the prefix and verifies that
+objects can be written, read, listed and deleted. With --versioning enables bucket versioning.
+AWS_REGION must be set when the bucket does not exist yet.
+`
+
+// ErrClusterIdentityMismatch happens when prefix already holds backups of another cluster
+var ErrClusterIdentityMismatch = errors.New("prefix belongs to another cluster")
+
+// ClusterIdentityDto is the marker of the cluster backed up to the prefix
+type ClusterIdentityDto struct {
+	SystemIdentifier string `json:"SystemIdentifier,omitempty"`
+	Hostname         string
+	CreatedTime      time.Time
+	WalgVersion      string
+}
+
+func printInitUsageAndFail() {
+	log.Fatal(InitUsage)
+}
+
+// getClusterIdentityKey gets path of cluster identity marker
+func getClusterIdentityKey(pre *Prefix) string {
+	return sanitizePath(*pre.Server + "/wal-g-identity.json")
+}
+
+// HandleInit is invoked to perform wal-g init
+func HandleInit(tu *TarUploader, pre *Prefix, args []string) {
+	versioning := false
+	for _, arg := range args[1:] {
+		if arg != "--versioning" {
+			printInitUsageAndFail()
+		}
+		versioning = true
+	}
+	if err := InitStorage(tu, pre, versioning); err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+}
+
+// InitStorage prepares bucket and prefix for the first backup
+func InitStorage(tu *TarUploader, pre *Prefix, versioning bool) error {
+	created, err := createBucketIfMissing(pre, tu.region)
+	if err != nil {
+		return err
+	}
+	if created {
+		fmt.Printf("Created bucket %s in %s\n", *pre.Bucket, tu.region)
+	}
+
+	if versioning {
+		_, err = pre.Svc.PutBucketVersioning(&s3.PutBucketVersioningInput{
+			Bucket:                  pre.Bucket,
+			VersioningConfiguration: &s3.VersioningConfiguration{Status: aws.String(s3.BucketVersioningStatusEnabled)},
+		})
+		if err != nil {
+			return errors.Wrap(err, "InitStorage: failed to enable versioning, check s3:PutBucketVersioning permission")
+		}
+		fmt.Println("Enabled bucket versioning")
+	}
+
+	if err = writeClusterIdentity(tu, pre); err != nil {
+		return err
+	}
+
+	failed := false
+	for _, finding := range []CheckFinding{checkStorageRoundTrip(tu, pre), checkBackupListing(pre)} {
+		fmt.Println(finding)
+		failed = failed || finding.Failed
+	}
+	if failed {
+		return errors.New("InitStorage: storage permissions are insufficient")
+	}
+	return nil
+}
+
+// createBucketIfMissing creates bucket in the region and waits until it is available
+func createBucketIfMissing(pre *Prefix, region string) (bool, error) {
+	_, err := pre.Svc.HeadBucket(&s3.HeadBucketInput{Bucket: pre.Bucket})
+	if err == nil {
+		return false, nil
+	}
+	if awsErr, ok := err.(awserr.RequestFailure); !ok || awsErr.StatusCode() != 404 {
+		return false, errors.Wrapf(err, "createBucketIfMissing: failed to check bucket %s", *pre.Bucket)
+	}
+
+	input := &s3.CreateBucketInput{Bucket: pre.Bucket}
+	// us-east-1 is the default location and can not be set explicitly
+	if region != "" && region != "us-east-1" {
+		input.CreateBucketConfiguration = &s3.CreateBucketConfiguration{LocationConstraint: aws.String(region)}
+	}
+	if _, err = pre.Svc.CreateBucket(input); err != nil {
+		return false, errors.Wrapf(err, "createBucketIfMissing: failed to create bucket %s, check s3:CreateBucket permission", *pre.Bucket)
+	}
+	err = pre.Svc.WaitUntilBucketExists(&s3.HeadBucketInput{Bucket: pre.Bucket})
+	return true, errors.Wrapf(err, "createBucketIfMissing: bucket %s is not available after creation", *pre.Bucket)
+}
+
+// writeClusterIdentity writes identity marker of the cluster or verifies the existing one.
+// Postgres is optional, without connection the marker does not record system identifier.
+func writeClusterIdentity(tu *TarUploader, pre *Prefix) error {
+	hostname, _ := os.Hostname()
+	identity := ClusterIdentityDto{
+		SystemIdentifier: getSystemIdentifier(),
+		Hostname:         hostname,
+		CreatedTime:      time.Now().UTC(),
+		WalgVersion:      WalgVersion,
+	}
+
+	key := getClusterIdentityKey(pre)
+	exists, err := (&Archive{Prefix: pre, Archive: aws.String(key)}).CheckExistence()
+	if err != nil {
+		return err
+	}
+	if exists {
+		existing := ClusterIdentityDto{}
+		if err = fetchJSONSentinel(pre, key, &existing); err != nil {
+			return err
+		}
+		if err = checkClusterIdentity(&existing, &identity); err != nil {
+			return err
+		}
+		if existing.SystemIdentifier != "" || identity.SystemIdentifier == "" {
+			fmt.Printf("Prefix already belongs to this cluster since %s\n", existing.CreatedTime.Format(time.RFC3339))
+			return nil
+		}
+		identity.CreatedTime = existing.CreatedTime
+	}
+
+	if err = uploadJSONSentinel(tu, key, &identity); err != nil {
+		return errors.Wrap(err, "writeClusterIdentity: failed to upload cluster identity")
+	}
+	fmt.Printf("Wrote cluster identity to %s\n", key)
+	return nil
+}
+
+// checkClusterIdentity fails when both markers know system identifiers and they differ
+func checkClusterIdentity(existing *ClusterIdentityDto, current *ClusterIdentityDto) error {
+	if existing.SystemIdentifier == "" || current.SystemIdentifier == "" || existing.SystemIdentifier == current.SystemIdentifier {
+		return nil
+	}
+	return errors.Wrapf(ErrClusterIdentityMismatch, "checkClusterIdentity: prefix holds cluster %s written from %s, this is cluster %s",
+		existing.SystemIdentifier, existing.Hostname, current.SystemIdentifier)
+}
+
+// getSystemIdentifier gets system identifier of the cluster or empty string if postgres is not available
+func getSystemIdentifier() string {
+	config, err := GetPgConnConfig()
+	if err != nil {
+		return ""
+	}
+	conn, err := pgx.Connect(config)
+	if err != nil {
+		log.Printf("WARNING! Cluster identity is written without system identifier, postgres is not available: %v\n", err)
+		return ""
+	}
+	defer conn.Close()
+	var systemIdentifier string
+	if err = conn.QueryRow("SELECT system_identifier::text FROM pg_control_system()").Scan(&systemIdentifier); err != nil {
+		log.Printf("WARNING! Cluster identity is written without system identifier: %v\n", err)
+		return ""
+	}
+	return systemIdentifier
+}
@@ -0,0 +1,27 @@
+package walg
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestCheckClusterIdentity(t *testing.T) {
+	cases := []struct {
+		existing string
+		current  string
+		mismatch bool
+	}{
+		{"", "", false},
+		{"6554000000000000001", "", false},
+		{"", "6554000000000000001", false},
+		{"6554000000000000001", "6554000000000000001", false},
+		{"6554000000000000001", "6554000000000000002", true},
+	}
+	for _, c := range cases {
+		err := checkClusterIdentity(&ClusterIdentityDto{SystemIdentifier: c.existing}, &ClusterIdentityDto{SystemIdentifier: c.current})
+		if (errors.Cause(err) == ErrClusterIdentityMismatch) != c.mismatch {
+			t.Errorf("%s %s: unexpected result %v", c.existing, c.current, err)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package walg
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+// inventoryPageSize is the number of inventory objects passed to listing callback at once, as in S3 listing
+const inventoryPageSize = 1000
+
+// inventoryManifestName is the name of the manifest S3 Inventory writes for every inventory it makes
+const inventoryManifestName = "manifest.json"
+
+// inventoryDateFolder is the folder of one inventory under inventory configuration folder
+var inventoryDateFolder = regexp.MustCompile(`/\d{4}-\d{2}-\d{2}T\d{2}-\d{2}Z/$`)
+
+// walSegmentKeyRegexp matches keys of segments, their partial files and backup history files
+var walSegmentKeyRegexp = regexp.MustCompile(`/[0-9A-F]{24}[^/]*$`)
+
+// ErrInventoryFormat happens when inventory is not in the format WAL-G reads
+var ErrInventoryFormat = errors.New("unsupported inventory")
+
+// inventoryManifest is manifest.json of S3 Inventory
+type inventoryManifest struct {
+	SourceBucket string `json:"sourceBucket"`
+	FileFormat   string `json:"fileFormat"`
+	FileSchema   string `json:"fileSchema"`
+	Files        []struct {
+		Key string `json:"key"`
+	} `json:"files"`
+}
+
+// getInventoryLocation returns WALG_S3_INVENTORY, s3://bucket/path of S3 Inventory configuration folder,
+// where the newest inventory is taken, or of manifest.json of particular inventory
+func getInventoryLocation() string {
+	return getSetting("WALG_S3_INVENTORY")
+}
+
+// listWalObjects lists WAL folder for retention and WAL verification. With WALG_S3_INVENTORY objects are
+// taken from the inventory and only objects uploaded after it are listed live, so archives with millions of
+// WAL files are listed in seconds. New segments have names greater than any segment in the inventory, live
+// listing starts after the greatest one. Bundles of wal-compact sort after all segments and are always listed
+// live, other objects after that segment, like history files, are listed once. Inventory is made daily or
+// weekly: objects deleted since then are still listed, that is harmless for deletion and hides them from WAL
+// verification.
+func listWalObjects(pre *Prefix, prefix string, fn func(*s3.ListObjectsV2Output, bool) bool) error {
+	location := getInventoryLocation()
+	input := &s3.ListObjectsV2Input{Bucket: pre.Bucket, Prefix: aws.String(prefix)}
+	if location == "" {
+		return listObjectsV2Pages(pre.Svc, input, fn)
+	}
+
+	page := &s3.ListObjectsV2Output{}
+	lastSegment := ""
+	listed := make(map[string]bool)
+	stopped := false
+	err := readInventory(pre, location, prefix, func(ob *s3.Object) bool {
+		if walSegmentKeyRegexp.MatchString(*ob.Key) {
+			if *ob.Key > lastSegment {
+				lastSegment = *ob.Key
+			}
+		} else if walBundleRegexp.MatchString(path.Base(*ob.Key)) {
+			return true
+		} else {
+			listed[*ob.Key] = true
+		}
+		page.Contents = append(page.Contents, ob)
+		if len(page.Contents) < inventoryPageSize {
+			return true
+		}
+		stopped = !fn(page, false)
+		page = &s3.ListObjectsV2Output{}
+		return !stopped
+	})
+	if err != nil || stopped {
+		return err
+	}
+	if len(page.Contents) > 0 && !fn(page, false) {
+		return nil
+	}
+	if lastSegment != "" {
+		input.StartAfter = aws.String(lastSegment)
+	}
+	return listObjectsV2Pages(pre.Svc, input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		contents := make([]*s3.Object, 0, len(page.Contents))
+		for _, ob := range page.Contents {
+			if !listed[*ob.Key] {
+				contents = append(contents, ob)
+			}
+		}
+		page.Contents = contents
+		return fn(page, lastPage)
+	})
+}
+
+// readInventory passes objects of the prefix recorded in the inventory to handler until it returns false
+func readInventory(pre *Prefix, location string, prefix string, handler func(ob *s3.Object) bool) error {
+	bucket, manifestKey, err := findInventoryManifest(pre, location)
+	if err != nil {
+		return err
+	}
+	manifest, err := fetchInventoryManifest(pre, bucket, manifestKey)
+	if err != nil {
+		return err
+	}
+	if manifest.SourceBucket != *pre.Bucket {
+		return errors.Wrapf(ErrInventoryFormat, "readInventory: %s is inventory of bucket %s", manifestKey, manifest.SourceBucket)
+	}
+	if !strings.EqualFold(manifest.FileFormat, "CSV") {
+		return errors.Wrapf(ErrInventoryFormat, "readInventory: %s is in %s format, Parquet and ORC inventories are not "+
+			"supported, configure S3 Inventory with CSV output format", manifestKey, manifest.FileFormat)
+	}
+	columns := make(map[string]int)
+	for i, column := range strings.Split(manifest.FileSchema, ",") {
+		columns[strings.TrimSpace(column)] = i
+	}
+	if _, ok := columns["Key"]; !ok {
+		return errors.Wrapf(ErrInventoryFormat, "readInventory: no Key in schema of %s", manifestKey)
+	}
+
+	infof("Listing %s from inventory %s\n", prefix, manifestKey)
+	for _, file := range manifest.Files {
+		more, err := readInventoryFile(pre, bucket, file.Key, columns, prefix, handler)
+		if err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseInventoryLocation splits WALG_S3_INVENTORY into bucket and path
+func parseInventoryLocation(location string) (string, string, error) {
+	u, err := url.Parse(location)
+	if err != nil || u.Scheme != "s3" || u.Host == "" {
+		return "", "", errors.Errorf("parseInventoryLocation: invalid WALG_S3_INVENTORY '%s', s3://bucket/path expected", location)
+	}
+	return u.Host, strings.TrimPrefix(u.Path, "/"), nil
+}
+
+// findInventoryManifest resolves inventory location to bucket and key of manifest.json
+func findInventoryManifest(pre *Prefix, location string) (string, string, error) {
+	bucket, key, err := parseInventoryLocation(location)
+	if err != nil {
+		return "", "", err
+	}
+	if strings.HasSuffix(key, inventoryManifestName) {
+		return bucket, key, nil
+	}
+	if key != "" && !strings.HasSuffix(key, "/") {
+		key += "/"
+	}
+
+	newest := ""
+	err = listObjectsV2Pages(pre.Svc, &s3.ListObjectsV2Input{
+		Bucket:    aws.String(bucket),
+		Prefix:    aws.String(key),
+		Delimiter: aws.String("/"),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, folder := range page.CommonPrefixes {
+			// Date folders sort by time, hive folder is skipped
+			if name := aws.StringValue(folder.Prefix); inventoryDateFolder.MatchString("/"+name) && name > newest {
+				newest = name
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return "", "", errors.Wrap(err, "findInventoryManifest: s3.ListObjectsV2 failed")
+	}
+	if newest == "" {
+		return "", "", errors.Wrapf(ErrInventoryFormat, "findInventoryManifest: no inventory in %s", location)
+	}
+	return bucket, newest + inventoryManifestName, nil
+}
+
+func fetchInventoryManifest(pre *Prefix, bucket string, key string) (manifest inventoryManifest, err error) {
+	reader, err := downloadObject(pre.Svc, aws.String(bucket), key)
+	if err != nil {
+		return manifest, errors.Wrapf(err, "fetchInventoryManifest: unable to download %s", key)
+	}
+	defer reader.Close()
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return manifest, errors.Wrapf(err, "fetchInventoryManifest: unable to download %s", key)
+	}
+	err = json.Unmarshal(content, &manifest)
+	return manifest, errors.Wrapf(err, "fetchInventoryManifest: unable to parse %s", key)
+}
+
+// readInventoryFile reads gzipped CSV data file of inventory, false is returned when handler stopped reading
+func readInventoryFile(pre *Prefix, bucket string, key string, columns map[string]int, prefix string, handler func(ob *s3.Object) bool) (bool, error) {
+	reader, err := downloadObject(pre.Svc, aws.String(bucket), key)
+	if err != nil {
+		return false, errors.Wrapf(err, "readInventoryFile: unable to download %s", key)
+	}
+	defer reader.Close()
+	decompressed, err := gzip.NewReader(reader)
+	if err != nil {
+		return false, errors.Wrapf(err, "readInventoryFile: unable to decompress %s", key)
+	}
+	records := csv.NewReader(decompressed)
+	records.FieldsPerRecord = -1
+	for {
+		record, err := records.Read()
+		if err == io.EOF {
+			return true, nil
+		}
+		if err != nil {
+			return false, errors.Wrapf(err, "readInventoryFile: unable to parse %s", key)
+		}
+		ob, err := parseInventoryRecord(record, columns)
+		if err != nil {
+			return false, errors.Wrapf(err, "readInventoryFile: invalid record in %s", key)
+		}
+		if ob != nil && strings.HasPrefix(*ob.Key, prefix) && !handler(ob) {
+			return false, nil
+		}
+	}
+}
+
+// parseInventoryRecord converts inventory record to object, keys in inventory are URL-encoded.
+// Inventory of versioned bucket lists old versions and delete markers, nil is returned for them.
+func parseInventoryRecord(record []string, columns map[string]int) (*s3.Object, error) {
+	field := func(name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return record[i]
+		}
+		return ""
+	}
+	if field("IsLatest") == "false" || field("IsDeleteMarker") == "true" {
+		return nil, nil
+	}
+	key, err := url.QueryUnescape(field("Key"))
+	if err != nil || key == "" {
+		return nil, errors.Errorf("parseInventoryRecord: invalid key '%s'", field("Key"))
+	}
+	ob := &s3.Object{Key: aws.String(key)}
+	if size, err := strconv.ParseInt(field("Size"), 10, 64); err == nil {
+		ob.Size = aws.Int64(size)
+	}
+	if modified, err := time.Parse(time.RFC3339, field("LastModifiedDate")); err == nil {
+		ob.LastModified = aws.Time(modified)
+	}
+	return ob, nil
+}
@@ -0,0 +1,104 @@
+package walg
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+// inventoryS3 serves inventory files and lists live objects
+type inventoryS3 struct {
+	truncatedListS3
+	files map[string][]byte
+}
+
+func (m *inventoryS3) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewReader(m.files[*input.Key]))}, nil
+}
+
+func gzipped(t *testing.T, content string) []byte {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	if _, err := writer.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func TestListWalObjectsFromInventory(t *testing.T) {
+	svc := &inventoryS3{
+		truncatedListS3: truncatedListS3{pageSize: 1000, keys: []string{
+			"server/wal_005/000000010000000000000002.lz4",
+			"server/wal_005/000000010000000000000003.lz4",
+			"server/wal_005/000000010000000000000004.lz4",
+			"server/wal_005/00000002.history.lz4",
+			"server/wal_005/bundle_000000010000000000000001_000000010000000000000001.tar.lz4",
+		}},
+		files: map[string][]byte{
+			"inventory/bucket/wal/2018-06-01T00-00Z/manifest.json": []byte(`{"sourceBucket": "bucket", "fileFormat": "CSV",
+				"fileSchema": "Bucket, Key, Size, LastModifiedDate", "files": [{"key": "inventory/bucket/wal/data/1.csv.gz"}]}`),
+			"inventory/bucket/wal/data/1.csv.gz": gzipped(t, `"bucket","server/wal_005/000000010000000000000001.lz4","100","2018-05-30T10:00:00.000Z"
+"bucket","server/wal_005/000000010000000000000002.lz4","100","2018-05-31T10:00:00.000Z"
+"bucket","server/wal_005/00000002.history.lz4","10","2018-05-31T10:00:00.000Z"
+"bucket","server/wal_005/bundle_000000010000000000000001_000000010000000000000001.tar.lz4","100","2018-05-31T10:00:00.000Z"
+"bucket","server/basebackups_005/base_000000010000000000000002_backup_stop_sentinel.json","10","2018-05-31T10:00:00.000Z"
+`),
+		},
+	}
+	pre := &Prefix{Svc: svc, Bucket: aws.String("bucket"), Server: aws.String("server")}
+	SetSettings(map[string]string{"WALG_S3_INVENTORY": "s3://inventory-bucket/inventory/bucket/wal/2018-06-01T00-00Z/manifest.json"})
+	defer SetSettings(nil)
+
+	keys := make([]string, 0)
+	err := listWalObjects(pre, GetWalFolderPath(pre), func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, ob := range page.Contents {
+			keys = append(keys, *ob.Key)
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Segments uploaded after the inventory are listed live, though they sort before bundles and history files
+	expected := []string{
+		"server/wal_005/000000010000000000000001.lz4",
+		"server/wal_005/000000010000000000000002.lz4",
+		"server/wal_005/00000002.history.lz4",
+		"server/wal_005/000000010000000000000003.lz4",
+		"server/wal_005/000000010000000000000004.lz4",
+		"server/wal_005/bundle_000000010000000000000001_000000010000000000000001.tar.lz4",
+	}
+	if len(keys) != len(expected) {
+		t.Fatalf("listWalObjects: unexpected %v", keys)
+	}
+	for i := range keys {
+		if keys[i] != expected[i] {
+			t.Errorf("listWalObjects: unexpected %v", keys)
+		}
+	}
+}
+
+func TestListWalObjectsRefusesParquetInventory(t *testing.T) {
+	svc := &inventoryS3{files: map[string][]byte{
+		"inventory/manifest.json": []byte(`{"sourceBucket": "bucket", "fileFormat": "Parquet", "fileSchema": "message s3.inventory {}"}`),
+	}}
+	pre := &Prefix{Svc: svc, Bucket: aws.String("bucket"), Server: aws.String("server")}
+	SetSettings(map[string]string{"WALG_S3_INVENTORY": "s3://inventory-bucket/inventory/manifest.json"})
+	defer SetSettings(nil)
+
+	err := listWalObjects(pre, GetWalFolderPath(pre), func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		t.Fatal("objects of Parquet inventory are listed")
+		return false
+	})
+	if errors.Cause(err) != ErrInventoryFormat {
+		t.Fatalf("Parquet inventory is not refused: %v", err)
+	}
+}
@@ -0,0 +1,42 @@
+package walg
+
+import (
+	"log"
+	"strings"
+)
+
+const (
+	// DefaultBackupFolder is the folder of base backups, WAL-E compatible
+	DefaultBackupFolder = "basebackups_005"
+	// DefaultWalFolder is the folder of WAL segments, WAL-E compatible
+	DefaultWalFolder = "wal_005"
+)
+
+// getStorageFolder reads folder name relative to the server prefix. Folder may contain several path
+// elements, e.g. pg/base, but can not escape the prefix.
+func getStorageFolder(variable string, defaultFolder string) string {
+	folder, ok := lookupSetting(variable)
+	if !ok {
+		return defaultFolder
+	}
+	folder = strings.Trim(folder, "/")
+	if folder == "" {
+		log.Fatalf("%s can not be empty\n", variable)
+	}
+	for _, element := range strings.Split(folder, "/") {
+		if element == "" || element == "." || element == ".." {
+			log.Fatalf("Invalid %s '%s'\n", variable, folder)
+		}
+	}
+	return folder
+}
+
+// backupFolderPath gets path of base backups under the server prefix, WALG_BACKUP_FOLDER overrides folder name
+func backupFolderPath(server string) string {
+	return sanitizePath(server + "/" + getStorageFolder("WALG_BACKUP_FOLDER", DefaultBackupFolder) + "/")
+}
+
+// walFolderPath gets path of WAL under the server prefix, WALG_WAL_FOLDER overrides folder name
+func walFolderPath(server string) string {
+	return sanitizePath(server + "/" + getStorageFolder("WALG_WAL_FOLDER", DefaultWalFolder) + "/")
+}
@@ -0,0 +1,26 @@
+package walg
+
+import (
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestStorageLayout(t *testing.T) {
+	pre := &Prefix{Server: aws.String("server")}
+	if *GetBackupPath(pre) != "server/basebackups_005/" || GetWalFolderPath(pre) != "server/wal_005/" {
+		t.Fatalf("Unexpected default layout %v %v", *GetBackupPath(pre), GetWalFolderPath(pre))
+	}
+
+	os.Setenv("WALG_BACKUP_FOLDER", "/pg/base/")
+	os.Setenv("WALG_WAL_FOLDER", "pg/wal")
+	defer os.Unsetenv("WALG_BACKUP_FOLDER")
+	defer os.Unsetenv("WALG_WAL_FOLDER")
+	if *GetBackupPath(pre) != "server/pg/base/" || GetWalFolderPath(pre) != "server/pg/wal/" {
+		t.Fatalf("Unexpected layout %v %v", *GetBackupPath(pre), GetWalFolderPath(pre))
+	}
+	if walFolderPath("") != "pg/wal/" {
+		t.Fatalf("Unexpected layout without server prefix %v", walFolderPath(""))
+	}
+}
@@ -0,0 +1,183 @@
+package walg
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+// LifecycleUsage is a text message explaining how to use lifecycle
+var LifecycleUsage = "usage:\twal-g lifecycle [--confirm]" + `
+Generates bucket lifecycle rules from WAL-G settings: backups are transitioned to WALG_LIFECYCLE_STORAGE_CLASS after
+WALG_LIFECYCLE_TRANSITION_DAYS, trash is expired after WALG_LIFECYCLE_TRASH_DAYS and incomplete uploads are aborted
+after a week. WAL is never expired by rules, the oldest retained backup needs WAL of any age; use delete for it.
+Without --confirm prints rules. Rules of other prefixes and rules not made by WAL-G are kept.
+`
+
+// lifecycleRulePrefix marks rules installed by WAL-G
+const lifecycleRulePrefix = "wal-g "
+
+func printLifecycleUsageAndFail() {
+	log.Fatal(LifecycleUsage)
+}
+
+// lifecycleSettings are age based rules, zero disables the rule
+type lifecycleSettings struct {
+	TransitionDays        int
+	TransitionClass       string
+	TrashExpirationDays   int
+	AbortIncompleteUpload int
+}
+
+// getLifecycleSettings reads lifecycle settings. There is no WAL expiration: retention keeps the newest backup
+// taken before the window or the oldest of WALG_RETENTION_FULL_COUNT fulls, which may be of any age, and
+// age of WAL objects can not tell whether such backup needs them.
+func getLifecycleSettings() (*lifecycleSettings, error) {
+	settings := &lifecycleSettings{TransitionClass: s3.TransitionStorageClassStandardIa, AbortIncompleteUpload: 7}
+	var err error
+	if settings.TransitionDays, err = getLifecycleDays("WALG_LIFECYCLE_TRANSITION_DAYS"); err != nil {
+		return nil, err
+	}
+	if settings.TrashExpirationDays, err = getLifecycleDays("WALG_LIFECYCLE_TRASH_DAYS"); err != nil {
+		return nil, err
+	}
+	if class, ok := lookupSetting("WALG_LIFECYCLE_STORAGE_CLASS"); ok {
+		settings.TransitionClass = class
+	}
+	return settings, nil
+}
+
+func getLifecycleDays(name string) (int, error) {
+	daysStr, ok := lookupSetting(name)
+	if !ok {
+		return 0, nil
+	}
+	days, err := strconv.Atoi(daysStr)
+	if err != nil || days < 0 {
+		return 0, errors.Errorf("getLifecycleDays: invalid %s '%s'", name, daysStr)
+	}
+	return days, nil
+}
+
+// HandleLifecycle is invoked to perform wal-g lifecycle
+func HandleLifecycle(pre *Prefix, args []string) {
+	confirm := false
+	for _, arg := range args[1:] {
+		if arg != "--confirm" {
+			printLifecycleUsageAndFail()
+		}
+		confirm = true
+	}
+	settings, err := getLifecycleSettings()
+	if err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+	if err = ApplyLifecycle(pre, settings, !confirm); err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+}
+
+// ApplyLifecycle replaces rules installed by WAL-G for the prefix with generated ones
+func ApplyLifecycle(pre *Prefix, settings *lifecycleSettings, dryRun bool) error {
+	generated := buildLifecycleRules(pre, settings)
+	for _, rule := range generated {
+		fmt.Println(describeLifecycleRule(rule))
+	}
+	if dryRun {
+		fmt.Println("Dry run finished, add --confirm to apply rules")
+		return nil
+	}
+
+	existing, err := pre.Svc.GetBucketLifecycleConfiguration(&s3.GetBucketLifecycleConfigurationInput{Bucket: pre.Bucket})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); !ok || awsErr.Code() != "NoSuchLifecycleConfiguration" {
+			return errors.Wrap(err, "ApplyLifecycle: failed to get lifecycle configuration, check s3:GetLifecycleConfiguration permission")
+		}
+		existing = &s3.GetBucketLifecycleConfigurationOutput{}
+	}
+
+	rules := mergeLifecycleRules(existing.Rules, generated, lifecycleRuleIDPrefix(pre))
+	if len(rules) == 0 {
+		_, err = pre.Svc.DeleteBucketLifecycle(&s3.DeleteBucketLifecycleInput{Bucket: pre.Bucket})
+	} else {
+		_, err = pre.Svc.PutBucketLifecycleConfiguration(&s3.PutBucketLifecycleConfigurationInput{
+			Bucket:                 pre.Bucket,
+			LifecycleConfiguration: &s3.BucketLifecycleConfiguration{Rules: rules},
+		})
+	}
+	if err != nil {
+		return errors.Wrap(err, "ApplyLifecycle: failed to update lifecycle configuration, check s3:PutLifecycleConfiguration permission")
+	}
+	fmt.Printf("Lifecycle configuration of %s is updated, %d rules in total\n", *pre.Bucket, len(rules))
+	return nil
+}
+
+// lifecycleRuleIDPrefix identifies rules of the prefix, so clusters sharing a bucket do not replace rules of each other
+func lifecycleRuleIDPrefix(pre *Prefix) string {
+	return lifecycleRulePrefix + sanitizePath(*pre.Server+"/") + " "
+}
+
+func buildLifecycleRules(pre *Prefix, settings *lifecycleSettings) []*s3.LifecycleRule {
+	idPrefix := lifecycleRuleIDPrefix(pre)
+	newRule := func(name string, prefix string) *s3.LifecycleRule {
+		return &s3.LifecycleRule{
+			ID:     aws.String(idPrefix + name),
+			Filter: &s3.LifecycleRuleFilter{Prefix: aws.String(prefix)},
+			Status: aws.String(s3.ExpirationStatusEnabled),
+		}
+	}
+
+	rules := make([]*s3.LifecycleRule, 0)
+	if settings.TransitionDays > 0 {
+		rule := newRule("transition backups", *GetBackupPath(pre))
+		rule.Transitions = []*s3.Transition{{
+			Days:         aws.Int64(int64(settings.TransitionDays)),
+			StorageClass: aws.String(settings.TransitionClass),
+		}}
+		rules = append(rules, rule)
+	}
+	if settings.TrashExpirationDays > 0 {
+		rule := newRule("expire trash", getTrashPath(pre))
+		rule.Expiration = &s3.LifecycleExpiration{Days: aws.Int64(int64(settings.TrashExpirationDays))}
+		rules = append(rules, rule)
+	}
+	if settings.AbortIncompleteUpload > 0 {
+		rule := newRule("abort incomplete uploads", sanitizePath(*pre.Server+"/"))
+		rule.AbortIncompleteMultipartUpload = &s3.AbortIncompleteMultipartUpload{
+			DaysAfterInitiation: aws.Int64(int64(settings.AbortIncompleteUpload)),
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// mergeLifecycleRules replaces rules with the ID prefix by generated ones
+func mergeLifecycleRules(existing []*s3.LifecycleRule, generated []*s3.LifecycleRule, idPrefix string) []*s3.LifecycleRule {
+	rules := make([]*s3.LifecycleRule, 0, len(existing)+len(generated))
+	for _, rule := range existing {
+		if !strings.HasPrefix(aws.StringValue(rule.ID), idPrefix) {
+			rules = append(rules, rule)
+		}
+	}
+	return append(rules, generated...)
+}
+
+func describeLifecycleRule(rule *s3.LifecycleRule) string {
+	action := ""
+	if rule.Expiration != nil {
+		action = fmt.Sprintf("expire after %d days", aws.Int64Value(rule.Expiration.Days))
+	}
+	for _, transition := range rule.Transitions {
+		action = fmt.Sprintf("transition to %s after %d days", aws.StringValue(transition.StorageClass), aws.Int64Value(transition.Days))
+	}
+	if rule.AbortIncompleteMultipartUpload != nil {
+		action = fmt.Sprintf("abort incomplete uploads after %d days", aws.Int64Value(rule.AbortIncompleteMultipartUpload.DaysAfterInitiation))
+	}
+	return fmt.Sprintf("%s: %s", aws.StringValue(rule.Filter.Prefix), action)
+}
@@ -0,0 +1,51 @@
+package walg
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestBuildLifecycleRules(t *testing.T) {
+	pre := &Prefix{Bucket: aws.String("bucket"), Server: aws.String("db1")}
+	rules := buildLifecycleRules(pre, &lifecycleSettings{TransitionDays: 30, TransitionClass: "GLACIER", AbortIncompleteUpload: 7})
+	expected := []string{
+		"db1/basebackups_005/: transition to GLACIER after 30 days",
+		"db1/: abort incomplete uploads after 7 days",
+	}
+	if len(rules) != len(expected) {
+		t.Fatalf("Expected %d rules, got %d", len(expected), len(rules))
+	}
+	for i, rule := range rules {
+		if description := describeLifecycleRule(rule); description != expected[i] {
+			t.Errorf("Expected %s, got %s", expected[i], description)
+		}
+	}
+}
+
+func TestMergeLifecycleRules(t *testing.T) {
+	pre := &Prefix{Bucket: aws.String("bucket"), Server: aws.String("db1")}
+	other := &Prefix{Bucket: aws.String("bucket"), Server: aws.String("db10")}
+	existing := []*s3.LifecycleRule{
+		{ID: aws.String("logs")},
+		{ID: aws.String(lifecycleRuleIDPrefix(pre) + "expire wal")},
+		{ID: aws.String(lifecycleRuleIDPrefix(other) + "expire wal")},
+	}
+	generated := []*s3.LifecycleRule{{ID: aws.String(lifecycleRuleIDPrefix(pre) + "transition backups")}}
+
+	rules := mergeLifecycleRules(existing, generated, lifecycleRuleIDPrefix(pre))
+	ids := make([]string, 0)
+	for _, rule := range rules {
+		ids = append(ids, *rule.ID)
+	}
+	expected := []string{"logs", "wal-g db10/ expire wal", "wal-g db1/ transition backups"}
+	if len(ids) != len(expected) {
+		t.Fatalf("Unexpected rules %v", ids)
+	}
+	for i := range ids {
+		if ids[i] != expected[i] {
+			t.Errorf("Unexpected rules %v", ids)
+		}
+	}
+}
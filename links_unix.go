@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package walg
+
+import (
+	"os"
+	"syscall"
+)
+
+// hardLinkCount returns number of names of the file
+func hardLinkCount(info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Nlink)
+	}
+	return 1
+}
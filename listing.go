@@ -0,0 +1,62 @@
+package walg
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/pkg/errors"
+)
+
+// ErrListingTruncated happens when storage reports truncated listing and gives no way to continue it
+var ErrListingTruncated = errors.New("listing is truncated without continuation")
+
+// listObjectsV2Pages is s3.ListObjectsV2Pages which does not stop early on storages answering truncated
+// pages without NextContinuationToken: SDK considers such page the last one, so objects after it were
+// silently skipped. Listing is resumed after the last returned key instead. Pages are passed to fn as they
+// are received, callers must not collect listings of millions of keys when they can process them on the way.
+// With WALG_READ_AT objects are listed as they were at that time.
+func listObjectsV2Pages(svc s3iface.S3API, input *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool) error {
+	if readAt := getReadAt(); readAt != nil {
+		return listObjectsAt(svc, input, *readAt, fn)
+	}
+	pageInput := *input
+	for {
+		var lastPage *s3.ListObjectsV2Output
+		stopped := false
+		err := svc.ListObjectsV2Pages(&pageInput, func(page *s3.ListObjectsV2Output, last bool) bool {
+			lastPage = page
+			if !fn(page, last && !isTruncatedWithoutToken(page)) {
+				stopped = true
+				return false
+			}
+			return true
+		})
+		if err != nil || stopped || lastPage == nil || !isTruncatedWithoutToken(lastPage) {
+			return err
+		}
+		startAfter := lastListedKey(lastPage)
+		if startAfter == "" || startAfter == aws.StringValue(pageInput.StartAfter) {
+			return errors.Wrapf(ErrListingTruncated, "listObjectsV2Pages: prefix %s", aws.StringValue(input.Prefix))
+		}
+		pageInput.ContinuationToken = nil
+		pageInput.StartAfter = aws.String(startAfter)
+	}
+}
+
+func isTruncatedWithoutToken(page *s3.ListObjectsV2Output) bool {
+	return aws.BoolValue(page.IsTruncated) && aws.StringValue(page.NextContinuationToken) == ""
+}
+
+// lastListedKey is the greatest key or common prefix of the page
+func lastListedKey(page *s3.ListObjectsV2Output) string {
+	last := ""
+	if len(page.Contents) > 0 {
+		last = aws.StringValue(page.Contents[len(page.Contents)-1].Key)
+	}
+	if len(page.CommonPrefixes) > 0 {
+		if prefix := aws.StringValue(page.CommonPrefixes[len(page.CommonPrefixes)-1].Prefix); prefix > last {
+			last = prefix
+		}
+	}
+	return last
+}
@@ -0,0 +1,68 @@
+package walg
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// truncatedListS3 answers truncated pages without continuation token like some S3-compatible storages,
+// SDK paginator considers every such page the last one
+type truncatedListS3 struct {
+	s3iface.S3API
+	keys     []string
+	pageSize int
+	requests int
+}
+
+func (m *truncatedListS3) ListObjectsV2Pages(input *s3.ListObjectsV2Input, callback func(*s3.ListObjectsV2Output, bool) bool) error {
+	m.requests++
+	output := &s3.ListObjectsV2Output{}
+	for _, key := range m.keys {
+		if !strings.HasPrefix(key, *input.Prefix) || key <= aws.StringValue(input.StartAfter) {
+			continue
+		}
+		if len(output.Contents) == m.pageSize {
+			output.IsTruncated = aws.Bool(true)
+			break
+		}
+		output.Contents = append(output.Contents, &s3.Object{Key: aws.String(key), Size: aws.Int64(1)})
+	}
+	callback(output, true)
+	return nil
+}
+
+func TestListObjectsV2PagesResumesTruncatedListing(t *testing.T) {
+	svc := &truncatedListS3{pageSize: 3}
+	for i := 1; i <= 10; i++ {
+		svc.keys = append(svc.keys, fmt.Sprintf("server/wal_005/0000000100000000000000%02X.lz4", i))
+	}
+	sort.Strings(svc.keys)
+	pre := &Prefix{Svc: svc, Bucket: aws.String("bucket"), Server: aws.String("server")}
+
+	listed := 0
+	if err := listAllObjects(pre, GetWalFolderPath(pre), func(ob *s3.Object) { listed++ }); err != nil {
+		t.Fatal(err)
+	}
+	if listed != 10 || svc.requests != 4 {
+		t.Errorf("listObjectsV2Pages: listed %d objects in %d requests", listed, svc.requests)
+	}
+
+	pages := 0
+	bk := &Backup{Prefix: pre, Path: aws.String(GetWalFolderPath(pre))}
+	err := bk.ListWals("000000010000000000000008", func(page []*s3.ObjectIdentifier) error {
+		pages++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wals, _ := bk.GetWals("000000010000000000000008"); pages != 3 || len(wals) != 7 {
+		t.Errorf("ListWals: %d pages, %d WAL files", pages, len(wals))
+	}
+}
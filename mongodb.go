@@ -0,0 +1,326 @@
+package walg
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+// MongoUsage is a text message explaining how to use mongodb subcommands
+var MongoUsage = "usage:\twal-g mongodb backup-push                               mongodump --oplog of the deployment at WALG_MONGO_URI" + `
+	wal-g mongodb backup-fetch backup_name|LATEST             write archive to stdout for mongorestore --archive --oplogReplay
+	wal-g mongodb backup-list                               list backups
+	wal-g mongodb oplog-push                                upload oplog written since the previous oplog-push
+	wal-g mongodb oplog-fetch backup_name|LATEST until dir  write oplog.bson to roll the backup forward until time (RFC3339)
+	wal-g mongodb delete retain N [--confirm]               delete backups except N latest and oplog older than them
+`
+
+// ErrMongoBackupNotFound happens when there are no MongoDB backups or requested backup does not exist
+var ErrMongoBackupNotFound = errors.New("MongoDB backup not found")
+
+// mongoOplogLag keeps oplog-push behind the latest writes, entries of the last seconds may be not visible yet
+const mongoOplogLag = 10 * time.Second
+
+func printMongoUsageAndFail() {
+	log.Fatal(MongoUsage)
+}
+
+// MongoSentinelDto describes MongoDB backup
+type MongoSentinelDto struct {
+	StartTime        time.Time
+	FinishTime       time.Time
+	UncompressedSize int64
+	WalgVersion      string `json:"WalgVersion,omitempty"`
+}
+
+// MongoOplogWindow is oplog with entries from Start inclusive to End exclusive, both in unix seconds
+type MongoOplogWindow struct {
+	Start int64
+	End   int64
+}
+
+// GetMongoBackupPath gets path for MongoDB backups in a bucket
+func GetMongoBackupPath(pre *Prefix) string {
+	return sanitizePath(*pre.Server + "/mongodb/basebackups_005/")
+}
+
+// GetMongoOplogPath gets path for MongoDB oplog in a bucket
+func GetMongoOplogPath(pre *Prefix) string {
+	return sanitizePath(*pre.Server + "/mongodb/oplog_005/")
+}
+
+// Name of window object, zero padded timestamps keep windows sorted
+func (window MongoOplogWindow) Name() string {
+	return fmt.Sprintf("oplog_%010d_%010d.lz4", window.Start, window.End)
+}
+
+func parseMongoOplogWindow(name string) (MongoOplogWindow, bool) {
+	var window MongoOplogWindow
+	if !strings.HasPrefix(name, "oplog_") || !strings.HasSuffix(name, ".lz4") {
+		return window, false
+	}
+	parts := strings.Split(strings.TrimSuffix(strings.TrimPrefix(name, "oplog_"), ".lz4"), "_")
+	if len(parts) != 2 {
+		return window, false
+	}
+	var err error
+	if window.Start, err = strconv.ParseInt(parts[0], 10, 64); err != nil {
+		return window, false
+	}
+	if window.End, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+		return window, false
+	}
+	return window, true
+}
+
+// getMongoArgs passes WALG_MONGO_URI to mongodump
+func getMongoArgs(args ...string) []string {
+	if uri := getSetting("WALG_MONGO_URI"); uri != "" {
+		return append([]string{"--uri=" + uri}, args...)
+	}
+	return args
+}
+
+// HandleMongo is invoked to perform wal-g mongodb subcommands
+func HandleMongo(tu *TarUploader, pre *Prefix, args []string) {
+	if len(args) < 2 {
+		printMongoUsageAndFail()
+	}
+
+	var err error
+	switch args[1] {
+	case "backup-push":
+		var name string
+		name, err = PushMongoBackup(tu, pre)
+		if err == nil {
+			fmt.Println("Uploaded MongoDB backup", name)
+		}
+	case "backup-fetch":
+		if len(args) != 3 {
+			printMongoUsageAndFail()
+		}
+		var name string
+		name, _, err = resolveMongoBackup(pre, args[2])
+		if err == nil {
+			err = fetchStreamObject(pre, GetMongoBackupPath(pre)+name+"/archive.lz4", os.Stdout)
+		}
+	case "backup-list":
+		err = listMongoBackups(pre, os.Stdout)
+	case "oplog-push":
+		err = PushMongoOplog(tu, pre, time.Now().Add(-mongoOplogLag))
+	case "oplog-fetch":
+		if len(args) != 5 {
+			printMongoUsageAndFail()
+		}
+		until, parseErr := time.Parse(time.RFC3339, args[3])
+		if parseErr != nil {
+			log.Println(parseErr)
+			printMongoUsageAndFail()
+		}
+		err = FetchMongoOplog(pre, args[2], until, args[4])
+	case "delete":
+		if len(args) < 4 || args[2] != "retain" {
+			printMongoUsageAndFail()
+		}
+		retain, parseErr := strconv.Atoi(args[3])
+		if parseErr != nil || retain <= 0 {
+			printMongoUsageAndFail()
+		}
+		confirm := len(args) > 4 && args[4] == "--confirm"
+		err = deleteMongoBackups(pre, retain, !confirm)
+	default:
+		printMongoUsageAndFail()
+	}
+
+	if err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+}
+
+// PushMongoBackup runs mongodump --archive --oplog, so the backup is consistent at the end of the dump
+func PushMongoBackup(tu *TarUploader, pre *Prefix) (string, error) {
+	sentinel := MongoSentinelDto{StartTime: time.Now().UTC(), WalgVersion: WalgVersion}
+	name := "base_" + sentinel.StartTime.Format("20060102T150405Z")
+	cmd := exec.Command("mongodump", getMongoArgs("--archive", "--oplog")...)
+	size, err := uploadCommandOutput(tu, pre, cmd, GetMongoBackupPath(pre)+name+"/archive.lz4")
+	if err != nil {
+		return "", errors.Wrap(err, "PushMongoBackup: backup failed")
+	}
+	sentinel.FinishTime = time.Now().UTC()
+	sentinel.UncompressedSize = size
+	err = uploadJSONSentinel(tu, GetMongoBackupPath(pre)+name+SentinelSuffix, &sentinel)
+	return name, errors.Wrap(err, "PushMongoBackup: failed to upload sentinel")
+}
+
+func resolveMongoBackup(pre *Prefix, name string) (string, *MongoSentinelDto, error) {
+	if name == "LATEST" {
+		backups, err := listStreamBackups(pre, GetMongoBackupPath(pre), SentinelSuffix)
+		if err != nil {
+			return "", nil, err
+		}
+		if len(backups) == 0 {
+			return "", nil, errors.Wrap(ErrMongoBackupNotFound, "resolveMongoBackup: no backups found")
+		}
+		name = backups[0].Name
+		log.Printf("Fetching MongoDB backup %v\n", name)
+	}
+	sentinel := &MongoSentinelDto{}
+	err := fetchJSONSentinel(pre, GetMongoBackupPath(pre)+name+SentinelSuffix, sentinel)
+	if err != nil {
+		return "", nil, errors.Wrapf(ErrMongoBackupNotFound, "resolveMongoBackup: %s: %v", name, err)
+	}
+	return name, sentinel, nil
+}
+
+func listMongoBackups(pre *Prefix, output io.Writer) error {
+	backups, err := listStreamBackups(pre, GetMongoBackupPath(pre), SentinelSuffix)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(output, 0, 0, 1, ' ', 0)
+	defer w.Flush()
+	fmt.Fprintln(w, "name\tlast_modified\tsize")
+	for i := len(backups) - 1; i >= 0; i-- {
+		sentinel := &MongoSentinelDto{}
+		if err = fetchJSONSentinel(pre, GetMongoBackupPath(pre)+backups[i].Name+SentinelSuffix, sentinel); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\n", backups[i].Name, backups[i].Time.Format(time.RFC3339), sentinel.UncompressedSize)
+	}
+	return nil
+}
+
+// listMongoOplogWindows lists oplog windows in storage sorted by time
+func listMongoOplogWindows(pre *Prefix) ([]MongoOplogWindow, error) {
+	oplogPath := GetMongoOplogPath(pre)
+	windows := make([]MongoOplogWindow, 0)
+	err := listAllObjects(pre, oplogPath, func(ob *s3.Object) {
+		if window, ok := parseMongoOplogWindow(strings.TrimPrefix(*ob.Key, oplogPath)); ok {
+			windows = append(windows, window)
+		}
+	})
+	sort.Slice(windows, func(i, j int) bool {
+		return windows[i].Start < windows[j].Start
+	})
+	return windows, err
+}
+
+// PushMongoOplog uploads oplog entries from the end of the previous window until the given time,
+// so consecutive windows have no gaps. The first window starts at the oldest entry of oplog.
+func PushMongoOplog(tu *TarUploader, pre *Prefix, until time.Time) error {
+	windows, err := listMongoOplogWindows(pre)
+	if err != nil {
+		return err
+	}
+	window := MongoOplogWindow{End: until.Unix()}
+	if len(windows) > 0 {
+		window.Start = windows[len(windows)-1].End
+	}
+	if window.Start >= window.End {
+		fmt.Println("Oplog is up to date")
+		return nil
+	}
+
+	query := fmt.Sprintf(`{"ts":{"$gte":{"$timestamp":{"t":%d,"i":0}},"$lt":{"$timestamp":{"t":%d,"i":0}}}}`, window.Start, window.End)
+	cmd := exec.Command("mongodump", getMongoArgs("--db=local", "--collection=oplog.rs", "--query="+query, "--out=-")...)
+	_, err = uploadCommandOutput(tu, pre, cmd, GetMongoOplogPath(pre)+window.Name())
+	if err != nil {
+		return errors.Wrap(err, "PushMongoOplog: oplog dump failed")
+	}
+	fmt.Println("Uploaded oplog", window.Name())
+	return nil
+}
+
+// selectMongoOplogWindows returns windows with entries between start and until, checking they have no gaps
+func selectMongoOplogWindows(windows []MongoOplogWindow, start int64, until int64) ([]MongoOplogWindow, error) {
+	selected := make([]MongoOplogWindow, 0)
+	for _, window := range windows {
+		if window.End <= start || window.Start > until {
+			continue
+		}
+		if len(selected) > 0 && selected[len(selected)-1].End != window.Start {
+			return nil, errors.Errorf("selectMongoOplogWindows: oplog from %d to %d is missing", selected[len(selected)-1].End, window.Start)
+		}
+		selected = append(selected, window)
+	}
+	if len(selected) == 0 || selected[0].Start > start {
+		return nil, errors.Errorf("selectMongoOplogWindows: oplog since %d is missing", start)
+	}
+	if selected[len(selected)-1].End <= until {
+		log.Printf("WARNING! Oplog is archived until %v only\n", time.Unix(selected[len(selected)-1].End, 0).UTC().Format(time.RFC3339))
+	}
+	return selected, nil
+}
+
+// FetchMongoOplog writes oplog since the start of the backup until the time to directory/oplog.bson,
+// mongorestore --oplogReplay --oplogLimit applies it.
+func FetchMongoOplog(pre *Prefix, backupName string, until time.Time, directory string) error {
+	_, sentinel, err := resolveMongoBackup(pre, backupName)
+	if err != nil {
+		return err
+	}
+	windows, err := listMongoOplogWindows(pre)
+	if err != nil {
+		return err
+	}
+	selected, err := selectMongoOplogWindows(windows, sentinel.StartTime.Unix(), until.Unix())
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(directory, 0750); err != nil {
+		return errors.Wrapf(err, "FetchMongoOplog: unable to create %s", directory)
+	}
+	file, err := os.Create(filepath.Join(directory, "oplog.bson"))
+	if err != nil {
+		return errors.Wrap(err, "FetchMongoOplog: unable to create oplog.bson")
+	}
+	defer file.Close()
+	// Concatenated BSON documents of windows make a valid oplog.bson
+	for _, window := range selected {
+		if err = fetchStreamObject(pre, GetMongoOplogPath(pre)+window.Name(), file); err != nil {
+			return errors.Wrapf(err, "FetchMongoOplog: unable to fetch %s", window.Name())
+		}
+	}
+	fmt.Printf("Apply with mongorestore --oplogReplay --oplogLimit %d:0 %s\n", until.Unix(), directory)
+	return errors.Wrap(file.Close(), "FetchMongoOplog: unable to write oplog.bson")
+}
+
+// deleteMongoBackups deletes backups except retain latest ones and oplog not needed to roll them forward
+func deleteMongoBackups(pre *Prefix, retain int, dryRun bool) error {
+	backups, err := listStreamBackups(pre, GetMongoBackupPath(pre), SentinelSuffix)
+	if err != nil {
+		return err
+	}
+	if len(backups) <= retain {
+		fmt.Printf("Have only %d backups, nothing to delete\n", len(backups))
+		return nil
+	}
+	_, oldest, err := resolveMongoBackup(pre, backups[retain-1].Name)
+	if err != nil {
+		return err
+	}
+	windows, err := listMongoOplogWindows(pre)
+	if err != nil {
+		return err
+	}
+
+	oplog := make([]string, 0)
+	for _, window := range windows {
+		if window.End <= oldest.StartTime.Unix() {
+			oplog = append(oplog, GetMongoOplogPath(pre)+window.Name())
+		}
+	}
+	return deleteStreamBackups(pre, GetMongoBackupPath(pre), "archive.lz4", backups[retain:], oplog, dryRun)
+}
@@ -0,0 +1,33 @@
+package walg
+
+import (
+	"testing"
+)
+
+func TestMongoOplogWindowName(t *testing.T) {
+	window := MongoOplogWindow{Start: 1539000000, End: 1539000600}
+	parsed, ok := parseMongoOplogWindow(window.Name())
+	if !ok || parsed != window {
+		t.Fatalf("Window %v was parsed from %v as %v", window, window.Name(), parsed)
+	}
+	if _, ok = parseMongoOplogWindow("oplog_1_x.lz4"); ok {
+		t.Fatal("Invalid window name was parsed")
+	}
+}
+
+func TestSelectMongoOplogWindows(t *testing.T) {
+	windows := []MongoOplogWindow{{0, 100}, {100, 200}, {200, 300}, {300, 400}}
+	selected, err := selectMongoOplogWindows(windows, 150, 250)
+	if err != nil || len(selected) != 2 || selected[0].Start != 100 || selected[1].End != 300 {
+		t.Fatalf("Unexpected windows %v %v", selected, err)
+	}
+
+	_, err = selectMongoOplogWindows([]MongoOplogWindow{{0, 100}, {200, 300}}, 50, 250)
+	if err == nil {
+		t.Fatal("Gap in oplog was not detected")
+	}
+	_, err = selectMongoOplogWindows([]MongoOplogWindow{{200, 300}}, 150, 250)
+	if err == nil {
+		t.Fatal("Missing oplog since backup start was not detected")
+	}
+}
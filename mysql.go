@@ -0,0 +1,295 @@
+package walg
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+// MySQLUsage is a text message explaining how to use mysql subcommands
+var MySQLUsage = "usage:\twal-g mysql backup-push                          stream output of WALG_MYSQL_BACKUP_STREAM_COMMAND to storage" + `
+	wal-g mysql backup-fetch backup_name|LATEST        write backup stream to stdout, e.g. for xbstream -x
+	wal-g mysql backup-list                            list backups
+	wal-g mysql binlog-push [binlog_index]            upload closed binlogs listed in the index, WALG_MYSQL_BINLOG_INDEX by default
+	wal-g mysql binlog-fetch backup_name|LATEST dir    download binlogs written since the backup for replay with mysqlbinlog
+`
+
+// ErrMySQLBackupNotFound happens when there are no MySQL backups or requested backup does not exist
+var ErrMySQLBackupNotFound = errors.New("MySQL backup not found")
+
+func printMySQLUsageAndFail() {
+	log.Fatal(MySQLUsage)
+}
+
+// MySQLSentinelDto describes MySQL backup. BinlogStart is the binlog active when backup started,
+// replay of binlogs starts from it.
+type MySQLSentinelDto struct {
+	BinlogStart      string `json:"BinlogStart,omitempty"`
+	StartTime        time.Time
+	FinishTime       time.Time
+	UncompressedSize int64
+	WalgVersion      string `json:"WalgVersion,omitempty"`
+}
+
+// GetMySQLBackupPath gets path for MySQL backups in a bucket
+func GetMySQLBackupPath(pre *Prefix) string {
+	return sanitizePath(*pre.Server + "/mysql/basebackups_005/")
+}
+
+// GetMySQLBinlogPath gets path for MySQL binlogs in a bucket
+func GetMySQLBinlogPath(pre *Prefix) string {
+	return sanitizePath(*pre.Server + "/mysql/binlog_005/")
+}
+
+// HandleMySQL is invoked to perform wal-g mysql subcommands
+func HandleMySQL(tu *TarUploader, pre *Prefix, args []string) {
+	if len(args) < 2 {
+		printMySQLUsageAndFail()
+	}
+
+	var err error
+	switch args[1] {
+	case "backup-push":
+		var name string
+		name, err = PushMySQLBackup(tu, pre, getSetting("WALG_MYSQL_BACKUP_STREAM_COMMAND"), getSetting("WALG_MYSQL_BINLOG_INDEX"))
+		if err == nil {
+			fmt.Println("Uploaded MySQL backup", name)
+		}
+	case "backup-fetch":
+		if len(args) != 3 {
+			printMySQLUsageAndFail()
+		}
+		err = FetchMySQLBackup(pre, args[2], os.Stdout)
+	case "backup-list":
+		err = listMySQLBackups(pre, os.Stdout)
+	case "binlog-push":
+		index := getSetting("WALG_MYSQL_BINLOG_INDEX")
+		if len(args) > 2 {
+			index = args[2]
+		}
+		if index == "" {
+			printMySQLUsageAndFail()
+		}
+		err = PushMySQLBinlogs(tu, pre, index)
+	case "binlog-fetch":
+		if len(args) != 4 {
+			printMySQLUsageAndFail()
+		}
+		err = FetchMySQLBinlogs(pre, args[2], args[3])
+	default:
+		printMySQLUsageAndFail()
+	}
+
+	if err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+}
+
+// PushMySQLBackup runs backup command, e.g. xtrabackup --backup --stream=xbstream, and uploads its output.
+// When binlog index is known, binlog active at the start of backup is recorded in sentinel.
+func PushMySQLBackup(tu *TarUploader, pre *Prefix, command string, binlogIndex string) (string, error) {
+	if command == "" {
+		return "", errors.New("PushMySQLBackup: WALG_MYSQL_BACKUP_STREAM_COMMAND is not set")
+	}
+	sentinel := MySQLSentinelDto{StartTime: time.Now().UTC(), WalgVersion: WalgVersion}
+	if binlogIndex != "" {
+		binlogs, err := readBinlogIndex(binlogIndex)
+		if err != nil {
+			return "", err
+		}
+		if len(binlogs) > 0 {
+			sentinel.BinlogStart = filepath.Base(binlogs[len(binlogs)-1])
+		}
+	}
+	name := "base_" + sentinel.StartTime.Format("20060102T150405Z")
+
+	size, err := uploadCommandOutput(tu, pre, exec.Command("/bin/sh", "-c", command), GetMySQLBackupPath(pre)+name+"/stream.lz4")
+	if err != nil {
+		return "", errors.Wrap(err, "PushMySQLBackup: backup failed")
+	}
+	sentinel.FinishTime = time.Now().UTC()
+	sentinel.UncompressedSize = size
+	err = uploadJSONSentinel(tu, GetMySQLBackupPath(pre)+name+SentinelSuffix, &sentinel)
+	return name, errors.Wrap(err, "PushMySQLBackup: failed to upload sentinel")
+}
+
+// resolveMySQLBackup finds the latest backup for LATEST and checks that named backup is complete
+func resolveMySQLBackup(pre *Prefix, name string) (string, *MySQLSentinelDto, error) {
+	if name == "LATEST" {
+		backups, err := listStreamBackups(pre, GetMySQLBackupPath(pre), SentinelSuffix)
+		if err != nil {
+			return "", nil, err
+		}
+		if len(backups) == 0 {
+			return "", nil, errors.Wrap(ErrMySQLBackupNotFound, "resolveMySQLBackup: no backups found")
+		}
+		name = backups[0].Name
+		log.Printf("Fetching MySQL backup %v\n", name)
+	}
+	sentinel := &MySQLSentinelDto{}
+	err := fetchJSONSentinel(pre, GetMySQLBackupPath(pre)+name+SentinelSuffix, sentinel)
+	if err != nil {
+		return "", nil, errors.Wrapf(ErrMySQLBackupNotFound, "resolveMySQLBackup: %s: %v", name, err)
+	}
+	return name, sentinel, nil
+}
+
+// FetchMySQLBackup writes decrypted and decompressed backup stream to output
+func FetchMySQLBackup(pre *Prefix, name string, output io.Writer) error {
+	name, _, err := resolveMySQLBackup(pre, name)
+	if err != nil {
+		return err
+	}
+	return fetchStreamObject(pre, GetMySQLBackupPath(pre)+name+"/stream.lz4", output)
+}
+
+func listMySQLBackups(pre *Prefix, output io.Writer) error {
+	backups, err := listStreamBackups(pre, GetMySQLBackupPath(pre), SentinelSuffix)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(output, 0, 0, 1, ' ', 0)
+	defer w.Flush()
+	fmt.Fprintln(w, "name\tlast_modified\tbinlog_start\tsize")
+	for i := len(backups) - 1; i >= 0; i-- {
+		sentinel := &MySQLSentinelDto{}
+		if err = fetchJSONSentinel(pre, GetMySQLBackupPath(pre)+backups[i].Name+SentinelSuffix, sentinel); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", backups[i].Name, backups[i].Time.Format(time.RFC3339), sentinel.BinlogStart, sentinel.UncompressedSize)
+	}
+	return nil
+}
+
+// readBinlogIndex reads binlog paths from index file, relative paths are resolved against index directory
+func readBinlogIndex(index string) ([]string, error) {
+	file, err := os.Open(index)
+	if err != nil {
+		return nil, errors.Wrap(err, "readBinlogIndex: unable to open binlog index")
+	}
+	defer file.Close()
+
+	binlogs := make([]string, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if !filepath.IsAbs(line) {
+			line = filepath.Join(filepath.Dir(index), line)
+		}
+		binlogs = append(binlogs, line)
+	}
+	return binlogs, errors.Wrap(scanner.Err(), "readBinlogIndex: unable to read binlog index")
+}
+
+// PushMySQLBinlogs uploads binlogs from the index which are not in storage yet. The last binlog
+// is being written by the server and is uploaded after rotation.
+func PushMySQLBinlogs(tu *TarUploader, pre *Prefix, index string) error {
+	binlogs, err := readBinlogIndex(index)
+	if err != nil {
+		return err
+	}
+	if len(binlogs) == 0 {
+		return nil
+	}
+	uploaded, err := listMySQLBinlogs(pre)
+	if err != nil {
+		return err
+	}
+	for _, binlog := range binlogs[:len(binlogs)-1] {
+		name := filepath.Base(binlog)
+		if uploaded[name] {
+			continue
+		}
+		if err = uploadMySQLBinlog(tu, pre, binlog); err != nil {
+			return err
+		}
+		fmt.Println("Uploaded binlog", name)
+	}
+	return nil
+}
+
+func uploadMySQLBinlog(tu *TarUploader, pre *Prefix, binlog string) error {
+	file, err := os.Open(binlog)
+	if err != nil {
+		return errors.Wrapf(err, "uploadMySQLBinlog: unable to open %s", binlog)
+	}
+	defer file.Close()
+	lz := &LzPipeWriter{Input: file}
+	lz.Compress(&OpenPGPCrypter{})
+	key := GetMySQLBinlogPath(pre) + filepath.Base(binlog) + ".lz4"
+	return errors.Wrapf(tu.upload(tu.createUploadInput(key, lz.Output), key), "uploadMySQLBinlog: failed to upload %s", binlog)
+}
+
+// listMySQLBinlogs returns names of binlogs in storage
+func listMySQLBinlogs(pre *Prefix) (map[string]bool, error) {
+	binlogPath := GetMySQLBinlogPath(pre)
+	binlogs := make(map[string]bool)
+	err := listAllObjects(pre, binlogPath, func(ob *s3.Object) {
+		binlogs[strings.TrimSuffix(strings.TrimPrefix(*ob.Key, binlogPath), ".lz4")] = true
+	})
+	return binlogs, err
+}
+
+// selectBinlogsForReplay returns binlogs starting from the given one in order of their sequence numbers
+func selectBinlogsForReplay(binlogs map[string]bool, start string) []string {
+	selected := make([]string, 0)
+	for name := range binlogs {
+		if name >= start {
+			selected = append(selected, name)
+		}
+	}
+	sort.Strings(selected)
+	return selected
+}
+
+// FetchMySQLBinlogs downloads binlogs needed to roll the backup forward into directory
+func FetchMySQLBinlogs(pre *Prefix, backupName string, directory string) error {
+	backupName, sentinel, err := resolveMySQLBackup(pre, backupName)
+	if err != nil {
+		return err
+	}
+	if sentinel.BinlogStart == "" {
+		return errors.Errorf("FetchMySQLBinlogs: backup %s was made without WALG_MYSQL_BINLOG_INDEX, its first binlog is unknown", backupName)
+	}
+	binlogs, err := listMySQLBinlogs(pre)
+	if err != nil {
+		return err
+	}
+	selected := selectBinlogsForReplay(binlogs, sentinel.BinlogStart)
+	if len(selected) == 0 || selected[0] != sentinel.BinlogStart {
+		return errors.Errorf("FetchMySQLBinlogs: binlog %s is not found in storage", sentinel.BinlogStart)
+	}
+
+	if err = os.MkdirAll(directory, 0750); err != nil {
+		return errors.Wrapf(err, "FetchMySQLBinlogs: unable to create %s", directory)
+	}
+	for _, name := range selected {
+		file, err := os.Create(filepath.Join(directory, name))
+		if err != nil {
+			return errors.Wrapf(err, "FetchMySQLBinlogs: unable to create %s", name)
+		}
+		err = fetchStreamObject(pre, GetMySQLBinlogPath(pre)+name+".lz4", file)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return errors.Wrapf(err, "FetchMySQLBinlogs: unable to fetch %s", name)
+		}
+		fmt.Println(filepath.Join(directory, name))
+	}
+	return nil
+}
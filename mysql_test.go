@@ -0,0 +1,40 @@
+package walg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadBinlogIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "binlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	index := filepath.Join(dir, "mysql-bin.index")
+	err = ioutil.WriteFile(index, []byte("./mysql-bin.000001\n/var/log/mysql/mysql-bin.000002\n\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	binlogs, err := readBinlogIndex(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{filepath.Join(dir, "mysql-bin.000001"), "/var/log/mysql/mysql-bin.000002"}
+	if !reflect.DeepEqual(binlogs, expected) {
+		t.Fatalf("Expected %v, got %v", expected, binlogs)
+	}
+}
+
+func TestSelectBinlogsForReplay(t *testing.T) {
+	binlogs := map[string]bool{"mysql-bin.000003": true, "mysql-bin.000001": true, "mysql-bin.000010": true, "mysql-bin.000002": true}
+	selected := selectBinlogsForReplay(binlogs, "mysql-bin.000002")
+	expected := []string{"mysql-bin.000002", "mysql-bin.000003", "mysql-bin.000010"}
+	if !reflect.DeepEqual(selected, expected) {
+		t.Fatalf("Expected %v, got %v", expected, selected)
+	}
+}
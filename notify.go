@@ -0,0 +1,157 @@
+package walg
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+// NotifyEvent is the JSON payload passed to WALG_NOTIFY_COMMAND and WALG_NOTIFY_URL
+type NotifyEvent struct {
+	Event   string    `json:"event"`
+	Success bool      `json:"success"`
+	Time    time.Time `json:"time"`
+	Host    string    `json:"host,omitempty"`
+	Bucket  string    `json:"bucket,omitempty"`
+	Server  string    `json:"server,omitempty"`
+	Backup  string    `json:"backup,omitempty"`
+	WalFile string    `json:"wal_file,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// NewNotifyEvent creates event description for a prefix
+func NewNotifyEvent(event string, pre *Prefix) NotifyEvent {
+	host, _ := os.Hostname()
+	result := NotifyEvent{Event: event, Host: host}
+	if pre != nil {
+		result.Bucket = *pre.Bucket
+		result.Server = *pre.Server
+	}
+	return result
+}
+
+// notifyTimeout limits time spent on notification, it must not stall archiving
+const notifyTimeout = 10 * time.Second
+
+// Notify passes event to WALG_NOTIFY_COMMAND on stdin and POSTs it to WALG_NOTIFY_URL.
+// Notification failures are logged but never fail the operation.
+func Notify(event NotifyEvent) {
+	command := getSetting("WALG_NOTIFY_COMMAND")
+	url := getSetting("WALG_NOTIFY_URL")
+	if command == "" && url == "" {
+		return
+	}
+
+	event.Time = time.Now().UTC()
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Println("WARNING! Unable to marshal notification ", err)
+		return
+	}
+
+	if command != "" {
+		cmd := exec.Command("/bin/sh", "-c", command)
+		cmd.Stdin = bytes.NewReader(payload)
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+		if err := runWithTimeout(cmd, notifyTimeout); err != nil {
+			log.Println("WARNING! WALG_NOTIFY_COMMAND failed ", err)
+		}
+	}
+
+	if url != "" {
+		client := &http.Client{Timeout: notifyTimeout}
+		response, err := client.Post(url, "application/json", bytes.NewReader(payload))
+		if err != nil {
+			log.Println("WARNING! WALG_NOTIFY_URL request failed ", err)
+			return
+		}
+		response.Body.Close()
+		if response.StatusCode >= 300 {
+			log.Println("WARNING! WALG_NOTIFY_URL responded with status ", response.Status)
+		}
+	}
+}
+
+func runWithTimeout(cmd *exec.Cmd, timeout time.Duration) error {
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		cmd.Process.Kill()
+		return <-done
+	}
+}
+
+// NotifyFailure sends failure notification for event
+func NotifyFailure(event NotifyEvent, err error) {
+	event.Success = false
+	event.Error = err.Error()
+	Notify(event)
+}
+
+// NotifySuccess sends success notification for event
+func NotifySuccess(event NotifyEvent) {
+	event.Success = true
+	Notify(event)
+}
+
+// fatalWithNotification reports failure of the event and terminates the process
+func fatalWithNotification(event NotifyEvent, err error) {
+	NotifyFailure(event, err)
+	log.Fatalf("%+v\n", err)
+}
+
+// getWalPushNotifyInterval reads WALG_NOTIFY_WAL_PUSH_INTERVAL, 5 minutes by default
+func getWalPushNotifyInterval() time.Duration {
+	intervalStr, ok := lookupSetting("WALG_NOTIFY_WAL_PUSH_INTERVAL")
+	if !ok {
+		return 5 * time.Minute
+	}
+	interval, err := time.ParseDuration(intervalStr)
+	if err != nil {
+		log.Println("WARNING! Unable to parse WALG_NOTIFY_WAL_PUSH_INTERVAL ", err)
+		return 5 * time.Minute
+	}
+	return interval
+}
+
+// NotifyWalPushFailure sends failure notification at most once in WALG_NOTIFY_WAL_PUSH_INTERVAL.
+// archive_command is retried by PostgreSQL every few seconds, so unlimited notifications would flood the receiver.
+// Time of the last notification is kept in modification time of a marker file shared by all wal-push processes.
+func NotifyWalPushFailure(event NotifyEvent, err error) {
+	if !shouldNotifyAgain(walPushNotifyMarker(event), getWalPushNotifyInterval(), time.Now()) {
+		return
+	}
+	NotifyFailure(event, err)
+}
+
+// walPushNotifyMarker names marker file of the archive, clusters sharing a host are limited separately
+func walPushNotifyMarker(event NotifyEvent) string {
+	archive := sha256Hex([]byte(event.Bucket + "/" + event.Server))
+	return filepath.Join(os.TempDir(), "wal-g-wal-push-notified-"+archive[:16])
+}
+
+func shouldNotifyAgain(marker string, interval time.Duration, now time.Time) bool {
+	if stat, err := os.Stat(marker); err == nil && now.Sub(stat.ModTime()) < interval {
+		return false
+	}
+	file, err := os.Create(marker)
+	if err != nil {
+		log.Println("WARNING! Unable to create notification marker ", err)
+		return true
+	}
+	file.Close()
+	os.Chtimes(marker, now, now)
+	return true
+}
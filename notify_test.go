@@ -0,0 +1,70 @@
+package walg
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNotifyURL(t *testing.T) {
+	received := make(chan NotifyEvent, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event NotifyEvent
+		body, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(body, &event)
+		received <- event
+	}))
+	defer server.Close()
+
+	os.Setenv("WALG_NOTIFY_URL", server.URL)
+	defer os.Unsetenv("WALG_NOTIFY_URL")
+
+	event := NewNotifyEvent("backup-push", nil)
+	event.Backup = "base_000000010000000000000002"
+	NotifyFailure(event, errors.New("upload failed"))
+
+	select {
+	case actual := <-received:
+		if actual.Event != "backup-push" || actual.Success || actual.Error != "upload failed" || actual.Backup != event.Backup {
+			t.Errorf("notify: unexpected event %+v", actual)
+		}
+	default:
+		t.Error("notify: event was not delivered")
+	}
+}
+
+func TestShouldNotifyAgain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "notify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	marker := filepath.Join(dir, "marker")
+	now := time.Now()
+
+	if !shouldNotifyAgain(marker, time.Minute, now) {
+		t.Error("notify: first notification was suppressed")
+	}
+	if shouldNotifyAgain(marker, time.Minute, now.Add(30*time.Second)) {
+		t.Error("notify: notification was not rate limited")
+	}
+	if !shouldNotifyAgain(marker, time.Minute, now.Add(2*time.Minute)) {
+		t.Error("notify: notification was suppressed after interval")
+	}
+}
+
+func TestWalPushNotifyMarker(t *testing.T) {
+	first := walPushNotifyMarker(NotifyEvent{Bucket: "bucket", Server: "cluster1"})
+	if first != walPushNotifyMarker(NotifyEvent{Bucket: "bucket", Server: "cluster1", WalFile: "000000010000000000000002"}) {
+		t.Error("notify: marker depends on WAL file")
+	}
+	if first == walPushNotifyMarker(NotifyEvent{Bucket: "bucket", Server: "cluster2"}) {
+		t.Error("notify: clusters share marker")
+	}
+}
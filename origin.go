@@ -0,0 +1,62 @@
+package walg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// User metadata keys attributing uploaded objects to their origin, so bucket-side auditing can tell
+// which cluster uploaded an object when many clusters share credentials
+const (
+	HostMetadataKey        = "Walg-Host"
+	ClusterMetadataKey     = "Walg-Cluster"
+	PgVersionMetadataKey   = "Walg-Pg-Version"
+	WalgVersionMetadataKey = "Walg-Version"
+)
+
+// getClusterName returns WALG_CLUSTER_NAME, name of the cluster recorded in metadata of uploaded objects
+func getClusterName() string {
+	return getSetting("WALG_CLUSTER_NAME")
+}
+
+// originMetadata returns metadata recorded on every uploaded object, unknown values are omitted
+func (tu *TarUploader) originMetadata() map[string]*string {
+	metadata := map[string]*string{WalgVersionMetadataKey: aws.String(WalgVersion)}
+	if host, err := os.Hostname(); err == nil {
+		metadata[HostMetadataKey] = aws.String(host)
+	}
+	if cluster := getClusterName(); cluster != "" {
+		metadata[ClusterMetadataKey] = aws.String(cluster)
+	}
+	if tu.PgVersion != "" {
+		metadata[PgVersionMetadataKey] = aws.String(tu.PgVersion)
+	}
+	return metadata
+}
+
+// formatPgMajorVersion converts server_version_num to major version as written in PG_VERSION, e.g. 9.6 or 10
+func formatPgMajorVersion(versionNum int) string {
+	if versionNum >= 100000 {
+		return strconv.Itoa(versionNum / 10000)
+	}
+	return strconv.Itoa(versionNum/10000) + "." + strconv.Itoa(versionNum/100%100)
+}
+
+// readWalPgVersion reads PG_VERSION of the data directory holding WAL file, archive_command passes
+// paths like pg_wal/000000010000000000000002 relative to it. Empty version is returned if there is none.
+func readWalPgVersion(walPath string) string {
+	absPath, err := filepath.Abs(walPath)
+	if err != nil {
+		return ""
+	}
+	content, err := ioutil.ReadFile(filepath.Join(filepath.Dir(filepath.Dir(absPath)), "PG_VERSION"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(content))
+}
@@ -0,0 +1,43 @@
+package walg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestOriginMetadata(t *testing.T) {
+	SetSettings(map[string]string{"WALG_CLUSTER_NAME": "billing"})
+	defer SetSettings(nil)
+
+	tu := NewTarUploader(nil, "bucket", "server", "region")
+	tu.PgVersion = formatPgMajorVersion(90605)
+	input := tu.createUploadInput("server/wal_005/000000010000000000000002.lz4", nil)
+	if aws.StringValue(input.Metadata[ClusterMetadataKey]) != "billing" || aws.StringValue(input.Metadata[PgVersionMetadataKey]) != "9.6" ||
+		aws.StringValue(input.Metadata[WalgVersionMetadataKey]) != WalgVersion {
+		t.Errorf("createUploadInput: unexpected metadata %v", input.Metadata)
+	}
+	if formatPgMajorVersion(110002) != "11" {
+		t.Errorf("formatPgMajorVersion: unexpected %s", formatPgMajorVersion(110002))
+	}
+}
+
+func TestReadWalPgVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walg-origin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = ioutil.WriteFile(filepath.Join(dir, "PG_VERSION"), []byte("10\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if version := readWalPgVersion(filepath.Join(dir, "pg_wal", "000000010000000000000002")); version != "10" {
+		t.Errorf("readWalPgVersion: unexpected %q", version)
+	}
+	if version := readWalPgVersion(filepath.Join(dir, "000000010000000000000002")); version != "" {
+		t.Errorf("readWalPgVersion: unexpected %q outside of data directory", version)
+	}
+}
@@ -232,6 +232,7 @@ func ReadDatabaseFile(fileName string, lsn *uint64, isNew bool) (io.ReadCloser,
 	if err != nil {
 		return nil, false, fileSize, err
 	}
+	adviseSequentialRead(file)
 
 	if lsn == nil || isNew || !IsPagedFile(info, fileName) {
 		return file, false, fileSize, nil
@@ -252,6 +253,7 @@ func ReadDatabaseFile(fileName string, lsn *uint64, isNew bool) (io.ReadCloser,
 			if err != nil {
 				return nil, false, fileSize, err
 			}
+			adviseSequentialRead(file)
 			return file, false, fileSize, nil
 		}
 
@@ -262,7 +264,7 @@ func ReadDatabaseFile(fileName string, lsn *uint64, isNew bool) (io.ReadCloser,
 
 // ApplyFileIncrement changes pages according to supplied change map file
 func ApplyFileIncrement(fileName string, increment io.Reader) error {
-	fmt.Println("Incrementing " + fileName)
+	infoln("Incrementing " + fileName)
 	header := make([]byte, sizeofInt32)
 	fileSizeBytes := make([]byte, sizeofInt64)
 	diffBlockBytes := make([]byte, sizeofInt32)
@@ -302,7 +304,7 @@ func ApplyFileIncrement(fileName string, increment io.Reader) error {
 		return err
 	}
 	defer file.Close()
-	defer file.Sync()
+	defer syncExtractedFile(file)
 
 	err = file.Truncate(int64(fileSize))
 	if err != nil {
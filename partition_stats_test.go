@@ -0,0 +1,54 @@
+package walg
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager/s3manageriface"
+)
+
+// discardUploader reads uploaded content to the end and drops it
+type discardUploader struct {
+	s3manageriface.UploaderAPI
+}
+
+func (u *discardUploader) Upload(input *s3manager.UploadInput, options ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
+	_, err := io.Copy(ioutil.Discard, input.Body)
+	return &s3manager.UploadOutput{}, err
+}
+
+func TestPartitionCompressionStats(t *testing.T) {
+	tu := NewTarUploader(nil, "bucket", "server", "region")
+	tu.Upl = &discardUploader{}
+	tarBall := &S3TarBall{number: 1, bkupName: "base_000000010000000000000002", tu: tu}
+	tarBall.SetUp(&OpenPGPCrypter{})
+
+	content := bytes.Repeat([]byte("compressible "), 10000)
+	if err := tarBall.Tw().WriteHeader(&tar.Header{Name: "base/1/1", Mode: 0600, Size: int64(len(content))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tarBall.Tw().Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := tarBall.CloseTar(); err != nil {
+		t.Fatal(err)
+	}
+	tarBall.AwaitUploads()
+
+	description, ok := tu.partitions.get()["part_001.tar.lz4"]
+	if !ok {
+		t.Fatal("partition is not recorded")
+	}
+	// Tar of one file is its header, content padded to 512 bytes and two zero blocks
+	rawSize := int64(512 + (len(content)+511)/512*512 + 1024)
+	if description.RawSize != rawSize || description.Codec != "lz4" || description.Encrypted {
+		t.Errorf("unexpected partition description %+v, expected raw size %d", description, rawSize)
+	}
+	if description.Size == 0 || description.Size >= description.RawSize {
+		t.Errorf("compressed size %d is not recorded", description.Size)
+	}
+}
@@ -0,0 +1,279 @@
+package walg
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx"
+	"github.com/pkg/errors"
+)
+
+// pgConnectionSettings maps WALG_PG_* variables to their libpq counterparts
+var pgConnectionSettings = map[string]string{
+	"WALG_PG_HOST":            "PGHOST",
+	"WALG_PG_PORT":            "PGPORT",
+	"WALG_PG_USER":            "PGUSER",
+	"WALG_PG_PASSWORD":        "PGPASSWORD",
+	"WALG_PG_DBNAME":          "PGDATABASE",
+	"WALG_PG_SSLMODE":         "PGSSLMODE",
+	"WALG_PG_SSLROOTCERT":     "PGSSLROOTCERT",
+	"WALG_PG_SSLCERT":         "PGSSLCERT",
+	"WALG_PG_SSLKEY":          "PGSSLKEY",
+	"WALG_PG_CONNECT_TIMEOUT": "PGCONNECT_TIMEOUT",
+	"WALG_PG_PASSFILE":        "PGPASSFILE",
+}
+
+// getPgSetting reads WALG_PG_* variable falling back to libpq variable
+func getPgSetting(name string) string {
+	if value, ok := lookupSetting(name); ok {
+		return value
+	}
+	return getSetting(pgConnectionSettings[name])
+}
+
+// GetPgConnConfig builds PostgreSQL connection configuration. WALG_PG_* variables take precedence over
+// libpq PG* variables, so WAL-G can run under users without PostgreSQL environment.
+func GetPgConnConfig() (pgx.ConnConfig, error) {
+	var config pgx.ConnConfig
+	config.RuntimeParams = make(map[string]string)
+	if appName := getSetting("PGAPPNAME"); appName != "" {
+		config.RuntimeParams["application_name"] = appName
+	}
+
+	config.Host = getPgSetting("WALG_PG_HOST")
+	config.User = getPgSetting("WALG_PG_USER")
+	config.Password = getPgSetting("WALG_PG_PASSWORD")
+	config.Database = getPgSetting("WALG_PG_DBNAME")
+	if portStr := getPgSetting("WALG_PG_PORT"); portStr != "" {
+		port, err := strconv.ParseUint(portStr, 10, 16)
+		if err != nil {
+			return config, errors.Wrapf(err, "GetPgConnConfig: invalid port '%s'", portStr)
+		}
+		config.Port = uint16(port)
+	}
+
+	err := configurePgTLS(&config)
+	if err != nil {
+		return config, err
+	}
+
+	keepAliveInterval, err := getPgKeepAliveInterval()
+	if err != nil {
+		return config, err
+	}
+	dialer := &net.Dialer{KeepAlive: keepAliveInterval}
+	if keepAliveInterval > 0 {
+		// Server side keepalives protect the session from NAT and firewall idle timeouts as well
+		seconds := strconv.Itoa(int((keepAliveInterval + time.Second - 1) / time.Second))
+		config.RuntimeParams["tcp_keepalives_idle"] = seconds
+		config.RuntimeParams["tcp_keepalives_interval"] = seconds
+	}
+	if timeoutStr := getPgSetting("WALG_PG_CONNECT_TIMEOUT"); timeoutStr != "" {
+		seconds, err := strconv.Atoi(timeoutStr)
+		if err != nil {
+			return config, errors.Wrapf(err, "GetPgConnConfig: invalid connect timeout '%s'", timeoutStr)
+		}
+		dialer.Timeout = time.Duration(seconds) * time.Second
+	}
+	config.Dial = dialer.Dial
+
+	// statement_timeout is always set, so server default can not cancel long pg_stop_backup()
+	statementTimeout, err := getPgDuration("WALG_PG_STATEMENT_TIMEOUT", 0)
+	if err != nil {
+		return config, err
+	}
+	config.RuntimeParams["statement_timeout"] = strconv.FormatInt(int64(statementTimeout/time.Millisecond), 10)
+
+	if config.Password == "" {
+		config.Password, err = lookupPgPass(&config)
+		if err != nil {
+			return config, err
+		}
+	}
+	return config, nil
+}
+
+// getPgKeepAliveInterval reads WALG_PG_KEEPALIVE_INTERVAL, zero disables keepalives
+func getPgKeepAliveInterval() (time.Duration, error) {
+	return getPgDuration("WALG_PG_KEEPALIVE_INTERVAL", time.Minute)
+}
+
+func getPgDuration(name string, defaultValue time.Duration) (time.Duration, error) {
+	durationStr, ok := lookupSetting(name)
+	if !ok {
+		return defaultValue, nil
+	}
+	duration, err := time.ParseDuration(durationStr)
+	if err != nil || duration < 0 {
+		return 0, errors.Errorf("getPgDuration: invalid %s '%s'", name, durationStr)
+	}
+	return duration, nil
+}
+
+// configurePgTLS follows libpq sslmode semantics, including certificate files
+func configurePgTLS(config *pgx.ConnConfig) error {
+	sslMode := getPgSetting("WALG_PG_SSLMODE")
+	rootCertFile := getPgSetting("WALG_PG_SSLROOTCERT")
+	certFile := getPgSetting("WALG_PG_SSLCERT")
+	keyFile := getPgSetting("WALG_PG_SSLKEY")
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: true}
+	if certFile != "" || keyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return errors.Wrap(err, "configurePgTLS: unable to load client certificate")
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	if sslMode == "verify-ca" || sslMode == "verify-full" {
+		if rootCertFile == "" {
+			return errors.Errorf("configurePgTLS: sslmode %s requires root certificate", sslMode)
+		}
+		pem, err := ioutil.ReadFile(rootCertFile)
+		if err != nil {
+			return errors.Wrap(err, "configurePgTLS: unable to read root certificate")
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return errors.Errorf("configurePgTLS: no certificates found in %s", rootCertFile)
+		}
+		if sslMode == "verify-full" {
+			tlsConfig = &tls.Config{RootCAs: roots, ServerName: config.Host, Certificates: tlsConfig.Certificates}
+		} else {
+			tlsConfig.VerifyPeerCertificate = verifyCertificateChain(roots)
+		}
+	}
+
+	switch sslMode {
+	case "disable":
+	case "allow":
+		config.UseFallbackTLS = true
+		config.FallbackTLSConfig = tlsConfig
+	case "", "prefer":
+		config.TLSConfig = tlsConfig
+		config.UseFallbackTLS = true
+	case "require", "verify-ca", "verify-full":
+		config.TLSConfig = tlsConfig
+	default:
+		return errors.Errorf("configurePgTLS: invalid sslmode '%s'", sslMode)
+	}
+	return nil
+}
+
+// verifyCertificateChain checks server certificate against roots without host name check, as verify-ca does
+func verifyCertificateChain(roots *x509.CertPool) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		certs := make([]*x509.Certificate, len(rawCerts))
+		for i, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+			certs[i] = cert
+		}
+		if len(certs) == 0 {
+			return errors.New("server did not present certificate")
+		}
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err := certs[0].Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates})
+		return err
+	}
+}
+
+// lookupPgPass finds password in WALG_PG_PASSFILE, PGPASSFILE or ~/.pgpass, %APPDATA%\postgresql\pgpass.conf on Windows
+func lookupPgPass(config *pgx.ConnConfig) (string, error) {
+	passFile := getPgSetting("WALG_PG_PASSFILE")
+	if passFile == "" && runtime.GOOS == "windows" {
+		passFile = filepath.Join(getSetting("APPDATA"), "postgresql", "pgpass.conf")
+	} else if passFile == "" {
+		u, err := user.Current()
+		if err != nil {
+			return "", nil
+		}
+		passFile = filepath.Join(u.HomeDir, ".pgpass")
+	}
+	f, err := os.Open(passFile)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "lookupPgPass: unable to open password file")
+	}
+	defer f.Close()
+
+	host := config.Host
+	if host == "" || strings.HasPrefix(host, "/") {
+		host = "localhost"
+	}
+	port := "5432"
+	if config.Port != 0 {
+		port = strconv.Itoa(int(config.Port))
+	}
+	username := config.User
+	if username == "" {
+		if u, err := user.Current(); err == nil {
+			username = u.Username
+		}
+	}
+	database := config.Database
+	if database == "" {
+		database = username
+	}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := splitPgPassLine(line)
+		if len(fields) != 5 {
+			continue
+		}
+		if pgPassFieldMatches(fields[0], host) && pgPassFieldMatches(fields[1], port) &&
+			pgPassFieldMatches(fields[2], database) && pgPassFieldMatches(fields[3], username) {
+			return fields[4], nil
+		}
+	}
+	return "", errors.Wrap(scanner.Err(), "lookupPgPass: unable to read password file")
+}
+
+func pgPassFieldMatches(field string, value string) bool {
+	return field == "*" || field == value
+}
+
+// splitPgPassLine splits hostname:port:database:username:password honoring \: and \\ escapes
+func splitPgPassLine(line string) []string {
+	fields := make([]string, 0, 5)
+	var current bytes.Buffer
+	escaped := false
+	for _, c := range line {
+		switch {
+		case escaped:
+			current.WriteRune(c)
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == ':':
+			fields = append(fields, current.String())
+			current.Reset()
+		default:
+			current.WriteRune(c)
+		}
+	}
+	return append(fields, current.String())
+}
@@ -0,0 +1,85 @@
+package walg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGetPgConnConfigPrecedence(t *testing.T) {
+	os.Setenv("PGHOST", "/var/run/postgresql")
+	os.Setenv("PGUSER", "postgres")
+	os.Setenv("WALG_PG_HOST", "db.example.com")
+	os.Setenv("WALG_PG_PORT", "6432")
+	os.Setenv("WALG_PG_SSLMODE", "require")
+	os.Setenv("WALG_PG_PASSWORD", "secret")
+	defer func() {
+		for _, name := range []string{"PGHOST", "PGUSER", "WALG_PG_HOST", "WALG_PG_PORT", "WALG_PG_SSLMODE", "WALG_PG_PASSWORD"} {
+			os.Unsetenv(name)
+		}
+	}()
+
+	config, err := GetPgConnConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Host != "db.example.com" || config.Port != 6432 || config.User != "postgres" || config.Password != "secret" {
+		t.Errorf("unexpected connection config %+v", config)
+	}
+	if config.TLSConfig == nil || config.UseFallbackTLS {
+		t.Error("sslmode require must not fall back to plain connection")
+	}
+
+	if config.RuntimeParams["statement_timeout"] != "0" || config.RuntimeParams["tcp_keepalives_idle"] != "60" {
+		t.Errorf("unexpected runtime params %v", config.RuntimeParams)
+	}
+
+	os.Setenv("WALG_PG_STATEMENT_TIMEOUT", "90s")
+	os.Setenv("WALG_PG_KEEPALIVE_INTERVAL", "0")
+	defer os.Unsetenv("WALG_PG_STATEMENT_TIMEOUT")
+	defer os.Unsetenv("WALG_PG_KEEPALIVE_INTERVAL")
+	config, err = GetPgConnConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.RuntimeParams["statement_timeout"] != "90000" {
+		t.Errorf("expected statement timeout in milliseconds, got %v", config.RuntimeParams["statement_timeout"])
+	}
+	if _, ok := config.RuntimeParams["tcp_keepalives_idle"]; ok {
+		t.Error("keepalives are set though disabled")
+	}
+
+	os.Setenv("WALG_PG_SSLMODE", "sometimes")
+	if _, err = GetPgConnConfig(); err == nil {
+		t.Error("invalid sslmode was accepted")
+	}
+}
+
+func TestLookupPgPass(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pgpass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	passFile := filepath.Join(dir, "pgpass")
+	content := "# comment\n" +
+		"other:5432:*:postgres:wrong\n" +
+		"db.example.com:6432:postgres:postgres:pass\\:word\n" +
+		"*:*:*:*:fallback\n"
+	if err = ioutil.WriteFile(passFile, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("WALG_PG_PASSFILE", passFile)
+	defer os.Unsetenv("WALG_PG_PASSFILE")
+
+	config, _ := GetPgConnConfig()
+	config.Host, config.Port, config.User, config.Database = "db.example.com", 6432, "postgres", ""
+	if password, err := lookupPgPass(&config); err != nil || password != "pass:word" {
+		t.Errorf("expected password from matching line, got '%v' %v", password, err)
+	}
+	config.Host = "another.example.com"
+	if password, err := lookupPgPass(&config); err != nil || password != "fallback" {
+		t.Errorf("expected wildcard password, got '%v' %v", password, err)
+	}
+}
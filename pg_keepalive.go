@@ -0,0 +1,61 @@
+package walg
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx"
+)
+
+// PgKeepAlive periodically runs empty query on the connection holding non-exclusive backup,
+// so idle session timeouts and network equipment do not drop it during long backups.
+// The connection must not be used by anyone else until Stop returns.
+type PgKeepAlive struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+// StartPgKeepAlive starts keepalive queries every WALG_PG_KEEPALIVE_INTERVAL
+func StartPgKeepAlive(conn *pgx.Conn) *PgKeepAlive {
+	keepAlive := &PgKeepAlive{stop: make(chan struct{}), done: make(chan struct{})}
+	interval, err := getPgKeepAliveInterval()
+	if err != nil || interval == 0 {
+		if err != nil {
+			log.Printf("WARNING! Keepalive queries are disabled: %v\n", err)
+		}
+		close(keepAlive.done)
+		return keepAlive
+	}
+
+	go func() {
+		defer close(keepAlive.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-keepAlive.stop:
+				return
+			case <-ticker.C:
+				// Keepalive query can not take longer than the interval
+				ctx, cancel := context.WithTimeout(context.Background(), interval)
+				err := conn.Ping(ctx)
+				cancel()
+				if err != nil {
+					log.Printf("WARNING! Keepalive query failed: %v\n", err)
+				}
+			}
+		}
+	}()
+	return keepAlive
+}
+
+// Stop stops keepalive queries and waits for running one to finish
+func (keepAlive *PgKeepAlive) Stop() {
+	select {
+	case <-keepAlive.done:
+	default:
+		close(keepAlive.stop)
+		<-keepAlive.done
+	}
+}
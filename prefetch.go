@@ -6,23 +6,37 @@ import (
 	"log"
 	"os"
 	"os/exec"
-	"path"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/pkg/errors"
 )
 
+// prefetchStaleTimeout is the age of file in running directory after which its download is considered dead
+const prefetchStaleTimeout = time.Minute
+
 // HandleWALPrefetch is invoked by wal-fetch command to speed up database restoration
 func HandleWALPrefetch(pre *Prefix, walFileName string, location string) {
 	var fileName = walFileName
 	var err error
-	location = path.Dir(location)
+	// Segment numbering depends on segment size, take it from the file just fetched
+	detectWalSegmentSize(location)
+	location = filepath.Dir(location)
+	cleanupStalePrefetchFiles(location)
+	prefetchLocation, _, _, _ := getPrefetchLocations(location, "")
+	os.MkdirAll(prefetchLocation, 0755)
 	wg := &sync.WaitGroup{}
 	for i := 0; i < getMaxDownloadConcurrency(8); i++ {
 		fileName, err = NextWALFileName(fileName)
 		if err != nil {
 			log.Println("WAL-prefetch failed: ", err, " file: ", fileName)
 		}
+		if !hasPrefetchSpace(prefetchLocation, i+1) {
+			log.Println("WAL-prefetch stopped, not enough free disk space for ", fileName)
+			break
+		}
 		wg.Add(1)
 		go prefetchFile(location, pre, fileName, wg)
 		time.Sleep(10 * time.Millisecond) // ramp up in order
@@ -42,33 +56,72 @@ func prefetchFile(location string, pre *Prefix, walFileName string, wg *sync.Wai
 	}()
 
 	_, runningLocation, oldPath, newPath := getPrefetchLocations(location, walFileName)
-	_, errO := os.Stat(oldPath)
-	_, errN := os.Stat(newPath)
-
-	if (errO == nil || !os.IsNotExist(errO)) || (errN == nil || !os.IsNotExist(errN)) {
-		// Seems someone is doing something about this file
+	if _, errN := os.Stat(newPath); errN == nil || !os.IsNotExist(errN) {
+		return // Already prefetched
+	}
+	if stat, errO := os.Stat(oldPath); errO == nil {
+		if time.Since(stat.ModTime()) < prefetchStaleTimeout {
+			return // Seems someone is doing something about this file
+		}
+		// Rename is atomic, so only one of concurrent prefetches takes over the stale download
+		stale := fmt.Sprintf("%s.stale.%d", oldPath, os.Getpid())
+		if os.Rename(oldPath, stale) != nil {
+			return
+		}
+		log.Println("WAL-prefetch takes over stale download of ", walFileName)
+		os.Remove(stale)
+	} else if !os.IsNotExist(errO) {
 		return
 	}
 
 	log.Println("WAL-prefetch file: ", walFileName)
 	os.MkdirAll(runningLocation, 0755)
 
-	DownloadWALFile(pre, walFileName, oldPath)
+	err := FetchWALFile(pre, walFileName, oldPath)
+	if err != nil {
+		if errors.Cause(err) != ErrWalNotFound {
+			log.Printf("WAL-prefetch of %s failed: %v\n", walFileName, err)
+		}
+		os.Remove(oldPath)
+		return
+	}
 
-	_, errO = os.Stat(oldPath)
-	_, errN = os.Stat(newPath)
-	if errO == nil && os.IsNotExist(errN) {
+	_, errN := os.Stat(newPath)
+	if os.IsNotExist(errN) {
 		os.Rename(oldPath, newPath)
 	} else {
 		os.Remove(oldPath) // error is ignored
 	}
 }
 
+// cleanupStalePrefetchFiles removes downloads left in running directory by crashed prefetch and files which
+// are not WAL, so they neither block nor confuse following fetches
+func cleanupStalePrefetchFiles(location string) {
+	prefetchLocation, runningLocation, _, _ := getPrefetchLocations(location, "")
+	for _, directory := range []string{prefetchLocation, runningLocation} {
+		fileInfos, err := ioutil.ReadDir(directory)
+		if err != nil {
+			continue
+		}
+		for _, info := range fileInfos {
+			if info.IsDir() {
+				continue
+			}
+			_, _, err = ParseWALFileName(info.Name())
+			isStale := directory == runningLocation && time.Since(info.ModTime()) >= prefetchStaleTimeout
+			if err != nil || isStale {
+				os.Remove(filepath.Join(directory, info.Name()))
+			}
+		}
+	}
+}
+
+// getPrefetchLocations gets prefetch directories for pg_wal location, they are in WALG_TMP_DIR when it is set
 func getPrefetchLocations(location string, walFileName string) (prefetchLocation string, runningLocation string, runningFile string, fetchedFile string) {
-	prefetchLocation = path.Join(location, ".wal-g", "prefetch")
-	runningLocation = path.Join(prefetchLocation, "running")
-	oldPath := path.Join(runningLocation, walFileName)
-	newPath := path.Join(prefetchLocation, walFileName)
+	prefetchLocation = filepath.Join(getScratchLocation(location), ".wal-g", "prefetch")
+	runningLocation = filepath.Join(prefetchLocation, "running")
+	oldPath := filepath.Join(runningLocation, walFileName)
+	newPath := filepath.Join(prefetchLocation, walFileName)
 	return prefetchLocation, runningLocation, oldPath, newPath
 }
 
@@ -79,7 +132,7 @@ func forkPrefetch(walFileName string, location string) {
 		return // There will be nothing ot prefetch anyway
 	}
 	cmd := exec.Command(os.Args[0], "wal-prefetch", walFileName, location)
-	cmd.Env = os.Environ()
+	cmd.Env = settingsEnviron()
 	err := cmd.Start()
 
 	if err != nil {
@@ -140,7 +193,7 @@ func cleanupPrefetchDirectory(directory string, timelineId uint32, logSegNo uint
 			continue
 		}
 		if fileTimelineId < timelineId || (fileTimelineId == timelineId && fileLogSegNo < logSegNo) {
-			cleaner.Remove(path.Join(directory, f))
+			cleaner.Remove(filepath.Join(directory, f))
 		}
 	}
 }
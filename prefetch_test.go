@@ -1,6 +1,12 @@
 package walg
 
-import "testing"
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
 
 type MockCleaner struct {
 	deleted []string
@@ -38,3 +44,60 @@ func TestCleanup(t *testing.T) {
 		t.Fatal("Prefetch cleaner didnot deleted files")
 	}
 }
+
+func TestGetWalFileLocationSymlinkedDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dir, _ = filepath.EvalSymlinks(dir)
+	walDir := filepath.Join(dir, "wal")
+	if err = os.Mkdir(walDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Symlink(walDir, filepath.Join(dir, "pg_wal")); err != nil {
+		t.Fatal(err)
+	}
+
+	location := getWalFileLocation(filepath.Join(dir, "pg_wal", "RECOVERYXLOG"))
+	if location != filepath.Join(walDir, "RECOVERYXLOG") {
+		t.Fatalf("WAL file location was resolved to %v", location)
+	}
+	location = getWalFileLocation(filepath.Join(dir, "pg_xlog", "000000010000000000000001"))
+	if location != filepath.Join(dir, "pg_xlog", "000000010000000000000001") {
+		t.Fatalf("Location in absent directory was changed to %v", location)
+	}
+}
+
+func TestCleanupStalePrefetchFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	prefetchLocation, runningLocation, _, _ := getPrefetchLocations(dir, "")
+	if err = os.MkdirAll(runningLocation, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	stale := filepath.Join(runningLocation, "000000010000000100000058")
+	running := filepath.Join(runningLocation, "000000010000000100000059")
+	prefetched := filepath.Join(prefetchLocation, "000000010000000100000057")
+	junk := filepath.Join(prefetchLocation, "000000010000000100000057.stale.42")
+	for _, file := range []string{stale, running, prefetched, junk} {
+		if err = ioutil.WriteFile(file, []byte{1}, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-2 * prefetchStaleTimeout)
+	os.Chtimes(stale, old, old)
+	os.Chtimes(prefetched, old, old)
+
+	cleanupStalePrefetchFiles(dir)
+	for file, kept := range map[string]bool{stale: false, running: true, prefetched: true, junk: false} {
+		if _, err = os.Stat(file); (err == nil) != kept {
+			t.Errorf("cleanupStalePrefetchFiles: %s is expected to be kept: %v", file, kept)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package walg
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// BackupPushArguments incapsulates arguments for backup-push command
+type BackupPushArguments struct {
+	dirArc          string
+	labels          map[string]string
+	fullIfOlderThan time.Duration
+	role            string
+}
+
+const (
+	// BackupRolePrimary makes backup-push refuse to back up a standby
+	BackupRolePrimary = "primary"
+	// BackupRoleStandby makes backup-push refuse to back up a primary
+	BackupRoleStandby = "standby"
+)
+
+// ErrUnexpectedRole happens when backup-push runs on server of role other than expected, e.g. just promoted standby
+var ErrUnexpectedRole = errors.New("server role differs from expected")
+
+// parseBackupRole validates expected role of backed up server, empty role means any
+func parseBackupRole(role string) (string, error) {
+	if role != "" && role != BackupRolePrimary && role != BackupRoleStandby {
+		return "", errors.Errorf("parseBackupRole: role '%s' is neither %s nor %s", role, BackupRolePrimary, BackupRoleStandby)
+	}
+	return role, nil
+}
+
+// getBackupRole returns role given by --role or WALG_BACKUP_ROLE
+func (cfg BackupPushArguments) getBackupRole() (string, error) {
+	if cfg.role != "" {
+		return cfg.role, nil
+	}
+	return parseBackupRole(getSetting("WALG_BACKUP_ROLE"))
+}
+
+// checkBackupRole compares expected role with recovery state of the server
+func checkBackupRole(role string, inRecovery bool) error {
+	actual := BackupRolePrimary
+	if inRecovery {
+		actual = BackupRoleStandby
+	}
+	if role != "" && role != actual {
+		return errors.Wrapf(ErrUnexpectedRole, "checkBackupRole: expected %s, server is %s", role, actual)
+	}
+	return nil
+}
+
+// ParseBackupPushArguments interprets arguments for backup-push command. TODO: use flags or cobra
+func ParseBackupPushArguments(args []string, fallBackFunc func()) (result BackupPushArguments) {
+	if len(args) < 2 {
+		fallBackFunc()
+		return
+	}
+
+	result.dirArc = args[1]
+	params := args[2:]
+	for len(params) > 0 {
+		if len(params) < 2 {
+			log.Printf("Value for %v not specified\n", params[0])
+			fallBackFunc()
+			return
+		}
+		switch strings.TrimLeft(params[0], "-") {
+		case "label":
+			key, value, err := ParseLabel(params[1])
+			if err != nil {
+				log.Println(err)
+				fallBackFunc()
+				return
+			}
+			if result.labels == nil {
+				result.labels = make(map[string]string)
+			}
+			result.labels[key] = value
+		case "full-if-older-than":
+			age, err := ParseAge(params[1])
+			if err != nil || age <= 0 {
+				log.Printf("Cannot parse age %v\n", params[1])
+				fallBackFunc()
+				return
+			}
+			result.fullIfOlderThan = age
+		case "role":
+			role, err := parseBackupRole(params[1])
+			if err != nil {
+				log.Println(err)
+				fallBackFunc()
+				return
+			}
+			result.role = role
+		default:
+			log.Printf("Unknown option %v\n", params[0])
+			fallBackFunc()
+			return
+		}
+		params = params[2:]
+	}
+	return
+}
+
+// ParseLabel splits label of the form key=value
+func ParseLabel(label string) (key string, value string, err error) {
+	parts := strings.SplitN(label, "=", 2)
+	if len(parts) != 2 || len(parts[0]) == 0 {
+		return "", "", errors.Errorf("Label '%s' is not of the form key=value", label)
+	}
+	return parts[0], parts[1], nil
+}
+
+// ParseAge parses duration which, besides units of time.ParseDuration, can be given in days, e.g. 7d
+func ParseAge(age string) (time.Duration, error) {
+	if strings.HasSuffix(age, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(age, "d"))
+		if err != nil {
+			return 0, errors.Errorf("ParseAge: invalid number of days '%s'", age)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(age)
+}
+
+// HandleBackupPushCommand is invoked to perform wal-g backup-push with command line arguments
+func HandleBackupPushCommand(tu *TarUploader, pre *Prefix, args []string) {
+	cfg := ParseBackupPushArguments(args, printBackupPushUsageAndFail)
+	backupPush(cfg, tu, pre)
+}
+
+// BackupPushUsage is a text message explaining how to use backup-push
+var BackupPushUsage = "usage:\twal-g backup-push backup_directory" + `
+	wal-g backup-push backup_directory --label key=value [--label key2=value2]   store labels in the sentinel
+	wal-g backup-push backup_directory --full-if-older-than 7d                    make delta unless latest full backup is older than 7 days
+	wal-g backup-push backup_directory --role primary                             refuse to back up a standby; standby refuses to back up a primary
+`
+
+func printBackupPushUsageAndFail() {
+	log.Fatal(BackupPushUsage)
+}
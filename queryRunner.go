@@ -59,6 +59,17 @@ func (queryRunner *PgQueryRunner) BuildStopBackup() (string, error) {
 	}
 }
 
+// BuildGetWalSegmentSize formats a query to retrieve WAL segment size in bytes
+func (queryRunner *PgQueryRunner) BuildGetWalSegmentSize() string {
+	// Before PostgreSQL 11 this setting is reported in XLOG blocks, afterwards in bytes
+	return "select setting::bigint * case unit when '8kB' then 8192 when 'MB' then 1048576 else 1 end from pg_settings where name = 'wal_segment_size'"
+}
+
+// BuildGetDataChecksums formats a query to retrieve data checksums setting, absent before 9.3
+func (queryRunner *PgQueryRunner) BuildGetDataChecksums() string {
+	return "select coalesce((select setting from pg_settings where name = 'data_checksums'), 'off')"
+}
+
 // NewPgQueryRunner builds QueryRunner from available connection
 func NewPgQueryRunner(conn *pgx.Conn) (*PgQueryRunner, error) {
 	r := &PgQueryRunner{connection: conn}
@@ -72,6 +83,7 @@ func NewPgQueryRunner(conn *pgx.Conn) (*PgQueryRunner, error) {
 
 // Retrieve PostgreSQL numeric version
 func (queryRunner *PgQueryRunner) getVersion() (err error) {
+	defer startQuerySpan("version()").endWith(&err)
 	conn := queryRunner.connection
 	err = conn.QueryRow(queryRunner.BuildGetVersion()).Scan(&queryRunner.Version)
 	if err != nil {
@@ -82,6 +94,7 @@ func (queryRunner *PgQueryRunner) getVersion() (err error) {
 
 // StartBackup informs the database that we are starting copy of cluster contents
 func (queryRunner *PgQueryRunner) StartBackup(backup string) (backupName string, lsnString string, inRecovery bool, err error) {
+	defer startQuerySpan("pg_start_backup()").endWith(&err)
 	startBackupQuery, err := queryRunner.BuildStartBackup()
 	conn := queryRunner.connection
 	if err != nil {
@@ -97,6 +110,7 @@ func (queryRunner *PgQueryRunner) StartBackup(backup string) (backupName string,
 
 // StopBackup informs the database that copy is over
 func (queryRunner *PgQueryRunner) StopBackup() (label string, offsetMap string, lsnStr string, err error) {
+	defer startQuerySpan("pg_stop_backup()").endWith(&err)
 	conn := queryRunner.connection
 
 	tx, err := conn.Begin()
@@ -127,3 +141,94 @@ func (queryRunner *PgQueryRunner) StopBackup() (label string, offsetMap string,
 
 	return label, offsetMap, lsnStr, nil
 }
+
+// ReadServerSettings retrieves cluster properties which are recorded in backup sentinel
+func (queryRunner *PgQueryRunner) ReadServerSettings() (walSegmentSize uint64, dataChecksums string, err error) {
+	defer startQuerySpan("current_setting()").endWith(&err)
+	conn := queryRunner.connection
+	err = conn.QueryRow(queryRunner.BuildGetWalSegmentSize()).Scan(&walSegmentSize)
+	if err != nil {
+		return 0, "", errors.Wrap(err, "QueryRunner ReadServerSettings: getting wal_segment_size failed")
+	}
+
+	err = conn.QueryRow(queryRunner.BuildGetDataChecksums()).Scan(&dataChecksums)
+	if err != nil {
+		return 0, "", errors.Wrap(err, "QueryRunner ReadServerSettings: getting data_checksums failed")
+	}
+	return walSegmentSize, dataChecksums, nil
+}
+
+// IsInRecovery tells whether the server is a standby
+func (queryRunner *PgQueryRunner) IsInRecovery() (inRecovery bool, err error) {
+	defer startQuerySpan("pg_is_in_recovery()").endWith(&err)
+	err = queryRunner.connection.QueryRow("SELECT pg_is_in_recovery()").Scan(&inRecovery)
+	if err != nil {
+		return false, errors.Wrap(err, "QueryRunner IsInRecovery: pg_is_in_recovery() failed")
+	}
+	return inRecovery, nil
+}
+
+// BuildCreateRestorePoint formats a query that creates named restore point, available since 9.1
+func (queryRunner *PgQueryRunner) BuildCreateRestorePoint() (string, error) {
+	switch {
+	case queryRunner.Version >= 90100:
+		return "SELECT pg_create_restore_point($1)::text", nil
+	case queryRunner.Version == 0:
+		return "", errors.New("Postgres version not set, cannot determine create restore point query")
+	default:
+		return "", errors.New("Restore points are not supported by version " + fmt.Sprintf("%d", queryRunner.Version))
+	}
+}
+
+// CreateRestorePoint writes named restore point into WAL and returns its LSN
+func (queryRunner *PgQueryRunner) CreateRestorePoint(name string) (lsnStr string, err error) {
+	defer startQuerySpan("pg_create_restore_point()").endWith(&err)
+	query, err := queryRunner.BuildCreateRestorePoint()
+	if err != nil {
+		return "", errors.Wrap(err, "QueryRunner CreateRestorePoint: Building create restore point query failed")
+	}
+	err = queryRunner.connection.QueryRow(query, name).Scan(&lsnStr)
+	if err != nil {
+		return "", errors.Wrap(err, "QueryRunner CreateRestorePoint: pg_create_restore_point() failed")
+	}
+	return lsnStr, nil
+}
+
+// BuildGetServerStatus formats a query that reads current WAL position and checkpoint counters,
+// on standby the position is the last replayed LSN
+func (queryRunner *PgQueryRunner) BuildGetServerStatus() (string, error) {
+	switch {
+	case queryRunner.Version >= 170000:
+		return "SELECT (case when pg_is_in_recovery() then pg_last_wal_replay_lsn() else pg_current_wal_insert_lsn() end)::text, num_timed + num_requested, buffers_written, pg_is_in_recovery() FROM pg_stat_checkpointer", nil
+	case queryRunner.Version >= 100000:
+		return "SELECT (case when pg_is_in_recovery() then pg_last_wal_replay_lsn() else pg_current_wal_insert_lsn() end)::text, checkpoints_timed + checkpoints_req, buffers_checkpoint, pg_is_in_recovery() FROM pg_stat_bgwriter", nil
+	case queryRunner.Version >= 90000:
+		return "SELECT (case when pg_is_in_recovery() then pg_last_xlog_replay_location() else pg_current_xlog_insert_location() end)::text, checkpoints_timed + checkpoints_req, buffers_checkpoint, pg_is_in_recovery() FROM pg_stat_bgwriter", nil
+	case queryRunner.Version == 0:
+		return "", errors.New("Postgres version not set, cannot determine server status query")
+	default:
+		return "", errors.New("Could not determine server status query for version " + fmt.Sprintf("%d", queryRunner.Version))
+	}
+}
+
+// GetServerStatus reads current WAL position and checkpoint counters of the server
+func (queryRunner *PgQueryRunner) GetServerStatus() (status ServerStatus, err error) {
+	defer startQuerySpan("server status").endWith(&err)
+	query, err := queryRunner.BuildGetServerStatus()
+	if err != nil {
+		return status, errors.Wrap(err, "QueryRunner GetServerStatus: Building server status query failed")
+	}
+	var lsnStr *string
+	err = queryRunner.connection.QueryRow(query).Scan(&lsnStr, &status.Checkpoints, &status.CheckpointBuffers, &status.InRecovery)
+	if err != nil {
+		return status, errors.Wrap(err, "QueryRunner GetServerStatus: server status query failed")
+	}
+	// Standby which has not replayed anything yet has no replay LSN
+	if lsnStr != nil {
+		status.WalLsn, err = ParseLsn(*lsnStr)
+		if err != nil {
+			return status, errors.Wrap(err, "QueryRunner GetServerStatus: invalid LSN")
+		}
+	}
+	return status, nil
+}
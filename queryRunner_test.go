@@ -71,3 +71,51 @@ func TestBuildStopBackup(t *testing.T) {
 		t.Errorf("Got wrong query string for BuildStopBackup with version 100000, got %s", queryString)
 	}
 }
+
+// Tests building create restore point query
+func TestBuildCreateRestorePoint(t *testing.T) {
+	queryBuilder := &walg.PgQueryRunner{Version: 0}
+	_, err := queryBuilder.BuildCreateRestorePoint()
+	if err == nil {
+		t.Error("BuildCreateRestorePoint did not error on version 0")
+	}
+
+	queryBuilder.Version = 90024
+	_, err = queryBuilder.BuildCreateRestorePoint()
+	if err == nil || err.Error() != "Restore points are not supported by version 90024" {
+		t.Errorf("Incorrect error for BuildCreateRestorePoint with version 90024, got error %v", err)
+	}
+
+	queryBuilder.Version = 100000
+	queryString, err := queryBuilder.BuildCreateRestorePoint()
+	if queryString != "SELECT pg_create_restore_point($1)::text" {
+		t.Errorf("Got wrong query string for BuildCreateRestorePoint with version 100000, got %s", queryString)
+	}
+}
+
+// Tests building server status query
+func TestBuildGetServerStatus(t *testing.T) {
+	queryBuilder := &walg.PgQueryRunner{Version: 0}
+	_, err := queryBuilder.BuildGetServerStatus()
+	if err == nil {
+		t.Error("BuildGetServerStatus did not error on version 0")
+	}
+
+	queryBuilder.Version = 90600
+	queryString, err := queryBuilder.BuildGetServerStatus()
+	if queryString != "SELECT (case when pg_is_in_recovery() then pg_last_xlog_replay_location() else pg_current_xlog_insert_location() end)::text, checkpoints_timed + checkpoints_req, buffers_checkpoint, pg_is_in_recovery() FROM pg_stat_bgwriter" {
+		t.Errorf("Got wrong query string for BuildGetServerStatus with version 90600, got %s", queryString)
+	}
+
+	queryBuilder.Version = 100000
+	queryString, err = queryBuilder.BuildGetServerStatus()
+	if queryString != "SELECT (case when pg_is_in_recovery() then pg_last_wal_replay_lsn() else pg_current_wal_insert_lsn() end)::text, checkpoints_timed + checkpoints_req, buffers_checkpoint, pg_is_in_recovery() FROM pg_stat_bgwriter" {
+		t.Errorf("Got wrong query string for BuildGetServerStatus with version 100000, got %s", queryString)
+	}
+
+	queryBuilder.Version = 170000
+	queryString, err = queryBuilder.BuildGetServerStatus()
+	if queryString != "SELECT (case when pg_is_in_recovery() then pg_last_wal_replay_lsn() else pg_current_wal_insert_lsn() end)::text, num_timed + num_requested, buffers_written, pg_is_in_recovery() FROM pg_stat_checkpointer" {
+		t.Errorf("Got wrong query string for BuildGetServerStatus with version 170000, got %s", queryString)
+	}
+}
@@ -0,0 +1,71 @@
+package walg
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// quietFlag is set by --quiet
+var quietFlag int32
+
+// infoOutput receives informational messages, programs embedding WAL-G redirect it with Config.Log
+var infoOutput io.Writer = os.Stdout
+
+// IsQuiet tells if informational output is suppressed by --quiet or WALG_QUIET, so busy archive_command does not
+// fill server log with lines for every segment
+func IsQuiet() bool {
+	if atomic.LoadInt32(&quietFlag) != 0 {
+		return true
+	}
+	quietStr, ok := lookupSetting("WALG_QUIET")
+	if !ok {
+		return false
+	}
+	quiet, err := strconv.ParseBool(quietStr)
+	if err != nil {
+		log.Fatalf("Unable to parse WALG_QUIET %v\n", err)
+	}
+	return quiet
+}
+
+// ConfigureQuiet turns quiet mode on if quiet is true or WALG_QUIET is set, only warnings and errors are logged then
+func ConfigureQuiet(quiet bool) {
+	if quiet {
+		atomic.StoreInt32(&quietFlag, 1)
+	}
+	if IsQuiet() {
+		log.SetOutput(&quietLogWriter{output: log.Writer()})
+	}
+}
+
+// infof prints informational message to stdout or Config.Log unless quiet mode is on
+func infof(format string, args ...interface{}) {
+	if !IsQuiet() {
+		fmt.Fprintf(infoOutput, format, args...)
+	}
+}
+
+// infoln prints informational line to stdout or Config.Log unless quiet mode is on
+func infoln(args ...interface{}) {
+	if !IsQuiet() {
+		fmt.Fprintln(infoOutput, args...)
+	}
+}
+
+// quietLogWriter drops log messages which are neither warnings nor errors
+type quietLogWriter struct {
+	output io.Writer
+}
+
+func (writer *quietLogWriter) Write(p []byte) (int, error) {
+	message := strings.TrimSpace(logTimestamp.ReplaceAllString(string(p), ""))
+	if getMessageSeverity(message) == syslogInfo && !isFatalLogCall() {
+		return len(p), nil
+	}
+	return writer.output.Write(p)
+}
@@ -0,0 +1,41 @@
+package walg
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"testing"
+)
+
+func TestQuietLogWriterKeepsWarningsAndErrors(t *testing.T) {
+	var stderr bytes.Buffer
+	logger := log.New(&quietLogWriter{output: &stderr}, "", log.LstdFlags)
+	logger.Println("Uploaded 3 compressed tar Files.")
+	logger.Printf("WARNING! Unable to read PG_VERSION\n")
+	logger.Println("ERROR: wal-fetch failed")
+	func() {
+		defer func() { recover() }()
+		logger.Panic("Backup does not exist.")
+	}()
+
+	output := stderr.String()
+	if bytes.Contains(stderr.Bytes(), []byte("Uploaded")) {
+		t.Errorf("Informational message is logged: %s", output)
+	}
+	for _, message := range []string{"WARNING!", "ERROR:", "Backup does not exist."} {
+		if !bytes.Contains(stderr.Bytes(), []byte(message)) {
+			t.Errorf("Message '%s' is dropped: %s", message, output)
+		}
+	}
+}
+
+func TestInfoOutputIsRedirected(t *testing.T) {
+	var output bytes.Buffer
+	defer func(previous io.Writer) { infoOutput = previous }(infoOutput)
+	infoOutput = &output
+	infoln("Restored", "000000010000000000000002")
+	infof("%d segments restored\n", 1)
+	if output.String() != "Restored 000000010000000000000002\n1 segments restored\n" {
+		t.Errorf("Informational messages are not redirected: %q", output.String())
+	}
+}
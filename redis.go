@@ -0,0 +1,289 @@
+package walg
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/pkg/errors"
+)
+
+// RedisUsage is a text message explaining how to use redis subcommands
+var RedisUsage = "usage:\twal-g redis backup-push [--bgsave]                  upload RDB snapshot received over replication protocol" + `
+	wal-g redis backup-fetch backup_name|LATEST [file]    write RDB snapshot to file or stdout
+	wal-g redis backup-list                               list backups
+	wal-g redis delete retain N [--confirm]               delete backups except N latest
+With --bgsave snapshot is made by BGSAVE and read from the data directory of the server, wal-g must run on its host.
+`
+
+// ErrRedisBackupNotFound happens when there are no Redis backups or requested backup does not exist
+var ErrRedisBackupNotFound = errors.New("Redis backup not found")
+
+// redisBgSavePollInterval is the interval of LASTSAVE checks waiting for BGSAVE to finish
+var redisBgSavePollInterval = time.Second
+
+func printRedisUsageAndFail() {
+	log.Fatal(RedisUsage)
+}
+
+// RedisSentinelDto describes Redis backup
+type RedisSentinelDto struct {
+	Method           string
+	StartTime        time.Time
+	FinishTime       time.Time
+	UncompressedSize int64
+	WalgVersion      string `json:"WalgVersion,omitempty"`
+}
+
+// GetRedisBackupPath gets path for Redis backups in a bucket
+func GetRedisBackupPath(pre *Prefix) string {
+	return sanitizePath(*pre.Server + "/redis/basebackups_005/")
+}
+
+// redisCli runs redis-cli with connection settings from WALG_REDIS_HOST, WALG_REDIS_PORT and WALG_REDIS_PASSWORD.
+// Password is passed in environment to keep it out of process list.
+func redisCli(args ...string) *exec.Cmd {
+	cliArgs := make([]string, 0, len(args)+4)
+	if host := getSetting("WALG_REDIS_HOST"); host != "" {
+		cliArgs = append(cliArgs, "-h", host)
+	}
+	if port := getSetting("WALG_REDIS_PORT"); port != "" {
+		cliArgs = append(cliArgs, "-p", port)
+	}
+	cmd := exec.Command("redis-cli", append(cliArgs, args...)...)
+	cmd.Env = settingsEnviron()
+	if password, ok := lookupSetting("WALG_REDIS_PASSWORD"); ok {
+		cmd.Env = append(cmd.Env, "REDISCLI_AUTH="+password)
+	}
+	return cmd
+}
+
+// redisCommand runs a command with redis-cli and returns lines of its output
+func redisCommand(args ...string) ([]string, error) {
+	cmd := redisCli(args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "redisCommand: %s failed: %s", args[0], strings.TrimSpace(stderr.String()))
+	}
+	return strings.Split(strings.TrimSpace(string(output)), "\n"), nil
+}
+
+// HandleRedis is invoked to perform wal-g redis subcommands
+func HandleRedis(tu *TarUploader, pre *Prefix, args []string) {
+	if len(args) < 2 {
+		printRedisUsageAndFail()
+	}
+
+	var err error
+	switch args[1] {
+	case "backup-push":
+		bgSave := len(args) > 2 && args[2] == "--bgsave"
+		var name string
+		name, err = PushRedisBackup(tu, pre, bgSave)
+		if err == nil {
+			fmt.Println("Uploaded Redis backup", name)
+		}
+	case "backup-fetch":
+		if len(args) < 3 || len(args) > 4 {
+			printRedisUsageAndFail()
+		}
+		output := os.Stdout
+		if len(args) == 4 {
+			if output, err = os.Create(args[3]); err != nil {
+				break
+			}
+		}
+		err = FetchRedisBackup(pre, args[2], output)
+		if closeErr := output.Close(); err == nil {
+			err = closeErr
+		}
+	case "backup-list":
+		err = listRedisBackups(pre, os.Stdout)
+	case "delete":
+		if len(args) < 4 || args[2] != "retain" {
+			printRedisUsageAndFail()
+		}
+		retain, parseErr := strconv.Atoi(args[3])
+		if parseErr != nil || retain <= 0 {
+			printRedisUsageAndFail()
+		}
+		confirm := len(args) > 4 && args[4] == "--confirm"
+		var backups []DumpTime
+		backups, err = listStreamBackups(pre, GetRedisBackupPath(pre), SentinelSuffix)
+		if err == nil && len(backups) > retain {
+			err = deleteStreamBackups(pre, GetRedisBackupPath(pre), "dump.rdb.lz4", backups[retain:], nil, !confirm)
+		}
+	default:
+		printRedisUsageAndFail()
+	}
+
+	if err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+}
+
+// PushRedisBackup uploads RDB snapshot. By default redis-cli --rdb receives it like a replica does,
+// which works for remote servers and replicas. With bgSave server is asked to save snapshot
+// to its data directory, which must be readable by wal-g.
+func PushRedisBackup(tu *TarUploader, pre *Prefix, bgSave bool) (string, error) {
+	sentinel := RedisSentinelDto{Method: "replication", StartTime: time.Now().UTC(), WalgVersion: WalgVersion}
+	name := "base_" + sentinel.StartTime.Format("20060102T150405Z")
+	key := GetRedisBackupPath(pre) + name + "/dump.rdb.lz4"
+
+	var size int64
+	var err error
+	if bgSave {
+		sentinel.Method = "bgsave"
+		var rdbPath string
+		if rdbPath, err = redisBgSave(); err == nil {
+			size, err = uploadRedisSnapshot(tu, key, rdbPath)
+		}
+	} else {
+		size, err = pushRedisReplicationSnapshot(tu, key)
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "PushRedisBackup: backup failed")
+	}
+
+	sentinel.FinishTime = time.Now().UTC()
+	sentinel.UncompressedSize = size
+	err = uploadJSONSentinel(tu, GetRedisBackupPath(pre)+name+SentinelSuffix, &sentinel)
+	return name, errors.Wrap(err, "PushRedisBackup: failed to upload sentinel")
+}
+
+// pushRedisReplicationSnapshot receives RDB with redis-cli --rdb into temporary file, redis-cli can not
+// write it to a pipe
+func pushRedisReplicationSnapshot(tu *TarUploader, key string) (int64, error) {
+	tmp, err := createTempDir("walg-redis")
+	if err != nil {
+		return 0, errors.Wrap(err, "pushRedisReplicationSnapshot: unable to create temporary directory")
+	}
+	defer os.RemoveAll(tmp)
+	rdbPath := filepath.Join(tmp, "dump.rdb")
+	cmd := redisCli("--rdb", rdbPath)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err = cmd.Run(); err != nil {
+		return 0, errors.Wrap(err, "pushRedisReplicationSnapshot: redis-cli --rdb failed")
+	}
+	return uploadRedisSnapshot(tu, key, rdbPath)
+}
+
+// redisBgSave starts BGSAVE, waits for LASTSAVE to change and returns path of the snapshot
+func redisBgSave() (string, error) {
+	lastSave, err := redisCommand("LASTSAVE")
+	if err != nil {
+		return "", err
+	}
+	dir, err := redisCommand("CONFIG", "GET", "dir")
+	if err != nil {
+		return "", err
+	}
+	fileName, err := redisCommand("CONFIG", "GET", "dbfilename")
+	if err != nil {
+		return "", err
+	}
+	if len(dir) != 2 || len(fileName) != 2 {
+		return "", errors.New("redisBgSave: unable to get location of RDB file, CONFIG command may be renamed")
+	}
+
+	if _, err = redisCommand("BGSAVE"); err != nil {
+		return "", err
+	}
+	// LASTSAVE does not change when BGSAVE fails, so status of the save is checked as well
+	for {
+		time.Sleep(redisBgSavePollInterval)
+		status, err := redisCommand("INFO", "persistence")
+		if err != nil {
+			return "", err
+		}
+		if redisInfoValue(status, "rdb_bgsave_in_progress") == "1" {
+			continue
+		}
+		current, err := redisCommand("LASTSAVE")
+		if err != nil {
+			return "", err
+		}
+		if current[0] != lastSave[0] {
+			break
+		}
+		if redisInfoValue(status, "rdb_last_bgsave_status") == "err" {
+			return "", errors.New("redisBgSave: BGSAVE failed, see Redis log")
+		}
+	}
+	return filepath.Join(dir[1], fileName[1]), nil
+}
+
+func redisInfoValue(info []string, field string) string {
+	for _, line := range info {
+		if strings.HasPrefix(line, field+":") {
+			return strings.TrimSpace(strings.TrimPrefix(line, field+":"))
+		}
+	}
+	return ""
+}
+
+func uploadRedisSnapshot(tu *TarUploader, key string, rdbPath string) (int64, error) {
+	file, err := os.Open(rdbPath)
+	if err != nil {
+		return 0, errors.Wrap(err, "uploadRedisSnapshot: unable to open RDB file")
+	}
+	defer file.Close()
+	counter := &countingReader{reader: file}
+	lz := &LzPipeWriter{Input: counter}
+	lz.Compress(&OpenPGPCrypter{})
+	err = tu.upload(tu.createUploadInput(key, lz.Output), key)
+	return counter.Count(), errors.Wrap(err, "uploadRedisSnapshot: upload failed")
+}
+
+// FetchRedisBackup writes decrypted and decompressed RDB snapshot to output
+func FetchRedisBackup(pre *Prefix, name string, output io.Writer) error {
+	if name == "LATEST" {
+		backups, err := listStreamBackups(pre, GetRedisBackupPath(pre), SentinelSuffix)
+		if err != nil {
+			return err
+		}
+		if len(backups) == 0 {
+			return errors.Wrap(ErrRedisBackupNotFound, "FetchRedisBackup: no backups found")
+		}
+		name = backups[0].Name
+		log.Printf("Fetching Redis backup %v\n", name)
+	}
+	exists, err := (&Archive{Prefix: pre, Archive: aws.String(GetRedisBackupPath(pre) + name + SentinelSuffix)}).CheckExistence()
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errors.Wrapf(ErrRedisBackupNotFound, "FetchRedisBackup: %s", name)
+	}
+	return fetchStreamObject(pre, GetRedisBackupPath(pre)+name+"/dump.rdb.lz4", output)
+}
+
+func listRedisBackups(pre *Prefix, output io.Writer) error {
+	backups, err := listStreamBackups(pre, GetRedisBackupPath(pre), SentinelSuffix)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(output, 0, 0, 1, ' ', 0)
+	defer w.Flush()
+	fmt.Fprintln(w, "name\tlast_modified\tmethod\tsize")
+	for i := len(backups) - 1; i >= 0; i-- {
+		sentinel := &RedisSentinelDto{}
+		if err = fetchJSONSentinel(pre, GetRedisBackupPath(pre)+backups[i].Name+SentinelSuffix, sentinel); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", backups[i].Name, backups[i].Time.Format(time.RFC3339), sentinel.Method, sentinel.UncompressedSize)
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package walg
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestRedisCli(t *testing.T) {
+	os.Setenv("WALG_REDIS_HOST", "replica")
+	os.Setenv("WALG_REDIS_PORT", "6380")
+	os.Setenv("WALG_REDIS_PASSWORD", "secret")
+	defer os.Unsetenv("WALG_REDIS_HOST")
+	defer os.Unsetenv("WALG_REDIS_PORT")
+	defer os.Unsetenv("WALG_REDIS_PASSWORD")
+
+	cmd := redisCli("--rdb", "/tmp/dump.rdb")
+	expected := []string{"redis-cli", "-h", "replica", "-p", "6380", "--rdb", "/tmp/dump.rdb"}
+	if !reflect.DeepEqual(cmd.Args, expected) {
+		t.Fatalf("Expected %v, got %v", expected, cmd.Args)
+	}
+	if cmd.Env[len(cmd.Env)-1] != "REDISCLI_AUTH=secret" {
+		t.Fatal("Password is not passed in environment")
+	}
+}
+
+func TestRedisInfoValue(t *testing.T) {
+	info := []string{"# Persistence", "rdb_bgsave_in_progress:0\r", "rdb_last_bgsave_status:ok\r"}
+	if redisInfoValue(info, "rdb_bgsave_in_progress") != "0" || redisInfoValue(info, "rdb_last_bgsave_status") != "ok" {
+		t.Fatal("INFO fields are parsed wrong")
+	}
+	if redisInfoValue(info, "loading") != "" {
+		t.Fatal("Missing INFO field is found")
+	}
+}
@@ -0,0 +1,101 @@
+package walg
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"time"
+)
+
+// regionCacheEntry is bucket region resolved by GetBucketLocation
+type regionCacheEntry struct {
+	Region   string
+	Resolved time.Time
+}
+
+// getRegionCacheTTL reads WALG_REGION_CACHE_TTL, zero disables region cache
+func getRegionCacheTTL() time.Duration {
+	ttlStr, ok := lookupSetting("WALG_REGION_CACHE_TTL")
+	if !ok {
+		return 24 * time.Hour
+	}
+	ttl, err := time.ParseDuration(ttlStr)
+	if err != nil || ttl < 0 {
+		log.Fatalf("Unable to parse WALG_REGION_CACHE_TTL '%v'\n", ttlStr)
+	}
+	return ttl
+}
+
+// getRegionCachePath reads WALG_REGION_CACHE_PATH, by default cache is kept in home directory of the user
+func getRegionCachePath() string {
+	if cachePath := getSetting("WALG_REGION_CACHE_PATH"); cachePath != "" {
+		return cachePath
+	}
+	u, err := user.Current()
+	if err != nil || u.HomeDir == "" {
+		return ""
+	}
+	return filepath.Join(u.HomeDir, ".walg_region_cache")
+}
+
+func regionCacheKey(bucket string, endpoint string) string {
+	return endpoint + "/" + bucket
+}
+
+func readRegionCache(cachePath string) map[string]regionCacheEntry {
+	cache := make(map[string]regionCacheEntry)
+	body, err := ioutil.ReadFile(cachePath)
+	if err == nil {
+		// Broken cache is ignored and rewritten
+		json.Unmarshal(body, &cache)
+	}
+	return cache
+}
+
+// getCachedBucketRegion returns region resolved less than WALG_REGION_CACHE_TTL ago
+func getCachedBucketRegion(bucket string, endpoint string) (string, bool) {
+	ttl := getRegionCacheTTL()
+	cachePath := getRegionCachePath()
+	if ttl == 0 || cachePath == "" {
+		return "", false
+	}
+	entry, ok := readRegionCache(cachePath)[regionCacheKey(bucket, endpoint)]
+	if !ok || entry.Region == "" || time.Since(entry.Resolved) > ttl {
+		return "", false
+	}
+	return entry.Region, true
+}
+
+// cacheBucketRegion stores resolved region. Cache is replaced atomically, so concurrent archive_command
+// calls never read partially written file. Failure to write cache is not fatal.
+func cacheBucketRegion(bucket string, endpoint string, region string) {
+	cachePath := getRegionCachePath()
+	if getRegionCacheTTL() == 0 || cachePath == "" {
+		return
+	}
+	cache := readRegionCache(cachePath)
+	cache[regionCacheKey(bucket, endpoint)] = regionCacheEntry{Region: region, Resolved: time.Now()}
+	body, err := json.Marshal(cache)
+	if err != nil {
+		return
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(cachePath), ".walg_region_cache")
+	if err == nil {
+		_, err = tmp.Write(body)
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), cachePath)
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}
+	if err != nil {
+		log.Printf("WARNING! Unable to cache region of bucket in %s: %v\n", cachePath, err)
+	}
+}
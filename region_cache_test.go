@@ -0,0 +1,36 @@
+package walg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRegionCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "region")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv("WALG_REGION_CACHE_PATH", filepath.Join(dir, "cache"))
+	defer os.Unsetenv("WALG_REGION_CACHE_PATH")
+
+	if _, ok := getCachedBucketRegion("bucket", ""); ok {
+		t.Fatal("Region is found in empty cache")
+	}
+	cacheBucketRegion("bucket", "", "eu-west-1")
+	cacheBucketRegion("bucket", "https://minio:9000", "us-east-1")
+	if region, ok := getCachedBucketRegion("bucket", ""); !ok || region != "eu-west-1" {
+		t.Fatalf("Unexpected cached region %v", region)
+	}
+	if region, ok := getCachedBucketRegion("bucket", "https://minio:9000"); !ok || region != "us-east-1" {
+		t.Fatalf("Unexpected cached region %v", region)
+	}
+
+	os.Setenv("WALG_REGION_CACHE_TTL", "0")
+	defer os.Unsetenv("WALG_REGION_CACHE_TTL")
+	if _, ok := getCachedBucketRegion("bucket", ""); ok {
+		t.Fatal("Region is found with disabled cache")
+	}
+}
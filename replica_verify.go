@@ -0,0 +1,223 @@
+package walg
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+// ReplicaVerifyUsage is a text message explaining how to use replica-verify
+var ReplicaVerifyUsage = "usage:\twal-g replica-verify s3://bucket/path [--checksums] [--lag duration]" + `
+	--checksums: compare SHA256 stored by wal-push --verify and ETags of objects, one HEAD request per object on each side
+	--lag: objects uploaded less than this ago may be not replicated yet, they are reported as pending; 15m by default
+Compares objects of the prefix with the replica prefix, e.g. DR bucket filled by bucket replication, and verifies
+sentinels and partitions of the latest backup in the replica. Replica bucket region is WALG_REPLICA_REGION or detected.
+`
+
+// defaultReplicationLag is S3 Replication Time Control threshold, most objects are replicated in seconds
+const defaultReplicationLag = 15 * time.Minute
+
+// ErrReplicaDiverged happens when replica prefix misses objects of the prefix or holds different ones
+var ErrReplicaDiverged = errors.New("replica diverged")
+
+// ReplicaVerifyArguments holds arguments of replica-verify
+type ReplicaVerifyArguments struct {
+	replica   string
+	checksums bool
+	lag       time.Duration
+}
+
+// replicaDivergence is an object of the prefix which is not in the replica as it is
+type replicaDivergence struct {
+	Key     string
+	Problem string
+}
+
+func printReplicaVerifyUsageAndFail() {
+	log.Fatal(ReplicaVerifyUsage)
+}
+
+// ParseReplicaVerifyArguments interprets arguments for replica-verify command. In case of any error it calls fallBackFunc
+func ParseReplicaVerifyArguments(args []string, fallBackFunc func()) (result ReplicaVerifyArguments) {
+	result.lag = defaultReplicationLag
+	params := args[1:]
+	for i := 0; i < len(params); i++ {
+		var err error
+		switch {
+		case params[i] == "--checksums":
+			result.checksums = true
+		case params[i] == "--lag" && i+1 < len(params):
+			i++
+			result.lag, err = time.ParseDuration(params[i])
+		case !strings.HasPrefix(params[i], "-") && result.replica == "":
+			result.replica = params[i]
+		default:
+			err = errors.Errorf("unknown argument %s", params[i])
+		}
+		if err != nil {
+			log.Println(err)
+			fallBackFunc()
+			return
+		}
+	}
+	if result.replica == "" {
+		fallBackFunc()
+	}
+	return
+}
+
+// HandleReplicaVerify is invoked to perform wal-g replica-verify
+func HandleReplicaVerify(pre *Prefix, args []string) {
+	arguments := ParseReplicaVerifyArguments(args, printReplicaVerifyUsageAndFail)
+	replica, err := configureReplicaPrefix(arguments.replica)
+	if err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+	if err = VerifyReplica(pre, replica, arguments); err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+}
+
+// configureReplicaPrefix connects to replica prefix with credentials of the prefix. Region of replica bucket
+// is WALG_REPLICA_REGION, it is detected when the setting is absent.
+func configureReplicaPrefix(replica string) (*Prefix, error) {
+	var pre *Prefix
+	err := withSettings(map[string]string{
+		"WALE_S3_PREFIX": replica,
+		"AWS_REGION":     getSetting("WALG_REPLICA_REGION"),
+	}, func() error {
+		var err error
+		_, pre, err = Configure()
+		return err
+	})
+	return pre, errors.Wrapf(err, "configureReplicaPrefix: failed to configure %s", replica)
+}
+
+// VerifyReplica compares objects of the prefix with the replica and verifies the latest backup of the replica
+func VerifyReplica(pre *Prefix, replica *Prefix, arguments ReplicaVerifyArguments) error {
+	divergences, pending, err := compareReplica(pre, replica, arguments.checksums, time.Now().Add(-arguments.lag))
+	if err != nil {
+		return err
+	}
+	for _, divergence := range divergences {
+		fmt.Printf("DIVERGED %s: %s\n", divergence.Key, divergence.Problem)
+	}
+	if pending > 0 {
+		fmt.Printf("%d objects uploaded during last %v are not replicated yet\n", pending, arguments.lag)
+	}
+
+	latest, err := (&Backup{Prefix: replica, Path: GetBackupPath(replica)}).GetLatest()
+	if err != nil && err != ErrLatestNotFound {
+		return err
+	}
+	if err == nil {
+		if err = verifyBackupChain(replica, latest); err != nil {
+			return errors.Wrapf(err, "VerifyReplica: latest backup %s of replica is not restorable", latest)
+		}
+		fmt.Printf("Latest backup %s of replica is verified\n", latest)
+	}
+
+	if len(divergences) > 0 {
+		return errors.Wrapf(ErrReplicaDiverged, "VerifyReplica: %d objects differ", len(divergences))
+	}
+	fmt.Println("Replica matches the prefix")
+	return nil
+}
+
+// compareReplica finds objects missing in replica or differing from the prefix. Objects uploaded after
+// settled may be not replicated yet, they are counted as pending when missing. Objects present only in
+// replica are not divergence, replication of deletes is usually off.
+func compareReplica(pre *Prefix, replica *Prefix, checksums bool, settled time.Time) ([]replicaDivergence, int, error) {
+	objects, err := listPrefixObjects(pre)
+	if err != nil {
+		return nil, 0, err
+	}
+	replicaObjects, err := listPrefixObjects(replica)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	names := make([]string, 0, len(objects))
+	for name := range objects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	divergences := make([]replicaDivergence, 0)
+	pending := 0
+	for _, name := range names {
+		object := objects[name]
+		replicaObject, ok := replicaObjects[name]
+		if !ok {
+			if aws.TimeValue(object.LastModified).After(settled) {
+				pending++
+				continue
+			}
+			divergences = append(divergences, replicaDivergence{name, "missing in replica"})
+			continue
+		}
+		if aws.Int64Value(object.Size) != aws.Int64Value(replicaObject.Size) {
+			divergences = append(divergences, replicaDivergence{name, fmt.Sprintf("size %d, replica size %d",
+				aws.Int64Value(object.Size), aws.Int64Value(replicaObject.Size))})
+			continue
+		}
+		if !checksums {
+			continue
+		}
+		problem, err := compareObjectChecksums(pre, *object.Key, replica, *replicaObject.Key)
+		if err != nil {
+			return nil, 0, err
+		}
+		if problem != "" {
+			divergences = append(divergences, replicaDivergence{name, problem})
+		}
+	}
+	return divergences, pending, nil
+}
+
+// listPrefixObjects lists objects of the prefix by their paths relative to the prefix
+func listPrefixObjects(pre *Prefix) (map[string]*s3.Object, error) {
+	prefix := storageKey(pre, "")
+	objects := make(map[string]*s3.Object)
+	err := listAllObjects(pre, prefix, func(ob *s3.Object) {
+		objects[strings.TrimPrefix(*ob.Key, prefix)] = ob
+	})
+	return objects, err
+}
+
+// compareObjectChecksums compares SHA256 stored in metadata and ETags of objects. ETags of objects encrypted
+// with KMS are not digests of content and differ between regions, they are not compared.
+func compareObjectChecksums(pre *Prefix, key string, replica *Prefix, replicaKey string) (string, error) {
+	head, err := pre.Svc.HeadObject(&s3.HeadObjectInput{Bucket: pre.Bucket, Key: aws.String(key)})
+	if err != nil {
+		return "", errors.Wrapf(err, "compareObjectChecksums: s3.HeadObject of %s failed", key)
+	}
+	replicaHead, err := replica.Svc.HeadObject(&s3.HeadObjectInput{Bucket: replica.Bucket, Key: aws.String(replicaKey)})
+	if err != nil {
+		return "", errors.Wrapf(err, "compareObjectChecksums: s3.HeadObject of replica %s failed", replicaKey)
+	}
+
+	if sum, ok := head.Metadata[ChecksumMetadataKey]; ok {
+		replicaSum, ok := replicaHead.Metadata[ChecksumMetadataKey]
+		if !ok {
+			return "SHA256 is not stored in replica", nil
+		}
+		if aws.StringValue(sum) != aws.StringValue(replicaSum) {
+			return fmt.Sprintf("SHA256 %s, replica SHA256 %s", aws.StringValue(sum), aws.StringValue(replicaSum)), nil
+		}
+	}
+	if aws.StringValue(head.ServerSideEncryption) == s3.ServerSideEncryptionAwsKms ||
+		aws.StringValue(replicaHead.ServerSideEncryption) == s3.ServerSideEncryptionAwsKms {
+		return "", nil
+	}
+	if aws.StringValue(head.ETag) != aws.StringValue(replicaHead.ETag) {
+		return fmt.Sprintf("ETag %s, replica ETag %s", aws.StringValue(head.ETag), aws.StringValue(replicaHead.ETag)), nil
+	}
+	return "", nil
+}
@@ -0,0 +1,77 @@
+package walg
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestParseReplicaVerifyArguments(t *testing.T) {
+	failed := false
+	fallBack := func() { failed = true }
+
+	arguments := ParseReplicaVerifyArguments([]string{"replica-verify", "s3://dr/path", "--checksums", "--lag", "1h"}, fallBack)
+	if failed || arguments.replica != "s3://dr/path" || !arguments.checksums || arguments.lag != time.Hour {
+		t.Errorf("ParseReplicaVerifyArguments: unexpected %+v", arguments)
+	}
+	arguments = ParseReplicaVerifyArguments([]string{"replica-verify", "s3://dr/path"}, fallBack)
+	if failed || arguments.checksums || arguments.lag != defaultReplicationLag {
+		t.Errorf("ParseReplicaVerifyArguments: unexpected defaults %+v", arguments)
+	}
+	for _, args := range [][]string{{"replica-verify"}, {"replica-verify", "--checksums"}, {"replica-verify", "s3://dr/path", "--lag"}} {
+		failed = false
+		ParseReplicaVerifyArguments(args, fallBack)
+		if !failed {
+			t.Errorf("ParseReplicaVerifyArguments: %v is accepted", args)
+		}
+	}
+}
+
+func TestCompareReplica(t *testing.T) {
+	pre := &Prefix{Svc: &listObjectsS3{objects: map[string]int64{
+		"server/wal_005/000000010000000000000002.lz4": 300,
+		"server/wal_005/000000010000000000000003.lz4": 200,
+		"server/wal_005/000000010000000000000004.lz4": 100,
+		"other/wal_005/000000010000000000000002.lz4":  300,
+	}}, Bucket: aws.String("bucket"), Server: aws.String("server")}
+	replica := &Prefix{Svc: &listObjectsS3{objects: map[string]int64{
+		"dr/wal_005/000000010000000000000002.lz4": 300,
+		"dr/wal_005/000000010000000000000003.lz4": 250,
+		"dr/wal_005/000000010000000000000001.lz4": 100,
+	}}, Bucket: aws.String("dr-bucket"), Server: aws.String("dr")}
+
+	divergences, pending, err := compareReplica(pre, replica, false, time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending != 1 || len(divergences) != 1 || divergences[0].Key != "wal_005/000000010000000000000003.lz4" {
+		t.Errorf("compareReplica: unexpected %v, %d pending", divergences, pending)
+	}
+
+	divergences, pending, err = compareReplica(pre, replica, false, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending != 0 || len(divergences) != 2 || divergences[1].Problem != "missing in replica" {
+		t.Errorf("compareReplica: unexpected %v, %d pending", divergences, pending)
+	}
+}
+
+func TestWithSettingsRestoresOverrides(t *testing.T) {
+	SetSettings(map[string]string{"WALE_S3_PREFIX": "s3://bucket/server"})
+	defer SetSettings(nil)
+
+	err := withSettings(map[string]string{"WALE_S3_PREFIX": "s3://dr/server"}, func() error {
+		if value := getSetting("WALE_S3_PREFIX"); value != "s3://dr/server" {
+			t.Errorf("withSettings: setting is not overridden: %s", value)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value := getSetting("WALE_S3_PREFIX"); value != "s3://bucket/server" {
+		t.Errorf("withSettings: setting is not restored: %s", value)
+	}
+}
@@ -0,0 +1,196 @@
+package walg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/pkg/errors"
+)
+
+// CreateRestorePointUsage is a text message explaining how to use create-restore-point
+var CreateRestorePointUsage = "usage:\twal-g create-restore-point name" + `
+Runs pg_create_restore_point on the primary and records name, LSN and time of the point in the index in storage.
+backup-fetch --target-name name then restores the newest backup before the point and configures recovery to stop
+at it. The point is reachable once WAL segment holding it is archived.
+`
+
+// ErrRestorePointNotFound happens when restore point name is not in the index
+var ErrRestorePointNotFound = errors.New("restore point is not found")
+
+// RestorePoint describes named restore point created by create-restore-point
+type RestorePoint struct {
+	Name string    `json:"name"`
+	LSN  uint64    `json:"lsn"`
+	Time time.Time `json:"time"`
+}
+
+// RestorePoints is the index of restore points, the newest is the last
+type RestorePoints []RestorePoint
+
+func printCreateRestorePointUsageAndFail() {
+	log.Fatal(CreateRestorePointUsage)
+}
+
+// HandleCreateRestorePoint is invoked to perform wal-g create-restore-point
+func HandleCreateRestorePoint(tu *TarUploader, pre *Prefix, args []string) {
+	if len(args) != 2 || args[1] == "" {
+		printCreateRestorePointUsageAndFail()
+	}
+	point, err := CreateRestorePoint(tu, pre, args[1])
+	if err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+	fmt.Printf("Restore point %s created at %s\n", point.Name, FormatLsn(point.LSN))
+}
+
+// CreateRestorePoint creates restore point in the database and appends it to the index
+func CreateRestorePoint(tu *TarUploader, pre *Prefix, name string) (RestorePoint, error) {
+	points, err := fetchRestorePoints(pre)
+	if err != nil {
+		return RestorePoint{}, err
+	}
+	conn, err := Connect()
+	if err != nil {
+		return RestorePoint{}, err
+	}
+	defer conn.Close()
+	queryRunner, err := NewPgQueryRunner(conn)
+	if err != nil {
+		return RestorePoint{}, errors.Wrap(err, "CreateRestorePoint: Failed to build query runner.")
+	}
+	lsnStr, err := queryRunner.CreateRestorePoint(name)
+	if err != nil {
+		return RestorePoint{}, err
+	}
+	lsn, err := ParseLsn(lsnStr)
+	if err != nil {
+		return RestorePoint{}, err
+	}
+	point := RestorePoint{Name: name, LSN: lsn, Time: time.Now().UTC()}
+	if err = saveRestorePoints(tu, pre, append(points, point)); err != nil {
+		return RestorePoint{}, err
+	}
+	return point, nil
+}
+
+// find returns the newest point with the name, recovery stops at the first point with the name after the backup
+// and this is the newest one when the backup is chosen by its LSN
+func (points RestorePoints) find(name string) (RestorePoint, bool) {
+	for i := len(points) - 1; i >= 0; i-- {
+		if points[i].Name == name {
+			return points[i], true
+		}
+	}
+	return RestorePoint{}, false
+}
+
+func getRestorePointsKey(pre *Prefix) string {
+	return sanitizePath(*pre.Server + "/wal-g-restore-points.json")
+}
+
+func fetchRestorePoints(pre *Prefix) (RestorePoints, error) {
+	points := make(RestorePoints, 0)
+	key := getRestorePointsKey(pre)
+	a := &Archive{Prefix: pre, Archive: aws.String(key)}
+	exists, err := a.CheckExistence()
+	if err != nil {
+		return nil, errors.Wrap(err, "fetchRestorePoints: unable to check index existence")
+	}
+	if !exists {
+		return points, nil
+	}
+	reader, err := a.GetArchive()
+	if err != nil {
+		return nil, errors.Wrap(err, "fetchRestorePoints: unable to download index")
+	}
+	defer reader.Close()
+	err = json.NewDecoder(reader).Decode(&points)
+	if err != nil {
+		return nil, errors.Wrapf(err, "fetchRestorePoints: unable to parse %s", key)
+	}
+	return points, nil
+}
+
+func saveRestorePoints(tu *TarUploader, pre *Prefix, points RestorePoints) error {
+	content, err := json.Marshal(points)
+	if err != nil {
+		return errors.Wrap(err, "saveRestorePoints: unable to marshal index")
+	}
+	key := getRestorePointsKey(pre)
+	return tu.upload(tu.createUploadInput(key, bytes.NewReader(content)), key)
+}
+
+// FindRestorePoint resolves restore point name from the index
+func FindRestorePoint(pre *Prefix, name string) (RestorePoint, error) {
+	points, err := fetchRestorePoints(pre)
+	if err != nil {
+		return RestorePoint{}, err
+	}
+	point, ok := points.find(name)
+	if !ok {
+		return RestorePoint{}, errors.Wrapf(ErrRestorePointNotFound, "FindRestorePoint: %s", name)
+	}
+	return point, nil
+}
+
+// writeRecoveryConf configures restored cluster to fetch WAL with wal-fetch and recover up to the target.
+// PostgreSQL 12 and newer read recovery settings from postgresql.auto.conf and start recovery by recovery.signal,
+// older versions read recovery.conf.
+func writeRecoveryConf(dirArc string, settings [][2]string) error {
+	executable, err := os.Executable()
+	if err != nil {
+		executable = "wal-g"
+	}
+	lines := []string{fmt.Sprintf("restore_command = %s", quoteRecoveryConfValue(executable+` wal-fetch "%f" "%p"`))}
+	for _, setting := range settings {
+		lines = append(lines, fmt.Sprintf("%s = %s", setting[0], quoteRecoveryConfValue(setting[1])))
+	}
+	content := strings.Join(lines, "\n") + "\n"
+
+	if getRestoredMajorVersion(dirArc) < 12 {
+		location := filepath.Join(dirArc, "recovery.conf")
+		return errors.Wrapf(ioutil.WriteFile(location, []byte(content), 0600), "writeRecoveryConf: unable to write %s", location)
+	}
+	location := filepath.Join(dirArc, "postgresql.auto.conf")
+	file, err := os.OpenFile(location, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "writeRecoveryConf: unable to open %s", location)
+	}
+	_, err = file.WriteString("# recovery settings written by wal-g backup-fetch\n" + content)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.Wrapf(err, "writeRecoveryConf: unable to write %s", location)
+	}
+	location = filepath.Join(dirArc, "recovery.signal")
+	return errors.Wrapf(ioutil.WriteFile(location, nil, 0600), "writeRecoveryConf: unable to write %s", location)
+}
+
+// getRestoredMajorVersion reads PG_VERSION of restored cluster, 9.6 is reported as 9
+func getRestoredMajorVersion(dirArc string) int {
+	content, err := ioutil.ReadFile(filepath.Join(dirArc, "PG_VERSION"))
+	if err != nil {
+		log.Printf("WARNING! Unable to read PG_VERSION, recovery.conf is written: %v\n", err)
+		return 0
+	}
+	major, err := strconv.Atoi(strings.SplitN(strings.TrimSpace(string(content)), ".", 2)[0])
+	if err != nil {
+		log.Printf("WARNING! Unable to parse PG_VERSION, recovery.conf is written: %v\n", err)
+		return 0
+	}
+	return major
+}
+
+func quoteRecoveryConfValue(value string) string {
+	return "'" + strings.Replace(value, "'", "''", -1) + "'"
+}
@@ -0,0 +1,50 @@
+package walg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRestorePointsFind(t *testing.T) {
+	points := RestorePoints{{Name: "release", LSN: 1}, {Name: "other", LSN: 2}, {Name: "release", LSN: 3}}
+	point, ok := points.find("release")
+	if !ok || point.LSN != 3 {
+		t.Fatalf("Wrong restore point %v", point)
+	}
+	if _, ok = points.find("missing"); ok {
+		t.Fatal("Missing restore point is found")
+	}
+}
+
+func TestWriteRecoveryConf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal-g-recovery-conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "PG_VERSION"), []byte("9.6\n"), 0600)
+	if err = writeRecoveryConf(dir, [][2]string{{"recovery_target_name", "it's"}}); err != nil {
+		t.Fatal(err)
+	}
+	content, _ := ioutil.ReadFile(filepath.Join(dir, "recovery.conf"))
+	if !strings.Contains(string(content), "recovery_target_name = 'it''s'\n") || !strings.Contains(string(content), `wal-fetch "%f" "%p"'`) {
+		t.Fatalf("Wrong recovery.conf %s", content)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "PG_VERSION"), []byte("12\n"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "postgresql.auto.conf"), []byte("work_mem = '4MB'\n"), 0600)
+	if err = writeRecoveryConf(dir, [][2]string{{"recovery_target_name", "release"}}); err != nil {
+		t.Fatal(err)
+	}
+	content, _ = ioutil.ReadFile(filepath.Join(dir, "postgresql.auto.conf"))
+	if !strings.HasPrefix(string(content), "work_mem = '4MB'\n") || !strings.Contains(string(content), "recovery_target_name = 'release'\n") {
+		t.Fatalf("Wrong postgresql.auto.conf %s", content)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "recovery.signal")); err != nil {
+		t.Fatal("recovery.signal is not created")
+	}
+}
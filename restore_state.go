@@ -0,0 +1,202 @@
+package walg
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RestoreStateFile records in restored directory which backup backup-fetch --delta-restore extracted there,
+// it is never included into backups
+const RestoreStateFile = "wal-g-restore.json"
+
+// ErrDeltaRestoreImpossible happens when backup can not be restored by applying its deltas to the backup
+// restored earlier, the directory must be restored from scratch then
+var ErrDeltaRestoreImpossible = errors.New("delta restore onto existing directory is impossible")
+
+// restoreDeltaOnto is set by backup-fetch --delta-restore
+var restoreDeltaOnto bool
+
+// restoreState is the backup extracted into a directory: SHA256 of partitions of its delta chain by
+// backup_name/partition and size and modification time of every file right after extraction
+type restoreState struct {
+	Backup     string
+	Partitions map[string]string
+	Files      map[string]restoredFile
+	dir        string
+}
+
+type restoredFile struct {
+	Size  int64
+	MTime time.Time
+}
+
+// readRestoreState reads state of directory, nil is returned when directory was not restored with --delta-restore
+func readRestoreState(dirArc string) (*restoreState, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dirArc, RestoreStateFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "readRestoreState: unable to read restore state")
+	}
+	state := &restoreState{dir: dirArc}
+	if err = json.Unmarshal(data, state); err != nil {
+		return nil, errors.Wrap(err, "readRestoreState: restore state is corrupt")
+	}
+	return state, nil
+}
+
+// writeRestoreState records the backup and files extracted into directory
+func writeRestoreState(pre *Prefix, dirArc string, backupName string) error {
+	partitions, err := getChainPartitions(pre, backupName)
+	if err != nil {
+		return err
+	}
+	state := &restoreState{Backup: backupName, Partitions: partitions, Files: make(map[string]restoredFile)}
+	err = filepath.Walk(dirArc, func(location string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			name, err := filepath.Rel(dirArc, location)
+			if err != nil {
+				return err
+			}
+			state.Files[filepath.ToSlash(name)] = restoredFile{Size: info.Size(), MTime: info.ModTime()}
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "writeRestoreState: unable to list restored files")
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	location := filepath.Join(dirArc, RestoreStateFile)
+	return errors.Wrapf(ioutil.WriteFile(location, data, 0600), "writeRestoreState: unable to write %s", location)
+}
+
+// getChainPartitions collects SHA256 of partitions of the backup and of its delta bases
+func getChainPartitions(pre *Prefix, backupName string) (map[string]string, error) {
+	partitions := make(map[string]string)
+	for backupName != "" {
+		bk, err := findBackup(backupName, pre)
+		if err != nil {
+			return nil, err
+		}
+		sentinel, err := readSentinel(*bk.Name, bk, pre)
+		if err != nil {
+			return nil, err
+		}
+		for name, partition := range sentinel.Partitions {
+			partitions[path.Join(*bk.Name, name)] = partition.Sha256
+		}
+		backupName = ""
+		if sentinel.IsIncremental() {
+			backupName = *sentinel.IncrementFrom
+		}
+	}
+	return partitions, nil
+}
+
+// prepareDeltaRestore returns the backup restored into directory which requested backup is applied onto, empty
+// name means that directory is restored from scratch. Restore state is removed until restore is done, so
+// interrupted restore is never reused.
+func prepareDeltaRestore(pre *Prefix, backupName string, dirArc string) (string, error) {
+	if !restoreDeltaOnto {
+		return "", nil
+	}
+	state, err := readRestoreState(dirArc)
+	if err != nil || state == nil {
+		return "", err
+	}
+	if err = planDeltaRestore(pre, state, backupName); err != nil {
+		return "", err
+	}
+	if err = os.Remove(filepath.Join(dirArc, RestoreStateFile)); err != nil {
+		return "", errors.Wrap(err, "prepareDeltaRestore: unable to remove restore state")
+	}
+	infof("Applying deltas of %s onto restored %s\n", backupName, state.Backup)
+	return state.Backup, nil
+}
+
+// planDeltaRestore finds the backup restored into directory in the delta chain of requested backup, only deltas
+// newer than it need to be fetched. Partitions of the restored part of the chain must have the checksums they had
+// when they were extracted, and files the first newer delta takes from the directory must be unchanged since.
+func planDeltaRestore(pre *Prefix, state *restoreState, backupName string) error {
+	var next *S3TarBallSentinelDto
+	for name := backupName; name != state.Backup; {
+		bk, err := findBackup(name, pre)
+		if err != nil {
+			return err
+		}
+		sentinel, err := readSentinel(*bk.Name, bk, pre)
+		if err != nil {
+			return err
+		}
+		if len(sentinel.Tablespaces) > 0 {
+			return errors.Wrapf(ErrDeltaRestoreImpossible, "%s has tablespaces outside of PGDATA", name)
+		}
+		if !sentinel.IsIncremental() {
+			return errors.Wrapf(ErrDeltaRestoreImpossible, "%s is not a delta of restored %s", backupName, state.Backup)
+		}
+		next = &sentinel
+		name = *sentinel.IncrementFrom
+	}
+
+	partitions, err := getChainPartitions(pre, state.Backup)
+	if err != nil {
+		return err
+	}
+	if len(partitions) == 0 {
+		return errors.Wrapf(ErrDeltaRestoreImpossible, "%s does not record partition checksums", state.Backup)
+	}
+	for name, sum := range partitions {
+		if state.Partitions[name] != sum {
+			return errors.Wrapf(ErrDeltaRestoreImpossible, "partition %s has changed since it was restored", name)
+		}
+	}
+	if next == nil {
+		return nil
+	}
+	if changed := findChangedBaseFiles(state, next.Files); len(changed) > 0 {
+		examples := changed[:min(len(changed), 10)]
+		return errors.Wrapf(ErrDeltaRestoreImpossible, "%d files changed since restore, e.g. %s", len(changed), strings.Join(examples, ", "))
+	}
+	return nil
+}
+
+// findChangedBaseFiles lists files delta takes from its base, skipped or incremented ones, which differ from
+// the files restored into directory
+func findChangedBaseFiles(state *restoreState, files BackupFileList) []string {
+	names := make([]string, 0)
+	for name, description := range files {
+		if description.IsSkipped || description.IsIncremented {
+			names = append(names, normalizeMemberName(name))
+		}
+	}
+	return findChangedFiles(state, names)
+}
+
+// findChangedFiles lists files which are absent or differ in size or modification time from restored ones
+func findChangedFiles(state *restoreState, names []string) []string {
+	changed := make([]string, 0)
+	for _, name := range names {
+		restored, ok := state.Files[name]
+		info, err := os.Stat(filepath.Join(state.dir, filepath.FromSlash(name)))
+		if !ok || err != nil || info.Size() != restored.Size || !info.ModTime().Equal(restored.MTime) {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
@@ -0,0 +1,74 @@
+package walg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/pkg/errors"
+)
+
+func TestPlanDeltaRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walg-delta-restore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"base/1/1", "base/1/2", "PG_VERSION"} {
+		if err = os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	base := "base_000000010000000000000002"
+	delta := "base_000000010000000000000004_D_000000010000000000000002"
+	path := "server/basebackups_005/"
+	svc := &backupChainS3{sentinels: map[string]string{
+		path + base + SentinelSuffix: `{"Partitions":{"part_001.tar.lz4":{"Size":30,"Sha256":"aa"}}}`,
+		path + delta + SentinelSuffix: `{"DeltaFrom":"` + base + `","DeltaFromLSN":1,"DeltaFullName":"` + base + `","DeltaCount":1,
+			"Files":{"/base/1/1":{"IsIncremented":true},"/base/1/2":{},"/PG_VERSION":{"IsSkipped":true}}}`,
+	}}
+	pre := &Prefix{Svc: svc, Bucket: aws.String("bucket"), Server: aws.String("server")}
+
+	if err = writeRestoreState(pre, dir, base); err != nil {
+		t.Fatal(err)
+	}
+	state, err := readRestoreState(dir)
+	if err != nil || state == nil || state.Backup != base || state.Partitions[base+"/part_001.tar.lz4"] != "aa" {
+		t.Fatalf("unexpected restore state %+v %v", state, err)
+	}
+	if err = planDeltaRestore(pre, state, delta); err != nil {
+		t.Fatal(err)
+	}
+	if err = planDeltaRestore(pre, state, base); err != nil {
+		t.Fatal(err)
+	}
+
+	// Fully fetched files may change, files taken from the base may not
+	if err = ioutil.WriteFile(filepath.Join(dir, "base/1/2"), []byte("changed"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = planDeltaRestore(pre, state, delta); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "PG_VERSION"), []byte("changed"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = planDeltaRestore(pre, state, delta); errors.Cause(err) != ErrDeltaRestoreImpossible {
+		t.Fatalf("delta is applied onto changed file: %v", err)
+	}
+
+	state.Partitions[base+"/part_001.tar.lz4"] = "bb"
+	if err = planDeltaRestore(pre, state, base); errors.Cause(err) != ErrDeltaRestoreImpossible {
+		t.Fatalf("replaced partition is reused: %v", err)
+	}
+	state.Backup = delta
+	if err = planDeltaRestore(pre, state, base); errors.Cause(err) != ErrDeltaRestoreImpossible {
+		t.Fatalf("base is restored onto its delta: %v", err)
+	}
+}
@@ -0,0 +1,100 @@
+package walg
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+// getRetentionDays reads WALG_RETENTION_DAYS, number of days backups and WAL are kept. Zero means not set.
+func getRetentionDays() int {
+	return getRetentionSetting("WALG_RETENTION_DAYS")
+}
+
+// getRetentionFullCount reads WALG_RETENTION_FULL_COUNT, number of full backups kept with their deltas.
+// Zero means not set.
+func getRetentionFullCount() int {
+	return getRetentionSetting("WALG_RETENTION_FULL_COUNT")
+}
+
+func getRetentionSetting(name string) int {
+	valueStr, ok := lookupSetting(name)
+	if !ok {
+		return 0
+	}
+	value, err := strconv.Atoi(valueStr)
+	if err != nil || value < 0 {
+		log.Fatalf("Unable to parse %s '%v'\n", name, valueStr)
+	}
+	return value
+}
+
+// applyRetention deletes backups, WAL, dumps and streams outside of configured retention.
+// It is invoked after successful backup-push, nothing is done when retention is not configured.
+func applyRetention(pre *Prefix) {
+	fullCount, days := getRetentionFullCount(), getRetentionDays()
+	if fullCount == 0 && days == 0 {
+		return
+	}
+	var bk = &Backup{
+		Prefix: pre,
+		Path:   GetBackupPath(pre),
+	}
+	backups, err := bk.GetBackups()
+	if err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+	target, found := findRetentionTarget(backups, func(name string) bool {
+		dto := fetchSentinel(name, bk, pre)
+		return !dto.IsIncremental()
+	}, fullCount, days, time.Now())
+	if !found {
+		fmt.Println("Retention: all backups are retained")
+		return
+	}
+	fmt.Printf("Retention: deleting everything before %s\n", target)
+	deleteBeforeTarget(target, bk, pre, true, backups, false)
+}
+
+// findRetentionTarget finds the oldest backup to keep. Backups are ordered newest first. With both settings
+// backups satisfying any of them are kept. Returns false when nothing is to be deleted.
+func findRetentionTarget(backups []BackupTime, isFull func(name string) bool, fullCount int, days int, now time.Time) (string, bool) {
+	target := -1
+	if fullCount > 0 {
+		fulls := 0
+		for i, backup := range backups {
+			if isFull(backup.Name) {
+				fulls++
+			}
+			if fulls == fullCount {
+				target = i
+				break
+			}
+		}
+		if target == -1 {
+			return "", false
+		}
+	}
+	if days > 0 {
+		// The newest backup taken before the window start is kept, so recovery to any moment of the window is possible
+		cutoff := now.Add(-time.Duration(days) * 24 * time.Hour)
+		byDays := -1
+		for i, backup := range backups {
+			if backup.Time.Before(cutoff) {
+				byDays = i
+				break
+			}
+		}
+		if byDays == -1 {
+			return "", false
+		}
+		if byDays > target {
+			target = byDays
+		}
+	}
+	if target == len(backups)-1 {
+		return "", false
+	}
+	return backups[target].Name, true
+}
@@ -0,0 +1,44 @@
+package walg
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFindRetentionTarget(t *testing.T) {
+	now := time.Date(2018, 9, 10, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	backups := []BackupTime{
+		{Name: "base_5_D_4", Time: now.Add(-1 * day)},
+		{Name: "base_4", Time: now.Add(-2 * day)},
+		{Name: "base_3_D_2", Time: now.Add(-5 * day)},
+		{Name: "base_2", Time: now.Add(-8 * day)},
+		{Name: "base_1", Time: now.Add(-10 * day)},
+	}
+	isFull := func(name string) bool {
+		return !strings.Contains(name, "_D_")
+	}
+
+	cases := []struct {
+		fullCount int
+		days      int
+		target    string
+	}{
+		{1, 0, "base_4"},
+		{2, 0, "base_2"},
+		{3, 0, ""},
+		{0, 3, "base_3_D_2"},
+		{0, 6, "base_2"},
+		{0, 9, ""},
+		{0, 30, ""},
+		{1, 3, "base_3_D_2"},
+		{2, 3, "base_2"},
+	}
+	for _, c := range cases {
+		target, found := findRetentionTarget(backups, isFull, c.fullCount, c.days, now)
+		if found != (c.target != "") || target != c.target {
+			t.Errorf("full %d, days %d: expected '%s', got '%s' %v", c.fullCount, c.days, c.target, target, found)
+		}
+	}
+}
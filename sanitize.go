@@ -0,0 +1,140 @@
+package walg
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx"
+	"github.com/pkg/errors"
+)
+
+// sanitizePort is the port of temporary server, it listens only on the socket in its own directory
+const sanitizePort = 5432
+
+// ErrRecoveryNotFinished happens when temporary server does not finish recovery in WALG_SANITIZE_TIMEOUT
+var ErrRecoveryNotFinished = errors.New("recovery of restored cluster is not finished")
+
+func getPgCtl() string {
+	if pgCtl := getSetting("WALG_PG_CTL"); pgCtl != "" {
+		return pgCtl
+	}
+	return "pg_ctl"
+}
+
+func getSanitizeTimeout() (time.Duration, error) {
+	return getPgDuration("WALG_SANITIZE_TIMEOUT", time.Hour)
+}
+
+// sanitizeRecoverySettings makes temporary server recover to the fetch target, or to the end of the backup
+// when backup is chosen by name, and promote, so the hook sees consistent writable cluster
+func sanitizeRecoverySettings(cfg BackupFetchArguments) [][2]string {
+	var settings [][2]string
+	switch {
+	case cfg.targetName != "":
+		settings = append(settings, [2]string{"recovery_target_name", cfg.targetName})
+	case cfg.targetTime != nil:
+		settings = append(settings, [2]string{"recovery_target_time", cfg.targetTime.Format(time.RFC3339Nano)})
+	case cfg.targetLsn != nil:
+		settings = append(settings, [2]string{"recovery_target_lsn", FormatLsn(*cfg.targetLsn)})
+	default:
+		settings = append(settings, [2]string{"recovery_target", "immediate"})
+	}
+	return append(settings, [2]string{"recovery_target_action", "promote"})
+}
+
+// SanitizeRestoredCluster starts temporary server on the restored cluster, waits until it recovers and
+// is promoted, runs WALG_POST_FETCH_SQL and WALG_POST_FETCH_COMMAND against it and stops it. Temporary
+// server does not archive WAL and does not listen on TCP, so sanitized cluster never reaches the storage
+// or clients before the hook is done.
+func SanitizeRestoredCluster(dirArc string, backupName string, cfg BackupFetchArguments) error {
+	timeout, err := getSanitizeTimeout()
+	if err != nil {
+		return err
+	}
+	if err = writeRecoveryConf(dirArc, sanitizeRecoverySettings(cfg)); err != nil {
+		return err
+	}
+	socketDir, err := createTempDir("walg-sanitize")
+	if err != nil {
+		return errors.Wrap(err, "SanitizeRestoredCluster: unable to create socket directory")
+	}
+	defer os.RemoveAll(socketDir)
+
+	infoln("Starting temporary server to sanitize restored cluster")
+	err = runPgCtl(dirArc, "start", "-w", "-t", strconv.Itoa(int(timeout/time.Second)), "-l", filepath.Join(dirArc, "walg-sanitize.log"),
+		"-o", fmt.Sprintf("-p %d -c listen_addresses='' -c unix_socket_directories='%s' -c archive_mode=off -c hot_standby=on",
+			sanitizePort, socketDir))
+	if err != nil {
+		return errors.Wrap(err, "SanitizeRestoredCluster: unable to start temporary server")
+	}
+	defer func() {
+		if stopErr := runPgCtl(dirArc, "stop", "-w", "-m", "fast"); stopErr != nil {
+			log.Printf("WARNING! Unable to stop temporary server: %v\n", stopErr)
+		}
+	}()
+
+	conn, err := awaitPromotion(socketDir, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return GetBackupHook(PostFetchHook).Run(conn, "WALG_RESTORE_DIRECTORY="+dirArc, "WALG_BACKUP_NAME="+backupName,
+		"PGHOST="+socketDir, "PGPORT="+strconv.Itoa(sanitizePort))
+}
+
+func runPgCtl(dirArc string, args ...string) error {
+	cmd := exec.Command(getPgCtl(), append([]string{"-D", dirArc}, args...)...)
+	cmd.Env = settingsEnviron()
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// awaitPromotion connects to temporary server and waits until recovery is finished
+func awaitPromotion(socketDir string, timeout time.Duration) (*pgx.Conn, error) {
+	config, err := GetPgConnConfig()
+	if err != nil {
+		return nil, err
+	}
+	config.Host = socketDir
+	config.Port = sanitizePort
+	config.TLSConfig = nil
+	config.UseFallbackTLS = false
+
+	deadline := time.Now().Add(timeout)
+	var conn *pgx.Conn
+	for {
+		if conn == nil {
+			conn, err = pgx.Connect(config)
+		}
+		if err == nil {
+			var inRecovery bool
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			err = conn.QueryRowEx(ctx, "SELECT pg_is_in_recovery()", nil).Scan(&inRecovery)
+			cancel()
+			if err == nil && !inRecovery {
+				return conn, nil
+			}
+		}
+		if !time.Now().Before(deadline) {
+			if conn != nil {
+				conn.Close()
+			}
+			if err != nil {
+				return nil, errors.Wrapf(err, "awaitPromotion: temporary server is not available in %v", timeout)
+			}
+			return nil, errors.Wrapf(ErrRecoveryNotFinished, "awaitPromotion: in %v", timeout)
+		}
+		if err != nil && conn != nil {
+			conn.Close()
+			conn = nil
+		}
+		time.Sleep(time.Second)
+	}
+}
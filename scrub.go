@@ -0,0 +1,310 @@
+package walg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+// ScrubUsage is a text message explaining how to use scrub
+var ScrubUsage = "usage:\twal-g scrub [--budget bytes_per_hour] [--duration duration]" + `
+	--budget: limit read throughput, suffixes K, M, G and T are allowed, e.g. 50G; unlimited by default
+	--duration: stop after given time, e.g. 6h; scrub continues from least recently verified objects next time
+Downloads, decrypts and decompresses backups and WAL files verifying their checksums.
+`
+
+// scrubStateSaveInterval is number of verified objects after which progress is saved
+const scrubStateSaveInterval = 100
+
+// ErrCorruptObjects happens when scrub found objects failing verification
+var ErrCorruptObjects = errors.New("corrupt objects found")
+
+// ScrubArguments holds limits of wal-g scrub
+type ScrubArguments struct {
+	budget   int64
+	duration time.Duration
+}
+
+// ScrubState maps object keys to time of their last successful verification.
+// It is kept in storage, so scrub can be continued from any host.
+type ScrubState map[string]time.Time
+
+func printScrubUsageAndFail() {
+	log.Fatal(ScrubUsage)
+}
+
+// ParseByteSize parses size in bytes with optional K, M, G or T binary suffix
+func ParseByteSize(size string) (int64, error) {
+	multiplier := int64(1)
+	trimmed := strings.TrimSuffix(strings.ToUpper(size), "B")
+	for i, suffix := range []string{"K", "M", "G", "T"} {
+		if strings.HasSuffix(trimmed, suffix) {
+			multiplier = int64(1) << (10 * uint(i+1))
+			trimmed = strings.TrimSuffix(trimmed, suffix)
+			break
+		}
+	}
+	value, err := strconv.ParseInt(trimmed, 10, 64)
+	if err != nil || value < 0 {
+		return 0, errors.Errorf("ParseByteSize: unable to parse size '%s'", size)
+	}
+	return value * multiplier, nil
+}
+
+// ParseScrubArguments interprets arguments for scrub command. In case of any error it calls fallBackFunc
+func ParseScrubArguments(args []string, fallBackFunc func()) (result ScrubArguments) {
+	params := args[1:]
+	for i := 0; i < len(params); i += 2 {
+		if i+1 >= len(params) {
+			fallBackFunc()
+			return
+		}
+		var err error
+		switch strings.TrimLeft(params[i], "-") {
+		case "budget":
+			result.budget, err = ParseByteSize(params[i+1])
+		case "duration":
+			result.duration, err = time.ParseDuration(params[i+1])
+		default:
+			err = errors.Errorf("unknown argument %s", params[i])
+		}
+		if err != nil {
+			log.Println(err)
+			fallBackFunc()
+			return
+		}
+	}
+	return
+}
+
+// byteRateLimiter sleeps to keep average throughput under the rate, it may be shared by goroutines
+type byteRateLimiter struct {
+	sync.Mutex
+	bytesPerSecond float64
+	start          time.Time
+	consumed       int64
+}
+
+func (l *byteRateLimiter) wait(n int) {
+	l.Lock()
+	l.consumed += int64(n)
+	consumed := l.consumed
+	l.Unlock()
+	if l.bytesPerSecond <= 0 {
+		return
+	}
+	expected := time.Duration(float64(consumed) / l.bytesPerSecond * float64(time.Second))
+	if elapsed := time.Since(l.start); elapsed < expected {
+		time.Sleep(expected - elapsed)
+	}
+}
+
+type throttledReader struct {
+	internal io.Reader
+	limiter  *byteRateLimiter
+}
+
+func (r *throttledReader) Read(p []byte) (n int, err error) {
+	n, err = r.internal.Read(p)
+	r.limiter.wait(n)
+	return
+}
+
+func getScrubStateKey(pre *Prefix) string {
+	return sanitizePath(*pre.Server + "/wal-g-scrub-state.json")
+}
+
+// HandleScrub is invoked to perform wal-g scrub
+func HandleScrub(tu *TarUploader, pre *Prefix, args []string) {
+	arguments := ParseScrubArguments(args, printScrubUsageAndFail)
+	err := scrub(tu, pre, arguments)
+	if err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+}
+
+func scrub(tu *TarUploader, pre *Prefix, arguments ScrubArguments) error {
+	state, err := fetchScrubState(pre)
+	if err != nil {
+		return err
+	}
+	objects, err := listScrubObjects(pre)
+	if err != nil {
+		return err
+	}
+	state.forgetMissing(objects)
+	keys := state.order(objects)
+
+	limiter := &byteRateLimiter{bytesPerSecond: float64(arguments.budget) / 3600, start: time.Now()}
+	corrupt := 0
+	verified := 0
+	for _, key := range keys {
+		if arguments.duration > 0 && time.Since(limiter.start) > arguments.duration {
+			fmt.Println("Scrub duration is exceeded")
+			break
+		}
+		err := scrubObject(pre, key, limiter)
+		if err != nil {
+			corrupt++
+			log.Printf("CORRUPT %s: %v\n", key, err)
+			continue
+		}
+		state[key] = time.Now().UTC()
+		verified++
+		if verified%scrubStateSaveInterval == 0 {
+			if err = saveScrubState(tu, pre, state); err != nil {
+				return err
+			}
+		}
+	}
+	if err = saveScrubState(tu, pre, state); err != nil {
+		return err
+	}
+
+	fmt.Printf("Verified %d of %d objects, %d corrupt, %d bytes read\n", verified, len(keys), corrupt, limiter.consumed)
+	if corrupt > 0 {
+		return errors.Wrapf(ErrCorruptObjects, "scrub: %d objects failed verification", corrupt)
+	}
+	return nil
+}
+
+// listScrubObjects lists keys of backup and WAL objects in the prefix
+func listScrubObjects(pre *Prefix) ([]string, error) {
+	keys := make([]string, 0)
+	for _, folder := range []string{*GetBackupPath(pre), GetWalFolderPath(pre)} {
+		objects := &s3.ListObjectsV2Input{
+			Bucket: pre.Bucket,
+			Prefix: aws.String(folder),
+		}
+		err := listObjectsV2Pages(pre.Svc, objects, func(files *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, ob := range files.Contents {
+				keys = append(keys, *ob.Key)
+			}
+			return true
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "listScrubObjects: s3.ListObjectsV2 failed")
+		}
+	}
+	return keys, nil
+}
+
+// forgetMissing removes deleted objects from the state
+func (state ScrubState) forgetMissing(keys []string) {
+	present := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		present[key] = true
+	}
+	for key := range state {
+		if !present[key] {
+			delete(state, key)
+		}
+	}
+}
+
+// order sorts keys so that never verified objects come first, then least recently verified
+func (state ScrubState) order(keys []string) []string {
+	sorted := append([]string(nil), keys...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return state[sorted[i]].Before(state[sorted[j]])
+	})
+	return sorted
+}
+
+func fetchScrubState(pre *Prefix) (ScrubState, error) {
+	state := make(ScrubState)
+	key := getScrubStateKey(pre)
+	a := &Archive{Prefix: pre, Archive: aws.String(key)}
+	exists, err := a.CheckExistence()
+	if err != nil {
+		return nil, errors.Wrap(err, "fetchScrubState: unable to check state existence")
+	}
+	if !exists {
+		return state, nil
+	}
+	reader, err := a.GetArchive()
+	if err != nil {
+		return nil, errors.Wrap(err, "fetchScrubState: unable to download state")
+	}
+	defer reader.Close()
+	err = json.NewDecoder(reader).Decode(&state)
+	if err != nil {
+		return nil, errors.Wrapf(err, "fetchScrubState: unable to parse %s", key)
+	}
+	return state, nil
+}
+
+func saveScrubState(tu *TarUploader, pre *Prefix, state ScrubState) error {
+	content, err := json.Marshal(state)
+	if err != nil {
+		return errors.Wrap(err, "saveScrubState: unable to marshal state")
+	}
+	key := getScrubStateKey(pre)
+	return tu.upload(tu.createUploadInput(key, bytes.NewReader(content)), key)
+}
+
+// scrubObject reads object through decryption and decompression and compares SHA256 stored in metadata
+func scrubObject(pre *Prefix, key string, limiter *byteRateLimiter) error {
+	body, metadata, err := downloadObjectWithMetadata(pre.Svc, pre.Bucket, key)
+	if err != nil {
+		return errors.Wrap(err, "scrubObject: download failed")
+	}
+	defer body.Close()
+
+	hashReader := newSha256Reader(&throttledReader{body, limiter})
+	err = validateObjectContent(hashReader, key, aws.StringValue(metadata[EncryptedMetadataKey]) == "true")
+	if err != nil {
+		return err
+	}
+	// decompressors may stop before the end of stream
+	if _, err = io.Copy(ioutil.Discard, hashReader); err != nil {
+		return errors.Wrap(err, "scrubObject: download failed")
+	}
+
+	expected := aws.StringValue(metadata[ChecksumMetadataKey])
+	if expected != "" && expected != hashReader.Sum() {
+		return errors.Wrapf(ErrChecksumMismatch, "scrubObject: sha256 is '%s', expected '%s'", hashReader.Sum(), expected)
+	}
+	return nil
+}
+
+// validateObjectContent checks that sentinels are valid JSON and compressed objects can be decrypted and decompressed.
+// Sentinels uploaded with WALG_ENCRYPT_METADATA are decrypted as readSentinelObject does.
+func validateObjectContent(reader io.Reader, key string, encrypted bool) error {
+	if strings.HasSuffix(key, ".json") {
+		if encrypted {
+			content, err := ioutil.ReadAll(reader)
+			if err != nil {
+				return errors.Wrap(err, "validateObjectContent: download failed")
+			}
+			if content, err = decryptMetadata(content); err != nil {
+				return errors.Wrap(err, "validateObjectContent: decryption failed")
+			}
+			reader = bytes.NewReader(content)
+		}
+		var sentinel json.RawMessage
+		if err := json.NewDecoder(reader).Decode(&sentinel); err != nil {
+			return errors.Wrap(err, "validateObjectContent: invalid JSON")
+		}
+		return nil
+	}
+	switch CheckType(key) {
+	case "lz4", "lzo":
+		if err := decodeObject(ioutil.Discard, ioutil.NopCloser(reader), key); err != nil {
+			return errors.Wrap(err, "validateObjectContent: decryption or decompression failed")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package walg
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/pkg/errors"
+)
+
+func TestParseByteSize(t *testing.T) {
+	for size, expected := range map[string]int64{"100": 100, "4K": 4096, "2MB": 2 << 20, "1g": 1 << 30, "1T": 1 << 40} {
+		value, err := ParseByteSize(size)
+		if err != nil || value != expected {
+			t.Errorf("ParseByteSize(%v) = %v, %v; expected %v", size, value, err, expected)
+		}
+	}
+	if _, err := ParseByteSize("much"); err == nil {
+		t.Error("ParseByteSize accepted 'much'")
+	}
+}
+
+func TestScrubStateOrder(t *testing.T) {
+	now := time.Now()
+	state := ScrubState{
+		"recent":  now,
+		"old":     now.Add(-time.Hour),
+		"deleted": now.Add(-2 * time.Hour),
+	}
+	keys := []string{"recent", "new", "old"}
+	state.forgetMissing(keys)
+	if _, ok := state["deleted"]; ok {
+		t.Error("deleted object was not removed from scrub state")
+	}
+	if order := state.order(keys); !reflect.DeepEqual(order, []string{"new", "old", "recent"}) {
+		t.Errorf("unexpected scrub order %v", order)
+	}
+}
+
+func TestScrubEncryptedSentinel(t *testing.T) {
+	content := []byte("encrypted sentinel")
+	svc := &sentinelS3{content: content, metadata: map[string]*string{
+		ChecksumMetadataKey:  aws.String(sha256Hex(content)),
+		EncryptedMetadataKey: aws.String("true"),
+	}}
+	pre := &Prefix{Svc: svc, Bucket: aws.String("bucket"), Server: aws.String("server")}
+
+	// Encrypted sentinel is decrypted before it is parsed, not reported as invalid JSON
+	err := scrubObject(pre, "server/basebackups_005/base_backup_stop_sentinel.json", &byteRateLimiter{})
+	if errors.Cause(err) != ErrMetadataKeyMissing {
+		t.Fatalf("expected missing key error, got %v", err)
+	}
+}
@@ -0,0 +1,133 @@
+package walg
+
+import (
+	"log"
+	"time"
+
+	"github.com/jackc/pgx"
+)
+
+// ServerStatus is WAL position and cumulative checkpoint counters of the server
+type ServerStatus struct {
+	WalLsn            uint64
+	Checkpoints       int64
+	CheckpointBuffers int64
+	InRecovery        bool
+}
+
+// ServerProgress is the server state reported with backup progress, counters are relative to the backup start
+type ServerProgress struct {
+	WalLsn            string `json:"wal_lsn"`
+	WalSinceStart     uint64 `json:"wal_since_start"`
+	Checkpoints       int64  `json:"checkpoints"`
+	CheckpointBuffers int64  `json:"checkpoint_buffers"`
+	InRecovery        bool   `json:"in_recovery,omitempty"`
+}
+
+// ServerMonitor periodically reads server state over its own connection while backup runs, so operators
+// can correlate backup pressure with WAL generation and checkpoints. The connection holding the backup
+// is not used, it is kept idle by PgKeepAlive.
+type ServerMonitor struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+func getServerMonitorInterval() (time.Duration, error) {
+	return getPgDuration("WALG_SERVER_MONITOR_INTERVAL", time.Minute)
+}
+
+// StartServerMonitor reports server state every WALG_SERVER_MONITOR_INTERVAL. Failures are only logged,
+// backup does not depend on monitoring.
+func StartServerMonitor(startLsn uint64) *ServerMonitor {
+	monitor := &ServerMonitor{stop: make(chan struct{}), done: make(chan struct{})}
+	interval, err := getServerMonitorInterval()
+	if err != nil || interval == 0 {
+		if err != nil {
+			log.Printf("WARNING! Server monitoring is disabled: %v\n", err)
+		}
+		close(monitor.done)
+		return monitor
+	}
+	queryRunner, err := connectServerMonitor()
+	if err != nil {
+		log.Printf("WARNING! Server monitoring is disabled: %v\n", err)
+		close(monitor.done)
+		return monitor
+	}
+	start, err := queryRunner.GetServerStatus()
+	if err != nil {
+		log.Printf("WARNING! Server monitoring is disabled: %v\n", err)
+		queryRunner.connection.Close()
+		close(monitor.done)
+		return monitor
+	}
+	start.WalLsn = startLsn
+
+	go func() {
+		defer close(monitor.done)
+		defer queryRunner.connection.Close()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-monitor.stop:
+				return
+			case <-ticker.C:
+				status, err := queryRunner.GetServerStatus()
+				if err != nil {
+					log.Printf("WARNING! Server status query failed: %v\n", err)
+					continue
+				}
+				reportServerProgress(getServerProgress(start, status))
+			}
+		}
+	}()
+	return monitor
+}
+
+func connectServerMonitor() (*PgQueryRunner, error) {
+	config, err := GetPgConnConfig()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := pgx.Connect(config)
+	if err != nil {
+		return nil, err
+	}
+	queryRunner, err := NewPgQueryRunner(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return queryRunner, nil
+}
+
+// getServerProgress compares server status with the status at backup start
+func getServerProgress(start, current ServerStatus) ServerProgress {
+	progress := ServerProgress{
+		WalLsn:            FormatLsn(current.WalLsn),
+		Checkpoints:       current.Checkpoints - start.Checkpoints,
+		CheckpointBuffers: current.CheckpointBuffers - start.CheckpointBuffers,
+		InRecovery:        current.InRecovery,
+	}
+	if current.WalLsn > start.WalLsn {
+		progress.WalSinceStart = current.WalLsn - start.WalLsn
+	}
+	return progress
+}
+
+func reportServerProgress(progress ServerProgress) {
+	infof("Server: WAL at %s, %d bytes since backup start, %d checkpoints writing %d buffers\n",
+		progress.WalLsn, progress.WalSinceStart, progress.Checkpoints, progress.CheckpointBuffers)
+	EmitEvent(Event{Event: EventProgress, Server: &progress})
+}
+
+// Stop stops monitoring and closes the monitoring connection
+func (monitor *ServerMonitor) Stop() {
+	select {
+	case <-monitor.done:
+	default:
+		close(monitor.stop)
+		<-monitor.done
+	}
+}
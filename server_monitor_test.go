@@ -0,0 +1,17 @@
+package walg
+
+import "testing"
+
+func TestGetServerProgress(t *testing.T) {
+	start := ServerStatus{WalLsn: 0x2000028, Checkpoints: 10, CheckpointBuffers: 1000}
+	progress := getServerProgress(start, ServerStatus{WalLsn: 0x3000000, Checkpoints: 12, CheckpointBuffers: 1500})
+	if progress.WalLsn != "0/3000000" || progress.WalSinceStart != 0xFFFFD8 || progress.Checkpoints != 2 || progress.CheckpointBuffers != 500 {
+		t.Errorf("getServerProgress: unexpected %+v", progress)
+	}
+
+	// Standby may report replay LSN behind the backup start
+	progress = getServerProgress(start, ServerStatus{WalLsn: 0x1000000, Checkpoints: 10, CheckpointBuffers: 1000, InRecovery: true})
+	if progress.WalSinceStart != 0 || !progress.InRecovery {
+		t.Errorf("getServerProgress: unexpected standby progress %+v", progress)
+	}
+}
@@ -0,0 +1,88 @@
+package walg
+
+import (
+	"os"
+	"sort"
+	"sync"
+)
+
+// settingOverrides replace environment variables with the same names, they are set by programs embedding WAL-G
+var settingOverrides = struct {
+	sync.RWMutex
+	values map[string]string
+}{values: make(map[string]string)}
+
+// SetSettings overrides environment variables read by WAL-G, e.g. WALE_S3_PREFIX or WALG_COMPRESSION_METHOD.
+// Settings are global for the process, like environment variables they replace.
+func SetSettings(settings map[string]string) {
+	settingOverrides.Lock()
+	defer settingOverrides.Unlock()
+	settingOverrides.values = make(map[string]string, len(settings))
+	for name, value := range settings {
+		settingOverrides.values[name] = value
+	}
+}
+
+// lookupSetting reads setting overridden by SetSettings or environment variable
+func lookupSetting(name string) (string, bool) {
+	settingOverrides.RLock()
+	value, ok := settingOverrides.values[name]
+	settingOverrides.RUnlock()
+	if ok {
+		return value, true
+	}
+	return os.LookupEnv(name)
+}
+
+// getSetting reads setting like os.Getenv, empty string is returned for absent setting
+func getSetting(name string) string {
+	value, _ := lookupSetting(name)
+	return value
+}
+
+// isSettingOverridden tells if setting is given by SetSettings rather than environment
+func isSettingOverridden(name string) bool {
+	settingOverrides.RLock()
+	defer settingOverrides.RUnlock()
+	_, ok := settingOverrides.values[name]
+	return ok
+}
+
+// settingsEnviron is the environment of child processes, overridden settings are passed to them as variables
+func settingsEnviron() []string {
+	settingOverrides.RLock()
+	defer settingOverrides.RUnlock()
+	env := os.Environ()
+	names := make([]string, 0, len(settingOverrides.values))
+	for name := range settingOverrides.values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		env = append(env, name+"="+settingOverrides.values[name])
+	}
+	return env
+}
+
+// withSettings runs action with settings temporarily overridden, e.g. to configure another prefix.
+// Previous overrides are restored afterwards.
+func withSettings(settings map[string]string, action func() error) error {
+	settingOverrides.Lock()
+	previous := settingOverrides.values
+	values := make(map[string]string, len(previous)+len(settings))
+	for name, value := range previous {
+		values[name] = value
+	}
+	for name, value := range settings {
+		values[name] = value
+	}
+	settingOverrides.values = values
+	settingOverrides.Unlock()
+
+	defer func() {
+		settingOverrides.Lock()
+		settingOverrides.values = previous
+		settingOverrides.Unlock()
+	}()
+	return action()
+}
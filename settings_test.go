@@ -0,0 +1,33 @@
+package walg
+
+import (
+	"os"
+	"testing"
+)
+
+func TestSettingsOverrideEnvironment(t *testing.T) {
+	os.Setenv("WALG_TEST_SETTING", "environment")
+	os.Setenv("WALG_TEST_OTHER_SETTING", "environment")
+	defer os.Unsetenv("WALG_TEST_SETTING")
+	defer os.Unsetenv("WALG_TEST_OTHER_SETTING")
+	SetSettings(map[string]string{"WALG_TEST_SETTING": "override", "WALG_TEST_EMPTY_SETTING": ""})
+	defer SetSettings(nil)
+
+	if value := getSetting("WALG_TEST_SETTING"); value != "override" {
+		t.Errorf("Setting is not overridden: %s", value)
+	}
+	if value := getSetting("WALG_TEST_OTHER_SETTING"); value != "environment" {
+		t.Errorf("Setting is not read from environment: %s", value)
+	}
+	if value, ok := lookupSetting("WALG_TEST_EMPTY_SETTING"); !ok || value != "" {
+		t.Errorf("Empty setting is not set: %s %v", value, ok)
+	}
+	if isSettingOverridden("WALG_TEST_OTHER_SETTING") || !isSettingOverridden("WALG_TEST_SETTING") {
+		t.Error("Wrong overridden settings")
+	}
+
+	env := settingsEnviron()
+	if env[len(env)-1] != "WALG_TEST_SETTING=override" || env[len(env)-2] != "WALG_TEST_EMPTY_SETTING=" {
+		t.Errorf("Overridden settings are not passed to child processes: %v", env[len(env)-2:])
+	}
+}
@@ -0,0 +1,145 @@
+package walg
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awsutil"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+// signV2Subresources are query parameters included in signature version 2 canonical resource
+var signV2Subresources = map[string]bool{
+	"acl": true, "cors": true, "delete": true, "lifecycle": true, "location": true, "logging": true,
+	"notification": true, "partNumber": true, "policy": true, "requestPayment": true, "tagging": true,
+	"torrent": true, "uploadId": true, "uploads": true, "versionId": true, "versioning": true,
+	"versions": true, "website": true, "response-cache-control": true, "response-content-disposition": true,
+	"response-content-encoding": true, "response-content-language": true, "response-content-type": true,
+	"response-expires": true,
+}
+
+// signV2RequestHandler signs S3 requests with signature version 2 instead of version 4
+var signV2RequestHandler = request.NamedHandler{Name: "walg.SignV2RequestHandler", Fn: signV2Request}
+
+// getSignatureVersion reads WALG_S3_SIGNATURE_VERSION, 4 by default. Version 2 is for legacy
+// S3-compatible storages which do not support version 4.
+func getSignatureVersion() (string, error) {
+	version := getSetting("WALG_S3_SIGNATURE_VERSION")
+	switch version {
+	case "":
+		return "4", nil
+	case "2", "4":
+		return version, nil
+	}
+	return "", errors.Errorf("getSignatureVersion: unsupported WALG_S3_SIGNATURE_VERSION '%s', 2 or 4 expected", version)
+}
+
+// newS3Client creates S3 client signing requests with the signature version
+func newS3Client(sess *session.Session, signatureVersion string) *s3.S3 {
+	svc := s3.New(sess)
+	svc.Handlers.Sign.PushFront(waitStorageThrottle)
+	svc.Handlers.Retry.PushBack(noteStorageThrottle)
+	svc.Handlers.Complete.PushBack(completeStorageThrottle)
+	svc.Handlers.Complete.PushBack(traceS3Request)
+	if signatureVersion == "2" {
+		svc.Handlers.Sign.RemoveByName(v4.SignRequestHandler.Name)
+		svc.Handlers.Sign.PushBackNamed(signV2RequestHandler)
+	}
+	return svc
+}
+
+func signV2Request(r *request.Request) {
+	credentials, err := r.Config.Credentials.Get()
+	if err != nil {
+		r.Error = errors.Wrap(err, "signV2Request: failed to get credentials")
+		return
+	}
+	if credentials.SessionToken != "" {
+		r.HTTPRequest.Header.Set("X-Amz-Security-Token", credentials.SessionToken)
+	}
+
+	bucket := ""
+	if values, err := awsutil.ValuesAtPath(r.Params, "Bucket"); err == nil && len(values) > 0 {
+		if value, ok := values[0].(*string); ok {
+			bucket = aws.StringValue(value)
+		}
+	}
+	virtualHost := bucket != "" && !aws.BoolValue(r.Config.S3ForcePathStyle) &&
+		strings.HasPrefix(r.HTTPRequest.URL.Host, bucket+".")
+
+	// Request is signed again on retry, so date is always renewed
+	r.HTTPRequest.Header.Del("Date")
+	signRequestV2(r.HTTPRequest, canonicalResourceV2(r.HTTPRequest.URL, bucket, virtualHost),
+		credentials.AccessKeyID, credentials.SecretAccessKey)
+}
+
+// canonicalResourceV2 is the path with bucket and signed subresources
+func canonicalResourceV2(u *url.URL, bucket string, virtualHost bool) string {
+	resource := u.EscapedPath()
+	if resource == "" {
+		resource = "/"
+	}
+	if virtualHost {
+		resource = "/" + bucket + resource
+	}
+
+	query := u.Query()
+	names := make([]string, 0)
+	for name := range query {
+		if signV2Subresources[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		if i == 0 {
+			resource += "?"
+		} else {
+			resource += "&"
+		}
+		resource += name
+		if value := query.Get(name); value != "" {
+			resource += "=" + value
+		}
+	}
+	return resource
+}
+
+// signRequestV2 sets Authorization header as described in
+// https://docs.aws.amazon.com/AmazonS3/latest/dev/RESTAuthentication.html
+func signRequestV2(r *http.Request, resource string, accessKey string, secretKey string) {
+	if r.Header.Get("Date") == "" {
+		r.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	}
+
+	amzHeaders := make([]string, 0)
+	for name, values := range r.Header {
+		name = strings.ToLower(name)
+		if !strings.HasPrefix(name, "x-amz-") || name == "x-amz-date" {
+			continue
+		}
+		trimmed := make([]string, len(values))
+		for i, value := range values {
+			trimmed[i] = strings.TrimSpace(value)
+		}
+		amzHeaders = append(amzHeaders, name+":"+strings.Join(trimmed, ",")+"\n")
+	}
+	sort.Strings(amzHeaders)
+
+	stringToSign := r.Method + "\n" + r.Header.Get("Content-MD5") + "\n" + r.Header.Get("Content-Type") + "\n" +
+		r.Header.Get("Date") + "\n" + strings.Join(amzHeaders, "") + resource
+	mac := hmac.New(sha1.New, []byte(secretKey))
+	mac.Write([]byte(stringToSign))
+	r.Header.Set("Authorization", "AWS "+accessKey+":"+base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+}
@@ -0,0 +1,68 @@
+package walg
+
+import (
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// FilesystemSnapshot is a snapshot of data directory taken by WALG_SNAPSHOT_COMMAND after backup start,
+// backup-push reads files from it instead of the live data directory
+type FilesystemSnapshot struct {
+	// Path is the directory where data directory is visible in the snapshot
+	Path     string
+	env      []string
+	released bool
+}
+
+// TakeFilesystemSnapshot runs WALG_SNAPSHOT_COMMAND, which creates a snapshot of the file system of data
+// directory, e.g. with zfs or btrfs, and prints the directory where data directory is visible in it as the
+// last line of its output. nil is returned when no command is configured.
+func TakeFilesystemSnapshot(dirArc string, backupName string) (*FilesystemSnapshot, error) {
+	command := getSetting("WALG_SNAPSHOT_COMMAND")
+	if command == "" {
+		return nil, nil
+	}
+	env := []string{"WALG_BACKUP_DIRECTORY=" + dirArc, "WALG_BACKUP_NAME=" + backupName}
+	infoln("Running snapshot command")
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Env = append(settingsEnviron(), env...)
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Wrap(err, "TakeFilesystemSnapshot: WALG_SNAPSHOT_COMMAND failed")
+	}
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	snapshot := &FilesystemSnapshot{Path: strings.TrimSpace(lines[len(lines)-1]), env: env}
+	snapshot.env = append(snapshot.env, "WALG_SNAPSHOT_PATH="+snapshot.Path)
+
+	// Backup of a wrong directory would look complete, so the snapshot must look like data directory
+	if _, err = os.Stat(filepath.Join(snapshot.Path, "PG_VERSION")); err != nil || !filepath.IsAbs(snapshot.Path) {
+		snapshot.Release()
+		return nil, errors.Errorf("TakeFilesystemSnapshot: WALG_SNAPSHOT_COMMAND printed '%s', which is not "+
+			"an absolute path of data directory in the snapshot", snapshot.Path)
+	}
+	infof("Reading data directory from snapshot %s\n", snapshot.Path)
+	return snapshot, nil
+}
+
+// Release runs WALG_SNAPSHOT_RELEASE_COMMAND to destroy the snapshot. Backup does not depend on the snapshot
+// once files are read, so failure is only logged.
+func (snapshot *FilesystemSnapshot) Release() {
+	if snapshot == nil || snapshot.released {
+		return
+	}
+	snapshot.released = true
+	command := getSetting("WALG_SNAPSHOT_RELEASE_COMMAND")
+	if command == "" {
+		return
+	}
+	infoln("Running snapshot release command")
+	if err := runHookCommand(command, snapshot.env); err != nil {
+		log.Printf("WARNING! WALG_SNAPSHOT_RELEASE_COMMAND failed, snapshot %s is left: %v\n", snapshot.Path, err)
+	}
+}
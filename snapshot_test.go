@@ -0,0 +1,56 @@
+package walg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFilesystemSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walg-snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = ioutil.WriteFile(filepath.Join(dir, "PG_VERSION"), []byte("10\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	released := filepath.Join(dir, "released")
+	SetSettings(map[string]string{
+		"WALG_SNAPSHOT_COMMAND":         "echo creating snapshot of $WALG_BACKUP_DIRECTORY; echo " + dir,
+		"WALG_SNAPSHOT_RELEASE_COMMAND": `echo "$WALG_BACKUP_NAME $WALG_SNAPSHOT_PATH" > ` + released,
+	})
+	defer SetSettings(nil)
+
+	snapshot, err := TakeFilesystemSnapshot("/var/lib/postgresql/data", "base_000000010000000000000002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.Path != dir {
+		t.Fatalf("unexpected snapshot path %s", snapshot.Path)
+	}
+	snapshot.Release()
+	snapshot.Release()
+	if content, err := ioutil.ReadFile(released); err != nil || string(content) != "base_000000010000000000000002 "+dir+"\n" {
+		t.Fatalf("snapshot is not released: %s %v", content, err)
+	}
+
+	// Snapshot without data directory is released and refused
+	os.Remove(released)
+	SetSettings(map[string]string{
+		"WALG_SNAPSHOT_COMMAND":         "echo " + filepath.Join(dir, "missing"),
+		"WALG_SNAPSHOT_RELEASE_COMMAND": "touch " + released,
+	})
+	if _, err = TakeFilesystemSnapshot("/var/lib/postgresql/data", "base_000000010000000000000002"); err == nil {
+		t.Fatal("snapshot without data directory is accepted")
+	}
+	if _, err = os.Stat(released); err != nil {
+		t.Fatal("refused snapshot is not released")
+	}
+
+	SetSettings(nil)
+	if snapshot, err = TakeFilesystemSnapshot("/var/lib/postgresql/data", "base_000000010000000000000002"); snapshot != nil || err != nil {
+		t.Fatalf("snapshot is taken without command: %v", err)
+	}
+}
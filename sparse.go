@@ -0,0 +1,115 @@
+package walg
+
+import (
+	"io"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// sparseHoleMinSize is the minimal hole recorded in the manifest, smaller holes are stored as zeroes
+const sparseHoleMinSize = 1024 * 1024
+
+// FileHole is a range of sparse file not stored in the tarball, it is recreated as a hole on fetch
+type FileHole struct {
+	Offset int64
+	Length int64
+}
+
+// useSparseFiles reads WALG_SPARSE_FILES setting. Backups with holes can not be fetched by WAL-G versions
+// not aware of them, so holes are not skipped by default.
+func useSparseFiles() bool {
+	sparseStr, ok := lookupSetting("WALG_SPARSE_FILES")
+	if !ok {
+		return false
+	}
+	sparse, err := strconv.ParseBool(sparseStr)
+	if err != nil {
+		log.Fatalf("Unable to parse WALG_SPARSE_FILES %v\n", err)
+	}
+	return sparse
+}
+
+// readSparseFile skips holes of the file, reader returns data between holes only
+func readSparseFile(file *os.File, size int64) (io.ReadCloser, []FileHole, int64) {
+	holes := findFileHoles(file, size)
+	if len(holes) == 0 {
+		return file, nil, size
+	}
+
+	readers := make([]io.Reader, 0, len(holes)+1)
+	dataSize := int64(0)
+	offset := int64(0)
+	for _, hole := range holes {
+		readers = append(readers, io.NewSectionReader(file, offset, hole.Offset-offset))
+		dataSize += hole.Offset - offset
+		offset = hole.Offset + hole.Length
+	}
+	readers = append(readers, io.NewSectionReader(file, offset, size-offset))
+	dataSize += size - offset
+	return ReadCascadeClose{io.MultiReader(readers...), file}, holes, dataSize
+}
+
+// writeSparseFile writes tar member data recreating recorded holes, all-zero pages of data become holes as well
+func writeSparseFile(file *os.File, data io.Reader, holes []FileHole) error {
+	offset := int64(0)
+	for _, hole := range holes {
+		written, err := writeSkippingZeroPages(file, io.LimitReader(data, hole.Offset-offset), offset)
+		if err != nil {
+			return err
+		}
+		if written != hole.Offset-offset {
+			return errors.Errorf("writeSparseFile: data of %s ends before hole at %d", file.Name(), hole.Offset)
+		}
+		offset = hole.Offset + hole.Length
+	}
+	written, err := writeSkippingZeroPages(file, data, offset)
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(file.Truncate(offset+written), "writeSparseFile: truncate failed")
+}
+
+// writeSkippingZeroPages writes data at offset, pages of zeroes are skipped leaving holes in the file
+func writeSkippingZeroPages(file *os.File, data io.Reader, offset int64) (int64, error) {
+	buffer := make([]byte, 8*int(BlockSize))
+	written := int64(0)
+	for {
+		n, err := io.ReadFull(data, buffer)
+		for start := 0; start < n; {
+			end := start
+			for end < n && !isZeroPage(buffer, end, n) {
+				end += int(BlockSize)
+			}
+			if end > n {
+				end = n
+			}
+			if end > start {
+				if _, writeErr := file.WriteAt(buffer[start:end], offset+written+int64(start)); writeErr != nil {
+					return written, errors.Wrap(writeErr, "writeSkippingZeroPages: write failed")
+				}
+				start = end
+			}
+			for start < n && isZeroPage(buffer, start, n) {
+				start += int(BlockSize)
+			}
+		}
+		written += int64(n)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, errors.Wrap(err, "writeSkippingZeroPages: read failed")
+		}
+	}
+}
+
+func isZeroPage(buffer []byte, start int, n int) bool {
+	end := start + int(BlockSize)
+	if end > n {
+		end = n
+	}
+	return allZero(buffer[start:end])
+}
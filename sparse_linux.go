@@ -0,0 +1,34 @@
+package walg
+
+import (
+	"io"
+	"os"
+)
+
+// lseek whence values of Linux
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// findFileHoles finds holes of sparse file with lseek SEEK_HOLE, file data is not read
+func findFileHoles(file *os.File, size int64) []FileHole {
+	defer file.Seek(0, io.SeekStart)
+	holes := make([]FileHole, 0)
+	for offset := int64(0); offset < size; {
+		holeStart, err := file.Seek(offset, seekHole)
+		if err != nil || holeStart >= size {
+			break
+		}
+		dataStart, err := file.Seek(holeStart, seekData)
+		if err != nil || dataStart > size {
+			// ENXIO means there is no data after the hole
+			dataStart = size
+		}
+		if dataStart-holeStart >= sparseHoleMinSize {
+			holes = append(holes, FileHole{holeStart, dataStart - holeStart})
+		}
+		offset = dataStart
+	}
+	return holes
+}
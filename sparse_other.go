@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package walg
+
+import "os"
+
+// findFileHoles does not detect holes where lseek SEEK_HOLE is not known to be supported
+func findFileHoles(file *os.File, size int64) []FileHole {
+	return nil
+}
@@ -0,0 +1,88 @@
+package walg
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSparseFileRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sparse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	expected := make([]byte, 4*sparseHoleMinSize)
+	copy(expected, bytes.Repeat([]byte{1}, 3*int(BlockSize)))
+	copy(expected[len(expected)-int(BlockSize):], bytes.Repeat([]byte{2}, int(BlockSize)))
+	source, err := os.Create(filepath.Join(dir, "source"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	source.Write(expected[:3*int(BlockSize)])
+	source.WriteAt(expected[len(expected)-int(BlockSize):], int64(len(expected)-int(BlockSize)))
+
+	reader, holes, size := readSparseFile(source, int64(len(expected)))
+	if len(holes) == 0 {
+		t.Skip("file system does not report holes")
+	}
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader.Close()
+	holesSize := int64(0)
+	for _, hole := range holes {
+		holesSize += hole.Length
+	}
+	if int64(len(data)) != size || size+holesSize != int64(len(expected)) {
+		t.Fatalf("read %d bytes, reported size %d, holes %v", len(data), size, holes)
+	}
+
+	target, err := os.Create(filepath.Join(dir, "target"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	if err = writeSparseFile(target, bytes.NewReader(data), holes); err != nil {
+		t.Fatal(err)
+	}
+	restored, _ := ioutil.ReadFile(target.Name())
+	if !bytes.Equal(restored, expected) {
+		t.Fatal("restored sparse file differs from source")
+	}
+}
+
+func TestWriteSparseFileZeroPages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sparse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := make([]byte, 20*int(BlockSize)+100)
+	data[int(BlockSize)+1] = 1
+	data[len(data)-1] = 3
+	holes := []FileHole{{int64(10 * int(BlockSize)), int64(5 * int(BlockSize))}}
+	expected := append(append(append([]byte{}, data[:10*int(BlockSize)]...), make([]byte, 5*int(BlockSize))...), data[10*int(BlockSize):]...)
+
+	target, err := os.Create(filepath.Join(dir, "target"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	if err = writeSparseFile(target, bytes.NewReader(data), holes); err != nil {
+		t.Fatal(err)
+	}
+	restored, _ := ioutil.ReadFile(target.Name())
+	if !bytes.Equal(restored, expected) {
+		t.Fatalf("restored file differs, %d bytes instead of %d", len(restored), len(expected))
+	}
+
+	if err = writeSparseFile(target, bytes.NewReader(data[:100]), holes); err == nil {
+		t.Fatal("data shorter than recorded holes was accepted")
+	}
+}
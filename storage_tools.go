@@ -0,0 +1,223 @@
+package walg
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+// StorageUsage is a text message explaining how to use st
+var StorageUsage = "usage:\twal-g st ls [path]                    list objects and folders under path in the prefix" + `
+	wal-g st cat path [--raw]              write decrypted and decompressed object to stdout
+	wal-g st get path file [--raw]         download decrypted and decompressed object to file
+	wal-g st put file path [--raw]         compress, encrypt and upload file, .lz4 is appended to the path
+	wal-g st rm path                       delete object
+Paths are relative to WALE_S3_PREFIX. --raw disables decryption/encryption and (de)compression.
+`
+
+func printStorageUsageAndFail() {
+	log.Fatal(StorageUsage)
+}
+
+// HandleStorageCommand is invoked to perform wal-g st subcommands
+func HandleStorageCommand(tu *TarUploader, pre *Prefix, args []string) {
+	if len(args) < 2 {
+		printStorageUsageAndFail()
+	}
+	params := args[2:]
+	raw := false
+	if len(params) > 0 && params[len(params)-1] == "--raw" {
+		raw = true
+		params = params[:len(params)-1]
+	}
+
+	var err error
+	switch args[1] {
+	case "ls":
+		path := ""
+		if len(params) > 0 {
+			path = params[0]
+		}
+		err = storageList(pre, path, os.Stdout)
+	case "cat":
+		if len(params) != 1 {
+			printStorageUsageAndFail()
+		}
+		err = storageFetch(pre, params[0], os.Stdout, raw)
+	case "get":
+		if len(params) != 2 {
+			printStorageUsageAndFail()
+		}
+		var f *os.File
+		f, err = os.Create(params[1])
+		if err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+		err = storageFetch(pre, params[0], f, raw)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	case "put":
+		if len(params) != 2 {
+			printStorageUsageAndFail()
+		}
+		err = storagePut(tu, pre, params[0], params[1], raw)
+	case "rm":
+		if len(params) != 1 {
+			printStorageUsageAndFail()
+		}
+		_, err = pre.Svc.DeleteObject(&s3.DeleteObjectInput{Bucket: pre.Bucket, Key: aws.String(storageKey(pre, params[0]))})
+	default:
+		printStorageUsageAndFail()
+	}
+
+	if err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+}
+
+// storageKey converts path relative to the prefix to object key
+func storageKey(pre *Prefix, path string) string {
+	return sanitizePath(*pre.Server + "/" + strings.TrimLeft(path, "/"))
+}
+
+func storageList(pre *Prefix, path string, output io.Writer) error {
+	prefix := storageKey(pre, path)
+	if len(prefix) > 0 && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	objects := &s3.ListObjectsV2Input{
+		Bucket:    pre.Bucket,
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	}
+
+	w := tabwriter.NewWriter(output, 0, 0, 1, ' ', 0)
+	defer w.Flush()
+	fmt.Fprintln(w, "type\tsize\tlast_modified\tname")
+
+	err := listObjectsV2Pages(pre.Svc, objects, func(files *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, folder := range files.CommonPrefixes {
+			fmt.Fprintf(w, "dir\t\t\t%v\n", strings.TrimPrefix(*folder.Prefix, prefix))
+		}
+		for _, ob := range files.Contents {
+			fmt.Fprintf(w, "obj\t%v\t%v\t%v\n", *ob.Size, ob.LastModified.Format(time.RFC3339), strings.TrimPrefix(*ob.Key, prefix))
+		}
+		return true
+	})
+	if err != nil {
+		return errors.Wrap(err, "storageList: s3.ListObjectsV2 failed")
+	}
+	return nil
+}
+
+// storageFetch downloads object and writes it through decryption and decompression pipeline
+func storageFetch(pre *Prefix, path string, output io.Writer, raw bool) error {
+	key := storageKey(pre, path)
+	reader, metadata, err := downloadObjectWithMetadata(pre.Svc, pre.Bucket, key)
+	if err != nil {
+		return errors.Wrapf(err, "storageFetch: failed to download %s", key)
+	}
+	defer reader.Close()
+
+	if raw {
+		_, err = io.Copy(output, reader)
+		return err
+	}
+	if aws.StringValue(metadata[EncryptedMetadataKey]) == "true" {
+		// Sentinel encrypted with WALG_ENCRYPT_METADATA, decrypted as readSentinelObject does
+		content, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return errors.Wrapf(err, "storageFetch: failed to download %s", key)
+		}
+		if content, err = decryptMetadata(content); err != nil {
+			return errors.Wrapf(err, "storageFetch: failed to decrypt %s", key)
+		}
+		_, err = output.Write(content)
+		return err
+	}
+	return decodeObject(output, reader, key)
+}
+
+// decodeObject decrypts compressed object if it is encrypted and decompresses it according to its extension.
+// Objects uploaded before WALE_GPG_KEY_ID was set are plaintext, so encryption is recognized by the first
+// packet of OpenPGP message.
+func decodeObject(output io.Writer, reader io.ReadCloser, key string) error {
+	objectType := CheckType(key)
+	var crypter = OpenPGPCrypter{}
+	if (objectType == "lz4" || objectType == "lzo" || objectType == "gz") && crypter.IsUsed() {
+		buffered := bufio.NewReader(reader)
+		header, err := buffered.Peek(1)
+		if err == nil && isOpenPGPMessage(header[0]) {
+			decrypted, err := crypter.Decrypt(ioutil.NopCloser(buffered))
+			if err != nil {
+				return errors.Wrap(err, "decodeObject: decrypt failed")
+			}
+			reader = ReadCascadeClose{decrypted, reader}
+		} else {
+			reader = ReadCascadeClose{buffered, reader}
+		}
+	}
+
+	var err error
+	switch objectType {
+	case "lz4":
+		_, err = DecompressLz4(output, reader)
+	case "lzo":
+		err = DecompressLzo(output, reader)
+	case "gz":
+		err = DecompressGzip(output, reader)
+	default:
+		_, err = io.Copy(output, reader)
+	}
+	return err
+}
+
+// isOpenPGPMessage tells whether the first byte of object is the tag of public key encrypted session key packet,
+// which starts messages encrypted by OpenPGPCrypter. Magic bytes of lz4, lzo and gzip are never such tags.
+func isOpenPGPMessage(tag byte) bool {
+	const publicKeyEncryptedSessionKey = 1
+	if tag&0x80 == 0 {
+		return false
+	}
+	if tag&0x40 != 0 {
+		return tag&0x3F == publicKeyEncryptedSessionKey
+	}
+	return (tag>>2)&0x0F == publicKeyEncryptedSessionKey
+}
+
+func storagePut(tu *TarUploader, pre *Prefix, file string, path string, raw bool) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return errors.Wrapf(err, "storagePut: failed to open file %s", file)
+	}
+	defer f.Close()
+
+	var reader io.Reader = f
+	key := storageKey(pre, path)
+	if !raw {
+		lz := &LzPipeWriter{
+			Input: f,
+		}
+		lz.Compress(&OpenPGPCrypter{})
+		reader = lz.Output
+		key += ".lz4"
+	}
+
+	err = tu.upload(tu.createUploadInput(key, reader), key)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Uploaded", key)
+	return nil
+}
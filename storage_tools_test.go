@@ -0,0 +1,64 @@
+package walg
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestStorageKey(t *testing.T) {
+	pre := &Prefix{Server: aws.String("server")}
+	if key := storageKey(pre, "/wal_005/000000010000000000000002.lz4"); key != "server/wal_005/000000010000000000000002.lz4" {
+		t.Errorf("storage tools: unexpected key %v", key)
+	}
+
+	pre.Server = aws.String("")
+	if key := storageKey(pre, "basebackups_005/"); key != "basebackups_005/" {
+		t.Errorf("storage tools: unexpected key %v", key)
+	}
+}
+
+func TestDecodeObject(t *testing.T) {
+	content := []byte("sentinel content")
+	lz := &LzPipeWriter{Input: bytes.NewReader(content)}
+	lz.Compress(&MockCrypter{})
+
+	var output bytes.Buffer
+	err := decodeObject(&output, ioutil.NopCloser(lz.Output), "object.lz4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(output.Bytes(), content) {
+		t.Errorf("storage tools: decoded %q instead of %q", output.Bytes(), content)
+	}
+}
+
+func TestDecodePlaintextObjectWithEncryptionConfigured(t *testing.T) {
+	SetSettings(map[string]string{"WALE_GPG_KEY_ID": "walg-test"})
+	defer SetSettings(nil)
+	content := []byte("uploaded before encryption was enabled")
+	lz := &LzPipeWriter{Input: bytes.NewReader(content)}
+	lz.Compress(&MockCrypter{})
+
+	var output bytes.Buffer
+	if err := decodeObject(&output, ioutil.NopCloser(lz.Output), "object.lz4"); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(output.Bytes(), content) {
+		t.Errorf("storage tools: decoded %q instead of %q", output.Bytes(), content)
+	}
+	output.Reset()
+	if err := decodeObject(&output, ioutil.NopCloser(bytes.NewReader([]byte(`{"LSN":1}`))), "base_backup_stop_sentinel.json"); err != nil || output.String() != `{"LSN":1}` {
+		t.Errorf("storage tools: plaintext sentinel is decoded as %q: %v", output.String(), err)
+	}
+}
+
+func TestIsOpenPGPMessage(t *testing.T) {
+	for tag, expected := range map[byte]bool{0xC1: true, 0x84: true, 0x85: true, 0x04: false, 0x89: false, 0x1F: false, '{': false, 0xC3: false} {
+		if isOpenPGPMessage(tag) != expected {
+			t.Errorf("isOpenPGPMessage(%X) is not %v", tag, expected)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package walg
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+// StorageUsageUsage is a text message explaining how to use storage-usage
+var StorageUsageUsage = "usage:\twal-g storage-usage" + `
+Prints number of objects, stored (compressed) bytes and logical (uncompressed) bytes per backup,
+per WAL timeline and in total. Logical size of backups is known for backups made by WAL-G recording it.
+`
+
+// StorageUsageItem accounts objects of one backup or one WAL timeline
+type StorageUsageItem struct {
+	Kind    string
+	Name    string
+	Objects int
+	Stored  int64
+	Logical int64
+}
+
+// HandleStorageUsage is invoked to perform wal-g storage-usage
+func HandleStorageUsage(pre *Prefix) {
+	bk := &Backup{
+		Prefix: pre,
+		Path:   GetBackupPath(pre),
+	}
+	items, err := collectStorageUsage(pre, func(name string) (int64, bool) {
+		exists, err := (&Archive{Prefix: pre, Archive: aws.String(*bk.Path + name + SentinelSuffix)}).CheckExistence()
+		if err != nil || !exists {
+			return 0, false
+		}
+		return fetchSentinel(name, bk, pre).UncompressedSize, true
+	})
+	if err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+	printStorageUsage(os.Stdout, items)
+}
+
+// collectStorageUsage lists backups and WAL. logicalSize returns uncompressed size of a backup recorded in its sentinel.
+func collectStorageUsage(pre *Prefix, logicalSize func(name string) (int64, bool)) ([]*StorageUsageItem, error) {
+	backups := make(map[string]*StorageUsageItem)
+	backupPath := *GetBackupPath(pre)
+	err := listAllObjects(pre, backupPath, func(ob *s3.Object) {
+		name := strings.SplitN(strings.TrimPrefix(*ob.Key, backupPath), "/", 2)[0]
+		name = strings.TrimSuffix(name, SentinelSuffix)
+		item, ok := backups[name]
+		if !ok {
+			item = &StorageUsageItem{Kind: "backup", Name: name}
+			backups[name] = item
+		}
+		item.Objects++
+		item.Stored += *ob.Size
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	timelines := make(map[string]*StorageUsageItem)
+	err = listAllObjects(pre, GetWalFolderPath(pre), func(ob *s3.Object) {
+		name := "other"
+		segment, isSegment := parseWalSegmentKey(*ob.Key)
+		if isSegment {
+			name = fmt.Sprintf("%08X", segment.Timeline)
+		} else if base := path.Base(*ob.Key); len(base) >= 8 && (strings.Contains(base, ".history") || strings.Contains(base, partialWalSuffix)) {
+			name = base[:8]
+		}
+		item, ok := timelines[name]
+		if !ok {
+			item = &StorageUsageItem{Kind: "timeline", Name: name}
+			timelines[name] = item
+		}
+		item.Objects++
+		item.Stored += *ob.Size
+		if isSegment {
+			item.Logical += int64(GetWalSegmentSize())
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]*StorageUsageItem, 0, len(backups)+len(timelines))
+	for _, item := range backups {
+		if size, ok := logicalSize(item.Name); ok {
+			item.Logical = size
+		}
+		items = append(items, item)
+	}
+	for _, item := range timelines {
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Kind != items[j].Kind {
+			return items[i].Kind < items[j].Kind
+		}
+		return items[i].Name < items[j].Name
+	})
+	return items, nil
+}
+
+func listAllObjects(pre *Prefix, prefix string, handler func(ob *s3.Object)) error {
+	objects := &s3.ListObjectsV2Input{
+		Bucket: pre.Bucket,
+		Prefix: aws.String(prefix),
+	}
+	err := listObjectsV2Pages(pre.Svc, objects, func(files *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, ob := range files.Contents {
+			handler(ob)
+		}
+		return true
+	})
+	return errors.Wrap(err, "listAllObjects: s3.ListObjectsV2 failed")
+}
+
+func printStorageUsage(output io.Writer, items []*StorageUsageItem) {
+	w := tabwriter.NewWriter(output, 0, 0, 1, ' ', 0)
+	defer w.Flush()
+	fmt.Fprintln(w, "kind\tname\tobjects\tstored_bytes\tlogical_bytes")
+	total := StorageUsageItem{Kind: "total"}
+	for _, item := range items {
+		logical := "-"
+		if item.Logical > 0 {
+			logical = fmt.Sprint(item.Logical)
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", item.Kind, item.Name, item.Objects, item.Stored, logical)
+		total.Objects += item.Objects
+		total.Stored += item.Stored
+		total.Logical += item.Logical
+	}
+	fmt.Fprintf(w, "%v\t\t%v\t%v\t%v\n", total.Kind, total.Objects, total.Stored, total.Logical)
+}
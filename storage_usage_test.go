@@ -0,0 +1,65 @@
+package walg
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+type listObjectsS3 struct {
+	s3iface.S3API
+	objects map[string]int64
+}
+
+func (m *listObjectsS3) ListObjectsV2Pages(input *s3.ListObjectsV2Input, callback func(*s3.ListObjectsV2Output, bool) bool) error {
+	output := &s3.ListObjectsV2Output{}
+	for key, size := range m.objects {
+		if strings.HasPrefix(key, *input.Prefix) {
+			output.Contents = append(output.Contents, &s3.Object{Key: aws.String(key), Size: aws.Int64(size), LastModified: aws.Time(time.Now())})
+		}
+	}
+	callback(output, true)
+	return nil
+}
+
+func TestCollectStorageUsage(t *testing.T) {
+	svc := &listObjectsS3{objects: map[string]int64{
+		"server/basebackups_005/base_000000010000000000000002_backup_stop_sentinel.json":         100,
+		"server/basebackups_005/base_000000010000000000000002/tar_partitions/part_001.tar.lz4":   1000,
+		"server/basebackups_005/base_000000010000000000000002/tar_partitions/pg_control.tar.lz4": 10,
+		"server/wal_005/000000010000000000000002.lz4":                                            300,
+		"server/wal_005/000000010000000000000003.lz4":                                            200,
+		"server/wal_005/00000002.history.lz4":                                                    1,
+		"server/wal_005/000000020000000000000003.lz4":                                            400,
+	}}
+	pre := &Prefix{Svc: svc, Bucket: aws.String("bucket"), Server: aws.String("server")}
+
+	items, err := collectStorageUsage(pre, func(name string) (int64, bool) { return 5000, true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 3 {
+		t.Fatalf("unexpected items %v", items)
+	}
+	expected := []StorageUsageItem{
+		{"backup", "base_000000010000000000000002", 3, 1110, 5000},
+		{"timeline", "00000001", 2, 500, 2 * int64(WalSegmentSize)},
+		{"timeline", "00000002", 2, 401, int64(WalSegmentSize)},
+	}
+	for i := range expected {
+		if *items[i] != expected[i] {
+			t.Errorf("expected %v, got %v", expected[i], *items[i])
+		}
+	}
+
+	var output bytes.Buffer
+	printStorageUsage(&output, items)
+	if !strings.Contains(output.String(), "total") {
+		t.Errorf("total is not printed:\n%v", output.String())
+	}
+}
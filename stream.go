@@ -0,0 +1,160 @@
+package walg
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/pkg/errors"
+)
+
+// StreamUsage is a text message explaining how to use stream-push, stream-fetch and stream-list
+var StreamUsage = "usage:\twal-g stream-push name      upload stdin, e.g. output of pg_dump or tar of pg_receivewal directory" + `
+	wal-g stream-fetch name [file]    write stream to file or stdout
+	wal-g stream-list                 list streams
+Streams are compressed and encrypted like backups and deleted by delete along with backups older than them.
+`
+
+// ErrStreamNotFound happens when requested stream does not exist
+var ErrStreamNotFound = errors.New("stream not found")
+
+// ErrStreamExists happens on attempt to push stream with the name of existing one
+var ErrStreamExists = errors.New("stream already exists")
+
+var streamNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*$`)
+
+func printStreamUsageAndFail() {
+	log.Fatal(StreamUsage)
+}
+
+// StreamSentinelDto describes stream
+type StreamSentinelDto struct {
+	StartTime        time.Time
+	FinishTime       time.Time
+	UncompressedSize int64
+	WalgVersion      string `json:"WalgVersion,omitempty"`
+}
+
+// GetStreamPath gets path for streams in a bucket
+func GetStreamPath(pre *Prefix) string {
+	return sanitizePath(*pre.Server + "/streams_005/")
+}
+
+func getStreamDataKey(pre *Prefix, name string) string {
+	return GetStreamPath(pre) + name + "/stream.lz4"
+}
+
+// HandleStreamPush is invoked to perform wal-g stream-push
+func HandleStreamPush(tu *TarUploader, pre *Prefix, args []string) {
+	if len(args) != 2 {
+		printStreamUsageAndFail()
+	}
+	if err := PushStream(tu, pre, args[1], os.Stdin); err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+	fmt.Fprintln(os.Stderr, "Uploaded stream", args[1])
+}
+
+// PushStream compresses, encrypts and uploads input. Stream is complete when its sentinel is uploaded.
+func PushStream(tu *TarUploader, pre *Prefix, name string, input io.Reader) error {
+	if !streamNameRegexp.MatchString(name) {
+		return errors.Errorf("PushStream: invalid stream name '%s', only letters, digits, '.', '_' and '-' are allowed, it can not start with '.'", name)
+	}
+	sentinelKey := GetStreamPath(pre) + name + SentinelSuffix
+	exists, err := (&Archive{Prefix: pre, Archive: aws.String(sentinelKey)}).CheckExistence()
+	if err != nil {
+		return err
+	}
+	if exists {
+		return errors.Wrapf(ErrStreamExists, "PushStream: %s", name)
+	}
+
+	sentinel := StreamSentinelDto{StartTime: time.Now().UTC(), WalgVersion: WalgVersion}
+	counter := &countingReader{reader: input}
+	lz := &LzPipeWriter{Input: counter}
+	lz.Compress(&OpenPGPCrypter{})
+	key := getStreamDataKey(pre, name)
+	if err = tu.upload(tu.createUploadInput(key, lz.Output), key); err != nil {
+		return errors.Wrap(err, "PushStream: upload failed")
+	}
+
+	sentinel.FinishTime = time.Now().UTC()
+	sentinel.UncompressedSize = counter.Count()
+	return errors.Wrap(uploadJSONSentinel(tu, sentinelKey, &sentinel), "PushStream: failed to upload sentinel")
+}
+
+// HandleStreamFetch is invoked to perform wal-g stream-fetch
+func HandleStreamFetch(pre *Prefix, args []string) {
+	if len(args) < 2 || len(args) > 3 {
+		printStreamUsageAndFail()
+	}
+	output := os.Stdout
+	if len(args) == 3 {
+		var err error
+		output, err = os.Create(args[2])
+		if err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+	}
+
+	err := FetchStream(pre, args[1], output)
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+}
+
+// FetchStream writes decrypted and decompressed stream to output
+func FetchStream(pre *Prefix, name string, output io.Writer) error {
+	exists, err := (&Archive{Prefix: pre, Archive: aws.String(GetStreamPath(pre) + name + SentinelSuffix)}).CheckExistence()
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errors.Wrapf(ErrStreamNotFound, "FetchStream: %s", name)
+	}
+	return fetchStreamObject(pre, getStreamDataKey(pre, name), output)
+}
+
+// HandleStreamList is invoked to perform wal-g stream-list
+func HandleStreamList(pre *Prefix) {
+	streams, err := listStreamBackups(pre, GetStreamPath(pre), SentinelSuffix)
+	if err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+	defer w.Flush()
+	fmt.Fprintln(w, "name\tlast_modified\tsize")
+	for i := len(streams) - 1; i >= 0; i-- {
+		sentinel := &StreamSentinelDto{}
+		if err = fetchJSONSentinel(pre, GetStreamPath(pre)+streams[i].Name+SentinelSuffix, sentinel); err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\n", streams[i].Name, streams[i].Time.Format(time.RFC3339), sentinel.UncompressedSize)
+	}
+}
+
+// deleteStreamsBefore deletes streams finished before the time, so streams share retention with backups
+func deleteStreamsBefore(pre *Prefix, before time.Time, dryRun bool) error {
+	streams, err := listStreamBackups(pre, GetStreamPath(pre), SentinelSuffix)
+	if err != nil {
+		return err
+	}
+	old := make([]DumpTime, 0)
+	for _, stream := range streams {
+		if stream.Time.Before(before) {
+			old = append(old, stream)
+		}
+	}
+	if len(old) == 0 {
+		return nil
+	}
+	return deleteStreamBackups(pre, GetStreamPath(pre), "stream.lz4", old, nil, dryRun)
+}
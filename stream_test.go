@@ -0,0 +1,36 @@
+package walg
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestDeleteStreamsBefore(t *testing.T) {
+	now := time.Now()
+	svc := &memoryS3{objects: map[string]time.Time{
+		"server/streams_005/old/stream.lz4":                now.Add(-48 * time.Hour),
+		"server/streams_005/old_backup_stop_sentinel.json": now.Add(-48 * time.Hour),
+		"server/streams_005/new/stream.lz4":                now,
+		"server/streams_005/new_backup_stop_sentinel.json": now,
+		"server/streams_005/partial/stream.lz4":            now.Add(-48 * time.Hour),
+	}}
+	pre := &Prefix{Svc: svc, Bucket: aws.String("bucket"), Server: aws.String("server")}
+
+	if err := deleteStreamsBefore(pre, now.Add(-time.Hour), false); err != nil {
+		t.Fatal(err)
+	}
+	keys := svc.keys()
+	if len(keys) != 3 || keys[0] != "server/streams_005/new/stream.lz4" || keys[2] != "server/streams_005/partial/stream.lz4" {
+		t.Fatalf("Unexpected objects left %v", keys)
+	}
+}
+
+func TestStreamNameValidation(t *testing.T) {
+	for _, name := range []string{"", "a/b", "..", ".hidden", "name with space"} {
+		if err := PushStream(nil, nil, name, nil); err == nil {
+			t.Fatalf("Stream name '%s' was accepted", name)
+		}
+	}
+}
@@ -2,18 +2,17 @@ package walg
 
 import (
 	"archive/tar"
-	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"path"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager/s3manageriface"
 	"github.com/pkg/errors"
 )
@@ -31,6 +30,7 @@ func init() {
 	EXCLUDE["postmaster.pid"] = Empty{}
 	EXCLUDE["postmaster.opts"] = Empty{}
 	EXCLUDE["recovery.conf"] = Empty{}
+	EXCLUDE[RestoreStateFile] = Empty{}
 
 	// DIRECTORIES
 	EXCLUDE["pg_dynshmem"] = Empty{}
@@ -65,6 +65,8 @@ type TarBundle interface {
 	CheckSizeAndEnqueueBack(tb TarBall) error
 	FinishQueue() error
 	GetFiles() *sync.Map
+	AddUncompressedSize(size int64)
+	AddTablespace(name string, target string)
 }
 
 // A Bundle represents the directory to
@@ -74,6 +76,9 @@ type TarBundle interface {
 // uploaded backups; in this case, pg_control is used as
 // the sentinel.
 type Bundle struct {
+	// uncompressedSize is updated atomically, so it is kept first for 64-bit alignment
+	uncompressedSize int64
+
 	MinSize            int64
 	Sen                *Sentinel
 	Tb                 TarBall
@@ -92,10 +97,33 @@ type Bundle struct {
 	started          bool
 
 	Files *sync.Map
+
+	// SkipUnlogged excludes forks of unlogged relations except init forks
+	SkipUnlogged      bool
+	unloggedRelations map[string]bool
+
+	tablespaces map[string]string
 }
 
 func (b *Bundle) GetFiles() *sync.Map { return b.Files }
 
+// AddTablespace records target of tablespace symlink, it is called from the walking goroutine only
+func (b *Bundle) AddTablespace(name string, target string) {
+	if b.tablespaces == nil {
+		b.tablespaces = make(map[string]string)
+	}
+	b.tablespaces[name] = target
+}
+
+// GetTablespaces returns targets of tablespace symlinks by their path in PGDATA
+func (b *Bundle) GetTablespaces() map[string]string { return b.tablespaces }
+
+// AddUncompressedSize accounts size of data packed into tarballs
+func (b *Bundle) AddUncompressedSize(size int64) { atomic.AddInt64(&b.uncompressedSize, size) }
+
+// GetUncompressedSize returns total size of data packed into tarballs
+func (b *Bundle) GetUncompressedSize() int64 { return atomic.LoadInt64(&b.uncompressedSize) }
+
 func (b *Bundle) StartQueue() {
 	if b.started {
 		panic("Trying to start already started Queue")
@@ -268,7 +296,8 @@ func (s *S3TarBall) CloseTar() error {
 	if err != nil {
 		return errors.Wrap(err, "CloseTar: failed to close underlying writer")
 	}
-	fmt.Printf("Finished writing part %d.\n", s.number)
+	infof("Finished writing part %d.\n", s.number)
+	EmitEvent(Event{Event: EventProgress, Done: int64(s.number)})
 	return nil
 }
 
@@ -289,8 +318,21 @@ type S3TarBallSentinelDto struct {
 
 	Files BackupFileList
 
-	PgVersion int
-	FinishLSN *uint64
+	PgVersion      int
+	FinishLSN      *uint64
+	WalSegmentSize uint64 `json:"WalSegmentSize,omitempty"`
+	DataChecksums  string `json:"DataChecksums,omitempty"`
+	WalgVersion    string `json:"WalgVersion,omitempty"`
+
+	UncompressedSize int64 `json:"UncompressedSize,omitempty"`
+
+	Tablespaces map[string]string `json:"Tablespaces,omitempty"`
+	ConfigFiles []string          `json:"ConfigFiles,omitempty"`
+
+	Labels map[string]string `json:"Labels,omitempty"`
+
+	// Partitions are sizes and checksums of tar partitions as stored, they are absent in older backups
+	Partitions map[string]PartitionDescription `json:"Partitions,omitempty"`
 
 	UserData interface{} `json:"UserData,omitempty"`
 }
@@ -310,6 +352,29 @@ type BackupFileDescription struct {
 	IsIncremented bool // should never be both incremented and Skipped
 	IsSkipped     bool
 	MTime         time.Time
+	SparseHoles   []FileHole `json:",omitempty"`
+	// Partition is the number of part_NNN partition holding the file, it is absent in older backups
+	Partition int `json:",omitempty"`
+}
+
+// PartitionDescription is size and SHA256 of tar partition object after compression and encryption.
+// Size of the tar before compression and the way it is compressed let plan storage and disk space of
+// restore without downloading anything, they are absent in older backups.
+type PartitionDescription struct {
+	Size      int64
+	Sha256    string
+	RawSize   int64  `json:"RawSize,omitempty"`
+	Codec     string `json:"Codec,omitempty"`
+	Encrypted bool   `json:"Encrypted,omitempty"`
+}
+
+// partition returns description of partition stored under the key, nil if it is not recorded
+func (dto *S3TarBallSentinelDto) partition(key string) *PartitionDescription {
+	description, ok := dto.Partitions[path.Base(key)]
+	if !ok {
+		return nil
+	}
+	return &description
 }
 
 // IsIncremental checks that sentinel represents delta backup
@@ -341,32 +406,22 @@ func (s *S3TarBall) Finish(sentinel *S3TarBallSentinelDto) error {
 	//If other parts are successful in uploading, upload json file.
 	if tupl.Success && sentinel != nil {
 		sentinel.UserData = GetSentinelUserData()
+		sentinel.Partitions = tupl.partitions.get()
 		dtoBody, err := json.Marshal(*sentinel)
 		if err != nil {
 			return err
 		}
-		path := tupl.server + "/basebackups_005/" + name
-		input := &s3manager.UploadInput{
-			Bucket:       aws.String(tupl.bucket),
-			Key:          aws.String(path),
-			Body:         bytes.NewReader(dtoBody),
-			StorageClass: aws.String(tupl.StorageClass),
-		}
-
-		if tupl.ServerSideEncryption != "" {
-			input.ServerSideEncryption = aws.String(tupl.ServerSideEncryption)
-
-			if tupl.SSEKMSKeyId != "" {
-				// Only aws:kms implies sseKmsKeyId, checked during validation
-				input.SSEKMSKeyId = aws.String(tupl.SSEKMSKeyId)
-			}
+		path := backupFolderPath(tupl.server) + name
+		input, err := tupl.createSentinelUploadInput(path, dtoBody)
+		if err != nil {
+			return err
 		}
 
 		tupl.wg.Add(1)
 		go func() {
 			defer tupl.wg.Done()
 
-			e := tupl.upload(input, path)
+			e := tupl.uploadVerified(input, path)
 			if e != nil {
 				log.Printf("upload: could not upload '%s'\n", path)
 				log.Fatalf("S3TarBall Finish: json failed to upload")
@@ -374,6 +429,9 @@ func (s *S3TarBall) Finish(sentinel *S3TarBallSentinelDto) error {
 		}()
 
 		tupl.Finish()
+		if err = tupl.awaitSentinel(path); err != nil {
+			return err
+		}
 	} else {
 		log.Printf("Uploaded %d compressed tar Files.\n", s.number)
 		log.Printf("Sentinel was not uploaded %v", name)
@@ -381,7 +439,7 @@ func (s *S3TarBall) Finish(sentinel *S3TarBallSentinelDto) error {
 	}
 
 	if err == nil && tupl.Success {
-		fmt.Printf("Uploaded %d compressed tar Files.\n", s.number)
+		infof("Uploaded %d compressed tar Files.\n", s.number)
 	}
 	return err
 }
@@ -420,6 +478,36 @@ type TarUploader struct {
 	server               string
 	region               string
 	wg                   *sync.WaitGroup
+	ReadBack             bool
+	EncryptMetadata      bool
+	svc                  s3iface.S3API
+	partitions           *uploadedPartitions
+	// PgVersion is the major version of the server recorded in metadata of uploaded objects
+	PgVersion string
+	// uploadSlots limits concurrent uploads to fit WALG_UPLOAD_MAX_INFLIGHT, nil means no limit
+	uploadSlots chan struct{}
+}
+
+// uploadedPartitions collects descriptions of partitions uploaded by TarUploader and its clones
+type uploadedPartitions struct {
+	sync.Mutex
+	descriptions map[string]PartitionDescription
+}
+
+func (p *uploadedPartitions) add(name string, description PartitionDescription) {
+	p.Lock()
+	defer p.Unlock()
+	p.descriptions[name] = description
+}
+
+func (p *uploadedPartitions) get() map[string]PartitionDescription {
+	p.Lock()
+	defer p.Unlock()
+	result := make(map[string]PartitionDescription, len(p.descriptions))
+	for name, description := range p.descriptions {
+		result[name] = description
+	}
+	return result
 }
 
 // NewTarUploader creates a new tar uploader without the actual
@@ -432,6 +520,8 @@ func NewTarUploader(svc s3iface.S3API, bucket, server, region string) *TarUpload
 		server:       server,
 		region:       region,
 		wg:           &sync.WaitGroup{},
+		svc:          svc,
+		partitions:   &uploadedPartitions{descriptions: make(map[string]PartitionDescription)},
 	}
 }
 
@@ -456,5 +546,11 @@ func (tu *TarUploader) Clone() *TarUploader {
 		tu.server,
 		tu.region,
 		&sync.WaitGroup{},
+		tu.ReadBack,
+		tu.EncryptMetadata,
+		tu.svc,
+		tu.partitions,
+		tu.PgVersion,
+		tu.uploadSlots,
 	}
 }
@@ -0,0 +1,105 @@
+package walg
+
+import (
+	"io"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// syslogFacilities are facility names accepted in WALG_SYSLOG_FACILITY with their codes from syslog.h
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// syslogSeverity is severity of a log message, lower is more severe
+type syslogSeverity int
+
+const (
+	syslogCrit    syslogSeverity = 2
+	syslogErr     syslogSeverity = 3
+	syslogWarning syslogSeverity = 4
+	syslogInfo    syslogSeverity = 6
+)
+
+// syslogSink sends a message with severity to syslog
+type syslogSink interface {
+	send(severity syslogSeverity, message string) error
+}
+
+// syslogLogWriter duplicates log output to syslog, severity is guessed from the message
+type syslogLogWriter struct {
+	output io.Writer
+	sink   syslogSink
+}
+
+func (writer *syslogLogWriter) Write(p []byte) (int, error) {
+	message := strings.TrimSpace(logTimestamp.ReplaceAllString(string(p), ""))
+	severity := getMessageSeverity(message)
+	if isFatalLogCall() {
+		severity = syslogCrit
+	}
+	// Lost syslog message must not fail the command, it is still written to stderr
+	writer.sink.send(severity, message)
+	return writer.output.Write(p)
+}
+
+func getMessageSeverity(message string) syslogSeverity {
+	upper := strings.ToUpper(message)
+	switch {
+	case strings.HasPrefix(upper, "FATAL") || strings.HasPrefix(upper, "ERROR"):
+		return syslogErr
+	case strings.HasPrefix(upper, "WARNING"):
+		return syslogWarning
+	default:
+		return syslogInfo
+	}
+}
+
+// ConfigureSyslog sends log messages to syslog in addition to stderr when WALG_LOG_SYSLOG is true.
+// Facility is taken from WALG_SYSLOG_FACILITY, user by default, and tag from WALG_SYSLOG_TAG, wal-g by default.
+// Unavailable syslog is reported and logging goes on to stderr only.
+func ConfigureSyslog() {
+	syslogStr, ok := lookupSetting("WALG_LOG_SYSLOG")
+	if !ok {
+		return
+	}
+	enabled, err := strconv.ParseBool(syslogStr)
+	if err != nil {
+		log.Fatalf("Unable to parse WALG_LOG_SYSLOG %v\n", err)
+	}
+	if !enabled {
+		return
+	}
+	facility, err := getSyslogFacility()
+	if err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+	tag := getSetting("WALG_SYSLOG_TAG")
+	if tag == "" {
+		tag = "wal-g"
+	}
+	sink, err := dialSyslog(facility, tag)
+	if err != nil {
+		log.Printf("WARNING! Unable to connect to syslog, logging to stderr only: %v\n", err)
+		return
+	}
+	log.SetOutput(&syslogLogWriter{output: log.Writer(), sink: sink})
+}
+
+// getSyslogFacility reads WALG_SYSLOG_FACILITY, user by default
+func getSyslogFacility() (int, error) {
+	name := strings.ToLower(getSetting("WALG_SYSLOG_FACILITY"))
+	if name == "" {
+		return syslogFacilities["user"], nil
+	}
+	facility, ok := syslogFacilities[name]
+	if !ok {
+		return 0, errors.Errorf("getSyslogFacility: unknown WALG_SYSLOG_FACILITY %s, expected e.g. daemon or local0", name)
+	}
+	return facility, nil
+}
@@ -0,0 +1,60 @@
+package walg
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"testing"
+)
+
+type recordingSyslog struct {
+	severities []syslogSeverity
+	messages   []string
+}
+
+func (sink *recordingSyslog) send(severity syslogSeverity, message string) error {
+	sink.severities = append(sink.severities, severity)
+	sink.messages = append(sink.messages, message)
+	return nil
+}
+
+func TestSyslogLogWriterSeverity(t *testing.T) {
+	sink := &recordingSyslog{}
+	var stderr bytes.Buffer
+	logger := log.New(&syslogLogWriter{output: &stderr, sink: sink}, "", log.LstdFlags)
+	logger.Println("Uploaded 3 compressed tar Files.")
+	logger.Printf("WARNING! Unable to read PG_VERSION\n")
+	logger.Println("ERROR: wal-fetch failed")
+	func() {
+		defer func() { recover() }()
+		logger.Panic("Backup does not exist.")
+	}()
+
+	expected := []syslogSeverity{syslogInfo, syslogWarning, syslogErr, syslogCrit}
+	if len(sink.severities) != len(expected) {
+		t.Fatalf("Wrong messages %v", sink.messages)
+	}
+	for i, severity := range expected {
+		if sink.severities[i] != severity {
+			t.Errorf("Wrong severity %d of '%s'", sink.severities[i], sink.messages[i])
+		}
+	}
+	if sink.messages[0] != "Uploaded 3 compressed tar Files." {
+		t.Errorf("Timestamp is not removed from syslog message '%s'", sink.messages[0])
+	}
+	if !bytes.Contains(stderr.Bytes(), []byte("Backup does not exist.")) {
+		t.Error("Messages are not written to stderr")
+	}
+}
+
+func TestGetSyslogFacility(t *testing.T) {
+	os.Setenv("WALG_SYSLOG_FACILITY", "LOCAL3")
+	defer os.Unsetenv("WALG_SYSLOG_FACILITY")
+	if facility, err := getSyslogFacility(); err != nil || facility != 19 {
+		t.Errorf("Wrong facility %d %v", facility, err)
+	}
+	os.Setenv("WALG_SYSLOG_FACILITY", "local9")
+	if _, err := getSyslogFacility(); err == nil {
+		t.Error("Unknown facility is accepted")
+	}
+}
@@ -0,0 +1,32 @@
+//go:build !windows
+// +build !windows
+
+package walg
+
+import "log/syslog"
+
+// localSyslog sends messages to local syslog daemon
+type localSyslog struct {
+	writer *syslog.Writer
+}
+
+func dialSyslog(facility int, tag string) (syslogSink, error) {
+	writer, err := syslog.New(syslog.Priority(facility<<3)|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &localSyslog{writer: writer}, nil
+}
+
+func (sink *localSyslog) send(severity syslogSeverity, message string) error {
+	switch severity {
+	case syslogCrit:
+		return sink.writer.Crit(message)
+	case syslogErr:
+		return sink.writer.Err(message)
+	case syslogWarning:
+		return sink.writer.Warning(message)
+	default:
+		return sink.writer.Info(message)
+	}
+}
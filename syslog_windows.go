@@ -0,0 +1,7 @@
+package walg
+
+import "github.com/pkg/errors"
+
+func dialSyslog(facility int, tag string) (syslogSink, error) {
+	return nil, errors.New("dialSyslog: syslog is not available on Windows")
+}
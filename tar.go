@@ -2,11 +2,9 @@ package walg
 
 import (
 	"archive/tar"
-	"fmt"
 	"github.com/pkg/errors"
 	"io"
 	"os"
-	"path"
 	"path/filepath"
 	"strings"
 )
@@ -39,18 +37,22 @@ func contains(s *[]string, e string) bool {
 
 // Interpret extracts a tar file to disk and creates needed directories.
 // Returns the first error encountered. Calls fsync after each file
-// is written successfully.
+// is written successfully, unless WALG_FSYNC is none.
 func (ti *FileTarInterpreter) Interpret(tr io.Reader, cur *tar.Header) error {
-	fmt.Println(cur.Name)
-	targetPath := path.Join(ti.NewDir, cur.Name)
+	infoln(cur.Name)
+	targetPath := filepath.Join(ti.NewDir, cur.Name)
 	// this path is only used for increment restoration
-	incrementalPath := path.Join(ti.IncrementalBaseDir, cur.Name)
+	incrementalPath := filepath.Join(ti.IncrementalBaseDir, cur.Name)
 	switch cur.Typeflag {
 	case tar.TypeReg, tar.TypeRegA:
 		fd, haveFd := ti.Sentinel.Files[cur.Name]
 
 		// If this file is incremental we use it's base version from incremental path
 		if haveFd && ti.Sentinel.IsIncremental() && fd.IsIncremented {
+			// Base file may be shared with clones made by backup-clone --hard-links
+			if err := breakHardLink(incrementalPath); err != nil {
+				return errors.Wrap(err, "Interpret: failed to copy shared base of "+targetPath)
+			}
 			err := ApplyFileIncrement(incrementalPath, tr)
 			if err != nil {
 				return errors.Wrap(err, "Interpret: failed to apply increment for "+targetPath)
@@ -61,6 +63,10 @@ func (ti *FileTarInterpreter) Interpret(tr io.Reader, cur *tar.Header) error {
 				return errors.Wrap(err, "Interpret: failed to move increment for "+targetPath)
 			}
 		} else {
+			// Truncating file shared with clones made by backup-clone --hard-links would change them too
+			if err := unlinkHardLink(targetPath); err != nil {
+				return errors.Wrap(err, "Interpret: failed to unlink shared "+targetPath)
+			}
 
 			var f *os.File
 
@@ -81,7 +87,7 @@ func (ti *FileTarInterpreter) Interpret(tr io.Reader, cur *tar.Header) error {
 				return errors.Wrapf(err, "Interpret: failed to create new file %s", targetPath)
 			}
 
-			_, err = io.Copy(f, tr)
+			err = writeSparseFile(f, tr, fd.SparseHoles)
 			if err != nil {
 				return errors.Wrap(err, "Interpret: copy failed")
 			}
@@ -91,7 +97,7 @@ func (ti *FileTarInterpreter) Interpret(tr io.Reader, cur *tar.Header) error {
 				return errors.Wrap(err, "Interpret: chmod failed")
 			}
 
-			if err = f.Sync(); err != nil {
+			if err = syncExtractedFile(f); err != nil {
 				return errors.Wrap(err, "Interpret: fsync failed")
 			}
 
@@ -112,8 +118,8 @@ func (ti *FileTarInterpreter) Interpret(tr io.Reader, cur *tar.Header) error {
 			return errors.Wrapf(err, "Interpret: failed to create hardlink %s", targetPath)
 		}
 	case tar.TypeSymlink:
-		if err := os.Symlink(cur.Name, targetPath); err != nil {
-			return errors.Wrapf(err, "Interpret: failed to create symlink", targetPath)
+		if err := os.Symlink(cur.Linkname, targetPath); err != nil {
+			return errors.Wrapf(err, "Interpret: failed to create symlink %s", targetPath)
 		}
 	}
 	return nil
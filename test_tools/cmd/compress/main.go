@@ -3,6 +3,7 @@ package main
 import (
 	"flag"
 	"fmt"
+	"github.com/jackc/pgx"
 	"github.com/wal-g/wal-g"
 	"github.com/wal-g/wal-g/test_tools"
 	"log"
@@ -39,6 +40,7 @@ func main() {
 	bundle := &walg.Bundle{
 		MinSize: int64(part),
 	}
+	var conn *pgx.Conn
 
 	if nop {
 		bundle.Tbm = &tools.NOPTarBallMaker{
@@ -82,6 +84,7 @@ func main() {
 		if err != nil {
 			panic(err)
 		}
+		conn = c
 
 		n, _, _, err := bundle.StartBackup(c, time.Now().String())
 		if err != nil {
@@ -96,9 +99,6 @@ func main() {
 			Tu:       tu,
 		}
 
-		bundle.NewTarBall(false)
-		bundle.HandleLabelFiles(c)
-
 	}
 
 	bundle.StartQueue()
@@ -112,6 +112,11 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	if conn != nil {
+		if _, err = bundle.HandleMetadataFiles(conn); err != nil {
+			panic(err)
+		}
+	}
 	err = bundle.Tb.Finish(&walg.S3TarBallSentinelDto{})
 	if err != nil {
 		panic(err)
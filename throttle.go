@@ -0,0 +1,149 @@
+package walg
+
+import (
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/awsutil"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+const (
+	minThrottleBackoff = time.Second
+	maxThrottleBackoff = time.Minute
+)
+
+// storageThrottle is backoff shared by all requests to storage. When storage responds with SlowDown or
+// RequestLimitExceeded every worker pauses, instead of each request retrying on its own and amplifying the throttle.
+var storageThrottle struct {
+	sync.Mutex
+	pausedUntil time.Time
+	backoff     time.Duration
+	relaxAfter  time.Time
+	throttled   int64
+}
+
+// StorageThrottledRequests returns number of requests throttled by storage since the process started
+func StorageThrottledRequests() int64 {
+	storageThrottle.Lock()
+	defer storageThrottle.Unlock()
+	return storageThrottle.throttled
+}
+
+// isStorageThrottled tells whether storage rejected the request because of request rate
+func isStorageThrottled(r *request.Request) bool {
+	if r.Error == nil {
+		return false
+	}
+	if aerr, ok := r.Error.(awserr.Error); ok && aerr.Code() == "SlowDown" {
+		return true
+	}
+	if request.IsErrorThrottle(r.Error) {
+		return true
+	}
+	// Responses to HEAD requests have no body with error code
+	return r.HTTPResponse != nil && r.HTTPResponse.StatusCode == http.StatusServiceUnavailable
+}
+
+// throttleStorage counts throttled request and pauses all requests unless they are paused already.
+// Backoff doubles with every pause and is jittered, so workers do not resume at once. Returns the pause started.
+func throttleStorage(now time.Time) time.Duration {
+	storageThrottle.Lock()
+	defer storageThrottle.Unlock()
+	storageThrottle.throttled++
+	if now.Before(storageThrottle.pausedUntil) {
+		// Requests sent before the pause are rejected during it, they do not prolong it
+		return 0
+	}
+	storageThrottle.backoff *= 2
+	if storageThrottle.backoff < minThrottleBackoff {
+		storageThrottle.backoff = minThrottleBackoff
+	}
+	if storageThrottle.backoff > maxThrottleBackoff {
+		storageThrottle.backoff = maxThrottleBackoff
+	}
+	half := storageThrottle.backoff / 2
+	pause := half + time.Duration(rand.Int63n(int64(half)+1))
+	storageThrottle.pausedUntil = now.Add(pause)
+	return pause
+}
+
+// storageThrottleWait returns how long request has to wait for the pause to end, the wait is jittered
+func storageThrottleWait(now time.Time) time.Duration {
+	storageThrottle.Lock()
+	defer storageThrottle.Unlock()
+	if !now.Before(storageThrottle.pausedUntil) {
+		return 0
+	}
+	jitter := time.Duration(rand.Int63n(int64(storageThrottle.backoff/4) + 1))
+	return storageThrottle.pausedUntil.Sub(now) + jitter
+}
+
+// relaxStorageThrottle halves backoff when requests succeed after the pause, once per backoff interval
+func relaxStorageThrottle(now time.Time) {
+	storageThrottle.Lock()
+	defer storageThrottle.Unlock()
+	if storageThrottle.backoff == 0 || now.Before(storageThrottle.pausedUntil) || now.Before(storageThrottle.relaxAfter) {
+		return
+	}
+	storageThrottle.relaxAfter = now.Add(storageThrottle.backoff)
+	storageThrottle.backoff /= 2
+	if storageThrottle.backoff < minThrottleBackoff {
+		storageThrottle.backoff = 0
+	}
+}
+
+// noteStorageThrottle is Retry handler of S3 client starting the shared pause on throttling responses
+func noteStorageThrottle(r *request.Request) {
+	if !isStorageThrottled(r) {
+		return
+	}
+	key := ""
+	if values, err := awsutil.ValuesAtPath(r.Params, "Key"); err == nil && len(values) > 0 {
+		if value, ok := values[0].(*string); ok {
+			key = aws.StringValue(value)
+		}
+	}
+	if pause := throttleStorage(time.Now()); pause > 0 {
+		log.Printf("WARNING! Storage is throttling requests (%s %s), pausing all requests for %v\n",
+			r.Operation.Name, key, pause.Round(time.Millisecond))
+	}
+	EmitEvent(Event{Event: EventThrottled, Object: key, Done: StorageThrottledRequests()})
+}
+
+// waitStorageThrottle is Sign handler of S3 client holding requests while storage is throttling
+func waitStorageThrottle(r *request.Request) {
+	wait := storageThrottleWait(time.Now())
+	if wait <= 0 {
+		return
+	}
+	if err := aws.SleepWithContext(r.Context(), wait); err != nil {
+		r.Error = awserr.New(request.CanceledErrorCode, "request context canceled", err)
+	}
+}
+
+// completeStorageThrottle is Complete handler of S3 client relaxing backoff on successful requests
+func completeStorageThrottle(r *request.Request) {
+	if r.Error == nil {
+		relaxStorageThrottle(time.Now())
+	}
+}
+
+// storageRetryer retries throttled requests without delay of its own, they wait for the shared pause
+// in waitStorageThrottle. Other failures are retried as by the default retryer.
+type storageRetryer struct {
+	client.DefaultRetryer
+}
+
+func (retryer storageRetryer) RetryRules(r *request.Request) time.Duration {
+	if isStorageThrottled(r) {
+		return 0
+	}
+	return retryer.DefaultRetryer.RetryRules(r)
+}
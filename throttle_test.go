@@ -0,0 +1,109 @@
+package walg
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func resetStorageThrottle() {
+	storageThrottle.Lock()
+	defer storageThrottle.Unlock()
+	storageThrottle.pausedUntil = time.Time{}
+	storageThrottle.backoff = 0
+	storageThrottle.relaxAfter = time.Time{}
+	storageThrottle.throttled = 0
+}
+
+func TestStorageThrottleBackoff(t *testing.T) {
+	resetStorageThrottle()
+	defer resetStorageThrottle()
+	now := time.Now()
+
+	pause := throttleStorage(now)
+	if pause < minThrottleBackoff/2 || pause > minThrottleBackoff {
+		t.Errorf("throttle: first pause %v is out of [%v, %v]", pause, minThrottleBackoff/2, minThrottleBackoff)
+	}
+	if wait := storageThrottleWait(now); wait < pause {
+		t.Errorf("throttle: request waits %v, less than pause %v", wait, pause)
+	}
+	if throttleStorage(now.Add(pause/2)) != 0 {
+		t.Error("throttle: response during pause prolonged it")
+	}
+	if StorageThrottledRequests() != 2 {
+		t.Errorf("throttle: counted %d throttled requests, expected 2", StorageThrottledRequests())
+	}
+
+	now = now.Add(pause)
+	if wait := storageThrottleWait(now); wait != 0 {
+		t.Errorf("throttle: request waits %v after pause", wait)
+	}
+	second := throttleStorage(now)
+	if second < minThrottleBackoff {
+		t.Errorf("throttle: backoff did not grow, second pause is %v", second)
+	}
+
+	now = now.Add(second)
+	relaxStorageThrottle(now)
+	relaxStorageThrottle(now)
+	if storageThrottle.backoff != minThrottleBackoff {
+		t.Errorf("throttle: backoff relaxed to %v, expected %v", storageThrottle.backoff, minThrottleBackoff)
+	}
+	relaxStorageThrottle(now.Add(minThrottleBackoff * 2))
+	if storageThrottle.backoff != 0 {
+		t.Errorf("throttle: backoff %v is not reset", storageThrottle.backoff)
+	}
+}
+
+func TestStorageThrottleSlowDown(t *testing.T) {
+	resetStorageThrottle()
+	defer resetStorageThrottle()
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("<Error><Code>SlowDown</Code><Message>Please reduce your request rate.</Message></Error>"))
+			return
+		}
+		w.Write([]byte("content"))
+	}))
+	defer server.Close()
+
+	sess, err := session.NewSession(&aws.Config{
+		Region:           aws.String("us-east-1"),
+		Endpoint:         aws.String(server.URL),
+		S3ForcePathStyle: aws.Bool(true),
+		Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+		Retryer:          storageRetryer{client.DefaultRetryer{NumMaxRetries: 3}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := newS3Client(sess, "4")
+
+	started := time.Now()
+	output, err := svc.GetObject(&s3.GetObjectInput{Bucket: aws.String("bucket"), Key: aws.String("key")})
+	if err != nil {
+		t.Fatalf("throttle: request was not retried after SlowDown: %v", err)
+	}
+	content, _ := ioutil.ReadAll(output.Body)
+	output.Body.Close()
+	if string(content) != "content" {
+		t.Errorf("throttle: unexpected content %q", content)
+	}
+	if elapsed := time.Since(started); elapsed < minThrottleBackoff/2 {
+		t.Errorf("throttle: retry was sent after %v, before the pause ended", elapsed)
+	}
+	if StorageThrottledRequests() != 1 {
+		t.Errorf("throttle: counted %d throttled requests, expected 1", StorageThrottledRequests())
+	}
+}
@@ -1,9 +1,13 @@
 package walg
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"github.com/jackc/pgx"
+	"io"
+	"log"
+	"os"
 	"strconv"
 	"strings"
 )
@@ -13,8 +17,8 @@ func readTimeline(conn *pgx.Conn) (timeline uint32, err error) {
 
 	// TODO: Check if this logic can be moved to queryRunner or abstracted away somehow
 	err = conn.QueryRow("select timeline_id, bytes_per_wal_segment from pg_control_checkpoint(), pg_control_init()").Scan(&timeline, &bytesPerWalSegment)
-	if err == nil && uint64(bytesPerWalSegment) != WalSegmentSize {
-		return 0, errors.New("bytes_per_wal_segment of the server does not match expected value")
+	if err == nil {
+		err = SetWalSegmentSize(uint64(bytesPerWalSegment))
 	}
 	return
 }
@@ -38,14 +42,91 @@ func ParseLsn(lsnStr string) (lsn uint64, err error) {
 	return
 }
 
+// FormatLsn converts LSN to PostgreSQL string representation like 2/E5000028
+func FormatLsn(lsn uint64) string {
+	return fmt.Sprintf("%X/%X", lsn>>sizeofInt32bits, lsn&0xFFFFFFFF)
+}
+
 const (
-	// WalSegmentSize is the size of one WAL file
+	// WalSegmentSize is the default size of one WAL file
 	WalSegmentSize = uint64(16 * 1024 * 1024) // xlog.c line 113ß
 
-	walFileFormat         = "%08X%08X%08X"               // xlog_internal.h line 155
-	xLogSegmentsPerXLogId = 0x100000000 / WalSegmentSize // xlog_internal.h line 101
+	minWalSegmentSize = uint64(1024 * 1024)        // xlog_internal.h WalSegMinSize
+	maxWalSegmentSize = uint64(1024 * 1024 * 1024) // xlog_internal.h WalSegMaxSize
+
+	walFileFormat = "%08X%08X%08X" // xlog_internal.h line 155
+
+	xlpLongHeader         = 0x0002 // xlog_internal.h XLP_LONG_HEADER
+	xlogLongPageHeaderLen = 40     // sizeof(XLogLongPageHeaderData)
 )
 
+// walSegmentSize is WAL file size of the cluster, PostgreSQL 11+ can be initialized with sizes other than 16MB
+var walSegmentSize = WalSegmentSize
+
+// GetWalSegmentSize returns WAL file size used in WAL file name and LSN arithmetic
+func GetWalSegmentSize() uint64 {
+	return walSegmentSize
+}
+
+// SetWalSegmentSize sets WAL file size detected from the server, WAL file or WALG_WAL_SEGMENT_SIZE
+func SetWalSegmentSize(size uint64) error {
+	if size < minWalSegmentSize || size > maxWalSegmentSize || size&(size-1) != 0 {
+		return errors.New("WAL segment size must be a power of two between 1MB and 1GB, got " + strconv.FormatUint(size, 10))
+	}
+	walSegmentSize = size
+	return nil
+}
+
+func xLogSegmentsPerXLogId() uint64 {
+	return 0x100000000 / walSegmentSize // xlog_internal.h line 101
+}
+
+// readWalSegmentSize reads segment size from long header of the first page of WAL file
+func readWalSegmentSize(reader io.Reader) (uint64, error) {
+	header := make([]byte, xlogLongPageHeaderLen)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return 0, err
+	}
+	if binary.LittleEndian.Uint16(header[2:4])&xlpLongHeader == 0 {
+		return 0, errors.New("WAL file does not start with long page header")
+	}
+	return uint64(binary.LittleEndian.Uint32(header[32:36])), nil
+}
+
+// detectWalSegmentSize sets WAL segment size from WAL file, sizes configured otherwise are kept if file is unreadable
+func detectWalSegmentSize(location string) {
+	file, err := os.Open(location)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	size, err := readWalSegmentSize(file)
+	if err == nil {
+		err = SetWalSegmentSize(size)
+	}
+	if err != nil {
+		log.Printf("WARNING! Unable to detect WAL segment size from %v: %v\n", location, err)
+	}
+}
+
+// checkWalFileSize verifies that size of WAL file matches segment size recorded in its header
+func checkWalFileSize(location string, size int64) error {
+	file, err := os.Open(location)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	segmentSize, err := readWalSegmentSize(file)
+	if err != nil {
+		return err
+	}
+	if uint64(size) != segmentSize {
+		return errors.New("WAL file size " + strconv.FormatInt(size, 10) + " does not match segment size " +
+			strconv.FormatUint(segmentSize, 10))
+	}
+	return nil
+}
+
 // WALFileName formats WAL file name using PostgreSQL connection. Essentially reads timeline of the server.
 func WALFileName(lsn uint64, conn *pgx.Conn) (string, uint32, error) {
 	timeline, err := readTimeline(conn)
@@ -53,13 +134,13 @@ func WALFileName(lsn uint64, conn *pgx.Conn) (string, uint32, error) {
 		return "", 0, err
 	}
 
-	logSegNo := (lsn - uint64(1)) / WalSegmentSize // xlog_internal.h line 121
+	logSegNo := (lsn - uint64(1)) / walSegmentSize // xlog_internal.h line 121
 
 	return formatWALFileName(timeline, logSegNo), timeline, nil
 }
 
 func formatWALFileName(timeline uint32, logSegNo uint64) string {
-	return fmt.Sprintf(walFileFormat, timeline, logSegNo/xLogSegmentsPerXLogId, logSegNo%xLogSegmentsPerXLogId)
+	return fmt.Sprintf(walFileFormat, timeline, logSegNo/xLogSegmentsPerXLogId(), logSegNo%xLogSegmentsPerXLogId())
 }
 
 // ParseWALFileName extracts numeric parts from WAL file name
@@ -84,12 +165,12 @@ func ParseWALFileName(name string) (timelineId uint32, logSegNo uint64, err erro
 		err = err0
 		return
 	}
-	if logSegNoLo >= xLogSegmentsPerXLogId {
+	if logSegNoLo >= xLogSegmentsPerXLogId() {
 		err = errors.New("Incorrect logSegNoLo in WAL file name: " + name)
 		return
 	}
 
-	logSegNo = logSegNoHi*xLogSegmentsPerXLogId + logSegNoLo
+	logSegNo = logSegNoHi*xLogSegmentsPerXLogId() + logSegNoLo
 	return
 }
 
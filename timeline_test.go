@@ -1,6 +1,10 @@
 package walg
 
-import "testing"
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
 
 func TestLSNParse(t *testing.T) {
 	lsn, err := ParseLsn("2/E5000028")
@@ -58,3 +62,98 @@ func TestPrefetchLocation(t *testing.T) {
 		t.Fatal("TestPrefetchLocation failed")
 	}
 }
+
+func TestParseWalSegmentKey(t *testing.T) {
+	segment, ok := parseWalSegmentKey("server/wal_005/00000002000000000000000A.lz4")
+	if !ok || segment != (WalSegmentNo{2, 10}) {
+		t.Fatal("WAL segment key was not parsed correctly")
+	}
+	for _, key := range []string{
+		"server/wal_005/00000002.history.lz4",
+		"server/wal_005/000000010000000000000002.00000028.backup.lz4",
+		"server/wal_005/000000010000000000000002.partial.lz4",
+	} {
+		if _, ok := parseWalSegmentKey(key); ok {
+			t.Fatalf("%v is not a WAL segment", key)
+		}
+	}
+}
+
+func TestFindWalGaps(t *testing.T) {
+	segments := []WalSegmentNo{{1, 1}, {1, 2}, {1, 3}, {1, 5}, {1, 6}, {2, 6}, {2, 7}, {2, 9}}
+
+	gaps := FindWalGaps(segments, WalSegmentNo{1, 2})
+	if len(gaps) != 2 || gaps[0] != (WalSegmentNo{1, 4}) || gaps[1] != (WalSegmentNo{2, 8}) {
+		t.Fatalf("Unexpected gaps %v", gaps)
+	}
+
+	gaps = FindWalGaps(segments, WalSegmentNo{1, 5})
+	if len(gaps) != 1 || gaps[0] != (WalSegmentNo{2, 8}) {
+		t.Fatalf("Unexpected gaps %v", gaps)
+	}
+
+	gaps = FindWalGaps(segments, WalSegmentNo{1, 10})
+	if len(gaps) != 1 || gaps[0] != (WalSegmentNo{1, 10}) {
+		t.Fatalf("Start segment of backup must be archived, got gaps %v", gaps)
+	}
+}
+
+func TestFormatLsn(t *testing.T) {
+	if lsn := FormatLsn(0x2E5000028); lsn != "2/E5000028" {
+		t.Fatalf("LSN was formatted as %v", lsn)
+	}
+}
+
+func TestNonDefaultWalSegmentSize(t *testing.T) {
+	defer SetWalSegmentSize(WalSegmentSize)
+	if err := SetWalSegmentSize(3 * 1024 * 1024); err == nil {
+		t.Fatal("segment size which is not a power of two was accepted")
+	}
+	if err := SetWalSegmentSize(64 * 1024 * 1024); err != nil {
+		t.Fatal(err)
+	}
+
+	nextname, err := NextWALFileName("00000001000000010000003F")
+	if err != nil || nextname != "000000010000000200000000" {
+		t.Fatalf("Unexpected next WAL file name %v %v", nextname, err)
+	}
+	if _, _, err = ParseWALFileName("000000010000000100000040"); err == nil {
+		t.Fatal("segment number out of range for 64MB segments was accepted")
+	}
+	if name := formatWALFileName(1, (0x2E5000028-1)/GetWalSegmentSize()); name != "000000010000000200000039" {
+		t.Fatalf("Unexpected WAL file name %v", name)
+	}
+}
+
+func TestReadWalSegmentSize(t *testing.T) {
+	header := make([]byte, xlogLongPageHeaderLen)
+	binary.LittleEndian.PutUint16(header[0:2], 0xD101)
+	binary.LittleEndian.PutUint16(header[2:4], xlpLongHeader)
+	binary.LittleEndian.PutUint32(header[32:36], 32*1024*1024)
+
+	size, err := readWalSegmentSize(bytes.NewReader(header))
+	if err != nil || size != 32*1024*1024 {
+		t.Fatalf("Unexpected segment size %v %v", size, err)
+	}
+
+	binary.LittleEndian.PutUint16(header[2:4], 0)
+	if _, err = readWalSegmentSize(bytes.NewReader(header)); err == nil {
+		t.Fatal("segment size was read from short page header")
+	}
+}
+
+func TestCheckDeltaBaseWal(t *testing.T) {
+	lsn := uint64(2 * WalSegmentSize)
+	base := &S3TarBallSentinelDto{LSN: &lsn}
+	segments := []WalSegmentNo{{1, 1}, {1, 2}, {1, 3}, {1, 4}}
+
+	if err := checkDeltaBaseWal("base_000000010000000000000002", base, 1, segments); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if err := checkDeltaBaseWal("base_000000010000000000000002_D_000000010000000000000001", base, 2, segments); err == nil {
+		t.Fatal("Timeline switch is not detected")
+	}
+	if err := checkDeltaBaseWal("base_000000010000000000000002", base, 1, []WalSegmentNo{{1, 2}, {1, 4}}); err == nil {
+		t.Fatal("WAL gap is not detected")
+	}
+}
@@ -0,0 +1,78 @@
+package walg
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// getTmpDir returns WALG_TMP_DIR, directory for scratch files, e.g. on fast local volume separate from the
+// data directory. Empty directory means system temporary directory, and prefetched WAL is kept in pg_wal.
+func getTmpDir() string {
+	return getSetting("WALG_TMP_DIR")
+}
+
+// createTempDir is ioutil.TempDir in WALG_TMP_DIR, the directory is created if it does not exist
+func createTempDir(prefix string) (string, error) {
+	tmpDir := getTmpDir()
+	if tmpDir != "" {
+		if err := os.MkdirAll(tmpDir, 0755); err != nil {
+			return "", errors.Wrapf(err, "createTempDir: unable to create %s", tmpDir)
+		}
+	}
+	return ioutil.TempDir(tmpDir, prefix)
+}
+
+// getScratchLocation is the place of scratch files WAL-G keeps beside location, in WALG_TMP_DIR it is
+// location's absolute path under the directory, so clusters sharing WALG_TMP_DIR do not collide
+func getScratchLocation(location string) string {
+	tmpDir := getTmpDir()
+	if tmpDir == "" {
+		return location
+	}
+	absLocation, err := filepath.Abs(location)
+	if err != nil {
+		return location
+	}
+	return filepath.Join(tmpDir, absLocation)
+}
+
+// moveFile renames file, falling back to copying it when WALG_TMP_DIR and destination are on different
+// file systems. Copy is written beside destination and renamed, so destination never has partial content.
+func moveFile(source string, destination string) error {
+	err := os.Rename(source, destination)
+	if linkErr, ok := err.(*os.LinkError); !ok || linkErr.Err != syscall.EXDEV {
+		return err
+	}
+	if err = copyFile(source, destination+".walg-move"); err != nil {
+		os.Remove(destination + ".walg-move")
+		return err
+	}
+	if err = os.Rename(destination+".walg-move", destination); err != nil {
+		return err
+	}
+	return os.Remove(source)
+}
+
+func copyFile(source string, destination string) error {
+	input, err := os.Open(source)
+	if err != nil {
+		return errors.Wrapf(err, "copyFile: unable to open %s", source)
+	}
+	defer input.Close()
+	output, err := os.OpenFile(destination, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "copyFile: unable to create %s", destination)
+	}
+	if _, err = io.Copy(output, input); err == nil {
+		err = output.Sync()
+	}
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+	return errors.Wrapf(err, "copyFile: unable to write %s", destination)
+}
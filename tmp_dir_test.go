@@ -0,0 +1,63 @@
+package walg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPrefetchLocationsInTmpDir(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "walg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	SetSettings(map[string]string{"WALG_TMP_DIR": tmpDir})
+	defer SetSettings(nil)
+
+	prefetchLocation, runningLocation, _, _ := getPrefetchLocations("/var/lib/postgresql/10/main/pg_wal", "")
+	if prefetchLocation != filepath.Join(tmpDir, "/var/lib/postgresql/10/main/pg_wal/.wal-g/prefetch") {
+		t.Fatalf("prefetch location is not in WALG_TMP_DIR: %s", prefetchLocation)
+	}
+	// Bundled segments are prefetched from running directory of wal-prefetch
+	bundlePrefetch, bundleRunning := getBundlePrefetchLocations(filepath.Join(runningLocation, "000000010000000100000058"))
+	if bundlePrefetch != prefetchLocation || bundleRunning != runningLocation {
+		t.Fatalf("unexpected bundle prefetch locations %s %s", bundlePrefetch, bundleRunning)
+	}
+
+	dir, err := createTempDir("walg-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(dir, tmpDir) {
+		t.Fatalf("temporary directory is not in WALG_TMP_DIR: %s", dir)
+	}
+}
+
+func TestMoveFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	source, destination := filepath.Join(dir, "source"), filepath.Join(dir, "destination")
+	if err = ioutil.WriteFile(source, []byte("segment"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = moveFile(source, destination); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(source); !os.IsNotExist(err) {
+		t.Fatalf("source is not removed: %v", err)
+	}
+
+	// Copy fallback produces the same result as rename
+	if err = copyFile(destination, source); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := ioutil.ReadFile(source); err != nil || string(content) != "segment" {
+		t.Fatalf("unexpected copy %q %v", content, err)
+	}
+}
@@ -0,0 +1,303 @@
+package walg
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awsutil"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/pkg/errors"
+)
+
+const (
+	// traceBatchSize is number of finished spans sent to collector in one request
+	traceBatchSize = 512
+	traceTimeout   = 5 * time.Second
+)
+
+// span is OpenTelemetry span of an operation, methods of nil span do nothing, so code does not check if tracing
+// is enabled
+type span struct {
+	traceID    [16]byte
+	spanID     [8]byte
+	parentID   [8]byte
+	name       string
+	start      time.Time
+	attributes map[string]interface{}
+}
+
+// tracer batches finished spans and exports them to OTLP/HTTP collector as JSON
+type tracer struct {
+	mutex    sync.Mutex
+	endpoint string
+	root     *span
+	finished []otlpSpan
+	client   *http.Client
+}
+
+// activeTracer is set by StartTracing when WALG_OTLP_ENDPOINT is set
+var activeTracer struct {
+	sync.RWMutex
+	tracer *tracer
+}
+
+// spanContextKey is context key of the span, S3 requests made with the context become its children
+type spanContextKey struct{}
+
+// StartTracing starts root span of the command when WALG_OTLP_ENDPOINT is set, e.g. http://localhost:4318.
+// Returned function ends the root span and sends remaining spans.
+func StartTracing(command string) func() {
+	endpoint := getSetting("WALG_OTLP_ENDPOINT")
+	if endpoint == "" {
+		return func() {}
+	}
+	if !strings.HasSuffix(endpoint, "/v1/traces") {
+		endpoint = strings.TrimSuffix(endpoint, "/") + "/v1/traces"
+	}
+	t := &tracer{endpoint: endpoint, client: &http.Client{Timeout: traceTimeout}}
+	activeTracer.Lock()
+	activeTracer.tracer = t
+	activeTracer.Unlock()
+
+	t.root = newSpan(nil, command, nil)
+	onFatalLog(func(message string) {
+		t.root.end(errors.New(message))
+		t.flush()
+	})
+	return func() {
+		t.root.end(nil)
+		t.flush()
+	}
+}
+
+func getTracer() *tracer {
+	activeTracer.RLock()
+	defer activeTracer.RUnlock()
+	return activeTracer.tracer
+}
+
+// startSpan starts child span of parent, spans without parent are children of the root span of the command
+func startSpan(parent *span, name string, attributes map[string]interface{}) *span {
+	t := getTracer()
+	if t == nil {
+		return nil
+	}
+	if parent == nil {
+		parent = t.root
+	}
+	return newSpan(parent, name, attributes)
+}
+
+func newSpan(parent *span, name string, attributes map[string]interface{}) *span {
+	s := &span{name: name, start: time.Now(), attributes: attributes}
+	if parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	return s
+}
+
+// startQuerySpan starts span of PostgreSQL query calling the function
+func startQuerySpan(function string) *span {
+	return startSpan(nil, "postgres "+function, map[string]interface{}{"db.system": "postgresql"})
+}
+
+// spanFromContext returns span started for the context, nil if there is none
+func spanFromContext(ctx context.Context) *span {
+	if ctx == nil {
+		return nil
+	}
+	s, _ := ctx.Value(spanContextKey{}).(*span)
+	return s
+}
+
+// context returns context carrying the span
+func (s *span) context() aws.Context {
+	if s == nil {
+		return aws.BackgroundContext()
+	}
+	return context.WithValue(aws.BackgroundContext(), spanContextKey{}, s)
+}
+
+// end finishes the span, error marks it as failed
+func (s *span) end(err error) {
+	t := getTracer()
+	if s == nil || t == nil {
+		return
+	}
+	exported := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              1,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(time.Now().UnixNano(), 10),
+		Attributes:        encodeOtlpAttributes(s.attributes),
+	}
+	if s.parentID != [8]byte{} {
+		exported.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	if err != nil {
+		exported.Status = &otlpStatus{Code: 2, Message: err.Error()}
+	}
+
+	t.mutex.Lock()
+	t.finished = append(t.finished, exported)
+	full := len(t.finished) >= traceBatchSize
+	t.mutex.Unlock()
+	if full {
+		t.flush()
+	}
+}
+
+// endWith finishes the span with error pointed by err, it is deferred by functions with named error result
+func (s *span) endWith(err *error) {
+	s.end(*err)
+}
+
+// flush sends finished spans to collector, failure to send traces never fails the command
+func (t *tracer) flush() {
+	t.mutex.Lock()
+	spans := t.finished
+	t.finished = nil
+	t.mutex.Unlock()
+	if len(spans) == 0 {
+		return
+	}
+
+	var request otlpTraceRequest
+	request.ResourceSpans = []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: encodeOtlpAttributes(map[string]interface{}{
+			"service.name":    "wal-g",
+			"service.version": WalgVersion,
+		})},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "wal-g"}, Spans: spans}},
+	}}
+	payload, err := json.Marshal(request)
+	if err != nil {
+		log.Printf("WARNING! Unable to marshal traces: %v\n", err)
+		return
+	}
+	response, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		log.Printf("WARNING! Unable to send traces to %s: %v\n", t.endpoint, err)
+		return
+	}
+	response.Body.Close()
+	if response.StatusCode >= 300 {
+		log.Printf("WARNING! Collector %s responded to traces with status %s\n", t.endpoint, response.Status)
+	}
+}
+
+// traceS3Request is Complete handler of S3 client recording every request as a span, S3 requests of multipart
+// upload are children of the span of uploaded object
+func traceS3Request(r *request.Request) {
+	if getTracer() == nil {
+		return
+	}
+	attributes := map[string]interface{}{
+		"rpc.system":  "aws-api",
+		"rpc.method":  r.Operation.Name,
+		"retry_count": int64(r.RetryCount),
+	}
+	if values, err := awsutil.ValuesAtPath(r.Params, "Key"); err == nil && len(values) > 0 {
+		if key, ok := values[0].(*string); ok {
+			attributes["s3.key"] = aws.StringValue(key)
+		}
+	}
+	if values, err := awsutil.ValuesAtPath(r.Params, "PartNumber"); err == nil && len(values) > 0 {
+		if part, ok := values[0].(*int64); ok {
+			attributes["s3.part_number"] = aws.Int64Value(part)
+		}
+	}
+	if isStorageThrottled(r) {
+		attributes["throttled"] = true
+	}
+	if r.HTTPResponse != nil {
+		attributes["http.status_code"] = int64(r.HTTPResponse.StatusCode)
+	}
+	s := startSpan(spanFromContext(r.Context()), "S3 "+r.Operation.Name, attributes)
+	if s != nil {
+		s.start = r.Time
+	}
+	s.end(r.Error)
+}
+
+// otlpTraceRequest is ExportTraceServiceRequest of OTLP in JSON encoding
+type otlpTraceRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string            `json:"key"`
+	Value map[string]string `json:"value"`
+}
+
+// encodeOtlpAttributes encodes string and int64 attributes, 64-bit integers are strings in OTLP JSON
+func encodeOtlpAttributes(attributes map[string]interface{}) []otlpAttribute {
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	result := make([]otlpAttribute, 0, len(keys))
+	for _, key := range keys {
+		switch value := attributes[key].(type) {
+		case int64:
+			result = append(result, otlpAttribute{Key: key, Value: map[string]string{"intValue": strconv.FormatInt(value, 10)}})
+		default:
+			result = append(result, otlpAttribute{Key: key, Value: map[string]string{"stringValue": fmt.Sprint(value)}})
+		}
+	}
+	return result
+}
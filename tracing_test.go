@@ -0,0 +1,66 @@
+package walg
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestTracingExportsSpans(t *testing.T) {
+	requests := make(chan otlpTraceRequest, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			t.Errorf("Wrong path %s", r.URL.Path)
+		}
+		var request otlpTraceRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Error(err)
+		}
+		requests <- request
+	}))
+	defer server.Close()
+	os.Setenv("WALG_OTLP_ENDPOINT", server.URL)
+	defer os.Unsetenv("WALG_OTLP_ENDPOINT")
+
+	stop := StartTracing("backup-push")
+	defer func() {
+		activeTracer.Lock()
+		activeTracer.tracer = nil
+		activeTracer.Unlock()
+	}()
+	upload := startSpan(nil, "upload part_1.tar.lz4", map[string]interface{}{"bytes": int64(42)})
+	startSpan(spanFromContext(upload.context()), "S3 UploadPart", nil).end(errors.New("SlowDown"))
+	upload.end(nil)
+	stop()
+
+	request := <-requests
+	spans := request.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 3 {
+		t.Fatalf("Wrong number of spans %d", len(spans))
+	}
+	part, object, root := spans[0], spans[1], spans[2]
+	if root.Name != "backup-push" || root.ParentSpanID != "" || root.Status != nil {
+		t.Errorf("Wrong root span %+v", root)
+	}
+	if object.ParentSpanID != root.SpanID || object.TraceID != root.TraceID || object.Attributes[0].Value["intValue"] != "42" {
+		t.Errorf("Wrong object span %+v", object)
+	}
+	if part.ParentSpanID != object.SpanID || part.Status == nil || part.Status.Message != "SlowDown" {
+		t.Errorf("Wrong part span %+v", part)
+	}
+}
+
+func TestSpansAreNoopWithoutTracing(t *testing.T) {
+	s := startSpan(nil, "upload", nil)
+	if s != nil {
+		t.Fatal("Span is started without WALG_OTLP_ENDPOINT")
+	}
+	s.end(nil)
+	if spanFromContext(s.context()) != nil {
+		t.Error("Nil span is put into context")
+	}
+}
@@ -0,0 +1,105 @@
+package walg
+
+import (
+	"io"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/pkg/errors"
+)
+
+// Transfer moves content of one object between WAL-G and storage
+type Transfer interface {
+	// Upload stores content under the key, content is read until EOF
+	Upload(key string, content io.Reader) error
+	// Download opens content of the object, caller closes it
+	Download(key string) (io.ReadCloser, error)
+}
+
+// TransferMiddleware wraps Transfer, e.g. to collect metrics, audit keys or compute extra checksums.
+// Middleware calls next to actually move the object and may wrap the content passed to it or returned by it.
+type TransferMiddleware func(next Transfer) Transfer
+
+// transferMiddleware is applied to every upload and download, the first registered is the outermost
+var transferMiddleware struct {
+	sync.RWMutex
+	chain []TransferMiddleware
+}
+
+// UseTransferMiddleware registers middleware wrapping all uploads and downloads of objects
+func UseTransferMiddleware(middleware TransferMiddleware) {
+	transferMiddleware.Lock()
+	defer transferMiddleware.Unlock()
+	transferMiddleware.chain = append(transferMiddleware.chain, middleware)
+}
+
+// SetTransferMiddleware replaces all registered middleware, nil removes it
+func SetTransferMiddleware(chain []TransferMiddleware) {
+	transferMiddleware.Lock()
+	defer transferMiddleware.Unlock()
+	transferMiddleware.chain = append([]TransferMiddleware(nil), chain...)
+}
+
+// transferFuncs is Transfer made of functions doing storage requests
+type transferFuncs struct {
+	upload   func(key string, content io.Reader) error
+	download func(key string) (io.ReadCloser, error)
+}
+
+func (transfer transferFuncs) Upload(key string, content io.Reader) error {
+	if transfer.upload == nil {
+		return errors.Errorf("Transfer: upload of %s is not supported here", key)
+	}
+	return transfer.upload(key, content)
+}
+
+func (transfer transferFuncs) Download(key string) (io.ReadCloser, error) {
+	if transfer.download == nil {
+		return nil, errors.Errorf("Transfer: download of %s is not supported here", key)
+	}
+	return transfer.download(key)
+}
+
+// wrapTransfer applies registered middleware to storage transfer
+func wrapTransfer(transfer Transfer) Transfer {
+	transferMiddleware.RLock()
+	defer transferMiddleware.RUnlock()
+	for i := len(transferMiddleware.chain) - 1; i >= 0; i-- {
+		transfer = transferMiddleware.chain[i](transfer)
+	}
+	return transfer
+}
+
+// downloadObject opens content of the object through registered middleware
+func downloadObject(svc s3iface.S3API, bucket *string, key string) (io.ReadCloser, error) {
+	body, _, err := downloadObjectWithMetadata(svc, bucket, key)
+	return body, err
+}
+
+// downloadObjectWithMetadata is downloadObject returning user metadata of the object as well.
+// With WALG_READ_AT the version of the object current at that time is downloaded.
+func downloadObjectWithMetadata(svc s3iface.S3API, bucket *string, key string) (io.ReadCloser, map[string]*string, error) {
+	var metadata map[string]*string
+	body, err := wrapTransfer(transferFuncs{download: func(key string) (io.ReadCloser, error) {
+		input := &s3.GetObjectInput{
+			Bucket: bucket,
+			Key:    aws.String(key),
+		}
+		if readAt := getReadAt(); readAt != nil {
+			versionID, err := objectVersionIDAt(svc, bucket, key, *readAt)
+			if err != nil {
+				return nil, err
+			}
+			input.VersionId = aws.String(versionID)
+		}
+		output, err := svc.GetObject(input)
+		if err != nil {
+			return nil, err
+		}
+		metadata = output.Metadata
+		return output.Body, nil
+	}}).Download(key)
+	return body, metadata, err
+}
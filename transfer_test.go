@@ -0,0 +1,87 @@
+package walg
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// recordingTransfer notes keys passed to the next transfer
+type recordingTransfer struct {
+	next  Transfer
+	name  string
+	calls *[]string
+}
+
+func (transfer recordingTransfer) Upload(key string, content io.Reader) error {
+	*transfer.calls = append(*transfer.calls, transfer.name+" upload "+key)
+	return transfer.next.Upload(key, content)
+}
+
+func (transfer recordingTransfer) Download(key string) (io.ReadCloser, error) {
+	*transfer.calls = append(*transfer.calls, transfer.name+" download "+key)
+	return transfer.next.Download(key)
+}
+
+func TestTransferMiddlewareOrder(t *testing.T) {
+	defer SetTransferMiddleware(nil)
+	var calls []string
+	record := func(name string) TransferMiddleware {
+		return func(next Transfer) Transfer {
+			return recordingTransfer{next: next, name: name, calls: &calls}
+		}
+	}
+	UseTransferMiddleware(record("outer"))
+	UseTransferMiddleware(record("inner"))
+
+	var uploaded bytes.Buffer
+	transfer := wrapTransfer(transferFuncs{
+		upload: func(key string, content io.Reader) error {
+			_, err := io.Copy(&uploaded, content)
+			return err
+		},
+		download: func(key string) (io.ReadCloser, error) {
+			return ioutil.NopCloser(strings.NewReader("content of " + key)), nil
+		},
+	})
+
+	if err := transfer.Upload("a", strings.NewReader("payload")); err != nil {
+		t.Fatalf("transfer: upload failed: %v", err)
+	}
+	if uploaded.String() != "payload" {
+		t.Errorf("transfer: uploaded %q", uploaded.String())
+	}
+	body, err := transfer.Download("b")
+	if err != nil {
+		t.Fatalf("transfer: download failed: %v", err)
+	}
+	content, _ := ioutil.ReadAll(body)
+	if string(content) != "content of b" {
+		t.Errorf("transfer: downloaded %q", content)
+	}
+
+	expected := []string{"outer upload a", "inner upload a", "outer download b", "inner download b"}
+	if strings.Join(calls, ",") != strings.Join(expected, ",") {
+		t.Errorf("transfer: middleware called as %v, expected %v", calls, expected)
+	}
+}
+
+func TestSetTransferMiddlewareReplaces(t *testing.T) {
+	defer SetTransferMiddleware(nil)
+	var calls []string
+	middleware := func(next Transfer) Transfer {
+		return recordingTransfer{next: next, name: "config", calls: &calls}
+	}
+	UseTransferMiddleware(middleware)
+	SetTransferMiddleware([]TransferMiddleware{middleware})
+
+	transfer := wrapTransfer(transferFuncs{})
+	if err := transfer.Upload("a", strings.NewReader("")); err == nil {
+		t.Error("transfer: upload without upload function did not fail")
+	}
+	if len(calls) != 1 {
+		t.Errorf("transfer: middleware called %d times, expected once", len(calls))
+	}
+}
@@ -0,0 +1,181 @@
+package walg
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+// TrashUsage is a text message explaining how to use trash
+var TrashUsage = "usage:\twal-g trash ls                                 list objects moved to trash by delete" + `
+	wal-g trash restore path                       move objects under path (e.g. basebackups_005/base_...) back from trash
+	wal-g trash purge older_than [--confirm]      delete objects trashed more than older_than (e.g. 72h) ago
+Objects are moved to trash by delete when WALG_DELETE_TO_TRASH is set.
+`
+
+func printTrashUsageAndFail() {
+	log.Fatal(TrashUsage)
+}
+
+// deleteToTrash reads WALG_DELETE_TO_TRASH setting
+func deleteToTrash() bool {
+	trashStr, ok := lookupSetting("WALG_DELETE_TO_TRASH")
+	if !ok {
+		return false
+	}
+	trash, err := strconv.ParseBool(trashStr)
+	if err != nil {
+		log.Fatalf("Unable to parse WALG_DELETE_TO_TRASH %v\n", err)
+	}
+	return trash
+}
+
+// getTrashPath gets path where deleted objects are kept, trashed object keeps its path relative to the prefix
+func getTrashPath(pre *Prefix) string {
+	return sanitizePath(*pre.Server + "/trash/")
+}
+
+// deleteObjects deletes objects or, with WALG_DELETE_TO_TRASH, moves them to trash
+func deleteObjects(pre *Prefix, objects []*s3.ObjectIdentifier) error {
+	if deleteToTrash() {
+		serverPath := sanitizePath(*pre.Server + "/")
+		trashPath := getTrashPath(pre)
+		tasks := make([]func() (int, error), 0, len(objects))
+		for _, object := range objects {
+			key := *object.Key
+			tasks = append(tasks, func() (int, error) {
+				err := copyObject(pre, key, trashPath+strings.TrimPrefix(key, serverPath))
+				if err != nil {
+					return 0, errors.Wrapf(err, "deleteObjects: unable to move %s to trash", key)
+				}
+				return 1, nil
+			})
+		}
+		if err := runDeleteTasks("Moved to trash", len(objects), tasks); err != nil {
+			return err
+		}
+	}
+
+	return deleteObjectsPermanently(pre, objects)
+}
+
+// copyObject copies object within the bucket. Missing source is not an error, folder keys are deleted
+// along with backups though they usually do not exist.
+func copyObject(pre *Prefix, source string, destination string) error {
+	input := &s3.CopyObjectInput{
+		Bucket:     pre.Bucket,
+		Key:        aws.String(destination),
+		CopySource: aws.String((&url.URL{Path: *pre.Bucket + "/" + source}).EscapedPath()),
+	}
+	setCopyObjectOptions(input)
+	_, err := pre.Svc.CopyObject(input)
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == s3.ErrCodeNoSuchKey {
+		return nil
+	}
+	return err
+}
+
+// setCopyObjectOptions makes copy stored the way uploads are
+func setCopyObjectOptions(input *s3.CopyObjectInput) {
+	if storageClass, ok := lookupSetting("WALG_S3_STORAGE_CLASS"); ok {
+		input.StorageClass = aws.String(storageClass)
+	}
+	if sse := getSetting("WALG_S3_SSE"); sse != "" {
+		input.ServerSideEncryption = aws.String(sse)
+		if kmsKeyID := getSetting("WALG_S3_SSE_KMS_ID"); kmsKeyID != "" {
+			input.SSEKMSKeyId = aws.String(kmsKeyID)
+		}
+	}
+}
+
+// HandleTrash is invoked to perform wal-g trash subcommands
+func HandleTrash(pre *Prefix, args []string) {
+	if len(args) < 2 {
+		printTrashUsageAndFail()
+	}
+	trashPath := getTrashPath(pre)
+
+	var err error
+	switch args[1] {
+	case "ls":
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+		fmt.Fprintln(w, "trashed\tsize\tpath")
+		err = listAllObjects(pre, trashPath, func(ob *s3.Object) {
+			fmt.Fprintf(w, "%v\t%v\t%v\n", ob.LastModified.Format(time.RFC3339), *ob.Size, strings.TrimPrefix(*ob.Key, trashPath))
+		})
+		w.Flush()
+	case "restore":
+		if len(args) != 3 {
+			printTrashUsageAndFail()
+		}
+		err = restoreFromTrash(pre, strings.TrimLeft(args[2], "/"))
+	case "purge":
+		if len(args) < 3 {
+			printTrashUsageAndFail()
+		}
+		olderThan, parseErr := time.ParseDuration(args[2])
+		if parseErr != nil {
+			log.Println(parseErr)
+			printTrashUsageAndFail()
+		}
+		confirm := len(args) > 3 && args[3] == "--confirm"
+		err = purgeTrash(pre, time.Now().Add(-olderThan), !confirm)
+	default:
+		printTrashUsageAndFail()
+	}
+
+	if err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+}
+
+func restoreFromTrash(pre *Prefix, path string) error {
+	trashPath := getTrashPath(pre)
+	serverPath := sanitizePath(*pre.Server + "/")
+	objects := make([]*s3.ObjectIdentifier, 0)
+	err := listAllObjects(pre, trashPath+path, func(ob *s3.Object) {
+		objects = append(objects, &s3.ObjectIdentifier{Key: ob.Key})
+	})
+	if err != nil {
+		return err
+	}
+	if len(objects) == 0 {
+		return errors.Errorf("restoreFromTrash: nothing found in trash under %s", path)
+	}
+	for _, object := range objects {
+		destination := serverPath + strings.TrimPrefix(*object.Key, trashPath)
+		if err = copyObject(pre, *object.Key, destination); err != nil {
+			return errors.Wrapf(err, "restoreFromTrash: unable to restore %s", destination)
+		}
+		fmt.Println("Restored", destination)
+	}
+	return deleteObjectsPermanently(pre, objects)
+}
+
+func purgeTrash(pre *Prefix, before time.Time, dryRun bool) error {
+	objects := make([]*s3.ObjectIdentifier, 0)
+	err := listAllObjects(pre, getTrashPath(pre), func(ob *s3.Object) {
+		if ob.LastModified.Before(before) {
+			objects = append(objects, &s3.ObjectIdentifier{Key: ob.Key})
+		}
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d objects trashed before %v will be purged\n", len(objects), before.Format(time.RFC3339))
+	if dryRun {
+		fmt.Println("Dry run finished, add --confirm to purge")
+		return nil
+	}
+	return deleteObjectsPermanently(pre, objects)
+}
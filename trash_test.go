@@ -0,0 +1,113 @@
+package walg
+
+import (
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// memoryS3 keeps objects of one bucket with their modification time
+type memoryS3 struct {
+	s3iface.S3API
+	objects map[string]time.Time
+	mutex   sync.Mutex
+}
+
+func (m *memoryS3) ListObjectsV2Pages(input *s3.ListObjectsV2Input, callback func(*s3.ListObjectsV2Output, bool) bool) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	output := &s3.ListObjectsV2Output{}
+	for key, modified := range m.objects {
+		if strings.HasPrefix(key, *input.Prefix) {
+			output.Contents = append(output.Contents, &s3.Object{Key: aws.String(key), Size: aws.Int64(1), LastModified: aws.Time(modified)})
+		}
+	}
+	callback(output, true)
+	return nil
+}
+
+func (m *memoryS3) CopyObject(input *s3.CopyObjectInput) (*s3.CopyObjectOutput, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	source, _ := url.PathUnescape(*input.CopySource)
+	source = strings.TrimPrefix(source, *input.Bucket+"/")
+	if _, ok := m.objects[source]; !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "no such key", nil)
+	}
+	m.objects[*input.Key] = time.Now()
+	return &s3.CopyObjectOutput{}, nil
+}
+
+func (m *memoryS3) DeleteObjects(input *s3.DeleteObjectsInput) (*s3.DeleteObjectsOutput, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, object := range input.Delete.Objects {
+		delete(m.objects, *object.Key)
+	}
+	return &s3.DeleteObjectsOutput{}, nil
+}
+
+func (m *memoryS3) keys() []string {
+	keys := make([]string, 0, len(m.objects))
+	for key := range m.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestDeleteToTrashAndRestore(t *testing.T) {
+	os.Setenv("WALG_DELETE_TO_TRASH", "true")
+	defer os.Unsetenv("WALG_DELETE_TO_TRASH")
+
+	svc := &memoryS3{objects: map[string]time.Time{
+		"server/basebackups_005/base_000000010000000000000002_backup_stop_sentinel.json":       time.Now(),
+		"server/basebackups_005/base_000000010000000000000002/tar_partitions/part_001.tar.lz4": time.Now(),
+	}}
+	pre := &Prefix{Svc: svc, Bucket: aws.String("bucket"), Server: aws.String("server")}
+
+	keys := append(svc.keys(), "server/basebackups_005/base_000000010000000000000002")
+	if err := deleteObjects(pre, partitionToObjects(keys)); err != nil {
+		t.Fatal(err)
+	}
+	trashed := svc.keys()
+	if len(trashed) != 2 || !strings.HasPrefix(trashed[0], "server/trash/basebackups_005/") {
+		t.Fatalf("objects were not moved to trash: %v", trashed)
+	}
+
+	if err := restoreFromTrash(pre, "basebackups_005/base_000000010000000000000002"); err != nil {
+		t.Fatal(err)
+	}
+	restored := svc.keys()
+	if len(restored) != 2 || !strings.HasPrefix(restored[0], "server/basebackups_005/") {
+		t.Fatalf("objects were not restored from trash: %v", restored)
+	}
+}
+
+func TestPurgeTrash(t *testing.T) {
+	svc := &memoryS3{objects: map[string]time.Time{
+		"server/trash/wal_005/000000010000000000000001.lz4": time.Now().Add(-100 * time.Hour),
+		"server/trash/wal_005/000000010000000000000002.lz4": time.Now(),
+		"server/wal_005/000000010000000000000003.lz4":       time.Now().Add(-100 * time.Hour),
+	}}
+	pre := &Prefix{Svc: svc, Bucket: aws.String("bucket"), Server: aws.String("server")}
+
+	if err := purgeTrash(pre, time.Now().Add(-72*time.Hour), true); err != nil || len(svc.objects) != 3 {
+		t.Fatalf("dry run purged objects: %v %v", err, svc.keys())
+	}
+	if err := purgeTrash(pre, time.Now().Add(-72*time.Hour), false); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := svc.objects["server/trash/wal_005/000000010000000000000001.lz4"]; ok || len(svc.objects) != 2 {
+		t.Fatalf("unexpected objects after purge %v", svc.keys())
+	}
+}
@@ -0,0 +1,50 @@
+package walg
+
+import (
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"regexp"
+	"strconv"
+)
+
+// relationForkRegexp matches relation file names like 16384, 16384.1, 16384_fsm or 16384_init
+var relationForkRegexp = regexp.MustCompile(`^(\d+)(_[a-z]+)?(\.\d+)?$`)
+
+const initForkSuffix = "_init"
+
+// skipUnloggedRelations reads WALG_SKIP_UNLOGGED_RELATIONS setting
+func skipUnloggedRelations() bool {
+	skipStr, ok := lookupSetting("WALG_SKIP_UNLOGGED_RELATIONS")
+	if !ok {
+		return false
+	}
+	skip, err := strconv.ParseBool(skipStr)
+	if err != nil {
+		log.Fatalf("Unable to parse WALG_SKIP_UNLOGGED_RELATIONS %v\n", err)
+	}
+	return skip
+}
+
+// findUnloggedRelations collects relations of database directory which have init fork. PostgreSQL resets
+// such relations from init fork at the end of recovery, so their other forks are not needed in the backup.
+func findUnloggedRelations(databaseDir string) (map[string]bool, error) {
+	files, err := ioutil.ReadDir(databaseDir)
+	if err != nil {
+		return nil, err
+	}
+	unlogged := make(map[string]bool)
+	for _, file := range files {
+		match := relationForkRegexp.FindStringSubmatch(file.Name())
+		if match != nil && match[2] == initForkSuffix {
+			unlogged[filepath.Join(databaseDir, match[1])] = true
+		}
+	}
+	return unlogged, nil
+}
+
+// isUnloggedRelationData checks that file is a fork of unlogged relation other than init fork
+func isUnloggedRelationData(path string, unlogged map[string]bool) bool {
+	match := relationForkRegexp.FindStringSubmatch(filepath.Base(path))
+	return match != nil && match[2] != initForkSuffix && unlogged[filepath.Join(filepath.Dir(path), match[1])]
+}
@@ -0,0 +1,38 @@
+package walg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFindUnloggedRelations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"100", "100.1", "100_fsm", "100_vm", "100_init", "200", "200_fsm", "PG_VERSION"} {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	unlogged, err := findUnloggedRelations(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unlogged) != 1 || !unlogged[filepath.Join(dir, "100")] {
+		t.Fatalf("Unexpected unlogged relations %v", unlogged)
+	}
+
+	for name, expected := range map[string]bool{
+		"100": true, "100.1": true, "100_fsm": true, "100_vm": true, "100_init": false,
+		"200": false, "200_fsm": false, "PG_VERSION": false,
+	} {
+		if isUnloggedRelationData(filepath.Join(dir, name), unlogged) != expected {
+			t.Errorf("%v is expected to be skipped: %v", name, expected)
+		}
+	}
+}
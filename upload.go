@@ -2,16 +2,21 @@ package walg
 
 import (
 	"archive/tar"
+	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/defaults"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
@@ -27,7 +32,7 @@ import (
 var MAXRETRIES = 7
 
 // Given an S3 bucket name, attempt to determine its region
-func findS3BucketRegion(bucket string, config *aws.Config) (string, error) {
+func findS3BucketRegion(bucket string, config *aws.Config, signatureVersion string) (string, error) {
 	input := s3.GetBucketLocationInput{
 		Bucket: aws.String(bucket),
 	}
@@ -37,7 +42,7 @@ func findS3BucketRegion(bucket string, config *aws.Config) (string, error) {
 		return "", err
 	}
 
-	output, err := s3.New(sess).GetBucketLocation(&input)
+	output, err := newS3Client(sess, signatureVersion).GetBucketLocation(&input)
 	if err != nil {
 		return "", err
 	}
@@ -59,7 +64,7 @@ func findS3BucketRegion(bucket string, config *aws.Config) (string, error) {
 //
 // Able to configure the upload part size in the S3 uploader.
 func Configure() (*TarUploader, *Prefix, error) {
-	waleS3Prefix := os.Getenv("WALE_S3_PREFIX")
+	waleS3Prefix := getSetting("WALE_S3_PREFIX")
 	if waleS3Prefix == "" {
 		return nil, nil, &UnsetEnvVarError{names: []string{"WALE_S3_PREFIX"}}
 	}
@@ -88,15 +93,34 @@ func Configure() (*TarUploader, *Prefix, error) {
 	config := defaults.Get().Config
 
 	config.MaxRetries = &MAXRETRIES
+	config.Retryer = storageRetryer{client.DefaultRetryer{NumMaxRetries: MAXRETRIES}}
+	config.HTTPClient, err = newStorageHTTPClient()
+	if err != nil {
+		return nil, nil, err
+	}
+	if isSettingOverridden("AWS_ACCESS_KEY_ID") {
+		// AWS SDK reads credentials from environment only
+		config.Credentials = credentials.NewStaticCredentials(getSetting("AWS_ACCESS_KEY_ID"),
+			getSetting("AWS_SECRET_ACCESS_KEY"), getSetting("AWS_SESSION_TOKEN"))
+	}
 	if _, err := config.Credentials.Get(); err != nil {
 		return nil, nil, errors.Wrapf(err, "Configure: failed to get AWS credentials; please specify AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
 	}
 
-	if endpoint := os.Getenv("AWS_ENDPOINT"); endpoint != "" {
+	if endpoint := getSetting("AWS_ENDPOINT"); endpoint != "" {
 		config.Endpoint = aws.String(endpoint)
 	}
 
-	s3ForcePathStyleStr := os.Getenv("AWS_S3_FORCE_PATH_STYLE")
+	profile, err := getEndpointProfile()
+	if err != nil {
+		return nil, nil, err
+	}
+	if profile != nil {
+		config.S3ForcePathStyle = aws.Bool(profile.ForcePathStyle)
+		config.S3Disable100Continue = aws.Bool(profile.Disable100Continue)
+	}
+
+	s3ForcePathStyleStr := getSetting("AWS_S3_FORCE_PATH_STYLE")
 	if len(s3ForcePathStyleStr) > 0 {
 		s3ForcePathStyle, err := strconv.ParseBool(s3ForcePathStyleStr)
 		if err != nil {
@@ -105,11 +129,25 @@ func Configure() (*TarUploader, *Prefix, error) {
 		config.S3ForcePathStyle = aws.Bool(s3ForcePathStyle)
 	}
 
-	region := os.Getenv("AWS_REGION")
+	signatureVersion, err := getSignatureVersion()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	region := getSetting("AWS_REGION")
+	if region == "" && profile != nil {
+		region = profile.Region
+	}
 	if region == "" {
-		region, err = findS3BucketRegion(bucket, config)
-		if err != nil {
-			return nil, nil, errors.Wrapf(err, "Configure: AWS_REGION is not set and s3:GetBucketLocation failed")
+		endpoint := aws.StringValue(config.Endpoint)
+		var cached bool
+		region, cached = getCachedBucketRegion(bucket, endpoint)
+		if !cached {
+			region, err = findS3BucketRegion(bucket, config, signatureVersion)
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "Configure: AWS_REGION is not set and s3:GetBucketLocation failed")
+			}
+			cacheBucketRegion(bucket, endpoint, region)
 		}
 	}
 	config = config.WithRegion(region)
@@ -124,22 +162,22 @@ func Configure() (*TarUploader, *Prefix, error) {
 		return nil, nil, errors.Wrap(err, "Configure: failed to create new session")
 	}
 
-	pre.Svc = s3.New(sess)
+	pre.Svc = newS3Client(sess, signatureVersion)
 
 	upload := NewTarUploader(pre.Svc, bucket, server, region)
 
 	var con = getMaxUploadConcurrency(10)
-	storageClass, ok := os.LookupEnv("WALG_S3_STORAGE_CLASS")
+	storageClass, ok := lookupSetting("WALG_S3_STORAGE_CLASS")
 	if ok {
 		upload.StorageClass = storageClass
 	}
 
-	serverSideEncryption, ok := os.LookupEnv("WALG_S3_SSE")
+	serverSideEncryption, ok := lookupSetting("WALG_S3_SSE")
 	if ok {
 		upload.ServerSideEncryption = serverSideEncryption
 	}
 
-	sseKmsKeyId, ok := os.LookupEnv("WALG_S3_SSE_KMS_ID")
+	sseKmsKeyId, ok := lookupSetting("WALG_S3_SSE_KMS_ID")
 	if ok {
 		upload.SSEKMSKeyId = sseKmsKeyId
 	}
@@ -149,7 +187,50 @@ func Configure() (*TarUploader, *Prefix, error) {
 		return nil, nil, errors.New("Configure: WALG_S3_SSE_KMS_ID must be set iff using aws:kms encryption")
 	}
 
-	upload.Upl = CreateUploader(pre.Svc, 20*1024*1024, con) //default 10 concurrency streams at 20MB
+	readBackStr, ok := lookupSetting("WALG_UPLOAD_READ_BACK")
+	if ok {
+		upload.ReadBack, err = strconv.ParseBool(readBackStr)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "Configure: failed parse WALG_UPLOAD_READ_BACK")
+		}
+	}
+
+	if encryptMetadataStr, ok := lookupSetting("WALG_ENCRYPT_METADATA"); ok {
+		upload.EncryptMetadata, err = strconv.ParseBool(encryptMetadataStr)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "Configure: failed parse WALG_ENCRYPT_METADATA")
+		}
+		if upload.EncryptMetadata && GetKeyRingId() == "" {
+			return nil, nil, errors.Wrap(ErrMetadataKeyMissing, "Configure: WALG_ENCRYPT_METADATA is set")
+		}
+	}
+
+	if segmentSizeStr, ok := lookupSetting("WALG_WAL_SEGMENT_SIZE"); ok {
+		segmentSize, err := ParseByteSize(segmentSizeStr)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "Configure: failed parse WALG_WAL_SEGMENT_SIZE")
+		}
+		if err = SetWalSegmentSize(uint64(segmentSize)); err != nil {
+			return nil, nil, errors.Wrap(err, "Configure: invalid WALG_WAL_SEGMENT_SIZE")
+		}
+	}
+
+	if location := getInventoryLocation(); location != "" {
+		if _, _, err := parseInventoryLocation(location); err != nil {
+			return nil, nil, errors.Wrap(err, "Configure: failed parse WALG_S3_INVENTORY")
+		}
+	}
+
+	maxInflight, err := getUploadMaxInflight()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Configure: failed parse WALG_UPLOAD_MAX_INFLIGHT")
+	}
+	// Tarballs written in parallel hold their uploads until they are full, one more slot is for metadata and sentinel
+	partSize, con, uploads := fitUploadMemory(maxInflight, defaultUploadPartSize, con, getMaxUploadDiskConcurrency()+1)
+	if uploads > 0 {
+		upload.uploadSlots = make(chan struct{}, uploads)
+	}
+	upload.Upl = CreateUploader(pre.Svc, int(partSize), con) //default 10 concurrency streams at 20MB
 
 	return upload, pre, err
 }
@@ -168,10 +249,29 @@ func CreateUploader(svc s3iface.S3API, partsize, concurrency int) s3manageriface
 // occur in exponentially incremental seconds.
 func (tu *TarUploader) upload(input *s3manager.UploadInput, path string) (err error) {
 	upl := tu.Upl
-
-	_, e := upl.Upload(input)
+	tu.acquireUploadSlot()
+	defer tu.releaseUploadSlot()
+
+	var uploaded func() int64
+	input.Body, uploaded = countUploadedBytes(input.Body)
+	objectSpan := startSpan(nil, "upload "+filepath.Base(path), map[string]interface{}{"s3.key": path})
+	e := wrapTransfer(transferFuncs{upload: func(key string, content io.Reader) (err error) {
+		input.Body = content
+		if objectSpan != nil {
+			// Requests of multipart upload become children of the object span
+			_, err = upl.UploadWithContext(objectSpan.context(), input)
+		} else {
+			_, err = upl.Upload(input)
+		}
+		return err
+	}}).Upload(path, input.Body)
+	if objectSpan != nil {
+		objectSpan.attributes["bytes"] = uploaded()
+	}
+	objectSpan.end(e)
 	if e == nil {
 		tu.Success = true
+		EmitEvent(Event{Event: EventUploadedObject, Object: path, Bytes: uploaded()})
 		return nil
 	}
 
@@ -184,13 +284,14 @@ func (tu *TarUploader) upload(input *s3manager.UploadInput, path string) (err er
 }
 
 // createUploadInput creates a s3manager.UploadInput for a TarUploader using
-// the specified path and reader.
+// the specified path and reader. Object metadata records its origin.
 func (tu *TarUploader) createUploadInput(path string, reader io.Reader) *s3manager.UploadInput {
 	uploadInput := &s3manager.UploadInput{
 		Bucket:       aws.String(tu.bucket),
 		Key:          aws.String(path),
 		Body:         reader,
 		StorageClass: aws.String(tu.StorageClass),
+		Metadata:     tu.originMetadata(),
 	}
 
 	if tu.ServerSideEncryption != "" {
@@ -205,16 +306,48 @@ func (tu *TarUploader) createUploadInput(path string, reader io.Reader) *s3manag
 	return uploadInput
 }
 
+// createSentinelUploadInput creates a s3manager.UploadInput for sentinel, its SHA256 is stored in metadata
+// to be verified by readers. With WALG_ENCRYPT_METADATA sentinel is encrypted, its name and modification
+// time are still visible for listing.
+func (tu *TarUploader) createSentinelUploadInput(path string, body []byte) (*s3manager.UploadInput, error) {
+	metadata := tu.originMetadata()
+	if tu.EncryptMetadata {
+		var err error
+		body, err = encryptMetadata(body)
+		if err != nil {
+			return nil, errors.Wrapf(err, "createSentinelUploadInput: failed to encrypt %s", path)
+		}
+		metadata[EncryptedMetadataKey] = aws.String("true")
+	}
+	metadata[ChecksumMetadataKey] = aws.String(sha256Hex(body))
+	uploadInput := tu.createUploadInput(path, bytes.NewReader(body))
+	uploadInput.Metadata = metadata
+	return uploadInput, nil
+}
+
+// uploadSentinel uploads sentinel created by createSentinelUploadInput
+func (tu *TarUploader) uploadSentinel(path string, body []byte) error {
+	input, err := tu.createSentinelUploadInput(path, body)
+	if err != nil {
+		return err
+	}
+	return tu.uploadVerified(input, path)
+}
+
 // StartUpload creates a lz4 writer and runs upload in the background once
 // a compressed tar member is finished writing.
 func (s *S3TarBall) StartUpload(name string, crypter Crypter) io.WriteCloser {
 	pr, pw := io.Pipe()
 	tupl := s.tu
 
-	path := tupl.server + "/basebackups_005/" + s.bkupName + "/tar_partitions/" + name
-	input := tupl.createUploadInput(path, pr)
+	path := backupFolderPath(tupl.server) + s.bkupName + "/tar_partitions/" + name
+	// Size and checksum of the partition are recorded in sentinel and verified by backup-fetch
+	hashReader := newSha256Reader(pr)
+	input := tupl.createUploadInput(path, hashReader)
+	counter := verifiedUploadBody(input)
+	raw := &countingWriteCloser{}
 
-	fmt.Printf("Starting part %d ...\n", s.number)
+	infof("Starting part %d ...\n", s.number)
 
 	tupl.wg.Add(1)
 	go func() {
@@ -229,6 +362,20 @@ func (s *S3TarBall) StartUpload(name string, crypter Crypter) io.WriteCloser {
 			log.Printf("upload: could not upload '%s'\n", path)
 			log.Printf("FATAL%v\n", err)
 		}
+		if err == nil && counter != nil {
+			if err = tupl.verifyUploadedObject(path, counter.Count(), ""); err != nil {
+				log.Fatalf("%+v\n", err)
+			}
+		}
+		if err == nil && tupl.ReadBack {
+			if err = tupl.readBack(path, hashReader.Sum()); err != nil {
+				log.Fatalf("%+v\n", err)
+			}
+		}
+		if err == nil {
+			tupl.partitions.add(name, PartitionDescription{Size: hashReader.Size(), Sha256: hashReader.Sum(),
+				RawSize: raw.Count(), Codec: partitionCodec, Encrypted: crypter.IsUsed()})
+		}
 
 	}()
 
@@ -239,15 +386,45 @@ func (s *S3TarBall) StartUpload(name string, crypter Crypter) io.WriteCloser {
 			log.Fatal("upload: encryption error ",err)
 		}
 
-		return &Lz4CascadeClose2{lz4.NewWriter(wc), wc, pw}
+		raw.WriteCloser = &Lz4CascadeClose2{lz4.NewWriter(wc), wc, pw}
+		return raw
 	}
 
-	return &Lz4CascadeClose{lz4.NewWriter(pw), pw}
+	raw.WriteCloser = &Lz4CascadeClose{lz4.NewWriter(pw), pw}
+	return raw
+}
+
+// partitionCodec is compression of tar partitions recorded in sentinel
+const partitionCodec = "lz4"
+
+// countingWriteCloser counts bytes written to it, upload of partition reads the count once the tar is closed
+type countingWriteCloser struct {
+	io.WriteCloser
+	count int64
+}
+
+func (w *countingWriteCloser) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	atomic.AddInt64(&w.count, int64(n))
+	return n, err
+}
+
+// Count returns number of bytes written so far
+func (w *countingWriteCloser) Count() int64 {
+	return atomic.LoadInt64(&w.count)
 }
 
 // UploadWal compresses a WAL file using LZ4 and uploads to S3. Returns
 // the first error encountered and an empty string upon failure.
+// With verify compressed WAL is buffered to store its SHA256 in object metadata,
+// which is checked after upload. With WALG_UPLOAD_CHECKPOINT_DIR interrupted
+// upload is resumed by the next attempt.
 func (tu *TarUploader) UploadWal(path string, pre *Prefix, verify bool) (string, error) {
+	if _, _, err := ParseWALFileName(filepath.Base(path)); err == nil && verifyWalCrc() {
+		if _, err = VerifyWalFile(path); err != nil {
+			return "", err
+		}
+	}
 	f, err := os.Open(path)
 	if err != nil {
 		return "", errors.Wrapf(err, "UploadWal: failed to open file %s\n", path)
@@ -259,169 +436,155 @@ func (tu *TarUploader) UploadWal(path string, pre *Prefix, verify bool) (string,
 
 	lz.Compress(&OpenPGPCrypter{})
 
-	p := sanitizePath(tu.server + "/wal_005/" + filepath.Base(path) + ".lz4")
+	p := walFolderPath(tu.server) + filepath.Base(path) + ".lz4"
 	reader := lz.Output
 
-	if verify {
-		reader = newMd5Reader(reader)
+	var sum string
+	var size int64
+	if verify || tu.ReadBack {
+		compressed, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return "", errors.Wrapf(err, "UploadWal: failed to compress file %s\n", path)
+		}
+		sum = sha256Hex(compressed)
+		size = int64(len(compressed))
+		reader = bytes.NewReader(compressed)
 	}
 
 	input := tu.createUploadInput(p, reader)
+	if verify {
+		input.Metadata[ChecksumMetadataKey] = aws.String(sum)
+	}
 
 	tu.wg.Add(1)
 	go func() {
 		defer tu.wg.Done()
-		err = tu.upload(input, path)
-
+		if getUploadCheckpointDir() != "" {
+			var stagedSum string
+			var stagedSize int64
+			stagedSum, stagedSize, err = tu.uploadCheckpointed(input, path)
+			if err == nil && sum != "" {
+				sum, size = stagedSum, stagedSize
+			}
+		} else {
+			err = tu.upload(input, path)
+		}
 	}()
 
 	tu.Finish()
-	fmt.Println("WAL PATH:", p)
-	if verify {
-		sum := reader.(*md5Reader).Sum()
-		a := &Archive{
-			Prefix:  pre,
-			Archive: aws.String(p),
-		}
-		eTag, err := a.GetETag()
+	infoln("WAL PATH:", p)
+	if verify && err == nil {
+		err = verifyUploadedChecksum(pre, p, sum, size)
 		if err != nil {
-			log.Fatalf("Unable to verify WAL %s", err)
-		}
-		if eTag == nil {
-			log.Fatalf("Unable to verify WAL: nil ETag ")
+			return "", err
 		}
-
-		trimETag := strings.Trim(*eTag, "\"")
-		if sum != trimETag {
-			log.Fatalf("WAL verification failed: md5 %s ETag %s", sum, trimETag)
+		infoln("SHA256 ", sum)
+	}
+	if tu.ReadBack && err == nil {
+		err = tu.readBack(p, sum)
+		if err != nil {
+			return "", err
 		}
-		fmt.Println("ETag ", trimETag)
 	}
 	return p, err
 }
 
-// HandleSentinel uploads the compressed tar file of `pg_control`. Will only be called
-// after the rest of the backup is successfully uploaded to S3. Returns
-// an error upon failure.
-func (bundle *Bundle) HandleSentinel() error {
-	fileName := bundle.Sen.Info.Name()
-	info := bundle.Sen.Info
-	path := bundle.Sen.path
-
-	bundle.NewTarBall(false)
-	tarBall := bundle.Tb
-	tarBall.SetUp(&bundle.Crypter, "pg_control.tar.lz4")
-	tarWriter := tarBall.Tw()
+// MetadataFile is a small file of backup which is held in memory until the metadata tarball is uploaded
+type MetadataFile struct {
+	Header  *tar.Header
+	Content []byte
+}
 
-	hdr, err := tar.FileInfoHeader(info, fileName)
+// PgControlFile reads `pg_control` found by TarWalker into memory
+func (bundle *Bundle) PgControlFile() (MetadataFile, error) {
+	if bundle.Sen == nil {
+		return MetadataFile{}, errors.New("PgControlFile: pg_control was not found in data directory")
+	}
+	hdr, err := tar.FileInfoHeader(bundle.Sen.Info, bundle.Sen.Info.Name())
 	if err != nil {
-		return errors.Wrap(err, "HandleSentinel: failed to grab header info")
+		return MetadataFile{}, errors.Wrap(err, "PgControlFile: failed to grab header info")
 	}
-
-	hdr.Name = strings.TrimPrefix(path, tarBall.Trim())
-	fmt.Println(hdr.Name)
-
-	err = tarWriter.WriteHeader(hdr)
+	hdr.Name = bundle.Sen.path
+	content, err := ioutil.ReadFile(bundle.Sen.path)
 	if err != nil {
-		return errors.Wrap(err, "HandleSentinel: failed to write header")
+		return MetadataFile{}, errors.Wrapf(err, "PgControlFile: failed to read %s", bundle.Sen.path)
 	}
+	hdr.Size = int64(len(content))
+	return MetadataFile{Header: hdr, Content: content}, nil
+}
 
-	if info.Mode().IsRegular() {
-		f, err := os.Open(path)
-		if err != nil {
-			return errors.Wrapf(err, "HandleSentinel: failed to open file %s\n", path)
-		}
+// UploadMetadataFiles writes files held in memory into a single tarball named after `pg_control`, which
+// is extracted after all other partitions. Header names are trimmed as names of files found by TarWalker.
+func (bundle *Bundle) UploadMetadataFiles(files ...MetadataFile) error {
+	bundle.NewTarBall(false)
+	tarBall := bundle.Tb
+	tarBall.SetUp(&bundle.Crypter, pgControlPartition)
+	tarWriter := tarBall.Tw()
 
-		lim := &io.LimitedReader{
-			R: f,
-			N: int64(hdr.Size),
+	for _, file := range files {
+		hdr := *file.Header
+		hdr.Name = strings.TrimPrefix(hdr.Name, tarBall.Trim())
+		err := tarWriter.WriteHeader(&hdr)
+		if err != nil {
+			return errors.Wrap(err, "UploadMetadataFiles: failed to write header")
 		}
-
-		_, err = io.Copy(tarWriter, lim)
+		_, err = tarWriter.Write(file.Content)
 		if err != nil {
-			return errors.Wrap(err, "HandleSentinel: copy failed")
+			return errors.Wrap(err, "UploadMetadataFiles: copy failed")
 		}
-
 		tarBall.AddSize(hdr.Size)
-		f.Close()
+		infoln(hdr.Name)
 	}
 
-	err = tarBall.CloseTar()
+	err := tarBall.CloseTar()
 	if err != nil {
-		return errors.Wrap(err, "HandleSentinel: failed to close tarball")
+		return errors.Wrap(err, "UploadMetadataFiles: failed to close tarball")
 	}
-
 	return nil
 }
 
-// HandleLabelFiles creates the `backup_label` and `tablespace_map` Files and uploads
-// it to S3 by stopping the backup. Returns error upon failure.
-func (bundle *Bundle) HandleLabelFiles(conn *pgx.Conn) (uint64, error) {
-	var lb string
-	var sc string
-	var lsnStr string
+// HandleMetadataFiles stops the backup and uploads `pg_control`, `backup_label` and `tablespace_map`
+// in one tarball. Will only be called after the rest of the backup is successfully uploaded to S3.
+// `pg_control` is read before the backup is stopped. Returns finish LSN or error upon failure.
+func (bundle *Bundle) HandleMetadataFiles(conn *pgx.Conn) (uint64, error) {
+	pgControl, err := bundle.PgControlFile()
+	if err != nil {
+		return 0, err
+	}
 
 	queryRunner, err := NewPgQueryRunner(conn)
 	if err != nil {
-		return 0, errors.Wrap(err, "HandleLabelFiles: Failed to build query runner.")
+		return 0, errors.Wrap(err, "HandleMetadataFiles: Failed to build query runner.")
 	}
-	lb, sc, lsnStr, err = queryRunner.StopBackup()
+	lb, sc, lsnStr, err := queryRunner.StopBackup()
 	if err != nil {
-		return 0, errors.Wrap(err, "HandleLabelFiles: failed to stop backup")
+		return 0, errors.Wrap(err, "HandleMetadataFiles: failed to stop backup")
 	}
 
 	lsn, err := ParseLsn(lsnStr)
 	if err != nil {
-		return 0, errors.Wrap(err, "HandleLabelFiles: failed to parse finish LSN")
-	}
-
-	if queryRunner.Version < 90600 {
-		return lsn, nil
+		return 0, errors.Wrap(err, "HandleMetadataFiles: failed to parse finish LSN")
 	}
 
-	bundle.NewTarBall(false)
-	tarBall := bundle.Tb
-	tarBall.SetUp(&bundle.Crypter)
-	tarWriter := tarBall.Tw()
-
-	lhdr := &tar.Header{
-		Name:     "backup_label",
-		Mode:     int64(0600),
-		Size:     int64(len(lb)),
-		Typeflag: tar.TypeReg,
+	files := []MetadataFile{pgControl}
+	if queryRunner.Version >= 90600 {
+		files = append(files, labelFile("backup_label", lb), labelFile("tablespace_map", sc))
 	}
-
-	err = tarWriter.WriteHeader(lhdr)
+	err = bundle.UploadMetadataFiles(files...)
 	if err != nil {
-		return 0, errors.Wrap(err, "HandleLabelFiles: failed to write header")
+		return 0, err
 	}
-	_, err = io.Copy(tarWriter, strings.NewReader(lb))
-	if err != nil {
-		return 0, errors.Wrap(err, "HandleLabelFiles: copy failed")
-	}
-	fmt.Println(lhdr.Name)
-
-	shdr := &tar.Header{
-		Name:     "tablespace_map",
-		Mode:     int64(0600),
-		Size:     int64(len(sc)),
-		Typeflag: tar.TypeReg,
-	}
-
-	err = tarWriter.WriteHeader(shdr)
-	if err != nil {
-		return 0, errors.Wrap(err, "HandleLabelFiles: failed to write header")
-	}
-	_, err = io.Copy(tarWriter, strings.NewReader(sc))
-	if err != nil {
-		return 0, errors.Wrap(err, "HandleLabelFiles: copy failed")
-	}
-	fmt.Println(shdr.Name)
+	return lsn, nil
+}
 
-	err = tarBall.CloseTar()
-	if err != nil {
-		return 0, errors.Wrap(err, "HandleLabelFiles: failed to close tarball")
+func labelFile(name string, content string) MetadataFile {
+	return MetadataFile{
+		Header: &tar.Header{
+			Name:     name,
+			Mode:     int64(0600),
+			Size:     int64(len(content)),
+			Typeflag: tar.TypeReg,
+		},
+		Content: []byte(content),
 	}
-
-	return lsn, nil
 }
@@ -0,0 +1,230 @@
+package walg
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/pkg/errors"
+)
+
+// checkpointPartSize is the part size of checkpointed uploads, interrupted upload loses at most one part
+const checkpointPartSize = s3manager.MinUploadPartSize
+
+// uploadCheckpoint is the state of checkpointed upload persisted between attempts
+type uploadCheckpoint struct {
+	Key           string           `json:"key"`
+	Source        string           `json:"source"`
+	SourceSize    int64            `json:"source_size"`
+	SourceModTime time.Time        `json:"source_mod_time"`
+	Size          int64            `json:"size"`
+	Sha256        string           `json:"sha256"`
+	UploadID      string           `json:"upload_id,omitempty"`
+	Parts         map[int64]string `json:"parts"`
+}
+
+// getUploadCheckpointDir returns WALG_UPLOAD_CHECKPOINT_DIR, empty directory disables checkpointing
+func getUploadCheckpointDir() string {
+	return getSetting("WALG_UPLOAD_CHECKPOINT_DIR")
+}
+
+// getCheckpointPaths are paths of persisted state and staged content of upload of the key
+func getCheckpointPaths(dir string, key string) (statePath string, stagedPath string) {
+	name := sha256Hex([]byte(key))[:32]
+	return filepath.Join(dir, name+".json"), filepath.Join(dir, name+".data")
+}
+
+// uploadCheckpointed is upload for unreliable links. Content is staged to WALG_UPLOAD_CHECKPOINT_DIR once and
+// uploaded by parts, every completed part is recorded on disk. When upload is interrupted, e.g. wal-push of
+// the same source file retried by archive_command after reconnect continues from the last completed part.
+// Checkpoint is discarded when the source file changed since it was staged. SHA256 and size of the uploaded
+// content are returned, resumed upload sends content staged by the interrupted attempt, and content encrypted
+// anew differs from it.
+func (tu *TarUploader) uploadCheckpointed(input *s3manager.UploadInput, source string) (string, int64, error) {
+	tu.acquireUploadSlot()
+	defer tu.releaseUploadSlot()
+
+	key := *input.Key
+	if closer, ok := input.Body.(io.Closer); ok {
+		// Resumed upload does not read content, compression is stopped
+		defer closer.Close()
+	}
+	var checkpoint *uploadCheckpoint
+	err := wrapTransfer(transferFuncs{upload: func(key string, content io.Reader) (err error) {
+		checkpoint, err = tu.uploadStaged(input, source, content)
+		return err
+	}}).Upload(key, input.Body)
+	if err != nil {
+		return "", 0, errors.Wrapf(err, "uploadCheckpointed: failed to upload '%s'", key)
+	}
+	tu.Success = true
+	EmitEvent(Event{Event: EventUploadedObject, Object: key, Bytes: checkpoint.Size})
+	return checkpoint.Sha256, checkpoint.Size, nil
+}
+
+func (tu *TarUploader) uploadStaged(input *s3manager.UploadInput, source string, content io.Reader) (*uploadCheckpoint, error) {
+	dir := getUploadCheckpointDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrapf(err, "uploadStaged: unable to create %s", dir)
+	}
+	statePath, stagedPath := getCheckpointPaths(dir, *input.Key)
+	stat, err := os.Stat(source)
+	if err != nil {
+		return nil, errors.Wrapf(err, "uploadStaged: unable to stat %s", source)
+	}
+
+	checkpoint, err := loadUploadCheckpoint(statePath, stagedPath)
+	if err != nil || checkpoint.Key != *input.Key || checkpoint.Source != source || checkpoint.Sha256 == "" ||
+		checkpoint.SourceSize != stat.Size() || !checkpoint.SourceModTime.Equal(stat.ModTime()) {
+		if checkpoint != nil && checkpoint.UploadID != "" {
+			tu.svc.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+				Bucket: input.Bucket, Key: aws.String(checkpoint.Key), UploadId: aws.String(checkpoint.UploadID)})
+		}
+		checkpoint = &uploadCheckpoint{Key: *input.Key, Source: source, SourceSize: stat.Size(), SourceModTime: stat.ModTime()}
+		if checkpoint.Size, checkpoint.Sha256, err = stageUploadContent(stagedPath, content); err != nil {
+			return nil, err
+		}
+	} else {
+		infof("Resuming upload of %s, %d parts are uploaded\n", *input.Key, len(checkpoint.Parts))
+	}
+	if _, ok := input.Metadata[ChecksumMetadataKey]; ok {
+		// Upload restarted after abort must record checksum of the staged content
+		input.Metadata[ChecksumMetadataKey] = aws.String(checkpoint.Sha256)
+	}
+
+	staged, err := os.Open(stagedPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "uploadStaged: unable to open %s", stagedPath)
+	}
+	defer staged.Close()
+	err = tu.uploadParts(input, checkpoint, statePath, staged)
+	if awsErr, ok := errors.Cause(err).(awserr.Error); ok && awsErr.Code() == s3.ErrCodeNoSuchUpload {
+		// Upload was aborted or expired by lifecycle rule meanwhile, staged content is uploaded again
+		checkpoint.UploadID, checkpoint.Parts = "", nil
+		err = tu.uploadParts(input, checkpoint, statePath, staged)
+	}
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(statePath)
+	os.Remove(stagedPath)
+	return checkpoint, nil
+}
+
+// uploadParts uploads parts missing in checkpoint and completes the upload
+func (tu *TarUploader) uploadParts(input *s3manager.UploadInput, checkpoint *uploadCheckpoint, statePath string, staged *os.File) error {
+	if checkpoint.UploadID == "" {
+		output, err := tu.svc.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+			Bucket:               input.Bucket,
+			Key:                  input.Key,
+			StorageClass:         input.StorageClass,
+			ServerSideEncryption: input.ServerSideEncryption,
+			SSEKMSKeyId:          input.SSEKMSKeyId,
+			Metadata:             input.Metadata,
+		})
+		if err != nil {
+			return errors.Wrapf(err, "uploadParts: unable to start upload of %s", checkpoint.Key)
+		}
+		checkpoint.UploadID = aws.StringValue(output.UploadId)
+		checkpoint.Parts = make(map[int64]string)
+		if err = saveUploadCheckpoint(statePath, checkpoint); err != nil {
+			return err
+		}
+	}
+
+	partCount := (checkpoint.Size + checkpointPartSize - 1) / checkpointPartSize
+	if partCount == 0 {
+		partCount = 1
+	}
+	for number := int64(1); number <= partCount; number++ {
+		if _, ok := checkpoint.Parts[number]; ok {
+			continue
+		}
+		offset := (number - 1) * checkpointPartSize
+		partSize := checkpoint.Size - offset
+		if partSize > checkpointPartSize {
+			partSize = checkpointPartSize
+		}
+		output, err := tu.svc.UploadPart(&s3.UploadPartInput{
+			Bucket:     input.Bucket,
+			Key:        input.Key,
+			UploadId:   aws.String(checkpoint.UploadID),
+			PartNumber: aws.Int64(number),
+			Body:       io.NewSectionReader(staged, offset, partSize),
+		})
+		if err != nil {
+			return errors.Wrapf(err, "uploadParts: unable to upload part %d of %s", number, checkpoint.Key)
+		}
+		checkpoint.Parts[number] = aws.StringValue(output.ETag)
+		if err = saveUploadCheckpoint(statePath, checkpoint); err != nil {
+			return err
+		}
+	}
+
+	parts := make([]*s3.CompletedPart, 0, len(checkpoint.Parts))
+	for number, etag := range checkpoint.Parts {
+		parts = append(parts, &s3.CompletedPart{PartNumber: aws.Int64(number), ETag: aws.String(etag)})
+	}
+	sort.Slice(parts, func(i, j int) bool { return *parts[i].PartNumber < *parts[j].PartNumber })
+	_, err := tu.svc.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          input.Bucket,
+		Key:             input.Key,
+		UploadId:        aws.String(checkpoint.UploadID),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	return errors.Wrapf(err, "uploadParts: unable to complete upload of %s", checkpoint.Key)
+}
+
+// stageUploadContent writes content to staged file, it is synced so checkpoint never refers to lost content.
+// Size and SHA256 of the content are returned.
+func stageUploadContent(stagedPath string, content io.Reader) (int64, string, error) {
+	file, err := os.OpenFile(stagedPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return 0, "", errors.Wrapf(err, "stageUploadContent: unable to create %s", stagedPath)
+	}
+	hashReader := newSha256Reader(content)
+	size, err := io.Copy(file, hashReader)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return size, hashReader.Sum(), errors.Wrapf(err, "stageUploadContent: unable to write %s", stagedPath)
+}
+
+// loadUploadCheckpoint reads checkpoint, nil is returned when there is none or its staged content is lost
+func loadUploadCheckpoint(statePath string, stagedPath string) (*uploadCheckpoint, error) {
+	content, err := ioutil.ReadFile(statePath)
+	if err != nil {
+		return nil, err
+	}
+	checkpoint := &uploadCheckpoint{}
+	if err = json.Unmarshal(content, checkpoint); err != nil {
+		return nil, errors.Wrapf(err, "loadUploadCheckpoint: unable to parse %s", statePath)
+	}
+	if stat, err := os.Stat(stagedPath); err != nil || stat.Size() != checkpoint.Size {
+		return checkpoint, errors.Errorf("loadUploadCheckpoint: staged content of %s is lost", checkpoint.Key)
+	}
+	return checkpoint, nil
+}
+
+// saveUploadCheckpoint replaces checkpoint atomically, interrupted save leaves the previous one
+func saveUploadCheckpoint(statePath string, checkpoint *uploadCheckpoint) error {
+	content, err := json.Marshal(checkpoint)
+	if err != nil {
+		return errors.Wrap(err, "saveUploadCheckpoint: unable to marshal checkpoint")
+	}
+	if err = ioutil.WriteFile(statePath+".tmp", content, 0600); err != nil {
+		return errors.Wrapf(err, "saveUploadCheckpoint: unable to write %s", statePath)
+	}
+	return errors.Wrapf(os.Rename(statePath+".tmp", statePath), "saveUploadCheckpoint: unable to write %s", statePath)
+}
@@ -0,0 +1,94 @@
+package walg
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// multipartS3 accepts multipart uploads and fails upload of one part once, as a dropped link would
+type multipartS3 struct {
+	s3iface.S3API
+	failPart  int64
+	parts     map[int64][]byte
+	uploaded  []int64
+	completed []byte
+}
+
+func (m *multipartS3) CreateMultipartUpload(input *s3.CreateMultipartUploadInput) (*s3.CreateMultipartUploadOutput, error) {
+	m.parts = make(map[int64][]byte)
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String("upload")}, nil
+}
+
+func (m *multipartS3) UploadPart(input *s3.UploadPartInput) (*s3.UploadPartOutput, error) {
+	if *input.PartNumber == m.failPart {
+		m.failPart = 0
+		return nil, awserr.New("RequestError", "connection reset", nil)
+	}
+	content, _ := ioutil.ReadAll(input.Body)
+	m.parts[*input.PartNumber] = content
+	m.uploaded = append(m.uploaded, *input.PartNumber)
+	return &s3.UploadPartOutput{ETag: aws.String(strconv.FormatInt(*input.PartNumber, 10))}, nil
+}
+
+func (m *multipartS3) CompleteMultipartUpload(input *s3.CompleteMultipartUploadInput) (*s3.CompleteMultipartUploadOutput, error) {
+	m.completed = nil
+	for _, part := range input.MultipartUpload.Parts {
+		m.completed = append(m.completed, m.parts[*part.PartNumber]...)
+	}
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+
+func TestUploadCheckpointedResumes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	SetSettings(map[string]string{"WALG_UPLOAD_CHECKPOINT_DIR": filepath.Join(dir, "checkpoints")})
+	defer SetSettings(nil)
+
+	source := filepath.Join(dir, "000000010000000000000001")
+	content := bytes.Repeat([]byte("0123456789abcdef"), int(3*checkpointPartSize/16-1))
+	if err = ioutil.WriteFile(source, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	svc := &multipartS3{failPart: 2}
+	tu := NewTarUploader(svc, "bucket", "server", "region")
+	key := "server/wal_005/000000010000000000000001.lz4"
+
+	if _, _, err = tu.uploadCheckpointed(tu.createUploadInput(key, bytes.NewReader(content)), source); err == nil {
+		t.Fatal("interrupted upload succeeded")
+	}
+	// Next attempt gets content again, but only missing parts are uploaded. Content encrypted anew differs,
+	// checksum of the staged content is reported then.
+	input := tu.createUploadInput(key, bytes.NewReader(bytes.ToUpper(content)))
+	input.Metadata[ChecksumMetadataKey] = aws.String(sha256Hex(bytes.ToUpper(content)))
+	sum, size, err := tu.uploadCheckpointed(input, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum != sha256Hex(content) || size != int64(len(content)) {
+		t.Errorf("uploadCheckpointed: sha256 %s and size %d are not of the staged content", sum, size)
+	}
+	if *input.Metadata[ChecksumMetadataKey] != sha256Hex(content) {
+		t.Errorf("uploadCheckpointed: checksum metadata is not of the staged content")
+	}
+	if len(svc.uploaded) != 3 || svc.uploaded[1] != 2 || svc.uploaded[2] != 3 {
+		t.Errorf("unexpected parts uploaded %v", svc.uploaded)
+	}
+	if !bytes.Equal(svc.completed, content) {
+		t.Errorf("uploaded object differs from content")
+	}
+	if files, _ := ioutil.ReadDir(filepath.Join(dir, "checkpoints")); len(files) != 0 {
+		t.Errorf("checkpoint is not removed after upload")
+	}
+}
@@ -0,0 +1,63 @@
+package walg
+
+import (
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/pkg/errors"
+)
+
+// defaultUploadPartSize is the part size of multipart uploads
+const defaultUploadPartSize = 20 * 1024 * 1024
+
+// getUploadMaxInflight reads WALG_UPLOAD_MAX_INFLIGHT, memory which buffered parts of all uploads may take,
+// 0 means unlimited
+func getUploadMaxInflight() (int64, error) {
+	maxInflightStr := getSetting("WALG_UPLOAD_MAX_INFLIGHT")
+	if maxInflightStr == "" {
+		return 0, nil
+	}
+	maxInflight, err := ParseByteSize(maxInflightStr)
+	if err != nil || maxInflight < 0 {
+		return 0, errors.Errorf("getUploadMaxInflight: invalid WALG_UPLOAD_MAX_INFLIGHT '%s'", maxInflightStr)
+	}
+	return maxInflight, nil
+}
+
+// fitUploadMemory picks part size and concurrency of one upload and number of concurrent uploads, so that
+// parts buffered by uploader fit into maxInflight. Uploader holds up to concurrency+1 parts of each upload.
+// At least minUploads run at once: every open tarball holds its upload until it is full, so fewer slots than
+// tarballs written in parallel would block the walker forever. Concurrency is lowered first, then part size,
+// but parts are never smaller than the minimal part size. Zero uploads means there is no limit.
+func fitUploadMemory(maxInflight int64, partSize int64, concurrency int, minUploads int) (int64, int, int) {
+	if maxInflight <= 0 {
+		return partSize, concurrency, 0
+	}
+	budget := maxInflight / int64(minUploads)
+	for concurrency > 1 && partSize*int64(concurrency+1) > budget {
+		concurrency--
+	}
+	if partSize*int64(concurrency+1) > budget {
+		partSize = budget / int64(concurrency+1)
+		if partSize < s3manager.MinUploadPartSize {
+			partSize = s3manager.MinUploadPartSize
+		}
+	}
+	uploads := int(maxInflight / (partSize * int64(concurrency+1)))
+	if uploads < minUploads {
+		uploads = minUploads
+	}
+	return partSize, concurrency, uploads
+}
+
+// acquireUploadSlot waits until upload fits into WALG_UPLOAD_MAX_INFLIGHT. Meanwhile tarball writer blocks on
+// its pipe, so reading the data directory slows down to the upload speed instead of buffering in memory.
+func (tu *TarUploader) acquireUploadSlot() {
+	if tu.uploadSlots != nil {
+		tu.uploadSlots <- struct{}{}
+	}
+}
+
+func (tu *TarUploader) releaseUploadSlot() {
+	if tu.uploadSlots != nil {
+		<-tu.uploadSlots
+	}
+}
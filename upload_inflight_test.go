@@ -0,0 +1,105 @@
+package walg
+
+import (
+	"archive/tar"
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+func TestFitUploadMemory(t *testing.T) {
+	const mb = 1024 * 1024
+	tests := []struct {
+		maxInflight int64
+		minUploads  int
+		partSize    int64
+		concurrency int
+		uploads     int
+	}{
+		{0, 1, 20 * mb, 10, 0},
+		{1024 * mb, 1, 20 * mb, 10, 4},
+		{100 * mb, 1, 20 * mb, 4, 1},
+		{40 * mb, 1, 20 * mb, 1, 1},
+		{30 * mb, 1, 15 * mb, 1, 1},
+		{mb, 1, s3manager.MinUploadPartSize, 1, 1},
+		{512 * mb, 5, 20 * mb, 4, 5},
+		{10 * mb, 3, s3manager.MinUploadPartSize, 1, 3},
+	}
+	for _, test := range tests {
+		partSize, concurrency, uploads := fitUploadMemory(test.maxInflight, 20*mb, 10, test.minUploads)
+		if partSize != test.partSize || concurrency != test.concurrency || uploads != test.uploads {
+			t.Errorf("fitUploadMemory(%d, %d): got part size %d, concurrency %d, %d uploads, expected %d, %d, %d", test.maxInflight,
+				test.minUploads, partSize, concurrency, uploads, test.partSize, test.concurrency, test.uploads)
+		}
+	}
+}
+
+func TestUploadSlotsBlockUploads(t *testing.T) {
+	tu := NewTarUploader(nil, "bucket", "server", "region")
+	tu.uploadSlots = make(chan struct{}, 1)
+	clone := tu.Clone()
+
+	tu.acquireUploadSlot()
+	acquired := make(chan struct{})
+	go func() {
+		clone.acquireUploadSlot()
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("upload started beyond WALG_UPLOAD_MAX_INFLIGHT")
+	case <-time.After(50 * time.Millisecond):
+	}
+	tu.releaseUploadSlot()
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("upload did not start after slot was released")
+	}
+	clone.releaseUploadSlot()
+}
+
+func TestUploadSlotsDoNotBlockParallelTarballs(t *testing.T) {
+	SetSettings(map[string]string{"WALG_UPLOAD_DISK_CONCURRENCY": "2"})
+	defer SetSettings(nil)
+	// 10MB fits one upload of minimal part size, but both tarballs must upload at once
+	_, _, uploads := fitUploadMemory(10*1024*1024, defaultUploadPartSize, 10, getMaxUploadDiskConcurrency()+1)
+	tu := NewTarUploader(nil, "bucket", "server", "region")
+	tu.Upl = &discardUploader{}
+	tu.uploadSlots = make(chan struct{}, uploads)
+	bundle := &Bundle{MinSize: 1 << 30, Tbm: &S3TarBallMaker{BkupName: "base_000000010000000000000002", Tu: tu}}
+
+	done := make(chan error)
+	go func() {
+		bundle.StartQueue()
+		content := bytes.Repeat([]byte("tarball "), 1024*1024)
+		notDone := false
+		for i := 0; i < 2; i++ {
+			tarBall := bundle.Deque()
+			tarBall.SetUp(&OpenPGPCrypter{})
+			if err := tarBall.Tw().WriteHeader(&tar.Header{Name: "base/1/1", Mode: 0600, Size: int64(len(content))}); err != nil {
+				done <- err
+				return
+			}
+			if _, err := tarBall.Tw().Write(content); err != nil {
+				done <- err
+				return
+			}
+			defer bundle.EnqueueBack(tarBall, &notDone)
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("writing parallel tarballs blocked on upload slots")
+	}
+	if err := bundle.FinishQueue(); err != nil {
+		t.Fatal(err)
+	}
+}
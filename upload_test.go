@@ -4,6 +4,7 @@ import (
 	"os"
 	"testing"
 
+	"github.com/pkg/errors"
 	"github.com/wal-g/wal-g"
 )
 
@@ -193,3 +194,26 @@ func TestUploadError(t *testing.T) {
 		t.Errorf("upload: UploadWal expected error but got `<nil>`")
 	}
 }
+
+func TestConfigureEncryptMetadata(t *testing.T) {
+	setFake(t)
+	os.Setenv("WALE_S3_PREFIX", "s3://bucket/server")
+	os.Setenv("WALG_ENCRYPT_METADATA", "true")
+	defer os.Unsetenv("WALG_ENCRYPT_METADATA")
+
+	os.Unsetenv("WALE_GPG_KEY_ID")
+	_, _, err := walg.Configure()
+	if errors.Cause(err) != walg.ErrMetadataKeyMissing {
+		t.Errorf("upload: expected missing key error, got %v", err)
+	}
+
+	os.Setenv("WALE_GPG_KEY_ID", "backup@example.com")
+	defer os.Unsetenv("WALE_GPG_KEY_ID")
+	tu, _, err := walg.Configure()
+	if err != nil {
+		t.Fatalf("upload: unexpected error %v", err)
+	}
+	if !tu.EncryptMetadata {
+		t.Error("upload: metadata encryption is not enabled")
+	}
+}
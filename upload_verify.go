@@ -0,0 +1,62 @@
+package walg
+
+import (
+	"log"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/pkg/errors"
+)
+
+// verifyUploads reads WALG_VERIFY_UPLOADS setting
+func verifyUploads() bool {
+	verifyStr, ok := lookupSetting("WALG_VERIFY_UPLOADS")
+	if !ok {
+		return false
+	}
+	verify, err := strconv.ParseBool(verifyStr)
+	if err != nil {
+		log.Fatalf("Unable to parse WALG_VERIFY_UPLOADS %v\n", err)
+	}
+	return verify
+}
+
+// uploadVerified is upload checking the stored object with WALG_VERIFY_UPLOADS
+func (tu *TarUploader) uploadVerified(input *s3manager.UploadInput, path string) error {
+	counter := verifiedUploadBody(input)
+	if err := tu.upload(input, path); err != nil || counter == nil {
+		return err
+	}
+	return tu.verifyUploadedObject(path, counter.Count(), aws.StringValue(input.Metadata[ChecksumMetadataKey]))
+}
+
+// verifiedUploadBody makes input count uploaded bytes when WALG_VERIFY_UPLOADS is set, nil is returned otherwise
+func verifiedUploadBody(input *s3manager.UploadInput) *countingReader {
+	if !verifyUploads() {
+		return nil
+	}
+	counter := &countingReader{reader: input.Body}
+	input.Body = counter
+	return counter
+}
+
+// verifyUploadedObject checks that stored object has size of uploaded content and the SHA256 recorded in its
+// metadata, if any. ETag is not compared, it is not MD5 of content with SSE-KMS, SSE-C and on many
+// S3-compatible storages.
+func (tu *TarUploader) verifyUploadedObject(key string, size int64, sum string) error {
+	head, err := tu.svc.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(tu.bucket), Key: aws.String(key)})
+	if err != nil {
+		return errors.Wrapf(err, "verifyUploadedObject: HEAD of %s failed", key)
+	}
+	if aws.Int64Value(head.ContentLength) != size {
+		return errors.Wrapf(ErrChecksumMismatch, "verifyUploadedObject: %s is %d bytes, uploaded %d bytes",
+			key, aws.Int64Value(head.ContentLength), size)
+	}
+	if stored := aws.StringValue(head.Metadata[ChecksumMetadataKey]); sum != "" && stored != sum {
+		return errors.Wrapf(ErrChecksumMismatch, "verifyUploadedObject: %s has sha256 '%s', uploaded '%s'", key, stored, sum)
+	}
+	infoln("Verified", key)
+	return nil
+}
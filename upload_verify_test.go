@@ -0,0 +1,36 @@
+package walg
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+func TestVerifyUploadedObject(t *testing.T) {
+	content := []byte("sentinel")
+	size := int64(len(content))
+	// Bucket default SSE-KMS is not configured in WAL-G, ETag is not MD5 of content and must not matter
+	svc := &headObjectS3{output: &s3.HeadObjectOutput{
+		ContentLength:        aws.Int64(size),
+		ETag:                 aws.String("\"d41d8cd98f00b204e9800998ecf8427e\""),
+		ServerSideEncryption: aws.String("aws:kms"),
+		Metadata:             map[string]*string{ChecksumMetadataKey: aws.String(sha256Hex(content))},
+	}}
+	tu := NewTarUploader(svc, "bucket", "server", "region")
+
+	if err := tu.verifyUploadedObject("key", size, sha256Hex(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tu.verifyUploadedObject("key", size, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := tu.verifyUploadedObject("key", size, sha256Hex([]byte("corrupt!"))); errors.Cause(err) != ErrChecksumMismatch {
+		t.Fatalf("object with other checksum is verified: %v", err)
+	}
+	svc.output.ContentLength = aws.Int64(1)
+	if err := tu.verifyUploadedObject("key", size, ""); errors.Cause(err) != ErrChecksumMismatch {
+		t.Fatalf("truncated object is verified: %v", err)
+	}
+}
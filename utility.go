@@ -1,13 +1,8 @@
 package walg
 
 import (
-	"crypto/md5"
-	"encoding/hex"
 	"github.com/aws/aws-sdk-go/service/s3"
-	"hash"
-	"io"
 	"log"
-	"os"
 	"path/filepath"
 	"strconv"
 	"time"
@@ -74,6 +69,13 @@ func ResolveSymlink(path string) string {
 	return resolve
 }
 
+// getWalFileLocation resolves symlinks of the directory of WAL file handed to wal-push or wal-fetch. WAL directory
+// is pg_xlog before PostgreSQL 10 and pg_wal since, either can be a symlink to another file system, and the path
+// is usually relative to PGDATA. The WAL file itself may not exist yet.
+func getWalFileLocation(walFilePath string) string {
+	return filepath.Join(ResolveSymlink(filepath.Dir(walFilePath)), filepath.Base(walFilePath))
+}
+
 func getMaxDownloadConcurrency(default_value int) int {
 	return getMaxConcurrency("WALG_DOWNLOAD_CONCURRENCY", default_value)
 }
@@ -90,7 +92,7 @@ func getMaxUploadQueue() int {
 
 // GetSentinelUserData tries to parse WALG_SENTINEL_USER_DATA env variable
 func GetSentinelUserData() interface{} {
-	dataStr, ok := os.LookupEnv("WALG_SENTINEL_USER_DATA")
+	dataStr, ok := lookupSetting("WALG_SENTINEL_USER_DATA")
 	if !ok || len(dataStr) == 0 {
 		return nil
 	}
@@ -110,7 +112,7 @@ func getMaxUploadDiskConcurrency() int {
 func getMaxConcurrency(key string, default_value int) int {
 	var con int
 	var err error
-	conc, ok := os.LookupEnv(key)
+	conc, ok := lookupSetting(key)
 	if ok {
 		con, err = strconv.Atoi(conc)
 
@@ -126,26 +128,3 @@ func getMaxConcurrency(key string, default_value int) int {
 	}
 	return max(con, 1)
 }
-
-type md5Reader struct {
-	internal io.Reader
-	md5      hash.Hash
-}
-
-func newMd5Reader(reader io.Reader) *md5Reader {
-	return &md5Reader{internal: reader, md5: md5.New()}
-}
-
-func (r *md5Reader) Read(p []byte) (n int, err error) {
-	n, err = r.internal.Read(p)
-	if err != nil {
-		return
-	}
-	_, err = r.md5.Write(p[:n])
-	return
-}
-
-func (r *md5Reader) Sum() string {
-	bytes := r.md5.Sum(nil)
-	return hex.EncodeToString(bytes)
-}
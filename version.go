@@ -0,0 +1,108 @@
+package walg
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// WalgVersion is the version of WAL-G recorded in backup sentinels. Set by main package.
+var WalgVersion = "devel"
+
+// FormatPgMajorVersion converts numeric server_version_num to major version string, e.g. 90605 to "9.6" and 100003 to "10"
+func FormatPgMajorVersion(versionNum int) string {
+	if versionNum >= 100000 {
+		return strconv.Itoa(versionNum / 10000)
+	}
+	return fmt.Sprintf("%d.%d", versionNum/10000, versionNum/100%100)
+}
+
+// pgVersionNum converts PG_VERSION content like "9.6" or "10" to server_version_num format
+func pgVersionNum(version string) (int, error) {
+	major, err := ParsePgMajorVersion(version)
+	if err != nil {
+		return 0, err
+	}
+	parts := strings.SplitN(major, ".", 2)
+	number, _ := strconv.Atoi(parts[0])
+	if len(parts) == 1 {
+		return number * 10000, nil
+	}
+	minor, _ := strconv.Atoi(parts[1])
+	return number*10000 + minor*100, nil
+}
+
+var pgVersionRegexp = regexp.MustCompile(`(\d+)(\.\d+)?`)
+
+// ParsePgMajorVersion extracts major version from strings like "postgres (PostgreSQL) 9.6.8", "10.4" or "11beta1"
+func ParsePgMajorVersion(version string) (string, error) {
+	match := pgVersionRegexp.FindStringSubmatch(version)
+	if match == nil {
+		return "", errors.Errorf("Unable to parse PostgreSQL version '%s'", strings.TrimSpace(version))
+	}
+	major, _ := strconv.Atoi(match[1])
+	if major >= 10 || match[2] == "" {
+		return match[1], nil
+	}
+	return match[1] + match[2], nil
+}
+
+// getTargetPgMajorVersion determines which PostgreSQL will run restored cluster.
+// PG_VERSION file in the target directory takes precedence over postgres binary in PATH.
+func getTargetPgMajorVersion(dirArc string) (string, error) {
+	if version, err := ioutil.ReadFile(filepath.Join(dirArc, "PG_VERSION")); err == nil {
+		return ParsePgMajorVersion(string(version))
+	}
+
+	out, err := exec.Command("postgres", "-V").Output()
+	if err != nil {
+		return "", errors.Wrap(err, "unable to run 'postgres -V'")
+	}
+	return ParsePgMajorVersion(string(out))
+}
+
+// ErrPgVersionMismatch happens when backup is fetched for PostgreSQL of other major version
+var ErrPgVersionMismatch = errors.New("Backup PostgreSQL major version does not match target")
+
+// checkRestoreCompatibility verifies that backup described by sentinel can be started by target PostgreSQL
+func checkRestoreCompatibility(sentinel S3TarBallSentinelDto, dirArc string) error {
+	if sentinel.PgVersion == 0 {
+		log.Println("WARNING! Backup does not contain PostgreSQL version, compatibility is not checked.")
+		return nil
+	}
+	backupVersion := FormatPgMajorVersion(sentinel.PgVersion)
+	if sentinel.WalgVersion != "" {
+		fmt.Printf("Backup was made by WAL-G %v from PostgreSQL %v\n", sentinel.WalgVersion, backupVersion)
+	}
+
+	targetVersion, err := getTargetPgMajorVersion(dirArc)
+	if err != nil {
+		log.Printf("WARNING! Unable to determine target PostgreSQL version, compatibility is not checked: %v\n", err)
+		return nil
+	}
+
+	if targetVersion != backupVersion {
+		return errors.Wrapf(ErrPgVersionMismatch, "backup is from PostgreSQL %s, target is PostgreSQL %s", backupVersion, targetVersion)
+	}
+	return nil
+}
+
+// ignorePgVersionMismatch reads WALG_IGNORE_PG_VERSION_MISMATCH override
+func ignorePgVersionMismatch() bool {
+	ignoreStr, ok := lookupSetting("WALG_IGNORE_PG_VERSION_MISMATCH")
+	if !ok {
+		return false
+	}
+	ignore, err := strconv.ParseBool(ignoreStr)
+	if err != nil {
+		log.Fatal("Unable to parse WALG_IGNORE_PG_VERSION_MISMATCH ", err)
+	}
+	return ignore
+}
@@ -0,0 +1,44 @@
+package walg_test
+
+import (
+	"testing"
+
+	"github.com/wal-g/wal-g"
+)
+
+func TestFormatPgMajorVersion(t *testing.T) {
+	versions := map[int]string{
+		90321:  "9.3",
+		90605:  "9.6",
+		100003: "10",
+		110000: "11",
+	}
+	for num, expected := range versions {
+		if actual := walg.FormatPgMajorVersion(num); actual != expected {
+			t.Errorf("version: FormatPgMajorVersion(%d) expected %s but got %s", num, expected, actual)
+		}
+	}
+}
+
+func TestParsePgMajorVersion(t *testing.T) {
+	versions := map[string]string{
+		"postgres (PostgreSQL) 9.6.8\n": "9.6",
+		"postgres (PostgreSQL) 10.4\n":  "10",
+		"11beta1":                       "11",
+		"9.5\n":                         "9.5",
+	}
+	for input, expected := range versions {
+		actual, err := walg.ParsePgMajorVersion(input)
+		if err != nil {
+			t.Errorf("version: ParsePgMajorVersion(%q) failed: %v", input, err)
+		}
+		if actual != expected {
+			t.Errorf("version: ParsePgMajorVersion(%q) expected %s but got %s", input, expected, actual)
+		}
+	}
+
+	_, err := walg.ParsePgMajorVersion("postgres")
+	if err == nil {
+		t.Error("version: ParsePgMajorVersion parsed string without version")
+	}
+}
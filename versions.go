@@ -0,0 +1,350 @@
+package walg
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/pkg/errors"
+)
+
+// VersionsUsage is a text message explaining how to use versions
+var VersionsUsage = "usage:\twal-g versions ls [path]                           list versions and delete markers of objects under path" + `
+	wal-g versions restore time [path] [--confirm]    restore objects under path to their state at time (RFC3339)
+Both need versioning enabled on the bucket. Fetch and list commands read the storage as it was at
+WALG_READ_AT (RFC3339) when it is set, e.g. to fetch a backup removed by an accidental delete.
+`
+
+// readAtCommands only read the storage, so they may run with WALG_READ_AT
+var readAtCommands = map[string]bool{
+	"wal-fetch":       true,
+	"wal-prefetch":    true,
+	"wal-dump":        true,
+	"wal-fetch-range": true,
+	"backup-fetch":    true,
+	"backup-list":     true,
+	"backup-export":   true,
+	"backup-mount":    true,
+	"backup-clone":    true,
+	"catalog":         true,
+	"storage-usage":   true,
+	"dump-fetch":      true,
+	"dump-list":       true,
+	"stream-fetch":    true,
+	"stream-list":     true,
+	"versions":        true,
+}
+
+// objectVersion is a version or a delete marker of an object
+type objectVersion struct {
+	Key          string
+	VersionID    string
+	LastModified time.Time
+	Size         int64
+	IsLatest     bool
+	DeleteMarker bool
+}
+
+func printVersionsUsageAndFail() {
+	log.Fatal(VersionsUsage)
+}
+
+// getReadAt reads WALG_READ_AT, nil means the latest versions are read
+func getReadAt() *time.Time {
+	readAtStr := getSetting("WALG_READ_AT")
+	if readAtStr == "" {
+		return nil
+	}
+	readAt, err := time.Parse(time.RFC3339, readAtStr)
+	if err != nil {
+		log.Fatalf("Unable to parse WALG_READ_AT %v\n", err)
+	}
+	return &readAt
+}
+
+// CheckReadAt refuses commands writing to the storage when WALG_READ_AT is set: they would see old state
+// of the storage and make decisions on it, e.g. delete backups which are not there anymore
+func CheckReadAt(command string) error {
+	if getReadAt() != nil && !readAtCommands[command] {
+		return errors.Errorf("CheckReadAt: %s cannot run with WALG_READ_AT, it is only for reading commands", command)
+	}
+	return nil
+}
+
+// listObjectVersions passes versions of objects under prefix to handler key by key in key order until it
+// returns false, versions of a key are ordered from the newest. Versions of a key may span listing pages.
+func listObjectVersions(svc s3iface.S3API, input *s3.ListObjectVersionsInput, handler func(key string, versions []objectVersion) bool) error {
+	var pending []objectVersion
+	stopped := false
+	err := svc.ListObjectVersionsPages(input, func(page *s3.ListObjectVersionsOutput, lastPage bool) bool {
+		versions := make([]objectVersion, 0, len(page.Versions)+len(page.DeleteMarkers))
+		for _, version := range page.Versions {
+			versions = append(versions, objectVersion{
+				Key:          aws.StringValue(version.Key),
+				VersionID:    aws.StringValue(version.VersionId),
+				LastModified: aws.TimeValue(version.LastModified),
+				Size:         aws.Int64Value(version.Size),
+				IsLatest:     aws.BoolValue(version.IsLatest),
+			})
+		}
+		for _, marker := range page.DeleteMarkers {
+			versions = append(versions, objectVersion{
+				Key:          aws.StringValue(marker.Key),
+				VersionID:    aws.StringValue(marker.VersionId),
+				LastModified: aws.TimeValue(marker.LastModified),
+				IsLatest:     aws.BoolValue(marker.IsLatest),
+				DeleteMarker: true,
+			})
+		}
+		sortObjectVersions(versions)
+		for _, version := range versions {
+			if len(pending) > 0 && pending[0].Key != version.Key {
+				sortObjectVersions(pending)
+				if !handler(pending[0].Key, pending) {
+					stopped = true
+					return false
+				}
+				pending = nil
+			}
+			pending = append(pending, version)
+		}
+		return true
+	})
+	if err != nil {
+		return errors.Wrapf(err, "listObjectVersions: s3.ListObjectVersions failed for %s", aws.StringValue(input.Prefix))
+	}
+	if !stopped && len(pending) > 0 {
+		sortObjectVersions(pending)
+		handler(pending[0].Key, pending)
+	}
+	return nil
+}
+
+// sortObjectVersions orders versions by key and then from the newest, the latest goes first among equal times
+func sortObjectVersions(versions []objectVersion) {
+	sort.SliceStable(versions, func(i, j int) bool {
+		if versions[i].Key != versions[j].Key {
+			return versions[i].Key < versions[j].Key
+		}
+		if !versions[i].LastModified.Equal(versions[j].LastModified) {
+			return versions[i].LastModified.After(versions[j].LastModified)
+		}
+		return versions[i].IsLatest && !versions[j].IsLatest
+	})
+}
+
+// versionAt returns version of the object current at the time, nil if the object did not exist or was deleted
+func versionAt(versions []objectVersion, at time.Time) *objectVersion {
+	for i := range versions {
+		if !versions[i].LastModified.After(at) {
+			if versions[i].DeleteMarker {
+				return nil
+			}
+			return &versions[i]
+		}
+	}
+	return nil
+}
+
+// listObjectsAt is ListObjectsV2Pages listing objects as they were at the time
+func listObjectsAt(svc s3iface.S3API, input *s3.ListObjectsV2Input, at time.Time, fn func(*s3.ListObjectsV2Output, bool) bool) error {
+	versionsInput := &s3.ListObjectVersionsInput{
+		Bucket:    input.Bucket,
+		Prefix:    input.Prefix,
+		Delimiter: input.Delimiter,
+		KeyMarker: input.StartAfter,
+	}
+	prefixes := make([]*s3.CommonPrefix, 0)
+	page := &s3.ListObjectsV2Output{}
+	stopped := false
+	err := listObjectVersions(svc, versionsInput, func(key string, versions []objectVersion) bool {
+		version := versionAt(versions, at)
+		if version == nil {
+			return true
+		}
+		page.Contents = append(page.Contents, &s3.Object{
+			Key:          aws.String(key),
+			Size:         aws.Int64(version.Size),
+			LastModified: aws.Time(version.LastModified),
+		})
+		if len(page.Contents) < inventoryPageSize {
+			return true
+		}
+		stopped = !fn(page, false)
+		page = &s3.ListObjectsV2Output{}
+		return !stopped
+	})
+	if err != nil || stopped {
+		return err
+	}
+	if input.Delimiter != nil {
+		// Folders are listed as they are now, folder which has only deleted objects is just empty
+		err = svc.ListObjectVersionsPages(versionsInput, func(versionsPage *s3.ListObjectVersionsOutput, lastPage bool) bool {
+			prefixes = append(prefixes, versionsPage.CommonPrefixes...)
+			return true
+		})
+		if err != nil {
+			return errors.Wrapf(err, "listObjectsAt: s3.ListObjectVersions failed for %s", aws.StringValue(input.Prefix))
+		}
+	}
+	page.CommonPrefixes = prefixes
+	fn(page, true)
+	return nil
+}
+
+// objectVersionIDAt returns ID of the version of the object current at the time. Absent object is
+// reported with the same error code as GetObject reports it.
+func objectVersionIDAt(svc s3iface.S3API, bucket *string, key string, at time.Time) (string, error) {
+	var version *objectVersion
+	err := listObjectVersions(svc, &s3.ListObjectVersionsInput{Bucket: bucket, Prefix: aws.String(key)},
+		func(versionsKey string, versions []objectVersion) bool {
+			if versionsKey == key {
+				version = versionAt(versions, at)
+			}
+			return versionsKey < key
+		})
+	if err != nil {
+		return "", err
+	}
+	if version == nil {
+		return "", awserr.New(s3.ErrCodeNoSuchKey, fmt.Sprintf("%s did not exist at %s", key, at.Format(time.RFC3339)), nil)
+	}
+	return version.VersionID, nil
+}
+
+// headObject is s3.HeadObject of the version current at WALG_READ_AT when it is set
+func headObject(svc s3iface.S3API, bucket *string, key *string) (*s3.HeadObjectOutput, error) {
+	input := &s3.HeadObjectInput{Bucket: bucket, Key: key}
+	if readAt := getReadAt(); readAt != nil {
+		versionID, err := objectVersionIDAt(svc, bucket, aws.StringValue(key), *readAt)
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == s3.ErrCodeNoSuchKey {
+			return nil, awserr.New("NotFound", awsErr.Message(), nil)
+		}
+		if err != nil {
+			return nil, err
+		}
+		input.VersionId = aws.String(versionID)
+	}
+	return svc.HeadObject(input)
+}
+
+// HandleVersions is invoked to perform wal-g versions subcommands
+func HandleVersions(pre *Prefix, args []string) {
+	if len(args) < 2 {
+		printVersionsUsageAndFail()
+	}
+	serverPath := sanitizePath(*pre.Server + "/")
+
+	var err error
+	switch args[1] {
+	case "ls":
+		if len(args) > 3 {
+			printVersionsUsageAndFail()
+		}
+		path := ""
+		if len(args) == 3 {
+			path = strings.TrimLeft(args[2], "/")
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+		fmt.Fprintln(w, "modified\tsize\tversion_id\tstate\tpath")
+		err = listObjectVersions(pre.Svc, &s3.ListObjectVersionsInput{Bucket: pre.Bucket, Prefix: aws.String(serverPath + path)},
+			func(key string, versions []objectVersion) bool {
+				for _, version := range versions {
+					fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", version.LastModified.Format(time.RFC3339), version.Size,
+						version.VersionID, formatVersionState(version), strings.TrimPrefix(key, serverPath))
+				}
+				return true
+			})
+		w.Flush()
+	case "restore":
+		if len(args) < 3 {
+			printVersionsUsageAndFail()
+		}
+		at, parseErr := time.Parse(time.RFC3339, args[2])
+		if parseErr != nil {
+			log.Println(parseErr)
+			printVersionsUsageAndFail()
+		}
+		path := ""
+		confirm := false
+		for _, arg := range args[3:] {
+			if arg == "--confirm" {
+				confirm = true
+			} else {
+				path = strings.TrimLeft(arg, "/")
+			}
+		}
+		err = restoreVersions(pre, serverPath+path, at, !confirm)
+	default:
+		printVersionsUsageAndFail()
+	}
+
+	if err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+}
+
+func formatVersionState(version objectVersion) string {
+	state := "old"
+	if version.DeleteMarker {
+		state = "deleted"
+	}
+	if version.IsLatest {
+		state += ",latest"
+	}
+	return strings.TrimPrefix(state, "old,")
+}
+
+// restoreVersions makes versions current at the time the latest ones for objects deleted or overwritten
+// since then. Objects created after the time are left as they are, old versions are kept by the bucket.
+func restoreVersions(pre *Prefix, prefix string, at time.Time, dryRun bool) error {
+	restored := make([]objectVersion, 0)
+	err := listObjectVersions(pre.Svc, &s3.ListObjectVersionsInput{Bucket: pre.Bucket, Prefix: aws.String(prefix)},
+		func(key string, versions []objectVersion) bool {
+			version := versionAt(versions, at)
+			if version != nil && versions[0].VersionID != version.VersionID {
+				restored = append(restored, *version)
+			}
+			return true
+		})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d objects changed since %v will be restored\n", len(restored), at.Format(time.RFC3339))
+	if dryRun {
+		for _, version := range restored {
+			fmt.Println(version.Key)
+		}
+		fmt.Println("Dry run finished, add --confirm to restore")
+		return nil
+	}
+	for _, version := range restored {
+		if err = copyObjectVersion(pre, version); err != nil {
+			return errors.Wrapf(err, "restoreVersions: unable to restore %s", version.Key)
+		}
+		fmt.Println("Restored", version.Key)
+	}
+	return nil
+}
+
+// copyObjectVersion copies old version of the object over it, so it becomes the latest version
+func copyObjectVersion(pre *Prefix, version objectVersion) error {
+	source := (&url.URL{Path: *pre.Bucket + "/" + version.Key}).EscapedPath() + "?versionId=" + url.QueryEscape(version.VersionID)
+	input := &s3.CopyObjectInput{
+		Bucket:     pre.Bucket,
+		Key:        aws.String(version.Key),
+		CopySource: aws.String(source),
+	}
+	setCopyObjectOptions(input)
+	_, err := pre.Svc.CopyObject(input)
+	return err
+}
@@ -0,0 +1,159 @@
+package walg
+
+import (
+	"bytes"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// versionedS3 is a versioned bucket listing versions in small pages, so versions of a key span pages
+type versionedS3 struct {
+	s3iface.S3API
+	versions []objectVersion
+	copied   []string
+	fetched  []string
+}
+
+func (m *versionedS3) ListObjectVersionsPages(input *s3.ListObjectVersionsInput, callback func(*s3.ListObjectVersionsOutput, bool) bool) error {
+	versions := make([]objectVersion, 0)
+	for _, version := range m.versions {
+		if strings.HasPrefix(version.Key, aws.StringValue(input.Prefix)) && version.Key > aws.StringValue(input.KeyMarker) {
+			versions = append(versions, version)
+		}
+	}
+	sortObjectVersions(versions)
+	for len(versions) > 0 {
+		size := 2
+		if size > len(versions) {
+			size = len(versions)
+		}
+		page := &s3.ListObjectVersionsOutput{}
+		for _, version := range versions[:size] {
+			if version.DeleteMarker {
+				page.DeleteMarkers = append(page.DeleteMarkers, &s3.DeleteMarkerEntry{Key: aws.String(version.Key),
+					VersionId: aws.String(version.VersionID), LastModified: aws.Time(version.LastModified), IsLatest: aws.Bool(version.IsLatest)})
+			} else {
+				page.Versions = append(page.Versions, &s3.ObjectVersion{Key: aws.String(version.Key), Size: aws.Int64(version.Size),
+					VersionId: aws.String(version.VersionID), LastModified: aws.Time(version.LastModified), IsLatest: aws.Bool(version.IsLatest)})
+			}
+		}
+		versions = versions[size:]
+		if !callback(page, len(versions) == 0) {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (m *versionedS3) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	m.fetched = append(m.fetched, aws.StringValue(input.VersionId))
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewReader(nil))}, nil
+}
+
+func (m *versionedS3) CopyObject(input *s3.CopyObjectInput) (*s3.CopyObjectOutput, error) {
+	m.copied = append(m.copied, *input.CopySource)
+	return &s3.CopyObjectOutput{}, nil
+}
+
+var versionsTestStart = time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+
+func newVersionedS3() *versionedS3 {
+	at := func(hours int) time.Time { return versionsTestStart.Add(time.Duration(hours) * time.Hour) }
+	return &versionedS3{versions: []objectVersion{
+		// Deleted after the time
+		{Key: "server/a", VersionID: "a1", LastModified: at(1), Size: 1},
+		{Key: "server/a", VersionID: "a2", LastModified: at(5), IsLatest: true, DeleteMarker: true},
+		// Overwritten after the time
+		{Key: "server/b", VersionID: "b1", LastModified: at(1), Size: 1},
+		{Key: "server/b", VersionID: "b2", LastModified: at(2), Size: 2},
+		{Key: "server/b", VersionID: "b3", LastModified: at(5), Size: 3, IsLatest: true},
+		// Created after the time
+		{Key: "server/c", VersionID: "c1", LastModified: at(5), Size: 1, IsLatest: true},
+		// Deleted before the time
+		{Key: "server/d", VersionID: "d1", LastModified: at(1), Size: 1},
+		{Key: "server/d", VersionID: "d2", LastModified: at(2), IsLatest: true, DeleteMarker: true},
+		// Unchanged
+		{Key: "server/e", VersionID: "e1", LastModified: at(1), Size: 1, IsLatest: true},
+	}}
+}
+
+func TestListObjectsAt(t *testing.T) {
+	SetSettings(map[string]string{"WALG_READ_AT": versionsTestStart.Add(3 * time.Hour).Format(time.RFC3339)})
+	defer SetSettings(nil)
+	svc := newVersionedS3()
+
+	listed := make([]string, 0)
+	err := listObjectsV2Pages(svc, &s3.ListObjectsV2Input{Bucket: aws.String("bucket"), Prefix: aws.String("server/")},
+		func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, ob := range page.Contents {
+				listed = append(listed, *ob.Key+":"+string('0'+byte(*ob.Size)))
+			}
+			return true
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(listed, " ") != "server/a:1 server/b:2 server/e:1" {
+		t.Fatalf("unexpected listing %v", listed)
+	}
+}
+
+func TestDownloadObjectAt(t *testing.T) {
+	SetSettings(map[string]string{"WALG_READ_AT": versionsTestStart.Add(3 * time.Hour).Format(time.RFC3339)})
+	defer SetSettings(nil)
+	svc := newVersionedS3()
+
+	for _, key := range []string{"server/a", "server/b"} {
+		reader, err := downloadObject(svc, aws.String("bucket"), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader.Close()
+	}
+	if strings.Join(svc.fetched, " ") != "a1 b2" {
+		t.Fatalf("unexpected versions fetched %v", svc.fetched)
+	}
+
+	for _, key := range []string{"server/c", "server/d"} {
+		_, err := downloadObject(svc, aws.String("bucket"), key)
+		if awsErr, ok := err.(awserr.Error); !ok || awsErr.Code() != s3.ErrCodeNoSuchKey {
+			t.Fatalf("absent %s is fetched: %v", key, err)
+		}
+	}
+}
+
+func TestRestoreVersions(t *testing.T) {
+	svc := newVersionedS3()
+	pre := &Prefix{Svc: svc, Bucket: aws.String("bucket"), Server: aws.String("server")}
+
+	if err := restoreVersions(pre, "server/", versionsTestStart.Add(3*time.Hour), true); err != nil || len(svc.copied) != 0 {
+		t.Fatalf("dry run restored objects: %v %v", err, svc.copied)
+	}
+	if err := restoreVersions(pre, "server/", versionsTestStart.Add(3*time.Hour), false); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(svc.copied)
+	if strings.Join(svc.copied, " ") != "bucket/server/a?versionId=a1 bucket/server/b?versionId=b2" {
+		t.Fatalf("unexpected restored versions %v", svc.copied)
+	}
+}
+
+func TestCheckReadAt(t *testing.T) {
+	SetSettings(map[string]string{"WALG_READ_AT": versionsTestStart.Format(time.RFC3339)})
+	defer SetSettings(nil)
+
+	if err := CheckReadAt("backup-fetch"); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckReadAt("delete"); err == nil {
+		t.Fatal("delete is allowed with WALG_READ_AT")
+	}
+}
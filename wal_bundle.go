@@ -0,0 +1,357 @@
+package walg
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+// WalCompactUsage is a text message explaining how to use wal-compact
+var WalCompactUsage = "usage:\twal-g wal-compact [--segments N] [--older-than 1h] [--confirm]" + `
+Bundles runs of consecutive WAL segments archived more than --older-than ago (1h by default) into objects
+of up to N segments (64 by default) and deletes the bundled segments. wal-fetch extracts segments from bundles.
+Without --confirm prints what would be compacted.
+`
+
+// walBundleRegexp matches bundle names, bundle name is the index of segments in it: it holds every segment
+// from the first to the last on one timeline
+var walBundleRegexp = regexp.MustCompile(`^bundle_([0-9A-F]{24})_([0-9A-F]{24})\.tar\.lz4$`)
+
+// WalBundle is an object holding consecutive WAL segments
+type WalBundle struct {
+	Key   string
+	First WalSegmentNo
+	Last  WalSegmentNo
+}
+
+// Contains checks whether segment is in the bundle
+func (bundle WalBundle) Contains(segment WalSegmentNo) bool {
+	return segment.Timeline == bundle.First.Timeline && segment.LogSegNo >= bundle.First.LogSegNo &&
+		segment.LogSegNo <= bundle.Last.LogSegNo
+}
+
+// Segments lists segments of the bundle
+func (bundle WalBundle) Segments() []WalSegmentNo {
+	segments := make([]WalSegmentNo, 0, bundle.Last.LogSegNo-bundle.First.LogSegNo+1)
+	for segNo := bundle.First.LogSegNo; segNo <= bundle.Last.LogSegNo; segNo++ {
+		segments = append(segments, WalSegmentNo{bundle.First.Timeline, segNo})
+	}
+	return segments
+}
+
+// walSegmentObject is archived WAL segment
+type walSegmentObject struct {
+	Segment      WalSegmentNo
+	Key          string
+	LastModified time.Time
+}
+
+func printWalCompactUsageAndFail() {
+	log.Fatal(WalCompactUsage)
+}
+
+// parseWalBundleKey extracts segment range from bundle key
+func parseWalBundleKey(key string) (WalBundle, bool) {
+	match := walBundleRegexp.FindStringSubmatch(path.Base(key))
+	if match == nil {
+		return WalBundle{}, false
+	}
+	firstTimeline, firstSegNo, err := ParseWALFileName(match[1])
+	if err != nil {
+		return WalBundle{}, false
+	}
+	lastTimeline, lastSegNo, err := ParseWALFileName(match[2])
+	if err != nil || lastTimeline != firstTimeline || lastSegNo < firstSegNo {
+		return WalBundle{}, false
+	}
+	return WalBundle{key, WalSegmentNo{firstTimeline, firstSegNo}, WalSegmentNo{lastTimeline, lastSegNo}}, true
+}
+
+func getWalBundleKey(pre *Prefix, first WalSegmentNo, last WalSegmentNo) string {
+	return GetWalFolderPath(pre) + "bundle_" + first.Name() + "_" + last.Name() + ".tar.lz4"
+}
+
+// HandleWalCompact is invoked to perform wal-g wal-compact
+func HandleWalCompact(tu *TarUploader, pre *Prefix, args []string) {
+	maxSegments := 64
+	olderThan := time.Hour
+	confirm := false
+	params := args[1:]
+	for len(params) > 0 {
+		switch params[0] {
+		case "--confirm":
+			confirm = true
+			params = params[1:]
+			continue
+		case "--segments":
+			if len(params) < 2 {
+				printWalCompactUsageAndFail()
+			}
+			var err error
+			if maxSegments, err = strconv.Atoi(params[1]); err != nil || maxSegments < 2 {
+				log.Fatalf("Cannot parse number of segments %v, at least 2 expected\n", params[1])
+			}
+		case "--older-than":
+			if len(params) < 2 {
+				printWalCompactUsageAndFail()
+			}
+			var err error
+			if olderThan, err = ParseAge(params[1]); err != nil || olderThan < 0 {
+				log.Fatalf("Cannot parse age %v\n", params[1])
+			}
+		default:
+			printWalCompactUsageAndFail()
+		}
+		params = params[2:]
+	}
+	if err := CompactWal(tu, pre, maxSegments, time.Now().Add(-olderThan), !confirm); err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+}
+
+// CompactWal uploads bundles first and deletes bundled segments after, so every segment stays fetchable
+func CompactWal(tu *TarUploader, pre *Prefix, maxSegments int, before time.Time, dryRun bool) error {
+	segments := make([]walSegmentObject, 0)
+	err := listAllObjects(pre, GetWalFolderPath(pre), func(ob *s3.Object) {
+		if segment, ok := parseWalSegmentKey(*ob.Key); ok && !strings.Contains(path.Base(*ob.Key), "partial") {
+			segments = append(segments, walSegmentObject{segment, *ob.Key, *ob.LastModified})
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	bundles := planWalBundles(segments, maxSegments, before)
+	compacted := 0
+	for _, bundle := range bundles {
+		compacted += len(bundle)
+	}
+	fmt.Printf("%d segments to compact into %d bundles\n", compacted, len(bundles))
+	if dryRun {
+		fmt.Println("Dry run finished, add --confirm to compact")
+		return nil
+	}
+
+	for _, bundle := range bundles {
+		key := getWalBundleKey(pre, bundle[0].Segment, bundle[len(bundle)-1].Segment)
+		if err = uploadWalBundle(tu, pre, key, bundle); err != nil {
+			return err
+		}
+		keys := make([]string, len(bundle))
+		for i, object := range bundle {
+			keys[i] = object.Key
+		}
+		if err = deleteObjects(pre, partitionToObjects(keys)); err != nil {
+			return err
+		}
+		fmt.Printf("Compacted %d segments into %s\n", len(bundle), path.Base(key))
+	}
+	return nil
+}
+
+// planWalBundles splits segments archived before the time into runs of consecutive segments of one timeline.
+// Segments archived more than once, e.g. lzo and lz4, are left as is.
+func planWalBundles(segments []walSegmentObject, maxSegments int, before time.Time) [][]walSegmentObject {
+	counts := make(map[WalSegmentNo]int)
+	for _, object := range segments {
+		counts[object.Segment]++
+	}
+	candidates := make([]walSegmentObject, 0, len(segments))
+	for _, object := range segments {
+		if counts[object.Segment] == 1 && object.LastModified.Before(before) {
+			candidates = append(candidates, object)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].Segment.Timeline != candidates[j].Segment.Timeline {
+			return candidates[i].Segment.Timeline < candidates[j].Segment.Timeline
+		}
+		return candidates[i].Segment.LogSegNo < candidates[j].Segment.LogSegNo
+	})
+
+	bundles := make([][]walSegmentObject, 0)
+	current := make([]walSegmentObject, 0, maxSegments)
+	flush := func() {
+		if len(current) > 1 {
+			bundles = append(bundles, current)
+		}
+		current = make([]walSegmentObject, 0, maxSegments)
+	}
+	for _, object := range candidates {
+		if len(current) > 0 {
+			previous := current[len(current)-1].Segment
+			if object.Segment.Timeline != previous.Timeline || object.Segment.LogSegNo != previous.LogSegNo+1 || len(current) == maxSegments {
+				flush()
+			}
+		}
+		current = append(current, object)
+	}
+	flush()
+	return bundles
+}
+
+// uploadWalBundle packs decoded segments into tar, compressed and encrypted like backup partitions
+func uploadWalBundle(tu *TarUploader, pre *Prefix, key string, bundle []walSegmentObject) error {
+	pr, pw := io.Pipe()
+	go func() {
+		tarWriter := tar.NewWriter(pw)
+		for _, object := range bundle {
+			reader, err := (&Archive{Prefix: pre, Archive: aws.String(object.Key)}).GetArchive()
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			var segment bytes.Buffer
+			err = decodeObject(&segment, reader, object.Key)
+			reader.Close()
+			if err != nil {
+				pw.CloseWithError(errors.Wrapf(err, "uploadWalBundle: failed to decode %s", object.Key))
+				return
+			}
+			hdr := &tar.Header{Name: object.Segment.Name(), Mode: 0600, Size: int64(segment.Len()), ModTime: object.LastModified}
+			if err = tarWriter.WriteHeader(hdr); err == nil {
+				_, err = io.Copy(tarWriter, &segment)
+			}
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.CloseWithError(tarWriter.Close())
+	}()
+	defer pr.Close()
+
+	lz := &LzPipeWriter{Input: pr}
+	lz.Compress(&OpenPGPCrypter{})
+	err := tu.upload(tu.createUploadInput(key, lz.Output), key)
+	return errors.Wrapf(err, "uploadWalBundle: failed to upload %s", key)
+}
+
+// listWalBundles lists bundles made by wal-compact
+func listWalBundles(pre *Prefix) ([]WalBundle, error) {
+	bundles := make([]WalBundle, 0)
+	err := listAllObjects(pre, GetWalFolderPath(pre)+"bundle_", func(ob *s3.Object) {
+		if bundle, ok := parseWalBundleKey(*ob.Key); ok {
+			bundles = append(bundles, bundle)
+		}
+	})
+	return bundles, err
+}
+
+// fetchWalFromBundle extracts segment from its bundle. Following segments of the bundle are put into prefetch
+// directory, so recovery downloads each bundle once. Returns false if no bundle holds the segment.
+func fetchWalFromBundle(pre *Prefix, walFileName string, location string) (bool, error) {
+	return readWalFromBundle(pre, walFileName, location, func(segment io.Reader) error {
+		return writeWalFile(location, segment)
+	})
+}
+
+// readWalFromBundle passes segment from its bundle to write. Following segments are prefetched next to location,
+// empty location disables prefetch.
+func readWalFromBundle(pre *Prefix, walFileName string, location string, write func(io.Reader) error) (bool, error) {
+	timeline, logSegNo, err := ParseWALFileName(walFileName)
+	if err != nil {
+		return false, nil
+	}
+	segment := WalSegmentNo{timeline, logSegNo}
+	bundles, err := listWalBundles(pre)
+	if err != nil {
+		return false, err
+	}
+	for _, bundle := range bundles {
+		if bundle.Contains(segment) {
+			return true, extractWalBundle(pre, bundle, walFileName, location, write)
+		}
+	}
+	return false, nil
+}
+
+func extractWalBundle(pre *Prefix, bundle WalBundle, walFileName string, location string, write func(io.Reader) error) error {
+	reader, err := (&Archive{Prefix: pre, Archive: aws.String(bundle.Key)}).GetArchive()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(decodeObject(pw, reader, bundle.Key))
+	}()
+	defer pr.Close()
+
+	prefetchLocation, runningLocation := "", ""
+	if location != "" {
+		prefetchLocation, runningLocation = getBundlePrefetchLocations(location)
+	}
+	found := false
+	tarReader := tar.NewReader(pr)
+	for {
+		hdr, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrapf(err, "extractWalBundle: failed to read %s", bundle.Key)
+		}
+		if hdr.Name == walFileName {
+			if err = write(tarReader); err != nil {
+				return err
+			}
+			found = true
+		} else if found && prefetchLocation != "" {
+			// Prefetch failures are not fatal, segment will be fetched from bundle again
+			prefetched := filepath.Join(prefetchLocation, hdr.Name)
+			if _, err = os.Stat(prefetched); os.IsNotExist(err) {
+				running := filepath.Join(runningLocation, hdr.Name)
+				if os.MkdirAll(runningLocation, 0755) == nil && writeWalFile(running, tarReader) == nil {
+					os.Rename(running, prefetched)
+				}
+			}
+		}
+	}
+	if !found {
+		return errors.Errorf("extractWalBundle: %s is not found in %s", walFileName, bundle.Key)
+	}
+	return nil
+}
+
+// getBundlePrefetchLocations gets prefetch directories for location of wal-fetch or wal-prefetch
+func getBundlePrefetchLocations(location string) (prefetchLocation string, runningLocation string) {
+	dir := filepath.Dir(location)
+	if filepath.Base(dir) == "running" && strings.HasSuffix(filepath.Dir(dir), filepath.Join(".wal-g", "prefetch")) {
+		return filepath.Dir(dir), dir
+	}
+	prefetchLocation, runningLocation, _, _ = getPrefetchLocations(dir, "")
+	return prefetchLocation, runningLocation
+}
+
+func writeWalFile(location string, reader io.Reader) error {
+	file, err := os.OpenFile(location, os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, reader)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = syncFetchedWalFile(location)
+	}
+	if err != nil {
+		os.Remove(location)
+	}
+	return err
+}
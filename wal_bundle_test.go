@@ -0,0 +1,61 @@
+package walg
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseWalBundleKey(t *testing.T) {
+	bundle, ok := parseWalBundleKey("server/wal_005/bundle_000000010000000000000002_000000010000000000000005.tar.lz4")
+	if !ok || bundle.First != (WalSegmentNo{1, 2}) || bundle.Last != (WalSegmentNo{1, 5}) || len(bundle.Segments()) != 4 {
+		t.Fatalf("Unexpected bundle %+v", bundle)
+	}
+	if !bundle.Contains(WalSegmentNo{1, 5}) || bundle.Contains(WalSegmentNo{1, 6}) || bundle.Contains(WalSegmentNo{2, 3}) {
+		t.Fatal("Unexpected bundle contents")
+	}
+
+	for _, key := range []string{
+		"server/wal_005/000000010000000000000002.lz4",
+		"server/wal_005/bundle_000000010000000000000005_000000010000000000000002.tar.lz4",
+		"server/wal_005/bundle_000000010000000000000002_000000020000000000000005.tar.lz4",
+	} {
+		if _, ok := parseWalBundleKey(key); ok {
+			t.Errorf("%s is not a bundle", key)
+		}
+	}
+}
+
+func TestPlanWalBundles(t *testing.T) {
+	now := time.Now()
+	old := now.Add(-2 * time.Hour)
+	objects := []walSegmentObject{
+		{WalSegmentNo{1, 1}, "1", old},
+		{WalSegmentNo{1, 2}, "2", old},
+		{WalSegmentNo{1, 3}, "3", old},
+		{WalSegmentNo{1, 4}, "4", old},
+		{WalSegmentNo{1, 6}, "6", old},
+		{WalSegmentNo{1, 7}, "7", old},
+		{WalSegmentNo{2, 8}, "8", old},
+		{WalSegmentNo{2, 9}, "9", old},
+		{WalSegmentNo{2, 9}, "9.lzo", old},
+		{WalSegmentNo{2, 10}, "10", old},
+		{WalSegmentNo{2, 11}, "11", old},
+		{WalSegmentNo{2, 12}, "12", now},
+	}
+
+	bundles := planWalBundles(objects, 3, now.Add(-time.Hour))
+	expected := [][]string{{"1", "2", "3"}, {"6", "7"}, {"10", "11"}}
+	if len(bundles) != len(expected) {
+		t.Fatalf("Unexpected bundles %v", bundles)
+	}
+	for i, bundle := range bundles {
+		if len(bundle) != len(expected[i]) {
+			t.Fatalf("Unexpected bundle %v", bundle)
+		}
+		for j, object := range bundle {
+			if object.Key != expected[i][j] {
+				t.Errorf("Unexpected bundle %v", bundle)
+			}
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package walg
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+// WalDumpUsage is a text message explaining how to use wal-dump
+var WalDumpUsage = "usage:\twal-g wal-dump segment_name" + `
+	wal-g wal-dump start_lsn end_lsn [--timeline N]
+Fetches WAL segments from the archive into a temporary directory and decodes them with pg_waldump
+(WALG_PG_WALDUMP, pg_waldump or pg_xlogdump from PATH). Without pg_waldump records are listed by WAL-G
+with resource manager, length, transaction and LSN only. Timeline of LSN range defaults to the newest
+archived timeline holding the start LSN.
+`
+
+// walRmgrNames are resource manager names by id, rmgrlist.h
+var walRmgrNames = []string{"XLOG", "Transaction", "Storage", "CLOG", "Database", "Tablespace", "MultiXact",
+	"RelMap", "Standby", "Heap2", "Heap", "Btree", "Hash", "Gin", "Gist", "Sequence", "SPGist", "BRIN",
+	"CommitTs", "ReplicationOrigin", "Generic", "LogicalMessage"}
+
+func printWalDumpUsageAndFail() {
+	log.Fatal(WalDumpUsage)
+}
+
+// walDumpRange is a range of LSN on one timeline, end is exclusive
+type walDumpRange struct {
+	timeline uint32
+	start    uint64
+	end      uint64
+	segment  string // set when whole segment is dumped
+}
+
+// HandleWalDump is invoked to perform wal-g wal-dump
+func HandleWalDump(pre *Prefix, args []string) {
+	dumpRange, err := parseWalDumpArguments(args)
+	if err != nil {
+		log.Println(err)
+		printWalDumpUsageAndFail()
+	}
+	if err = DumpWal(pre, dumpRange, os.Stdout); err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+}
+
+func parseWalDumpArguments(args []string) (walDumpRange, error) {
+	if len(args) == 2 {
+		timeline, _, err := ParseWALFileName(args[1])
+		if err != nil {
+			return walDumpRange{}, err
+		}
+		return walDumpRange{timeline: timeline, segment: args[1]}, nil
+	}
+	if len(args) != 3 && len(args) != 5 {
+		return walDumpRange{}, errors.New("wrong number of arguments")
+	}
+	start, err := ParseLsn(args[1])
+	if err != nil {
+		return walDumpRange{}, err
+	}
+	end, err := ParseLsn(args[2])
+	if err != nil {
+		return walDumpRange{}, err
+	}
+	if end <= start {
+		return walDumpRange{}, errors.New("end LSN must be after start LSN")
+	}
+	if len(args) == 5 {
+		if args[3] != "--timeline" {
+			return walDumpRange{}, errors.Errorf("unknown option %s", args[3])
+		}
+		timeline, err := strconv.ParseUint(args[4], 10, 32)
+		if err != nil {
+			return walDumpRange{}, errors.Wrap(err, "invalid timeline")
+		}
+		return walDumpRange{timeline: uint32(timeline), start: start, end: end}, nil
+	}
+	return walDumpRange{start: start, end: end}, nil
+}
+
+// archivedSegmentRegexp matches names of compressed segment archives. Names are not parsed, logical segment
+// numbers depend on segment size which is not known yet.
+var archivedSegmentRegexp = regexp.MustCompile(`^([0-9A-F]{24})\.[0-9a-z]+$`)
+
+// detectArchivedWalSegmentSize fetches a segment archived in the prefix to read segment size from its header,
+// names of segments holding LSN of the range depend on it. Default size is kept if no segment is archived.
+func detectArchivedWalSegmentSize(pre *Prefix, dir string) error {
+	segment := ""
+	err := listWalObjects(pre, GetWalFolderPath(pre), func(files *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, ob := range files.Contents {
+			if match := archivedSegmentRegexp.FindStringSubmatch(path.Base(*ob.Key)); match != nil {
+				segment = match[1]
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return errors.Wrap(err, "detectArchivedWalSegmentSize: s3.ListObjectsV2 failed")
+	}
+	if segment == "" {
+		return nil
+	}
+	location := filepath.Join(dir, segment)
+	if err = FetchWALFile(pre, segment, location); err != nil {
+		return err
+	}
+	detectWalSegmentSize(location)
+	return os.Remove(location)
+}
+
+// findArchivedTimeline finds the newest timeline with the segment in the archive
+func findArchivedTimeline(pre *Prefix, logSegNo uint64) (uint32, error) {
+	segments, err := ListWalSegments(pre)
+	if err != nil {
+		return 0, err
+	}
+	timeline := uint32(0)
+	for _, segment := range segments {
+		if segment.LogSegNo == logSegNo && segment.Timeline > timeline {
+			timeline = segment.Timeline
+		}
+	}
+	if timeline == 0 {
+		return 0, errors.Wrapf(ErrWalNotFound, "findArchivedTimeline: segment of LSN %s", FormatLsn(logSegNo*GetWalSegmentSize()))
+	}
+	return timeline, nil
+}
+
+// DumpWal fetches segments of the range into temporary directory and decodes them to output. Zero timeline of
+// LSN range stands for the newest archived timeline holding the start LSN.
+func DumpWal(pre *Prefix, dumpRange walDumpRange, output io.Writer) error {
+	dir, err := createTempDir("wal-g-wal-dump")
+	if err != nil {
+		return errors.Wrap(err, "DumpWal: unable to create temporary directory")
+	}
+	defer os.RemoveAll(dir)
+
+	if dumpRange.segment == "" {
+		if err = detectArchivedWalSegmentSize(pre, dir); err != nil {
+			return err
+		}
+		if dumpRange.timeline == 0 {
+			dumpRange.timeline, err = findArchivedTimeline(pre, dumpRange.start/GetWalSegmentSize())
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	segments, err := fetchWalDumpSegments(pre, dumpRange, dir)
+	if err != nil {
+		return err
+	}
+
+	if waldump, err := findPgWaldump(); err == nil {
+		cmdArgs := []string{filepath.Join(dir, dumpRange.segment)}
+		if dumpRange.segment == "" {
+			cmdArgs = []string{"-p", dir, "-t", strconv.FormatUint(uint64(dumpRange.timeline), 10),
+				"-s", FormatLsn(dumpRange.start), "-e", FormatLsn(dumpRange.end)}
+		}
+		cmd := exec.Command(waldump, cmdArgs...)
+		cmd.Stdout = output
+		cmd.Stderr = os.Stderr
+		return errors.Wrapf(cmd.Run(), "DumpWal: %s failed", waldump)
+	}
+
+	log.Println("pg_waldump is not found, records are listed without decoding")
+	for _, segment := range segments {
+		if err = listWalRecords(filepath.Join(dir, segment), dumpRange, output); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fetchWalDumpSegments fetches the dumped segment or segments of the range, size of the dumped segment is taken
+// from its header
+func fetchWalDumpSegments(pre *Prefix, dumpRange walDumpRange, dir string) ([]string, error) {
+	if dumpRange.segment != "" {
+		location := filepath.Join(dir, dumpRange.segment)
+		if err := FetchWALFile(pre, dumpRange.segment, location); err != nil {
+			return nil, err
+		}
+		detectWalSegmentSize(location)
+		return []string{dumpRange.segment}, nil
+	}
+	segments := make([]string, 0)
+	for logSegNo := dumpRange.start / GetWalSegmentSize(); logSegNo <= (dumpRange.end-1)/GetWalSegmentSize(); logSegNo++ {
+		segment := formatWALFileName(dumpRange.timeline, logSegNo)
+		if err := FetchWALFile(pre, segment, filepath.Join(dir, segment)); err != nil {
+			return nil, err
+		}
+		segments = append(segments, segment)
+	}
+	return segments, nil
+}
+
+// findPgWaldump finds WALG_PG_WALDUMP, pg_waldump or pg_xlogdump of PostgreSQL before 10
+func findPgWaldump() (string, error) {
+	if waldump, ok := lookupSetting("WALG_PG_WALDUMP"); ok {
+		return waldump, nil
+	}
+	waldump, err := exec.LookPath("pg_waldump")
+	if err != nil {
+		waldump, err = exec.LookPath("pg_xlogdump")
+	}
+	return waldump, err
+}
+
+// listWalRecords prints records of the segment file which start inside of the range
+func listWalRecords(location string, dumpRange walDumpRange, output io.Writer) error {
+	data, err := ioutil.ReadFile(location)
+	if err != nil {
+		return errors.Wrapf(err, "listWalRecords: failed to read %s", location)
+	}
+	_, logSegNo, err := ParseWALFileName(filepath.Base(location))
+	if err != nil {
+		return err
+	}
+	_, err = walkWalRecords(data, logSegNo*GetWalSegmentSize(), func(lsn uint64, header []byte, body []byte) {
+		if dumpRange.segment == "" && (lsn < dumpRange.start || lsn >= dumpRange.end) {
+			return
+		}
+		rmgr := strconv.Itoa(int(header[17]))
+		if int(header[17]) < len(walRmgrNames) {
+			rmgr = walRmgrNames[header[17]]
+		}
+		fmt.Fprintf(output, "rmgr: %-11s len (tot): %6d, tx: %10d, lsn: %s, prev %s, info: %02X\n", rmgr,
+			binary.LittleEndian.Uint32(header[0:4]), binary.LittleEndian.Uint32(header[4:8]),
+			FormatLsn(lsn), FormatLsn(binary.LittleEndian.Uint64(header[8:16])), header[16])
+	})
+	return errors.Wrapf(err, "listWalRecords: %s is corrupt", location)
+}
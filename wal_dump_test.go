@@ -0,0 +1,34 @@
+package walg
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestDetectArchivedWalSegmentSize(t *testing.T) {
+	defer SetWalSegmentSize(WalSegmentSize)
+	header := make([]byte, xlogLongPageHeaderLen)
+	binary.LittleEndian.PutUint16(header[2:4], xlpLongHeader)
+	binary.LittleEndian.PutUint32(header[32:36], 64*1024*1024)
+	svc := &walObjectsS3{objects: map[string][]byte{
+		"server/wal_005/00000002.history.gz":         gzipTestContent([]byte("1\t0/3000000\tno recovery target specified\n")),
+		"server/wal_005/000000010000000000000003.gz": gzipTestContent(header),
+	}}
+	pre := &Prefix{Svc: svc, Bucket: aws.String("bucket"), Server: aws.String("server")}
+
+	dir, err := ioutil.TempDir("", "wal-g-wal-dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = detectArchivedWalSegmentSize(pre, dir); err != nil {
+		t.Fatalf("detectArchivedWalSegmentSize: %+v", err)
+	}
+	if GetWalSegmentSize() != 64*1024*1024 {
+		t.Errorf("detectArchivedWalSegmentSize: segment size %d, expected 64MB", GetWalSegmentSize())
+	}
+}
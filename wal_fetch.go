@@ -0,0 +1,149 @@
+package walg
+
+import (
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrWalNotFound happens when WAL file is not in storage, which is expected at the end of archive recovery
+var ErrWalNotFound = errors.New("WAL file not found")
+
+// walFetchNotFoundExitCode tells restore_command caller that WAL file is absent
+const walFetchNotFoundExitCode = 1
+
+// defaultWalFetchErrorExitCode tells restore_command caller that wal-fetch failed for another reason
+const defaultWalFetchErrorExitCode = 2
+
+// getWalFetchErrorExitCode reads WALG_WAL_FETCH_ERROR_EXIT_CODE. PostgreSQL treats any exit code up to 125
+// as a missing file and ends recovery, codes above 125 make it abort recovery instead.
+func getWalFetchErrorExitCode() int {
+	codeStr, ok := lookupSetting("WALG_WAL_FETCH_ERROR_EXIT_CODE")
+	if !ok {
+		return defaultWalFetchErrorExitCode
+	}
+	code, err := strconv.Atoi(codeStr)
+	if err != nil || code <= walFetchNotFoundExitCode || code > 255 {
+		// Failing here would exit with the code of missing file
+		log.Printf("ERROR: invalid WALG_WAL_FETCH_ERROR_EXIT_CODE %v, expected 2..255\n", codeStr)
+		return defaultWalFetchErrorExitCode
+	}
+	return code
+}
+
+// exitOnWalFetchError exits with the code of missing file or of failure, nothing is done on success
+func exitOnWalFetchError(walFileName string, err error) {
+	if errors.Cause(err) == ErrWalNotFound {
+		// This is expected at the end of archive recovery
+		log.Printf("Archive '%s' does not exist.\n", walFileName)
+		EmitEvent(Event{Event: EventFailed, Object: walFileName, Error: ErrWalNotFound.Error()})
+		os.Exit(walFetchNotFoundExitCode)
+	}
+	if err != nil {
+		FailWalFetch(walFileName, err)
+	}
+}
+
+// FailWalFetch reports failure of wal-fetch which is not a missing file, e.g. network, credentials
+// or corrupt object, and exits with the code distinct from missing file
+func FailWalFetch(walFileName string, err error) {
+	log.Printf("ERROR: wal-fetch of %s failed, the file may exist in storage: %+v\n", walFileName, err)
+	EmitEvent(Event{Event: EventFailed, Object: walFileName, Error: err.Error()})
+	os.Exit(getWalFetchErrorExitCode())
+}
+
+// walFetchMaxPollInterval limits backoff between checks for a segment which is not archived yet
+const walFetchMaxPollInterval = 10 * time.Second
+
+// getWalFetchWait reads WALG_WAL_FETCH_WAIT, Go duration or number of seconds
+func getWalFetchWait() (time.Duration, error) {
+	waitStr, ok := lookupSetting("WALG_WAL_FETCH_WAIT")
+	if !ok {
+		return 0, nil
+	}
+	if seconds, err := strconv.Atoi(waitStr); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	wait, err := time.ParseDuration(waitStr)
+	if err != nil || wait < 0 {
+		return 0, errors.Errorf("getWalFetchWait: invalid WALG_WAL_FETCH_WAIT '%s'", waitStr)
+	}
+	return wait, nil
+}
+
+// fetchWALFileWaiting polls storage for WAL segment which is not archived yet until wait expires, so standby
+// restoring from archive rides over archiving lag. History and other files are not waited for, PostgreSQL
+// probes them expecting them to be absent. Segment missing after the wait may be taken from its partial file.
+func fetchWALFileWaiting(pre *Prefix, walFileName string, location string, wait time.Duration) error {
+	deadline := time.Now().Add(wait)
+	interval := time.Second
+	for {
+		err := FetchWALFile(pre, walFileName, location)
+		if errors.Cause(err) != ErrWalNotFound || !isWalSegmentName(walFileName) {
+			return err
+		}
+		if !time.Now().Before(deadline) {
+			return fetchPartialWALFile(walFileName, err, func(partialName string) error {
+				return FetchWALFile(pre, partialName, location)
+			})
+		}
+		sleep := interval
+		if remaining := deadline.Sub(time.Now()); remaining < sleep {
+			sleep = remaining
+		}
+		time.Sleep(sleep)
+		interval *= 2
+		if interval > walFetchMaxPollInterval {
+			interval = walFetchMaxPollInterval
+		}
+	}
+}
+
+func isWalSegmentName(walFileName string) bool {
+	_, _, err := ParseWALFileName(walFileName)
+	return err == nil
+}
+
+// timelineHistoryRegexp matches names of timeline history files written at promotion, e.g. 00000002.history
+var timelineHistoryRegexp = regexp.MustCompile(`^[0-9A-F]{8}\.history$`)
+
+// partialWalSuffix is appended to the last segment of a timeline on promotion and by pg_receivewal
+// to the segment being streamed
+const partialWalSuffix = ".partial"
+
+// fetchPartialFallback reads WALG_WAL_FETCH_PARTIAL
+func fetchPartialFallback() bool {
+	partialStr, ok := lookupSetting("WALG_WAL_FETCH_PARTIAL")
+	if !ok {
+		return false
+	}
+	partial, err := strconv.ParseBool(partialStr)
+	if err != nil {
+		log.Fatalf("Unable to parse WALG_WAL_FETCH_PARTIAL %v\n", err)
+	}
+	return partial
+}
+
+// fetchPartialWALFile fetches partial file of segment which is not archived with fetch when
+// WALG_WAL_FETCH_PARTIAL is set, notFound is returned otherwise or when partial file is not archived either
+func fetchPartialWALFile(walFileName string, notFound error, fetch func(partialName string) error) error {
+	if !fetchPartialFallback() {
+		return notFound
+	}
+	err := fetch(walFileName + partialWalSuffix)
+	if errors.Cause(err) == ErrWalNotFound {
+		return notFound
+	}
+	if err == nil {
+		log.Printf("WARNING! %s is not archived, fetched its partial file instead\n", walFileName)
+	}
+	return err
+}
+
+func isTimelineHistoryName(walFileName string) bool {
+	return timelineHistoryRegexp.MatchString(walFileName)
+}
@@ -0,0 +1,139 @@
+package walg
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// WalFetchRangeUsage is a text message explaining how to use wal-fetch-range
+var WalFetchRangeUsage = "usage:\twal-g wal-fetch-range start_segment end_segment directory" + `
+Fetches segments from start_segment to end_segment inclusive into directory with WALG_DOWNLOAD_CONCURRENCY
+downloads at once, e.g. to feed a recovery sandbox or forensic analysis. Segment names follow the history of the
+timeline of end_segment, so a range may cross timeline switches; the history file is put into directory too.
+Segments already present in directory with full size are kept. Fails if any segment of the range is missing.
+`
+
+func printWalFetchRangeUsageAndFail() {
+	log.Fatal(WalFetchRangeUsage)
+}
+
+// HandleWalFetchRange is invoked to perform wal-g wal-fetch-range
+func HandleWalFetchRange(pre *Prefix, args []string) {
+	if len(args) != 4 {
+		printWalFetchRangeUsageAndFail()
+	}
+	for _, name := range args[1:3] {
+		if _, _, err := ParseWALFileName(name); err != nil {
+			log.Println(err)
+			printWalFetchRangeUsageAndFail()
+		}
+	}
+	if err := FetchWalRange(pre, args[1], args[2], args[3]); err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+}
+
+// FetchWalRange fetches contiguous range of segments into directory. Names are parsed after the start segment is
+// fetched, because logical segment numbers depend on segment size recorded in its header.
+func FetchWalRange(pre *Prefix, startSegment string, endSegment string, dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errors.Wrapf(err, "FetchWalRange: unable to create %s", dir)
+	}
+	if err := fetchRangeSegment(pre, startSegment, dir); err != nil {
+		return err
+	}
+	detectWalSegmentSize(filepath.Join(dir, startSegment))
+
+	startTimeline, start, err := ParseWALFileName(startSegment)
+	if err != nil {
+		return err
+	}
+	timeline, end, err := ParseWALFileName(endSegment)
+	if err != nil {
+		return err
+	}
+	if end < start {
+		return errors.Errorf("FetchWalRange: %s is before %s", endSegment, startSegment)
+	}
+	history, err := fetchTimelineHistory(pre, timeline, dir)
+	if err != nil {
+		return err
+	}
+	segments := walRangeSegments(timeline, history, start, end)
+	if segments[0] != startSegment {
+		log.Printf("WARNING! %s of timeline %d is not in history of timeline %d, %s is fetched too\n",
+			startSegment, startTimeline, timeline, segments[0])
+	}
+
+	failed, err := fetchRangeSegments(pre, segments, dir, getMaxDownloadConcurrency(8))
+	if err != nil {
+		return errors.Wrapf(err, "FetchWalRange: %d of %d segments are not fetched", failed, len(segments))
+	}
+	fmt.Printf("%d segments fetched into %s\n", len(segments), dir)
+	return nil
+}
+
+// walRangeSegments names segments from start to end inclusive on the timeline and its ancestors
+func walRangeSegments(timeline uint32, history []TimelineSwitch, start uint64, end uint64) []string {
+	segments := make([]string, 0, end-start+1)
+	for logSegNo := start; logSegNo <= end; logSegNo++ {
+		segments = append(segments, formatWALFileName(timelineOfSegment(timeline, history, logSegNo), logSegNo))
+	}
+	return segments
+}
+
+// fetchRangeSegments fetches segments by concurrent workers, number of failed segments and the first failure
+// are returned. Workers do not stop on failure, so one run fetches everything available.
+func fetchRangeSegments(pre *Prefix, segments []string, dir string, concurrency int) (int, error) {
+	names := make(chan string)
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var firstErr error
+	failed := 0
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range names {
+				if err := fetchRangeSegment(pre, name, dir); err != nil {
+					log.Printf("ERROR: %v\n", err)
+					mutex.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					failed++
+					mutex.Unlock()
+				}
+			}
+		}()
+	}
+	for _, name := range segments {
+		names <- name
+	}
+	close(names)
+	wg.Wait()
+	return failed, firstErr
+}
+
+// fetchRangeSegment fetches segment unless directory has it with full size, partially written segment never
+// has the final name
+func fetchRangeSegment(pre *Prefix, name string, dir string) error {
+	location := filepath.Join(dir, name)
+	if stat, err := os.Stat(location); err == nil && uint64(stat.Size()) == GetWalSegmentSize() {
+		return nil
+	}
+	if err := FetchWALFile(pre, name, location+".wal-g-range"); err != nil {
+		os.Remove(location + ".wal-g-range")
+		return err
+	}
+	if err := os.Rename(location+".wal-g-range", location); err != nil {
+		return errors.Wrapf(err, "fetchRangeSegment: unable to move %s into place", name)
+	}
+	infoln("Fetched", name)
+	return nil
+}
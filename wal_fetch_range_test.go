@@ -0,0 +1,18 @@
+package walg
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestWalRangeSegments(t *testing.T) {
+	history := []TimelineSwitch{{1, 0x5000098}}
+	segments := walRangeSegments(2, history, 3, 6)
+	expected := []string{"000000010000000000000003", "000000010000000000000004", "000000020000000000000005", "000000020000000000000006"}
+	if !reflect.DeepEqual(segments, expected) {
+		t.Fatalf("Wrong segments %v", segments)
+	}
+	if segments = walRangeSegments(1, nil, 0xFF, 0x100); !reflect.DeepEqual(segments, []string{"0000000100000000000000FF", "000000010000000100000000"}) {
+		t.Fatalf("Wrong segments across xlogid %v", segments)
+	}
+}
@@ -0,0 +1,177 @@
+package walg
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/pkg/errors"
+)
+
+// walObjectsS3 serves objects by key, missing objects are not found
+type walObjectsS3 struct {
+	s3iface.S3API
+	objects map[string][]byte
+}
+
+func (m *walObjectsS3) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	content, ok := m.objects[*input.Key]
+	if !ok {
+		return nil, awserr.New("NotFound", "Not Found", nil)
+	}
+	return &s3.HeadObjectOutput{ContentLength: aws.Int64(int64(len(content)))}, nil
+}
+
+func (m *walObjectsS3) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	content, ok := m.objects[*input.Key]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist.", nil)
+	}
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewReader(content))}, nil
+}
+
+func (m *walObjectsS3) ListObjectsV2Pages(input *s3.ListObjectsV2Input, callback func(*s3.ListObjectsV2Output, bool) bool) error {
+	output := &s3.ListObjectsV2Output{}
+	for key, content := range m.objects {
+		if strings.HasPrefix(key, *input.Prefix) {
+			output.Contents = append(output.Contents, &s3.Object{Key: aws.String(key), Size: aws.Int64(int64(len(content)))})
+		}
+	}
+	callback(output, true)
+	return nil
+}
+
+// gzipTestContent compresses content the way WAL-E archives WAL
+func gzipTestContent(content []byte) []byte {
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write(content)
+	gz.Close()
+	return compressed.Bytes()
+}
+
+func TestFetchGzipWALFile(t *testing.T) {
+	history := []byte("1\t0/3000000\tno recovery target specified\n")
+	svc := &walObjectsS3{objects: map[string][]byte{"server/wal_005/00000002.history.gz": gzipTestContent(history)}}
+	pre := &Prefix{Svc: svc, Bucket: aws.String("bucket"), Server: aws.String("server")}
+
+	dir, err := ioutil.TempDir("", "wal-g-fetch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	location := filepath.Join(dir, "00000002.history")
+	if err = FetchWALFile(pre, "00000002.history", location); err != nil {
+		t.Fatalf("FetchWALFile: %+v", err)
+	}
+	if content, _ := ioutil.ReadFile(location); !bytes.Equal(content, history) {
+		t.Errorf("FetchWALFile: unexpected content %q", content)
+	}
+}
+
+func TestGetWalFetchErrorExitCode(t *testing.T) {
+	defer os.Unsetenv("WALG_WAL_FETCH_ERROR_EXIT_CODE")
+	for value, expected := range map[string]int{"": 2, "3": 3, "255": 255, "1": 2, "256": 2, "abc": 2} {
+		if value == "" {
+			os.Unsetenv("WALG_WAL_FETCH_ERROR_EXIT_CODE")
+		} else {
+			os.Setenv("WALG_WAL_FETCH_ERROR_EXIT_CODE", value)
+		}
+		if code := getWalFetchErrorExitCode(); code != expected {
+			t.Errorf("getWalFetchErrorExitCode: %v for '%v', expected %v", code, value, expected)
+		}
+	}
+}
+
+func TestGetWalFetchWait(t *testing.T) {
+	defer os.Unsetenv("WALG_WAL_FETCH_WAIT")
+	for value, expected := range map[string]time.Duration{"30": 30 * time.Second, "2m": 2 * time.Minute, "0": 0} {
+		os.Setenv("WALG_WAL_FETCH_WAIT", value)
+		if wait, err := getWalFetchWait(); err != nil || wait != expected {
+			t.Errorf("getWalFetchWait: %v, %v for '%v', expected %v", wait, err, value, expected)
+		}
+	}
+	os.Setenv("WALG_WAL_FETCH_WAIT", "-1s")
+	if _, err := getWalFetchWait(); err == nil {
+		t.Error("getWalFetchWait: negative wait is accepted")
+	}
+}
+
+func TestGetWalsKeepsTimelineHistory(t *testing.T) {
+	svc := &listObjectsS3{objects: map[string]int64{
+		"server/wal_005/000000010000000000000002.lz4":                 1,
+		"server/wal_005/000000010000000000000002.00000028.backup.lz4": 1,
+		"server/wal_005/00000002.history.lz4":                         1,
+		"server/wal_005/000000020000000000000003.lz4":                 1,
+		"server/wal_005/000000030000000000000004.lz4":                 1,
+	}}
+	pre := &Prefix{Svc: svc, Bucket: aws.String("bucket"), Server: aws.String("server")}
+	bk := &Backup{Prefix: pre, Path: aws.String(GetWalFolderPath(pre))}
+
+	objects, err := bk.GetWals("000000030000000000000004")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted := make(map[string]bool)
+	for _, object := range objects {
+		deleted[*object.Key] = true
+	}
+	if len(deleted) != 3 || deleted["server/wal_005/00000002.history.lz4"] {
+		t.Errorf("GetWals: unexpected objects to delete %v", deleted)
+	}
+}
+
+func TestFetchPartialWALFileDisabled(t *testing.T) {
+	defer os.Unsetenv("WALG_WAL_FETCH_PARTIAL")
+	notFound := errors.Wrap(ErrWalNotFound, "FetchWALFile: 000000010000000000000002")
+	for _, value := range []string{"", "false"} {
+		if value == "" {
+			os.Unsetenv("WALG_WAL_FETCH_PARTIAL")
+		} else {
+			os.Setenv("WALG_WAL_FETCH_PARTIAL", value)
+		}
+		// Storage is not touched unless fallback is enabled
+		if err := fetchPartialWALFile("000000010000000000000002", notFound, nil); err != notFound {
+			t.Errorf("fetchPartialWALFile: %v for '%v', expected %v", err, value, notFound)
+		}
+	}
+	os.Setenv("WALG_WAL_FETCH_PARTIAL", "true")
+	if !fetchPartialFallback() {
+		t.Error("fetchPartialFallback: WALG_WAL_FETCH_PARTIAL=true is ignored")
+	}
+}
+
+func TestFetchPartialWALFile(t *testing.T) {
+	SetSettings(map[string]string{"WALG_WAL_FETCH_PARTIAL": "true"})
+	defer SetSettings(nil)
+	partial := []byte("streamed part of segment")
+	svc := &walObjectsS3{objects: map[string][]byte{"server/wal_005/000000010000000000000002.partial.gz": gzipTestContent(partial)}}
+	pre := &Prefix{Svc: svc, Bucket: aws.String("bucket"), Server: aws.String("server")}
+
+	dir, err := ioutil.TempDir("", "wal-g-fetch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	location := filepath.Join(dir, "000000010000000000000002")
+	if err = fetchWALFileWaiting(pre, "000000010000000000000002", location, 0); err != nil {
+		t.Fatalf("fetchWALFileWaiting: %+v", err)
+	}
+	if content, _ := ioutil.ReadFile(location); !bytes.Equal(content, partial) {
+		t.Errorf("fetchWALFileWaiting: partial file is not fetched, got %q", content)
+	}
+
+	err = fetchWALFileWaiting(pre, "000000010000000000000003", filepath.Join(dir, "000000010000000000000003"), 0)
+	if errors.Cause(err) != ErrWalNotFound {
+		t.Errorf("fetchWALFileWaiting: %v for segment without partial file, expected %v", err, ErrWalNotFound)
+	}
+}
@@ -0,0 +1,113 @@
+package walg
+
+import (
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+// WalSegmentNo identifies WAL segment by timeline and segment number
+type WalSegmentNo struct {
+	Timeline uint32
+	LogSegNo uint64
+}
+
+// Name formats WAL file name of the segment
+func (s WalSegmentNo) Name() string {
+	return formatWALFileName(s.Timeline, s.LogSegNo)
+}
+
+// parseWalSegmentKey extracts segment from key like server/wal_005/000000010000000000000002.lz4.
+// History, backup label and partial files are not segments.
+func parseWalSegmentKey(key string) (WalSegmentNo, bool) {
+	parts := strings.SplitN(path.Base(key), ".", 2)
+	if len(parts) == 2 && strings.Contains(parts[1], ".") {
+		return WalSegmentNo{}, false
+	}
+	timeline, logSegNo, err := ParseWALFileName(parts[0])
+	if err != nil {
+		return WalSegmentNo{}, false
+	}
+	return WalSegmentNo{timeline, logSegNo}, true
+}
+
+// GetWalFolderPath gets path for WAL segments in a bucket
+func GetWalFolderPath(pre *Prefix) string {
+	return walFolderPath(*pre.Server)
+}
+
+// ListWalSegments lists all WAL segments archived in the prefix
+func ListWalSegments(pre *Prefix) ([]WalSegmentNo, error) {
+	segments := make([]WalSegmentNo, 0)
+	err := listWalObjects(pre, GetWalFolderPath(pre), func(files *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, ob := range files.Contents {
+			if segment, ok := parseWalSegmentKey(*ob.Key); ok {
+				segments = append(segments, segment)
+			} else if bundle, ok := parseWalBundleKey(*ob.Key); ok {
+				segments = append(segments, bundle.Segments()...)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "ListWalSegments: s3.ListObjectsV2 failed")
+	}
+	return segments, nil
+}
+
+// FindWalGaps returns segments which are missing in the archive to replay WAL from start segment up to the newest
+// archived segment. Switch to higher timeline is followed when segment of current timeline is absent.
+func FindWalGaps(segments []WalSegmentNo, start WalSegmentNo) []WalSegmentNo {
+	timelinesBySegNo := make(map[uint64][]uint32)
+	maxSegNo := start.LogSegNo
+	for _, s := range segments {
+		if s.Timeline < start.Timeline || s.LogSegNo < start.LogSegNo {
+			continue
+		}
+		timelinesBySegNo[s.LogSegNo] = append(timelinesBySegNo[s.LogSegNo], s.Timeline)
+		if s.LogSegNo > maxSegNo {
+			maxSegNo = s.LogSegNo
+		}
+	}
+
+	gaps := make([]WalSegmentNo, 0)
+	timeline := start.Timeline
+	for segNo := start.LogSegNo; segNo <= maxSegNo; segNo++ {
+		timelines := timelinesBySegNo[segNo]
+		sort.Slice(timelines, func(i, j int) bool { return timelines[i] < timelines[j] })
+		found := false
+		for _, t := range timelines {
+			if t >= timeline {
+				timeline = t
+				found = true
+				break
+			}
+		}
+		if !found {
+			gaps = append(gaps, WalSegmentNo{timeline, segNo})
+		}
+	}
+	return gaps
+}
+
+// checkDeltaBaseWal verifies that the server continues history of delta base: it is on the same timeline and
+// WAL is archived without gaps since start of the base. Delta over broken WAL history can not be restored.
+func checkDeltaBaseWal(baseName string, base *S3TarBallSentinelDto, currentTimeline uint32, segments []WalSegmentNo) error {
+	baseTimeline, _, err := ParseWALFileName(stripWalFileName(baseName))
+	if err != nil {
+		return errors.Wrapf(err, "checkDeltaBaseWal: unable to get timeline of %s", baseName)
+	}
+	if baseTimeline != currentTimeline {
+		return errors.Errorf("checkDeltaBaseWal: server is on timeline %d, delta base %s is on timeline %d",
+			currentTimeline, baseName, baseTimeline)
+	}
+	gaps := FindWalGaps(segments, WalSegmentNo{baseTimeline, *base.LSN / GetWalSegmentSize()})
+	if len(gaps) > 0 {
+		return errors.Errorf("checkDeltaBaseWal: %d WAL segments are missing since start of delta base %s, first is %s",
+			len(gaps), baseName, gaps[0].Name())
+	}
+	return nil
+}
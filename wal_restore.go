@@ -0,0 +1,320 @@
+package walg
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// WalRestoreUsage is a text message explaining how to use wal-restore
+var WalRestoreUsage = "usage:\twal-g wal-restore target_pgdata [--timeline N]" + `
+Fetches WAL segments missing in pg_wal of stopped cluster, from the REDO point of its last checkpoint up to the end
+of the archive. Segments are named after timeline history of the newest archived timeline or of --timeline. When
+that timeline forked from the local one, local WAL is fetched from the last checkpoint before the fork, so an
+ex-primary can be rewound with pg_rewind or started after a crash without copying WAL by hand.
+`
+
+const (
+	// pgControlVersionNoPrevCheckPoint is pg_control_version of PostgreSQL 11, which removed prevCheckPoint field
+	pgControlVersionNoPrevCheckPoint = 1100
+
+	rmXlogID               = 0    // rmgrlist.h RM_XLOG_ID
+	xlogCheckpointShutdown = 0x00 // pg_control.h XLOG_CHECKPOINT_SHUTDOWN
+	xlogCheckpointOnline   = 0x10 // pg_control.h XLOG_CHECKPOINT_ONLINE
+	xlrBlockIDDataShort    = 255  // xlogrecord.h XLR_BLOCK_ID_DATA_SHORT
+)
+
+func printWalRestoreUsageAndFail() {
+	log.Fatal(WalRestoreUsage)
+}
+
+// TimelineSwitch is a line of timeline history file: parent timeline ends and its child begins at the LSN
+type TimelineSwitch struct {
+	Timeline uint32
+	LSN      uint64
+}
+
+// HandleWalRestore is invoked to perform wal-g wal-restore
+func HandleWalRestore(pre *Prefix, args []string) {
+	timeline := uint32(0)
+	if len(args) == 4 && args[2] == "--timeline" {
+		parsed, err := strconv.ParseUint(args[3], 10, 32)
+		if err != nil {
+			printWalRestoreUsageAndFail()
+		}
+		timeline = uint32(parsed)
+	} else if len(args) != 2 {
+		printWalRestoreUsageAndFail()
+	}
+	if err := RestoreMissingWal(pre, args[1], timeline); err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+}
+
+// RestoreMissingWal fetches segments which are absent in pg_wal of target, zero timeline means the newest one.
+// When the timeline forked from the local one, WAL of the local timeline is restored from the last checkpoint
+// before the fork, which pg_rewind reads to find blocks changed locally, then WAL of the timeline from the fork.
+func RestoreMissingWal(pre *Prefix, pgdata string, timeline uint32) error {
+	redo, controlTimeline, err := readPgControlCheckpoint(filepath.Join(pgdata, "global", "pg_control"))
+	if err != nil {
+		return err
+	}
+	walDir := ResolveSymlink(filepath.Join(pgdata, "pg_wal"))
+	if _, err = os.Stat(walDir); os.IsNotExist(err) {
+		walDir = ResolveSymlink(filepath.Join(pgdata, "pg_xlog"))
+	}
+	detectLocalWalSegmentSize(walDir)
+
+	if timeline == 0 {
+		if timeline, err = findNewestTimeline(pre, controlTimeline); err != nil {
+			return err
+		}
+	}
+	history, err := fetchTimelineHistory(pre, timeline, walDir)
+	if err != nil {
+		return err
+	}
+	infof("Checkpoint REDO %s on timeline %d, restoring WAL of timeline %d into %s\n", FormatLsn(redo), controlTimeline, timeline, walDir)
+
+	restored := 0
+	if fork := findTimelineFork(history, controlTimeline); fork != nil {
+		localHistory := history[:fork.index]
+		if redo >= fork.LSN {
+			if redo, err = findCheckpointBefore(pre, walDir, controlTimeline, localHistory, fork.LSN); err != nil {
+				return err
+			}
+		}
+		infof("Timeline %d forked from %d at %s, restoring WAL of timeline %d from REDO %s\n",
+			timeline, controlTimeline, FormatLsn(fork.LSN), controlTimeline, FormatLsn(redo))
+		if restored, err = restoreMissingSegments(pre, walDir, controlTimeline, localHistory, redo/GetWalSegmentSize()); err != nil {
+			return err
+		}
+		redo = fork.LSN
+	}
+	count, err := restoreMissingSegments(pre, walDir, timeline, history, redo/GetWalSegmentSize())
+	if err != nil {
+		return err
+	}
+	infof("%d segments restored\n", restored+count)
+	return nil
+}
+
+// timelineFork is the switch from the local timeline to its child in history of the restored timeline
+type timelineFork struct {
+	TimelineSwitch
+	index int
+}
+
+// findTimelineFork finds where the local timeline ends in history, nil is returned when it is not an ancestor
+func findTimelineFork(history []TimelineSwitch, localTimeline uint32) *timelineFork {
+	for i, timelineSwitch := range history {
+		if timelineSwitch.Timeline == localTimeline {
+			return &timelineFork{timelineSwitch, i}
+		}
+	}
+	return nil
+}
+
+// findCheckpointBefore finds REDO of the last checkpoint before the LSN, scanning segments of the timeline back
+// from the one holding the LSN. Scanned segments are restored into WAL directory, pg_rewind needs them anyway.
+func findCheckpointBefore(pre *Prefix, walDir string, timeline uint32, history []TimelineSwitch, lsn uint64) (uint64, error) {
+	for logSegNo := lsn / GetWalSegmentSize(); ; logSegNo-- {
+		name := formatWALFileName(timelineOfSegment(timeline, history, logSegNo), logSegNo)
+		found, err := restoreMissingSegment(pre, walDir, name)
+		if err != nil {
+			return 0, err
+		}
+		if !found {
+			return 0, errors.Errorf("findCheckpointBefore: no checkpoint before %s is found in WAL up to %s", FormatLsn(lsn), name)
+		}
+		data, err := ioutil.ReadFile(filepath.Join(walDir, name))
+		if err != nil {
+			return 0, errors.Wrapf(err, "findCheckpointBefore: unable to read %s", name)
+		}
+		if redo, found, err := findCheckpointInSegment(data, logSegNo*GetWalSegmentSize(), lsn); found || err != nil {
+			return redo, errors.Wrapf(err, "findCheckpointBefore: unable to read records of %s", name)
+		}
+		if logSegNo == 0 {
+			return 0, errors.Errorf("findCheckpointBefore: no checkpoint before %s", FormatLsn(lsn))
+		}
+	}
+}
+
+// findCheckpointInSegment finds REDO of the last checkpoint record of the segment which starts before the LSN
+func findCheckpointInSegment(data []byte, segStart uint64, lsn uint64) (uint64, bool, error) {
+	redo, found := uint64(0), false
+	_, err := walkWalRecords(data, segStart, func(recordLsn uint64, header []byte, body []byte) {
+		info, rmid := header[16]&0xF0, header[17]
+		if recordLsn >= lsn || rmid != rmXlogID || (info != xlogCheckpointShutdown && info != xlogCheckpointOnline) {
+			return
+		}
+		// Main data of checkpoint record is CheckPoint struct, which starts with REDO
+		if len(body) >= 10 && body[0] == xlrBlockIDDataShort {
+			redo, found = binary.LittleEndian.Uint64(body[2:10]), true
+		}
+	})
+	return redo, found, err
+}
+
+// restoreMissingSegments fetches segments of the timeline from the segment to the end of the archive
+func restoreMissingSegments(pre *Prefix, walDir string, timeline uint32, history []TimelineSwitch, logSegNo uint64) (int, error) {
+	restored := 0
+	for ; ; logSegNo++ {
+		name := formatWALFileName(timelineOfSegment(timeline, history, logSegNo), logSegNo)
+		location := filepath.Join(walDir, name)
+		if stat, err := os.Stat(location); err == nil && uint64(stat.Size()) == GetWalSegmentSize() {
+			continue
+		}
+		found, err := restoreMissingSegment(pre, walDir, name)
+		if err != nil || !found {
+			return restored, err
+		}
+		restored++
+	}
+}
+
+// restoreMissingSegment fetches segment unless WAL directory has it with full size, false is returned when
+// the segment is not archived
+func restoreMissingSegment(pre *Prefix, walDir string, name string) (bool, error) {
+	location := filepath.Join(walDir, name)
+	if stat, err := os.Stat(location); err == nil && uint64(stat.Size()) == GetWalSegmentSize() {
+		return true, nil
+	}
+	err := FetchWALFile(pre, name, location+".wal-g-restore")
+	if errors.Cause(err) == ErrWalNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err = os.Rename(location+".wal-g-restore", location); err != nil {
+		return false, errors.Wrapf(err, "restoreMissingSegment: unable to move %s into place", name)
+	}
+	infoln("Restored", name)
+	return true, nil
+}
+
+// readPgControlCheckpoint reads REDO location and timeline of the last checkpoint from pg_control
+func readPgControlCheckpoint(location string) (uint64, uint32, error) {
+	data, err := ioutil.ReadFile(location)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "readPgControlCheckpoint: unable to read pg_control")
+	}
+	return parsePgControlCheckpoint(data)
+}
+
+func parsePgControlCheckpoint(data []byte) (uint64, uint32, error) {
+	// ControlFileData: system_identifier, pg_control_version, catalog_version_no, state, time, checkPoint,
+	// prevCheckPoint before PostgreSQL 11, checkPointCopy starting with redo and ThisTimeLineID
+	if len(data) < 60 {
+		return 0, 0, errors.New("parsePgControlCheckpoint: pg_control is too short")
+	}
+	checkPointCopy := 40
+	if binary.LittleEndian.Uint32(data[8:12]) < pgControlVersionNoPrevCheckPoint {
+		checkPointCopy = 48
+	}
+	redo := binary.LittleEndian.Uint64(data[checkPointCopy : checkPointCopy+8])
+	timeline := binary.LittleEndian.Uint32(data[checkPointCopy+8 : checkPointCopy+12])
+	if timeline == 0 {
+		return 0, 0, errors.New("parsePgControlCheckpoint: invalid timeline in pg_control")
+	}
+	return redo, timeline, nil
+}
+
+// detectLocalWalSegmentSize takes segment size from any segment in WAL directory
+func detectLocalWalSegmentSize(walDir string) {
+	files, err := ioutil.ReadDir(walDir)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		if _, _, err = ParseWALFileName(file.Name()); err == nil && file.Mode().IsRegular() {
+			detectWalSegmentSize(filepath.Join(walDir, file.Name()))
+			return
+		}
+	}
+}
+
+// findNewestTimeline finds the newest timeline in the archive, but not older than local one
+func findNewestTimeline(pre *Prefix, timeline uint32) (uint32, error) {
+	segments, err := ListWalSegments(pre)
+	if err != nil {
+		return 0, err
+	}
+	for _, segment := range segments {
+		if segment.Timeline > timeline {
+			timeline = segment.Timeline
+		}
+	}
+	return timeline, nil
+}
+
+// fetchTimelineHistory fetches history file of the timeline, it is also put into WAL directory for recovery
+func fetchTimelineHistory(pre *Prefix, timeline uint32, walDir string) ([]TimelineSwitch, error) {
+	if timeline == 1 {
+		return nil, nil
+	}
+	name := fmt.Sprintf("%08X.history", timeline)
+	var buffer bytes.Buffer
+	err := FetchWALFileToWriter(pre, name, &buffer)
+	if errors.Cause(err) == ErrWalNotFound {
+		log.Printf("WARNING! History of timeline %d is not archived, segments are restored from this timeline only\n", timeline)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	location := filepath.Join(walDir, name)
+	if _, err = os.Stat(location); os.IsNotExist(err) {
+		if err = ioutil.WriteFile(location, buffer.Bytes(), 0600); err != nil {
+			return nil, errors.Wrapf(err, "fetchTimelineHistory: unable to write %s", location)
+		}
+	}
+	return parseTimelineHistory(buffer.Bytes())
+}
+
+// parseTimelineHistory parses lines 'parent_timeline switch_lsn reason', comments and empty lines are skipped
+func parseTimelineHistory(data []byte) ([]TimelineSwitch, error) {
+	history := make([]TimelineSwitch, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, errors.Errorf("parseTimelineHistory: invalid line '%s'", scanner.Text())
+		}
+		timeline, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parseTimelineHistory: invalid timeline in '%s'", scanner.Text())
+		}
+		lsn, err := ParseLsn(fields[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "parseTimelineHistory: invalid LSN in '%s'", scanner.Text())
+		}
+		history = append(history, TimelineSwitch{uint32(timeline), lsn})
+	}
+	return history, scanner.Err()
+}
+
+// timelineOfSegment finds timeline of the segment as recovery does: segment belongs to the newest timeline
+// begun in it or before it, so the segment holding the switch point is taken from the child timeline
+func timelineOfSegment(timeline uint32, history []TimelineSwitch, logSegNo uint64) uint32 {
+	for i := len(history) - 1; i >= 0; i-- {
+		if logSegNo >= history[i].LSN/GetWalSegmentSize() {
+			return timeline
+		}
+		timeline = history[i].Timeline
+	}
+	return timeline
+}
@@ -0,0 +1,85 @@
+package walg
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestParseTimelineHistory(t *testing.T) {
+	history, err := parseTimelineHistory([]byte("1\t0/5000098\tno recovery target specified\n\n2\t0/9000000\tbefore 2018-01-01\n"))
+	if err != nil || len(history) != 2 || history[0] != (TimelineSwitch{1, 0x5000098}) || history[1] != (TimelineSwitch{2, 0x9000000}) {
+		t.Fatalf("Wrong history %v %v", history, err)
+	}
+	if _, err = parseTimelineHistory([]byte("1\n")); err == nil {
+		t.Fatal("Invalid history is parsed")
+	}
+}
+
+func TestTimelineOfSegment(t *testing.T) {
+	history := []TimelineSwitch{{1, 0x5000098}, {2, 0x9000000}}
+	for logSegNo, expected := range map[uint64]uint32{3: 1, 4: 1, 5: 2, 8: 2, 9: 3, 12: 3} {
+		if timeline := timelineOfSegment(3, history, logSegNo); timeline != expected {
+			t.Errorf("Segment %d is on timeline %d, expected %d", logSegNo, timeline, expected)
+		}
+	}
+	if timeline := timelineOfSegment(1, nil, 7); timeline != 1 {
+		t.Errorf("Segment without history is on timeline %d", timeline)
+	}
+}
+
+func TestParsePgControlCheckpoint(t *testing.T) {
+	data := make([]byte, 296)
+	binary.LittleEndian.PutUint32(data[8:12], 1100)
+	binary.LittleEndian.PutUint64(data[40:48], 0x2E5000028)
+	binary.LittleEndian.PutUint32(data[48:52], 3)
+	redo, timeline, err := parsePgControlCheckpoint(data)
+	if err != nil || redo != 0x2E5000028 || timeline != 3 {
+		t.Fatalf("Wrong checkpoint %X %d %v", redo, timeline, err)
+	}
+
+	// PostgreSQL 10 has prevCheckPoint before checkPointCopy
+	data = make([]byte, 296)
+	binary.LittleEndian.PutUint32(data[8:12], 1002)
+	binary.LittleEndian.PutUint64(data[48:56], 0x3000028)
+	binary.LittleEndian.PutUint32(data[56:60], 1)
+	redo, timeline, err = parsePgControlCheckpoint(data)
+	if err != nil || redo != 0x3000028 || timeline != 1 {
+		t.Fatalf("Wrong checkpoint %X %d %v", redo, timeline, err)
+	}
+}
+
+func TestFindCheckpointInSegment(t *testing.T) {
+	checkpoint := func(redo uint64) []byte {
+		body := make([]byte, 90)
+		body[0], body[1] = xlrBlockIDDataShort, 88
+		binary.LittleEndian.PutUint64(body[2:10], redo)
+		return body
+	}
+	records := [][]byte{checkpoint(0x2FFF000), make([]byte, 3*testWalPageSize), checkpoint(0x3000028), make([]byte, 10)}
+	data := buildTestWalSegment(0x3000000, 8, records)
+	lsns := make([]uint64, 0)
+	if _, err := walkWalRecords(data, 0x3000000, func(lsn uint64, header []byte, body []byte) {
+		lsns = append(lsns, lsn)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for lsn, expected := range map[uint64]uint64{lsns[2]: 0x2FFF000, lsns[3]: 0x3000028} {
+		if redo, found, err := findCheckpointInSegment(data, 0x3000000, lsn); err != nil || !found || redo != expected {
+			t.Errorf("Checkpoint before %X has REDO %X %v %v, expected %X", lsn, redo, found, err, expected)
+		}
+	}
+	if _, found, err := findCheckpointInSegment(data, 0x3000000, lsns[0]); err != nil || found {
+		t.Errorf("Checkpoint is found before the first record: %v", err)
+	}
+}
+
+func TestFindTimelineFork(t *testing.T) {
+	history := []TimelineSwitch{{1, 0x5000098}, {2, 0x9000000}}
+	if fork := findTimelineFork(history, 2); fork == nil || fork.LSN != 0x9000000 || fork.index != 1 {
+		t.Fatalf("Wrong fork %v", fork)
+	}
+	if fork := findTimelineFork(history, 3); fork != nil {
+		t.Fatalf("Restored timeline is forked from itself at %X", fork.LSN)
+	}
+}
@@ -0,0 +1,220 @@
+package walg
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// WalVerifyUsage is a text message explaining how to use wal-verify
+var WalVerifyUsage = "usage:\twal-g wal-verify wal_file [wal_file...]" + `
+Walks WAL records of segment files and verifies their CRC32C. wal-push verifies segments the same way
+before upload when WALG_VERIFY_WAL_CRC is set.
+`
+
+const (
+	xlpFirstIsContRecord   = 0x0001 // xlog_internal.h XLP_FIRST_IS_CONTRECORD
+	xlogShortPageHeaderLen = 24     // MAXALIGN(sizeof(XLogPageHeaderData))
+	xlogRecordHeaderLen    = 24     // SizeOfXLogRecord
+	xlogRecordCrcOffset    = 20     // offsetof(XLogRecord, xl_crc)
+)
+
+// castagnoliTable is computed with SSE4.2 or ARMv8 CRC instructions when CPU supports them
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+func printWalVerifyUsageAndFail() {
+	log.Fatal(WalVerifyUsage)
+}
+
+// verifyWalCrc reads WALG_VERIFY_WAL_CRC setting
+func verifyWalCrc() bool {
+	verifyStr, ok := lookupSetting("WALG_VERIFY_WAL_CRC")
+	if !ok {
+		return false
+	}
+	verify, err := strconv.ParseBool(verifyStr)
+	if err != nil {
+		log.Fatalf("Unable to parse WALG_VERIFY_WAL_CRC %v\n", err)
+	}
+	return verify
+}
+
+// HandleWalVerify is invoked to perform wal-g wal-verify
+func HandleWalVerify(args []string) {
+	if len(args) < 2 {
+		printWalVerifyUsageAndFail()
+	}
+	failed := false
+	for _, path := range args[1:] {
+		records, err := VerifyWalFile(path)
+		if err != nil {
+			fmt.Printf("%s: %v\n", path, err)
+			failed = true
+			continue
+		}
+		fmt.Printf("%s: %d records OK\n", path, records)
+	}
+	if failed {
+		EmitEvent(Event{Event: EventFailed, Error: "WAL verification failed"})
+		os.Exit(1)
+	}
+}
+
+// VerifyWalFile verifies CRC of WAL records of the segment file. Records continued from the previous segment
+// or into the next one can not be verified and are skipped.
+func VerifyWalFile(path string) (int, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, errors.Wrapf(err, "VerifyWalFile: failed to read %s", path)
+	}
+	// Segment number in the file name depends on segment size
+	if len(data) >= xlogLongPageHeaderLen {
+		if err = SetWalSegmentSize(uint64(binary.LittleEndian.Uint32(data[32:36]))); err != nil {
+			return 0, errors.Wrapf(err, "VerifyWalFile: invalid segment size in %s", path)
+		}
+	}
+	_, logSegNo, err := ParseWALFileName(filepath.Base(path))
+	if err != nil {
+		return 0, errors.Wrapf(err, "VerifyWalFile: %s is not a WAL segment", path)
+	}
+	records, err := verifyWalRecords(data, logSegNo*GetWalSegmentSize())
+	return records, errors.Wrapf(err, "VerifyWalFile: %s is corrupt", path)
+}
+
+// walRecordReader reads WAL as continuous stream of record bytes, skipping page headers
+type walRecordReader struct {
+	data     []byte
+	pageSize int
+	magic    uint16
+	segStart uint64
+	pos      int
+	start    int // offset of the first byte of the last read
+}
+
+// readPageHeader validates page header at current position and returns its length and flags.
+// Page with wrong magic or address is recycled or not yet written.
+func (r *walRecordReader) readPageHeader() (int, uint16, uint32, bool) {
+	if r.pos+xlogShortPageHeaderLen > len(r.data) {
+		return 0, 0, 0, false
+	}
+	header := r.data[r.pos:]
+	info := binary.LittleEndian.Uint16(header[2:4])
+	if binary.LittleEndian.Uint16(header[0:2]) != r.magic || binary.LittleEndian.Uint64(header[8:16]) != r.segStart+uint64(r.pos) {
+		return 0, 0, 0, false
+	}
+	length := xlogShortPageHeaderLen
+	if info&xlpLongHeader != 0 {
+		length = xlogLongPageHeaderLen
+	}
+	return length, info, binary.LittleEndian.Uint32(header[16:20]), true
+}
+
+// read reads n record bytes. Returns false when WAL ends, records continued on the next page must be marked
+// as continuation there.
+func (r *walRecordReader) read(n int, continued bool) ([]byte, bool, error) {
+	result := make([]byte, 0, n)
+	for len(result) < n {
+		if r.pos >= len(r.data) {
+			return nil, false, nil
+		}
+		if r.pos%r.pageSize == 0 {
+			length, info, _, ok := r.readPageHeader()
+			continued = continued || len(result) > 0
+			if !ok {
+				if continued {
+					return nil, false, errors.Errorf("invalid page header at offset %d inside of a record", r.pos)
+				}
+				return nil, false, nil
+			}
+			if continued && info&xlpFirstIsContRecord == 0 {
+				return nil, false, errors.Errorf("page at offset %d does not continue the record", r.pos)
+			}
+			r.pos += length
+		}
+		pageEnd := (r.pos/r.pageSize + 1) * r.pageSize
+		if pageEnd > len(r.data) {
+			pageEnd = len(r.data)
+		}
+		chunk := n - len(result)
+		if chunk > pageEnd-r.pos {
+			chunk = pageEnd - r.pos
+		}
+		if len(result) == 0 {
+			r.start = r.pos
+		}
+		result = append(result, r.data[r.pos:r.pos+chunk]...)
+		r.pos += chunk
+	}
+	return result, true, nil
+}
+
+// verifyWalRecords walks records of the segment starting at the LSN and checks their CRC32C
+func verifyWalRecords(data []byte, segStart uint64) (int, error) {
+	return walkWalRecords(data, segStart, nil)
+}
+
+// walkWalRecords checks CRC32C of records of the segment starting at the LSN and passes records started
+// in the segment with their LSN to visit, if it is not nil
+func walkWalRecords(data []byte, segStart uint64, visit func(lsn uint64, header []byte, body []byte)) (int, error) {
+	if len(data) < xlogLongPageHeaderLen {
+		return 0, errors.New("segment is shorter than page header")
+	}
+	info := binary.LittleEndian.Uint16(data[2:4])
+	if info&xlpLongHeader == 0 {
+		return 0, errors.New("segment does not start with long page header")
+	}
+	pageSize := int(binary.LittleEndian.Uint32(data[36:40]))
+	if pageSize < xlogLongPageHeaderLen || pageSize&(pageSize-1) != 0 {
+		return 0, errors.Errorf("invalid page size %d", pageSize)
+	}
+	r := &walRecordReader{data: data, pageSize: pageSize, magic: binary.LittleEndian.Uint16(data[0:2]), segStart: segStart}
+
+	length, info, remaining, ok := r.readPageHeader()
+	if !ok {
+		return 0, errors.New("invalid address in the first page header")
+	}
+	r.pos = length
+	if info&xlpFirstIsContRecord != 0 {
+		if _, ok, err := r.read(int(remaining), true); !ok || err != nil {
+			return 0, err
+		}
+	}
+
+	records := 0
+	for {
+		r.pos = (r.pos + 7) &^ 7 // records are MAXALIGNed
+		header, ok, err := r.read(xlogRecordHeaderLen, false)
+		if !ok || err != nil {
+			return records, err
+		}
+		start := r.start
+		totalLength := int(binary.LittleEndian.Uint32(header[0:4]))
+		if totalLength == 0 {
+			// Rest of the segment is empty, e.g. after segment switch
+			return records, nil
+		}
+		if totalLength < xlogRecordHeaderLen {
+			return records, errors.Errorf("invalid record length %d at offset %d", totalLength, r.pos-xlogRecordHeaderLen)
+		}
+		body, ok, err := r.read(totalLength-xlogRecordHeaderLen, true)
+		if !ok || err != nil {
+			return records, err
+		}
+		crc := crc32.Update(0, castagnoliTable, body)
+		crc = crc32.Update(crc, castagnoliTable, header[:xlogRecordCrcOffset])
+		if expected := binary.LittleEndian.Uint32(header[xlogRecordCrcOffset:]); crc != expected {
+			return records, errors.Errorf("record %d ending at offset %d has CRC %08X, %08X expected", records+1, r.pos, crc, expected)
+		}
+		if visit != nil {
+			visit(segStart+uint64(start), header, body)
+		}
+		records++
+	}
+}
@@ -0,0 +1,121 @@
+package walg
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+)
+
+const testWalPageSize = 8192
+
+// buildTestWalSegment lays records out as PostgreSQL does: MAXALIGNed, split across pages with continuation flags
+func buildTestWalSegment(segStart uint64, pages int, records [][]byte) []byte {
+	stream := make([]byte, 0)
+	for _, body := range records {
+		for len(stream)%8 != 0 {
+			stream = append(stream, 0)
+		}
+		header := make([]byte, xlogRecordHeaderLen)
+		binary.LittleEndian.PutUint32(header[0:4], uint32(xlogRecordHeaderLen+len(body)))
+		crc := crc32.Update(0, castagnoliTable, body)
+		crc = crc32.Update(crc, castagnoliTable, header[:xlogRecordCrcOffset])
+		binary.LittleEndian.PutUint32(header[xlogRecordCrcOffset:], crc)
+		stream = append(stream, header...)
+		stream = append(stream, body...)
+	}
+
+	// Record boundaries are needed to set continuation flags
+	ends := make([]int, 0)
+	position := 0
+	for _, body := range records {
+		position = (position + 7) &^ 7
+		position += xlogRecordHeaderLen + len(body)
+		ends = append(ends, position)
+	}
+
+	data := make([]byte, 0, pages*testWalPageSize)
+	consumed := 0
+	for page := 0; page < pages; page++ {
+		headerLen := xlogShortPageHeaderLen
+		info := uint16(0)
+		if page == 0 {
+			headerLen = xlogLongPageHeaderLen
+			info |= xlpLongHeader
+		}
+		remaining := 0
+		for i, end := range ends {
+			start := end - xlogRecordHeaderLen - len(records[i])
+			if start < consumed && end > consumed {
+				info |= xlpFirstIsContRecord
+				remaining = end - consumed
+			}
+		}
+		header := make([]byte, headerLen)
+		binary.LittleEndian.PutUint16(header[0:2], 0xD098)
+		binary.LittleEndian.PutUint16(header[2:4], info)
+		binary.LittleEndian.PutUint64(header[8:16], segStart+uint64(page*testWalPageSize))
+		binary.LittleEndian.PutUint32(header[16:20], uint32(remaining))
+		if page == 0 {
+			binary.LittleEndian.PutUint32(header[32:36], uint32(pages*testWalPageSize))
+			binary.LittleEndian.PutUint32(header[36:40], testWalPageSize)
+		}
+		data = append(data, header...)
+		chunk := testWalPageSize - headerLen
+		if consumed+chunk > len(stream) {
+			chunk = len(stream) - consumed
+		}
+		data = append(data, stream[consumed:consumed+chunk]...)
+		consumed += chunk
+		for len(data)%testWalPageSize != 0 {
+			data = append(data, 0)
+		}
+	}
+	return data
+}
+
+func TestVerifyWalRecords(t *testing.T) {
+	records := make([][]byte, 0)
+	for i := 0; i < 40; i++ {
+		body := make([]byte, 50+i*97)
+		for j := range body {
+			body[j] = byte(i + j)
+		}
+		records = append(records, body)
+	}
+	// Record spanning several pages
+	records = append(records, make([]byte, 3*testWalPageSize))
+	data := buildTestWalSegment(0x3000000, 16, records)
+
+	count, err := verifyWalRecords(data, 0x3000000)
+	if err != nil || count != len(records) {
+		t.Fatalf("Expected %d valid records, got %d %v", len(records), count, err)
+	}
+
+	data[testWalPageSize+100] ^= 0xFF
+	if _, err = verifyWalRecords(data, 0x3000000); err == nil {
+		t.Fatal("Corrupted record is not detected")
+	}
+
+	if _, err = verifyWalRecords(data, 0x4000000); err == nil {
+		t.Fatal("Segment with wrong page address is not detected")
+	}
+}
+
+func TestWalkWalRecordsLsn(t *testing.T) {
+	records := [][]byte{make([]byte, 50), make([]byte, 3*testWalPageSize), make([]byte, 10)}
+	data := buildTestWalSegment(0x3000000, 8, records)
+
+	lsns := make([]uint64, 0)
+	_, err := walkWalRecords(data, 0x3000000, func(lsn uint64, header []byte, body []byte) {
+		lsns = append(lsns, lsn)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The third record follows the second one after three page headers
+	third := uint64(0x3000000 + xlogLongPageHeaderLen + 80 + xlogRecordHeaderLen + 3*testWalPageSize + 3*xlogShortPageHeaderLen)
+	third = (third + 7) &^ 7
+	if len(lsns) != 3 || lsns[0] != 0x3000000+xlogLongPageHeaderLen || lsns[1] != 0x3000000+xlogLongPageHeaderLen+80 || lsns[2] != third {
+		t.Fatalf("Wrong record LSNs %X, third expected at %X", lsns, third)
+	}
+}
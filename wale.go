@@ -0,0 +1,135 @@
+package walg
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// walEBackupNameRegexp matches WAL-E backup names, they contain offset of backup start in the segment
+var walEBackupNameRegexp = regexp.MustCompile(`^base_([0-9A-F]{24})_([0-9A-F]{8})$`)
+
+// walESegmentSize is the only segment size supported by WAL-E
+const walESegmentSize = 0x1000000
+
+// WalESentinelDto is the sentinel of a backup made by WAL-E
+type WalESentinelDto struct {
+	WalSegmentBackupStop       string                     `json:"wal_segment_backup_stop"`
+	WalSegmentOffsetBackupStop string                     `json:"wal_segment_offset_backup_stop"`
+	ExpandedSizeBytes          int64                      `json:"expanded_size_bytes"`
+	Spec                       map[string]json.RawMessage `json:"spec"`
+}
+
+// walETablespaceSpec describes tablespace in WAL-E spec
+type walETablespaceSpec struct {
+	Loc  string `json:"loc"`
+	Link string `json:"link"`
+}
+
+// isWalEBackup checks whether backup was made by WAL-E
+func isWalEBackup(backupName string) bool {
+	return walEBackupNameRegexp.MatchString(backupName)
+}
+
+// walELsn computes LSN from WAL segment name and hex offset in the segment
+func walELsn(segment string, offset string) (uint64, error) {
+	if len(segment) != 24 {
+		return 0, errors.Errorf("walELsn: invalid segment name '%s'", segment)
+	}
+	logID, err := strconv.ParseUint(segment[8:16], 16, 32)
+	if err != nil {
+		return 0, errors.Wrapf(err, "walELsn: invalid segment name '%s'", segment)
+	}
+	segNo, err := strconv.ParseUint(segment[16:24], 16, 32)
+	if err != nil {
+		return 0, errors.Wrapf(err, "walELsn: invalid segment name '%s'", segment)
+	}
+	segmentOffset, err := strconv.ParseUint(offset, 16, 32)
+	if err != nil {
+		return 0, errors.Wrapf(err, "walELsn: invalid offset '%s'", offset)
+	}
+	return logID<<32 + segNo*walESegmentSize + segmentOffset, nil
+}
+
+// applyWalESentinel fills WAL-G sentinel from WAL-E one: start LSN from backup name, finish LSN,
+// size and tablespace locations
+func applyWalESentinel(backupName string, body []byte, dto *S3TarBallSentinelDto) error {
+	match := walEBackupNameRegexp.FindStringSubmatch(backupName)
+	if match == nil {
+		return errors.Errorf("applyWalESentinel: %s is not WAL-E backup name", backupName)
+	}
+	walE := WalESentinelDto{}
+	if err := json.Unmarshal(body, &walE); err != nil {
+		return errors.Wrap(err, "applyWalESentinel: failed to unmarshal sentinel")
+	}
+
+	lsn, err := walELsn(match[1], match[2])
+	if err != nil {
+		return err
+	}
+	dto.LSN = &lsn
+	if walE.WalSegmentBackupStop != "" {
+		finishLsn, err := walELsn(walE.WalSegmentBackupStop, walE.WalSegmentOffsetBackupStop)
+		if err != nil {
+			return err
+		}
+		dto.FinishLSN = &finishLsn
+	}
+	dto.UncompressedSize = walE.ExpandedSizeBytes
+
+	var tablespaces []string
+	if raw, ok := walE.Spec["tablespaces"]; ok {
+		if err = json.Unmarshal(raw, &tablespaces); err != nil {
+			return errors.Wrap(err, "applyWalESentinel: invalid tablespaces in spec")
+		}
+	}
+	for _, oid := range tablespaces {
+		spec := walETablespaceSpec{}
+		if err = json.Unmarshal(walE.Spec[oid], &spec); err != nil {
+			return errors.Wrapf(err, "applyWalESentinel: invalid spec of tablespace %s", oid)
+		}
+		if dto.Tablespaces == nil {
+			dto.Tablespaces = make(map[string]string)
+		}
+		link := spec.Link
+		if link == "" {
+			link = "pg_tblspc/" + oid
+		}
+		dto.Tablespaces[link] = filepath.Clean(spec.Loc)
+	}
+	return nil
+}
+
+// relocateTablespaces moves tablespaces extracted into PGDATA as directories, as WAL-E stores them,
+// to their locations and replaces them with symlinks. Existing locations are never overwritten.
+func relocateTablespaces(dirArc string, tablespaces map[string]string) {
+	for link, target := range tablespaces {
+		linkPath := filepath.Join(dirArc, link)
+		info, err := os.Lstat(linkPath)
+		if err != nil || !info.IsDir() {
+			continue
+		}
+		if _, err = os.Lstat(target); err == nil {
+			log.Printf("WARNING! Tablespace %s is left in %s, its location %s already exists\n", link, linkPath, target)
+			continue
+		}
+		if err = os.MkdirAll(filepath.Dir(target), 0700); err == nil {
+			if err = os.Rename(linkPath, target); err == nil {
+				if err = os.Symlink(target, linkPath); err != nil {
+					os.Rename(target, linkPath)
+				}
+			}
+		}
+		if err != nil {
+			log.Printf("WARNING! Unable to move tablespace %s to %s, it is left in PGDATA: %v\n", link, target, err)
+			continue
+		}
+		fmt.Printf("Tablespace %s is moved to %s\n", link, target)
+	}
+}
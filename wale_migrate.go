@@ -0,0 +1,180 @@
+package walg
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+// WalEMigrateUsage is a text message explaining how to use wal-e-migrate
+var WalEMigrateUsage = "usage:\twal-g wal-e-migrate [--confirm]" + `
+Recompresses WAL and backups made by WAL-E from lzo to lz4 and replaces WAL-E sentinels with WAL-G ones.
+Without --confirm prints what would be migrated. Migration is resumable, rerun continues where it stopped.
+`
+
+func printWalEMigrateUsageAndFail() {
+	log.Fatal(WalEMigrateUsage)
+}
+
+// HandleWalEMigrate is invoked to perform wal-g wal-e-migrate
+func HandleWalEMigrate(tu *TarUploader, pre *Prefix, args []string) {
+	confirm := false
+	for _, arg := range args[1:] {
+		if arg != "--confirm" {
+			printWalEMigrateUsageAndFail()
+		}
+		confirm = true
+	}
+	if err := MigrateWalE(tu, pre, !confirm); err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+}
+
+// MigrateWalE migrates WAL first, then backups one by one. Every object is recompressed before its lzo
+// original is deleted and existing lz4 objects are not recompressed again, so interrupted migration can be rerun.
+func MigrateWalE(tu *TarUploader, pre *Prefix, dryRun bool) error {
+	if err := migrateWalEObjects(tu, pre, GetWalFolderPath(pre), dryRun); err != nil {
+		return err
+	}
+
+	backups, err := (&Backup{Prefix: pre, Path: GetBackupPath(pre)}).GetBackups()
+	if err == ErrLatestNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, backup := range backups {
+		if err = migrateWalEBackup(tu, pre, backup.Name, dryRun); err != nil {
+			return errors.Wrapf(err, "MigrateWalE: failed to migrate %s", backup.Name)
+		}
+	}
+	if dryRun {
+		fmt.Println("Dry run finished, add --confirm to migrate")
+	}
+	return nil
+}
+
+// migrateWalEObjects recompresses lzo objects under the prefix
+func migrateWalEObjects(tu *TarUploader, pre *Prefix, prefix string, dryRun bool) error {
+	existing := make(map[string]bool)
+	sources := make([]string, 0)
+	err := listAllObjects(pre, prefix, func(ob *s3.Object) {
+		existing[*ob.Key] = true
+		if strings.HasSuffix(*ob.Key, ".lzo") {
+			sources = append(sources, *ob.Key)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d objects under %s to migrate\n", len(sources), prefix)
+	if dryRun {
+		return nil
+	}
+
+	for i, source := range sources {
+		target := strings.TrimSuffix(source, ".lzo") + ".lz4"
+		if !existing[target] {
+			if err = recompressObject(tu, pre, source, target); err != nil {
+				return err
+			}
+		}
+		if err = deleteObjects(pre, partitionToObjects([]string{source})); err != nil {
+			return err
+		}
+		fmt.Printf("Migrated %s (%d of %d)\n", path.Base(source), i+1, len(sources))
+	}
+	return nil
+}
+
+// migrateWalEBackup recompresses partitions, then uploads WAL-G sentinel and deletes lzo partitions last,
+// so backup can be restored at any moment of migration
+func migrateWalEBackup(tu *TarUploader, pre *Prefix, backupName string, dryRun bool) error {
+	partitions, err := listTarPartitions(pre, backupName)
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]bool)
+	sources := make([]string, 0)
+	for _, partition := range partitions {
+		existing[partition] = true
+		if strings.HasSuffix(partition, ".lzo") {
+			sources = append(sources, partition)
+		}
+	}
+	if len(sources) == 0 && !isWalEBackup(backupName) {
+		return nil
+	}
+
+	bk := &Backup{Prefix: pre, Path: GetBackupPath(pre), Name: aws.String(backupName)}
+	sentinel := fetchSentinel(backupName, bk, pre)
+	fmt.Printf("Backup %s: %d partitions to migrate\n", backupName, len(sources))
+	if dryRun {
+		return nil
+	}
+
+	for _, source := range sources {
+		target := strings.TrimSuffix(source, ".lzo") + ".lz4"
+		if !existing[target] {
+			if err = recompressObject(tu, pre, source, target); err != nil {
+				return err
+			}
+		}
+	}
+
+	body, err := json.Marshal(&sentinel)
+	if err != nil {
+		return errors.Wrap(err, "migrateWalEBackup: failed to marshal sentinel")
+	}
+	sentinelKey := *bk.Path + backupName + SentinelSuffix
+	if err = tu.uploadSentinel(sentinelKey, body); err != nil {
+		return errors.Wrap(err, "migrateWalEBackup: failed to upload sentinel")
+	}
+	if err = deleteObjects(pre, partitionToObjects(sources)); err != nil {
+		return err
+	}
+	fmt.Printf("Migrated backup %s\n", backupName)
+	return nil
+}
+
+// recompressObject decodes object and uploads it compressed with lz4 and encrypted with current key
+func recompressObject(tu *TarUploader, pre *Prefix, source string, target string) error {
+	reader, err := (&Archive{Prefix: pre, Archive: aws.String(source)}).GetArchive()
+	if err != nil {
+		return errors.Wrapf(err, "recompressObject: failed to download %s", source)
+	}
+	defer reader.Close()
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(decodeObject(pw, reader, source))
+	}()
+	defer pr.Close()
+	lz := &LzPipeWriter{Input: pr}
+	lz.Compress(&OpenPGPCrypter{})
+	err = tu.upload(tu.createUploadInput(target, lz.Output), target)
+	return errors.Wrapf(err, "recompressObject: failed to upload %s", target)
+}
+
+// skipMigratedPartitions drops lzo partitions which already have lz4 copy made by interrupted migration
+func skipMigratedPartitions(keys []string) []string {
+	existing := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		existing[key] = true
+	}
+	result := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if !strings.HasSuffix(key, ".lzo") || !existing[strings.TrimSuffix(key, ".lzo")+".lz4"] {
+			result = append(result, key)
+		}
+	}
+	return result
+}
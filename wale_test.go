@@ -0,0 +1,76 @@
+package walg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWalELsn(t *testing.T) {
+	lsn, err := walELsn("0000000100000002000000A3", "00000028")
+	if err != nil || lsn != 0x2A3000028 {
+		t.Fatalf("Expected LSN 2/A3000028, got %x %v", lsn, err)
+	}
+	if _, err = walELsn("000000010000000200", "00000028"); err == nil {
+		t.Fatal("Invalid segment name was parsed")
+	}
+}
+
+func TestApplyWalESentinel(t *testing.T) {
+	body := []byte(`{"wal_segment_backup_stop": "000000010000000000000004", "wal_segment_offset_backup_stop": "00000178",
+		"expanded_size_bytes": 12345,
+		"spec": {"base_prefix": "/var/lib/postgresql/data", "tablespaces": ["16384"],
+			"16384": {"loc": "/mnt/ts/", "link": "pg_tblspc/16384"}}}`)
+	dto := S3TarBallSentinelDto{}
+	err := applyWalESentinel("base_000000010000000000000002_00000040", body, &dto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *dto.LSN != 0x2000040 || *dto.FinishLSN != 0x4000178 || dto.UncompressedSize != 12345 {
+		t.Fatalf("Unexpected sentinel %+v", dto)
+	}
+	if dto.Tablespaces["pg_tblspc/16384"] != "/mnt/ts" {
+		t.Fatalf("Unexpected tablespaces %v", dto.Tablespaces)
+	}
+	if isWalEBackup("base_000000010000000000000002") || !isWalEBackup("base_000000010000000000000002_00000040") {
+		t.Fatal("WAL-E backup name is not recognized")
+	}
+}
+
+func TestStripWalFileNameOfWalEBackup(t *testing.T) {
+	name := stripWalFileName("server/basebackups_005/base_000000010000000000000002_00000040_backup_stop_sentinel.json")
+	if name != "000000010000000000000002" {
+		t.Fatalf("Unexpected WAL file name %v", name)
+	}
+}
+
+func TestRelocateTablespaces(t *testing.T) {
+	dir, err := ioutil.TempDir("", "relocate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pgdata := filepath.Join(dir, "data")
+	target := filepath.Join(dir, "ts", "16384")
+	err = os.MkdirAll(filepath.Join(pgdata, "pg_tblspc", "16384", "PG_9.6_201608131"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	relocateTablespaces(pgdata, map[string]string{"pg_tblspc/16384": target})
+	link, err := os.Readlink(filepath.Join(pgdata, "pg_tblspc", "16384"))
+	if err != nil || link != target {
+		t.Fatalf("Tablespace is not replaced with symlink: %v %v", link, err)
+	}
+	if _, err = os.Stat(filepath.Join(target, "PG_9.6_201608131")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSkipMigratedPartitions(t *testing.T) {
+	keys := skipMigratedPartitions([]string{"part_00000000.tar.lz4", "part_00000000.tar.lzo", "part_00000001.tar.lzo"})
+	if len(keys) != 2 || keys[0] != "part_00000000.tar.lz4" || keys[1] != "part_00000001.tar.lzo" {
+		t.Fatalf("Unexpected partitions %v", keys)
+	}
+}
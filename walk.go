@@ -2,9 +2,9 @@ package walg
 
 import (
 	"archive/tar"
-	"fmt"
 	"github.com/pkg/errors"
 	"io"
+	"log"
 	"os"
 	"path/filepath"
 	"strings"
@@ -30,14 +30,29 @@ func (z *ZeroReader) Read(p []byte) (int, error) {
 func (bundle *Bundle) TarWalker(path string, info os.FileInfo, err error) error {
 	if err != nil {
 		if os.IsNotExist(err) {
-			fmt.Println(path, " deleted dring filepath walk")
+			infoln(path, " deleted dring filepath walk")
 			return nil
 		}
 		return errors.Wrap(err, "TarWalker: walk failed")
 	}
 
+	if bundle.SkipUnlogged && info.IsDir() && filepath.Base(filepath.Dir(path)) == "base" {
+		unlogged, err := findUnloggedRelations(path)
+		if err != nil {
+			return errors.Wrap(err, "TarWalker: failed to find unlogged relations")
+		}
+		if bundle.unloggedRelations == nil {
+			bundle.unloggedRelations = make(map[string]bool)
+		}
+		for relation := range unlogged {
+			bundle.unloggedRelations[relation] = true
+		}
+	}
+
 	if info.Name() == "pg_control" {
 		bundle.Sen = &Sentinel{info, path}
+	} else if bundle.SkipUnlogged && isUnloggedRelationData(path, bundle.unloggedRelations) {
+		infoln(path, " skipped as data of unlogged relation")
 	} else {
 		err = HandleTar(bundle, path, info, &bundle.Crypter)
 		if err == filepath.SkipDir {
@@ -51,7 +66,7 @@ func (bundle *Bundle) TarWalker(path string, info os.FileInfo, err error) error
 }
 
 // HandleTar creates underlying tar writer and handles one given file.
-// Does not follow symlinks. If file is in EXCLUDE, will not be included
+// Does not follow symlinks, see handleSymlink. If file is in EXCLUDE, will not be included
 // in the final tarball. EXCLUDED directories are created
 // but their contents are not written to local disk.
 func HandleTar(bundle TarBundle, path string, info os.FileInfo, crypter Crypter) error {
@@ -65,14 +80,18 @@ func HandleTar(bundle TarBundle, path string, info os.FileInfo, crypter Crypter)
 	tarBall.SetUp(crypter)
 	tarWriter := tarBall.Tw()
 
+	if info.Mode()&os.ModeSymlink != 0 {
+		return handleSymlink(bundle, tarWriter, tarBall.Trim(), path, info)
+	}
+
 	if !excluded {
 		hdr, err := tar.FileInfoHeader(info, fileName)
 		if err != nil {
 			return errors.Wrap(err, "HandleTar: could not grab header info")
 		}
 
-		hdr.Name = strings.TrimPrefix(path, tarBall.Trim())
-		fmt.Println(hdr.Name)
+		hdr.Name = tarMemberName(path, tarBall.Trim())
+		infoln(hdr.Name)
 
 		if info.Mode().IsRegular() {
 			baseFiles := bundle.GetIncrementBaseFiles()
@@ -88,7 +107,7 @@ func HandleTar(bundle TarBundle, path string, info os.FileInfo, crypter Crypter)
 			if wasInBase && (time.Equal(bf.MTime)) {
 				// File was not changed since previous backup
 
-				fmt.Println("Skiped due to unchanged modification time")
+				infoln("Skiped due to unchanged modification time")
 				bundle.GetFiles().Store(hdr.Name, BackupFileDescription{IsSkipped: true, IsIncremented: false, MTime: time})
 
 			} else {
@@ -99,9 +118,13 @@ func HandleTar(bundle TarBundle, path string, info os.FileInfo, crypter Crypter)
 						return errors.Wrapf(err, "HandleTar: failed to open file '%s'\n", path)
 					}
 
+					var holes []FileHole
+					if file, isFile := f.(*os.File); isFile && !isPaged && useSparseFiles() {
+						f, holes, size = readSparseFile(file, size)
+					}
 					hdr.Size = size
 
-					bundle.GetFiles().Store(hdr.Name, BackupFileDescription{IsSkipped: false, IsIncremented: isPaged, MTime: time})
+					bundle.GetFiles().Store(hdr.Name, BackupFileDescription{IsSkipped: false, IsIncremented: isPaged, MTime: time, SparseHoles: holes, Partition: tarBall.Number()})
 
 					err = tarWriter.WriteHeader(hdr)
 					if err != nil {
@@ -123,7 +146,9 @@ func HandleTar(bundle TarBundle, path string, info os.FileInfo, crypter Crypter)
 					}
 
 					tarBall.AddSize(hdr.Size)
+					bundle.AddUncompressedSize(hdr.Size)
 					f.Close()
+					dropReadFileCache(path)
 					return nil
 				}
 
@@ -156,8 +181,8 @@ func HandleTar(bundle TarBundle, path string, info os.FileInfo, crypter Crypter)
 			return errors.Wrap(err, "HandleTar: failed to grab header info")
 		}
 
-		hdr.Name = strings.TrimPrefix(path, tarBall.Trim())
-		fmt.Println(hdr.Name)
+		hdr.Name = tarMemberName(path, tarBall.Trim())
+		infoln(hdr.Name)
 
 		err = tarWriter.WriteHeader(hdr)
 		if err != nil {
@@ -168,3 +193,57 @@ func HandleTar(bundle TarBundle, path string, info os.FileInfo, crypter Crypter)
 
 	return nil
 }
+
+// handleSymlink archives symlink according to its kind. Symlinked excluded directories, like pg_wal moved to
+// another disk, are archived as empty directories, PostgreSQL does not start without them. Tablespace symlinks
+// are preserved and their targets are recorded in the sentinel. Other symlinks are preserved if they point
+// inside PGDATA and skipped otherwise, files outside PGDATA are not part of the backup.
+func handleSymlink(bundle TarBundle, tarWriter *tar.Writer, pgdata string, path string, info os.FileInfo) error {
+	name := tarMemberName(path, pgdata)
+	target, err := os.Readlink(path)
+	if err != nil {
+		return errors.Wrapf(err, "handleSymlink: failed to read symlink %s", path)
+	}
+
+	var hdr *tar.Header
+	_, excluded := EXCLUDE[info.Name()]
+	if excluded {
+		targetInfo, err := os.Stat(path)
+		if err != nil || !targetInfo.IsDir() {
+			return nil
+		}
+		hdr = &tar.Header{Name: name, Typeflag: tar.TypeDir, Mode: int64(targetInfo.Mode().Perm()), ModTime: targetInfo.ModTime()}
+	} else {
+		absoluteTarget := target
+		if !filepath.IsAbs(target) {
+			absoluteTarget = filepath.Join(filepath.Dir(path), target)
+		}
+		isTablespace := filepath.Base(filepath.Dir(path)) == "pg_tblspc"
+		if !isTablespace && !isInDirectory(absoluteTarget, pgdata) {
+			log.Printf("WARNING! Symlink %s points outside of PGDATA to %s, it is not included in the backup\n", name, target)
+			return nil
+		}
+		hdr, err = tar.FileInfoHeader(info, target)
+		if err != nil {
+			return errors.Wrap(err, "handleSymlink: could not grab header info")
+		}
+		hdr.Name = name
+		if isTablespace {
+			bundle.AddTablespace(name, target)
+		}
+	}
+
+	infoln(hdr.Name)
+	err = tarWriter.WriteHeader(hdr)
+	return errors.Wrap(err, "handleSymlink: failed to write header")
+}
+
+func isInDirectory(path string, directory string) bool {
+	relative, err := filepath.Rel(directory, path)
+	return err == nil && relative != ".." && !strings.HasPrefix(relative, ".."+string(filepath.Separator))
+}
+
+// tarMemberName names file in tar relative to PGDATA, tar names are separated with slashes on any OS
+func tarMemberName(path string, pgdata string) string {
+	return filepath.ToSlash(strings.TrimPrefix(path, pgdata))
+}
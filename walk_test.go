@@ -362,15 +362,14 @@ func TestWalk(t *testing.T) {
 		t.Errorf("walk: Sentinel expected %s but got %s", "pg_control", sen)
 	}
 
-	err = bundle.HandleSentinel()
+	pgControl, err := bundle.PgControlFile()
+	if err != nil {
+		t.Errorf("walk: Sentinel expected to succeed but got %+v\n", err)
+	}
+	err = bundle.UploadMetadataFiles(pgControl)
 	if err != nil {
 		t.Errorf("walk: Sentinel expected to succeed but got %+v\n", err)
 	}
-
-	// err = bundle.HandleLabelFiles("backup", "table")
-	// if err != nil {
-	// 	t.Errorf("walk: Sentinel expected to succeed but got %+v\n", err)
-	// }
 
 	// Extracts compressed directory to `extracted`.
 	extracted := extract(t, compressed)
@@ -396,3 +395,72 @@ func TestWalk(t *testing.T) {
 		t.Logf("%+v\n", err)
 	}
 }
+
+func TestWalkSymlinks(t *testing.T) {
+	root, err := ioutil.TempDir("", "symlinks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	data := filepath.Join(root, "data")
+	for _, dir := range []string{"base", "pg_tblspc", "wal", "tablespace"} {
+		target := data
+		if dir == "wal" || dir == "tablespace" {
+			target = root
+		}
+		if err = os.MkdirAll(filepath.Join(target, dir), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"pg_wal":          filepath.Join(root, "wal"),
+		"pg_tblspc/16384": filepath.Join(root, "tablespace"),
+		"base/internal":   "../pg_tblspc",
+		"external":        filepath.Join(root, "wal"),
+	}
+	for name, target := range links {
+		if err = os.Symlink(target, filepath.Join(data, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bundle := &walg.Bundle{
+		MinSize: int64(10),
+		Files:   &sync.Map{},
+	}
+	compressed := filepath.Join(root, "compressed")
+	bundle.Tbm = &tools.FileTarBallMaker{
+		BaseDir: filepath.Base(data),
+		Trim:    data,
+		Out:     compressed,
+	}
+	os.MkdirAll(compressed, 0766)
+	bundle.StartQueue()
+	if err = filepath.Walk(data, bundle.TarWalker); err != nil {
+		t.Fatal(err)
+	}
+	if err = bundle.FinishQueue(); err != nil {
+		t.Fatal(err)
+	}
+	if err = bundle.Tb.Finish(&walg.S3TarBallSentinelDto{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if target := bundle.GetTablespaces()["/pg_tblspc/16384"]; target != links["pg_tblspc/16384"] {
+		t.Errorf("tablespace target was recorded as '%v'", target)
+	}
+
+	extracted := extract(t, compressed)
+	defer os.RemoveAll(extracted)
+	if info, err := os.Lstat(filepath.Join(extracted, "pg_wal")); err != nil || !info.IsDir() {
+		t.Errorf("symlinked pg_wal must be restored as directory")
+	}
+	for _, name := range []string{"pg_tblspc/16384", "base/internal"} {
+		if target, err := os.Readlink(filepath.Join(extracted, name)); err != nil || target != links[name] {
+			t.Errorf("symlink %v was restored to '%v' %v", name, target, err)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(extracted, "external")); !os.IsNotExist(err) {
+		t.Errorf("symlink outside of PGDATA must be skipped")
+	}
+}